@@ -0,0 +1,162 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/chainguard-dev/go-apk/pkg/secdb"
+)
+
+func runCheck(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("check", flag.ContinueOnError)
+	if err := parseFlags(fset, "", args); err != nil {
+		return err
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	checks, err := a.CheckRepositories(ctx)
+	if err != nil {
+		return fmt.Errorf("check: %w", err)
+	}
+	var failed int
+	for _, c := range checks {
+		if !g.json {
+			fmt.Println(c)
+		}
+		if !c.OK() {
+			failed++
+		}
+	}
+	if g.json {
+		if err := apk.WriteReport(os.Stdout, apk.ReportRepositoryChecks, checks); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("check: %d of %d repositories failed", failed, len(checks))
+	}
+	return nil
+}
+
+func runValidate(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("validate", flag.ContinueOnError)
+	if err := parseFlags(fset, "", args); err != nil {
+		return err
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	problems, err := a.Validate(ctx)
+	if err != nil {
+		return fmt.Errorf("validate: %w", err)
+	}
+	if g.json {
+		if err := apk.WriteReport(os.Stdout, apk.ReportValidation, problems); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("validate: %d problems", len(problems))
+	}
+	return nil
+}
+
+func runAudit(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("audit", flag.ContinueOnError)
+	var urls stringList
+	fset.Var(&urls, "secdb", "URL or path of a security database to check against, instead of those of the repositories of the root (may be repeated)")
+	fix := fset.Bool("fix", false, "first upgrade the vulnerable packages to the earliest versions that fix them, and nothing else")
+	if err := parseFlags(fset, "[-fix] [-secdb url]...", args); err != nil {
+		return err
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	if len(urls) == 0 {
+		repos, err := a.GetRepositories()
+		if err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+		for _, repo := range repos {
+			if u, ok := secdb.URLForRepository(repo); ok {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) == 0 {
+			return errors.New("audit: no security database for the repositories of the root, give them with -secdb")
+		}
+	}
+	dbs := make([]*secdb.Database, 0, len(urls))
+	for _, u := range urls {
+		db, err := secdb.Fetch(ctx, nil, u)
+		if err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+		dbs = append(dbs, db)
+	}
+	if *fix {
+		upgrades, err := secdb.SuggestSecurityUpgrades(ctx, a, dbs...)
+		if err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+		for _, u := range upgrades {
+			fmt.Fprintln(os.Stderr, u)
+		}
+		if err := secdb.ApplySecurityUpgrades(ctx, a, upgrades, g.sourceDateEpoch()); err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	pkgs := make([]*repository.Package, len(installed))
+	for i, pkg := range installed {
+		pkgs[i] = &pkg.Package
+	}
+	vulns, err := secdb.Match(pkgs, dbs...)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	if g.json {
+		if err := apk.WriteReport(os.Stdout, apk.ReportVulnerabilities, vulns); err != nil {
+			return err
+		}
+	} else {
+		for _, v := range vulns {
+			fmt.Println(v)
+		}
+	}
+	if len(vulns) > 0 {
+		return fmt.Errorf("audit: %d fixable vulnerabilities in the installed packages", len(vulns))
+	}
+	return nil
+}
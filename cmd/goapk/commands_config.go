@@ -0,0 +1,72 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+func runConfig(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("config", flag.ContinueOnError)
+	if err := parseFlags(fset, "", args); err != nil {
+		return err
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	cfg, err := a.Config()
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if g.json {
+		return apk.WriteReport(os.Stdout, apk.ReportConfig, []apk.Config{cfg})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cfg)
+}
+
+func runSign(_ context.Context, _ *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("sign", flag.ContinueOnError)
+	key := fset.String("key", "", "RSA private key to sign with, whose public key is key.pub")
+	output := fset.String("o", "", "file to write the signature to; <file>.sig if empty")
+	if err := parseFlags(fset, "-key key [-o file] <file>", args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 || *key == "" {
+		return errors.New("sign: expected -key and a single file")
+	}
+	name := fset.Arg(0)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	sig, err := apk.SignFile(data, *key, "")
+	if err != nil {
+		return fmt.Errorf("sign: %w", err)
+	}
+	if *output == "" {
+		*output = name + ".sig"
+	}
+	return os.WriteFile(*output, sig, 0o644)
+}
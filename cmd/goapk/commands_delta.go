@@ -0,0 +1,75 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+func runDelta(ctx context.Context, _ *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("delta", flag.ContinueOnError)
+	dir := fset.String("o", "", "directory to write the delta to; the directory of the new package if empty")
+	if err := parseFlags(fset, "[-o dir] <old.apk> <new.apk>", args); err != nil {
+		return err
+	}
+	if fset.NArg() != 2 {
+		return errors.New("delta: an old and a new package must be given")
+	}
+	oldName, newName := fset.Arg(0), fset.Arg(1)
+	oldPkg, err := readPackage(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	newPkg, err := readPackage(ctx, newName)
+	if err != nil {
+		return err
+	}
+	if oldPkg.Name != newPkg.Name {
+		return fmt.Errorf("delta: %s and %s are different packages", oldPkg.Name, newPkg.Name)
+	}
+	oldAPK, err := os.ReadFile(oldName)
+	if err != nil {
+		return err
+	}
+	newAPK, err := os.ReadFile(newName)
+	if err != nil {
+		return err
+	}
+
+	var delta bytes.Buffer
+	if err := apk.WriteDelta(&delta, oldAPK, newAPK); err != nil {
+		return fmt.Errorf("delta: %w", err)
+	}
+	if *dir == "" {
+		*dir = filepath.Dir(newName)
+	}
+	// DeltaURL of a package without a repository is relative
+	out := filepath.Join(*dir, apk.DeltaURL(repository.NewRepositoryPackage(newPkg, nil), oldPkg.Version))
+	if err := os.WriteFile(out, delta.Bytes(), 0o644); err != nil { //nolint:gosec // the delta is to be published
+		return err
+	}
+	fmt.Printf("%s (%d bytes, %d%% of %s)\n", out, delta.Len(), 100*delta.Len()/len(newAPK), filepath.Base(newName))
+	return nil
+}
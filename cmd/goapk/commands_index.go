@@ -0,0 +1,246 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+func runIndex(ctx context.Context, _ *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("index", flag.ContinueOnError)
+	output := fset.String("o", "APKINDEX.tar.gz", "file to write the index to")
+	description := fset.String("d", "", "description of the index")
+	signingKey := fset.String("sign", "", "private key to sign the index with")
+	shards := fset.Int("shards", 0, "also write a sharded index of this many shards next to the index")
+	update := fset.Bool("update", false, "add the packages to the index there is, instead of writing it from the packages given alone")
+	var remove stringList
+	fset.Var(&remove, "remove", "with -update, remove the package from the index, by name or as name-version (may be repeated)")
+	if err := parseFlags(fset, "[-o file] [-d description] [-sign key] [-shards n] [-update [-remove package]...] <file.apk>...", args); err != nil {
+		return err
+	}
+	if fset.NArg() == 0 && len(remove) == 0 {
+		return errors.New("index: no packages given")
+	}
+	if len(remove) > 0 && !*update {
+		return errors.New("index: -remove needs -update")
+	}
+	if *update && *shards != 0 {
+		return errors.New("index: -update cannot write a sharded index")
+	}
+	var pkgs []*repository.Package
+	for _, name := range fset.Args() {
+		pkg, err := readPackage(ctx, name)
+		if err != nil {
+			return err
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	if *update {
+		return apk.UpdateIndexFile(ctx, *output, *description, *signingKey, pkgs, remove...)
+	}
+	if err := writeIndex(ctx, *output, *description, *signingKey, pkgs); err != nil {
+		return err
+	}
+	if *shards == 0 {
+		return nil
+	}
+	files, err := apk.WriteShardedIndex(filepath.Dir(*output), *description, pkgs, *shards)
+	if err != nil {
+		return err
+	}
+	if *signingKey == "" {
+		return nil
+	}
+	for _, file := range files {
+		if err := signature.SignIndex(ctx, logrus.New(), *signingKey, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPackage returns the index entry for the .apk file.
+func readPackage(ctx context.Context, name string) (*repository.Package, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	exp, err := apk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", name, err)
+	}
+	defer exp.Close()
+	pkg, err := exp.PackageInfo()
+	if err != nil {
+		return nil, fmt.Errorf("reading .PKGINFO of %s: %w", name, err)
+	}
+	pkg.Size = uint64(fi.Size())
+	return pkg, nil
+}
+
+// writeIndex writes the packages as an APKINDEX.tar.gz to the file, signing it if a key is given.
+func writeIndex(ctx context.Context, file, description, signingKey string, pkgs []*repository.Package) (err error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+	if err := apk.WriteIndexArchive(f, description, pkgs); err != nil {
+		return err
+	}
+
+	if signingKey == "" {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return signature.SignIndex(ctx, logrus.New(), signingKey, file)
+}
+
+func runVerify(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("verify", flag.ContinueOnError)
+	keysDir := fset.String("keys-dir", "", "directory of trusted public keys (default <root>/etc/apk/keys)")
+	if err := parseFlags(fset, "[-keys-dir dir] <file.apk|url>...", args); err != nil {
+		return err
+	}
+	if fset.NArg() == 0 {
+		return errors.New("verify: no packages given")
+	}
+	if *keysDir == "" {
+		*keysDir = filepath.Join(g.root, g.installRoot, "etc", "apk", "keys")
+	}
+	keys, err := readKeys(*keysDir)
+	if err != nil {
+		return err
+	}
+	var failed int
+	verifications := make([]apk.PackageVerification, 0, fset.NArg())
+	for _, source := range fset.Args() {
+		v := apk.VerifyPackage(ctx, source, keys, nil)
+		var untrusted *apk.UntrustedPackageError
+		if g.allowUntrusted && errors.As(v.SignatureErr, &untrusted) {
+			v.SignatureErr = nil
+		}
+		if !v.OK() {
+			failed++
+		}
+		if !g.json {
+			fmt.Println(v)
+		}
+		verifications = append(verifications, v)
+	}
+	if g.json {
+		if err := apk.WriteReport(os.Stdout, apk.ReportVerifications, verifications); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("verify: %d of %d packages failed", failed, fset.NArg())
+	}
+	return nil
+}
+
+func runPublish(ctx context.Context, _ *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("publish", flag.ContinueOnError)
+	dir := fset.String("dir", "", "top of the tree of repositories to publish to, as <dir>/<branch>/<repo>/<arch>")
+	branch := fset.String("branch", "edge", "branch to publish to, such as v3.18")
+	repo := fset.String("repo", "main", "repository of the branch to publish to")
+	description := fset.String("d", "", "description of the indexes (default <branch>/<repo>)")
+	signingKey := fset.String("sign", "", "private key to sign the indexes with")
+	keysDir := fset.String("keys-dir", "", "directory of public keys the packages must be signed with; not verified if empty")
+	var remove stringList
+	fset.Var(&remove, "remove", "remove the package from the repository first, by name or as name-version (may be repeated)")
+	if err := parseFlags(fset, "-dir dir [-branch branch] [-repo repo] [-d description] [-sign key] [-keys-dir dir] [-remove package]... <file.apk>...", args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("publish: no -dir given")
+	}
+	if fset.NArg() == 0 && len(remove) == 0 {
+		return errors.New("publish: no packages given")
+	}
+	p := &apk.Publisher{Dir: *dir, SigningKey: *signingKey, Description: *description}
+	if *keysDir != "" {
+		keys, err := readKeys(*keysDir)
+		if err != nil {
+			return err
+		}
+		p.Keys = keys
+	}
+	var indexes []string
+	if len(remove) > 0 {
+		removed, err := p.Remove(ctx, *branch, *repo, remove...)
+		if err != nil {
+			return err
+		}
+		indexes = append(indexes, removed...)
+	}
+	if fset.NArg() > 0 {
+		published, err := p.Publish(ctx, *branch, *repo, fset.Args()...)
+		if err != nil {
+			return err
+		}
+		indexes = append(indexes, published...)
+	}
+	seen := map[string]bool{}
+	for _, index := range indexes {
+		if !seen[index] {
+			seen[index] = true
+			fmt.Println(index)
+		}
+	}
+	return nil
+}
+
+// readKeys returns the keys in the directory by name, or none if it does not exist.
+func readKeys(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	keys := map[string][]byte{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		keys[e.Name()] = b
+	}
+	return keys, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+func runMirror(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("mirror", flag.ContinueOnError)
+	dir := fset.String("o", ".", "directory to mirror to; packages go in <dir>/<arch>")
+	signingKey := fset.String("sign", "", "private key to sign the index with")
+	if err := parseFlags(fset, "[-o dir] [-sign key] <package>...", args); err != nil {
+		return err
+	}
+	if fset.NArg() == 0 {
+		return errors.New("mirror: no packages given")
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	indexes, err := g.indexes(ctx, a)
+	if err != nil {
+		return err
+	}
+	pkgs, _, err := apk.NewPkgResolver(ctx, indexes).GetPackagesWithDependencies(ctx, fset.Args())
+	if err != nil {
+		return fmt.Errorf("mirror: %w", err)
+	}
+
+	archDir := filepath.Join(*dir, g.arch)
+	if err := os.MkdirAll(archDir, 0o755); err != nil {
+		return err
+	}
+	index := make([]*repository.Package, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		if err := mirrorPackage(ctx, a, pkg, archDir); err != nil {
+			return fmt.Errorf("mirror: %s: %w", pkg.Name, err)
+		}
+		index = append(index, pkg.Package)
+		fmt.Println(pkg.Filename())
+	}
+	return writeIndex(ctx, filepath.Join(archDir, "APKINDEX.tar.gz"), "", *signingKey, index)
+}
+
+func mirrorPackage(ctx context.Context, a *apk.APK, pkg *repository.RepositoryPackage, dir string) (err error) {
+	rc, err := a.FetchPackage(ctx, pkg)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(filepath.Join(dir, pkg.Filename()))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+	_, err = io.Copy(f, rc)
+	return err
+}
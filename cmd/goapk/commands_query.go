@@ -0,0 +1,260 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+func runSearch(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("search", flag.ContinueOnError)
+	all := fset.Bool("a", false, "list every version, not only the latest of each package")
+	exact := fset.Bool("x", false, "match exactly instead of as a glob")
+	regex := fset.Bool("r", false, "match as a regular expression instead of as a glob")
+	description := fset.Bool("d", false, "match the descriptions instead of the names and provides")
+	origin := fset.Bool("o", false, "list one package per origin")
+	commit := fset.Bool("c", false, "match the commits the packages were built from instead of the names and provides")
+	if err := parseFlags(fset, "[-a] [-x|-r] [-d|-c] [-o] <pattern>...", args); err != nil {
+		return err
+	}
+	patterns := fset.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	options := []apk.SearchOption{apk.WithSearchAllVersions(*all), apk.WithSearchOrigin(*origin)}
+	switch {
+	case *exact && *regex:
+		return errors.New("search: -x and -r are mutually exclusive")
+	case *exact:
+		options = append(options, apk.WithSearchMatch(apk.SearchExact))
+	case *regex:
+		options = append(options, apk.WithSearchMatch(apk.SearchRegex))
+	}
+	switch {
+	case *description && *commit:
+		return errors.New("search: -d and -c are mutually exclusive")
+	case *description:
+		options = append(options, apk.WithSearchFields(apk.SearchDescription))
+	case *commit:
+		options = append(options, apk.WithSearchFields(apk.SearchCommit))
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	indexes, err := g.indexes(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	seen := map[*repository.Package]bool{}
+	var found []*apk.PackageInfo
+	for _, pattern := range patterns {
+		pkgs, err := apk.SearchIndexes(indexes, pattern, options...)
+		if err != nil {
+			return fmt.Errorf("search: %w", err)
+		}
+		for _, pkg := range pkgs {
+			if seen[pkg.Package] {
+				continue
+			}
+			seen[pkg.Package] = true
+			if g.json {
+				found = append(found, &apk.PackageInfo{Package: *pkg.Package, Repository: pkg.Repository().Uri})
+				continue
+			}
+			fmt.Printf("%s-%s\n", pkg.Name, pkg.Version)
+		}
+	}
+	if g.json {
+		return apk.WriteReport(os.Stdout, apk.ReportPackages, found)
+	}
+	return nil
+}
+
+func runInfo(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("info", flag.ContinueOnError)
+	contents := fset.Bool("L", false, "list the contents of the package, if known")
+	if err := parseFlags(fset, "[-L] <package>...", args); err != nil {
+		return err
+	}
+	if fset.NArg() == 0 {
+		return errors.New("info: no packages given")
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	var infos []*apk.PackageInfo
+	for i, name := range fset.Args() {
+		info, err := a.Info(ctx, name)
+		if err != nil {
+			return fmt.Errorf("info: %w", err)
+		}
+		if g.json {
+			if !*contents {
+				info.Contents = nil
+			}
+			infos = append(infos, info)
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		printInfo(info, *contents)
+	}
+	if g.json {
+		return apk.WriteReport(os.Stdout, apk.ReportPackages, infos)
+	}
+	return nil
+}
+
+func printInfo(info *apk.PackageInfo, contents bool) {
+	fmt.Printf("%s-%s\n", info.Name, info.Version)
+	for _, field := range []struct{ name, value string }{
+		{"description", info.Description},
+		{"webpage", info.URL},
+		{"license", info.License},
+		{"origin", info.Origin},
+		{"maintainer", info.Maintainer},
+		{"commit", info.RepoCommit},
+		{"repository", info.Repository},
+		{"installed size", fmt.Sprint(info.InstalledSize)},
+		{"depends", strings.Join(info.Dependencies, " ")},
+		{"provides", strings.Join(info.Provides, " ")},
+		{"install_if", strings.Join(info.InstallIf, " ")},
+		{"replaces", info.Replaces},
+		{"triggers", strings.Join(info.Triggers, " ")},
+		{"installed", fmt.Sprint(info.Installed)},
+	} {
+		if field.value != "" {
+			fmt.Printf("%s: %s\n", field.name, field.value)
+		}
+	}
+	if contents {
+		for _, path := range info.Contents {
+			fmt.Println(path)
+		}
+	}
+}
+
+func runWhy(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("why", flag.ContinueOnError)
+	if err := parseFlags(fset, "<package>", args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		return errors.New("why: one package must be given")
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	chains, err := a.Why(ctx, fset.Arg(0))
+	if err != nil {
+		return fmt.Errorf("why: %w", err)
+	}
+	if len(chains) == 0 {
+		fmt.Printf("%s is not required by the world\n", fset.Arg(0))
+	}
+	for _, chain := range chains {
+		fmt.Println(strings.Join(chain, " -> "))
+	}
+	return nil
+}
+
+func runSonames(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("sonames", flag.ContinueOnError)
+	add := fset.Bool("add", false, "add the packages that provide the libraries to the world, and install them")
+	if err := parseFlags(fset, "[-add] <path>...", args); err != nil {
+		return err
+	}
+	if fset.NArg() == 0 {
+		return errors.New("sonames: no paths given")
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	// the paths are in the root
+	paths := make([]string, 0, fset.NArg())
+	for _, p := range fset.Args() {
+		if p = strings.TrimPrefix(path.Clean("/"+p), "/"); p == "" {
+			p = "."
+		}
+		paths = append(paths, p)
+	}
+	var providers []apk.SonameProvider
+	if *add {
+		providers, err = a.AddSonamePackages(ctx, g.sourceDateEpoch(), paths...)
+	} else {
+		providers, err = a.SuggestSonamePackages(ctx, paths...)
+	}
+	if g.json && providers != nil {
+		if err := apk.WriteReport(os.Stdout, apk.ReportSonameProviders, providers); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range providers {
+			pkg := p.Package
+			if pkg == "" {
+				pkg = "(no package)"
+			}
+			fmt.Printf("%s: %s, needed by %s\n", p.Soname, pkg, strings.Join(p.Files, " "))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("sonames: %w", err)
+	}
+	return nil
+}
+
+func runVersions(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("versions", flag.ContinueOnError)
+	if err := parseFlags(fset, "<package>", args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		return errors.New("versions: one package must be given")
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	versions, err := a.Versions(ctx, fset.Arg(0))
+	if err != nil {
+		return fmt.Errorf("versions: %w", err)
+	}
+	if len(versions) == 0 && !g.json {
+		return fmt.Errorf("versions: %s is not in the repositories", fset.Arg(0))
+	}
+	if g.json {
+		return apk.WriteReport(os.Stdout, apk.ReportVersions, versions)
+	}
+	for _, v := range versions {
+		fmt.Println(v)
+	}
+	return nil
+}
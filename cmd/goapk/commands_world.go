@@ -0,0 +1,91 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+)
+
+func runAdd(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("add", flag.ContinueOnError)
+	if err := parseFlags(fset, "<package|file.apk>...", args); err != nil {
+		return err
+	}
+	if fset.NArg() == 0 {
+		return errors.New("add: no packages given")
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	// as with apk-tools, paths of .apk files are installed as they are
+	var names, local []string
+	for _, arg := range fset.Args() {
+		if strings.HasSuffix(arg, ".apk") {
+			if _, err := os.Stat(arg); err == nil {
+				local = append(local, arg)
+				continue
+			}
+		}
+		names = append(names, arg)
+	}
+	if len(local) == 0 {
+		return a.UpdateWorld(ctx, names, nil, g.sourceDateEpoch())
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return err
+	}
+	if err := a.SetWorld(append(world, names...)); err != nil {
+		return err
+	}
+	for _, p := range local {
+		if err := a.InstallLocalPackage(ctx, p, g.sourceDateEpoch()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runDel(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("del", flag.ContinueOnError)
+	if err := parseFlags(fset, "<package>...", args); err != nil {
+		return err
+	}
+	if fset.NArg() == 0 {
+		return errors.New("del: no packages given")
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	return a.DeletePackages(ctx, fset.Args()...)
+}
+
+func runUpgrade(ctx context.Context, g *globalFlags, args []string) error {
+	fset := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	if err := parseFlags(fset, "", args); err != nil {
+		return err
+	}
+	a, err := g.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	return a.UpgradeWorld(ctx, g.sourceDateEpoch())
+}
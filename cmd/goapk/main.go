@@ -0,0 +1,452 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command goapk is a small apk client built on github.com/chainguard-dev/go-apk. It is a
+// demonstration of the library, and a static replacement for apk in scratch containers.
+//
+// Usage:
+//
+//	goapk [global flags] <command> [command flags] [args...]
+//
+// Commands:
+//
+//	add       add packages, or .apk files, to the world and install them
+//	del       remove packages from the world, and whatever nothing else needs
+//	upgrade   upgrade the installed packages to the latest versions in the world
+//	search    list the packages in the repositories matching glob patterns
+//	info      show the details of a package
+//	versions  list the versions of a package in the repositories, latest first
+//	why       show the chains of dependencies from the world to an installed package
+//	sonames   list the packages that provide the shared libraries needed by binaries in the root, or add them
+//	index     build an APKINDEX.tar.gz from .apk files
+//	verify    verify the signatures, checksums and datahashes of .apk files or URLs
+//	publish   publish .apk files into a tree of repositories by branch and architecture, with their indexes
+//	mirror    download packages, with their dependencies, into a directory with an index
+//	delta     write the delta from an older version of a package, for a repository to host
+//	check     check that the repositories are reachable, signed, and have valid indexes for the architecture
+//	audit     check the installed packages against security databases, failing if any have fixable vulnerabilities
+//	validate  check the root for broken symlinks, missing shared libraries and dangling alternatives
+//	config    show the effective configuration of the root and flags, as JSON
+//	sign      write the detached signature of a configuration file, for -image-signature
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// globalFlags are the flags accepted before the command.
+type globalFlags struct {
+	root           string
+	installRoot    string
+	arch           string
+	cacheDir       string
+	cacheClone     apkfs.CloneMode
+	repositories   stringList
+	priorities     stringList
+	repoArches     stringList
+	proxies        stringList
+	mirrors        stringList
+	maxIndexAge    time.Duration
+	failStale      bool
+	keys           stringList
+	allowUntrusted bool
+	strict         bool
+	deltas         bool
+	dedup          bool
+	sharded        bool
+	scripts        bool
+	scriptsAllow   stringList
+	scriptsDeny    stringList
+	lintScripts    bool
+	cosignKeys     stringList
+	firstBoot      bool
+	bestEffort     bool
+	epoch          string
+	cleanup        stringList
+	commit         string
+	hosts          stringList
+	caCerts        stringList
+	pinnedCerts    stringList
+	initDB         bool
+	image          string
+	imageSignature string
+	imageKeys      stringList
+	verbose        bool
+	json           bool
+}
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, g *globalFlags, args []string) error
+}
+
+var commands = []command{
+	{"add", "add packages, or .apk files, to the world and install them", runAdd},
+	{"del", "remove packages from the world, and whatever nothing else needs", runDel},
+	{"upgrade", "upgrade the installed packages to the latest versions in the world", runUpgrade},
+	{"search", "list the packages in the repositories matching glob patterns", runSearch},
+	{"info", "show the details of a package", runInfo},
+	{"versions", "list the versions of a package in the repositories, latest first", runVersions},
+	{"why", "show the chains of dependencies from the world to an installed package", runWhy},
+	{"sonames", "list the packages that provide the shared libraries needed by binaries in the root, or add them", runSonames},
+	{"index", "build an APKINDEX.tar.gz from .apk files", runIndex},
+	{"verify", "verify the signatures, checksums and datahashes of .apk files or URLs", runVerify},
+	{"publish", "publish .apk files into a tree of repositories by branch and architecture, with their indexes", runPublish},
+	{"mirror", "download packages, with their dependencies, into a directory with an index", runMirror},
+	{"delta", "write the delta from an older version of a package, for a repository to host", runDelta},
+	{"check", "check that the repositories are reachable, signed, and have valid indexes for the architecture", runCheck},
+	{"audit", "check the installed packages against security databases, failing if any have fixable vulnerabilities", runAudit},
+	{"validate", "check the root for broken symlinks, missing shared libraries and dangling alternatives", runValidate},
+	{"config", "show the effective configuration of the root and flags, as JSON", runConfig},
+	{"sign", "write the detached signature of a configuration file, for -image-signature", runSign},
+}
+
+func main() {
+	if err := run(context.Background(), os.Args[1:], os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "goapk: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stderr io.Writer) error {
+	g := &globalFlags{}
+	fset := flag.NewFlagSet("goapk", flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	fset.StringVar(&g.root, "root", "/", "root directory to manage")
+	fset.StringVar(&g.installRoot, "install-root", "", "install under the directory of the root instead, such as /sysroot, with its own database")
+	fset.StringVar(&g.arch, "arch", apk.ArchToAPK(runtime.GOARCH), "architecture of the packages")
+	fset.StringVar(&g.cacheDir, "cache", "", "directory to cache indexes and packages in; no caching if empty")
+	fset.TextVar(&g.cacheClone, "cache-clone", apkfs.NoClone, "with -cache, install files as reflinks or hardlinks of copies in the cache, when the root is on its filesystem: reflink or hardlink")
+	fset.Var(&g.repositories, "repository", "repository to use, replacing /etc/apk/repositories (may be repeated)")
+	fset.Var(&g.repoArches, "repository-arch", "architecture to fetch a repository for instead of that of the root, as <repository>=<arch>, such as noarch (may be repeated)")
+	fset.Var(&g.priorities, "repository-priority", "priority of a repository, as <repository>=<priority>; higher priority repositories are preferred (may be repeated)")
+	fset.Var(&g.proxies, "repository-proxy", "proxy of a repository, as <repository>=<proxy>, or <repository>=direct to not use the proxy of the environment (may be repeated)")
+	fset.Var(&g.keys, "key", "path or URL of a key to install in /etc/apk/keys (may be repeated)")
+	fset.BoolVar(&g.allowUntrusted, "allow-untrusted", false, "do not verify the signatures of indexes, of .apk files given to add, or of packages given to verify")
+	fset.BoolVar(&g.strict, "strict-indexes", false, "fail on malformed and duplicate entries of indexes, instead of skipping them with a warning")
+	fset.BoolVar(&g.dedup, "dedup", false, "install files of the same content, mode, ownership and time as hardlinks to the first installed, outside of etc/")
+	fset.BoolVar(&g.deltas, "deltas", false, "upgrade cached packages from the deltas of the repositories, where there are any")
+	fset.BoolVar(&g.sharded, "sharded-indexes", false, "fetch only the shards needed of repositories with a sharded index")
+	fset.BoolVar(&g.scripts, "scripts", false, "run the scripts of packages, chrooted into the root in user namespaces (linux only), with qemu-user through binfmt_misc for other architectures than the host's")
+	fset.Var(&g.scriptsAllow, "scripts-allow", "with -scripts, only run the scripts of packages matching the pattern (may be repeated)")
+	fset.Var(&g.scriptsDeny, "scripts-deny", "with -scripts, never run the scripts of packages matching the pattern (may be repeated)")
+	fset.BoolVar(&g.lintScripts, "lint-scripts", false, "refuse to install packages whose scripts fetch from the network, pipe to a shell or make files writable by everyone")
+	fset.Var(&g.cosignKeys, "cosign-key", "cosign public key to verify the packages of a repository with, as <repository>=<key>, or <key> for every repository (may be repeated)")
+	fset.BoolVar(&g.firstBoot, "firstboot", false, "write "+apk.FirstBootPath+", to run the scripts that were not run, and the triggers, at the first start of the image")
+	fset.BoolVar(&g.bestEffort, "best-effort", false, "install what can be of the world, leaving out the packages that cannot be resolved or fetched, and failing with a list of them")
+	fset.StringVar(&g.epoch, "source-date-epoch", os.Getenv("SOURCE_DATE_EPOCH"), "clamp the times of the files written to the root to the Unix time in seconds, which defaults to $SOURCE_DATE_EPOCH")
+	fset.DurationVar(&g.maxIndexAge, "max-index-age", 0, "warn about repository indexes built longer ago than the duration, such as those of a frozen mirror; 0 checks none")
+	fset.BoolVar(&g.failStale, "fail-stale-indexes", false, "with -max-index-age, fail instead of warning about stale indexes")
+	fset.Var(&g.mirrors, "mirror", "mirror of the Alpine CDN to fetch from instead, if it is the fastest to answer (may be repeated)")
+	fset.Var(&g.cleanup, "cleanup", "cleanup policy to apply after installing: none, cache, docs or locales (may be repeated)")
+	fset.StringVar(&g.commit, "commit", "", "resolve only from the packages built from the commit, abbreviated to at least 7 characters")
+	fset.Var(&g.hosts, "add-host", "connect to the address instead for the host, as <host>=<address> (may be repeated)")
+	fset.Var(&g.caCerts, "cacert", "PEM file of CA certificates to verify repositories with, instead of the system's (may be repeated)")
+	fset.Var(&g.pinnedCerts, "pin-cert", "SHA-256 fingerprint of a certificate that repositories must have in their chain (may be repeated)")
+	fset.StringVar(&g.image, "image", "", "apko image configuration to set the repositories, keyring and world from")
+	fset.StringVar(&g.imageSignature, "image-signature", "", "detached signature of the -image configuration, as written by the sign command, to verify before using it")
+	fset.Var(&g.imageKeys, "image-key", "public key to verify -image-signature with, instead of the keys trusted by the root (may be repeated)")
+	fset.BoolVar(&g.initDB, "initdb", false, "initialize the apk database in the root first")
+	fset.BoolVar(&g.verbose, "v", false, "log what is being done, every HTTP request, and how long installing each package took")
+	fset.BoolVar(&g.json, "json", false, "write the output of audit, check, config, info, search, sonames, validate and versions as a versioned JSON report")
+	fset.Usage = func() {
+		fmt.Fprintf(stderr, "usage: goapk [flags] <command> [args...]\n\ncommands:\n")
+		for _, c := range commands {
+			fmt.Fprintf(stderr, "  %-8s  %s\n", c.name, c.summary)
+		}
+		fmt.Fprintf(stderr, "\nflags:\n")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fset.NArg() == 0 {
+		fset.Usage()
+		return errors.New("no command given")
+	}
+	name, rest := fset.Arg(0), fset.Args()[1:]
+	for _, c := range commands {
+		if c.name == name {
+			return c.run(ctx, g, rest)
+		}
+	}
+	fset.Usage()
+	return fmt.Errorf("unknown command %q", name)
+}
+
+// newAPK returns an APK for the root, applying the global flags: initializing the database,
+// installing keys and setting the repositories, as requested.
+func (g *globalFlags) newAPK(ctx context.Context) (*apk.APK, error) {
+	log := logrus.New()
+	log.SetOutput(os.Stderr)
+	log.SetLevel(logrus.WarnLevel)
+	if g.verbose {
+		log.SetLevel(logrus.DebugLevel)
+	}
+
+	options := []apk.Option{
+		apk.WithFS(apkfs.DirFS(g.root)),
+		apk.WithArch(g.arch),
+		apk.WithLogger(log),
+		apk.WithIgnoreMknodErrors(os.Getuid() != 0),
+		apk.WithStrictIndexes(g.strict),
+		apk.WithDeltas(g.deltas),
+		apk.WithDedup(g.dedup),
+		apk.WithShardedIndexes(g.sharded),
+		apk.WithFirstBoot(g.firstBoot),
+		apk.WithBestEffort(g.bestEffort),
+		apk.WithInstallRoot(g.installRoot),
+		apk.WithAllowUntrusted(g.allowUntrusted),
+		apk.WithRepoCommit(g.commit),
+		apk.WithFetchTracing(g.verbose),
+		apk.WithMaxIndexAge(g.maxIndexAge, g.failStale),
+	}
+	if g.verbose {
+		options = append(options, apk.WithInstallReportHandler(func(report *apk.InstallReport) {
+			for _, p := range report.Packages {
+				log.Debugf("%s-%s: fetch %s, verify %s, extract %s", p.Name, p.Version, p.Fetch.Round(time.Millisecond), p.Verify.Round(time.Millisecond), p.Extract.Round(time.Millisecond))
+			}
+			log.Debugf("installed %d packages in %s: fetch %s, verify %s, extract %s", len(report.Packages), report.Total.Round(time.Millisecond),
+				report.Fetch.Round(time.Millisecond), report.Verify.Round(time.Millisecond), report.Extract.Round(time.Millisecond))
+		}))
+	}
+	if len(g.mirrors) > 0 {
+		options = append(options, apk.WithMirrorSelection(apk.MirrorSelection{Mirrors: g.mirrors}))
+	}
+	epoch, err := g.parseEpoch()
+	if err != nil {
+		return nil, err
+	}
+	if epoch != nil {
+		options = append(options, apk.WithTimestampOverride(*epoch))
+	}
+	if g.cacheDir != "" {
+		options = append(options, apk.WithCache(g.cacheDir, false), apk.WithCacheClone(g.cacheClone))
+	}
+	if len(g.caCerts) > 0 {
+		pool := x509.NewCertPool()
+		for _, name := range g.caCerts {
+			b, err := os.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("no certificates in %s", name)
+			}
+		}
+		options = append(options, apk.WithRootCAs(pool))
+	}
+	if len(g.pinnedCerts) > 0 {
+		options = append(options, apk.WithPinnedCerts(g.pinnedCerts...))
+	}
+	if len(g.hosts) > 0 {
+		hosts, err := apk.ParseHosts(g.hosts)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, apk.WithHosts(hosts))
+	}
+	if g.scripts {
+		// the scripts run chrooted into the install root, which is their /
+		root := filepath.Join(g.root, g.installRoot)
+		options = append(options, apk.WithExecutor(apk.NewEmulatedExecutor(g.arch, root, apk.NewNamespaceExecutor(root))),
+			apk.WithScriptPolicy(apk.ScriptPolicy{Skip: len(g.scriptsAllow) > 0, Allow: g.scriptsAllow, Deny: g.scriptsDeny}))
+	}
+	if g.lintScripts {
+		options = append(options, apk.WithScriptLinter(apk.DefaultScriptRules))
+	}
+	for _, k := range g.cosignKeys {
+		repo, name, ok := strings.Cut(k, "=")
+		if !ok {
+			repo, name = "", k
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, apk.WithPackageVerifier(repo, apk.CosignVerifier{PublicKey: b}))
+	}
+	for _, name := range g.cleanup {
+		policy, err := apk.CleanupPolicyByName(name)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, apk.WithCleanup(policy))
+	}
+	if len(g.proxies) > 0 {
+		proxies := map[string]string{}
+		for _, p := range g.proxies {
+			repo, proxy, ok := strings.Cut(p, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid repository proxy %q, expected <repository>=<proxy>", p)
+			}
+			proxies[repo] = proxy
+		}
+		options = append(options, apk.WithRepositoryProxies(proxies))
+	}
+	if len(g.priorities) > 0 {
+		priorities := map[string]int{}
+		for _, p := range g.priorities {
+			repo, priority, ok := strings.Cut(p, "=")
+			n, err := strconv.Atoi(priority)
+			if !ok || err != nil {
+				return nil, fmt.Errorf("invalid repository priority %q, expected <repository>=<priority>", p)
+			}
+			priorities[repo] = n
+		}
+		options = append(options, apk.WithRepositoryPriorities(priorities))
+	}
+	if len(g.repoArches) > 0 {
+		arches := map[string]string{}
+		for _, p := range g.repoArches {
+			repo, arch, ok := strings.Cut(p, "=")
+			if !ok || arch == "" {
+				return nil, fmt.Errorf("invalid repository architecture %q, expected <repository>=<arch>", p)
+			}
+			arches[repo] = arch
+		}
+		options = append(options, apk.WithRepositoryArches(arches))
+	}
+	a, err := apk.New(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.initDB {
+		if err := a.InitDB(ctx); err != nil {
+			return nil, fmt.Errorf("initializing database: %w", err)
+		}
+	}
+	if len(g.keys) > 0 {
+		if err := a.InitKeyring(ctx, g.keys, nil); err != nil {
+			return nil, fmt.Errorf("installing keys: %w", err)
+		}
+	}
+	if g.image != "" {
+		contents, err := g.imageContents(ctx, a)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", g.image, err)
+		}
+		if err := a.ApplyImageContents(ctx, contents); err != nil {
+			return nil, fmt.Errorf("%s: %w", g.image, err)
+		}
+	}
+	if len(g.repositories) > 0 {
+		if err := a.SetRepositories(g.repositories); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// parseEpoch returns the time of -source-date-epoch, which defaults to $SOURCE_DATE_EPOCH, or nil if
+// it is not set.
+func (g *globalFlags) parseEpoch() (*time.Time, error) {
+	if g.epoch == "" {
+		return nil, nil
+	}
+	sec, err := strconv.ParseInt(g.epoch, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source date epoch %q: %w", g.epoch, err)
+	}
+	t := time.Unix(sec, 0).UTC()
+	return &t, nil
+}
+
+// sourceDateEpoch returns the time of -source-date-epoch, if it is set, for reproducible installs.
+// newAPK has already failed if it is not a valid time.
+func (g *globalFlags) sourceDateEpoch() *time.Time {
+	t, _ := g.parseEpoch()
+	return t
+}
+
+// imageContents reads the contents of the -image configuration, verifying it first with
+// -image-signature, if given.
+func (g *globalFlags) imageContents(ctx context.Context, a *apk.APK) (*apk.ImageContents, error) {
+	data, err := os.ReadFile(g.image)
+	if err != nil {
+		return nil, err
+	}
+	if g.imageSignature == "" {
+		return apk.LoadImageContents(bytes.NewReader(data))
+	}
+	sig, err := os.ReadFile(g.imageSignature)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string][]byte{}
+	for _, name := range g.imageKeys {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		keys[filepath.Base(name)] = b
+	}
+	if len(g.imageKeys) == 0 {
+		if keys, err = a.TrustedKeys(ctx); err != nil {
+			return nil, fmt.Errorf("loading trusted keys: %w", err)
+		}
+	}
+	contents, _, err := apk.LoadSignedImageContents(data, sig, apk.RSAFileVerifier(keys))
+	return contents, err
+}
+
+// indexes returns the indexes of the repositories of the root.
+func (g *globalFlags) indexes(ctx context.Context, a *apk.APK) ([]apk.NamedIndex, error) {
+	indexes, err := a.GetRepositoryIndexes(ctx, g.allowUntrusted)
+	if err != nil {
+		return nil, fmt.Errorf("loading repository indexes: %w", err)
+	}
+	return indexes, nil
+}
+
+// parseFlags parses the flags of a command, printing its usage on error.
+func parseFlags(fset *flag.FlagSet, usage string, args []string) error {
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: goapk %s %s\n", fset.Name(), usage)
+		fset.PrintDefaults()
+	}
+	return fset.Parse(args)
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/apktest"
+)
+
+func TestRunFlags(t *testing.T) {
+	ctx := context.Background()
+	var stderr bytes.Buffer
+	require.NoError(t, run(ctx, []string{"-h"}, &stderr))
+	require.Contains(t, stderr.String(), "usage: goapk")
+	require.Contains(t, stderr.String(), "-source-date-epoch")
+
+	require.EqualError(t, run(ctx, nil, io.Discard), "no command given")
+	require.EqualError(t, run(ctx, []string{"-root", t.TempDir()}, io.Discard), "no command given")
+	require.EqualError(t, run(ctx, []string{"frobnicate"}, io.Discard), `unknown command "frobnicate"`)
+	require.Error(t, run(ctx, []string{"-no-such-flag", "add", "hello"}, io.Discard))
+	require.EqualError(t, run(ctx, []string{"add"}, io.Discard), "add: no packages given")
+}
+
+// testRepository writes a signed repository of a hello package, returning its directory and the
+// path of its public key.
+func testRepository(t *testing.T) (dir, pub string) {
+	t.Helper()
+	key, err := apktest.NewKey("test.rsa")
+	require.NoError(t, err)
+	repo := apktest.NewRepository("test", key)
+	_, err = repo.Add(&apktest.Package{
+		Package: repository.Package{Name: "hello", Version: "1.0-r0", Arch: "x86_64"},
+		Files:   map[string]string{"usr/bin/hello": "hello"},
+	})
+	require.NoError(t, err)
+	dir = t.TempDir()
+	require.NoError(t, repo.WriteDir(dir, "x86_64"))
+	keys := t.TempDir()
+	_, err = key.WriteFiles(keys)
+	require.NoError(t, err)
+	return dir, filepath.Join(keys, key.PublicName())
+}
+
+func TestRunAdd(t *testing.T) {
+	ctx := context.Background()
+	dir, pub := testRepository(t)
+	root := t.TempDir()
+	args := []string{"-root", root, "-initdb", "-arch", "x86_64", "-repository", dir, "-key", pub}
+	require.NoError(t, run(ctx, append(args, "add", "hello"), io.Discard))
+	b, err := os.ReadFile(filepath.Join(root, "usr/bin/hello"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+	world, err := os.ReadFile(filepath.Join(root, "etc/apk/world"))
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", string(world))
+}
+
+func TestRunSourceDateEpoch(t *testing.T) {
+	ctx := context.Background()
+	dir, pub := testRepository(t)
+	args := func(flags ...string) []string {
+		return append([]string{"-root", t.TempDir(), "-initdb", "-arch", "x86_64", "-repository", dir, "-key", pub}, append(flags, "add", "hello")...)
+	}
+
+	// the flag defaults to $SOURCE_DATE_EPOCH, which must be a time
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	require.ErrorContains(t, run(ctx, args(), io.Discard), `invalid source date epoch "yesterday"`)
+	require.ErrorContains(t, run(ctx, args("-source-date-epoch", "today"), io.Discard), `invalid source date epoch "today"`)
+
+	// and the flag overrides it
+	require.NoError(t, run(ctx, args("-source-date-epoch", "1700000000"), io.Discard))
+}
@@ -108,12 +108,6 @@ func (cr *countReader) Read(p []byte) (int, error) {
 }
 
 func New(open func() (io.ReadSeekCloser, error)) (*FS, error) {
-	fsys := &FS{
-		open:  open,
-		files: []Entry{},
-		index: map[string]int{},
-	}
-
 	// TODO: Consider caching this across builds.
 	r, err := open()
 	if err != nil {
@@ -121,7 +115,21 @@ func New(open func() (io.ReadSeekCloser, error)) (*FS, error) {
 	}
 	defer r.Close()
 
-	cr := &countReader{bufio.NewReaderSize(r, 1<<20), 0}
+	return Index(bufio.NewReaderSize(r, 1<<20), open, nil)
+}
+
+// Index builds an FS while reading the tar stream r, which must have the same contents as the file
+// returned by open, e.g. because it is being written to that file as it is read. If visit is not nil,
+// it is called for every entry with a reader of its contents, so that they can be processed in the
+// same pass rather than by reading the file again.
+func Index(r io.Reader, open func() (io.ReadSeekCloser, error), visit func(hdr *tar.Header, r io.Reader) error) (*FS, error) {
+	fsys := &FS{
+		open:  open,
+		files: []Entry{},
+		index: map[string]int{},
+	}
+
+	cr := &countReader{r, 0}
 	tr := tar.NewReader(cr)
 	for {
 		hdr, err := tr.Next()
@@ -136,6 +144,11 @@ func New(open func() (io.ReadSeekCloser, error)) (*FS, error) {
 			Header: *hdr,
 			Offset: cr.n,
 		})
+		if visit != nil {
+			if err := visit(hdr, tr); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return fsys, nil
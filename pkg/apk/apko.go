@@ -0,0 +1,87 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"gopkg.in/yaml.v3"
+)
+
+// ImageContents is the contents section of an apko image configuration: the repositories, keys, and
+// packages of the image.
+type ImageContents struct {
+	// Repositories are lines of /etc/apk/repositories, which can be pinned, as "@local ./packages".
+	Repositories []string `json:"repositories,omitempty" yaml:"repositories,omitempty"`
+	// Keyring are the paths or URLs of the keys to trust.
+	Keyring []string `json:"keyring,omitempty" yaml:"keyring,omitempty"`
+	// Packages are the entries of the world.
+	Packages []string `json:"packages,omitempty" yaml:"packages,omitempty"`
+}
+
+// LoadImageContents reads the contents of an apko image configuration from YAML, either a whole
+// configuration, of which only the contents section is read, or the contents section on its own.
+func LoadImageContents(r io.Reader) (*ImageContents, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var image struct {
+		Contents *ImageContents `yaml:"contents"`
+	}
+	if err := yaml.Unmarshal(b, &image); err != nil {
+		return nil, fmt.Errorf("parsing image configuration: %w", err)
+	}
+	if image.Contents != nil {
+		return image.Contents, nil
+	}
+	var contents ImageContents
+	if err := yaml.Unmarshal(b, &contents); err != nil {
+		return nil, fmt.Errorf("parsing image contents: %w", err)
+	}
+	return &contents, nil
+}
+
+// ApplyImageContents configures the root with the contents: it installs the keys, as InitKeyring
+// does, and sets the repositories and world, if the contents have any. The database of the root must
+// already be initialized, as with InitDB.
+func (a *APK) ApplyImageContents(ctx context.Context, contents *ImageContents) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "ApplyImageContents")
+	defer span.End()
+
+	if len(contents.Repositories) == 0 && len(contents.Keyring) == 0 && len(contents.Packages) == 0 {
+		return errors.New("image contents have no repositories, keyring or packages")
+	}
+	if len(contents.Keyring) > 0 {
+		if err := a.InitKeyring(ctx, contents.Keyring, nil); err != nil {
+			return fmt.Errorf("installing keyring: %w", err)
+		}
+	}
+	if len(contents.Repositories) > 0 {
+		if err := a.SetRepositories(contents.Repositories); err != nil {
+			return err
+		}
+	}
+	if len(contents.Packages) > 0 {
+		if err := a.SetWorld(contents.Packages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestImageContents(t *testing.T) {
+	ctx := context.Background()
+	key := filepath.Join(t.TempDir(), "demo.rsa.pub")
+	require.NoError(t, os.WriteFile(key, []byte(testDemoKey), 0o644))
+
+	image := `
+contents:
+  keyring:
+    - ` + key + `
+  repositories:
+    - https://dl-cdn.alpinelinux.org/alpine/v3.18/main
+    - '@local ./packages'
+  packages:
+    - alpine-baselayout
+    - busybox
+entrypoint:
+  command: /bin/sh -l
+archs:
+  - x86_64
+`
+	contents, err := LoadImageContents(strings.NewReader(image))
+	require.NoError(t, err)
+	require.Equal(t, &ImageContents{
+		Repositories: []string{"https://dl-cdn.alpinelinux.org/alpine/v3.18/main", "@local ./packages"},
+		Keyring:      []string{key},
+		Packages:     []string{"alpine-baselayout", "busybox"},
+	}, contents)
+
+	// the contents section on its own
+	section, err := LoadImageContents(strings.NewReader("repositories:\n  - https://packages.wolfi.dev/os\n"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"https://packages.wolfi.dev/os"}, section.Repositories)
+
+	a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithIgnoreMknodErrors(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.ApplyImageContents(ctx, contents))
+	repos, err := a.GetRepositories()
+	require.NoError(t, err)
+	require.Equal(t, contents.Repositories, repos)
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, contents.Packages, world)
+	b, err := a.fs.ReadFile(filepath.Join(DefaultKeyRingPath, "demo.rsa.pub"))
+	require.NoError(t, err)
+	require.Equal(t, testDemoKey, string(b))
+
+	require.Error(t, a.ApplyImageContents(ctx, &ImageContents{}))
+	_, err = LoadImageContents(strings.NewReader("contents: ["))
+	require.Error(t, err)
+}
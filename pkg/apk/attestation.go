@@ -0,0 +1,116 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+const (
+	// InTotoStatementType is the _type of an in-toto v0.1 statement.
+	InTotoStatementType = "https://in-toto.io/Statement/v0.1"
+	// SLSAProvenancePredicateType is the predicateType of a SLSA v0.2 provenance predicate.
+	SLSAProvenancePredicateType = "https://slsa.dev/provenance/v0.2"
+	// DefaultProvenanceBuildType is the buildType recorded for installs performed by this library.
+	DefaultProvenanceBuildType = "https://github.com/chainguard-dev/go-apk/install@v1"
+)
+
+// InTotoStatement is an in-toto v0.1 statement carrying a SLSA v0.2 provenance predicate.
+// It is plain JSON, so it can be marshaled and handed to cosign (or anything else) for signing.
+type InTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []InTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     SLSAProvenance  `json:"predicate"`
+}
+
+// InTotoSubject is an artifact the statement is about, e.g. the image or layer that
+// the packages were installed into.
+type InTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// SLSAProvenance is the subset of the SLSA v0.2 provenance predicate that we can fill in.
+type SLSAProvenance struct {
+	Builder   SLSABuilder    `json:"builder"`
+	BuildType string         `json:"buildType"`
+	Materials []SLSAMaterial `json:"materials,omitempty"`
+}
+
+// SLSABuilder identifies the entity that performed the install.
+type SLSABuilder struct {
+	ID string `json:"id"`
+}
+
+// SLSAMaterial is a single input to the build, in our case an installed package.
+type SLSAMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// NewProvenanceStatement creates an in-toto statement for the given subjects, listing each
+// of the packages as a material. Materials are identified by their package URL and, where known,
+// the sha1 of their control section, which is the checksum apk uses to identify a package.
+func NewProvenanceStatement(builderID string, subjects []InTotoSubject, pkgs []*repository.Package) *InTotoStatement {
+	materials := make([]SLSAMaterial, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		m := SLSAMaterial{URI: packagePURL(pkg)}
+		if len(pkg.Checksum) > 0 {
+			m.Digest = map[string]string{"sha1": hex.EncodeToString(pkg.Checksum)}
+		}
+		materials = append(materials, m)
+	}
+	if subjects == nil {
+		subjects = []InTotoSubject{}
+	}
+	return &InTotoStatement{
+		Type:          InTotoStatementType,
+		Subject:       subjects,
+		PredicateType: SLSAProvenancePredicateType,
+		Predicate: SLSAProvenance{
+			Builder:   SLSABuilder{ID: builderID},
+			BuildType: DefaultProvenanceBuildType,
+			Materials: materials,
+		},
+	}
+}
+
+// ProvenanceStatement returns an in-toto statement whose materials are the packages currently
+// recorded in the installed database.
+func (a *APK) ProvenanceStatement(builderID string, subjects ...InTotoSubject) (*InTotoStatement, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	pkgs := make([]*repository.Package, 0, len(installed))
+	for _, pkg := range installed {
+		pkgs = append(pkgs, &pkg.Package)
+	}
+	return NewProvenanceStatement(builderID, subjects, pkgs), nil
+}
+
+// packagePURL returns the purl for a package, e.g. pkg:apk/busybox@1.36.1-r0?arch=x86_64
+func packagePURL(pkg *repository.Package) string {
+	u := fmt.Sprintf("pkg:apk/%s@%s", url.PathEscape(pkg.Name), url.PathEscape(pkg.Version))
+	if pkg.Arch != "" {
+		u += "?arch=" + url.QueryEscape(pkg.Arch)
+	}
+	return u
+}
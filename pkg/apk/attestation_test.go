@@ -0,0 +1,53 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestProvenanceStatement(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+	err = a.addInstalledPackage(&repository.Package{
+		Name:     "testpkg",
+		Version:  "1.0.0-r0",
+		Arch:     "x86_64",
+		Checksum: []byte{0xde, 0xad, 0xbe, 0xef},
+	}, nil)
+	require.NoError(t, err, "unable to add installed package")
+
+	subject := InTotoSubject{Name: "image", Digest: map[string]string{"sha256": "abc"}}
+	stmt, err := a.ProvenanceStatement("https://example.com/builder", subject)
+	require.NoError(t, err)
+	require.Equal(t, InTotoStatementType, stmt.Type)
+	require.Equal(t, SLSAProvenancePredicateType, stmt.PredicateType)
+	require.Equal(t, []InTotoSubject{subject}, stmt.Subject)
+	require.Len(t, stmt.Predicate.Materials, len(testInstalledPackages)+1)
+
+	last := stmt.Predicate.Materials[len(stmt.Predicate.Materials)-1]
+	require.Equal(t, "pkg:apk/testpkg@1.0.0-r0?arch=x86_64", last.URI)
+	require.Equal(t, map[string]string{"sha1": "deadbeef"}, last.Digest)
+
+	b, err := json.Marshal(stmt)
+	require.NoError(t, err)
+	var raw map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &raw))
+	require.Equal(t, InTotoStatementType, raw["_type"])
+}
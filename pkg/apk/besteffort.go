@@ -0,0 +1,74 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// skipUnfetched returns which of the packages to leave out of a best effort install, given the
+// errors fetching each of them: those that could not be fetched, and those that depend on them,
+// directly or not, with why for each.
+func skipUnfetched(ctx context.Context, pkgs []*repository.RepositoryPackage, fetchErrs []error) ([]bool, []PackageFailure) {
+	skip := make([]bool, len(pkgs))
+	causes := make([]string, len(pkgs))
+	var queue []int
+	for i, err := range fetchErrs {
+		if err != nil {
+			skip[i] = true
+			queue = append(queue, i)
+		}
+	}
+	if len(queue) == 0 {
+		return skip, nil
+	}
+
+	deps := NewPkgResolver(ctx, nil).dependencyGraph(pkgs)
+	dependents := make([][]int, len(pkgs))
+	for i, ds := range deps {
+		for _, j := range ds {
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+	for len(queue) > 0 {
+		j := queue[0]
+		queue = queue[1:]
+		cause := causes[j]
+		if cause == "" {
+			cause = pkgs[j].Name
+		}
+		for _, i := range dependents[j] {
+			if !skip[i] {
+				skip[i] = true
+				causes[i] = cause
+				queue = append(queue, i)
+			}
+		}
+	}
+
+	var failures []PackageFailure
+	for i, pkg := range pkgs {
+		switch {
+		case fetchErrs[i] != nil:
+			failures = append(failures, PackageFailure{Name: pkg.Name, Err: fmt.Errorf("fetching %s: %w", pkg.Name, fetchErrs[i])})
+		case skip[i]:
+			failures = append(failures, PackageFailure{Name: pkg.Name, Err: fmt.Errorf("depends on %s, which could not be fetched", causes[i])})
+		}
+	}
+	return skip, failures
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestBestEffort(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	writeTestRepository(t, repoDir,
+		testPackage{repository.Package{Name: "libhello", Version: "1.0-r0"}, map[string]string{"usr/lib/libhello.so": "lib"}},
+		testPackage{repository.Package{Name: "hello", Version: "1.0-r0", Dependencies: []string{"libhello"}}, map[string]string{"usr/bin/hello": "hello"}},
+		testPackage{repository.Package{Name: "broken", Version: "1.0-r0"}, map[string]string{"usr/lib/broken.so": "broken"}},
+		testPackage{repository.Package{Name: "user", Version: "1.0-r0", Dependencies: []string{"broken"}}, map[string]string{"usr/bin/user": "user"}},
+	)
+	// the index lists broken, but it cannot be fetched
+	require.NoError(t, os.Remove(filepath.Join(repoDir, "broken-1.0-r0.apk")))
+
+	newRoot := func(bestEffort bool) (*APK, apkfs.FullFS) {
+		fs := apkfs.NewMemFS()
+		return newTestAPK(t, fs, []string{repoDir}, []string{"hello", "missing", "user"}, WithBestEffort(bestEffort)), fs
+	}
+
+	t.Run("all or nothing", func(t *testing.T) {
+		a, _ := newRoot(false)
+		err := a.FixateWorld(ctx, nil)
+		require.Error(t, err)
+		var partial *PartialInstallError
+		require.False(t, errors.As(err, &partial))
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		require.Empty(t, installed)
+	})
+
+	t.Run("best effort", func(t *testing.T) {
+		a, fs := newRoot(true)
+		err := a.FixateWorld(ctx, nil)
+		var partial *PartialInstallError
+		require.ErrorAs(t, err, &partial)
+		failed := map[string]string{}
+		for _, f := range partial.Failures {
+			failed[f.Name] = f.Err.Error()
+		}
+		require.Len(t, failed, 3)
+		require.Contains(t, failed, "missing")
+		require.Contains(t, failed["broken"], "fetching broken")
+		require.Contains(t, failed["user"], "depends on broken")
+
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		var names []string
+		for _, pkg := range installed {
+			names = append(names, pkg.Name)
+		}
+		require.ElementsMatch(t, []string{"libhello", "hello"}, names)
+		_, err = fs.ReadFile("usr/bin/hello")
+		require.NoError(t, err)
+		_, err = fs.ReadFile("usr/bin/user")
+		require.Error(t, err)
+
+		// the world is kept, for the next install to try the rest again
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"hello", "missing", "user"}, world)
+	})
+}
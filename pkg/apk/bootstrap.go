@@ -0,0 +1,85 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// BootstrapConfig describes the apk configuration that Bootstrap writes into a root.
+type BootstrapConfig struct {
+	// AlpineVersions are the alpine release branches, e.g. "v3.18", whose keys are fetched, as with InitDB.
+	AlpineVersions []string
+	// Keys are key files or https URLs to install into the keyring, as with InitKeyring.
+	Keys []string
+	// Repositories are written to /etc/apk/repositories.
+	Repositories []string
+	// World is written to /etc/apk/world.
+	World []string
+}
+
+// Bootstrap initializes the root with everything apk needs to run inside it later, e.g. from a chroot:
+// the base directories, /etc/apk/arch, an empty database, the keyring, /etc/apk/repositories and
+// /etc/apk/world. Nothing is installed; call FixateWorld to do that.
+//
+// This is the equivalent of "apk add --initdb" with the keys and repositories copied in,
+// without needing apk.static on the host.
+func (a *APK) Bootstrap(ctx context.Context, cfg BootstrapConfig) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Bootstrap")
+	defer span.End()
+
+	if err := a.InitDB(ctx, cfg.AlpineVersions...); err != nil {
+		return fmt.Errorf("failed to initialize apk database: %w", err)
+	}
+	if len(cfg.Keys) > 0 {
+		if err := a.InitKeyring(ctx, cfg.Keys, nil); err != nil {
+			return fmt.Errorf("failed to initialize apk keyring: %w", err)
+		}
+	}
+	if len(cfg.Repositories) > 0 {
+		if err := a.SetRepositories(cfg.Repositories); err != nil {
+			return err
+		}
+	}
+	if len(cfg.World) > 0 {
+		if err := a.SetWorld(cfg.World); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BootstrapDir creates dir if needed and runs Bootstrap with it as the root. The options are
+// applied after the filesystem and architecture are set.
+func BootstrapDir(ctx context.Context, dir, arch string, cfg BootstrapConfig, options ...Option) (*APK, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create root %s: %w", dir, err)
+	}
+	opts := append([]Option{WithFS(apkfs.DirFS(dir)), WithArch(arch)}, options...)
+	a, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Bootstrap(ctx, cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
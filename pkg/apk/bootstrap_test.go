@@ -0,0 +1,52 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrapDir(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(testPrimaryPkgDir, "alpine-devel@lists.alpinelinux.org-4a6a0840.rsa.pub")
+	a, err := BootstrapDir(context.Background(), dir, testArch, BootstrapConfig{
+		Keys:         []string{keyFile},
+		Repositories: []string{testAlpineRepos},
+		World:        []string{"busybox", "apk-tools"},
+	}, WithIgnoreMknodErrors(ignoreMknodErrors))
+	require.NoError(t, err)
+
+	for path, want := range map[string]string{
+		archFilePath:      testArch + "\n",
+		reposFilePath:     testAlpineRepos + "\n",
+		worldFilePath:     "apk-tools\nbusybox\n",
+		installedFilePath: "",
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, path))
+		require.NoError(t, err, "reading %s", path)
+		require.Equal(t, want, string(b), "contents of %s", path)
+	}
+	_, err = os.Stat(filepath.Join(dir, keysDirPath, filepath.Base(keyFile)))
+	require.NoError(t, err, "key was not installed")
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Empty(t, installed)
+}
@@ -0,0 +1,341 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+)
+
+// bundleManifestFile is the first entry of a bundle, describing the rest.
+const bundleManifestFile = "bundle.json"
+
+type bundleManifest struct {
+	Arch string `json:"arch"`
+	// Packages are the packages the bundle was exported for, as they were asked for.
+	Packages     []string           `json:"packages"`
+	Repositories []bundleRepository `json:"repositories"`
+}
+
+type bundleRepository struct {
+	// Name is the pin of the repository, if any.
+	Name string `json:"name,omitempty"`
+	// Source is the URL the repository was exported from.
+	Source string `json:"source"`
+	// Dir is where, in the bundle, the repository is, in the layout of an Alpine repository.
+	Dir string `json:"dir"`
+}
+
+// ExportBundle writes a single archive, for use where there is no network, with everything needed
+// to install the packages: their resolved dependencies, the indexes of the repositories, as they were
+// signed, and the trusted keys. See InstallFromBundle.
+func (a *APK) ExportBundle(ctx context.Context, packages []string, bundle string) (err error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "ExportBundle")
+	defer span.End()
+
+	if len(packages) == 0 {
+		return errors.New("no packages to export")
+	}
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	if a.repoCommit != "" {
+		indexes = IndexesFromCommit(indexes, a.repoCommit)
+	}
+	resolver, err := a.resolverOf(ctx, indexes, nil)
+	if err != nil {
+		return err
+	}
+	pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, packages)
+	if err != nil {
+		return fmt.Errorf("resolving packages: %w", err)
+	}
+	keys, err := a.TrustedKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the indexes as they were signed, as the parsed ones no longer are
+	repos, err := a.GetRepositories()
+	if err != nil {
+		return err
+	}
+	httpClient := a.getClient()
+	if a.cache != nil {
+		httpClient = a.cacheClient(httpClient, true)
+	}
+	opts := &indexOpts{layout: AlpineLayout{}, arches: a.repoArches}
+	for _, opt := range []IndexOption{WithHTTPClient(httpClient), WithLayout(a.layout)} {
+		opt(opts)
+	}
+	manifest := bundleManifest{Arch: a.arch, Packages: packages}
+	archives := map[string][]byte{}
+	dirs := map[string]string{}
+	for i, repo := range repos {
+		name, repoURL, err := parseRepositoryLine(repo)
+		if err != nil {
+			return err
+		}
+		repoArch := opts.repositoryArch(repoURL, a.arch)
+		b, err := fetchIndex(ctx, opts.layout.IndexURL(repoURL, repoArch), repoArch, opts)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			continue
+		}
+		dir := fmt.Sprintf("repositories/%d", i)
+		manifest.Repositories = append(manifest.Repositories, bundleRepository{Name: name, Source: repoURL, Dir: dir})
+		archives[dir] = b
+		dirs[opts.layout.PackagesURL(repoURL, repoArch)] = dir
+	}
+
+	f, err := os.Create(bundle)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(bundle)
+		}
+	}()
+	tw := tar.NewWriter(f)
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeBundleEntry(tw, bundleManifestFile, bytes.NewReader(b), int64(len(b))); err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(keys) {
+		if err := writeBundleEntry(tw, path.Join("keys", name), bytes.NewReader(keys[name]), int64(len(keys[name]))); err != nil {
+			return err
+		}
+	}
+	for _, repo := range manifest.Repositories {
+		b := archives[repo.Dir]
+		if err := writeBundleEntry(tw, path.Join(repo.Dir, a.arch, indexFilename), bytes.NewReader(b), int64(len(b))); err != nil {
+			return err
+		}
+	}
+	for _, pkg := range pkgs {
+		if err := a.exportPackage(ctx, tw, pkg, dirs); err != nil {
+			return fmt.Errorf("exporting %s: %w", pkg.Name, err)
+		}
+	}
+	return tw.Close()
+}
+
+func (a *APK) exportPackage(ctx context.Context, tw *tar.Writer, pkg *repository.RepositoryPackage, dirs map[string]string) error {
+	repo := pkg.Repository()
+	if repo == nil || repo.Repository == nil {
+		return errors.New("package is not from a repository")
+	}
+	dir, ok := dirs[repo.Uri]
+	if !ok {
+		return fmt.Errorf("repository %s is not in the bundle", repo.Uri)
+	}
+	rc, err := a.FetchPackage(ctx, pkg)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	// the size is needed up front, so the package goes through a temporary file
+	tmp, err := os.CreateTemp("", "apk-bundle-*.apk")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, rc)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return writeBundleEntry(tw, path.Join(dir, a.arch, path.Base(pkg.Url())), tmp, size)
+}
+
+func writeBundleEntry(tw *tar.Writer, name string, r io.Reader, size int64) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+	}); err != nil {
+		return fmt.Errorf("writing %s to bundle: %w", name, err)
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("writing %s to bundle: %w", name, err)
+	}
+	return nil
+}
+
+// InstallFromBundle adds the packages of a bundle from ExportBundle to the world, and installs the
+// world from the bundle, without any network access. The signatures of the indexes in the bundle are
+// verified with the keys trusted by the root, as for GetRepositoryIndexes, not with the keys in the
+// bundle, which have to be installed, e.g. with InitKeyring, once they have been checked by other means.
+// Each package is verified against the checksum of its entry in the index. The repositories of the root
+// are left as they are, as is the world if the install fails.
+func (a *APK) InstallFromBundle(ctx context.Context, bundle string, sourceDateEpoch *time.Time) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallFromBundle")
+	defer span.End()
+
+	dir, err := os.MkdirTemp("", "apk-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	manifest, err := extractBundle(bundle, dir)
+	if err != nil {
+		return fmt.Errorf("extracting bundle %s: %w", bundle, err)
+	}
+	if manifest.Arch != a.arch {
+		return fmt.Errorf("bundle is for architecture %s, not %s", manifest.Arch, a.arch)
+	}
+
+	keys, err := a.loadKeys(ctx, a.getClient())
+	if err != nil {
+		return err
+	}
+	var repos []string
+	for _, repo := range manifest.Repositories {
+		if !filepath.IsLocal(filepath.FromSlash(repo.Dir)) {
+			return fmt.Errorf("bundle has repository %s outside of it, at %s", repo.Source, repo.Dir)
+		}
+		line := filepath.Join(dir, filepath.FromSlash(repo.Dir))
+		if repo.Name != "" {
+			line = "@" + repo.Name + " " + line
+		}
+		repos = append(repos, line)
+	}
+	indexes, err := GetRepositoryIndexes(ctx, repos, keys, a.arch, WithIgnoreSignatures(a.ignoreSignatures), WithStrictIndex(a.strictIndexes))
+	if err != nil {
+		return fmt.Errorf("error getting bundle indexes: %w", err)
+	}
+
+	previous, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	world := append([]string(nil), previous...)
+	inWorld := map[string]bool{}
+	for _, pkg := range world {
+		inWorld[pkg] = true
+	}
+	for _, pkg := range manifest.Packages {
+		if !inWorld[pkg] {
+			world = append(world, pkg)
+		}
+	}
+	if err := a.SetWorld(world); err != nil {
+		return err
+	}
+
+	if err := a.fixateWorld(ctx, sourceDateEpoch, false, true, indexes); err != nil {
+		// the world is left as it was, rather than asking for what could not be installed
+		if setErr := a.SetWorld(previous); setErr != nil {
+			return errors.Join(err, fmt.Errorf("restoring the world: %w", setErr))
+		}
+		return err
+	}
+	return nil
+}
+
+// extractBundle extracts the bundle into dir, returning its manifest.
+func extractBundle(bundle, dir string) (*bundleManifest, error) {
+	f, err := os.Open(bundle)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	var manifest *bundleManifest
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("unexpected entry %s", hdr.Name)
+		}
+		if name == bundleManifestFile {
+			manifest = &bundleManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("reading manifest: %w", err)
+			}
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return nil, err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(out, tr); err != nil { //nolint:gosec // the bundle is as big as it is
+			out.Close()
+			return nil, err
+		}
+		if err := out.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("no %s in bundle", bundleManifestFile)
+	}
+	return manifest, nil
+}
+
+// verifyExpanded checks that the package is the one in the index: that its control section has the
+// checksum of the index entry, and its data section the datahash recorded in the control section.
+func verifyExpanded(pkg *repository.Package, exp *APKExpanded) error {
+	if !bytes.Equal(exp.ControlHash, pkg.Checksum) {
+		return fmt.Errorf("checksum %s does not match %s of the index", FormatQ1Checksum(exp.ControlHash), pkg.ChecksumString())
+	}
+	info, err := exp.PackageInfo()
+	if err != nil {
+		return err
+	}
+	if info.DataHash != "" && info.DataHash != hex.EncodeToString(exp.PackageHash) {
+		return fmt.Errorf("data section does not match datahash %s", info.DataHash)
+	}
+	return nil
+}
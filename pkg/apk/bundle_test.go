@@ -0,0 +1,117 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+func TestBundle(t *testing.T) {
+	ctx := context.Background()
+	const pkgFile = "alpine-baselayout-3.2.0-r23.apk"
+
+	// a local repository with the package, signed with a key of our own
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+	keyFile := filepath.Join(t.TempDir(), "test.rsa")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+
+	repo := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, testArch), 0o755))
+	b, err := os.ReadFile(filepath.Join("testdata", "alpine-316", pkgFile))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repo, testArch, pkgFile), b, 0o644))
+	index := filepath.Join(repo, testArch, indexFilename)
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	writeIndex := func(checksum string) {
+		require.NoError(t, os.WriteFile(index, testIndexArchive(t, "C:"+checksum+"\nP:alpine-baselayout\nV:3.2.0-r23\nA:aarch64\nS:11012\n\n"), 0o644))
+		require.NoError(t, signature.SignIndex(ctx, log, keyFile, index))
+	}
+	newRoot := func() *APK {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithIgnoreMknodErrors(true))
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, a.fs.WriteFile(filepath.Join(keysDirPath, "test.rsa.pub"), pubPEM, 0o644))
+		return a
+	}
+
+	writeIndex("Q1LLq2qDNrS/qRnhxQ3hsY/sHbQnc=")
+	src := newRoot()
+	require.NoError(t, src.SetRepositories([]string{repo}))
+	bundle := filepath.Join(t.TempDir(), "bundle.tar")
+	require.NoError(t, src.ExportBundle(ctx, []string{"alpine-baselayout"}, bundle))
+
+	t.Run("install", func(t *testing.T) {
+		dst := newRoot()
+		require.NoError(t, dst.InstallFromBundle(ctx, bundle, nil))
+		installed, err := dst.GetInstalled()
+		require.NoError(t, err)
+		require.Len(t, installed, 1)
+		require.Equal(t, "alpine-baselayout", installed[0].Name)
+		world, err := dst.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"alpine-baselayout"}, world)
+	})
+	t.Run("untrusted", func(t *testing.T) {
+		dst, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch))
+		require.NoError(t, err)
+		require.NoError(t, dst.InitDB(ctx))
+		var untrusted *UntrustedKeyError
+		require.ErrorAs(t, dst.InstallFromBundle(ctx, bundle, nil), &untrusted)
+	})
+	t.Run("checksum mismatch", func(t *testing.T) {
+		// a correctly signed index whose entry is not for the package
+		writeIndex("Q1Meo+LHGPSi3uY9gIouEVb9z8Fbo=")
+		bad := filepath.Join(t.TempDir(), "bundle.tar")
+		require.NoError(t, src.ExportBundle(ctx, []string{"alpine-baselayout"}, bad))
+		dst := newRoot()
+		require.ErrorContains(t, dst.InstallFromBundle(ctx, bad, nil), "does not match")
+		// and the world is left as it was
+		world, err := dst.GetWorld()
+		require.NoError(t, err)
+		require.Empty(t, world)
+	})
+	t.Run("repository outside of the bundle", func(t *testing.T) {
+		evil := filepath.Join(t.TempDir(), "bundle.tar")
+		f, err := os.Create(evil)
+		require.NoError(t, err)
+		tw := tar.NewWriter(f)
+		manifest := []byte(`{"arch":"` + testArch + `","packages":["alpine-baselayout"],"repositories":[{"source":"` + repo + `","dir":"../../` + filepath.Base(repo) + `"}]}`)
+		require.NoError(t, writeBundleEntry(tw, bundleManifestFile, bytes.NewReader(manifest), int64(len(manifest))))
+		require.NoError(t, tw.Close())
+		require.NoError(t, f.Close())
+		require.ErrorContains(t, newRoot().InstallFromBundle(ctx, evil, nil), "outside of it")
+	})
+}
@@ -15,6 +15,8 @@
 package apk
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -24,12 +26,18 @@ import (
 	"strings"
 
 	"gitlab.alpinelinux.org/alpine/go/repository"
+	"golang.org/x/sync/singleflight"
 )
 
 // cache
 type cache struct {
 	dir     string
 	offline bool
+	// stats are shared by the clients of the cache, and the APKs cloned with it
+	stats *cacheStats
+	// fetches collapses concurrent fetches of the same package or index into one, by the path it is
+	// cached at, so that only one of them downloads it and the others read it from the cache
+	fetches *singleflight.Group
 }
 
 // client return an http.Client that knows how to read from and write to the cache
@@ -41,6 +49,8 @@ func (c cache) client(wrapped *http.Client, etagRequired bool) *http.Client {
 			root:         c.dir,
 			offline:      c.offline,
 			etagRequired: etagRequired,
+			stats:        c.stats,
+			fetches:      c.fetches,
 		},
 	}
 }
@@ -50,6 +60,8 @@ type cacheTransport struct {
 	root         string
 	offline      bool
 	etagRequired bool
+	stats        *cacheStats
+	fetches      *singleflight.Group
 }
 
 func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error) {
@@ -72,12 +84,13 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 			if t.offline {
 				return nil, fmt.Errorf("failed to read %q in offline cache: %w", cacheFile, err)
 			}
-			return t.wrapped.Do(request)
+			return t.miss(t.wrapped.Do(request))
 		}
 
 		return &http.Response{
 			StatusCode: http.StatusOK,
-			Body:       f,
+			Header:     http.Header{cacheStatusHeader: {cacheHit}},
+			Body:       t.stats.countServed(f),
 		}, nil
 	}
 
@@ -115,7 +128,8 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 
 		return &http.Response{
 			StatusCode:    http.StatusOK,
-			Body:          f,
+			Header:        http.Header{cacheStatusHeader: {cacheHit}},
+			Body:          t.stats.countServed(f),
 			ContentLength: newest.Size(),
 		}, nil
 	}
@@ -128,14 +142,14 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 	if !ok {
 		// If the server doesn't return etags, and we require them,
 		// then do not cache.
-		return t.wrapped.Do(request)
+		return t.miss(t.wrapped.Do(request))
 	}
 	// We simulate content-based addressing with the etag values using an .etag
 	// file extension.
 	etagFile := cacheFileFromEtag(cacheFile, initialEtag)
 	f, err := os.Open(etagFile)
 	if err != nil {
-		return t.retrieveAndSaveFile(request, func(r *http.Response) (string, error) {
+		return t.retrieveOnce(etagFile, request, func(r *http.Response) (string, error) {
 			// On the etag path, use the etag from the actual response to
 			// compute the final file name.
 			finalEtag, ok := etagFromResponse(r)
@@ -148,11 +162,22 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 	}
 	return &http.Response{
 		StatusCode:    http.StatusOK,
-		Body:          f,
+		Header:        http.Header{cacheStatusHeader: {cacheHit}},
+		Body:          t.stats.countServed(f),
 		ContentLength: resp.ContentLength,
 	}, nil
 }
 
+// miss counts a response fetched without being cached, whose body is counted as it is read.
+func (t *cacheTransport) miss(resp *http.Response, err error) (*http.Response, error) {
+	setCacheStatus(resp, cacheMiss)
+	if err == nil && resp != nil {
+		t.stats.miss()
+		resp.Body = t.stats.countFetched(resp.Body)
+	}
+	return resp, err
+}
+
 func cacheDirFromFile(cacheFile string) string {
 	if strings.HasSuffix(cacheFile, "APKINDEX.tar.gz") {
 		return filepath.Join(filepath.Dir(cacheFile), "APKINDEX")
@@ -186,54 +211,166 @@ func etagFromResponse(resp *http.Response) (string, bool) {
 
 type cachePlacer func(*http.Response) (string, error)
 
-func (t *cacheTransport) retrieveAndSaveFile(request *http.Request, cp cachePlacer) (*http.Response, error) {
+// doOnce runs fn for key once among the concurrent callers of the group, waiting for it unless ctx is
+// done first. It returns the result, and whether it was the fn of this caller that ran, whose result
+// is then its own. The others share the result, but not the errors of the context of the caller whose
+// fn ran: should that be done, and ctx not, fn is run again. The result of the fn of a caller that
+// gave up waiting is handed to release, if it is not nil, once it is done.
+func doOnce(ctx context.Context, g *singleflight.Group, key string, fn func() (interface{}, error), release func(interface{})) (interface{}, bool, error) {
+	for {
+		ran := false
+		ch := g.DoChan(key, func() (interface{}, error) {
+			ran = true
+			return fn()
+		})
+		select {
+		case <-ctx.Done():
+			if release != nil {
+				go func() {
+					if res := <-ch; ran && res.Val != nil {
+						release(res.Val)
+					}
+				}()
+			}
+			return nil, false, ctx.Err()
+		case res := <-ch:
+			if ran {
+				return res.Val, true, res.Err
+			}
+			if isContextError(res.Err) && ctx.Err() == nil {
+				continue
+			}
+			return res.Val, false, res.Err
+		}
+	}
+}
+
+// isContextError reports whether the error is that of a context that is done.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// retrieval is what retrieveOnce retrieved: the response, for the caller that retrieved it, and the
+// file it was cached at, for the others.
+type retrieval struct {
+	resp   *http.Response
+	cached string
+}
+
+// retrieveOnce is retrieveAndSaveFile, for the file to be cached at key, collapsing concurrent
+// retrievals of it into one: the others wait for it and then read the file it cached. Should it
+// not have cached one, as for a response other than 200, they retrieve their own.
+func (t *cacheTransport) retrieveOnce(key string, request *http.Request, cp cachePlacer) (*http.Response, error) {
+	if t.fetches == nil {
+		resp, _, err := t.retrieveAndSaveFile(request, cp)
+		return resp, err
+	}
+	v, led, err := doOnce(request.Context(), t.fetches, key, func() (interface{}, error) {
+		resp, cached, err := t.retrieveAndSaveFile(request, cp)
+		return retrieval{resp: resp, cached: cached}, err
+	}, func(v interface{}) {
+		if resp := v.(retrieval).resp; resp != nil {
+			resp.Body.Close()
+		}
+	})
+	if led {
+		return v.(retrieval).resp, err
+	}
+	if err != nil {
+		// all of them, if it failed
+		return nil, err
+	}
+	f, err := os.Open(v.(retrieval).cached)
+	if err != nil {
+		// nothing cached, or evicted since
+		resp, _, err := t.retrieveAndSaveFile(request, cp)
+		return resp, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{cacheStatusHeader: {cacheHit}},
+		Body:          t.stats.countServed(f),
+		ContentLength: fi.Size(),
+	}, nil
+}
+
+// retrieveAndSaveFile fetches the request and caches its response where the placer says, returning
+// the response, with its body read from the cached file, and that file, which is empty if the
+// response was not cached.
+func (t *cacheTransport) retrieveAndSaveFile(request *http.Request, cp cachePlacer) (*http.Response, string, error) {
 	if t.wrapped == nil {
-		return nil, fmt.Errorf("wrapped client is nil")
+		return nil, "", fmt.Errorf("wrapped client is nil")
 	}
 	resp, err := t.wrapped.Do(request)
 	if err != nil || resp.StatusCode != 200 {
-		return resp, err
+		return resp, "", err
 	}
 
 	// Determine the file we will caching stuff in based on the URL/response
 	cacheFile, err := cp(resp)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	cacheDir := filepath.Dir(cacheFile)
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return nil, fmt.Errorf("unable to create cache directory: %w", err)
+		return nil, "", fmt.Errorf("unable to create cache directory: %w", err)
 	}
 
 	// Stream the request response to a temporary file within the final cache
 	// directory
 	tmp, err := os.CreateTemp(cacheDir, "*.tmp")
 	if err != nil {
-		return nil, fmt.Errorf("unable to create a temporary cache file: %w", err)
+		return nil, "", fmt.Errorf("unable to create a temporary cache file: %w", err)
 	}
-	if err := func() error {
-		defer tmp.Close()
-		if _, err := io.Copy(tmp, resp.Body); err != nil {
-			return fmt.Errorf("unable to write to cache file: %w", err)
-		}
-		return nil
-	}(); err != nil {
-		return nil, err
+	if _, err := io.Copy(tmp, t.stats.countFetched(resp.Body)); err != nil {
+		tmp.Close()
+		return nil, "", fmt.Errorf("unable to write to cache file: %w", err)
 	}
 
 	// Now that we have the file has been written, rename to atomically populate
 	// the cache
 	if err := os.Rename(tmp.Name(), cacheFile); err != nil {
-		return nil, fmt.Errorf("unable to populate cache: %v", err)
+		tmp.Close()
+		return nil, "", fmt.Errorf("unable to populate cache: %v", err)
 	}
 
-	// return a handle to our file
-	f2, err := os.Open(cacheFile)
+	// return our handle to the file, which stays readable even if another fetch
+	// of the index evicts it in turn
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, "", fmt.Errorf("unable to read cache file: %w", err)
+	}
+	t.stats.miss()
+	if filepath.Base(cacheDir) == "APKINDEX" {
+		t.evictIndexes(cacheFile)
+	}
+	resp.Body = tmp
+	setCacheStatus(resp, cacheMiss)
+	return resp, cacheFile, nil
+}
+
+// evictIndexes removes the versions of an index older than the one just cached, which nothing reads
+// again, as the offline cache reads the newest. Any that cannot be removed are left for the next time.
+func (t *cacheTransport) evictIndexes(cacheFile string) {
+	dir := filepath.Dir(cacheFile)
+	des, err := os.ReadDir(dir)
 	if err != nil {
-		return nil, fmt.Errorf("unable to open cache file: %w", err)
+		return
+	}
+	for _, de := range des {
+		name := filepath.Join(dir, de.Name())
+		if name == cacheFile || de.IsDir() || !strings.HasSuffix(name, ".tar.gz") {
+			continue
+		}
+		if err := os.Remove(name); err == nil {
+			t.stats.evicted()
+		}
 	}
-	resp.Body = f2
-	return resp, nil
 }
 
 func cacheDirForPackage(root string, pkg *repository.RepositoryPackage) (string, error) {
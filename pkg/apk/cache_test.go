@@ -0,0 +1,162 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"golang.org/x/sync/singleflight"
+)
+
+func TestCacheCollapsesFetches(t *testing.T) {
+	ctx := context.Background()
+	const pkgFile = "alpine-baselayout-3.2.0-r23.apk"
+	b, err := os.ReadFile(filepath.Join("testdata", "alpine-316", pkgFile))
+	require.NoError(t, err)
+	exp, err := ExpandApk(ctx, bytes.NewReader(b), "")
+	require.NoError(t, err)
+	checksum := exp.ControlHash
+	require.NoError(t, exp.Close())
+
+	var gets atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"one"`)
+		if r.Method != http.MethodGet {
+			return
+		}
+		gets.Add(1)
+		// long enough for every other fetch to be waiting
+		time.Sleep(200 * time.Millisecond)
+		if filepath.Ext(r.URL.Path) == ".apk" {
+			_, _ = w.Write(b)
+			return
+		}
+		_, _ = io.WriteString(w, "index")
+	}))
+	defer server.Close()
+
+	a, err := New(WithCache(t.TempDir(), false), WithArch("x86_64"))
+	require.NoError(t, err)
+	a.SetClient(server.Client())
+	concurrently := func(fn func()) {
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				fn()
+			}()
+		}
+		close(start)
+		wg.Wait()
+	}
+
+	repo := repository.Repository{Uri: server.URL + "/main/x86_64"}
+	pkg := repository.NewRepositoryPackage(&repository.Package{Name: "alpine-baselayout", Version: "3.2.0-r23", Arch: "x86_64", Checksum: checksum}, repo.WithIndex(nil))
+	concurrently(func() {
+		clone, err := a.Clone()
+		require.NoError(t, err)
+		exp, err := clone.expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		info, err := exp.PackageInfo()
+		require.NoError(t, err)
+		require.Equal(t, "alpine-baselayout", info.Name)
+	})
+	require.EqualValues(t, 1, gets.Load())
+	require.Equal(t, uint64(1), a.CacheStats().Misses)
+	require.Equal(t, uint64(7), a.CacheStats().Hits)
+
+	gets.Store(0)
+	concurrently(func() {
+		res, err := a.cacheClient(a.getClient(), true).Get(server.URL + "/main/x86_64/APKINDEX.tar.gz")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, "index", string(body))
+	})
+	require.EqualValues(t, 1, gets.Load())
+}
+
+func TestDoOnce(t *testing.T) {
+	var g singleflight.Group
+	var runs atomic.Int32
+	started := make(chan struct{})
+	// the first fn run fails with the context of its caller, the others succeed
+	fn := func(ctx context.Context) func() (interface{}, error) {
+		return func() (interface{}, error) {
+			if runs.Add(1) == 1 {
+				close(started)
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return "fetched", nil
+		}
+	}
+
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, _, err := doOnce(first, &g, "key", fn(first), nil)
+		firstErr <- err
+	}()
+	<-started
+	type result struct {
+		v   interface{}
+		led bool
+		err error
+	}
+	second := make(chan result, 1)
+	go func() {
+		v, led, err := doOnce(context.Background(), &g, "key", fn(context.Background()), nil)
+		second <- result{v, led, err}
+	}()
+	// long enough for the second to be waiting on the first
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-firstErr, context.Canceled)
+	// the second is not failed by the context of the first, but runs its own fn
+	res := <-second
+	require.NoError(t, res.err)
+	require.True(t, res.led)
+	require.Equal(t, "fetched", res.v)
+
+	// and whoever waits stops waiting once their context is done, releasing what their fn returns
+	block := make(chan struct{})
+	released := make(chan interface{}, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := doOnce(ctx, &g, "other", func() (interface{}, error) {
+		<-block
+		return "late", nil
+	}, func(v interface{}) { released <- v })
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	close(block)
+	require.Equal(t, "late", <-released)
+}
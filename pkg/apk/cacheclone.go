@@ -0,0 +1,101 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// cachedFilesDir is the directory of the cache that holds the files of the packages installed with
+// WithCacheClone, by their checksum.
+const cachedFilesDir = "files"
+
+// cloneFromCache installs the regular file of the header, whose content is read from r and has the
+// checksum, by cloning its copy in the cache, which is first written from r if there is none. It
+// returns false, having read nothing, for the files it does not clone: those of an APK without
+// WithCacheClone or a cache, or whose filesystem cannot clone, and, for hardlinks, those of etc/,
+// which are expected to be changed once installed. A file that cannot be cloned after all, as across
+// filesystems, is copied from the cache instead.
+func (a *APK) cloneFromCache(header *tar.Header, r io.Reader, checksum []byte) (bool, error) {
+	if a.cacheClone == apkfs.NoClone || a.cache == nil || checksum == nil {
+		return false, nil
+	}
+	if _, ok := a.fs.(apkfs.CloneFS); !ok {
+		return false, nil
+	}
+	if a.cacheClone == apkfs.Hardlink && (header.Name == "etc" || strings.HasPrefix(header.Name, "etc/")) {
+		return false, nil
+	}
+	src, err := a.cachedFile(header, r, checksum)
+	if err != nil {
+		return true, err
+	}
+	_, err = apkfs.CloneHeader(a.fs, header, src, a.cacheClone)
+	return true, err
+}
+
+// cachedFile returns the copy in the cache of the file of the header, with the checksum, writing it
+// from r if there is none. Hardlinks share their mode, ownership and times with the copy, so there is
+// a copy for each of those that the content is installed with.
+func (a *APK) cachedFile(header *tar.Header, r io.Reader, checksum []byte) (string, error) {
+	name := hex.EncodeToString(checksum)
+	if a.cacheClone == apkfs.Hardlink {
+		mtime := header.ModTime
+		if !a.timestampOverride.IsZero() && mtime.After(a.timestampOverride) {
+			// as the root clamps it
+			mtime = a.timestampOverride
+		}
+		name += fmt.Sprintf("-%o-%d-%d-%d", header.Mode, header.Uid, header.Gid, mtime.Unix())
+	}
+	dir := filepath.Join(a.cache.dir, cachedFilesDir, name[:2])
+	file := filepath.Join(dir, name)
+	if fi, err := os.Stat(file); err == nil && fi.Size() == header.Size {
+		return file, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("unable to create cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("unable to create a temporary cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	h := sha1.New() //nolint:gosec // this is what apk tools is using
+	if _, err := io.CopyN(io.MultiWriter(tmp, h), r, header.Size); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("unable to write %s to the cache: %w", header.Name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if !bytes.Equal(h.Sum(nil), checksum) {
+		return "", fmt.Errorf("checksum of %s is %s, not %s as in its header", header.Name, FormatQ1Checksum(h.Sum(nil)), FormatQ1Checksum(checksum))
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return "", fmt.Errorf("unable to populate cache: %w", err)
+	}
+	return file, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestCacheClone(t *testing.T) {
+	ctx := context.Background()
+	local := filepath.Join(t.TempDir(), "hello.apk")
+	writeTestAPK(t, local, &repository.Package{Name: "hello", Version: "1.0-r0", Arch: testArch},
+		map[string]string{"usr/bin/hello": "hello", "etc/hello.conf": "conf"})
+	cacheDir := t.TempDir()
+	install := func(mode apkfs.CloneMode, options ...Option) string {
+		root := t.TempDir()
+		a, err := New(append([]Option{WithFS(apkfs.DirFS(root)), WithArch(testArch), WithIgnoreMknodErrors(true), WithAllowUntrusted(true),
+			WithCache(cacheDir, false), WithCacheClone(mode)}, options...)...)
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, a.InstallLocalPackage(ctx, local, nil))
+		for name, content := range map[string]string{"usr/bin/hello": "hello", "etc/hello.conf": "conf"} {
+			b, err := os.ReadFile(filepath.Join(root, name))
+			require.NoError(t, err)
+			require.Equal(t, content, string(b))
+		}
+		return root
+	}
+	same := func(a, b string) bool {
+		fa, err := os.Stat(a)
+		require.NoError(t, err)
+		fb, err := os.Stat(b)
+		require.NoError(t, err)
+		return os.SameFile(fa, fb)
+	}
+
+	first, second := install(apkfs.Hardlink), install(apkfs.Hardlink)
+	require.True(t, same(filepath.Join(first, "usr/bin/hello"), filepath.Join(second, "usr/bin/hello")))
+	require.False(t, same(filepath.Join(first, "etc/hello.conf"), filepath.Join(second, "etc/hello.conf")))
+	fi, err := os.Stat(filepath.Join(first, "usr/bin/hello"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o644), fi.Mode().Perm())
+	// the filesystems of the root wrap that of the directory
+	clamped := install(apkfs.Hardlink, WithTimestampOverride(time.Unix(1000, 0)))
+	require.True(t, same(filepath.Join(first, "usr/bin/hello"), filepath.Join(clamped, "usr/bin/hello")))
+
+	// reflinks, where the filesystem has them, or else copies from the cache, are separate files
+	reflinked := install(apkfs.Reflink)
+	require.False(t, same(filepath.Join(first, "usr/bin/hello"), filepath.Join(reflinked, "usr/bin/hello")))
+	install(apkfs.NoClone)
+
+	_, err = New(WithCacheClone(apkfs.Reflink))
+	require.ErrorContains(t, err, "WithCacheClone needs a cache")
+
+	b, err := json.Marshal(Config{CacheClone: apkfs.Hardlink})
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"cacheClone":"hardlink"`)
+	var cfg Config
+	require.NoError(t, json.Unmarshal(b, &cfg))
+	require.Equal(t, apkfs.Hardlink, cfg.CacheClone)
+	require.Error(t, json.Unmarshal([]byte(`{"cacheClone":"symlink"}`), &cfg))
+}
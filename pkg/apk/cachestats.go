@@ -0,0 +1,138 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// CacheStats are the counts of what the cache of WithCache has done since it was set, for all the
+// APKs cloned from the one it was set on, which share it.
+type CacheStats struct {
+	// Hits are the packages, indexes and keys read from the cache.
+	Hits uint64 `json:"hits"`
+	// Misses are those that were not in the cache, or not current, and were fetched into it.
+	Misses uint64 `json:"misses"`
+	// Evictions are the entries removed from the cache, such as the versions of an index older than
+	// the one that replaced them.
+	Evictions uint64 `json:"evictions"`
+	// BytesServed are the bytes read from the cache, for hits.
+	BytesServed uint64 `json:"bytesServed"`
+	// BytesFetched are the bytes fetched from repositories through the cache, for misses.
+	BytesFetched uint64 `json:"bytesFetched"`
+}
+
+// cacheStats counts what the cache does, for any number of goroutines. A nil one counts nothing.
+type cacheStats struct {
+	hits, misses, evictions, served, fetched atomic.Uint64
+}
+
+func (s *cacheStats) hit(size int64) {
+	if s == nil {
+		return
+	}
+	s.hits.Add(1)
+	s.served.Add(uint64(size))
+}
+
+func (s *cacheStats) miss() {
+	if s != nil {
+		s.misses.Add(1)
+	}
+}
+
+func (s *cacheStats) evicted() {
+	if s != nil {
+		s.evictions.Add(1)
+	}
+}
+
+// countServed returns the body of a hit, counting what is read of it as served.
+func (s *cacheStats) countServed(body io.ReadCloser) io.ReadCloser {
+	if s == nil {
+		return body
+	}
+	s.hits.Add(1)
+	return &countingBody{ReadCloser: body, n: &s.served}
+}
+
+// countFetched returns the body of a miss, counting what is read of it as fetched.
+func (s *cacheStats) countFetched(body io.ReadCloser) io.ReadCloser {
+	if s == nil || body == nil {
+		return body
+	}
+	return &countingBody{ReadCloser: body, n: &s.fetched}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Uint64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(uint64(n))
+	return n, err
+}
+
+// CacheStats returns the counts of what the cache has done so far, which are all zero without one.
+func (a *APK) CacheStats() CacheStats {
+	if a.cache == nil || a.cache.stats == nil {
+		return CacheStats{}
+	}
+	s := a.cache.stats
+	return CacheStats{
+		Hits:         s.hits.Load(),
+		Misses:       s.misses.Load(),
+		Evictions:    s.evictions.Load(),
+		BytesServed:  s.served.Load(),
+		BytesFetched: s.fetched.Load(),
+	}
+}
+
+// PublishCacheStats publishes the CacheStats of the APK with expvar, as name, for them to be served
+// with the other variables of the process at /debug/vars. Unlike expvar.Publish, it returns an error
+// rather than panicking if the name is already used.
+func (a *APK) PublishCacheStats(name string) error {
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("expvar %s is already published", name)
+	}
+	expvar.Publish(name, expvar.Func(func() any { return a.CacheStats() }))
+	return nil
+}
+
+// WritePrometheus writes the stats in the Prometheus text exposition format, as counters named
+// with the prefix, such as goapk_cache, for a metrics endpoint to serve without a client library.
+func (s CacheStats) WritePrometheus(w io.Writer, prefix string) error {
+	for _, m := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"hits_total", "Packages, indexes and keys read from the cache.", s.Hits},
+		{"misses_total", "Packages, indexes and keys fetched into the cache.", s.Misses},
+		{"evictions_total", "Entries removed from the cache.", s.Evictions},
+		{"served_bytes_total", "Bytes read from the cache.", s.BytesServed},
+		{"fetched_bytes_total", "Bytes fetched from repositories through the cache.", s.BytesFetched},
+	} {
+		name := prefix + "_" + m.name
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, m.help, name, name, m.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheStats(t *testing.T) {
+	etag := "one"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+etag+`"`)
+		_, _ = io.WriteString(w, "index")
+	}))
+	defer server.Close()
+
+	// without a cache, there is nothing to count
+	a, err := New()
+	require.NoError(t, err)
+	require.Equal(t, CacheStats{}, a.CacheStats())
+
+	dir := t.TempDir()
+	a, err = New(WithCache(dir, false))
+	require.NoError(t, err)
+	clone, err := a.Clone()
+	require.NoError(t, err)
+
+	u := server.URL + "/main/x86_64/APKINDEX.tar.gz"
+	get := func() {
+		res, err := clone.cacheClient(clone.getClient(), true).Get(u)
+		require.NoError(t, err)
+		_, err = io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+	}
+	get()
+	get()
+	// the changed index replaces the one in the cache
+	etag = "two"
+	get()
+
+	// clones share the stats of the cache
+	stats := a.CacheStats()
+	require.Equal(t, CacheStats{Hits: 1, Misses: 2, Evictions: 1, BytesServed: 5, BytesFetched: 10}, stats)
+	parsed, err := url.Parse(u)
+	require.NoError(t, err)
+	cacheFile, err := cachePathFromURL(dir, *parsed)
+	require.NoError(t, err)
+	indexes, err := os.ReadDir(cacheDirFromFile(cacheFile))
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.Equal(t, "two.tar.gz", indexes[0].Name())
+
+	var buf bytes.Buffer
+	require.NoError(t, stats.WritePrometheus(&buf, "goapk_cache"))
+	require.Contains(t, buf.String(), "# TYPE goapk_cache_hits_total counter\ngoapk_cache_hits_total 1\n")
+	require.Contains(t, buf.String(), "goapk_cache_fetched_bytes_total 10\n")
+
+	// expvar names are global to the process, so each run, as with -count, needs its own
+	name := fmt.Sprintf("goapk_cache_test_%d", time.Now().UnixNano())
+	require.NoError(t, a.PublishCacheStats(name))
+	require.JSONEq(t, `{"hits":1,"misses":2,"evictions":1,"bytesServed":5,"bytesFetched":10}`, expvar.Get(name).String())
+	require.ErrorContains(t, a.PublishCacheStats(name), "already published")
+}
@@ -0,0 +1,156 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// RepositoryCheckStage is what a repository failed in CheckRepositories.
+type RepositoryCheckStage string
+
+const (
+	// CheckReachable is fetching the index of the repository.
+	CheckReachable RepositoryCheckStage = "reachable"
+	// CheckArch is the repository having an index for the architecture, of packages for it.
+	CheckArch RepositoryCheckStage = "arch"
+	// CheckSignature is the signature of the index verifying against the trusted keys.
+	CheckSignature RepositoryCheckStage = "signature"
+	// CheckIndex is the index parsing without problems.
+	CheckIndex RepositoryCheckStage = "index"
+)
+
+// RepositoryCheck is the result of checking a repository with CheckRepositories.
+type RepositoryCheck struct {
+	// Repository is the line of /etc/apk/repositories.
+	Repository string `json:"repository"`
+	IndexURL   string `json:"index_url,omitempty"`
+	// Signer is the key the index is signed with.
+	Signer string `json:"signer,omitempty"`
+	// Packages is the number of packages in the index.
+	Packages int `json:"packages"`
+	// Failed is what the repository failed, or empty if it passed every check.
+	Failed RepositoryCheckStage `json:"failed,omitempty"`
+	Err    error                `json:"-"`
+}
+
+// OK reports whether the repository passed every check.
+func (c RepositoryCheck) OK() bool {
+	return c.Failed == ""
+}
+
+func (c RepositoryCheck) String() string {
+	if c.OK() {
+		return fmt.Sprintf("%s: ok, %d packages, signed with %s", c.Repository, c.Packages, c.Signer)
+	}
+	return fmt.Sprintf("%s: %s check failed: %v", c.Repository, c.Failed, c.Err)
+}
+
+// CheckRepositories checks each of the repositories: that its index can be fetched, for the
+// architecture, without the cache, that it is signed with one of the trusted keys, that it parses
+// without problems and that its packages are for the architecture. It returns a report for each
+// repository, in order, so that a build can fail early with a clear reason; the error is only for
+// what keeps the repositories from being checked at all, such as not being able to load the keys.
+func (a *APK) CheckRepositories(ctx context.Context) ([]RepositoryCheck, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "CheckRepositories")
+	defer span.End()
+
+	repos, err := a.GetRepositories()
+	if err != nil {
+		return nil, err
+	}
+	b, err := a.fs.ReadFile(archFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read arch file: %w", err)
+	}
+	arch := strings.TrimSpace(string(b))
+	httpClient := a.getClient()
+	keys, err := a.loadKeys(ctx, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	opts := &indexOpts{layout: a.layout, httpClient: httpClient, arches: a.repoArches}
+	if opts.layout == nil {
+		opts.layout = AlpineLayout{}
+	}
+
+	checks := make([]RepositoryCheck, 0, len(repos))
+	for _, repo := range repos {
+		checks = append(checks, checkRepository(ctx, repo, arch, keys, opts))
+	}
+	return checks, nil
+}
+
+func checkRepository(ctx context.Context, repo, arch string, keys map[string][]byte, opts *indexOpts) RepositoryCheck {
+	check := RepositoryCheck{Repository: repo}
+	fail := func(stage RepositoryCheckStage, err error) RepositoryCheck {
+		check.Failed, check.Err = stage, err
+		return check
+	}
+	_, repoURL, err := parseRepositoryLine(repo)
+	if err != nil {
+		return fail(CheckReachable, err)
+	}
+	// the packages are still checked against the root's architecture, as a repository may only name
+	// its directories its own way
+	repoArch := opts.repositoryArch(repoURL, arch)
+	check.IndexURL = opts.layout.IndexURL(repoURL, repoArch)
+
+	b, err := fetchIndex(ctx, check.IndexURL, repoArch, opts)
+	switch {
+	case errors.Is(err, errIndexNotFound):
+		return fail(CheckArch, err)
+	case err != nil:
+		return fail(CheckReachable, err)
+	case b == nil:
+		return fail(CheckArch, fmt.Errorf("%w for architecture %s at %s", errIndexNotFound, repoArch, check.IndexURL))
+	}
+	if check.Signer, err = verifyIndexSignature(b, check.IndexURL, keys); err != nil {
+		return fail(CheckSignature, err)
+	}
+	index, problems, err := parseIndexArchive(b, "", "")
+	if err != nil {
+		return fail(CheckIndex, err)
+	}
+	if len(problems) > 0 {
+		for i := range problems {
+			problems[i].Index = check.IndexURL
+		}
+		return fail(CheckIndex, &IndexProblemsError{Problems: problems})
+	}
+	check.Packages = len(index.Packages)
+
+	others := map[string]bool{}
+	for _, pkg := range index.Packages {
+		if pkg.Arch != arch && pkg.Arch != repoArch && pkg.Arch != "noarch" && pkg.Arch != "" {
+			others[pkg.Arch] = true
+		}
+	}
+	if len(others) > 0 {
+		names := make([]string, 0, len(others))
+		for name := range others {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fail(CheckArch, fmt.Errorf("index has packages for %s, not only %s", strings.Join(names, ", "), arch))
+	}
+	return check
+}
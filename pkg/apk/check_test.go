@@ -0,0 +1,75 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestCheckRepositories(t *testing.T) {
+	check := func(t *testing.T, arch string, keys bool, transport http.RoundTripper) RepositoryCheck {
+		src := apkfs.NewMemFS()
+		require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+		require.NoError(t, src.WriteFile(archFilePath, []byte(arch+"\n"), 0o644))
+		require.NoError(t, src.WriteFile(reposFilePath, []byte(testAlpineRepos), 0o644))
+		if keys {
+			for k, v := range testKeys {
+				require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, k), []byte(v), 0o644))
+			}
+		}
+		a, err := New(WithFS(src))
+		require.NoError(t, err)
+		a.SetClient(&http.Client{Transport: transport})
+		checks, err := a.CheckRepositories(context.Background())
+		require.NoError(t, err)
+		require.Len(t, checks, 1)
+		require.Equal(t, testAlpineRepos, checks[0].Repository)
+		return checks[0]
+	}
+	local := &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}
+
+	t.Run("ok", func(t *testing.T) {
+		c := check(t, "x86_64", true, local)
+		require.True(t, c.OK(), c.String())
+		require.Greater(t, c.Packages, 0)
+		require.NotEmpty(t, c.Signer)
+	})
+	t.Run("unreachable", func(t *testing.T) {
+		c := check(t, "x86_64", true, &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true, requireBasicAuth: true})
+		require.Equal(t, CheckReachable, c.Failed)
+	})
+	t.Run("no index for the arch", func(t *testing.T) {
+		c := check(t, "x86_64", true, &testLocalTransport{fail: true})
+		require.Equal(t, CheckArch, c.Failed, c.String())
+	})
+	t.Run("untrusted", func(t *testing.T) {
+		c := check(t, "x86_64", false, local)
+		require.Equal(t, CheckSignature, c.Failed)
+		var untrusted *UntrustedKeyError
+		require.ErrorAs(t, c.Err, &untrusted)
+	})
+	t.Run("packages of another arch", func(t *testing.T) {
+		c := check(t, "aarch64", true, local)
+		require.Equal(t, CheckArch, c.Failed)
+		require.ErrorContains(t, c.Err, "index has packages for x86_64")
+	})
+}
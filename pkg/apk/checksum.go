@@ -0,0 +1,184 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"  //nolint:gosec // this is what older apk tools is using
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// q1Prefix marks a checksum as SHA1, as opposed to the MD5 sums of older apk-tools.
+const q1Prefix = "Q1"
+
+// FormatQ1Checksum formats a SHA1 sum the way apk-tools writes it, both for the C: field of
+// index and installed database entries and for the Z: field of installed files: "Q1" followed
+// by the standard base64 encoding of the sum.
+func FormatQ1Checksum(sum []byte) string {
+	return q1Prefix + base64.StdEncoding.EncodeToString(sum)
+}
+
+// ParseQ1Checksum parses a checksum in the format written by FormatQ1Checksum into the SHA1 sum.
+func ParseQ1Checksum(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, q1Prefix) {
+		return nil, fmt.Errorf("checksum %q is not a Q1 checksum", s)
+	}
+	sum, err := base64.StdEncoding.DecodeString(s[len(q1Prefix):])
+	if err != nil {
+		return nil, fmt.Errorf("decoding checksum %q: %w", s, err)
+	}
+	if len(sum) != sha1.Size {
+		return nil, fmt.Errorf("checksum %q has %d bytes, expected %d", s, len(sum), sha1.Size)
+	}
+	return sum, nil
+}
+
+// Q1Checksum returns the checksum of everything read from r, formatted by FormatQ1Checksum.
+// Given the contents of an installed file, it is the value of its Z: record in the installed database.
+func Q1Checksum(r io.Reader) (string, error) {
+	h := sha1.New() //nolint:gosec // this is what apk tools is using
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return FormatQ1Checksum(h.Sum(nil)), nil
+}
+
+// PackageQ1Checksum returns the checksum that identifies the .apk package read from r in indexes and the
+// installed database, which is that of its control section, formatted by FormatQ1Checksum.
+func PackageQ1Checksum(ctx context.Context, r io.Reader) (string, error) {
+	exp, err := ExpandApk(ctx, r, "")
+	if err != nil {
+		return "", fmt.Errorf("expanding package: %w", err)
+	}
+	defer exp.Close()
+	return FormatQ1Checksum(exp.ControlHash), nil
+}
+
+// The algorithms of checksums, as Checksum.Algorithm.
+const (
+	ChecksumMD5    = "md5"
+	ChecksumSHA1   = "sha1"
+	ChecksumSHA256 = "sha256"
+)
+
+// Checksum is a checksum in any of the encodings apk-tools reads, for index C: fields, installed
+// database Z: records and the checksums in the PAX records of package files.
+type Checksum struct {
+	// Algorithm is one of ChecksumMD5, ChecksumSHA1 or ChecksumSHA256.
+	Algorithm string
+	Sum       []byte
+}
+
+// checksumEncodings are the prefixes of the encodings of checksums, after the letter for the
+// encoding, Q for base64 and X for hex.
+var checksumEncodings = map[byte]string{'1': ChecksumSHA1, '2': ChecksumSHA256}
+
+// checksumSizes are the sizes of the sums of the algorithms.
+var checksumSizes = map[string]int{ChecksumMD5: md5.Size, ChecksumSHA1: sha1.Size, ChecksumSHA256: sha256.Size}
+
+// ParseChecksum parses a checksum in any of the encodings of apk-tools: "Q1" or "Q2" followed by the
+// base64 of a SHA1 or SHA256 sum, "X1" or "X2" followed by its hex, or the bare hex of an MD5, SHA1
+// or SHA256 sum, told apart by its length.
+func ParseChecksum(s string) (Checksum, error) {
+	if len(s) > 2 && (s[0] == 'Q' || s[0] == 'X') {
+		algorithm, ok := checksumEncodings[s[1]]
+		if !ok {
+			return Checksum{}, fmt.Errorf("checksum %q has an unknown algorithm %c", s, s[1])
+		}
+		var sum []byte
+		var err error
+		if s[0] == 'Q' {
+			sum, err = base64.StdEncoding.DecodeString(s[2:])
+		} else {
+			sum, err = hex.DecodeString(s[2:])
+		}
+		if err != nil {
+			return Checksum{}, fmt.Errorf("decoding checksum %q: %w", s, err)
+		}
+		if len(sum) != checksumSizes[algorithm] {
+			return Checksum{}, fmt.Errorf("checksum %q has %d bytes, expected %d", s, len(sum), checksumSizes[algorithm])
+		}
+		return Checksum{Algorithm: algorithm, Sum: sum}, nil
+	}
+
+	sum, err := hex.DecodeString(s)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("decoding checksum %q: %w", s, err)
+	}
+	for _, algorithm := range []string{ChecksumMD5, ChecksumSHA1, ChecksumSHA256} {
+		if len(sum) == checksumSizes[algorithm] {
+			return Checksum{Algorithm: algorithm, Sum: sum}, nil
+		}
+	}
+	return Checksum{}, fmt.Errorf("checksum %q has %d bytes, which is not the size of any algorithm", s, len(sum))
+}
+
+// ComputeChecksum returns the checksum of the algorithm of everything read from r.
+func ComputeChecksum(algorithm string, r io.Reader) (Checksum, error) {
+	var h hash.Hash
+	switch algorithm {
+	case ChecksumMD5:
+		h = md5.New() //nolint:gosec // this is what older apk tools is using
+	case ChecksumSHA1:
+		h = sha1.New() //nolint:gosec // this is what apk tools is using
+	case ChecksumSHA256:
+		h = sha256.New()
+	default:
+		return Checksum{}, fmt.Errorf("unknown checksum algorithm %q", algorithm)
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return Checksum{}, err
+	}
+	return Checksum{Algorithm: algorithm, Sum: h.Sum(nil)}, nil
+}
+
+// String formats the checksum the way apk-tools writes it: "Q1" or "Q2" followed by the base64 of
+// a SHA1 or SHA256 sum, or the bare hex of an MD5 sum.
+func (c Checksum) String() string {
+	switch c.Algorithm {
+	case ChecksumSHA1:
+		return FormatQ1Checksum(c.Sum)
+	case ChecksumSHA256:
+		return "Q2" + base64.StdEncoding.EncodeToString(c.Sum)
+	default:
+		return hex.EncodeToString(c.Sum)
+	}
+}
+
+// Hex formats the checksum in its "X1" or "X2" form, followed by the hex of the sum, or the bare
+// hex of an MD5 sum.
+func (c Checksum) Hex() string {
+	switch c.Algorithm {
+	case ChecksumSHA1:
+		return "X1" + hex.EncodeToString(c.Sum)
+	case ChecksumSHA256:
+		return "X2" + hex.EncodeToString(c.Sum)
+	default:
+		return hex.EncodeToString(c.Sum)
+	}
+}
+
+// Equal reports whether the checksums are of the same algorithm and sum, however they were encoded.
+func (c Checksum) Equal(other Checksum) bool {
+	return c.Algorithm == other.Algorithm && bytes.Equal(c.Sum, other.Sum)
+}
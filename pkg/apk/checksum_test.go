@@ -0,0 +1,100 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQ1Checksum(t *testing.T) {
+	sum, err := hex.DecodeString("91abf197227d2fe71d016f4ccb68b16c9c9b2768")
+	require.NoError(t, err)
+	require.Equal(t, "Q1kavxlyJ9L+cdAW9My2ixbJybJ2g=", FormatQ1Checksum(sum))
+
+	parsed, err := ParseQ1Checksum("Q1kavxlyJ9L+cdAW9My2ixbJybJ2g=")
+	require.NoError(t, err)
+	require.Equal(t, sum, parsed)
+	for _, invalid := range []string{"kavxlyJ9L+cdAW9My2ixbJybJ2g=", "Q1not base64", "Q1AAAA"} {
+		_, err := ParseQ1Checksum(invalid)
+		require.Error(t, err, invalid)
+	}
+
+	// sha1 of "hello world"
+	checksum, err := Q1Checksum(strings.NewReader("hello world"))
+	require.NoError(t, err)
+	require.Equal(t, "Q1Kq5sNclPz7QV2+lfQIuc6R7oRu0=", checksum)
+}
+
+func TestPackageQ1Checksum(t *testing.T) {
+	f, err := os.Open(filepath.Join(testPrimaryPkgDir, "alpine-baselayout-3.2.0-r23.apk"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	// the sha1 of the control section, which is the gzip stream after the signature
+	checksum, err := PackageQ1Checksum(context.Background(), f)
+	require.NoError(t, err)
+	require.Equal(t, "Q1LLq2qDNrS/qRnhxQ3hsY/sHbQnc=", checksum)
+}
+
+func TestParseChecksum(t *testing.T) {
+	sha1Sum, err := hex.DecodeString("2aae6c35c94fcfb415dbe95f408b9ce91ee846ed")
+	require.NoError(t, err)
+	sha256Sum, err := hex.DecodeString("b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9")
+	require.NoError(t, err)
+	md5Sum, err := hex.DecodeString("5eb63bbbe01eeed093cb22bb8f5acdc3")
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		in   string
+		want Checksum
+	}{
+		{in: "Q1Kq5sNclPz7QV2+lfQIuc6R7oRu0=", want: Checksum{ChecksumSHA1, sha1Sum}},
+		{in: "X12aae6c35c94fcfb415dbe95f408b9ce91ee846ed", want: Checksum{ChecksumSHA1, sha1Sum}},
+		{in: "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed", want: Checksum{ChecksumSHA1, sha1Sum}},
+		{in: "Q2uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=", want: Checksum{ChecksumSHA256, sha256Sum}},
+		{in: "X2b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", want: Checksum{ChecksumSHA256, sha256Sum}},
+		{in: "5eb63bbbe01eeed093cb22bb8f5acdc3", want: Checksum{ChecksumMD5, md5Sum}},
+	} {
+		got, err := ParseChecksum(tt.in)
+		require.NoError(t, err, tt.in)
+		require.True(t, tt.want.Equal(got), tt.in)
+	}
+	for _, invalid := range []string{"Q3AAAA", "Q1AAAA", "X1zz", "abcd", "not a checksum"} {
+		_, err := ParseChecksum(invalid)
+		require.Error(t, err, invalid)
+	}
+
+	for _, algorithm := range []string{ChecksumMD5, ChecksumSHA1, ChecksumSHA256} {
+		c, err := ComputeChecksum(algorithm, strings.NewReader("hello world"))
+		require.NoError(t, err)
+		for _, encoded := range []string{c.String(), c.Hex()} {
+			parsed, err := ParseChecksum(encoded)
+			require.NoError(t, err, encoded)
+			require.True(t, c.Equal(parsed), encoded)
+		}
+	}
+	c, err := ComputeChecksum(ChecksumSHA1, strings.NewReader("hello world"))
+	require.NoError(t, err)
+	require.Equal(t, "Q1Kq5sNclPz7QV2+lfQIuc6R7oRu0=", c.String())
+	_, err = ComputeChecksum("crc32", strings.NewReader(""))
+	require.Error(t, err)
+}
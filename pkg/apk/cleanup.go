@@ -0,0 +1,107 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// CleanupPolicy names paths of the filesystem that are removed after the packages are installed,
+// such as caches or documentation an image does not need. Files of packages that are removed stay
+// listed in the installed database.
+type CleanupPolicy struct {
+	Name string
+	// Paths are fs.Glob patterns, relative to the root, of the paths to remove, with whatever is below them.
+	Paths []string
+}
+
+var (
+	// CleanupNone leaves everything.
+	CleanupNone = CleanupPolicy{Name: "none"}
+	// CleanupCache removes the contents of the apk cache and of the temporary directories.
+	CleanupCache = CleanupPolicy{Name: "cache", Paths: []string{"var/cache/apk/*", "tmp/*", "var/tmp/*"}}
+	// CleanupDocs removes man and info pages and other documentation.
+	CleanupDocs = CleanupPolicy{Name: "docs", Paths: []string{"usr/share/man", "usr/share/info", "usr/share/doc", "usr/share/gtk-doc"}}
+	// CleanupLocales removes translations.
+	CleanupLocales = CleanupPolicy{Name: "locales", Paths: []string{"usr/share/locale", "usr/lib/locale"}}
+)
+
+// CleanupPolicies are the named policies, for CleanupPolicyByName.
+var CleanupPolicies = []CleanupPolicy{CleanupNone, CleanupCache, CleanupDocs, CleanupLocales}
+
+// CleanupPolicyByName returns the policy of CleanupPolicies with the name.
+func CleanupPolicyByName(name string) (CleanupPolicy, error) {
+	names := make([]string, 0, len(CleanupPolicies))
+	for _, p := range CleanupPolicies {
+		if p.Name == name {
+			return p, nil
+		}
+		names = append(names, p.Name)
+	}
+	return CleanupPolicy{}, fmt.Errorf("unknown cleanup policy %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// cleanup removes the paths of the cleanup policies.
+func (a *APK) cleanup() error {
+	for _, policy := range a.cleanupPolicies {
+		for _, pattern := range policy.Paths {
+			matches, err := fs.Glob(a.fs, pattern)
+			if err != nil {
+				return fmt.Errorf("cleanup policy %s: %w", policy.Name, err)
+			}
+			for _, p := range matches {
+				if err := a.removeAll(p); err != nil {
+					return fmt.Errorf("cleanup policy %s: removing %s: %w", policy.Name, p, err)
+				}
+			}
+			if len(matches) > 0 {
+				a.logger.Debugf("cleanup policy %s removed %d paths matching %s", policy.Name, len(matches), pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// removeAll removes the path and whatever is below it, the deepest paths first.
+func (a *APK) removeAll(p string) error {
+	var paths []string
+	err := fs.WalkDir(a.fs, p, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return strings.Count(paths[i], "/") > strings.Count(paths[j], "/")
+	})
+	for _, p := range paths {
+		if err := a.fs.Remove(path.Clean(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestCleanup(t *testing.T) {
+	fs := apkfs.NewMemFS()
+	for _, p := range []string{
+		"var/cache/apk/APKINDEX.abc.tar.gz",
+		"tmp/build/out.o",
+		"usr/share/man/man1/ls.1.gz",
+		"usr/share/locale/de/LC_MESSAGES/x.mo",
+		"usr/bin/ls",
+	} {
+		require.NoError(t, fs.MkdirAll(path.Dir(p), 0o755))
+		require.NoError(t, fs.WriteFile(p, []byte("x"), 0o644))
+	}
+
+	policy, err := CleanupPolicyByName("docs")
+	require.NoError(t, err)
+	a, err := New(WithFS(fs), WithCleanup(CleanupCache, policy))
+	require.NoError(t, err)
+	require.NoError(t, a.cleanup())
+
+	for p, exists := range map[string]bool{
+		"var/cache/apk":                        true,
+		"var/cache/apk/APKINDEX.abc.tar.gz":    false,
+		"tmp":                                  true,
+		"tmp/build":                            false,
+		"usr/share/man":                        false,
+		"usr/share/locale/de/LC_MESSAGES/x.mo": true,
+		"usr/bin/ls":                           true,
+	} {
+		_, err := fs.Stat(p)
+		if exists {
+			require.NoError(t, err, p)
+		} else {
+			require.ErrorIs(t, err, os.ErrNotExist, p)
+		}
+	}
+
+	_, err = CleanupPolicyByName("everything")
+	require.ErrorContains(t, err, "unknown cleanup policy")
+}
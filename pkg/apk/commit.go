@@ -0,0 +1,56 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// CommitMatches reports whether the package was built from the commit, the c: field of its index
+// entry, which is the commit of the aports tree, or other source repository, that it was built from.
+// The commit can be abbreviated, as by git, to at least 7 characters; packages with no commit match
+// no commit.
+func CommitMatches(pkg *repository.Package, commit string) bool {
+	if pkg.RepoCommit == "" || len(commit) < 7 {
+		return false
+	}
+	return strings.HasPrefix(strings.ToLower(pkg.RepoCommit), strings.ToLower(commit))
+}
+
+// IndexesFromCommit returns the indexes with only the packages that were built from the commit, as
+// in CommitMatches, e.g. to check that a rebuild of the world from that commit gets the same packages.
+// Indexes other than those of GetRepositoryIndexes are returned as they are.
+func IndexesFromCommit(indexes []NamedIndex, commit string) []NamedIndex {
+	filtered := make([]NamedIndex, 0, len(indexes))
+	for _, index := range indexes {
+		named, ok := index.(*namedRepositoryWithIndex)
+		if !ok || named.repo == nil {
+			filtered = append(filtered, index)
+			continue
+		}
+		var pkgs []*repository.Package
+		for _, pkg := range named.repo.Packages() {
+			if CommitMatches(pkg.Package, commit) {
+				pkgs = append(pkgs, pkg.Package)
+			}
+		}
+		copied := *named
+		copied.repo = named.repo.Repository.WithIndex(&repository.ApkIndex{Packages: pkgs})
+		filtered = append(filtered, &copied)
+	}
+	return filtered
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestIndexesFromCommit(t *testing.T) {
+	const (
+		older = "0123456789abcdef0123456789abcdef01234567"
+		newer = "fedcba9876543210fedcba9876543210fedcba98"
+	)
+	index := &repository.ApkIndex{Packages: []*repository.Package{
+		{Name: "hello", Version: "1.0-r0", RepoCommit: older, Dependencies: []string{"libhello"}},
+		{Name: "hello", Version: "2.0-r0", RepoCommit: newer, Dependencies: []string{"libhello"}},
+		{Name: "libhello", Version: "1.0-r0", RepoCommit: older},
+		{Name: "libhello", Version: "2.0-r0", RepoCommit: newer},
+		{Name: "nocommit", Version: "1.0-r0"},
+	}}
+	repo := &repository.Repository{Uri: "local"}
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(index)})
+
+	require.True(t, CommitMatches(index.Packages[0], older))
+	require.True(t, CommitMatches(index.Packages[0], "0123456"))
+	require.True(t, CommitMatches(index.Packages[0], "0123456789ABCDEF"))
+	require.False(t, CommitMatches(index.Packages[0], "012345"), "too short to be a commit")
+	require.False(t, CommitMatches(index.Packages[0], newer))
+	require.False(t, CommitMatches(index.Packages[4], "0123456"))
+
+	filtered := IndexesFromCommit(indexes, older[:7])
+	require.Len(t, filtered, 1)
+	require.Equal(t, 2, filtered[0].Count())
+	require.Equal(t, indexes[0].Source(), filtered[0].Source())
+	require.Equal(t, 5, indexes[0].Count(), "the indexes given are left as they were")
+
+	resolver := NewPkgResolver(context.Background(), filtered)
+	pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"hello"})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 2)
+	for _, pkg := range pkgs {
+		require.Equal(t, "1.0-r0", pkg.Version)
+		require.Equal(t, "local", pkg.Repository().Uri)
+	}
+
+	_, _, err = NewPkgResolver(context.Background(), filtered).GetPackagesWithDependencies(context.Background(), []string{"nocommit"})
+	require.Error(t, err)
+
+	_, err = New(WithRepoCommit("abc"))
+	require.ErrorContains(t, err, "too short")
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build compat
+// +build compat
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/chainguard-dev/go-apk/pkg/fsdiff"
+)
+
+const (
+	compatDefaultImage    = "alpine:3.18"
+	compatDefaultPackages = "alpine-baselayout busybox"
+)
+
+// compatIgnore are the paths that apk-tools and go-apk are not expected to agree on: caches, lock
+// files, device nodes, the scripts archive, which holds timestamps, the scripts that go-apk records
+// as pending, and the keys and repositories, which apk-tools is given on the command line.
+var compatIgnore = []string{
+	"etc/apk/keys",
+	"etc/apk/repositories",
+	"dev",
+	"proc",
+	"sys",
+	"var/cache",
+	"lib/apk/db/lock",
+	"lib/apk/db/scripts.tar",
+	"lib/apk/db/scripts.pending",
+	"lib/apk/exec",
+}
+
+// TestCompat installs the same packages with apk-tools, in a container, and with go-apk, and compares
+// the results. It needs docker and network access, so it only runs with:
+//
+//	go test -tags compat ./pkg/apk/ -run TestCompat
+//
+// GOAPK_COMPAT_IMAGE sets the alpine image to use, and GOAPK_COMPAT_PACKAGES a space separated
+// list of the packages to install.
+func TestCompat(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not available")
+	}
+	image := compatEnv("GOAPK_COMPAT_IMAGE", compatDefaultImage)
+	packages := strings.Fields(compatEnv("GOAPK_COMPAT_PACKAGES", compatDefaultPackages))
+	version := strings.TrimPrefix(image[strings.LastIndex(image, ":")+1:], "v")
+	repo := fmt.Sprintf("%s/v%s/main", alpineRepositoriesURL, version)
+	arch := ArchToAPK(runtime.GOARCH)
+	ctx := context.Background()
+
+	// apk-tools, in a container of the same release
+	apkRoot := t.TempDir()
+	args := []string{
+		"run", "--rm", "-v", apkRoot + ":/out", image,
+		"apk", "add", "--root", "/out", "--initdb", "--no-cache", "--no-scripts",
+		"--keys-dir", "/etc/apk/keys", "--repository", repo,
+	}
+	out, err := exec.Command("docker", append(args, packages...)...).CombinedOutput() //nolint:gosec // the arguments are our own
+	require.NoError(t, err, "apk-tools failed: %s", out)
+	// let the test clean up what the container wrote as root
+	_ = exec.Command("docker", "run", "--rm", "-v", apkRoot+":/out", image, //nolint:gosec // the arguments are our own
+		"chown", "-R", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()), "/out").Run()
+
+	// go-apk
+	goRoot := t.TempDir()
+	a, err := New(WithFS(apkfs.DirFS(goRoot)), WithArch(arch), WithIgnoreMknodErrors(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx, version))
+	require.NoError(t, a.SetRepositories([]string{repo}))
+	require.NoError(t, a.SetWorld(packages))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	diffs, err := fsdiff.Diff(apkfs.DirFS(apkRoot), apkfs.DirFS(goRoot), fsdiff.WithIgnore(compatIgnore...))
+	require.NoError(t, err)
+	for _, d := range diffs {
+		t.Errorf("apk-tools and go-apk differ: %s", d)
+	}
+}
+
+func compatEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The compressions of package sections told apart by sniffCompression.
+const (
+	CompressionGzip  = "gzip"
+	CompressionBzip2 = "bzip2"
+	CompressionXz    = "xz"
+	CompressionZstd  = "zstd"
+	CompressionLz4   = "lz4"
+	// CompressionNone is a plain tar section.
+	CompressionNone = "none"
+)
+
+// sniffLength is how much of a section sniffCompression needs to recognize all the compressions,
+// up to the end of the magic of a tar header.
+const sniffLength = 262
+
+var compressionMagics = []struct {
+	compression string
+	magic       []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionBzip2, []byte("BZh")},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressionLz4, []byte{0x04, 0x22, 0x4d, 0x18}},
+}
+
+// sniffCompression returns the compression of the section starting with b, from its magic bytes,
+// or "" if it is not recognized.
+func sniffCompression(b []byte) string {
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(b, m.magic) {
+			return m.compression
+		}
+	}
+	if len(b) >= sniffLength && bytes.Equal(b[257:262], []byte("ustar")) {
+		return CompressionNone
+	}
+	return ""
+}
+
+// UnsupportedCompressionError is returned for packages with a section that is not gzipped, such as
+// those of build systems writing plain tar or bzip2 sections, which apk does not support either.
+//
+// Other compressions are recognized only to explain the error, not decoded, even bzip2 which the
+// standard library could read. The sections of a package are found at the ends of its gzip streams,
+// and the checksum identifying it in an index, and the hash its signature covers, are those of the
+// gzipped bytes, so a package with other sections could not be verified or matched to an index. The
+// expanded sections are also kept gzipped for everything reading them afterwards. Decoding them
+// would only install packages that apk itself rejects.
+type UnsupportedCompressionError struct {
+	// Compression is the compression of the section, one of the Compression constants.
+	Compression string
+}
+
+func (e *UnsupportedCompressionError) Error() string {
+	if e.Compression == CompressionNone {
+		return "unsupported compression: none (plain tar), sections must be gzipped"
+	}
+	return fmt.Sprintf("unsupported compression: %s, sections must be gzipped", e.Compression)
+}
+
+// sectionCompressionError returns the error for a section that failed to be read as gzip with err,
+// explaining what its compression is instead, if it is recognized. The start of the section is in
+// the file, which r writes to as it is read; more of it is read for the compression to be sniffed.
+func sectionCompressionError(r io.Reader, file string, err error) error {
+	if _, copyErr := io.CopyN(io.Discard, r, sniffLength); copyErr != nil && !errors.Is(copyErr, io.EOF) {
+		return err
+	}
+	f, openErr := os.Open(file)
+	if openErr != nil {
+		return err
+	}
+	defer f.Close()
+	b := make([]byte, sniffLength)
+	n, _ := io.ReadFull(f, b)
+	return compressionError(b[:n], err)
+}
+
+// compressionError returns an UnsupportedCompressionError for the section starting with b, if its
+// compression is recognized, or else err.
+func compressionError(b []byte, err error) error {
+	if c := sniffCompression(b); c != "" && c != CompressionGzip {
+		return &UnsupportedCompressionError{Compression: c}
+	}
+	return err
+}
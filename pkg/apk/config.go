@@ -0,0 +1,218 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// Config is the configuration of an APK, as plain data, for tools built on the library to read from
+// JSON or YAML files with NewFromConfig, or to log or record the exact settings they used, as Config
+// returns them. Settings that are not data, such as the filesystem, logger, executor and selectors,
+// are given as options to NewFromConfig instead, and are only noted as being set.
+type Config struct {
+	Arch              string `json:"arch" yaml:"arch"`
+	Version           string `json:"version,omitempty" yaml:"version,omitempty"`
+	CacheDir          string `json:"cacheDir,omitempty" yaml:"cacheDir,omitempty"`
+	CacheOffline      bool   `json:"cacheOffline,omitempty" yaml:"cacheOffline,omitempty"`
+	IgnoreMknodErrors bool   `json:"ignoreMknodErrors,omitempty" yaml:"ignoreMknodErrors,omitempty"`
+	// Repositories are the lines of /etc/apk/repositories of the root, if it has them.
+	Repositories         []string          `json:"repositories,omitempty" yaml:"repositories,omitempty"`
+	RepositoryPriorities map[string]int    `json:"repositoryPriorities,omitempty" yaml:"repositoryPriorities,omitempty"`
+	RepositoryArches     map[string]string `json:"repositoryArches,omitempty" yaml:"repositoryArches,omitempty"`
+	RepositoryCommit     string            `json:"repositoryCommit,omitempty" yaml:"repositoryCommit,omitempty"`
+	KeyringDirs          []string          `json:"keyringDirs,omitempty" yaml:"keyringDirs,omitempty"`
+	KeyringURLs          []string          `json:"keyringURLs,omitempty" yaml:"keyringURLs,omitempty"`
+	AllowUntrusted       bool              `json:"allowUntrusted,omitempty" yaml:"allowUntrusted,omitempty"`
+	AllowDowngrade       bool              `json:"allowDowngrade,omitempty" yaml:"allowDowngrade,omitempty"`
+	FailOnDowngrade      bool              `json:"failOnDowngrade,omitempty" yaml:"failOnDowngrade,omitempty"`
+	StrictIndexes        bool              `json:"strictIndexes,omitempty" yaml:"strictIndexes,omitempty"`
+	ShardedIndexes       bool              `json:"shardedIndexes,omitempty" yaml:"shardedIndexes,omitempty"`
+	RejectKeyChanges     bool              `json:"rejectKeyChanges,omitempty" yaml:"rejectKeyChanges,omitempty"`
+	Deltas               bool              `json:"deltas,omitempty" yaml:"deltas,omitempty"`
+	CacheClone           apkfs.CloneMode   `json:"cacheClone,omitempty" yaml:"cacheClone,omitempty"`
+	Dedup                bool              `json:"dedup,omitempty" yaml:"dedup,omitempty"`
+	Fsync                bool              `json:"fsync,omitempty" yaml:"fsync,omitempty"`
+	FirstBoot            bool              `json:"firstBoot,omitempty" yaml:"firstBoot,omitempty"`
+	MaxInstalledSize     uint64            `json:"maxInstalledSize,omitempty" yaml:"maxInstalledSize,omitempty"`
+	ScriptPolicy         *ScriptPolicy     `json:"scriptPolicy,omitempty" yaml:"scriptPolicy,omitempty"`
+	Cleanup              []string          `json:"cleanup,omitempty" yaml:"cleanup,omitempty"`
+	Hosts                map[string]string `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+	PinnedCerts          []string          `json:"pinnedCerts,omitempty" yaml:"pinnedCerts,omitempty"`
+	FetchTracing         bool              `json:"fetchTracing,omitempty" yaml:"fetchTracing,omitempty"`
+	BestEffort           bool              `json:"bestEffort,omitempty" yaml:"bestEffort,omitempty"`
+	TimestampOverride    *time.Time        `json:"timestampOverride,omitempty" yaml:"timestampOverride,omitempty"`
+	Mirrors              []MirrorSelection `json:"mirrors,omitempty" yaml:"mirrors,omitempty"`
+	MaxIndexAge          time.Duration     `json:"maxIndexAge,omitempty" yaml:"maxIndexAge,omitempty"`
+	FailStaleIndexes     bool              `json:"failStaleIndexes,omitempty" yaml:"failStaleIndexes,omitempty"`
+	InstallRoot          string            `json:"installRoot,omitempty" yaml:"installRoot,omitempty"`
+	// Executor is whether the scripts of packages are run, with WithExecutor. It is ignored by
+	// NewFromConfig.
+	Executor bool `json:"executor,omitempty" yaml:"executor,omitempty"`
+	// ScriptLinter is whether the scripts of packages are linted, with WithScriptLinter. It is ignored
+	// by NewFromConfig.
+	ScriptLinter bool `json:"scriptLinter,omitempty" yaml:"scriptLinter,omitempty"`
+	// PackageVerifiers is whether packages are verified for any repository, with WithPackageVerifier.
+	// It is ignored by NewFromConfig.
+	PackageVerifiers bool `json:"packageVerifiers,omitempty" yaml:"packageVerifiers,omitempty"`
+	// Client is whether a client was set with SetClient, which the settings of the default client,
+	// such as Hosts and PinnedCerts, do not apply to. It is ignored by NewFromConfig.
+	Client bool `json:"client,omitempty" yaml:"client,omitempty"`
+}
+
+// Config returns the effective configuration of the APK, with the defaults of the options that
+// were not given.
+func (a *APK) Config() (Config, error) {
+	cfg := Config{
+		Arch:                 a.arch,
+		Version:              a.version,
+		IgnoreMknodErrors:    a.ignoreMknodErrors,
+		RepositoryPriorities: a.repoPriorities,
+		RepositoryArches:     a.repoArches,
+		RepositoryCommit:     a.repoCommit,
+		KeyringDirs:          a.keyringDirs,
+		KeyringURLs:          a.keyringURLs,
+		AllowUntrusted:       a.ignoreSignatures,
+		AllowDowngrade:       a.allowDowngrade,
+		FailOnDowngrade:      a.failOnDowngrade,
+		StrictIndexes:        a.strictIndexes,
+		ShardedIndexes:       a.shardedIndexes,
+		RejectKeyChanges:     a.rejectKeyChanges,
+		Deltas:               a.deltas,
+		CacheClone:           a.cacheClone,
+		Dedup:                a.dedup != nil,
+		Fsync:                a.fsync,
+		FirstBoot:            a.firstBoot,
+		MaxInstalledSize:     a.maxInstalledSize,
+		Hosts:                a.hosts,
+		PinnedCerts:          a.pinnedCerts,
+		FetchTracing:         a.traceFetches,
+		BestEffort:           a.bestEffort,
+		Mirrors:              a.mirrors,
+		MaxIndexAge:          a.maxIndexAge,
+		FailStaleIndexes:     a.failStaleIndexes,
+		Executor:             a.executor != nil,
+		ScriptLinter:         a.scriptLinter != nil,
+		PackageVerifiers:     len(a.packageVerifiers) > 0,
+		Client:               a.client != nil,
+	}
+	if a.installRoot != "" {
+		cfg.InstallRoot = "/" + a.installRoot
+	}
+	if !a.timestampOverride.IsZero() {
+		t := a.timestampOverride
+		cfg.TimestampOverride = &t
+	}
+	if a.cache != nil {
+		cfg.CacheDir = a.cache.dir
+		cfg.CacheOffline = a.cache.offline
+	}
+	if a.scriptPolicy.Skip || len(a.scriptPolicy.Allow) > 0 || len(a.scriptPolicy.Deny) > 0 {
+		policy := a.scriptPolicy
+		cfg.ScriptPolicy = &policy
+	}
+	for _, policy := range a.cleanupPolicies {
+		cfg.Cleanup = append(cfg.Cleanup, policy.Name)
+	}
+	repos, err := a.GetRepositories()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return cfg, err
+	}
+	cfg.Repositories = repos
+	return cfg, nil
+}
+
+// NewFromConfig returns an APK with the configuration, as New does with the equivalent options,
+// followed by the options given, which come after those of the configuration and so override them.
+// The repositories of the configuration, if any, are written to the root, as SetRepositories does.
+func NewFromConfig(cfg Config, options ...Option) (*APK, error) {
+	cfgOptions := []Option{
+		WithIgnoreMknodErrors(cfg.IgnoreMknodErrors),
+		WithRepoCommit(cfg.RepositoryCommit),
+		WithKeyringDirs(cfg.KeyringDirs...),
+		WithKeyringURLs(cfg.KeyringURLs...),
+		WithAllowUntrusted(cfg.AllowUntrusted),
+		WithAllowDowngrade(cfg.AllowDowngrade),
+		WithFailOnDowngrade(cfg.FailOnDowngrade),
+		WithStrictIndexes(cfg.StrictIndexes),
+		WithShardedIndexes(cfg.ShardedIndexes),
+		WithRejectKeyChanges(cfg.RejectKeyChanges),
+		WithDeltas(cfg.Deltas),
+		WithCacheClone(cfg.CacheClone),
+		WithDedup(cfg.Dedup),
+		WithFsync(cfg.Fsync),
+		WithFirstBoot(cfg.FirstBoot),
+		WithMaxInstalledSize(cfg.MaxInstalledSize),
+		WithPinnedCerts(cfg.PinnedCerts...),
+		WithFetchTracing(cfg.FetchTracing),
+		WithBestEffort(cfg.BestEffort),
+		WithMaxIndexAge(cfg.MaxIndexAge, cfg.FailStaleIndexes),
+		WithInstallRoot(cfg.InstallRoot),
+	}
+	if cfg.Arch != "" {
+		cfgOptions = append(cfgOptions, WithArch(cfg.Arch))
+	}
+	if cfg.Version != "" {
+		cfgOptions = append(cfgOptions, WithVersion(cfg.Version))
+	}
+	if cfg.CacheDir != "" || cfg.CacheOffline {
+		cfgOptions = append(cfgOptions, WithCache(cfg.CacheDir, cfg.CacheOffline))
+	}
+	if len(cfg.RepositoryPriorities) > 0 {
+		cfgOptions = append(cfgOptions, WithRepositoryPriorities(cfg.RepositoryPriorities))
+	}
+	if len(cfg.RepositoryArches) > 0 {
+		cfgOptions = append(cfgOptions, WithRepositoryArches(cfg.RepositoryArches))
+	}
+	if cfg.ScriptPolicy != nil {
+		cfgOptions = append(cfgOptions, WithScriptPolicy(*cfg.ScriptPolicy))
+	}
+	if len(cfg.Mirrors) > 0 {
+		cfgOptions = append(cfgOptions, WithMirrorSelection(cfg.Mirrors...))
+	}
+	if cfg.TimestampOverride != nil {
+		cfgOptions = append(cfgOptions, WithTimestampOverride(*cfg.TimestampOverride))
+	}
+	for _, name := range cfg.Cleanup {
+		policy, err := CleanupPolicyByName(name)
+		if err != nil {
+			return nil, err
+		}
+		cfgOptions = append(cfgOptions, WithCleanup(policy))
+	}
+	if len(cfg.Hosts) > 0 {
+		cfgOptions = append(cfgOptions, WithHosts(cfg.Hosts))
+	}
+
+	a, err := New(append(cfgOptions, options...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Repositories) > 0 {
+		if err := a.fs.MkdirAll(filepath.Dir(reposFilePath), 0o755); err != nil {
+			return nil, fmt.Errorf("creating %s: %w", filepath.Dir(reposFilePath), err)
+		}
+		if err := a.SetRepositories(cfg.Repositories); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
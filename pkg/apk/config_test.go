@@ -0,0 +1,91 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestConfig(t *testing.T) {
+	cacheDir := t.TempDir()
+	a, err := New(WithFS(apkfs.NewMemFS()), WithArch("x86_64"), WithCache(cacheDir, false), WithCleanup(CleanupDocs),
+		WithHosts(map[string]string{"dl-cdn.alpinelinux.org": "10.0.0.5"}), WithScriptPolicy(ScriptPolicy{Deny: []string{"busybox"}}))
+	require.NoError(t, err)
+
+	// before there is a repositories file
+	cfg, err := a.Config()
+	require.NoError(t, err)
+	require.Empty(t, cfg.Repositories)
+
+	require.NoError(t, a.InitDB(context.Background()))
+	require.NoError(t, a.SetRepositories([]string{"https://dl-cdn.alpinelinux.org/alpine/v3.18/main"}))
+	cfg, err = a.Config()
+	require.NoError(t, err)
+	require.Equal(t, Config{
+		Arch:         "x86_64",
+		CacheDir:     cacheDir,
+		Repositories: []string{"https://dl-cdn.alpinelinux.org/alpine/v3.18/main"},
+		Cleanup:      []string{CleanupDocs.Name},
+		Hosts:        map[string]string{"dl-cdn.alpinelinux.org": "10.0.0.5"},
+		ScriptPolicy: &ScriptPolicy{Deny: []string{"busybox"}},
+	}, cfg)
+
+	b, err := json.Marshal(cfg)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"arch": "x86_64",
+		"cacheDir": "`+cacheDir+`",
+		"repositories": ["https://dl-cdn.alpinelinux.org/alpine/v3.18/main"],
+		"cleanup": ["docs"],
+		"hosts": {"dl-cdn.alpinelinux.org": "10.0.0.5"},
+		"scriptPolicy": {"deny": ["busybox"]}
+	}`, string(b))
+}
+
+func TestNewFromConfig(t *testing.T) {
+	var cfg Config
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"arch": "aarch64",
+		"cacheDir": "`+t.TempDir()+`",
+		"deltas": true,
+		"repositories": ["@edge https://dl-cdn.alpinelinux.org/alpine/edge/main", "https://dl-cdn.alpinelinux.org/alpine/v3.18/main"],
+		"repositoryPriorities": {"https://dl-cdn.alpinelinux.org/alpine/v3.18/main": 10},
+		"cleanup": ["cache", "docs"],
+		"scriptPolicy": {"skip": true, "allow": ["ca-certificates"]}
+	}`), &cfg))
+
+	a, err := NewFromConfig(cfg, WithFS(apkfs.NewMemFS()))
+	require.NoError(t, err)
+	got, err := a.Config()
+	require.NoError(t, err)
+	require.Equal(t, cfg, got)
+
+	// the options come after the configuration
+	a, err = NewFromConfig(cfg, WithFS(apkfs.NewMemFS()), WithArch("x86_64"))
+	require.NoError(t, err)
+	require.Equal(t, "x86_64", a.arch)
+
+	_, err = NewFromConfig(Config{Cleanup: []string{"everything"}})
+	require.Error(t, err)
+	_, err = NewFromConfig(Config{Deltas: true})
+	var invalid *InvalidOptionsError
+	require.ErrorAs(t, err, &invalid)
+}
@@ -27,11 +27,17 @@ const (
 	scriptsFilePath   = "lib/apk/db/scripts.tar"
 	scriptsTarPerms   = 0o644
 	triggersFilePath  = "lib/apk/db/triggers"
+	// the scripts that were not run, for a later run such as at first boot
+	pendingScriptsFilePath = "lib/apk/db/scripts.pending"
+	// where scripts are put to be run, as by apk-tools
+	scriptsExecDir = "lib/apk/exec"
 	// which PAX record we use in the tar header
 	paxRecordsChecksumKey = "APK-TOOLS.checksum.SHA1"
 
 	// for fetching the alpine keys
 	alpineReleasesURL = "https://alpinelinux.org/releases.json"
+	// base of the official alpine package repositories
+	alpineRepositoriesURL = "https://dl-cdn.alpinelinux.org/alpine"
 
 	xattrTarPAXRecordsPrefix = "SCHILY.xattr."
 )
@@ -0,0 +1,213 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// controlChunkSize is the size of the first range of a package requested by FetchControl. The
+// signature and control sections of most packages fit in it; each further range is twice as big.
+const controlChunkSize = 64 << 10
+
+// PackageControl is the metadata of a package, read from its signature and control sections.
+type PackageControl struct {
+	// Package is the index entry of the package, from its .PKGINFO, with the checksum of its
+	// control section. Its size is not known without the data section, so is left empty.
+	Package *repository.Package
+	// Scripts are the scripts of the package, by name without the leading dot, e.g. post-install.
+	Scripts map[string][]byte
+	// Triggers are the directories, or globs of them, that the trigger script is run for when the
+	// contents of any of them change, from the triggers of the .PKGINFO.
+	Triggers []string
+	// Signature is the gzipped signature section, or nil if the package is not signed.
+	Signature []byte
+	// Control is the gzipped control section, whose sha1 is the checksum of the package.
+	Control []byte
+}
+
+// FetchControl returns the signature and control sections of the package, without its data
+// section. They are at the front of the file, so only as much of it as they need is fetched, with
+// HTTP range requests, which makes it cheap to look at the metadata and scripts of big packages.
+// If the server does not support range requests, the download is stopped once they are read. The
+// control section is verified against the checksum of the package, if it has one.
+func (a *APK) FetchControl(ctx context.Context, pkg *repository.RepositoryPackage) (*PackageControl, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "FetchControl", trace.WithAttributes(attribute.String("package", pkg.Name)))
+	defer span.End()
+
+	u := pkg.Url()
+	asURL, err := packageAsURL(pkg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse package as URL: %w", err)
+	}
+
+	var fetch func(off, n int64) ([]byte, error)
+	switch asURL.Scheme {
+	case "file":
+		f, err := os.Open(u)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read repository package apk %s: %w", u, err)
+		}
+		defer f.Close()
+		fetch = func(off, n int64) ([]byte, error) {
+			b := make([]byte, n)
+			read, err := f.ReadAt(b, off)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			return b[:read], nil
+		}
+	case "https":
+		fetch = func(off, n int64) ([]byte, error) {
+			return a.fetchRange(ctx, u, off, n)
+		}
+	default:
+		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+	}
+
+	var b []byte
+	for n := int64(controlChunkSize); ; n *= 2 {
+		chunk, err := fetch(int64(len(b)), n)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get package apk at %s: %w", u, err)
+		}
+		b = append(b, chunk...)
+		control, err := parseControl(b)
+		if errors.Is(err, io.ErrUnexpectedEOF) && int64(len(chunk)) == n {
+			// the sections go on past what has been fetched so far
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading control section of %s: %w", u, err)
+		}
+		if len(pkg.Checksum) > 0 && !bytes.Equal(pkg.Checksum, control.Package.Checksum) {
+			return nil, fmt.Errorf("control section of %s does not match checksum %s", u, FormatQ1Checksum(pkg.Checksum))
+		}
+		return control, nil
+	}
+}
+
+// fetchRange gets n bytes of u from off, or fewer at the end of it. A server that ignores the range
+// is read from the start, up to the end of the range.
+func (a *APK) fetchRange(ctx context.Context, u string, off, n int64) ([]byte, error) {
+	client := a.getClient()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		return io.ReadAll(io.LimitReader(res.Body, n))
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, res.Body, off); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return io.ReadAll(io.LimitReader(res.Body, n))
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the range starts past the end
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+}
+
+// parseControl returns the control of the package whose apk starts with b. It returns an error
+// wrapping io.ErrUnexpectedEOF if b ends before the control section does.
+func parseControl(b []byte) (*PackageControl, error) {
+	// the reader reads no further than the end of each gzip stream, as it is an io.ByteReader
+	r := bytes.NewReader(b)
+	first, err := readGzipStream(r)
+	if err != nil {
+		return nil, err
+	}
+	firstEnd := len(b) - r.Len()
+	control := &PackageControl{Control: b[:firstEnd]}
+	hdr, err := tar.NewReader(bytes.NewReader(first)).Next()
+	if err != nil {
+		return nil, fmt.Errorf("reading first section: %w", err)
+	}
+	if strings.HasPrefix(hdr.Name, ".SIGN.") {
+		if _, err := readGzipStream(r); err != nil {
+			return nil, err
+		}
+		control.Signature = b[:firstEnd]
+		control.Control = b[firstEnd : len(b)-r.Len()]
+	}
+
+	values, err := controlValues(bytes.NewReader(control.Control))
+	if err != nil {
+		return nil, err
+	}
+	if control.Package, err = packageFromInfo(values); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(control.Control) //nolint:gosec // this is what apk tools is using
+	control.Package.Checksum = sum[:]
+	for _, triggers := range values["triggers"] {
+		control.Triggers = append(control.Triggers, strings.Fields(triggers)...)
+	}
+	if control.Scripts, err = readPackageScripts(bytes.NewReader(control.Control)); err != nil {
+		return nil, err
+	}
+	return control, nil
+}
+
+// readGzipStream returns the decompressed contents of the gzip stream at the front of r, leaving r
+// at its end.
+func readGzipStream(r *bytes.Reader) ([]byte, error) {
+	if r.Len() == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	start := int64(r.Size()) - int64(r.Len())
+	zr, err := getGzipReader(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		b := make([]byte, sniffLength)
+		n, _ := r.ReadAt(b, start)
+		return nil, compressionError(b[:n], err)
+	}
+	defer putGzipReader(zr)
+	zr.Multistream(false)
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// countingWriter counts the bytes of the responses of a handler.
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	w.n.Add(int64(len(b)))
+	return w.ResponseWriter.Write(b)
+}
+
+func TestFetchControl(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// a data section that is too big, and random to not compress, to be worth fetching
+	data := make([]byte, 4*controlChunkSize)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	p := filepath.Join(dir, "big-1.0-r0.apk")
+	pkg := writeTestAPK(t, p, &repository.Package{Name: "big", Version: "1.0-r0", Arch: testArch, Dependencies: []string{"libbig"}},
+		map[string]string{"usr/share/big": string(data)})
+
+	for _, tt := range []struct {
+		name         string
+		ignoreRanges bool
+	}{
+		{name: "range requests"},
+		{name: "ranges ignored", ignoreRanges: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var served atomic.Int64
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.ignoreRanges {
+					r.Header.Del("Range")
+				}
+				http.ServeFile(countingWriter{w, &served}, r, filepath.Join(dir, filepath.Base(r.URL.Path)))
+			}))
+			defer server.Close()
+
+			a, err := New(WithArch(testArch))
+			require.NoError(t, err)
+			a.SetClient(server.Client())
+			repo := repository.Repository{Uri: server.URL}
+			control, err := a.FetchControl(ctx, repository.NewRepositoryPackage(pkg, repo.WithIndex(nil)))
+			require.NoError(t, err)
+			require.Equal(t, "big", control.Package.Name)
+			require.Equal(t, "1.0-r0", control.Package.Version)
+			require.Equal(t, []string{"libbig"}, control.Package.Dependencies)
+			require.Equal(t, pkg.Checksum, control.Package.Checksum)
+			require.Nil(t, control.Signature)
+			require.Empty(t, control.Scripts)
+			if !tt.ignoreRanges {
+				info, err := os.Stat(p)
+				require.NoError(t, err)
+				require.Less(t, served.Load(), info.Size()/2)
+			}
+		})
+	}
+
+	t.Run("local", func(t *testing.T) {
+		a, err := New(WithArch(testArch))
+		require.NoError(t, err)
+		repo := repository.Repository{Uri: dir}
+		control, err := a.FetchControl(ctx, repository.NewRepositoryPackage(pkg, repo.WithIndex(nil)))
+		require.NoError(t, err)
+		require.Equal(t, "big", control.Package.Name)
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		a, err := New(WithArch(testArch))
+		require.NoError(t, err)
+		wrong := *pkg
+		wrong.Checksum = make([]byte, len(pkg.Checksum))
+		repo := repository.Repository{Uri: dir}
+		_, err = a.FetchControl(ctx, repository.NewRepositoryPackage(&wrong, repo.WithIndex(nil)))
+		require.ErrorContains(t, err, "does not match checksum")
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		a, err := New(WithArch(testArch))
+		require.NoError(t, err)
+		repo := repository.Repository{Uri: filepath.Join("testdata", "alpine-316")}
+		baselayout := &repository.Package{Name: "alpine-baselayout", Version: "3.2.0-r23", Arch: testArch}
+		control, err := a.FetchControl(ctx, repository.NewRepositoryPackage(baselayout, repo.WithIndex(nil)))
+		require.NoError(t, err)
+		require.NotNil(t, control.Signature)
+		require.Equal(t, "alpine-baselayout", control.Package.Name)
+		require.Contains(t, control.Scripts, "post-install")
+	})
+}
@@ -0,0 +1,433 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PackageVerifier verifies the packages fetched from a repository, with WithPackageVerifier, in
+// addition to the checksums of its index, such as against signatures the repository publishes for
+// them. The client is that of the APK, to fetch what it needs with. CosignVerifier is one.
+type PackageVerifier interface {
+	VerifyPackage(ctx context.Context, client *http.Client, pkg *repository.RepositoryPackage, exp *APKExpanded) error
+}
+
+// PackageVerifierFunc is a function that is a PackageVerifier.
+type PackageVerifierFunc func(ctx context.Context, client *http.Client, pkg *repository.RepositoryPackage, exp *APKExpanded) error
+
+func (f PackageVerifierFunc) VerifyPackage(ctx context.Context, client *http.Client, pkg *repository.RepositoryPackage, exp *APKExpanded) error {
+	return f(ctx, client, pkg, exp)
+}
+
+// CosignVerifier is a PackageVerifier of the cosign signatures of packages, as cosign sign-blob
+// writes them with --output-signature, published next to each package with the .sig extension. The
+// signature is of the SHA-256 digest of the whole .apk file.
+//
+// Keyless signatures, whose certificates are from Fulcio, are verified by CosignKeylessVerifier.
+type CosignVerifier struct {
+	// PublicKey is the PEM of the ECDSA or RSA public key, as cosign generate-key-pair writes it.
+	PublicKey []byte
+}
+
+func (v CosignVerifier) VerifyPackage(ctx context.Context, client *http.Client, pkg *repository.RepositoryPackage, exp *APKExpanded) error {
+	block, _ := pem.Decode(v.PublicKey)
+	if block == nil {
+		return errors.New("no PEM block in cosign public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing cosign public key: %w", err)
+	}
+
+	b, err := fetchPackageSidecar(ctx, client, pkg, ".sig")
+	if err != nil {
+		return fmt.Errorf("fetching cosign signature: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("decoding cosign signature: %w", err)
+	}
+	digest, err := expandedDigest(exp)
+	if err != nil {
+		return err
+	}
+
+	return verifyCosignSignature(pub, digest, sig)
+}
+
+// verifyCosignSignature verifies the signature of the digest with the ECDSA or RSA public key.
+func verifyCosignSignature(pub crypto.PublicKey, digest, sig []byte) error {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			return errors.New("invalid cosign signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig); err != nil {
+			return fmt.Errorf("invalid cosign signature: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported cosign public key type %T", pub)
+	}
+	return nil
+}
+
+var (
+	// oidFulcioIssuer is the extension of Fulcio certificates with the OIDC issuer of the identity, as
+	// a DER UTF8String, and oidFulcioIssuerV1 the one it was before, as the raw string.
+	oidFulcioIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+	oidFulcioIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+)
+
+// CosignKeylessVerifier is a PackageVerifier of the keyless cosign signatures of packages, as cosign
+// sign-blob writes them with --bundle, published next to each package with the .bundle extension. The
+// bundle holds the signature of the SHA-256 digest of the whole .apk file, the short-lived certificate
+// Fulcio issued for the identity that signed it, and the entry of the signature in the Rekor
+// transparency log, with the timestamp Rekor signed for it.
+//
+// The certificate must chain to the Fulcio roots, have been valid when Rekor recorded the entry, and
+// be for the identity and OIDC issuer given; the entry must be signed by Rekor and be of the signature
+// and certificate of the bundle. The inclusion proof of the entry in the log is not checked, which
+// needs the log itself to be reached.
+type CosignKeylessVerifier struct {
+	// FulcioRoots is the PEM of the certificates of the Fulcio root and intermediate CAs, as in the
+	// sigstore trusted root.
+	FulcioRoots []byte
+	// RekorPublicKey is the PEM of the public key of the Rekor log.
+	RekorPublicKey []byte
+	// Identity is the identity, the email or URI subject alternative name of the certificate, that
+	// must have signed, or IdentityRegexp a regular expression it must match, as for the
+	// --certificate-identity and --certificate-identity-regexp flags of cosign.
+	Identity       string
+	IdentityRegexp string
+	// OIDCIssuer is the issuer of the OIDC token of the identity, such as
+	// https://token.actions.githubusercontent.com.
+	OIDCIssuer string
+}
+
+// cosignBundle is the bundle of a keyless signature, as cosign sign-blob --bundle writes it.
+type cosignBundle struct {
+	Base64Signature string `json:"base64Signature"`
+	// Cert is the base64 of the PEM of the certificate.
+	Cert        string `json:"cert"`
+	RekorBundle struct {
+		SignedEntryTimestamp string       `json:"SignedEntryTimestamp"`
+		Payload              rekorPayload `json:"Payload"`
+	} `json:"rekorBundle"`
+}
+
+// rekorPayload is the entry of a Rekor log, as the signed entry timestamp is of its canonical JSON:
+// the fields are in the order of their keys.
+type rekorPayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// hashedRekord is the body of a Rekor entry of a signed digest.
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   string `json:"content"`
+			PublicKey struct {
+				Content string `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+func (v CosignKeylessVerifier) VerifyPackage(ctx context.Context, client *http.Client, pkg *repository.RepositoryPackage, exp *APKExpanded) error {
+	b, err := fetchPackageSidecar(ctx, client, pkg, ".bundle")
+	if err != nil {
+		return fmt.Errorf("fetching cosign bundle: %w", err)
+	}
+	var bundle cosignBundle
+	if err := json.Unmarshal(b, &bundle); err != nil {
+		return fmt.Errorf("parsing cosign bundle: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(bundle.Base64Signature)
+	if err != nil {
+		return fmt.Errorf("decoding cosign signature: %w", err)
+	}
+	certPEM, err := base64.StdEncoding.DecodeString(bundle.Cert)
+	if err != nil {
+		return fmt.Errorf("decoding cosign certificate: %w", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return errors.New("no PEM block in cosign certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing cosign certificate: %w", err)
+	}
+	digest, err := expandedDigest(exp)
+	if err != nil {
+		return err
+	}
+
+	// the entry in the log, and when it was recorded, which the certificate must have been valid at
+	integrated, err := v.verifyRekorEntry(bundle, digest, sig, certPEM)
+	if err != nil {
+		return err
+	}
+	if err := v.verifyCertificate(cert, integrated); err != nil {
+		return err
+	}
+	return verifyCosignSignature(cert.PublicKey, digest, sig)
+}
+
+// verifyCertificate verifies that the certificate chains to the Fulcio roots at the time, and is of the
+// identity and issuer of the verifier.
+func (v CosignKeylessVerifier) verifyCertificate(cert *x509.Certificate, at time.Time) error {
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for rest := v.FulcioRoots; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("parsing Fulcio root: %w", err)
+		}
+		if bytes.Equal(ca.RawIssuer, ca.RawSubject) {
+			roots.AddCert(ca)
+		} else {
+			intermediates.AddCert(ca)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return fmt.Errorf("invalid cosign certificate: %w", err)
+	}
+
+	identities := append([]string(nil), cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		identities = append(identities, u.String())
+	}
+	var re *regexp.Regexp
+	if v.IdentityRegexp != "" {
+		var err error
+		if re, err = regexp.Compile(v.IdentityRegexp); err != nil {
+			return fmt.Errorf("invalid cosign identity regexp: %w", err)
+		}
+	}
+	if v.Identity == "" && re == nil {
+		return errors.New("no cosign identity to verify the certificate against")
+	}
+	matched := false
+	for _, identity := range identities {
+		if identity == v.Identity || (re != nil && re.MatchString(identity)) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return fmt.Errorf("cosign certificate is for %s, not the identity expected", strings.Join(identities, ", "))
+	}
+
+	issuer := ""
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidFulcioIssuer):
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &issuer, "utf8"); err != nil {
+				return fmt.Errorf("parsing cosign certificate issuer: %w", err)
+			}
+		case ext.Id.Equal(oidFulcioIssuerV1) && issuer == "":
+			issuer = string(ext.Value)
+		}
+	}
+	if issuer != v.OIDCIssuer {
+		return fmt.Errorf("cosign certificate is from issuer %q, not %q", issuer, v.OIDCIssuer)
+	}
+	return nil
+}
+
+// verifyRekorEntry verifies that the Rekor entry of the bundle is signed by Rekor, and is of the
+// digest, signature and certificate, returning when it was recorded.
+func (v CosignKeylessVerifier) verifyRekorEntry(bundle cosignBundle, digest, sig, certPEM []byte) (time.Time, error) {
+	block, _ := pem.Decode(v.RekorPublicKey)
+	if block == nil {
+		return time.Time{}, errors.New("no PEM block in Rekor public key")
+	}
+	rekorKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing Rekor public key: %w", err)
+	}
+	payload := bundle.RekorBundle.Payload
+	if logID := sha256.Sum256(block.Bytes); payload.LogID != hex.EncodeToString(logID[:]) {
+		return time.Time{}, fmt.Errorf("cosign bundle is of Rekor log %s, not of the key given", payload.LogID)
+	}
+
+	canonical, err := json.Marshal(payload)
+	if err != nil {
+		return time.Time{}, err
+	}
+	set, err := base64.StdEncoding.DecodeString(bundle.RekorBundle.SignedEntryTimestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("decoding Rekor signed entry timestamp: %w", err)
+	}
+	setDigest := sha256.Sum256(canonical)
+	if err := verifyCosignSignature(rekorKey, setDigest[:], set); err != nil {
+		return time.Time{}, fmt.Errorf("invalid Rekor signed entry timestamp: %w", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("decoding Rekor entry: %w", err)
+	}
+	var entry hashedRekord
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("parsing Rekor entry: %w", err)
+	}
+	entryCert, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.PublicKey.Content)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("decoding Rekor entry certificate: %w", err)
+	}
+	entrySig, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.Content)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("decoding Rekor entry signature: %w", err)
+	}
+	switch {
+	case entry.Kind != "hashedrekord" || entry.Spec.Data.Hash.Algorithm != "sha256":
+		return time.Time{}, fmt.Errorf("unsupported Rekor entry %s", entry.Kind)
+	case entry.Spec.Data.Hash.Value != hex.EncodeToString(digest):
+		return time.Time{}, errors.New("the Rekor entry is of another package")
+	case !bytes.Equal(entrySig, sig) || !bytes.Equal(bytes.TrimSpace(entryCert), bytes.TrimSpace(certPEM)):
+		return time.Time{}, errors.New("the Rekor entry is of another signature")
+	}
+	return time.Unix(payload.IntegratedTime, 0), nil
+}
+
+// fetchPackageSidecar returns the file published next to the package, with the extension added to
+// its name, from a local repository or with the client.
+func fetchPackageSidecar(ctx context.Context, client *http.Client, pkg *repository.RepositoryPackage, ext string) ([]byte, error) {
+	u := pkg.Url() + ext
+	asURL, err := packageAsURL(pkg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse package as URL: %w", err)
+	}
+	if asURL.Scheme == "file" {
+		return os.ReadFile(u)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// expandedDigest returns the SHA-256 digest of the whole .apk file of the expanded package, whose
+// sections are its gzip streams, in order.
+func expandedDigest(exp *APKExpanded) ([]byte, error) {
+	h := sha256.New()
+	for _, name := range []string{exp.SignatureFile, exp.ControlFile, exp.PackageFile} {
+		if name == "" {
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// packageVerifier returns the verifier of WithPackageVerifier for the repository of the package, that
+// of the longest repository URL the packages URL of its repository is under, or else that for every
+// repository, if any.
+func (a *APK) packageVerifier(pkg *repository.RepositoryPackage) PackageVerifier {
+	if len(a.packageVerifiers) == 0 {
+		return nil
+	}
+	var uri string
+	if repo := pkg.Repository(); repo != nil && repo.Repository != nil {
+		uri = repo.Uri
+	}
+	matched := ""
+	for repo := range a.packageVerifiers {
+		trimmed := strings.TrimSuffix(repo, "/")
+		if repo != "" && len(repo) > len(matched) && (uri == trimmed || strings.HasPrefix(uri, trimmed+"/")) {
+			matched = repo
+		}
+	}
+	return a.packageVerifiers[matched]
+}
+
+// verifyPackage verifies the fetched package with the verifier of its repository, if any.
+func (a *APK) verifyPackage(ctx context.Context, pkg *repository.RepositoryPackage, exp *APKExpanded) error {
+	verifier := a.packageVerifier(pkg)
+	if verifier == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "verifyPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
+	defer span.End()
+
+	if err := verifier.VerifyPackage(ctx, a.getClient(), pkg, exp); err != nil {
+		return fmt.Errorf("verifying %s: %w", pkg.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestCosignVerifier(t *testing.T) {
+	ctx := context.Background()
+	const pkgFile = "alpine-baselayout-3.2.0-r23.apk"
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	verifier := CosignVerifier{PublicKey: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})}
+
+	dir := t.TempDir()
+	b, err := os.ReadFile(filepath.Join("testdata", "alpine-316", pkgFile))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, pkgFile), b, 0o644))
+	digest := sha256.Sum256(b)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+
+	repo := repository.Repository{Uri: dir}
+	pkg := repository.NewRepositoryPackage(&repository.Package{Name: "alpine-baselayout", Version: "3.2.0-r23", Arch: testArch}, repo.WithIndex(nil))
+	expand := func(options ...Option) error {
+		a, err := New(append([]Option{WithArch(testArch)}, options...)...)
+		require.NoError(t, err)
+		exp, err := a.expandPackage(ctx, pkg)
+		if err == nil {
+			exp.Close()
+		}
+		return err
+	}
+
+	// not signed
+	require.ErrorContains(t, expand(WithPackageVerifier(dir, verifier)), "fetching cosign signature")
+	// only the repositories with a verifier are verified
+	require.NoError(t, expand(WithPackageVerifier("https://example.com/alpine", verifier)))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, pkgFile+".sig"), []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0o644))
+	require.NoError(t, expand(WithPackageVerifier(dir, verifier)))
+	require.NoError(t, expand(WithPackageVerifier("", verifier)))
+
+	// signed with another key
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherPub, err := x509.MarshalPKIXPublicKey(&other.PublicKey)
+	require.NoError(t, err)
+	err = expand(WithPackageVerifier(dir, CosignVerifier{PublicKey: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: otherPub})}))
+	require.ErrorContains(t, err, "verifying alpine-baselayout: invalid cosign signature")
+
+	// the verifier of the repository is preferred to that of every repository
+	refuse := PackageVerifierFunc(func(context.Context, *http.Client, *repository.RepositoryPackage, *APKExpanded) error {
+		return os.ErrPermission
+	})
+	require.NoError(t, expand(WithPackageVerifier("", refuse), WithPackageVerifier(dir, verifier)))
+	require.ErrorIs(t, expand(WithPackageVerifier("", refuse)), os.ErrPermission)
+}
+
+func TestCosignKeylessVerifier(t *testing.T) {
+	ctx := context.Background()
+	const pkgFile = "alpine-baselayout-3.2.0-r23.apk"
+	dir := t.TempDir()
+	b, err := os.ReadFile(filepath.Join("testdata", "alpine-316", pkgFile))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, pkgFile), b, 0o644))
+	digest := sha256.Sum256(b)
+
+	// a Fulcio, which issues a certificate for the identity that signs, and a Rekor
+	now := time.Now()
+	newCA := func() (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "fulcio"},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		require.NoError(t, err)
+		ca, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		return ca, key
+	}
+	ca, caKey := newCA()
+	issuer, err := asn1.MarshalWithParams("https://issuer.example.com", "utf8")
+	require.NoError(t, err)
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       now.Add(-time.Minute),
+		NotAfter:        now.Add(10 * time.Minute),
+		EmailAddresses:  []string{"builder@example.com"},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		ExtraExtensions: []pkix.Extension{{Id: oidFulcioIssuer, Value: issuer}},
+	}, ca, &signer.PublicKey, caKey)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+	sig, err := ecdsa.SignASN1(rand.Reader, signer, digest[:])
+	require.NoError(t, err)
+	rekor, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rekorPub, err := x509.MarshalPKIXPublicKey(&rekor.PublicKey)
+	require.NoError(t, err)
+	logID := sha256.Sum256(rekorPub)
+
+	writeBundle := func(integrated time.Time) {
+		var entry hashedRekord
+		entry.Kind = "hashedrekord"
+		entry.Spec.Data.Hash.Algorithm = "sha256"
+		entry.Spec.Data.Hash.Value = hex.EncodeToString(digest[:])
+		entry.Spec.Signature.Content = base64.StdEncoding.EncodeToString(sig)
+		entry.Spec.Signature.PublicKey.Content = base64.StdEncoding.EncodeToString(certPEM)
+		body, err := json.Marshal(entry)
+		require.NoError(t, err)
+		var bundle cosignBundle
+		bundle.Base64Signature = base64.StdEncoding.EncodeToString(sig)
+		bundle.Cert = base64.StdEncoding.EncodeToString(certPEM)
+		bundle.RekorBundle.Payload = rekorPayload{
+			Body:           base64.StdEncoding.EncodeToString(body),
+			IntegratedTime: integrated.Unix(),
+			LogIndex:       42,
+			LogID:          hex.EncodeToString(logID[:]),
+		}
+		canonical, err := json.Marshal(bundle.RekorBundle.Payload)
+		require.NoError(t, err)
+		setDigest := sha256.Sum256(canonical)
+		set, err := ecdsa.SignASN1(rand.Reader, rekor, setDigest[:])
+		require.NoError(t, err)
+		bundle.RekorBundle.SignedEntryTimestamp = base64.StdEncoding.EncodeToString(set)
+		b, err := json.Marshal(bundle)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, pkgFile+".bundle"), b, 0o644))
+	}
+
+	repo := repository.Repository{Uri: dir}
+	pkg := repository.NewRepositoryPackage(&repository.Package{Name: "alpine-baselayout", Version: "3.2.0-r23", Arch: testArch}, repo.WithIndex(nil))
+	verifier := CosignKeylessVerifier{
+		FulcioRoots:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}),
+		RekorPublicKey: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rekorPub}),
+		Identity:       "builder@example.com",
+		OIDCIssuer:     "https://issuer.example.com",
+	}
+	expand := func(verifier PackageVerifier) error {
+		a, err := New(WithArch(testArch), WithPackageVerifier(dir, verifier))
+		require.NoError(t, err)
+		exp, err := a.expandPackage(ctx, pkg)
+		if err == nil {
+			exp.Close()
+		}
+		return err
+	}
+
+	// not signed
+	require.ErrorContains(t, expand(verifier), "fetching cosign bundle")
+
+	writeBundle(now)
+	require.NoError(t, expand(verifier))
+	byRegexp := verifier
+	byRegexp.Identity, byRegexp.IdentityRegexp = "", `@example\.com$`
+	require.NoError(t, expand(byRegexp))
+
+	// by another identity, or from another issuer
+	other := verifier
+	other.Identity = "someone@example.com"
+	require.ErrorContains(t, expand(other), "not the identity expected")
+	other = verifier
+	other.OIDCIssuer = "https://accounts.example.com"
+	require.ErrorContains(t, expand(other), "not \"https://accounts.example.com\"")
+
+	// from another Fulcio, or recorded by another Rekor
+	otherCA, _ := newCA()
+	other = verifier
+	other.FulcioRoots = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCA.Raw})
+	require.ErrorContains(t, expand(other), "invalid cosign certificate")
+	otherRekor, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherRekorPub, err := x509.MarshalPKIXPublicKey(&otherRekor.PublicKey)
+	require.NoError(t, err)
+	other = verifier
+	other.RekorPublicKey = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: otherRekorPub})
+	require.ErrorContains(t, expand(other), "not of the key given")
+
+	// recorded once the certificate had expired
+	writeBundle(now.Add(time.Hour))
+	require.ErrorContains(t, expand(verifier), "invalid cosign certificate")
+}
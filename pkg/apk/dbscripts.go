@@ -0,0 +1,102 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// The installed database keeps the scripts and triggers of the installed packages in two files, which
+// are written in the formats of apk-tools by the functions below, so that other tools can regenerate
+// or patch them as the installer does:
+//
+//   - lib/apk/db/scripts.tar is an uncompressed tarball of the scripts, each named by ScriptsTarName
+//     and written by WriteScripts. The entries of a package are removed by dropping those whose names
+//     start with ScriptsTarName(pkg, "").
+//   - lib/apk/db/triggers has a line for each package with triggers, written by WriteTriggers: the
+//     base64 checksum of the package and its triggers, separated by spaces.
+
+// ScriptsTarName returns the name of the script of the package in lib/apk/db/scripts.tar, as
+// <name>-<version>.Q1<base64 checksum><script>, where the script is named as in the control section of
+// the package, such as .post-install.
+func ScriptsTarName(pkg *repository.Package, script string) string {
+	return fmt.Sprintf("%s-%s.Q1%s%s", pkg.Name, pkg.Version, base64.StdEncoding.EncodeToString(pkg.Checksum), script)
+}
+
+// WriteScripts writes the scripts of the package, from the gzipped tarball of its control section, to
+// the tar writer, as the entries of lib/apk/db/scripts.tar named by ScriptsTarName. The .PKGINFO is not
+// a script, and is skipped. With a source date epoch, the times of the entries are set to it, for
+// reproducible builds. The tar writer is not closed, so that the scripts of several packages can be
+// written to it, or appended to an existing scripts.tar by writing over its two trailing zero blocks.
+func WriteScripts(tw *tar.Writer, pkg *repository.Package, controlTarGz io.Reader, sourceDateEpoch *time.Time) error {
+	gz, err := getGzipReader(controlTarGz)
+	if err != nil {
+		return fmt.Errorf("unable to gunzip control tar.gz file: %w", err)
+	}
+	defer putGzipReader(gz)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// ignore .PKGINFO as it is not a script
+		if header.Name == ".PKGINFO" { //nolint:goconst
+			continue
+		}
+
+		header.Name = ScriptsTarName(pkg, header.Name)
+
+		// zero out timestamps for reproducibility
+		if sourceDateEpoch != nil {
+			header.ModTime = *sourceDateEpoch
+			// we do not use AccessTime or ChangeTime because these are incompatible with USTar, which is required for apk.
+			// See https://pkg.go.dev/archive/tar#Format for the capabilities of each format.
+			// Setting them to time.Time{} or the epoch will cause them to be ignored.
+			header.AccessTime = time.Time{}
+			header.ChangeTime = time.Time{}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("unable to write scripts header for %s: %w", header.Name, err)
+		}
+		if _, err := io.CopyN(tw, tr, header.Size); err != nil {
+			return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
+		}
+	}
+}
+
+// WriteTriggers writes the line of lib/apk/db/triggers for the package with the triggers, the globs of
+// the directories whose changes run its trigger script, as in the triggers of its .PKGINFO. Nothing is
+// written for a package without triggers.
+func WriteTriggers(w io.Writer, pkg *repository.Package, triggers ...string) error {
+	if len(triggers) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", base64.StdEncoding.EncodeToString(pkg.Checksum), strings.Join(triggers, " "))
+	return err
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestWriteScriptsAndTriggers(t *testing.T) {
+	pkg := &repository.Package{Name: "foo", Version: "1.0-r0", Checksum: []byte{0xfb, 0xff, 0x01}}
+	require.Equal(t, "foo-1.0-r0.Q1+/8B.post-install", ScriptsTarName(pkg, ".post-install"))
+
+	var control bytes.Buffer
+	gw := gzip.NewWriter(&control)
+	tw := tar.NewWriter(gw)
+	for _, name := range []string{".PKGINFO", ".pre-install", ".post-install"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(name)), ModTime: time.Now()}))
+		_, err := tw.Write([]byte(name))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	var scripts bytes.Buffer
+	epoch := time.Unix(1000, 0)
+	tw = tar.NewWriter(&scripts)
+	require.NoError(t, WriteScripts(tw, pkg, &control, &epoch))
+	require.NoError(t, tw.Close())
+	tr := tar.NewReader(&scripts)
+	got := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		require.True(t, header.ModTime.Equal(epoch), header.Name)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		got[header.Name] = string(b)
+	}
+	require.Equal(t, map[string]string{
+		ScriptsTarName(pkg, ".pre-install"):  ".pre-install",
+		ScriptsTarName(pkg, ".post-install"): ".post-install",
+	}, got)
+
+	var triggers bytes.Buffer
+	require.NoError(t, WriteTriggers(&triggers, pkg))
+	require.Empty(t, triggers.String())
+	require.NoError(t, WriteTriggers(&triggers, pkg, "/usr/share/fonts/*", "/usr/lib/gdk-pixbuf-2.0/*"))
+	require.Equal(t, "+/8B /usr/share/fonts/* /usr/lib/gdk-pixbuf-2.0/*\n", triggers.String())
+}
@@ -0,0 +1,143 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// dedupStore is the content-addressed store of the files installed with WithDedup: the first file
+// installed with each content, mode, ownership and time, which the later ones are hardlinked to.
+type dedupStore struct {
+	mu    sync.Mutex
+	files map[dedupKey]dedupFile
+}
+
+// dedupKey is what files must share to be hardlinked, as hardlinks share their metadata too.
+type dedupKey struct {
+	checksum string
+	mode     int64
+	uid, gid int
+	mtime    int64
+}
+
+// dedupFile is the file that the others with its key are linked to, and its hardlink ID when it was
+// installed, which tells whether it has been replaced since.
+type dedupFile struct {
+	path string
+	id   any
+}
+
+// newDedupStore returns an empty store, or nil if dedup is false.
+func newDedupStore(dedup bool) *dedupStore {
+	if !dedup {
+		return nil
+	}
+	return &dedupStore{files: map[dedupKey]dedupFile{}}
+}
+
+// dedupKeyOf returns the key of the file of the header, with the checksum, and false for the files
+// that are not deduplicated: empty ones, those without a checksum or with extended attributes, and
+// those of etc/, which are expected to be changed once installed.
+func dedupKeyOf(header *tar.Header, checksum []byte) (dedupKey, bool) {
+	if checksum == nil || header.Size == 0 || header.Name == "etc" || strings.HasPrefix(header.Name, "etc/") {
+		return dedupKey{}, false
+	}
+	for k := range header.PAXRecords {
+		if strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
+			return dedupKey{}, false
+		}
+	}
+	return dedupKey{
+		checksum: hex.EncodeToString(checksum),
+		mode:     header.Mode,
+		uid:      header.Uid,
+		gid:      header.Gid,
+		mtime:    header.ModTime.Unix(),
+	}, true
+}
+
+// link installs the file of the header, with the checksum, as a hardlink to the file installed before
+// it with the same content and metadata, if there is one and it is still as it was installed. It
+// returns false, having done nothing, otherwise, for the file to be written.
+func (d *dedupStore) link(fsys apkfs.FullFS, header *tar.Header, checksum []byte) (bool, error) {
+	if d == nil {
+		return false, nil
+	}
+	key, ok := dedupKeyOf(header, checksum)
+	if !ok {
+		return false, nil
+	}
+	d.mu.Lock()
+	first, ok := d.files[key]
+	d.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	// it is gone, or has been replaced since, if it is not the file it was
+	fi, err := fsys.Lstat(first.path)
+	if err != nil {
+		d.forget(key, first)
+		return false, nil
+	}
+	if id, _ := apkfs.HardlinkID(fi); !fi.Mode().IsRegular() || id != first.id {
+		d.forget(key, first)
+		return false, nil
+	}
+	if err := fsys.Link(first.path, header.Name); err != nil {
+		return true, fmt.Errorf("unable to link %s to %s of the same content: %w", header.Name, first.path, err)
+	}
+	return true, nil
+}
+
+// record records the file of the header, with the checksum, just written, as the one to link the
+// later files with its content and metadata to, unless there is one already.
+func (d *dedupStore) record(fsys apkfs.FullFS, header *tar.Header, checksum []byte) {
+	if d == nil {
+		return
+	}
+	key, ok := dedupKeyOf(header, checksum)
+	if !ok {
+		return
+	}
+	fi, err := fsys.Lstat(header.Name)
+	if err != nil {
+		return
+	}
+	id, _ := apkfs.HardlinkID(fi)
+	if id == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.files[key]; !ok {
+		d.files[key] = dedupFile{path: header.Name, id: id}
+	}
+}
+
+// forget drops the file recorded for the key, if it is still the one, as it is gone or has changed.
+func (d *dedupStore) forget(key dedupKey, file dedupFile) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.files[key] == file {
+		delete(d.files, key)
+	}
+}
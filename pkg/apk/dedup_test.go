@@ -0,0 +1,96 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestDedup(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	build := func(name string) string {
+		file := filepath.Join(src, name+".apk")
+		writeTestAPK(t, file, &repository.Package{Name: name, Version: "1.0-r0", Arch: testArch}, map[string]string{
+			"usr/share/licenses/" + name + "/LICENSE": "the same license",
+			"usr/bin/" + name:                         name,
+			"etc/" + name + ".conf":                   "the same conf",
+		})
+		return file
+	}
+	repoDir := t.TempDir()
+	_, err := (&Publisher{Dir: repoDir}).Publish(ctx, "edge", "main", build("foo"), build("bar"))
+	require.NoError(t, err)
+	install := func(dedup bool) string {
+		root := t.TempDir()
+		a, err := New(WithFS(apkfs.DirFS(root)), WithArch(testArch), WithIgnoreMknodErrors(true), WithAllowUntrusted(true), WithDedup(dedup))
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, a.SetRepositories([]string{filepath.Join(repoDir, "edge", "main")}))
+		require.NoError(t, a.SetWorld([]string{"foo", "bar"}))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		for _, pkg := range installed {
+			for _, f := range pkg.Files {
+				if f.Typeflag != tar.TypeDir {
+					// listed as shipped, not as links
+					require.NotEmpty(t, f.PAXRecords[paxRecordsChecksumKey], f.Name)
+				}
+			}
+		}
+		return root
+	}
+	same := func(root, a, b string) bool {
+		fa, err := os.Stat(filepath.Join(root, a))
+		require.NoError(t, err)
+		fb, err := os.Stat(filepath.Join(root, b))
+		require.NoError(t, err)
+		return os.SameFile(fa, fb)
+	}
+
+	root := install(true)
+	require.True(t, same(root, "usr/share/licenses/foo/LICENSE", "usr/share/licenses/bar/LICENSE"))
+	require.False(t, same(root, "etc/foo.conf", "etc/bar.conf"))
+	b, err := os.ReadFile(filepath.Join(root, "usr/share/licenses/bar/LICENSE"))
+	require.NoError(t, err)
+	require.Equal(t, "the same license", string(b))
+
+	root = install(false)
+	require.False(t, same(root, "usr/share/licenses/foo/LICENSE", "usr/share/licenses/bar/LICENSE"))
+
+	cfg := Config{Dedup: true}
+	a, err := NewFromConfig(cfg)
+	require.NoError(t, err)
+	got, err := a.Config()
+	require.NoError(t, err)
+	require.True(t, got.Dedup)
+	clone, err := a.Clone()
+	require.NoError(t, err)
+	got, err = clone.Config()
+	require.NoError(t, err)
+	require.True(t, got.Dedup)
+	require.NotSame(t, a.dedup, clone.dedup)
+}
@@ -0,0 +1,294 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A delta rebuilds an apk from an older version of the package, so that only what changed between
+// the two is downloaded. It is hosted next to the new apk, at DeltaURL, and consists of:
+//
+//	"APKDELTA1\n"
+//	the sha256 of the old apk, and of the new apk
+//	instructions, each a byte followed by uvarints:
+//	  'C' offset length: copy length bytes of the old apk, from offset
+//	  'D' length, and as many bytes: insert the bytes
+//	  'E': the end
+//
+// As apks are compressed, deltas help most with large packages of which little has changed.
+const (
+	deltaMagic     = "APKDELTA1\n"
+	deltaExt       = ".apkdelta"
+	deltaBlockSize = 1 << 12
+	// maxDeltaInsert bounds the bytes a single instruction may insert, so that a corrupt delta
+	// cannot make us allocate arbitrary amounts of memory.
+	maxDeltaInsert = 1 << 24
+	// maxDeltaOutput bounds the package a delta rebuilds, when its size is not known.
+	maxDeltaOutput = 1 << 31
+)
+
+// DeltaURL returns where the delta to the package from an older version of it is hosted.
+func DeltaURL(pkg *repository.RepositoryPackage, fromVersion string) string {
+	return fmt.Sprintf("%s-from-%s%s", strings.TrimSuffix(pkg.Url(), ".apk"), fromVersion, deltaExt)
+}
+
+// WriteDelta writes the delta that rebuilds the new apk from the old one.
+func WriteDelta(w io.Writer, oldAPK, newAPK []byte) error {
+	bw := bufio.NewWriter(w)
+	oldSum, newSum := sha256.Sum256(oldAPK), sha256.Sum256(newAPK)
+	bw.WriteString(deltaMagic)
+	bw.Write(oldSum[:])
+	bw.Write(newSum[:])
+
+	// the offsets of the blocks of the old apk, by their weak checksum
+	blocks := map[uint32][]int{}
+	for off := 0; off+deltaBlockSize <= len(oldAPK); off += deltaBlockSize {
+		sum := newRollingSum(oldAPK[off : off+deltaBlockSize]).sum()
+		blocks[sum] = append(blocks[sum], off)
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	op := func(kind byte, values ...int) {
+		bw.WriteByte(kind)
+		for _, v := range values {
+			bw.Write(buf[:binary.PutUvarint(buf[:], uint64(v))])
+		}
+	}
+	insert := func(data []byte) {
+		for len(data) > 0 {
+			n := len(data)
+			if n > maxDeltaInsert {
+				n = maxDeltaInsert
+			}
+			op('D', n)
+			bw.Write(data[:n])
+			data = data[n:]
+		}
+	}
+
+	pending := 0 // start of the bytes of the new apk not yet written
+	pos := 0
+	var rs *rollingSum
+	for pos+deltaBlockSize <= len(newAPK) {
+		if rs == nil {
+			rs = newRollingSum(newAPK[pos : pos+deltaBlockSize])
+		}
+		var match = -1
+		for _, off := range blocks[rs.sum()] {
+			if bytes.Equal(oldAPK[off:off+deltaBlockSize], newAPK[pos:pos+deltaBlockSize]) {
+				match = off
+				break
+			}
+		}
+		if match < 0 {
+			if pos+deltaBlockSize < len(newAPK) {
+				rs.roll(newAPK[pos], newAPK[pos+deltaBlockSize])
+			}
+			pos++
+			continue
+		}
+		// extend the match as far as it goes
+		n := deltaBlockSize
+		for match+n < len(oldAPK) && pos+n < len(newAPK) && oldAPK[match+n] == newAPK[pos+n] {
+			n++
+		}
+		insert(newAPK[pending:pos])
+		op('C', match, n)
+		pos += n
+		pending = pos
+		rs = nil
+	}
+	insert(newAPK[pending:])
+	op('E')
+	return bw.Flush()
+}
+
+// ApplyDelta rebuilds the new apk from the old one and the delta, checking both against the checksums
+// in the delta. A delta that rebuilds more than size bytes, the size of the new apk in its index, is an
+// error; if size is 0, the new apk may be up to 2GiB.
+func ApplyDelta(oldAPK []byte, delta io.Reader, size uint64) ([]byte, error) {
+	r := bufio.NewReader(delta)
+	header := make([]byte, len(deltaMagic)+2*sha256.Size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading delta header: %w", err)
+	}
+	if string(header[:len(deltaMagic)]) != deltaMagic {
+		return nil, errors.New("not a delta")
+	}
+	oldSum, newSum := header[len(deltaMagic):len(deltaMagic)+sha256.Size], header[len(deltaMagic)+sha256.Size:]
+	if sum := sha256.Sum256(oldAPK); !bytes.Equal(sum[:], oldSum) {
+		return nil, errors.New("delta is not from this version of the package")
+	}
+
+	if size == 0 {
+		size = maxDeltaOutput
+	}
+	var out bytes.Buffer
+	grow := func(n uint64) error {
+		if n > size-uint64(out.Len()) {
+			return fmt.Errorf("delta rebuilds more than the %d bytes of the package", size)
+		}
+		return nil
+	}
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading delta: %w", err)
+		}
+		switch kind {
+		case 'C':
+			off, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err := errors.Join(err1, err2); err != nil {
+				return nil, fmt.Errorf("reading delta: %w", err)
+			}
+			if off > uint64(len(oldAPK)) || n > uint64(len(oldAPK))-off {
+				return nil, fmt.Errorf("delta copies beyond the old package")
+			}
+			if err := grow(n); err != nil {
+				return nil, err
+			}
+			out.Write(oldAPK[off : off+n])
+		case 'D':
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, fmt.Errorf("reading delta: %w", err)
+			}
+			if n > maxDeltaInsert {
+				return nil, fmt.Errorf("delta inserts %d bytes at once", n)
+			}
+			if err := grow(n); err != nil {
+				return nil, err
+			}
+			if _, err := io.CopyN(&out, r, int64(n)); err != nil {
+				return nil, fmt.Errorf("reading delta: %w", err)
+			}
+		case 'E':
+			if sum := sha256.Sum256(out.Bytes()); !bytes.Equal(sum[:], newSum) {
+				return nil, errors.New("rebuilt package does not match the delta")
+			}
+			return out.Bytes(), nil
+		default:
+			return nil, fmt.Errorf("unknown delta instruction %q", kind)
+		}
+	}
+}
+
+// rollingSum is the weak checksum of rsync, which can be moved along the data a byte at a time.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(block []byte) *rollingSum {
+	rs := &rollingSum{n: uint32(len(block))}
+	for i, c := range block {
+		rs.a += uint32(c)
+		rs.b += uint32(len(block)-i) * uint32(c)
+	}
+	return rs
+}
+
+func (rs *rollingSum) roll(out, in byte) {
+	rs.a += uint32(in) - uint32(out)
+	rs.b += rs.a - rs.n*uint32(out)
+}
+
+func (rs *rollingSum) sum() uint32 {
+	return rs.a&0xffff | rs.b<<16
+}
+
+// expandDelta rebuilds the package from the delta to it from the cached older version, and expands
+// it into the cache directory. The rebuilt package is checked against the index.
+func (a *APK) expandDelta(ctx context.Context, pkg *repository.RepositoryPackage, from *repository.Package, cacheDir string) (*APKExpanded, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "expandDelta", trace.WithAttributes(attribute.String("package", pkg.Name)))
+	defer span.End()
+
+	old := repository.NewRepositoryPackage(from, pkg.Repository())
+	oldDir, err := cacheDirForPackage(a.cache.dir, old)
+	if err != nil {
+		return nil, err
+	}
+	oldExp, err := a.cachedPackage(ctx, old, oldDir)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not in the cache: %w", from.Version, err)
+	}
+	rc, err := oldExp.APK()
+	if err != nil {
+		return nil, err
+	}
+	oldAPK, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	delta, err := a.fetchURL(ctx, DeltaURL(pkg, from.Version))
+	if err != nil {
+		return nil, err
+	}
+	defer delta.Close()
+	newAPK, err := ApplyDelta(oldAPK, delta, pkg.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	exp, err := ExpandApk(ctx, bytes.NewReader(newAPK), cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("expanding rebuilt package: %w", err)
+	}
+	// the delta only vouches for itself, the index for the package
+	if err := verifyExpanded(pkg.Package, exp); err != nil {
+		exp.Close()
+		return nil, fmt.Errorf("verifying rebuilt package: %w", err)
+	}
+	return exp, nil
+}
+
+// fetchURL opens a local path, or gets an https URL, without caching it.
+func (a *APK) fetchURL(ctx context.Context, u string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(u, "https://") {
+		return os.Open(strings.TrimPrefix(u, "file://"))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.getClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unable to get %s: %v", u, res.Status)
+	}
+	return res.Body, nil
+}
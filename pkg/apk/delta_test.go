@@ -0,0 +1,131 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestDelta(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1)) //nolint:gosec // test data
+	oldAPK := make([]byte, 100_000)
+	rnd.Read(oldAPK)
+	// changed in the middle, with bytes inserted, and appended to
+	newAPK := append([]byte(nil), oldAPK[:30_000]...)
+	newAPK = append(newAPK, []byte("something new")...)
+	newAPK = append(newAPK, oldAPK[30_500:]...)
+	newAPK = append(newAPK, []byte("and more")...)
+
+	var delta bytes.Buffer
+	require.NoError(t, WriteDelta(&delta, oldAPK, newAPK))
+	require.Less(t, delta.Len(), len(newAPK)/10)
+
+	got, err := ApplyDelta(oldAPK, bytes.NewReader(delta.Bytes()), uint64(len(newAPK)))
+	require.NoError(t, err)
+	require.Equal(t, newAPK, got)
+
+	_, err = ApplyDelta(newAPK, bytes.NewReader(delta.Bytes()), 0)
+	require.ErrorContains(t, err, "not from this version")
+	_, err = ApplyDelta(oldAPK, bytes.NewReader(delta.Bytes()[:delta.Len()-10]), 0)
+	require.Error(t, err)
+	_, err = ApplyDelta(oldAPK, bytes.NewReader([]byte("not a delta at all, just some text")), 0)
+	require.Error(t, err)
+
+	// a delta cannot rebuild more than the size of the package, as one copying the old one over and over
+	_, err = ApplyDelta(oldAPK, bytes.NewReader(delta.Bytes()), uint64(len(newAPK)-1))
+	require.ErrorContains(t, err, "more than")
+	oldSum := sha256.Sum256(oldAPK)
+	repeated := append([]byte(deltaMagic), oldSum[:]...)
+	repeated = append(repeated, make([]byte, sha256.Size)...)
+	for i := 0; i < 100; i++ {
+		repeated = append(repeated, 'C')
+		repeated = binary.AppendUvarint(repeated, 0)
+		repeated = binary.AppendUvarint(repeated, uint64(len(oldAPK)))
+	}
+	_, err = ApplyDelta(oldAPK, bytes.NewReader(repeated), uint64(len(newAPK)))
+	require.ErrorContains(t, err, "more than")
+	require.Error(t, err)
+}
+
+func TestExpandDelta(t *testing.T) {
+	ctx := context.Background()
+	checksum, err := ParseQ1Checksum("Q1LLq2qDNrS/qRnhxQ3hsY/sHbQnc=")
+	require.NoError(t, err)
+
+	repoDir := t.TempDir()
+	archDir := filepath.Join(repoDir, testArch)
+	require.NoError(t, os.MkdirAll(archDir, 0o755))
+	repo := &repository.RepositoryWithIndex{Repository: &repository.Repository{Uri: archDir}}
+	pkg := func(version string) *repository.RepositoryPackage {
+		return repository.NewRepositoryPackage(&repository.Package{Name: "alpine-baselayout", Version: version, Arch: testArch, Checksum: checksum}, repo)
+	}
+	// the test data has no two versions of a package that differ, so the new version is the old one
+	// under another name
+	b, err := os.ReadFile(filepath.Join("testdata", "alpine-316", "alpine-baselayout-3.2.0-r23.apk"))
+	require.NoError(t, err)
+	oldPkg, newPkg := pkg("3.2.0-r23"), pkg("3.4.0-r0")
+
+	newAPK := func(t *testing.T) *APK {
+		cache := t.TempDir()
+		a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithCache(cache, true), WithDeltas(true))
+		require.NoError(t, err)
+		// fill the cache with the old version
+		require.NoError(t, os.WriteFile(oldPkg.Url(), b, 0o644))
+		_, err = a.expandPackage(ctx, oldPkg)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(oldPkg.Url()))
+		return a
+	}
+	writeDelta := func(t *testing.T, oldAPK []byte) {
+		var delta bytes.Buffer
+		require.NoError(t, WriteDelta(&delta, oldAPK, b))
+		require.NoError(t, os.WriteFile(DeltaURL(newPkg, oldPkg.Version), delta.Bytes(), 0o644))
+	}
+
+	t.Run("delta", func(t *testing.T) {
+		a := newAPK(t)
+		writeDelta(t, b)
+		// the new version can only be had from the delta
+		exp, err := a.expandPackageFrom(ctx, newPkg, oldPkg.Package, false, nil)
+		require.NoError(t, err)
+		require.Equal(t, checksum, exp.ControlHash)
+	})
+	t.Run("no delta", func(t *testing.T) {
+		a := newAPK(t)
+		_ = os.Remove(DeltaURL(newPkg, oldPkg.Version))
+		_, err := a.expandPackageFrom(ctx, newPkg, oldPkg.Package, false, nil)
+		require.ErrorContains(t, err, "fetching package")
+	})
+	t.Run("bad delta falls back", func(t *testing.T) {
+		a := newAPK(t)
+		writeDelta(t, []byte("another old version"))
+		require.NoError(t, os.WriteFile(newPkg.Url(), b, 0o644))
+		exp, err := a.expandPackageFrom(ctx, newPkg, oldPkg.Package, false, nil)
+		require.NoError(t, err)
+		require.Equal(t, checksum, exp.ControlHash)
+	})
+}
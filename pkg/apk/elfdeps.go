@@ -0,0 +1,192 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+// ELFDependencies are the shared libraries that ELF files need, and those that they are themselves.
+type ELFDependencies struct {
+	// Needed are the files that need each soname, as DT_NEEDED, sorted.
+	Needed map[string][]string
+	// Sonames are the sonames of the shared libraries among the files, as DT_SONAME, by file.
+	Sonames map[string]string
+}
+
+// ScanELF scans the files of the paths in the filesystem, walking those that are directories, for the
+// sonames that the ELF files among them need and are. Files that are not ELF, such as scripts, and
+// symlinks, whose targets are scanned where they are, are skipped.
+func ScanELF(fsys fs.FS, paths ...string) (*ELFDependencies, error) {
+	deps := &ELFDependencies{Needed: map[string][]string{}, Sonames: map[string]string{}}
+	for _, root := range paths {
+		if err := fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			f, err := openELF(fsys, p)
+			if err != nil {
+				return fmt.Errorf("unable to read %s: %w", p, err)
+			}
+			if f == nil {
+				return nil
+			}
+			defer f.Close()
+			needed, err := f.DynString(elf.DT_NEEDED)
+			if err != nil {
+				return fmt.Errorf("unable to read the needed libraries of %s: %w", p, err)
+			}
+			for _, soname := range needed {
+				deps.Needed[soname] = append(deps.Needed[soname], p)
+			}
+			if sonames, err := f.DynString(elf.DT_SONAME); err == nil && len(sonames) > 0 {
+				deps.Sonames[p] = sonames[0]
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	for soname, files := range deps.Needed {
+		sort.Strings(files)
+		deps.Needed[soname] = files
+	}
+	return deps, nil
+}
+
+// openELF returns the ELF file of the path, or nil if it is not one.
+func openELF(fsys fs.FS, p string) (*elf.File, error) {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(elf.ELFMAG))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != elf.ELFMAG {
+		return nil, nil //nolint:nilerr // too short to be ELF
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	ef, err := elf.NewFile(bytes.NewReader(append(magic, rest...)))
+	if err != nil {
+		return nil, nil //nolint:nilerr // not ELF after all
+	}
+	return ef, nil
+}
+
+// SonameProvider is a shared library needed by files scanned by SuggestSonamePackages, and the package
+// that provides it.
+type SonameProvider struct {
+	Soname string `json:"soname"`
+	// Files are the files that need it.
+	Files []string `json:"files"`
+	// Package is the package of the repositories that provides it, as so:<soname>, or empty if none does.
+	Package string `json:"package,omitempty"`
+}
+
+// SuggestSonamePackages scans the files of the paths in the root, such as binaries copied into it
+// rather than installed, as ScanELF does, and returns the shared libraries that they need that nothing
+// installed provides, with the packages of the repositories that do, by soname. Libraries provided
+// by installed packages, as so:, or by the scanned files themselves, are not returned, and those that
+// no package provides are returned without one, so that the caller can tell that they cannot be
+// installed.
+func (a *APK) SuggestSonamePackages(ctx context.Context, paths ...string) ([]SonameProvider, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "SuggestSonamePackages")
+	defer span.End()
+
+	deps, err := ScanELF(a.fs, paths...)
+	if err != nil {
+		return nil, err
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	provided := map[string]bool{}
+	for _, pkg := range installed {
+		for _, p := range pkg.Provides {
+			provided[resolvePackageNameVersionPin(p).name] = true
+		}
+	}
+	for _, soname := range deps.Sonames {
+		provided["so:"+soname] = true
+	}
+
+	providers := []SonameProvider{}
+	for soname, files := range deps.Needed {
+		if !provided["so:"+soname] {
+			providers = append(providers, SonameProvider{Soname: soname, Files: files})
+		}
+	}
+	if len(providers) == 0 {
+		return providers, nil
+	}
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	resolver, err := a.resolverOf(ctx, indexes, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range providers {
+		if pkgs, err := resolver.ResolvePackage("so:" + providers[i].Soname); err == nil && len(pkgs) > 0 {
+			providers[i].Package = pkgs[0].Name
+		}
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Soname < providers[j].Soname
+	})
+	return providers, nil
+}
+
+// AddSonamePackages adds the packages that SuggestSonamePackages suggests for the files of the paths
+// to the world, and installs them, as UpdateWorld does. It returns the suggestions, and is an error,
+// having added nothing, if any of the libraries needed is provided by no package.
+func (a *APK) AddSonamePackages(ctx context.Context, sourceDateEpoch *time.Time, paths ...string) ([]SonameProvider, error) {
+	providers, err := a.SuggestSonamePackages(ctx, paths...)
+	if err != nil {
+		return nil, err
+	}
+	var add []string
+	seen := map[string]bool{}
+	for _, p := range providers {
+		if p.Package == "" {
+			return providers, fmt.Errorf("no package provides %s, needed by %s", p.Soname, p.Files[0])
+		}
+		if !seen[p.Package] {
+			seen[p.Package] = true
+			add = append(add, p.Package)
+		}
+	}
+	if len(add) == 0 {
+		return providers, nil
+	}
+	return providers, a.UpdateWorld(ctx, add, nil, sourceDateEpoch)
+}
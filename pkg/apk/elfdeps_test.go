@@ -0,0 +1,148 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// testELF returns a minimal ELF shared object, of only the sections that name the libraries it needs
+// and its soname, if any.
+func testELF(t *testing.T, soname string, needed ...string) []byte {
+	t.Helper()
+	dynstr := []byte{0}
+	var dyn []elf.Dyn64
+	addString := func(tag elf.DynTag, s string) {
+		dyn = append(dyn, elf.Dyn64{Tag: int64(tag), Val: uint64(len(dynstr))})
+		dynstr = append(append(dynstr, s...), 0)
+	}
+	for _, lib := range needed {
+		addString(elf.DT_NEEDED, lib)
+	}
+	if soname != "" {
+		addString(elf.DT_SONAME, soname)
+	}
+	dyn = append(dyn, elf.Dyn64{Tag: int64(elf.DT_NULL)})
+	shstrtab := []byte("\x00.dynstr\x00.dynamic\x00.shstrtab\x00")
+
+	const headerSize, dynSize, sectionSize = 64, 16, 64
+	dynstrOff := uint64(headerSize)
+	dynOff := (dynstrOff + uint64(len(dynstr)) + 7) &^ 7
+	shstrtabOff := dynOff + uint64(len(dyn)*dynSize)
+	shOff := (shstrtabOff + uint64(len(shstrtab)) + 7) &^ 7
+
+	var buf bytes.Buffer
+	write := func(v any) { require.NoError(t, binary.Write(&buf, binary.LittleEndian, v)) }
+	pad := func(off uint64) { buf.Write(make([]byte, int(off)-buf.Len())) }
+	header := elf.Header64{
+		Type: uint16(elf.ET_DYN), Machine: uint16(elf.EM_X86_64), Version: uint32(elf.EV_CURRENT),
+		Shoff: shOff, Ehsize: headerSize, Shentsize: sectionSize, Shnum: 4, Shstrndx: 3,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	write(header)
+	buf.Write(dynstr)
+	pad(dynOff)
+	write(dyn)
+	buf.Write(shstrtab)
+	pad(shOff)
+	write([]elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: dynstrOff, Size: uint64(len(dynstr)), Addralign: 1},
+		{Name: 9, Type: uint32(elf.SHT_DYNAMIC), Off: dynOff, Size: uint64(len(dyn) * dynSize), Link: 1, Addralign: 8, Entsize: dynSize},
+		{Name: 18, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint64(len(shstrtab)), Addralign: 1},
+	})
+	return buf.Bytes()
+}
+
+func TestScanELF(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("opt/app/lib", 0o755))
+	require.NoError(t, fsys.WriteFile("opt/app/app", testELF(t, "", "libfoo.so.1", "libself.so.2"), 0o755))
+	require.NoError(t, fsys.WriteFile("opt/app/lib/libself.so.2", testELF(t, "libself.so.2", "libfoo.so.1"), 0o755))
+	require.NoError(t, fsys.WriteFile("opt/app/run.sh", []byte("#!/bin/sh\n"), 0o755))
+	require.NoError(t, fsys.WriteFile("opt/app/short", []byte("\x7fE"), 0o644))
+	require.NoError(t, fsys.Symlink("app", "opt/app/app-link"))
+
+	deps, err := ScanELF(fsys, "opt/app")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{
+		"libfoo.so.1":  {"opt/app/app", "opt/app/lib/libself.so.2"},
+		"libself.so.2": {"opt/app/app"},
+	}, deps.Needed)
+	require.Equal(t, map[string]string{"opt/app/lib/libself.so.2": "libself.so.2"}, deps.Sonames)
+
+	_, err = ScanELF(fsys, "opt/missing")
+	require.Error(t, err)
+}
+
+func TestSonamePackages(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	build := func(pkg *repository.Package, files map[string]string) string {
+		file := filepath.Join(src, pkg.Name+".apk")
+		writeTestAPK(t, file, pkg, files)
+		return file
+	}
+	repoDir := t.TempDir()
+	_, err := (&Publisher{Dir: repoDir}).Publish(ctx, "edge", "main",
+		build(&repository.Package{Name: "libfoo", Version: "1.0-r0", Arch: testArch, Provides: []string{"so:libfoo.so.1=1"}},
+			map[string]string{"usr/lib/libfoo.so.1": "lib"}),
+		build(&repository.Package{Name: "musl", Version: "1.2-r0", Arch: testArch, Provides: []string{"so:libc.musl-aarch64.so.1=1"}},
+			map[string]string{"lib/ld-musl-aarch64.so.1": "musl"}))
+	require.NoError(t, err)
+
+	a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithIgnoreMknodErrors(true), WithAllowUntrusted(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetRepositories([]string{filepath.Join(repoDir, "edge", "main")}))
+	require.NoError(t, a.SetWorld([]string{"musl"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	require.NoError(t, a.fs.MkdirAll("opt/app", 0o755))
+	require.NoError(t, a.fs.WriteFile("opt/app/app", testELF(t, "", "libfoo.so.1", "libc.musl-aarch64.so.1"), 0o755))
+	require.NoError(t, a.fs.WriteFile("opt/app/tool", testELF(t, "", "libnone.so.9"), 0o755))
+
+	providers, err := a.SuggestSonamePackages(ctx, "opt/app")
+	require.NoError(t, err)
+	require.Equal(t, []SonameProvider{
+		{Soname: "libfoo.so.1", Files: []string{"opt/app/app"}, Package: "libfoo"},
+		{Soname: "libnone.so.9", Files: []string{"opt/app/tool"}},
+	}, providers)
+	_, err = a.AddSonamePackages(ctx, nil, "opt/app")
+	require.ErrorContains(t, err, "no package provides libnone.so.9, needed by opt/app/tool")
+
+	providers, err = a.AddSonamePackages(ctx, nil, "opt/app/app")
+	require.NoError(t, err)
+	require.Len(t, providers, 1)
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"libfoo", "musl"}, world)
+	providers, err = a.SuggestSonamePackages(ctx, "opt/app/app")
+	require.NoError(t, err)
+	require.Empty(t, providers)
+}
@@ -17,6 +17,8 @@ package apk
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
 type FileExistsError struct {
@@ -32,3 +34,126 @@ func (f FileExistsError) Is(target error) bool {
 	var targetError FileExistsError
 	return errors.As(target, &targetError)
 }
+
+// InvalidOptionsError is returned by New and Clone for options that cannot be used, alone or together.
+type InvalidOptionsError struct {
+	// Problems describe each of the options, or combinations of them, that cannot be used.
+	Problems []string
+}
+
+func (e *InvalidOptionsError) Error() string {
+	return "invalid options: " + strings.Join(e.Problems, "; ")
+}
+
+// PartialInstallError is returned with WithBestEffort when some of the packages could not be
+// resolved or fetched, once the rest of them are installed.
+type PartialInstallError struct {
+	// Failures are the packages that were not installed, and why.
+	Failures []PackageFailure
+}
+
+// PackageFailure is a package that could not be installed. Name is that of the world entry if it
+// could not be resolved, or of the package if it, or a package it depends on, could not be fetched.
+type PackageFailure struct {
+	Name string
+	Err  error
+}
+
+func (e *PartialInstallError) Error() string {
+	parts := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		parts = append(parts, fmt.Sprintf("%s: %v", f.Name, f.Err))
+	}
+	return fmt.Sprintf("%d packages were not installed: %s", len(e.Failures), strings.Join(parts, "; "))
+}
+
+func (e *PartialInstallError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		errs = append(errs, f.Err)
+	}
+	return errs
+}
+
+// InstalledSizeExceededError is returned when the resolved set of packages is larger than
+// the budget set with WithMaxInstalledSize.
+type InstalledSizeExceededError struct {
+	Max   uint64
+	Total uint64
+	// Largest holds the biggest contributors to Total, largest first.
+	Largest []PackageSize
+}
+
+// PackageSize is the installed size of a single package.
+type PackageSize struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+}
+
+func (e *InstalledSizeExceededError) Error() string {
+	parts := make([]string, 0, len(e.Largest))
+	for _, p := range e.Largest {
+		parts = append(parts, fmt.Sprintf("%s (%d)", p.Name, p.Size))
+	}
+	return fmt.Sprintf("installed size %d exceeds maximum of %d bytes, largest packages: %s", e.Total, e.Max, strings.Join(parts, ", "))
+}
+
+// InsufficientSpaceError is returned when the packages to install do not fit in the space available
+// on the filesystem of the root, before any of them is installed.
+type InsufficientSpaceError struct {
+	// Needed is the installed size of the packages, less that of the versions they replace.
+	Needed    uint64
+	Available uint64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("not enough disk space to install: %d bytes needed, %d available", e.Needed, e.Available)
+}
+
+// HeldPackageError is returned when the world cannot be resolved because a held package
+// would need to move to another version.
+type HeldPackageError struct {
+	Name string
+	Held string
+	// Wanted is the version, or version constraint, that resolution needs for the package.
+	Wanted string
+	// RequiredBy is the package that needs the other version, if known.
+	RequiredBy string
+	wrapped    error
+}
+
+func (e *HeldPackageError) Error() string {
+	msg := fmt.Sprintf("held package %s=%s blocks resolution, which wants %s", e.Name, e.Held, e.Wanted)
+	if e.RequiredBy != "" {
+		msg = fmt.Sprintf("held package %s=%s blocks %s, which requires %s", e.Name, e.Held, e.RequiredBy, e.Wanted)
+	}
+	if e.wrapped != nil {
+		msg += ": " + e.wrapped.Error()
+	}
+	return msg
+}
+
+func (e *HeldPackageError) Unwrap() error {
+	return e.wrapped
+}
+
+// StaleIndexError is returned, with WithMaxIndexAge, when repository indexes were built longer ago than
+// allowed, as those of a mirror that stopped syncing are.
+type StaleIndexError struct {
+	MaxAge time.Duration
+	Stale  []StaleIndex
+}
+
+// StaleIndex is a repository index, by its URL, and when it was built.
+type StaleIndex struct {
+	Index string
+	Built time.Time
+}
+
+func (e *StaleIndexError) Error() string {
+	parts := make([]string, 0, len(e.Stale))
+	for _, s := range e.Stale {
+		parts = append(parts, fmt.Sprintf("%s (built %s)", s.Index, s.Built.UTC().Format(time.RFC3339)))
+	}
+	return fmt.Sprintf("repository indexes older than %s: %s", e.MaxAge, strings.Join(parts, ", "))
+}
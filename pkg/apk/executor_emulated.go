@@ -0,0 +1,176 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// EmulatedExecutor runs commands of another architecture than that of the host, such as the scripts
+// of aarch64 packages installed on an x86_64 host, through another executor, such as a
+// NamespaceExecutor, relying on qemu-user being registered with binfmt_misc for the architecture.
+// If it is registered without the F flag, so that the kernel looks for qemu in the root the command
+// runs in, qemu is copied into the root for as long as the command runs. Commands of the architecture
+// of the host are run as they are.
+type EmulatedExecutor struct {
+	arch     string
+	root     string
+	executor Executor
+	// binfmtDir is where binfmt_misc is mounted.
+	binfmtDir string
+}
+
+// EmulationUnavailableError is returned by EmulatedExecutor when commands of the architecture cannot
+// be run on the host.
+type EmulationUnavailableError struct {
+	Arch   string
+	Host   string
+	Reason string
+}
+
+func (e *EmulationUnavailableError) Error() string {
+	return fmt.Sprintf("cannot run commands for %s on this %s host: %s; register qemu-user with binfmt_misc, e.g. by installing qemu-user-static and binfmt-support, or with docker run --privileged --rm tonistiigi/binfmt --install %s",
+		e.Arch, e.Host, e.Reason, qemuArch(e.Arch))
+}
+
+// NewEmulatedExecutor returns an executor running commands of the architecture, in the root directory
+// the executor runs them in, with the executor.
+func NewEmulatedExecutor(arch, root string, executor Executor) *EmulatedExecutor {
+	return &EmulatedExecutor{arch: arch, root: root, executor: executor, binfmtDir: binfmtMiscDir}
+}
+
+// Check returns an EmulationUnavailableError if commands of the architecture cannot be run.
+func (e *EmulatedExecutor) Check() error {
+	_, err := e.emulator()
+	return err
+}
+
+// Execute runs the command with the arguments.
+func (e *EmulatedExecutor) Execute(name string, arg ...string) error {
+	emulator, err := e.emulator()
+	if err != nil {
+		return err
+	}
+	if emulator == "" {
+		return e.executor.Execute(name, arg...)
+	}
+	target := filepath.Join(e.root, emulator)
+	if _, err := os.Stat(target); err == nil {
+		return e.executor.Execute(name, arg...)
+	}
+	created, err := copyEmulator(emulator, target)
+	defer removeEmulator(target, created)
+	if err != nil {
+		return fmt.Errorf("copying %s into the root: %w", emulator, err)
+	}
+	return e.executor.Execute(name, arg...)
+}
+
+// emulator returns the interpreter that the kernel runs commands of the architecture with and that
+// must be in the root, or "" if the commands can be run as they are.
+func (e *EmulatedExecutor) emulator() (string, error) {
+	host := ArchToAPK(runtime.GOARCH)
+	if e.arch == host || (e.arch == "x86" && host == "x86_64") {
+		return "", nil
+	}
+	unavailable := func(reason string) error {
+		return &EmulationUnavailableError{Arch: e.arch, Host: host, Reason: reason}
+	}
+	if status, err := os.ReadFile(filepath.Join(e.binfmtDir, "status")); err != nil || strings.TrimSpace(string(status)) != "enabled" {
+		return "", unavailable("binfmt_misc is not enabled")
+	}
+	b, err := os.ReadFile(filepath.Join(e.binfmtDir, "qemu-"+qemuArch(e.arch)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", unavailable("qemu-" + qemuArch(e.arch) + " is not registered with binfmt_misc")
+	}
+	if err != nil {
+		return "", unavailable(err.Error())
+	}
+	var (
+		enabled     bool
+		interpreter string
+		flags       string
+	)
+	for _, line := range strings.Split(string(b), "\n") {
+		switch key, value, _ := strings.Cut(line, " "); key {
+		case "enabled":
+			enabled = true
+		case "interpreter":
+			interpreter = value
+		case "flags:":
+			flags = value
+		}
+	}
+	switch {
+	case !enabled:
+		return "", unavailable("qemu-" + qemuArch(e.arch) + " is disabled in binfmt_misc")
+	case strings.Contains(flags, "F"):
+		// the kernel has qemu open already, so it need not be in the root
+		return "", nil
+	case interpreter == "":
+		return "", unavailable("qemu-" + qemuArch(e.arch) + " has no interpreter in binfmt_misc")
+	}
+	return interpreter, nil
+}
+
+// copyEmulator copies qemu from the host into the root, where the kernel expects it. It returns the
+// directories it created for it, deepest first, including when it fails.
+func copyEmulator(src, dst string) ([]string, error) {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	var created []string
+	for dir := filepath.Dir(dst); ; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil || dir == filepath.Dir(dir) {
+			break
+		}
+		created = append(created, dir)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return created, err
+	}
+	// #nosec G306 -- qemu must be executable
+	return created, os.WriteFile(dst, b, 0o755)
+}
+
+// removeEmulator removes qemu from the root, along with the directories copyEmulator created for it.
+// Those that the command has put anything else in are kept.
+func removeEmulator(dst string, created []string) {
+	_ = os.Remove(dst)
+	for _, dir := range created {
+		_ = os.Remove(dir)
+	}
+}
+
+// qemuArch returns the name qemu has for the apk architecture.
+func qemuArch(arch string) string {
+	switch arch {
+	case "x86":
+		return "i386"
+	case "armhf", "armv7":
+		return "arm"
+	default:
+		return arch
+	}
+}
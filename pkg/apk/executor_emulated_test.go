@@ -0,0 +1,97 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type funcExecutor func(name string, arg ...string) error
+
+func (f funcExecutor) Execute(name string, arg ...string) error { return f(name, arg...) }
+
+func TestEmulatedExecutor(t *testing.T) {
+	foreign := "aarch64"
+	if ArchToAPK(runtime.GOARCH) == foreign {
+		foreign = "x86_64"
+	}
+	qemu := filepath.Join(t.TempDir(), "qemu-static")
+	require.NoError(t, os.WriteFile(qemu, []byte("qemu"), 0o755))
+
+	newExecutor := func(t *testing.T, arch, registration string) (*EmulatedExecutor, *[]string) {
+		root, binfmt := t.TempDir(), t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(binfmt, "status"), []byte("enabled\n"), 0o644))
+		if registration != "" {
+			require.NoError(t, os.WriteFile(filepath.Join(binfmt, "qemu-"+qemuArch(arch)), []byte(registration), 0o644))
+		}
+		var runs []string
+		e := NewEmulatedExecutor(arch, root, funcExecutor(func(name string, arg ...string) error {
+			// whether qemu was in the root while the command ran
+			_, err := os.Stat(filepath.Join(root, qemu))
+			runs = append(runs, name+" "+map[bool]string{true: "with qemu", false: "without qemu"}[err == nil])
+			return nil
+		}))
+		e.binfmtDir = binfmt
+		return e, &runs
+	}
+
+	t.Run("native", func(t *testing.T) {
+		e, runs := newExecutor(t, ArchToAPK(runtime.GOARCH), "")
+		require.NoError(t, e.Execute("/bin/true"))
+		require.Equal(t, []string{"/bin/true without qemu"}, *runs)
+	})
+	t.Run("unavailable", func(t *testing.T) {
+		e, runs := newExecutor(t, foreign, "")
+		var unavailable *EmulationUnavailableError
+		require.ErrorAs(t, e.Check(), &unavailable)
+		require.Equal(t, foreign, unavailable.Arch)
+		require.ErrorAs(t, e.Execute("/bin/true"), &unavailable)
+		require.Empty(t, *runs)
+	})
+	t.Run("disabled", func(t *testing.T) {
+		e, _ := newExecutor(t, foreign, "disabled\ninterpreter "+qemu+"\nflags: F\n")
+		require.ErrorContains(t, e.Check(), "is disabled")
+	})
+	t.Run("fix binary", func(t *testing.T) {
+		e, runs := newExecutor(t, foreign, "enabled\ninterpreter "+qemu+"\nflags: OCF\n")
+		require.NoError(t, e.Execute("/bin/true"))
+		require.Equal(t, []string{"/bin/true without qemu"}, *runs)
+	})
+	t.Run("qemu copied into the root", func(t *testing.T) {
+		e, runs := newExecutor(t, foreign, "enabled\ninterpreter "+qemu+"\nflags: OC\n")
+		require.NoError(t, e.Execute("/bin/true"))
+		require.Equal(t, []string{"/bin/true with qemu"}, *runs)
+		// along with the directories created for it
+		entries, err := os.ReadDir(e.root)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+	t.Run("directories of the root are kept", func(t *testing.T) {
+		e, runs := newExecutor(t, foreign, "enabled\ninterpreter "+qemu+"\nflags: OC\n")
+		existing := filepath.Join(e.root, filepath.Dir(filepath.Dir(qemu)))
+		require.NoError(t, os.MkdirAll(existing, 0o755))
+		require.NoError(t, e.Execute("/bin/true"))
+		require.Equal(t, []string{"/bin/true with qemu"}, *runs)
+		_, err := os.Stat(filepath.Join(e.root, filepath.Dir(qemu)))
+		require.ErrorIs(t, err, os.ErrNotExist)
+		_, err = os.Stat(existing)
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"time"
+)
+
+// maxExecOutput is how much of the output of each command is kept.
+const maxExecOutput = 1 << 20
+
+// ExecOutput is what a command run by an executor wrote, and how it ended.
+type ExecOutput struct {
+	Name     string
+	Args     []string
+	Stdout   []byte
+	Stderr   []byte
+	Duration time.Duration
+	// Err is nil if the command succeeded.
+	Err error
+}
+
+// NamespaceExecutor runs commands, such as the scripts of packages, chrooted into a root filesystem,
+// in new user, mount, PID, IPC, UTS and network namespaces, as root of the user namespace, which is
+// the calling user outside of it. It needs no privileges on Linux systems that allow unprivileged
+// user namespaces, and no container runtime. Only Linux is supported.
+type NamespaceExecutor struct {
+	root    string
+	env     []string
+	network bool
+	timeout time.Duration
+	limits  map[int]uint64
+	output  func(ExecOutput)
+}
+
+// NamespaceExecutorOption is an option of NewNamespaceExecutor.
+type NamespaceExecutorOption func(*NamespaceExecutor)
+
+// NewNamespaceExecutor returns an executor that runs commands in the root directory, which is usually
+// that of the filesystem packages are installed in.
+func NewNamespaceExecutor(root string, options ...NamespaceExecutorOption) *NamespaceExecutor {
+	e := &NamespaceExecutor{
+		root:   root,
+		env:    []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root"},
+		limits: map[int]uint64{},
+	}
+	for _, option := range options {
+		option(e)
+	}
+	return e
+}
+
+// WithExecEnv sets the environment of the commands, replacing the default of PATH and HOME.
+func WithExecEnv(env ...string) NamespaceExecutorOption {
+	return func(e *NamespaceExecutor) {
+		e.env = env
+	}
+}
+
+// WithExecNetwork lets the commands use the network of the host; by default they have none.
+func WithExecNetwork(network bool) NamespaceExecutorOption {
+	return func(e *NamespaceExecutor) {
+		e.network = network
+	}
+}
+
+// WithExecTimeout kills commands that run for longer than the timeout.
+func WithExecTimeout(timeout time.Duration) NamespaceExecutorOption {
+	return func(e *NamespaceExecutor) {
+		e.timeout = timeout
+	}
+}
+
+// WithExecLimit sets the limit of a resource of the commands, one of the RLIMIT_ constants of
+// golang.org/x/sys/unix, such as RLIMIT_AS for memory or RLIMIT_CPU for CPU seconds. The limit is
+// set as soon as the command is started, so it may be exceeded for the first instants.
+func WithExecLimit(resource int, limit uint64) NamespaceExecutorOption {
+	return func(e *NamespaceExecutor) {
+		e.limits[resource] = limit
+	}
+}
+
+// WithExecOutput calls output with what each command wrote, up to a megabyte of each of its
+// standard output and error, once it has ended.
+func WithExecOutput(output func(ExecOutput)) NamespaceExecutorOption {
+	return func(e *NamespaceExecutor) {
+		e.output = output
+	}
+}
+
+// limitedBuffer keeps the first max bytes written to it, and discards the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// lastLine returns the last non-empty line of the output, for errors.
+func lastLine(b []byte) string {
+	lines := bytes.Split(bytes.TrimRight(b, "\n"), []byte("\n"))
+	return string(lines[len(lines)-1])
+}
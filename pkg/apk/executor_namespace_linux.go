@@ -0,0 +1,83 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Execute runs the command, which is a path in the root, with the arguments.
+func (e *NamespaceExecutor) Execute(name string, arg ...string) error {
+	ctx := context.Background()
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+
+	stdout := &limitedBuffer{max: maxExecOutput}
+	stderr := &limitedBuffer{max: maxExecOutput}
+	cmd := exec.CommandContext(ctx, name, arg...) //nolint:gosec // running the command is the point
+	cmd.Dir = "/"
+	cmd.Env = e.env
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	if !e.network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Chroot:                     e.root,
+		Cloneflags:                 uintptr(flags),
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+		Pdeathsig:                  syscall.SIGKILL,
+	}
+
+	start := time.Now()
+	err := cmd.Start()
+	if err == nil {
+		for resource, limit := range e.limits {
+			if limitErr := unix.Prlimit(cmd.Process.Pid, resource, &unix.Rlimit{Cur: limit, Max: limit}, nil); limitErr != nil {
+				_ = cmd.Process.Kill()
+				err = fmt.Errorf("limiting resource %d: %w", resource, limitErr)
+				break
+			}
+		}
+		err = errors.Join(err, cmd.Wait())
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %s: %w", e.timeout, err)
+	}
+	if err != nil && stderr.Len() > 0 {
+		err = fmt.Errorf("%w: %s", err, lastLine(stderr.Bytes()))
+	}
+	if e.output != nil {
+		e.output(ExecOutput{Name: name, Args: arg, Stdout: stdout.Bytes(), Stderr: stderr.Bytes(), Duration: time.Since(start), Err: err})
+	}
+	return err
+}
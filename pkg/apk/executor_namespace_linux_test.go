@@ -0,0 +1,46 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package apk
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaceExecutor(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	// the host is the root, so that there is a shell to run
+	if err := NewNamespaceExecutor("/").Execute("/bin/sh", "-c", "true"); err != nil {
+		t.Skipf("user namespaces are not available: %v", err)
+	}
+	var outputs []ExecOutput
+	e := NewNamespaceExecutor("/", WithExecOutput(func(o ExecOutput) { outputs = append(outputs, o) }), WithExecTimeout(time.Minute))
+	err := e.Execute("/bin/sh", "-c", "id -u; echo oops >&2; exit 3")
+	require.ErrorContains(t, err, "exit status 3: oops")
+	require.Len(t, outputs, 1)
+	require.Equal(t, "0\n", string(outputs[0].Stdout))
+	require.Equal(t, "oops\n", string(outputs[0].Stderr))
+
+	e = NewNamespaceExecutor("/", WithExecTimeout(100*time.Millisecond))
+	require.ErrorContains(t, e.Execute("/bin/sh", "-c", "sleep 10"), "timed out")
+}
@@ -22,7 +22,6 @@ import (
 	"strings"
 
 	"github.com/chainguard-dev/go-apk/internal/tarfs"
-	"github.com/klauspost/compress/gzip"
 
 	"go.opentelemetry.io/otel"
 )
@@ -82,10 +81,11 @@ func (a *APKExpanded) PackageData() (io.ReadSeekCloser, error) {
 	}
 
 	br := bufio.NewReaderSize(f, bufSize)
-	zr, err := gzip.NewReader(br)
+	zr, err := getGzipReader(br)
 	if err != nil {
 		return nil, fmt.Errorf("parsing %q: %w", a.PackageFile, err)
 	}
+	defer putGzipReader(zr)
 
 	uf, err = os.Create(a.tarFile)
 	if err != nil {
@@ -201,11 +201,11 @@ func (w *expandApkWriter) Next() error {
 			return fmt.Errorf("expandApkWriter.Next error 2: %v", err)
 		}
 		defer f.Close()
-		gzipRead, err := gzip.NewReader(f)
+		gzipRead, err := getGzipReader(f)
 		if err != nil {
 			return fmt.Errorf("expandApkWriter.Next error 3: %v", err)
 		}
-		defer gzipRead.Close()
+		defer putGzipReader(gzipRead)
 		tarRead := tar.NewReader(gzipRead)
 		hdr, err := tarRead.Next()
 		if err != nil {
@@ -288,6 +288,8 @@ func (r *expandApkReader) EnableFastRead() {
 //	own gzip stream (3 streams total). These streams contain the package signature,
 //	control data, and package data"
 //
+// Sections that are not gzipped are rejected with an UnsupportedCompressionError, as apk does.
+//
 // Returns an APKExpanded struct containing references to the file. You *must* call APKExpanded.Close()
 // when finished to clean up the various files.
 func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpanded, error) {
@@ -303,9 +305,22 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	if err != nil {
 		return nil, fmt.Errorf("expandApk error 1: %w", err)
 	}
+	// leave nothing open or behind for packages that cannot be expanded
+	expandedOK := false
+	defer func() {
+		if !expandedOK {
+			if sw.f != nil {
+				_ = sw.f.Close()
+			}
+			_ = os.RemoveAll(dir)
+		}
+	}()
 	exR := newExpandApkReader(source)
 	tr := io.TeeReader(exR, sw)
-	var gzi *gzip.Reader
+	// the package data is indexed as it is verified, so it is declared up front for the index
+	// to open its tar file, wherever that ends up
+	var expanded APKExpanded
+	var gzi *gzipReader
 	gzipStreams := []string{}
 	hashes := [][]byte{}
 	maxStreamsReached := false
@@ -328,7 +343,7 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 		hr := io.TeeReader(tr, h)
 
 		if gzi == nil {
-			gzi, err = gzip.NewReader(hr)
+			gzi, err = getGzipReader(hr)
 		} else {
 			err = gzi.Reset(hr)
 		}
@@ -336,7 +351,7 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return nil, fmt.Errorf("creating gzip reader: %w", err)
+			return nil, fmt.Errorf("creating gzip reader: %w", sectionCompressionError(tr, sw.CurrentName(), err))
 		}
 
 		if !maxStreamsReached {
@@ -355,10 +370,13 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 			if err != nil {
 				return nil, fmt.Errorf("opening tar file: %w", err)
 			}
+			defer tarfile.Close()
 			bw := bufio.NewWriterSize(tarfile, 1<<20)
 			tr := io.TeeReader(gzi, bw)
 
-			if err := checkSums(ctx, tr); err != nil {
+			expanded.tarFile = tarfilename
+			expanded.tarfs, err = indexAndCheckSums(ctx, tr, expanded.PackageData)
+			if err != nil {
 				return nil, fmt.Errorf("checking sums: %w", err)
 			}
 			if _, err := io.Copy(io.Discard, tr); err != nil {
@@ -378,9 +396,14 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 		}
 	}
 
+	if gzi == nil {
+		// the source was empty, or not gzip at all
+		return nil, fmt.Errorf("invalid number of tar streams: 0")
+	}
 	if err := gzi.Close(); err != nil {
 		return nil, fmt.Errorf("expandApk error 6: %w", err)
 	}
+	gzipReaders.Put(gzi)
 	if err := sw.CloseFile(); err != nil {
 		return nil, fmt.Errorf("expandApk error 7: %w", err)
 	}
@@ -409,68 +432,54 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 		return nil, fmt.Errorf("invalid number of tar streams: %d", numGzipStreams)
 	}
 
-	expanded := APKExpanded{
-		tempDir:     dir,
-		Signed:      signed,
-		Size:        totalSize,
-		ControlFile: gzipStreams[controlDataIndex],
-		ControlHash: hashes[controlDataIndex],
-		PackageFile: gzipStreams[controlDataIndex+1],
-		PackageHash: hashes[controlDataIndex+1],
-	}
+	expanded.tempDir = dir
+	expanded.Signed = signed
+	expanded.Size = totalSize
+	expanded.ControlFile = gzipStreams[controlDataIndex]
+	expanded.ControlHash = hashes[controlDataIndex]
+	expanded.PackageFile = gzipStreams[controlDataIndex+1]
+	expanded.PackageHash = hashes[controlDataIndex+1]
 	if signed {
 		expanded.SignatureFile = gzipStreams[0]
 	}
 
-	expanded.tarFile = strings.TrimSuffix(expanded.PackageFile, ".gz")
-
-	// TODO: We could overlap this with checkSums.
-	expanded.tarfs, err = tarfs.New(expanded.PackageData)
-	if err != nil {
-		return nil, fmt.Errorf("indexing %q: %w", expanded.tarFile, err)
-	}
-
+	expandedOK = true
 	return &expanded, nil
 }
 
-func checkSums(ctx context.Context, r io.Reader) error {
-	ctx, span := otel.Tracer("go-apk").Start(ctx, "checkSums")
+// indexAndCheckSums indexes the package data tar as it streams past, verifying the checksum of each
+// file on the way, so that neither requires another pass over the data once it is on disk.
+func indexAndCheckSums(ctx context.Context, r io.Reader, open func() (io.ReadSeekCloser, error)) (*tarfs.FS, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "checkSums")
 	defer span.End()
 
-	tr := tar.NewReader(r)
-
-	for {
-		header, err := tr.Next()
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
-			return err
-		}
+	return tarfs.Index(r, open, checkSum)
+}
 
-		if header.Typeflag != tar.TypeReg {
-			continue
-		}
+// checkSum verifies the contents of a regular file against the checksum in its header.
+func checkSum(header *tar.Header, r io.Reader) error {
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
 
-		checksum, err := checksumFromHeader(header)
-		if err != nil {
-			return err
-		}
+	checksum, err := checksumFromHeader(header)
+	if err != nil {
+		return err
+	}
 
-		// If for some reason this is missing, ignore it. We will calculate it later.
-		if checksum == nil {
-			continue
-		}
+	// If for some reason this is missing, ignore it. We will calculate it later.
+	if checksum == nil {
+		return nil
+	}
 
-		w := sha1.New() //nolint:gosec // this is what apk tools is using
+	w := sha1.New() //nolint:gosec // this is what apk tools is using
 
-		if _, err := io.Copy(w, tr); err != nil {
-			return fmt.Errorf("hashing %s: %w", header.Name, err)
-		}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("hashing %s: %w", header.Name, err)
+	}
 
-		if want, got := checksum, w.Sum(nil); !bytes.Equal(want, got) {
-			return fmt.Errorf("checksum mismatch: %s header was %x, computed %x", header.Name, want, got)
-		}
+	if want, got := checksum, w.Sum(nil); !bytes.Equal(want, got) {
+		return fmt.Errorf("checksum mismatch: %s header was %x, computed %x", header.Name, want, got)
 	}
 
 	return nil
@@ -0,0 +1,111 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandApkIndex(t *testing.T) {
+	f, err := os.Open(filepath.Join(testPrimaryPkgDir, "alpine-baselayout-3.2.0-r23.apk"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	exp, err := ExpandApk(context.Background(), f, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+
+	// the index is built while the data streams past; every file found through it must verify
+	// against its checksum when read back from the tar file on disk
+	var files int
+	for _, entry := range exp.tarfs.Entries() {
+		hdr := entry.Header
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			continue
+		}
+		files++
+		ef, err := exp.tarfs.Open(hdr.Name)
+		require.NoError(t, err)
+		b, err := io.ReadAll(ef)
+		require.NoError(t, err)
+		require.NoError(t, ef.Close())
+		require.Len(t, b, int(hdr.Size))
+		require.NoError(t, checkSum(&hdr, bytes.NewReader(b)), hdr.Name)
+	}
+	require.NotZero(t, files)
+}
+
+func TestExpandApkCompression(t *testing.T) {
+	plainTar := func(name, contents string) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(contents))}))
+		_, err := tw.Write([]byte(contents))
+		require.NoError(t, err)
+		require.NoError(t, tw.Flush())
+		return buf.Bytes()
+	}
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+	control := plainTar(".PKGINFO", "pkgname = hello\npkgver = 1.0-r0\n")
+
+	for _, tt := range []struct {
+		name        string
+		apk         []byte
+		compression string
+	}{
+		{name: "plain tar", apk: append(control, plainTar("usr/bin/hello", "hello")...), compression: CompressionNone},
+		{name: "bzip2", apk: []byte("BZh91AY&SY\x00\x00\x00"), compression: CompressionBzip2},
+		{name: "xz", apk: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00, 0x04}, compression: CompressionXz},
+		{name: "zstd", apk: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x00}, compression: CompressionZstd},
+		{name: "plain tar data section", apk: append(gzipped(control), plainTar("usr/bin/hello", "hello")...), compression: CompressionNone},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ExpandApk(context.Background(), bytes.NewReader(tt.apk), t.TempDir())
+			var unsupported *UnsupportedCompressionError
+			require.ErrorAs(t, err, &unsupported)
+			require.Equal(t, tt.compression, unsupported.Compression)
+			require.ErrorContains(t, err, "unsupported compression: "+tt.compression)
+
+			if tt.name == "plain tar" {
+				_, err := parseControl(tt.apk)
+				require.ErrorAs(t, err, &unsupported)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := ExpandApk(context.Background(), bytes.NewReader([]byte("not a package at all")), t.TempDir())
+		require.Error(t, err)
+		var unsupported *UnsupportedCompressionError
+		require.False(t, errors.As(err, &unsupported))
+	})
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	logger "github.com/chainguard-dev/go-apk/pkg/logger"
+)
+
+// cacheStatusHeader is set by the cache on its responses, to how they were served, for the fetch
+// trace to log.
+const cacheStatusHeader = "X-Go-Apk-Cache"
+
+const (
+	cacheHit  = "hit"
+	cacheMiss = "miss"
+)
+
+// setCacheStatus records how the cache served the response, if there is one.
+func setCacheStatus(resp *http.Response, status string) {
+	if resp == nil {
+		return
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Set(cacheStatusHeader, status)
+}
+
+// fetchTracedKey marks the context of a request that is already traced, so that the requests the
+// cache makes for it are not traced again.
+type fetchTracedKey struct{}
+
+// tracingTransport logs every request, with the status, size and duration of its response, and how
+// the cache served it, once the body of the response is read or closed.
+type tracingTransport struct {
+	wrapped http.RoundTripper
+	logger  logger.Logger
+}
+
+// traceClient returns the client, logging its requests if WithFetchTracing is set.
+func (a *APK) traceClient(client *http.Client) *http.Client {
+	if !a.traceFetches {
+		return client
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	traced := *client
+	traced.Transport = &tracingTransport{wrapped: transport, logger: a.logger}
+	return &traced
+}
+
+// cacheClient returns client reading from and writing to the cache, which must be set, as
+// cache.client does, logging its requests if WithFetchTracing is set.
+func (a *APK) cacheClient(client *http.Client, etagRequired bool) *http.Client {
+	return a.traceClient(a.cache.client(client, etagRequired))
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(fetchTracedKey{}) != nil {
+		return t.wrapped.RoundTrip(req)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), fetchTracedKey{}, true))
+	start := time.Now()
+	resp, err := t.wrapped.RoundTrip(req)
+	if err != nil {
+		t.logger.Debugf("fetch %s %s: failed after %s: %v", req.Method, req.URL.Redacted(), time.Since(start).Round(time.Millisecond), err)
+		return resp, err
+	}
+	cacheStatus := resp.Header.Get(cacheStatusHeader)
+	if cacheStatus == "" {
+		cacheStatus = "none"
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		t.logger.Debugf("fetch %s %s: %d, 0 bytes in %s, cache %s", req.Method, req.URL.Redacted(), resp.StatusCode, time.Since(start).Round(time.Millisecond), cacheStatus)
+		return resp, nil
+	}
+	body := &tracedBody{ReadCloser: resp.Body}
+	body.done = func() {
+		t.logger.Debugf("fetch %s %s: %d, %d bytes in %s, cache %s", req.Method, req.URL.Redacted(), resp.StatusCode, body.n, time.Since(start).Round(time.Millisecond), cacheStatus)
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// tracedBody counts the bytes read of a body, calling done once it is read to the end or closed.
+type tracedBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func()
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchTracing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		_, _ = io.WriteString(w, "index")
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&logs)
+	log.SetLevel(logrus.DebugLevel)
+	a, err := New(WithLogger(log), WithCache(t.TempDir(), false), WithFetchTracing(true))
+	require.NoError(t, err)
+
+	u := server.URL + "/main/x86_64/APKINDEX.tar.gz"
+	for i := 0; i < 2; i++ {
+		res, err := a.cacheClient(a.getClient(), true).Get(u)
+		require.NoError(t, err)
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, "index", string(b))
+	}
+
+	var fetches []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if _, fetch, ok := strings.Cut(line, "fetch "); ok {
+			fetches = append(fetches, strings.TrimSuffix(fetch, `"`))
+		}
+	}
+	require.Len(t, fetches, 4)
+	require.Regexp(t, `^HEAD .*/APKINDEX.tar.gz: 200, 0 bytes in .*, cache none$`, fetches[0])
+	require.Regexp(t, `^GET .*/APKINDEX.tar.gz: 200, 5 bytes in .*, cache miss$`, fetches[1])
+	require.Regexp(t, `^HEAD `, fetches[2])
+	require.Regexp(t, `^GET .*/APKINDEX.tar.gz: 200, 5 bytes in .*, cache hit$`, fetches[3])
+
+	// without it, nothing is logged
+	logs.Reset()
+	quiet, err := New(WithLogger(log))
+	require.NoError(t, err)
+	res, err := quiet.getClient().Get(u)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.NotContains(t, logs.String(), "fetch ")
+}
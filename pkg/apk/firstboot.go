@@ -0,0 +1,160 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+const (
+	// FirstBootPath is where WithFirstBoot writes the first boot script, in the filesystem.
+	FirstBootPath = "/usr/libexec/apk-firstboot"
+	// what the scripts are embedded between in the first boot script
+	firstBootDelimiter = "APK_FIRSTBOOT_SCRIPT"
+)
+
+const firstBootHeader = `#!/bin/sh
+# Generated by go-apk: runs the scripts of the installed packages that were not run when they were
+# installed, followed by the triggers of the packages. Once all have succeeded, they are no longer
+# pending, and running this again does nothing.
+[ -e /%[1]s ] || exit 0
+mkdir -p /%[2]s
+status=0
+run() {
+	script="$1"
+	shift
+	chmod 755 "$script"
+	if ! "$script" "$@"; then
+		echo "apk-firstboot: ${script##*/} failed" >&2
+		status=1
+	fi
+	rm -f "$script"
+}
+trigger() {
+	script="$1"
+	shift
+	dirs=""
+	for d in "$@"; do
+		[ -d "$d" ] && dirs="$dirs $d"
+	done
+	if [ -n "$dirs" ]; then
+		run "$script" $dirs
+	else
+		rm -f "$script"
+	fi
+}
+`
+
+const firstBootFooter = `[ "$status" -eq 0 ] && rm -f /%[1]s
+exit "$status"
+`
+
+// FirstBootScript returns a shell script that runs the pending scripts of the installed packages,
+// as PendingScripts returns them, and then the triggers of the installed packages with those of
+// their trigger directories that exist, for an image to run at its first start. Pre-install scripts
+// are run after the files of the package are already installed. It returns nil if there is nothing
+// to run.
+func (a *APK) FirstBootScript() ([]byte, error) {
+	pending, err := a.PendingScripts()
+	if err != nil {
+		return nil, err
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	contents, err := a.installedScripts()
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	embed := func(name string, script []byte) (string, error) {
+		if bytes.Contains(script, []byte(firstBootDelimiter)) {
+			return "", fmt.Errorf("%s cannot be embedded, as it contains %s", name, firstBootDelimiter)
+		}
+		p := "/" + path.Join(scriptsExecDir, name)
+		fmt.Fprintf(&body, "cat > %s <<'%s'\n%s", p, firstBootDelimiter, script)
+		if !bytes.HasSuffix(script, []byte("\n")) {
+			body.WriteString("\n")
+		}
+		fmt.Fprintf(&body, "%s\n", firstBootDelimiter)
+		return p, nil
+	}
+	for _, p := range pending {
+		script, err := embed(fmt.Sprintf("%s-%s.%s", p.Package, p.Version, p.Script), p.Contents)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&body, "run %s %s\n", script, strings.Join(p.Args, " "))
+	}
+	for _, pkg := range installed {
+		name := fmt.Sprintf("%s-%s.trigger", pkg.Name, pkg.Version)
+		trigger, ok := contents[name]
+		if !ok {
+			continue
+		}
+		info, err := a.installedInfo(pkg)
+		if err != nil {
+			return nil, err
+		}
+		if len(info.Triggers) == 0 {
+			continue
+		}
+		script, err := embed(name, trigger)
+		if err != nil {
+			return nil, err
+		}
+		// the trigger directories are not quoted, for the shell to expand their globs
+		fmt.Fprintf(&body, "trigger %s %s\n", script, strings.Join(info.Triggers, " "))
+	}
+	if body.Len() == 0 {
+		return nil, nil
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, firstBootHeader, pendingScriptsFilePath, scriptsExecDir)
+	b.Write(body.Bytes())
+	fmt.Fprintf(&b, firstBootFooter, pendingScriptsFilePath)
+	return b.Bytes(), nil
+}
+
+// writeFirstBoot writes the FirstBootScript to FirstBootPath, or removes it if there is nothing to run.
+func (a *APK) writeFirstBoot() error {
+	p := strings.TrimPrefix(FirstBootPath, "/")
+	script, err := a.FirstBootScript()
+	if err != nil {
+		return fmt.Errorf("generating first boot script: %w", err)
+	}
+	if script == nil {
+		if err := a.fs.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing %s: %w", FirstBootPath, err)
+		}
+		return nil
+	}
+	if err := a.fs.MkdirAll(path.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("creating directory for %s: %w", FirstBootPath, err)
+	}
+	// #nosec G306 -- the script is run by the image
+	if err := a.fs.WriteFile(p, script, 0o755); err != nil {
+		return fmt.Errorf("writing %s: %w", FirstBootPath, err)
+	}
+	return nil
+}
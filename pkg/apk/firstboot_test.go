@@ -0,0 +1,70 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestFirstBoot(t *testing.T) {
+	ctx := context.Background()
+	fs := apkfs.NewMemFS()
+	a, err := New(WithFS(fs), WithArch(testArch), WithIgnoreMknodErrors(true), WithFirstBoot(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+
+	// nothing to run
+	require.NoError(t, a.writeFirstBoot())
+	_, err = fs.Stat(strings.TrimPrefix(FirstBootPath, "/"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	f, err := os.Open(filepath.Join("testdata", "alpine-316", "alpine-baselayout-3.2.0-r23.apk"))
+	require.NoError(t, err)
+	defer f.Close()
+	exp, err := ExpandApk(ctx, f, "")
+	require.NoError(t, err)
+	pkg := repository.NewRepositoryPackage(&repository.Package{Name: "alpine-baselayout", Version: "3.2.0-r23", Arch: testArch, Checksum: exp.ControlHash}, nil)
+	require.NoError(t, a.installPackage(ctx, pkg, exp, nil, nil))
+
+	require.NoError(t, a.writeFirstBoot())
+	script, err := fs.ReadFile(strings.TrimPrefix(FirstBootPath, "/"))
+	require.NoError(t, err)
+	fi, err := fs.Stat(strings.TrimPrefix(FirstBootPath, "/"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+
+	s := string(script)
+	require.True(t, strings.HasPrefix(s, "#!/bin/sh\n"))
+	pre := strings.Index(s, "run /lib/apk/exec/alpine-baselayout-3.2.0-r23.pre-install 3.2.0-r23\n")
+	post := strings.Index(s, "run /lib/apk/exec/alpine-baselayout-3.2.0-r23.post-install 3.2.0-r23\n")
+	require.True(t, pre >= 0 && post > pre, "scripts are not run in order:\n%s", s)
+	require.Contains(t, s, "cat > /lib/apk/exec/alpine-baselayout-3.2.0-r23.post-install <<'"+firstBootDelimiter+"'\n")
+	require.Contains(t, s, "rm -f /"+pendingScriptsFilePath+"\n")
+
+	if sh, err := exec.LookPath("sh"); err == nil {
+		out, err := exec.Command(sh, "-n", "-c", s).CombinedOutput()
+		require.NoError(t, err, "invalid script: %s", out)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fuzz targets parse what a repository or a package file can contain. Without -fuzz they only
+// run their seeds; to fuzz one, e.g.:
+//
+//	go test ./pkg/apk/ -run '^$' -fuzz FuzzParseIndexArchive -fuzztime 1m
+
+func FuzzParseIndexArchive(f *testing.F) {
+	// the real indexes are too large for the fuzzer to mutate efficiently, so the seed is a small one
+	f.Add(testIndexArchive(f, "C:Q1Meo+LHGPSi3uY9gIouEVb9z8Fbo=\nP:busybox\nV:1.35.0-r17\nA:aarch64\nS:500000\nI:900000\nD:so:libc.musl-aarch64.so.1\n\n"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_, _ = ParseIndexArchive(bytes.NewReader(b))
+	})
+}
+
+func FuzzParsePackageIndex(f *testing.F) {
+	f.Add([]byte("P:pkg\nV:1.0-r0\nA:aarch64\nD:so:libc.musl-aarch64.so.1\np:cmd:pkg=1.0-r0\n\nP:other\nV:2\n"))
+	f.Add([]byte("\n\n\n"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, workers := range []int{1, 4} {
+			_, _ = parsePackageIndexParallel(b, workers)
+		}
+		for _, n := range []int{1, 2, 7} {
+			if chunks := splitStanzas(b, n); !bytes.Equal(bytes.Join(chunks, nil), b) {
+				t.Fatalf("splitting into %d chunks lost data", n)
+			}
+		}
+	})
+}
+
+func FuzzParsePackageInfo(f *testing.F) {
+	f.Add([]byte("# Generated by abuild\npkgname = foo\npkgver = 1.0-r0\nsize = 1024\nbuilddate = 1690000000\ndepend = bar\n"))
+	f.Add([]byte("pkgname = foo\npkgver = 1\nprovider_priority = x\n"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_, _ = ParsePackageInfo(bytes.NewReader(b))
+	})
+}
+
+func FuzzExpandApk(f *testing.F) {
+	if b, err := os.ReadFile(filepath.Join("testdata", "alpine-316", "alpine-baselayout-3.2.0-r23.apk")); err == nil {
+		f.Add(b)
+	}
+	f.Add([]byte{0x1f, 0x8b})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		exp, err := ExpandApk(context.Background(), bytes.NewReader(b), t.TempDir())
+		if err == nil {
+			exp.Close()
+		}
+	})
+}
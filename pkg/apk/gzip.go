@@ -0,0 +1,54 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// gzipReader is the decompressor used for packages, the optimized pure Go implementation from
+// klauspost/compress, which BenchmarkGzipImplementations compares with compress/gzip.
+type gzipReader = gzip.Reader
+
+var newGzipReader = gzip.NewReader
+
+// gzipReaders holds decompressors for reuse across packages, as each one carries sizeable
+// decoding tables and window buffers that are costly to allocate for every stream.
+var gzipReaders sync.Pool
+
+// getGzipReader returns a decompressor reading from r, reusing one from a previous stream if possible.
+// Return it with putGzipReader when done.
+func getGzipReader(r io.Reader) (*gzipReader, error) {
+	if zr, ok := gzipReaders.Get().(*gzipReader); ok {
+		if err := zr.Reset(r); err != nil {
+			return nil, err
+		}
+		zr.Multistream(true)
+		return zr, nil
+	}
+	return newGzipReader(r)
+}
+
+// putGzipReader closes the decompressor and keeps it for reuse. It must not be used afterwards.
+func putGzipReader(zr *gzipReader) {
+	if zr == nil {
+		return
+	}
+	_ = zr.Close()
+	gzipReaders.Put(zr)
+}
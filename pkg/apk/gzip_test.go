@@ -0,0 +1,145 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	stdgzip "compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+)
+
+func testGzipData(t testing.TB, contents ...string) []byte {
+	var buf bytes.Buffer
+	for _, c := range contents {
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write([]byte(c))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+	}
+	return buf.Bytes()
+}
+
+func TestGzipReaderReuse(t *testing.T) {
+	zr, err := getGzipReader(bytes.NewReader(testGzipData(t, "first")))
+	require.NoError(t, err)
+	zr.Multistream(false)
+	b, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(b))
+	putGzipReader(zr)
+
+	// a reused reader must not keep the settings of its previous stream
+	zr, err = getGzipReader(bytes.NewReader(testGzipData(t, "second", "third")))
+	require.NoError(t, err)
+	b, err = io.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, "secondthird", string(b))
+	putGzipReader(zr)
+
+	_, err = getGzipReader(bytes.NewReader([]byte("not gzip")))
+	require.Error(t, err)
+}
+
+func BenchmarkExpandApk(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, "alpine-baselayout-3.2.0-r23.apk"))
+	require.NoError(b, err)
+	dir := b.TempDir()
+	ctx := context.Background()
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		exp, err := ExpandApk(ctx, bytes.NewReader(data), dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := exp.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGzipReader(b *testing.B) {
+	content := bytes.Repeat([]byte("some compressible package contents\n"), 1<<12)
+	data := testGzipData(b, string(content))
+
+	b.Run("new", func(b *testing.B) {
+		b.SetBytes(int64(len(content)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			zr, err := newGzipReader(bytes.NewReader(data))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, zr); err != nil {
+				b.Fatal(err)
+			}
+			zr.Close()
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.SetBytes(int64(len(content)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			zr, err := getGzipReader(bytes.NewReader(data))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, zr); err != nil {
+				b.Fatal(err)
+			}
+			putGzipReader(zr)
+		}
+	})
+}
+
+func BenchmarkGzipImplementations(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, "alpine-baselayout-3.2.0-r23.apk"))
+	require.NoError(b, err)
+	// an apk is several gzip streams, which both read as one
+	zr, err := stdgzip.NewReader(bytes.NewReader(data))
+	require.NoError(b, err)
+	size, err := io.Copy(io.Discard, zr)
+	require.NoError(b, err)
+
+	for _, impl := range []struct {
+		name      string
+		newReader func(io.Reader) (io.Reader, error)
+	}{
+		{"compress/gzip", func(r io.Reader) (io.Reader, error) { return stdgzip.NewReader(r) }},
+		{"klauspost", func(r io.Reader) (io.Reader, error) { return newGzipReader(r) }},
+	} {
+		b.Run(impl.name, func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				zr, err := impl.newReader(bytes.NewReader(data))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, zr); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
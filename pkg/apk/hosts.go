@@ -0,0 +1,69 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseHosts parses entries of the form host=address, such as those of a command line flag, into a
+// map for WithHosts.
+func ParseHosts(entries []string) (map[string]string, error) {
+	hosts := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		host, addr, ok := strings.Cut(entry, "=")
+		if !ok || host == "" || addr == "" {
+			return nil, fmt.Errorf("invalid host %q, expected <host>=<address>", entry)
+		}
+		hosts[strings.ToLower(host)] = addr
+	}
+	return hosts, nil
+}
+
+// resolvingDialer returns a dial function that connects to the address of the hosts map for the
+// hosts in it, or else to the addresses the resolver looks up, if there is one, before dialing
+// with dial. Only where the connection goes is changed: TLS is still verified against the name of
+// the host in the URL.
+func resolvingDialer(dial DialContextFunc, hosts map[string]string, resolver *net.Resolver) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+		if override, ok := hosts[strings.ToLower(host)]; ok {
+			return dial(ctx, network, net.JoinHostPort(override, port))
+		}
+		if resolver == nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, a := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(a, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, fmt.Errorf("dialing %s: %w", host, errors.Join(errs...))
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "mirror of "+r.Host)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	hosts, err := ParseHosts([]string{"Repo.Example=" + u.Hostname()})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"repo.example": u.Hostname()}, hosts)
+	_, err = ParseHosts([]string{"repo.example"})
+	require.Error(t, err)
+
+	a, err := New(WithHosts(hosts))
+	require.NoError(t, err)
+	res, err := a.getClient().Get("http://repo.example:" + u.Port() + "/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	// the request still names the host it was for
+	require.Equal(t, "mirror of repo.example:"+u.Port(), string(b))
+}
+
+func TestResolvingDialer(t *testing.T) {
+	var dialed []string
+	dial := func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, nil
+	}
+	resolve := resolvingDialer(dial, map[string]string{"cdn.example": "10.0.0.5"}, nil)
+	for _, addr := range []string{"cdn.example:443", "CDN.example:80", "other.example:443", "192.0.2.1:443"} {
+		_, err := resolve(context.Background(), "tcp", addr)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"10.0.0.5:443", "10.0.0.5:80", "other.example:443", "192.0.2.1:443"}, dialed)
+}
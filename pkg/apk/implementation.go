@@ -17,19 +17,22 @@ package apk
 import (
 	"archive/tar"
 	"context"
-	"encoding/base64"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"gitlab.alpinelinux.org/alpine/go/repository"
@@ -46,16 +49,78 @@ import (
 	"github.com/hashicorp/go-retryablehttp"
 )
 
+// APK manipulates the apk database and packages of a root filesystem.
+//
+// An APK reads and writes the files of its root, such as the repositories, the world, the keyring and
+// the installed database, without any locking, so a single APK must not be used from several goroutines
+// at the same time. To work concurrently, e.g. resolving for several images at once, give each goroutine
+// its own APK from Clone, with WithFS for a root of its own: a clone without it works on the same root,
+// and so the same files. Clones share the http client and the package cache, which are safe for
+// concurrent use, and have their own copies of the rest of the configuration.
 type APK struct {
 	arch              string
 	version           string
 	logger            logger.Logger
 	fs                apkfs.FullFS
 	executor          Executor
+	scriptLinter      ScriptLinter
+	packageVerifiers  map[string]PackageVerifier
 	ignoreMknodErrors bool
+	installRoot       string
 	client            *http.Client
 	cache             *cache
 	ignoreSignatures  bool
+	licensePolicy     LicensePolicy
+	maxInstalledSize  uint64
+	keyringDirs       []string
+	keyringURLs       []string
+	dialContext       DialContextFunc
+	allowDowngrade    bool
+	failOnDowngrade   bool
+	providerSelector  ProviderSelector
+	newResolver       NewResolverFunc
+	layout            RepositoryLayout
+	fsync             bool
+	subpackageRules   []SubpackageRule
+	strictIndexes     bool
+	keyEventHandler   func(KeyEvent)
+	rejectKeyChanges  bool
+	deltas            bool
+	cacheClone        apkfs.CloneMode
+	// dedup is the store of the files installed with WithDedup, if any; clones start their own
+	dedup             *dedupStore
+	repoPriorities    map[string]int
+	repoArches        map[string]string
+	shardedIndexes    bool
+	scriptPolicy      ScriptPolicy
+	firstBoot         bool
+	cleanupPolicies   []CleanupPolicy
+	repoCommit        string
+	hosts             map[string]string
+	resolver          *net.Resolver
+	tls               *tls.Config
+	rootCAs           *x509.CertPool
+	pinnedCerts       []string
+	repoProxies       []repositoryProxy
+	traceFetches      bool
+	installReports    func(*InstallReport)
+	bestEffort        bool
+	timestampOverride time.Time
+	mirrors           []MirrorSelection
+	maxIndexAge       time.Duration
+	failStaleIndexes  bool
+	memoryRepos       map[string]*MemoryRepository
+
+	// keyring is what was seen of the keys by the last GetRepositoryIndexes, guarded by keyringMu.
+	keyring   *keyringState
+	keyringMu sync.Mutex
+	// txn is the installed database transaction of the FixateWorld in progress, if any.
+	txn *installedTxn
+	// baseFS is the filesystem as given with WithFS, that of the install root is in, for clones.
+	baseFS apkfs.FullFS
+	// baseFiles are the checksums, permissions and ownership of the regular files of the base loaded
+	// with LoadInstalled, by path. Like the rest of the state of the root, they are not carried over by Clone.
+	baseFiles map[string]baseFile
 }
 
 func New(options ...Option) (*APK, error) {
@@ -65,15 +130,146 @@ func New(options ...Option) (*APK, error) {
 			return nil, err
 		}
 	}
+	if err := opt.validate(); err != nil {
+		return nil, err
+	}
+	return newAPK(opt), nil
+}
+
+// Clone returns a new APK with the same configuration as this one, including its http client and
+// cache, with the options applied on top. Typically this is WithFS, to work on another root.
+func (a *APK) Clone(options ...Option) (*APK, error) {
+	opt := &opts{
+		logger:            a.logger,
+		executor:          a.executor,
+		scriptLinter:      a.scriptLinter,
+		packageVerifiers:  cloneMap(a.packageVerifiers),
+		arch:              a.arch,
+		ignoreMknodErrors: a.ignoreMknodErrors,
+		fs:                a.baseFS,
+		installRoot:       a.installRoot,
+		version:           a.version,
+		cache:             a.cache,
+		licensePolicy:     a.licensePolicy,
+		maxInstalledSize:  a.maxInstalledSize,
+		keyringDirs:       append([]string(nil), a.keyringDirs...),
+		keyringURLs:       append([]string(nil), a.keyringURLs...),
+		dialContext:       a.dialContext,
+		allowDowngrade:    a.allowDowngrade,
+		failOnDowngrade:   a.failOnDowngrade,
+		providerSelector:  a.providerSelector,
+		newResolver:       a.newResolver,
+		layout:            a.layout,
+		fsync:             a.fsync,
+		subpackageRules:   append([]SubpackageRule(nil), a.subpackageRules...),
+		strictIndexes:     a.strictIndexes,
+		keyEventHandler:   a.keyEventHandler,
+		rejectKeyChanges:  a.rejectKeyChanges,
+		deltas:            a.deltas,
+		cacheClone:        a.cacheClone,
+		dedup:             a.dedup != nil,
+		repoPriorities:    cloneMap(a.repoPriorities),
+		repoArches:        cloneMap(a.repoArches),
+		shardedIndexes:    a.shardedIndexes,
+		scriptPolicy:      a.scriptPolicy,
+		firstBoot:         a.firstBoot,
+		cleanupPolicies:   append([]CleanupPolicy(nil), a.cleanupPolicies...),
+		allowUntrusted:    a.ignoreSignatures,
+		repoCommit:        a.repoCommit,
+		hosts:             cloneMap(a.hosts),
+		resolver:          a.resolver,
+		tls:               a.tls,
+		rootCAs:           a.rootCAs,
+		pinnedCerts:       append([]string(nil), a.pinnedCerts...),
+		repoProxies:       append([]repositoryProxy(nil), a.repoProxies...),
+		traceFetches:      a.traceFetches,
+		installReports:    a.installReports,
+		bestEffort:        a.bestEffort,
+		timestampOverride: a.timestampOverride,
+		mirrors:           append([]MirrorSelection(nil), a.mirrors...),
+		maxIndexAge:       a.maxIndexAge,
+		failStaleIndexes:  a.failStaleIndexes,
+		memoryRepos:       cloneMap(a.memoryRepos),
+	}
+	for _, o := range options {
+		if err := o(opt); err != nil {
+			return nil, err
+		}
+	}
+	if err := opt.validate(); err != nil {
+		return nil, err
+	}
+	clone := newAPK(opt)
+	clone.client = a.client
+	return clone, nil
+}
+
+// cloneMap returns a copy of m, so that options applied to a clone do not change the original.
+func cloneMap[K comparable, V any](m map[K]V) map[K]V {
+	if m == nil {
+		return nil
+	}
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func newAPK(opt *opts) *APK {
 	return &APK{
-		fs:                opt.fs,
+		fs:                clampTimes(apkfs.Sub(opt.fs, opt.installRoot), opt.timestampOverride),
+		baseFS:            opt.fs,
+		installRoot:       opt.installRoot,
 		logger:            opt.logger,
 		arch:              opt.arch,
 		executor:          opt.executor,
+		scriptLinter:      opt.scriptLinter,
+		packageVerifiers:  opt.packageVerifiers,
 		ignoreMknodErrors: opt.ignoreMknodErrors,
 		version:           opt.version,
 		cache:             opt.cache,
-	}, nil
+		licensePolicy:     opt.licensePolicy,
+		maxInstalledSize:  opt.maxInstalledSize,
+		keyringDirs:       opt.keyringDirs,
+		keyringURLs:       opt.keyringURLs,
+		dialContext:       opt.dialContext,
+		allowDowngrade:    opt.allowDowngrade,
+		failOnDowngrade:   opt.failOnDowngrade,
+		providerSelector:  opt.providerSelector,
+		newResolver:       opt.newResolver,
+		layout:            opt.layout,
+		fsync:             opt.fsync,
+		subpackageRules:   opt.subpackageRules,
+		strictIndexes:     opt.strictIndexes,
+		keyEventHandler:   opt.keyEventHandler,
+		rejectKeyChanges:  opt.rejectKeyChanges,
+		deltas:            opt.deltas,
+		cacheClone:        opt.cacheClone,
+		dedup:             newDedupStore(opt.dedup),
+		repoPriorities:    opt.repoPriorities,
+		repoArches:        opt.repoArches,
+		shardedIndexes:    opt.shardedIndexes,
+		scriptPolicy:      opt.scriptPolicy,
+		firstBoot:         opt.firstBoot,
+		cleanupPolicies:   opt.cleanupPolicies,
+		ignoreSignatures:  opt.allowUntrusted,
+		repoCommit:        opt.repoCommit,
+		hosts:             opt.hosts,
+		resolver:          opt.resolver,
+		tls:               opt.tls,
+		rootCAs:           opt.rootCAs,
+		pinnedCerts:       opt.pinnedCerts,
+		repoProxies:       opt.repoProxies,
+		traceFetches:      opt.traceFetches,
+		installReports:    opt.installReports,
+		bestEffort:        opt.bestEffort,
+		timestampOverride: opt.timestampOverride,
+		mirrors:           opt.mirrors,
+		maxIndexAge:       opt.maxIndexAge,
+		failStaleIndexes:  opt.failStaleIndexes,
+		memoryRepos:       opt.memoryRepos,
+	}
 }
 
 type directory struct {
@@ -149,6 +345,33 @@ func (a *APK) SetClient(client *http.Client) {
 	a.client = client
 }
 
+// getClient returns the client set with SetClient or, if there is none, a retrying client
+// that dials with the function set by WithDialContext, if any, to the hosts as WithHosts and
+// WithResolver resolve them, verifying them as the TLS options set, and through the proxies of the
+// environment or of WithRepositoryProxies. Either is traced, with WithFetchTracing, and fetches from
+// the mirrors of WithMirrorSelection.
+func (a *APK) getClient() *http.Client {
+	if a.client != nil {
+		return a.mirrorClient(a.traceClient(a.client))
+	}
+	client := retryablehttp.NewClient()
+	if transport, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+		if a.dialContext != nil {
+			transport.DialContext = a.dialContext
+		}
+		if (len(a.hosts) > 0 || a.resolver != nil) && transport.DialContext != nil {
+			transport.DialContext = resolvingDialer(transport.DialContext, a.hosts, a.resolver)
+		}
+		if cfg := a.tlsConfig(); cfg != nil {
+			transport.TLSClientConfig = cfg
+		}
+		if len(a.repoProxies) > 0 {
+			transport.Proxy = proxyFunc(a.repoProxies, transport.Proxy)
+		}
+	}
+	return a.mirrorClient(a.traceClient(client.StandardClient()))
+}
+
 // ListInitFiles list the files that are installed during the InitDB phase.
 func (a *APK) ListInitFiles() []tar.Header {
 	headers := make([]tar.Header, 0, 20)
@@ -209,6 +432,12 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 	*/
 	a.logger.Infof("initializing apk database")
 
+	if a.installRoot != "" {
+		if err := a.baseFS.MkdirAll(a.installRoot, 0o755); err != nil {
+			return fmt.Errorf("failed to create install root %s: %w", a.installRoot, err)
+		}
+	}
+
 	// additionalFiles are files we need but can only be resolved in the context of
 	// this func, e.g. we need the architecture
 	additionalFiles := []file{
@@ -370,12 +599,9 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 					return fmt.Errorf("failed to read apk key: %w", err)
 				}
 			case "https": //nolint:goconst
-				client := a.client
-				if client == nil {
-					client = retryablehttp.NewClient().StandardClient()
-				}
+				client := a.getClient()
 				if a.cache != nil {
-					client = a.cache.client(client, true)
+					client = a.cacheClient(client, true)
 				}
 				req, err := http.NewRequestWithContext(ctx, http.MethodGet, asURL.String(), nil)
 				if err != nil {
@@ -420,6 +646,8 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 }
 
 // ResolveWorld determine the target state for the requested dependencies in /etc/apk/world. Do not install anything.
+// With WithBestEffort, the packages of the rest of the world are returned along with a PartialInstallError
+// for the entries that cannot be resolved.
 func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
 	a.logger.Infof("determining desired apk world")
 
@@ -428,28 +656,119 @@ func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*repository.Reposit
 
 	// to fix the world, we need to:
 	// 1. Get the apkIndexes for each repository for the target arch
-	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	var names []string
+	if a.shardedIndexes {
+		if names, err = a.GetWorld(); err != nil {
+			return toInstall, conflicts, fmt.Errorf("error getting world packages: %w", err)
+		}
+	}
+	indexes, err := a.getRepositoryIndexes(ctx, a.ignoreSignatures, names)
 	if err != nil {
 		return toInstall, conflicts, fmt.Errorf("error getting repository indexes: %w", err)
 	}
+	return a.resolveWorld(ctx, indexes)
+}
+
+// resolveWorld resolves the world against the indexes.
+func (a *APK) resolveWorld(ctx context.Context, indexes []NamedIndex) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
+	if a.repoCommit != "" {
+		indexes = IndexesFromCommit(indexes, a.repoCommit)
+	}
+	// virtual packages only exist in the installed file, so make them available to the resolver too
+	virtual, err := a.virtualPackagesIndex()
+	if err != nil {
+		return toInstall, conflicts, fmt.Errorf("error getting virtual packages: %w", err)
+	}
+	if virtual != nil {
+		indexes = append(indexes, virtual)
+	}
 	// debugging info, if requested
 	a.logger.Debugf("got %d indexes:\n%s", len(indexes), strings.Join(indexNames(indexes), "\n"))
 
 	// 2. Get the dependency tree for each package from the world file
-	directPkgs, err := a.GetWorld()
+	world, err := a.GetWorld()
 	if err != nil {
 		return toInstall, conflicts, fmt.Errorf("error getting world packages: %w", err)
 	}
 	resolver := NewPkgResolver(ctx, indexes)
-	toInstall, conflicts, err = resolver.GetPackagesWithDependencies(ctx, directPkgs)
+	resolver.SetProviderSelector(a.providerSelector)
+	worldResolver, err := a.resolverOf(ctx, indexes, resolver)
+	if err != nil {
+		return toInstall, conflicts, err
+	}
+	// the subpackages added follow the version of their package, but are not held themselves
+	addSubpackages := func(world []string) []string { return a.addSubpackages(resolver, world) }
+	extended := addSubpackages(world)
+	directPkgs := extended
+	toInstall, conflicts, err = worldResolver.GetPackagesWithDependencies(ctx, directPkgs)
+	var failures []PackageFailure
+	if err != nil && a.bestEffort {
+		// leave out the entries that cannot be resolved on their own, and try the rest together
+		var resolvable []string
+		for _, entry := range directPkgs {
+			if _, _, entryErr := worldResolver.GetPackagesWithDependencies(ctx, []string{entry}); entryErr != nil {
+				a.logger.Warnf("leaving out %s, which cannot be resolved: %v", entry, entryErr)
+				failures = append(failures, PackageFailure{Name: entry, Err: entryErr})
+				continue
+			}
+			resolvable = append(resolvable, entry)
+		}
+		if len(failures) > 0 {
+			directPkgs = resolvable
+			toInstall, conflicts, err = worldResolver.GetPackagesWithDependencies(ctx, directPkgs)
+		}
+	}
 	if err != nil {
-		return
+		return toInstall, conflicts, explainHeldPackages(ctx, worldResolver, world, addSubpackages, err)
+	}
+	if err := checkHeldPackages(world, toInstall); err != nil {
+		return nil, nil, err
+	}
+	if err := a.checkSubpackageVersions(world, extended, toInstall); err != nil {
+		return nil, nil, err
+	}
+	toInstall = a.excludeSubpackages(directPkgs, toInstall)
+	if err := a.checkLicenses(toInstall); err != nil {
+		return nil, nil, err
+	}
+	if err := a.checkInstalledSize(toInstall); err != nil {
+		return nil, nil, err
+	}
+	toInstall, cycles := resolver.InstallOrder(toInstall)
+	for _, cycle := range cycles {
+		a.logger.Infof("%s", cycle)
 	}
 	a.logger.Debugf("got %d packages to install:\n%s", len(toInstall), strings.Join(packageRefs(toInstall), "\n"))
+	for _, pkg := range toInstall {
+		if repos := resolver.Repositories(pkg.Name); len(repos) > 1 {
+			a.logger.Infof("%s %s is from %s, of %s", pkg.Name, pkg.Version, packageRepository(pkg), strings.Join(repos, ", "))
+		}
+	}
+	if len(failures) > 0 {
+		return toInstall, conflicts, &PartialInstallError{Failures: failures}
+	}
 	return
 }
 
+// resolverOf returns the Resolver of the packages of the indexes: the one set with WithResolverFunc,
+// or else the PkgResolver of them, which is created if it is nil.
+func (a *APK) resolverOf(ctx context.Context, indexes []NamedIndex, resolver *PkgResolver) (Resolver, error) {
+	if a.newResolver == nil {
+		if resolver == nil {
+			resolver = NewPkgResolver(ctx, indexes)
+			resolver.SetProviderSelector(a.providerSelector)
+		}
+		return resolver, nil
+	}
+	r, err := a.newResolver(ctx, indexes)
+	if err != nil {
+		return nil, fmt.Errorf("error creating resolver: %w", err)
+	}
+	return r, nil
+}
+
 // FixateWorld force apk's resolver to re-resolve the requested dependencies in /etc/apk/world.
+// Packages that are already installed are left at their version, even if a newer one is available.
 func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error {
 	/*
 		equivalent of: "apk fix --arch arch --root root"
@@ -462,12 +781,47 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "FixateWorld")
 	defer span.End()
 
+	return a.fixateWorld(ctx, sourceDateEpoch, false, false, nil)
+}
+
+// UpgradeWorld is FixateWorld, but also replaces installed packages with any newer version that the
+// world resolves to. This is the equivalent of "apk upgrade".
+func (a *APK) UpgradeWorld(ctx context.Context, sourceDateEpoch *time.Time) error {
+	a.logger.Infof("upgrading apk world")
+
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "UpgradeWorld")
+	defer span.End()
+
+	return a.fixateWorld(ctx, sourceDateEpoch, true, false, nil)
+}
+
+// fixateWorld installs the world from the indexes, or, if they are nil, from the indexes of the repositories.
+// With verify, every package fetched is checked against the checksum of its index entry.
+func (a *APK) fixateWorld(ctx context.Context, sourceDateEpoch *time.Time, upgrade, verify bool, indexes []NamedIndex) (err error) {
+	// the timings of the packages are by their index in allpkgs, filled in as they are installed
+	var timings []PackageTiming
+	if a.installReports != nil {
+		start := time.Now()
+		defer func() {
+			a.installReports(newInstallReport(timings, start))
+		}()
+	}
+
 	// to fix the world, we need to:
 	// 1. Get the apkIndexes for each repository for the target arch
-	allpkgs, conflicts, err := a.ResolveWorld(ctx)
-	if err != nil {
+	var allpkgs []*repository.RepositoryPackage
+	var conflicts []string
+	if indexes == nil {
+		allpkgs, conflicts, err = a.ResolveWorld(ctx)
+	} else {
+		allpkgs, conflicts, err = a.resolveWorld(ctx, indexes)
+	}
+	// with WithBestEffort, the world entries that cannot be resolved are left out, and reported at the end
+	var partial *PartialInstallError
+	if err != nil && !errors.As(err, &partial) {
 		return fmt.Errorf("error getting package dependencies: %w", err)
 	}
+	err = nil
 
 	// 3. For each name on the list:
 	//     a. Check if it is installed, if so, skip
@@ -476,14 +830,16 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	//     d. Update /lib/apk/db/scripts.tar
 	//     d. Update /lib/apk/db/triggers
 	//     e. Update the installed file
-	for _, pkg := range conflicts {
-		isInstalled, err := a.isInstalledPackage(pkg)
-		if err != nil {
-			return fmt.Errorf("error checking if package %s is installed: %w", pkg, err)
-		}
-		if isInstalled {
-			return fmt.Errorf("cannot install due to conflict with %s", pkg)
-		}
+	isInstalled, replace, err := a.checkInstalledVersions(allpkgs, upgrade)
+	if err != nil {
+		return err
+	}
+	conflicting, err := a.checkInstalledConflicts(conflicts, replace, upgrade)
+	if err != nil {
+		return err
+	}
+	if err := a.checkDiskSpace(allpkgs, isInstalled, replace); err != nil {
+		return err
 	}
 
 	// TODO: Consider making this configurable option.
@@ -493,6 +849,7 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	g.SetLimit(jobs + 1)
 
 	expanded := make([]*APKExpanded, len(allpkgs))
+	timings = make([]PackageTiming, len(allpkgs))
 
 	// A slice of pseudo-promises that get closed when expanded[i] is ready.
 	done := make([]chan struct{}, len(allpkgs))
@@ -500,12 +857,92 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 		done[i] = make(chan struct{})
 	}
 
+	// the first boot script is written once the installed database has been, and the cleanup done last
+	defer func() {
+		if err == nil && a.firstBoot {
+			err = a.writeFirstBoot()
+		}
+		if err == nil {
+			err = a.cleanup()
+		}
+		if err == nil && partial != nil {
+			err = partial
+		}
+	}()
+
+	// buffer the installed database for the whole run, and write it once at the end;
+	// whatever was installed is recorded even if a later package fails
+	if err := a.beginInstalledTxn(); err != nil {
+		return err
+	}
+	// the installed packages that conflict with what is being installed, when upgrading, are removed
+	// once it all is, so that they are left in place if anything fails; until then, their files may
+	// be installed over
+	for _, pkg := range conflicting {
+		a.txn.removing[pkg.Name] = true
+	}
+	// the packages being upgraded or downgraded are replaced as the files of the new version are
+	// installed, so that they are left in place if it cannot be
+	for _, pkg := range allpkgs {
+		if old, ok := replace[pkg.Name]; ok {
+			verb := "downgrading"
+			if !isDowngrade(old.Version, pkg.Version) {
+				verb = "upgrading"
+			}
+			a.logger.Infof("%s %s from %s to %s", verb, pkg.Name, old.Version, pkg.Version)
+			a.txn.replacing[pkg.Name] = old
+		}
+	}
+	defer func() {
+		if err != nil {
+			return
+		}
+		for _, pkg := range conflicting {
+			a.logger.Infof("removing %s %s, as it conflicts with what was installed", pkg.Name, pkg.Version)
+			if err = a.removeInstalledPackage(pkg); err != nil {
+				err = fmt.Errorf("removing %s: %w", pkg.Name, err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		if commitErr := a.commitInstalledTxn(); commitErr != nil {
+			err = errors.Join(err, commitErr)
+		}
+	}()
+
 	// Kick off a goroutine that sequentially installs packages as they become ready.
 	//
 	// We could probably do better than this by mirroring the dependency graph or even
 	// just computing non-overlapping packages based on the installed files, but we'll
 	// keep this simple for now by assuming we must install in the given order exactly.
+	// With WithBestEffort, the packages that cannot be fetched are recorded instead of failing the install,
+	// and they are left out once everything is fetched, with the packages that depend on them.
+	fetchErrs := make([]error, len(allpkgs))
 	g.Go(func() error {
+		var skip []bool
+		if a.bestEffort {
+			for _, ch := range done {
+				select {
+				case <-gctx.Done():
+					return gctx.Err()
+				case <-ch:
+				}
+			}
+			var failures []PackageFailure
+			skip, failures = skipUnfetched(gctx, allpkgs, fetchErrs)
+			for i := range allpkgs {
+				if skip[i] && expanded[i] != nil {
+					expanded[i].Close()
+				}
+			}
+			if len(failures) > 0 {
+				if partial == nil {
+					partial = &PartialInstallError{}
+				}
+				partial.Failures = append(partial.Failures, failures...)
+			}
+		}
 		for i, ch := range done {
 			select {
 			case <-gctx.Done():
@@ -514,18 +951,20 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 				exp := expanded[i]
 				pkg := allpkgs[i]
 
-				isInstalled, err := a.isInstalledPackage(pkg.Name)
-				if err != nil {
-					return fmt.Errorf("error checking if package %s is installed: %w", pkg.Name, err)
-				}
-
-				if isInstalled {
+				if isInstalled[pkg.Name] || (skip != nil && skip[i]) {
 					continue
 				}
 
-				if err := a.installPackage(gctx, pkg, exp, sourceDateEpoch); err != nil {
+				var from *repository.Package
+				if old, ok := replace[pkg.Name]; ok {
+					from = &old.Package
+				}
+				start := time.Now()
+				if err := a.installPackage(gctx, pkg, exp, sourceDateEpoch, from); err != nil {
 					return fmt.Errorf("installing %s: %w", pkg.Name, err)
 				}
+				timings[i].Extract = time.Since(start)
+				timings[i].Name, timings[i].Version = pkg.Name, pkg.Version
 			}
 		}
 
@@ -537,8 +976,25 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	for i, pkg := range allpkgs {
 		i, pkg := i, pkg
 
+		// already installed packages, including virtual ones, have nothing to fetch
+		if isInstalled[pkg.Name] {
+			close(done[i])
+			continue
+		}
+
+		var from *repository.Package
+		if old, ok := replace[pkg.Name]; ok {
+			from = &old.Package
+		}
 		g.Go(func() error {
-			exp, err := a.expandPackage(gctx, pkg)
+			timings[i].Repository = pkg.Repository().Uri
+			exp, err := a.expandPackageFrom(gctx, pkg, from, verify, &timings[i])
+			if err != nil && a.bestEffort && gctx.Err() == nil {
+				a.logger.Warnf("leaving out %s, which cannot be fetched: %v", pkg.Name, err)
+				fetchErrs[i] = err
+				close(done[i])
+				return nil
+			}
 			if err != nil {
 				return fmt.Errorf("expanding %s: %w", pkg.Name, err)
 			}
@@ -572,10 +1028,7 @@ func (a *APK) fetchAlpineKeys(ctx context.Context, alpineVersions []string) erro
 	defer span.End()
 
 	u := alpineReleasesURL
-	client := a.client
-	if client == nil {
-		client = retryablehttp.NewClient().StandardClient()
-	}
+	client := a.getClient()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return err
@@ -684,12 +1137,7 @@ func (a *APK) cachedPackage(ctx context.Context, pkg *repository.RepositoryPacka
 	_, span := otel.Tracer("go-apk").Start(ctx, "cachedPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
 	defer span.End()
 
-	chk := pkg.ChecksumString()
-	if !strings.HasPrefix(chk, "Q1") {
-		return nil, fmt.Errorf("unexpected checksum: %q", chk)
-	}
-
-	checksum, err := base64.StdEncoding.DecodeString(chk[2:])
+	checksum, err := ParseQ1Checksum(pkg.ChecksumString())
 	if err != nil {
 		return nil, err
 	}
@@ -749,9 +1197,22 @@ func (a *APK) cachedPackage(ctx context.Context, pkg *repository.RepositoryPacka
 }
 
 func (a *APK) expandPackage(ctx context.Context, pkg *repository.RepositoryPackage) (*APKExpanded, error) {
+	return a.expandPackageFrom(ctx, pkg, nil, false, nil)
+}
+
+// expandPackageFrom expands the package, which replaces the installed version from, if it is not nil.
+// With WithDeltas, a cache miss is then first tried from the delta to the package from the cached
+// older version. With verify, a package that is fetched is checked against the checksum of its index
+// entry. How long fetching and verifying it took is recorded in timing, if it is not nil.
+func (a *APK) expandPackageFrom(ctx context.Context, pkg *repository.RepositoryPackage, from *repository.Package, verify bool, timing *PackageTiming) (*APKExpanded, error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "expandPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
 	defer span.End()
 
+	if timing == nil {
+		timing = &PackageTiming{}
+	}
+	start := time.Now()
+
 	cacheDir := ""
 	if a.cache != nil {
 		var err error
@@ -763,6 +1224,9 @@ func (a *APK) expandPackage(ctx context.Context, pkg *repository.RepositoryPacka
 		exp, err := a.cachedPackage(ctx, pkg, cacheDir)
 		if err == nil {
 			a.logger.Debugf("cache hit (%s)", pkg.Name)
+			a.cache.stats.hit(exp.Size)
+			timing.Cached = true
+			timing.Fetch = time.Since(start)
 			return exp, nil
 		}
 
@@ -771,6 +1235,57 @@ func (a *APK) expandPackage(ctx context.Context, pkg *repository.RepositoryPacka
 		if err := os.MkdirAll(cacheDir, 0o755); err != nil {
 			return nil, fmt.Errorf("unable to create cache directory %q: %w", cacheDir, err)
 		}
+
+		if a.cache.fetches != nil {
+			// concurrent misses of the package, as of builds for several architectures sharing the
+			// cache, wait for one of them to fetch it and then read it from the cache
+			// the timing is kept apart until this one is known to be the one that fetched it
+			fetchTiming := *timing
+			v, led, err := doOnce(ctx, a.cache.fetches, cacheDir, func() (interface{}, error) {
+				exp, err := a.fetchPackageToCache(ctx, pkg, from, verify, cacheDir, &fetchTiming, start)
+				if exp == nil {
+					return nil, err
+				}
+				return exp, err
+			}, func(v interface{}) {
+				v.(*APKExpanded).Close()
+			})
+			if led {
+				*timing = fetchTiming
+				exp, _ := v.(*APKExpanded)
+				return exp, err
+			}
+			if err != nil {
+				return nil, err
+			}
+			exp, err = a.cachedPackage(ctx, pkg, cacheDir)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s from the cache once fetched: %w", pkg.Name, err)
+			}
+			a.cache.stats.hit(exp.Size)
+			timing.Cached = true
+			timing.Fetch = time.Since(start)
+			return exp, nil
+		}
+	}
+	return a.fetchPackageToCache(ctx, pkg, from, verify, cacheDir, timing, start)
+}
+
+// fetchPackageToCache fetches and expands the package, on a miss of the cache, if any, into cacheDir,
+// timing it from start, and verifying it against its index entry with verify.
+func (a *APK) fetchPackageToCache(ctx context.Context, pkg *repository.RepositoryPackage, from *repository.Package, verify bool, cacheDir string, timing *PackageTiming, start time.Time) (*APKExpanded, error) {
+	if a.deltas && a.cache != nil && from != nil {
+		exp, err := a.expandDelta(ctx, pkg, from, cacheDir)
+		if err == nil {
+			a.logger.Debugf("rebuilt %s %s from the delta from %s", pkg.Name, pkg.Version, from.Version)
+			defer func() { timing.Fetch = time.Since(start) }()
+			if err := a.verifyPackage(ctx, pkg, exp); err != nil {
+				exp.Close()
+				return nil, err
+			}
+			return a.cachePackage(ctx, pkg, exp, cacheDir)
+		}
+		a.logger.Debugf("no delta for %s from %s, fetching it whole: %v", pkg.Name, from.Version, err)
 	}
 
 	rc, err := a.FetchPackage(ctx, pkg)
@@ -783,12 +1298,28 @@ func (a *APK) expandPackage(ctx context.Context, pkg *repository.RepositoryPacka
 	if err != nil {
 		return nil, fmt.Errorf("expanding %s: %w", pkg.Name, err)
 	}
+	timing.Fetch = time.Since(start)
+	if verify {
+		start := time.Now()
+		if err := verifyExpanded(pkg.Package, exp); err != nil {
+			exp.Close()
+			return nil, fmt.Errorf("verifying %s: %w", pkg.Name, err)
+		}
+		timing.Verify = time.Since(start)
+	}
+	if err := a.verifyPackage(ctx, pkg, exp); err != nil {
+		exp.Close()
+		return nil, err
+	}
 
 	// If we don't have a cache, we're done.
 	if a.cache == nil {
 		return exp, nil
 	}
 
+	// writing it to the cache is part of fetching it
+	cacheStart := time.Now()
+	defer func() { timing.Fetch += time.Since(cacheStart) }()
 	return a.cachePackage(ctx, pkg, exp, cacheDir)
 }
 
@@ -817,6 +1348,14 @@ func (a *APK) FetchPackage(ctx context.Context, pkg *repository.RepositoryPackag
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "fetchPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
 	defer span.End()
 
+	if m, ok := a.memoryRepository(pkg); ok {
+		rc, err := m.lookup(ctx, pkg)
+		if err != nil {
+			return nil, fmt.Errorf("looking up package apk %s in %s: %w", pkg.Filename(), m.URI(), err)
+		}
+		return rc, nil
+	}
+
 	u := pkg.Url()
 
 	// Normalize the repo as a URI, so that local paths
@@ -835,12 +1374,9 @@ func (a *APK) FetchPackage(ctx context.Context, pkg *repository.RepositoryPackag
 		}
 		return f, nil
 	case "https":
-		client := a.client
-		if client == nil {
-			client = retryablehttp.NewClient().StandardClient()
-		}
+		client := a.getClient()
 		if a.cache != nil {
-			client = a.cache.client(client, false)
+			client = a.cacheClient(client, false)
 		}
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 		if err != nil {
@@ -867,8 +1403,113 @@ type writeHeaderer interface {
 	WriteHeader(hdr tar.Header, tfs fs.FS, pkg *repository.Package) error
 }
 
-// installPackage installs a single package and updates installed db.
-func (a *APK) installPackage(ctx context.Context, pkg *repository.RepositoryPackage, expanded *APKExpanded, sourceDateEpoch *time.Time) error {
+// checkInstalledVersions compares the resolved packages to those that are installed. It returns the
+// names of the packages that can be left as they are, and the installed packages that are to be replaced
+// by an older resolved version, or also by a newer one when upgrading. Unless downgrades are allowed,
+// the installed version is kept, or it is an error with WithFailOnDowngrade.
+func (a *APK) checkInstalledVersions(pkgs []*repository.RepositoryPackage, upgrade bool) (map[string]bool, map[string]*InstalledPackage, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	installedByName := make(map[string]*InstalledPackage, len(installed))
+	for _, pkg := range installed {
+		installedByName[pkg.Name] = pkg
+	}
+
+	var (
+		keep    = make(map[string]bool, len(installed))
+		replace = map[string]*InstalledPackage{}
+	)
+	for _, pkg := range pkgs {
+		current, ok := installedByName[pkg.Name]
+		if !ok {
+			continue
+		}
+		if current.Version == pkg.Version {
+			keep[pkg.Name] = true
+			continue
+		}
+		if !isDowngrade(current.Version, pkg.Version) {
+			if upgrade {
+				replace[pkg.Name] = current
+			} else {
+				keep[pkg.Name] = true
+			}
+			continue
+		}
+		if !a.allowDowngrade {
+			if a.failOnDowngrade {
+				return nil, nil, fmt.Errorf("package %s is installed at version %s, which is newer than the requested %s; use WithAllowDowngrade to downgrade it", pkg.Name, current.Version, pkg.Version)
+			}
+			a.logger.Warnf("keeping %s %s, which is newer than the requested %s; use WithAllowDowngrade to downgrade it", pkg.Name, current.Version, pkg.Version)
+			keep[pkg.Name] = true
+			continue
+		}
+		replace[pkg.Name] = current
+	}
+	// anything else that is installed, including virtual packages, stays as it is
+	for name := range installedByName {
+		if _, ok := replace[name]; !ok {
+			keep[name] = true
+		}
+	}
+	return keep, replace, nil
+}
+
+// checkInstalledConflicts checks the installed packages against the conflicts of the resolved packages,
+// dependencies without their leading ! such as foo or foo<2, leaving out those that are to be replaced.
+// An installed package that is in conflict is an error, unless upgrading, when it is returned to be
+// removed, as apk upgrade does.
+func (a *APK) checkInstalledConflicts(conflicts []string, replace map[string]*InstalledPackage, upgrade bool) ([]*InstalledPackage, error) {
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	var remove []*InstalledPackage
+	for _, pkg := range installed {
+		if _, ok := replace[pkg.Name]; ok {
+			continue
+		}
+		for _, conflict := range conflicts {
+			if !conflictMatches(conflict, &pkg.Package) {
+				continue
+			}
+			if !upgrade {
+				return nil, fmt.Errorf("cannot install due to conflict with %s, installed at %s (!%s)", pkg.Name, pkg.Version, conflict)
+			}
+			remove = append(remove, pkg)
+			break
+		}
+	}
+	return remove, nil
+}
+
+// isDowngrade reports whether moving from the installed version to the wanted one is a downgrade.
+// Versions that cannot be parsed are never considered a downgrade.
+func isDowngrade(installed, wanted string) bool {
+	installedVersion, err := parseVersion(installed)
+	if err != nil {
+		return false
+	}
+	wantedVersion, err := parseVersion(wanted)
+	if err != nil {
+		return false
+	}
+	return compareVersions(wantedVersion, installedVersion) == less
+}
+
+// installPackage installs a single package and updates installed db. If from is not nil, the package
+// replaces that installed version, which the transaction in progress removes once the files of the
+// package are installed. With an executor, the scripts
+// of the package are run: a failing pre-install or pre-upgrade script fails the install, while a
+// failing post-install or post-upgrade one is only logged, as with apk-tools. Scripts that are not
+// run are recorded as pending; see PendingScripts. A package the script linter vetoes is not
+// installed at all.
+func (a *APK) installPackage(ctx context.Context, pkg *repository.RepositoryPackage, expanded *APKExpanded, sourceDateEpoch *time.Time, from *repository.Package) error {
 	a.logger.Debugf("installing %s (%s)", pkg.Name, pkg.Version)
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "installPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
@@ -878,10 +1519,31 @@ func (a *APK) installPackage(ctx context.Context, pkg *repository.RepositoryPack
 
 	var (
 		installedFiles []tar.Header
+		scripts        map[string][]byte
 		err            error
 	)
 
-	if wh, ok := a.fs.(writeHeaderer); ok {
+	pre, post, scriptArgs := "pre-install", "post-install", []string{pkg.Version}
+	if from != nil {
+		pre, post, scriptArgs = "pre-upgrade", "post-upgrade", []string{pkg.Version, from.Version}
+	}
+	if scripts, err = packageScripts(expanded.ControlFile); err != nil {
+		return fmt.Errorf("reading scripts of pkg %s: %w", pkg.Name, err)
+	}
+	if err := a.lintScripts(pkg.Package, scripts, expanded.ControlFile); err != nil {
+		return err
+	}
+	runScripts := a.executor != nil && a.scriptPolicy.Runs(pkg.Name)
+	if a.executor != nil && !runScripts {
+		a.logger.Debugf("not running the scripts of %s, by the script policy", pkg.Name)
+	}
+	if runScripts {
+		if err := a.runScript(pkg.Package, scripts, pre, scriptArgs...); err != nil {
+			return err
+		}
+	}
+
+	if wh, ok := headerWriter(a.fs); ok {
 		installedFiles, err = a.lazilyInstallAPKFiles(ctx, wh, expanded.tarfs, pkg.Package)
 		if err != nil {
 			return fmt.Errorf("unable to install files for pkg %s: %w", pkg.Name, err)
@@ -898,6 +1560,11 @@ func (a *APK) installPackage(ctx context.Context, pkg *repository.RepositoryPack
 			return fmt.Errorf("unable to install files for pkg %s: %w", pkg.Name, err)
 		}
 	}
+	if old := a.replacingPackage(pkg.Name); old != nil {
+		if err := a.replaceInstalledPackage(old, installedFiles); err != nil {
+			return fmt.Errorf("removing %s %s: %w", old.Name, old.Version, err)
+		}
+	}
 
 	// update the scripts.tar
 	controlData, err := os.Open(expanded.ControlFile)
@@ -921,6 +1588,16 @@ func (a *APK) installPackage(ctx context.Context, pkg *repository.RepositoryPack
 	if err := a.addInstalledPackage(pkg.Package, installedFiles); err != nil {
 		return fmt.Errorf("unable to update installed file for pkg %s: %w", pkg.Name, err)
 	}
+
+	if !runScripts {
+		if err := a.addPendingScripts(pkg.Package, scripts, []string{pre, post}, scriptArgs); err != nil {
+			return fmt.Errorf("unable to record pending scripts for pkg %s: %w", pkg.Name, err)
+		}
+		return nil
+	}
+	if err := a.runScript(pkg.Package, scripts, post, scriptArgs...); err != nil {
+		a.logger.Warnf("%v", err)
+	}
 	return nil
 }
 
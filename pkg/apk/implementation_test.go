@@ -15,10 +15,13 @@
 package apk
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -27,6 +30,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"gitlab.alpinelinux.org/alpine/go/repository"
@@ -61,6 +65,27 @@ var (
 	testPkgFilename = fmt.Sprintf("%s-%s.apk", testPkg.Name, testPkg.Version)
 )
 
+func TestNewValidatesOptions(t *testing.T) {
+	_, err := New(WithFS(nil), WithDeltas(true), WithCache(filepath.Join(t.TempDir(), "missing"), true))
+	var invalid *InvalidOptionsError
+	require.ErrorAs(t, err, &invalid)
+	require.Len(t, invalid.Problems, 2)
+	require.Contains(t, invalid.Problems[0], "no filesystem")
+	require.Contains(t, invalid.Problems[1], "offline cache")
+
+	_, err = New(WithDeltas(true))
+	require.ErrorContains(t, err, "WithDeltas needs a cache")
+	_, err = New(WithRejectKeyChanges(true))
+	require.ErrorContains(t, err, "WithRejectKeyChanges needs a cache")
+	_, err = New(WithScriptPolicy(ScriptPolicy{Deny: []string{"["}}))
+	require.ErrorContains(t, err, "invalid script policy pattern")
+
+	a, err := New(WithCache(t.TempDir(), true), WithDeltas(true))
+	require.NoError(t, err)
+	_, err = a.Clone(WithArch(""))
+	require.ErrorContains(t, err, "no architecture")
+}
+
 func TestInitDB(t *testing.T) {
 	src := apkfs.NewMemFS()
 	apk, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
@@ -457,3 +482,219 @@ func TestFetchPackage(t *testing.T) {
 		require.Equal(t, apk1, apk2, "apk files do not match")
 	})
 }
+
+func TestDialContext(t *testing.T) {
+	errDial := fmt.Errorf("dial refused")
+	var dialed string
+	a, err := New(WithDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		return nil, errDial
+	}))
+	require.NoError(t, err)
+
+	// do not wait around for the retries
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://repo.example.com/APKINDEX.tar.gz", nil)
+	require.NoError(t, err)
+	_, err = a.getClient().Do(req) //nolint:bodyclose
+	require.Error(t, err)
+	require.Equal(t, "repo.example.com:80", dialed)
+
+	// an explicitly set client is used as is
+	client := &http.Client{}
+	a.SetClient(client)
+	require.Same(t, client, a.getClient())
+}
+
+func TestCheckInstalledVersions(t *testing.T) {
+	a, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	pkgs := []*repository.RepositoryPackage{
+		{Package: &repository.Package{Name: "busybox", Version: "1.30.0-r0"}},
+		{Package: &repository.Package{Name: "musl", Version: "1.2.4-r0"}},
+		{Package: &repository.Package{Name: "zlib", Version: "1.2.12-r3"}},
+		{Package: &repository.Package{Name: "newpkg", Version: "1.0.0-r0"}},
+	}
+
+	// by default, the newer installed version is kept
+	keep, replace, err := a.checkInstalledVersions(pkgs, false)
+	require.NoError(t, err)
+	require.Empty(t, replace)
+	require.True(t, keep["busybox"])
+
+	a, err = New(WithFS(src), WithFailOnDowngrade(true))
+	require.NoError(t, err)
+	_, _, err = a.checkInstalledVersions(pkgs, false)
+	require.ErrorContains(t, err, "busybox")
+
+	a, err = New(WithFS(src), WithAllowDowngrade(true), WithFailOnDowngrade(true))
+	require.NoError(t, err)
+	keep, replace, err = a.checkInstalledVersions(pkgs, false)
+	require.NoError(t, err)
+	require.Len(t, replace, 1)
+	require.Equal(t, "1.35.0-r17", replace["busybox"].Version)
+	require.False(t, keep["busybox"])
+	require.True(t, keep["musl"], "upgrades are not performed")
+	require.True(t, keep["zlib"])
+	require.False(t, keep["newpkg"])
+
+	keep, replace, err = a.checkInstalledVersions(pkgs, true)
+	require.NoError(t, err)
+	require.Len(t, replace, 2)
+	require.Equal(t, "1.2.3-r0", replace["musl"].Version)
+	require.False(t, keep["musl"])
+	require.True(t, keep["zlib"])
+}
+
+func TestClone(t *testing.T) {
+	a, err := New(WithArch("aarch64"), WithMaxInstalledSize(1000), WithKeyringDirs("usr/share/keys"),
+		WithHosts(map[string]string{"dl-cdn.alpinelinux.org": "10.0.0.5"}))
+	require.NoError(t, err)
+	client := &http.Client{}
+	a.SetClient(client)
+
+	fsys := apkfs.NewMemFS()
+	clone, err := a.Clone(WithFS(fsys), WithKeyringDirs("opt/keys"), WithHosts(map[string]string{"example.com": "10.0.0.6"}))
+	require.NoError(t, err)
+	require.Equal(t, "aarch64", clone.arch)
+	require.Equal(t, uint64(1000), clone.maxInstalledSize)
+	require.Same(t, client, clone.client)
+	require.Equal(t, fsys, clone.fs)
+	require.Equal(t, []string{"usr/share/keys", "opt/keys"}, clone.keyringDirs)
+
+	// changes to the clone do not leak back
+	require.Equal(t, []string{"usr/share/keys"}, a.keyringDirs)
+	require.Len(t, clone.hosts, 2)
+	require.Equal(t, map[string]string{"dl-cdn.alpinelinux.org": "10.0.0.5"}, a.hosts)
+	clone.SetClient(nil)
+	require.Same(t, client, a.client)
+}
+
+func TestInstallRoot(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	writeTestRepository(t, repoDir, testPackage{repository.Package{Name: "hello", Version: "1.0-r0"}, map[string]string{"usr/bin/hello": "hello"}})
+
+	fsys := apkfs.NewMemFS()
+	a := newTestAPK(t, fsys, []string{repoDir}, []string{"hello"}, WithInstallRoot("/sysroot/"))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	for _, path := range []string{"sysroot/usr/bin/hello", "sysroot/etc/apk/world", "sysroot/etc/apk/arch", "sysroot/lib/apk/db/installed"} {
+		_, err := fsys.Stat(path)
+		require.NoError(t, err, path)
+	}
+	for _, path := range []string{"usr", "etc", "lib"} {
+		_, err := fsys.Stat(path)
+		require.ErrorIs(t, err, fs.ErrNotExist, path)
+	}
+
+	// clones install under the same root, rather than under it again
+	clone, err := a.Clone()
+	require.NoError(t, err)
+	installed, err := clone.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+	cfg, err := clone.Config()
+	require.NoError(t, err)
+	require.Equal(t, "/sysroot", cfg.InstallRoot)
+
+	_, err = New(WithInstallRoot("../sysroot"))
+	require.Error(t, err)
+}
+
+// testPackage is a package of a test repository, with the files of its .apk.
+type testPackage struct {
+	pkg   repository.Package
+	files map[string]string
+}
+
+// writeTestRepository writes a flat repository of the packages to the directory, each as
+// name-version.apk along with the index that lists them. Packages without an arch get testArch.
+func writeTestRepository(t *testing.T, dir string, pkgs ...testPackage) {
+	t.Helper()
+	indexed := make([]*repository.Package, 0, len(pkgs))
+	for _, p := range pkgs {
+		pkg := p.pkg
+		if pkg.Arch == "" {
+			pkg.Arch = testArch
+		}
+		indexed = append(indexed, writeTestAPK(t, filepath.Join(dir, pkg.Name+"-"+pkg.Version+".apk"), &pkg, p.files))
+	}
+	writeTestIndex(t, dir, indexed)
+}
+
+// writeTestIndex writes the index of a flat repository of the packages to the directory.
+func writeTestIndex(t *testing.T, dir string, pkgs []*repository.Package) {
+	t.Helper()
+	var index bytes.Buffer
+	require.NoError(t, WriteIndexArchive(&index, "test", pkgs))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, indexFilename), index.Bytes(), 0o644))
+}
+
+// copyTestBaselayout copies testPkg, a real package from the testdata, into the directory, and
+// returns it as an index lists it. Its dependencies are left out, so that it installs on its own.
+func copyTestBaselayout(t *testing.T, dir string) *repository.Package {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, testPkgFilename))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, testPkgFilename), b, 0o644))
+	exp, err := ExpandApk(context.Background(), bytes.NewReader(b), "")
+	require.NoError(t, err)
+	defer exp.Close()
+	pkg := testPkg
+	pkg.Checksum = exp.ControlHash
+	return &pkg
+}
+
+// newTestAPK returns an initialized APK for fsys that installs untrusted packages of testArch from
+// flat repositories, such as those of writeTestRepository, with the world set unless it is nil.
+func newTestAPK(t *testing.T, fsys apkfs.FullFS, repositories, world []string, options ...Option) *APK {
+	t.Helper()
+	ctx := context.Background()
+	options = append([]Option{WithFS(fsys), WithArch(testArch), WithIgnoreMknodErrors(true), WithRepositoryLayout(FlatLayout{}), WithAllowUntrusted(true)}, options...)
+	a, err := New(options...)
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetRepositories(repositories))
+	if world != nil {
+		require.NoError(t, a.SetWorld(world))
+	}
+	return a
+}
+
+// installTestBaselayout installs testPkg, a real package from the testdata, without its dependencies
+// or scripts, and returns the files the installed database lists for it.
+func installTestBaselayout(t *testing.T, a *APK) []string {
+	t.Helper()
+	pkg := testPkg
+	installTestAPK(t, a, filepath.Join(testPrimaryPkgDir, testPkgFilename), &pkg)
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	var files []string
+	for _, p := range installed {
+		if p.Name != testPkg.Name {
+			continue
+		}
+		for _, f := range p.Files {
+			if f.Typeflag == tar.TypeReg {
+				files = append(files, f.Name)
+			}
+		}
+	}
+	require.Contains(t, files, "etc/modprobe.d/aliases.conf")
+	return files
+}
+
+// installTestAPK installs the package at p, without its dependencies or scripts.
+func installTestAPK(t *testing.T, a *APK, p string, pkg *repository.Package) {
+	t.Helper()
+	ctx := context.Background()
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer f.Close()
+	exp, err := ExpandApk(ctx, f, "")
+	require.NoError(t, err)
+	require.NoError(t, a.installPackage(ctx, repository.NewRepositoryPackage(pkg, nil), exp, nil, nil))
+}
@@ -39,190 +39,241 @@ import (
 
 var signatureFileRegex = regexp.MustCompile(`^\.SIGN\.RSA\.(.*\.rsa\.pub)$`)
 
-// IndexURL full URL to the index file for the given repo and arch
+// errIndexNotFound is returned by fetchIndex when a repository has no index at the URL.
+var errIndexNotFound = errors.New("repository index not found")
+
+// IndexURL full URL to the index file for the given repo and arch, in the default AlpineLayout
 func IndexURL(repo, arch string) string {
-	return fmt.Sprintf("%s/%s/%s", repo, arch, indexFilename)
+	return AlpineLayout{}.IndexURL(repo, arch)
 }
 
 // GetRepositoryIndexes returns the indexes for the named repositories, keys and archs.
 // The signatures for each index are verified unless ignoreSignatures is set to true.
 // The key-value pairs in the map for `keys` are the name of the key and the contents of the key.
 // The name is just indicative. If it finds a match, it will use it. Else, it will try all keys.
+// Of the builds of a version of a package for several architectures, as in an index merged with
+// MergeArchIndexes, only those for arch are kept, or else one noarch build.
 func GetRepositoryIndexes(ctx context.Context, repos []string, keys map[string][]byte, arch string, options ...IndexOption) (indexes []NamedIndex, err error) { //nolint:gocyclo
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetRepositoryIndexes")
 	defer span.End()
 
-	opts := &indexOpts{}
+	opts := &indexOpts{layout: AlpineLayout{}}
 	for _, opt := range options {
 		opt(opts)
 	}
 
 	for _, repo := range repos {
-		// does it start with a pin?
-		var (
-			repoName string
-			repoURL  = repo
-		)
-		if strings.HasPrefix(repo, "@") {
-			// it's a pinned repository, get the name
-			parts := strings.Fields(repo)
-			if len(parts) < 2 {
-				return nil, errors.New("invalid repository line")
-			}
-			repoName = parts[0][1:]
-			repoURL = parts[1]
-		}
-
-		repoBase := fmt.Sprintf("%s/%s", repoURL, arch)
-		u := IndexURL(repoURL, arch)
-
-		// Normalize the repo as a URI, so that local paths
-		// are translated into file:// URLs, allowing them to be parsed
-		// into a url.URL{}.
-		var (
-			b     []byte
-			asURL *url.URL
-		)
-		if strings.HasPrefix(u, "https://") {
-			asURL, err = url.Parse(u)
-		} else {
-			// Attempt to parse non-https elements into URI's so they are translated into
-			// file:// URLs allowing them to parse into a url.URL{}
-			asURL, err = url.Parse(string(uri.New(u)))
-		}
+		repoName, repoURL, err := parseRepositoryLine(repo)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse repo as URI: %w", err)
+			return nil, err
 		}
 
-		switch asURL.Scheme {
-		case "file":
-			b, err = os.ReadFile(u)
-			if err != nil {
-				if !errors.Is(err, fs.ErrNotExist) {
-					return nil, fmt.Errorf("failed to read repository %s: %w", u, err)
-				}
-				continue
-			}
-		case "https":
-			client := opts.httpClient
-			if client == nil {
-				client = retryablehttp.NewClient().StandardClient()
-			}
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, asURL.String(), nil)
-			if err != nil {
-				return nil, err
-			}
-			// if the repo URL contains HTTP Basic Auth credentials, add them to the request
-			if asURL.User != nil {
-				user := asURL.User.Username()
-				pass, _ := asURL.User.Password()
-				req.SetBasicAuth(user, pass)
-			}
+		repoArch := opts.repositoryArch(repoURL, arch)
+		repoBase := opts.layout.PackagesURL(repoURL, repoArch)
+		u := opts.layout.IndexURL(repoURL, repoArch)
 
-			// This will return a body that retries requests using Range requests if Read() hits an error.
-			rrt := newRangeRetryTransport(ctx, client)
-			res, err := rrt.RoundTrip(req)
-			if err != nil {
-				return nil, fmt.Errorf("unable to get repository index at %s: %w", u, err)
-			}
-			switch res.StatusCode {
-			case http.StatusOK:
-				// this is fine
-			case http.StatusNotFound:
-				return nil, fmt.Errorf("repository index not found for architecture %s at %s", arch, u)
-			default:
-				return nil, fmt.Errorf("unexpected status code %d when getting repository index for architecture %s at %s", res.StatusCode, arch, u)
-			}
-			defer res.Body.Close()
-			buf := bytes.NewBuffer(nil)
-			if _, err := io.Copy(buf, res.Body); err != nil {
-				return nil, fmt.Errorf("unable to read repository index at %s: %w", u, err)
-			}
-			b = buf.Bytes()
-		default:
-			return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+		b, err := fetchIndex(ctx, u, repoArch, opts)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			continue
 		}
 
 		// validate the signature
+		var signer string
 		if !opts.ignoreSignatures {
-			buf := bytes.NewReader(b)
-			gzipReader, err := gzip.NewReader(buf)
-			if err != nil {
-				return nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
-			}
-			// set multistream to false, so we can read each part separately;
-			// the first part is the signature, the second is the index, which should be
-			// verified.
-			gzipReader.Multistream(false)
-			defer gzipReader.Close()
-
-			tarReader := tar.NewReader(gzipReader)
-
-			// read the signature
-			signatureFile, err := tarReader.Next()
-			if err != nil {
-				return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
-			}
-			matches := signatureFileRegex.FindStringSubmatch(signatureFile.Name)
-			if len(matches) != 2 {
-				return nil, fmt.Errorf("failed to find key name in signature file name: %s", signatureFile.Name)
-			}
-			signature, err := io.ReadAll(tarReader)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
-			}
-			// with multistream false, we should read the next one
-			if _, err := tarReader.Next(); err != nil && !errors.Is(err, io.EOF) {
-				return nil, fmt.Errorf("unexpected error reading from tgz: %w", err)
-			}
-			// we now have the signature bytes and name, get the contents of the rest;
-			// this should be everything else in the raw gzip file as is.
-			allBytes := len(b)
-			unreadBytes := buf.Len()
-			readBytes := allBytes - unreadBytes
-			indexData := b[readBytes:]
-
-			indexDigest, err := sign.HashData(indexData)
-			if err != nil {
+			if signer, err = verifyIndexSignature(b, u, keys); err != nil {
 				return nil, err
 			}
-			// now we can check the signature
-			if keys == nil {
-				return nil, fmt.Errorf("no keys provided to verify signature")
-			}
-			var verified bool
-			keyData, ok := keys[matches[1]]
-			if ok {
-				if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err != nil {
-					verified = false
-				}
-			}
-			if !verified {
-				for _, keyData := range keys {
-					if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err == nil {
-						verified = true
-						break
-					}
-				}
-			}
-			if !verified {
-				return nil, fmt.Errorf("no key found to verify signature for keyfile %s; tried all other keys as well", matches[1])
-			}
 		}
 		// with a valid signature, convert it to an ApkIndex
-		index, err := repository.IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
+		index, problems, err := parseIndexArchive(b, opts.cacheDir, u)
 		if err != nil {
 			return nil, fmt.Errorf("unable to read convert repository index bytes to index struct at %s: %w", u, err)
 		}
+		for i := range problems {
+			problems[i].Index = u
+		}
+		if len(problems) > 0 && opts.strict {
+			// the problems name the index
+			return nil, &IndexProblemsError{Problems: problems}
+		}
+		// of the builds of a merged index for several architectures, only those for the root are resolved from
+		index.Packages = packagesForArch(index.Packages, arch)
 		repoRef := repository.Repository{Uri: repoBase}
-		indexes = append(indexes, NewNamedRepositoryWithIndex(repoName, repoRef.WithIndex(index)))
+		indexes = append(indexes, &namedRepositoryWithIndex{name: repoName, repo: repoRef.WithIndex(index), problems: problems, signer: signer, priority: opts.priorities[repoURL], built: readIndexBuilt(b)})
 	}
 	return indexes, nil
 }
 
+// parseRepositoryLine returns the pin, if any, and the URL of a line of the repositories file.
+func parseRepositoryLine(repo string) (name, repoURL string, err error) {
+	if !strings.HasPrefix(repo, "@") {
+		return "", repo, nil
+	}
+	// it's a pinned repository, get the name
+	parts := strings.Fields(repo)
+	if len(parts) < 2 {
+		return "", "", errors.New("invalid repository line")
+	}
+	return parts[0][1:], parts[1], nil
+}
+
+// verifyIndexSignature verifies the signature of the index archive from u against the keys, returning
+// the name of the key it claims to be signed with.
+func verifyIndexSignature(b []byte, u string, keys map[string][]byte) (string, error) {
+	buf := bytes.NewReader(b)
+	gzipReader, err := gzip.NewReader(buf)
+	if err != nil {
+		return "", fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+	}
+	// set multistream to false, so we can read each part separately;
+	// the first part is the signature, the second is the index, which should be
+	// verified.
+	gzipReader.Multistream(false)
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+
+	// read the signature
+	signatureFile, err := tarReader.Next()
+	if err != nil {
+		return "", fmt.Errorf("failed to read signature from repository index: %w", err)
+	}
+	matches := signatureFileRegex.FindStringSubmatch(signatureFile.Name)
+	if len(matches) != 2 {
+		return "", fmt.Errorf("failed to find key name in signature file name: %s", signatureFile.Name)
+	}
+	signature, err := io.ReadAll(tarReader)
+	if err != nil {
+		return "", fmt.Errorf("failed to read signature from repository index: %w", err)
+	}
+	// with multistream false, we should read the next one
+	if _, err := tarReader.Next(); err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("unexpected error reading from tgz: %w", err)
+	}
+	// we now have the signature bytes and name, get the contents of the rest;
+	// this should be everything else in the raw gzip file as is.
+	allBytes := len(b)
+	unreadBytes := buf.Len()
+	readBytes := allBytes - unreadBytes
+	indexData := b[readBytes:]
+
+	indexDigest, err := sign.HashData(indexData)
+	if err != nil {
+		return "", err
+	}
+	// now we can check the signature
+	if keys == nil {
+		return "", fmt.Errorf("no keys provided to verify signature")
+	}
+	var verified bool
+	keyData, ok := keys[matches[1]]
+	if ok {
+		if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err != nil {
+			verified = false
+		}
+	}
+	if !verified {
+		for _, keyData := range keys {
+			if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err == nil {
+				verified = true
+				break
+			}
+		}
+	}
+	if !verified {
+		return "", &UntrustedKeyError{Index: u, Key: matches[1]}
+	}
+	return matches[1], nil
+}
+
+// fetchIndex returns the contents of the index archive at u, or nil for a local index that does not exist.
+func fetchIndex(ctx context.Context, u, arch string, opts *indexOpts) ([]byte, error) {
+	// Normalize the repo as a URI, so that local paths
+	// are translated into file:// URLs, allowing them to be parsed
+	// into a url.URL{}.
+	var (
+		b     []byte
+		asURL *url.URL
+		err   error
+	)
+	if strings.HasPrefix(u, "https://") {
+		asURL, err = url.Parse(u)
+	} else {
+		// Attempt to parse non-https elements into URI's so they are translated into
+		// file:// URLs allowing them to parse into a url.URL{}
+		asURL, err = url.Parse(string(uri.New(u)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse repo as URI: %w", err)
+	}
+
+	switch asURL.Scheme {
+	case "file":
+		b, err = os.ReadFile(u)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("failed to read repository %s: %w", u, err)
+			}
+			return nil, nil
+		}
+	case "https":
+		client := opts.httpClient
+		if client == nil {
+			client = retryablehttp.NewClient().StandardClient()
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, asURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		// if the repo URL contains HTTP Basic Auth credentials, add them to the request
+		if asURL.User != nil {
+			user := asURL.User.Username()
+			pass, _ := asURL.User.Password()
+			req.SetBasicAuth(user, pass)
+		}
+
+		// This will return a body that retries requests using Range requests if Read() hits an error.
+		rrt := newRangeRetryTransport(ctx, client)
+		res, err := rrt.RoundTrip(req)
+		if res != nil && res.StatusCode == http.StatusNotFound {
+			// the transport returns an error for it along with the response
+			if res.Body != nil {
+				res.Body.Close()
+			}
+			return nil, fmt.Errorf("%w for architecture %s at %s", errIndexNotFound, arch, u)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to get repository index at %s: %w", u, err)
+		}
+		switch res.StatusCode {
+		case http.StatusOK:
+			// this is fine
+		default:
+			return nil, fmt.Errorf("unexpected status code %d when getting repository index for architecture %s at %s", res.StatusCode, arch, u)
+		}
+		defer res.Body.Close()
+		buf := bytes.NewBuffer(nil)
+		if _, err := io.Copy(buf, res.Body); err != nil {
+			return nil, fmt.Errorf("unable to read repository index at %s: %w", u, err)
+		}
+		b = buf.Bytes()
+	default:
+		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+	}
+	return b, nil
+}
+
 type indexOpts struct {
 	ignoreSignatures bool
 	httpClient       *http.Client
+	layout           RepositoryLayout
+	cacheDir         string
+	strict           bool
+	priorities       map[string]int
+	arches           map[string]string
 }
 type IndexOption func(*indexOpts)
 
@@ -237,3 +288,64 @@ func WithHTTPClient(c *http.Client) IndexOption {
 		o.httpClient = c
 	}
 }
+
+// WithLayout sets the layout of the repositories. If not provided, or nil, AlpineLayout is used.
+func WithLayout(layout RepositoryLayout) IndexOption {
+	return func(o *indexOpts) {
+		if layout != nil {
+			o.layout = layout
+		}
+	}
+}
+
+// WithIndexCacheDir keeps the parsed form of each index in dir, keyed by the checksum of the index,
+// so that indexes which have not changed since the last run do not need to be parsed again.
+func WithIndexCacheDir(dir string) IndexOption {
+	return func(o *indexOpts) {
+		o.cacheDir = dir
+	}
+}
+
+// WithStrictIndex fails with an *IndexProblemsError for indexes that have problems, such as malformed
+// stanzas or duplicate packages. Without it, the entries with problems are skipped, and available from
+// IndexProblems.
+func WithStrictIndex(strict bool) IndexOption {
+	return func(o *indexOpts) {
+		o.strict = strict
+	}
+}
+
+// WithRepositoryPriority sets the priority of the repository, which is its URL, as in
+// /etc/apk/repositories, without any pin. When a package is in several repositories, those of
+// the repositories with the highest priority are preferred, whatever their versions; otherwise,
+// the highest version is, and, of equal versions, the one of the repository listed first.
+// Repositories have priority 0 unless set. The priority of each index is available from
+// IndexPriority.
+func WithRepositoryPriority(repo string, priority int) IndexOption {
+	return func(o *indexOpts) {
+		if o.priorities == nil {
+			o.priorities = map[string]int{}
+		}
+		o.priorities[repo] = priority
+	}
+}
+
+// WithRepositoryArch fetches the repository, which is its URL, as in /etc/apk/repositories, without
+// any pin, for arch rather than the architecture the indexes are fetched for, such as for a private
+// repository that only publishes noarch, or names its architecture directories its own way.
+func WithRepositoryArch(repo, arch string) IndexOption {
+	return func(o *indexOpts) {
+		if o.arches == nil {
+			o.arches = map[string]string{}
+		}
+		o.arches[repo] = arch
+	}
+}
+
+// repositoryArch returns the architecture to fetch the repository of the URL for, instead of arch.
+func (o *indexOpts) repositoryArch(repoURL, arch string) string {
+	if repoArch, ok := o.arches[repoURL]; ok {
+		return repoArch
+	}
+	return arch
+}
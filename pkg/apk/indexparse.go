@@ -0,0 +1,271 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+const (
+	// parsedIndexDir is the directory in the cache where parsed indexes are kept. It must not be
+	// the APKINDEX directory used by the cache transport, which expects only archives there.
+	parsedIndexDir = "parsed-indexes"
+	// parsedIndexVersion is bumped whenever the encoding of a parsed index changes, so that
+	// entries from older versions are ignored rather than misread.
+	parsedIndexVersion = "v1"
+	// minStanzasPerChunk is the smallest number of packages worth handing to a parsing goroutine.
+	minStanzasPerChunk = 256
+)
+
+// ParseIndexArchive parses an APKINDEX.tar.gz, as served by a repository, into an ApkIndex. The signature,
+// if any, is returned in the index but not verified. Entries with problems, such as malformed stanzas or
+// duplicate packages, are left out of the index; ParseIndexArchiveProblems returns them too.
+func ParseIndexArchive(r io.Reader) (*repository.ApkIndex, error) {
+	index, _, err := ParseIndexArchiveProblems(r)
+	return index, err
+}
+
+// ParseIndexArchiveProblems parses an APKINDEX.tar.gz as ParseIndexArchive does, also returning the
+// entries that were left out of the index, as problems.
+func ParseIndexArchiveProblems(r io.Reader) (*repository.ApkIndex, []IndexProblem, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read repository index: %w", err)
+	}
+	return parseIndexArchiveParallel(b)
+}
+
+// parseIndexArchive converts the bytes of an APKINDEX.tar.gz into an ApkIndex, leaving out the entries
+// with problems. If cacheDir is set, the parsed index is stored there under its source, the URL it was
+// fetched from, and the checksum of the archive, and read back on the next call with the same archive,
+// skipping the text parsing entirely. Storing it removes what is stored of earlier versions of the index
+// from the same source. Indexes with problems are not stored, so that the problems are reported every time.
+func parseIndexArchive(b []byte, cacheDir, source string) (*repository.ApkIndex, []IndexProblem, error) {
+	var cacheFile string
+	if cacheDir != "" {
+		sum := sha256.Sum256(b)
+		cacheFile = filepath.Join(cacheDir, parsedIndexDir, parsedIndexVersion, parsedIndexPrefix(source)+hex.EncodeToString(sum[:])+".gob")
+		if index, err := readParsedIndex(cacheFile); err == nil {
+			return index, nil, nil
+		}
+	}
+
+	index, problems, err := parseIndexArchiveParallel(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cacheFile != "" && len(problems) == 0 {
+		// failing to write the cache is not fatal, we just parse again next time
+		if err := writeParsedIndex(cacheFile, index); err == nil {
+			pruneParsedIndexes(cacheDir, cacheFile)
+		}
+	}
+	return index, problems, nil
+}
+
+// parseIndexArchiveParallel reads the archive and parses the APKINDEX it contains, splitting the
+// packages across goroutines.
+func parseIndexArchiveParallel(b []byte) (*repository.ApkIndex, []IndexProblem, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+	}
+	defer gzipReader.Close()
+
+	index := &repository.ApkIndex{}
+	var problems []IndexProblem
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		hdr, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read repository index: %w", err)
+		}
+		switch {
+		case strings.HasPrefix(hdr.Name, ".SIGN."):
+			if index.Signature, err = io.ReadAll(tarReader); err != nil {
+				return nil, nil, fmt.Errorf("failed to read signature from repository index: %w", err)
+			}
+		case hdr.Name == "DESCRIPTION":
+			desc, err := io.ReadAll(tarReader)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read description from repository index: %w", err)
+			}
+			index.Description = string(desc)
+		case hdr.Name == "APKINDEX":
+			data, err := io.ReadAll(tarReader)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read APKINDEX from repository index: %w", err)
+			}
+			index.Packages, problems = parsePackageIndexParallel(data, runtime.GOMAXPROCS(0))
+		}
+	}
+	return index, problems, nil
+}
+
+// readIndexBuilt returns the time the APKINDEX of an APKINDEX.tar.gz was written, which is when the
+// index was built, or the zero time if the archive has none. Only the headers up to that of the
+// APKINDEX are read, not the APKINDEX itself.
+func readIndexBuilt(b []byte) time.Time {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return time.Time{}
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		hdr, err := tarReader.Next()
+		if err != nil {
+			return time.Time{}
+		}
+		if hdr.Name == "APKINDEX" {
+			return hdr.ModTime
+		}
+	}
+}
+
+// parsePackageIndexParallel splits the APKINDEX text into at most workers chunks on stanza
+// boundaries, parses them concurrently and returns the packages in their original order,
+// leaving out those with problems.
+func parsePackageIndexParallel(data []byte, workers int) ([]*repository.Package, []IndexProblem) {
+	chunks := splitStanzas(data, workers)
+	results := make([][]*repository.Package, len(chunks))
+	chunkProblems := make([][]IndexProblem, len(chunks))
+
+	var wg sync.WaitGroup
+	line := 1
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk []byte, line int) {
+			defer wg.Done()
+			results[i], chunkProblems[i] = parseStanzas(chunk, line)
+		}(i, chunk, line)
+		line += bytes.Count(chunk, []byte("\n"))
+	}
+	wg.Wait()
+
+	var pkgs []*repository.Package
+	var problems []IndexProblem
+	for i, result := range results {
+		pkgs = append(pkgs, result...)
+		problems = append(problems, chunkProblems[i]...)
+	}
+	pkgs, checked := checkIndexPackages(pkgs)
+	return pkgs, append(problems, checked...)
+}
+
+// splitStanzas splits the APKINDEX text into at most n chunks of roughly equal size, each ending
+// at the blank line that separates two packages.
+func splitStanzas(data []byte, n int) [][]byte {
+	stanzas := bytes.Count(data, []byte("\n\n")) + 1
+	if most := stanzas / minStanzasPerChunk; n > most {
+		n = most
+	}
+	if n <= 1 {
+		return [][]byte{data}
+	}
+	size := len(data) / n
+	var chunks [][]byte
+	for len(chunks) < n-1 && len(data) > size {
+		end := bytes.Index(data[size:], []byte("\n\n"))
+		if end < 0 {
+			break
+		}
+		end += size + 2
+		chunks = append(chunks, data[:end])
+		data = data[end:]
+	}
+	return append(chunks, data)
+}
+
+// parsedIndexPrefix is the prefix of the names of the parsed indexes of the source in the cache.
+func parsedIndexPrefix(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:8]) + "-"
+}
+
+// pruneParsedIndexes removes the parsed indexes in the cache that keep, the one just stored, replaces:
+// those of the same source with another checksum, and those of other versions of the encoding. Failing
+// to remove them is not fatal, they are only left behind.
+func pruneParsedIndexes(cacheDir, keep string) {
+	name := filepath.Base(keep)
+	prefix := name[:strings.IndexByte(name, '-')+1]
+	stale, _ := filepath.Glob(filepath.Join(filepath.Dir(keep), prefix+"*.gob"))
+	for _, p := range stale {
+		if p != keep {
+			_ = os.Remove(p)
+		}
+	}
+	versions, _ := os.ReadDir(filepath.Join(cacheDir, parsedIndexDir))
+	for _, v := range versions {
+		if v.Name() != parsedIndexVersion {
+			_ = os.RemoveAll(filepath.Join(cacheDir, parsedIndexDir, v.Name()))
+		}
+	}
+}
+
+func readParsedIndex(path string) (*repository.ApkIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	index := &repository.ApkIndex{}
+	if err := gob.NewDecoder(f).Decode(index); err != nil {
+		return nil, fmt.Errorf("failed to decode parsed index %s: %w", path, err)
+	}
+	return index, nil
+}
+
+// writeParsedIndex writes to a temporary file and moves it into place, so that concurrent
+// readers never see a partially written index.
+func writeParsedIndex(path string, index *repository.ApkIndex) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(index); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
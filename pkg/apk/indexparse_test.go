@@ -0,0 +1,188 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestParsePackageIndexParallel(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&buf, "P:pkg-%d\nV:1.%d-r0\nA:aarch64\nD:so:libc.musl-aarch64.so.1 dep-%d\n\n", i, i, i)
+	}
+	expected, err := repository.ParsePackageIndex(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	for _, workers := range []int{1, 3, 8} {
+		pkgs, problems := parsePackageIndexParallel(buf.Bytes(), workers)
+		require.Empty(t, problems)
+		require.Equal(t, expected, pkgs, "workers %d", workers)
+	}
+
+	pkgs, problems := parsePackageIndexParallel([]byte("P:broken\nnot a field\n"), 4)
+	require.Empty(t, pkgs)
+	require.Len(t, problems, 1)
+}
+
+func TestParsePackageIndexProblems(t *testing.T) {
+	data := []byte(`P:good
+V:1.0-r0
+
+P:broken
+V:2.0-r0
+not a field
+
+V:3.0-r0
+A:aarch64
+
+P:noversion
+
+P:good
+V:1.0-r0
+
+P:other
+V:1.0-r0
+`)
+	for _, workers := range []int{1, 4} {
+		pkgs, problems := parsePackageIndexParallel(data, workers)
+		var names []string
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Name)
+		}
+		require.Equal(t, []string{"good", "other"}, names)
+
+		var reasons []string
+		for _, p := range problems {
+			reasons = append(reasons, fmt.Sprintf("%d %s %s", p.Line, p.Package, p.Reason))
+		}
+		require.Len(t, reasons, 4)
+		require.Contains(t, reasons[0], "4 broken cannot parse line")
+		require.Equal(t, []string{
+			"8  missing package name",
+			"0 noversion missing version",
+			"0 good duplicate entry",
+		}, reasons[1:])
+	}
+}
+
+func TestParseIndexArchiveCache(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, "APKINDEX.tar.gz"))
+	require.NoError(t, err)
+	expected, err := repository.IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
+	require.NoError(t, err)
+
+	const source = "https://example.com/APKINDEX.tar.gz"
+	dir := t.TempDir()
+	index, problems, err := parseIndexArchive(b, dir, source)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	require.Equal(t, expected, index)
+
+	cached, err := filepath.Glob(filepath.Join(dir, parsedIndexDir, parsedIndexVersion, "*.gob"))
+	require.NoError(t, err)
+	require.Len(t, cached, 1)
+
+	// the cached entry decodes to the same index, and is what the second parse returns
+	cachedIndex, err := readParsedIndex(cached[0])
+	require.NoError(t, err)
+	require.Equal(t, expected, cachedIndex)
+	index, _, err = parseIndexArchive(b, dir, source)
+	require.NoError(t, err)
+	require.Equal(t, expected, index)
+
+	// a corrupt cache entry falls back to parsing
+	require.NoError(t, os.WriteFile(cached[0], []byte("garbage"), 0o644))
+	index, _, err = parseIndexArchive(b, dir, source)
+	require.NoError(t, err)
+	require.Equal(t, expected, index)
+
+	// a newer index from the same source replaces it, along with entries of older encodings, while
+	// the indexes of other sources are kept
+	stale := filepath.Join(dir, parsedIndexDir, "v0", "old.gob")
+	require.NoError(t, os.MkdirAll(filepath.Dir(stale), 0o755))
+	require.NoError(t, os.WriteFile(stale, []byte("old"), 0o644))
+	_, _, err = parseIndexArchive(b, dir, "https://example.com/other/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	_, _, err = parseIndexArchive(testIndexArchive(t, "P:foo\nV:1.0-r0\n"), dir, source)
+	require.NoError(t, err)
+	entries, err := filepath.Glob(filepath.Join(dir, parsedIndexDir, parsedIndexVersion, "*.gob"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.NotContains(t, entries, cached[0])
+	_, err = os.Stat(stale)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestGetRepositoryIndexesProblems(t *testing.T) {
+	repo := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, testArch), 0o755))
+	b := testIndexArchive(t, "P:foo\nV:1.0-r0\n\nP:foo\nV:1.0-r0\n\nP:bar\nV:2.0-r0\n")
+	require.NoError(t, os.WriteFile(filepath.Join(repo, testArch, indexFilename), b, 0o644))
+
+	_, err := GetRepositoryIndexes(context.Background(), []string{repo}, nil, testArch, WithIgnoreSignatures(true), WithStrictIndex(true))
+	var problemsErr *IndexProblemsError
+	require.ErrorAs(t, err, &problemsErr)
+	require.Len(t, problemsErr.Problems, 1)
+
+	indexes, err := GetRepositoryIndexes(context.Background(), []string{repo}, nil, testArch, WithIgnoreSignatures(true))
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.Equal(t, 2, indexes[0].Count())
+	require.Equal(t, []IndexProblem{{
+		Index:   IndexURL(repo, testArch),
+		Package: "foo",
+		Version: "1.0-r0",
+		Reason:  "duplicate entry",
+	}}, IndexProblems(indexes[0]))
+
+	// as does parsing the archive itself
+	index, err := ParseIndexArchive(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Len(t, index.Packages, 2)
+	index, problems, err := ParseIndexArchiveProblems(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Len(t, index.Packages, 2)
+	require.Len(t, problems, 1)
+}
+
+// testIndexArchive returns an unsigned APKINDEX.tar.gz with the APKINDEX text.
+func testIndexArchive(t testing.TB, apkindex string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, f := range []struct{ name, content string }{
+		{"DESCRIPTION", "test"},
+		{"APKINDEX", apkindex},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.content))}))
+		_, err := tw.Write([]byte(f.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
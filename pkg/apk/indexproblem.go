@@ -0,0 +1,172 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// IndexProblem is an entry of an APKINDEX that could not be used, such as a malformed stanza, one
+// missing a required field, or a duplicate of an earlier entry.
+type IndexProblem struct {
+	// Index is the URL of the index, when known.
+	Index string `json:"index,omitempty"`
+	// Line is the line of the APKINDEX the entry starts on, or 0 if it is not known.
+	Line int `json:"line,omitempty"`
+	// Package and Version identify the entry, as far as they could be read.
+	Package string `json:"package,omitempty"`
+	Version string `json:"version,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+func (p IndexProblem) String() string {
+	var b strings.Builder
+	if p.Index != "" {
+		b.WriteString(p.Index + ": ")
+	}
+	if p.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", p.Line)
+	}
+	switch {
+	case p.Package != "" && p.Version != "":
+		fmt.Fprintf(&b, "%s-%s: ", p.Package, p.Version)
+	case p.Package != "":
+		b.WriteString(p.Package + ": ")
+	}
+	b.WriteString(p.Reason)
+	return b.String()
+}
+
+// IndexProblemsError is returned for an index with problems, when the index is parsed strictly.
+type IndexProblemsError struct {
+	Problems []IndexProblem
+}
+
+func (e *IndexProblemsError) Error() string {
+	const shown = 3
+	var msgs []string
+	for i, p := range e.Problems {
+		if i == shown {
+			msgs = append(msgs, fmt.Sprintf("and %d more", len(e.Problems)-shown))
+			break
+		}
+		msgs = append(msgs, p.String())
+	}
+	return fmt.Sprintf("%d problems in repository index: %s", len(e.Problems), strings.Join(msgs, "; "))
+}
+
+// IndexProblems returns the problems that were skipped when the index was parsed by
+// GetRepositoryIndexes, without WithStrictIndex. It returns nil for indexes from elsewhere.
+func IndexProblems(index NamedIndex) []IndexProblem {
+	if p, ok := index.(interface{ Problems() []IndexProblem }); ok {
+		return p.Problems()
+	}
+	return nil
+}
+
+// parseStanzas parses a chunk of APKINDEX text that starts on the given line. Usually the chunk
+// parses as a whole; if it does not, or some stanza is dropped while parsing, such as one without
+// a name, the stanzas are parsed one by one to find those at fault, which are left out.
+func parseStanzas(chunk []byte, line int) ([]*repository.Package, []IndexProblem) {
+	pkgs, err := repository.ParsePackageIndex(bytes.NewReader(chunk))
+	if err == nil && len(pkgs) == countStanzas(chunk) {
+		return pkgs, nil
+	}
+
+	pkgs = nil
+	var problems []IndexProblem
+	forEachStanza(chunk, line, func(stanza []byte, line int) {
+		parsed, err := repository.ParsePackageIndex(bytes.NewReader(stanza))
+		switch {
+		case err != nil:
+			name, version := stanzaID(stanza)
+			problems = append(problems, IndexProblem{Line: line, Package: name, Version: version, Reason: err.Error()})
+		case len(parsed) != 1 || parsed[0].Name == "":
+			_, version := stanzaID(stanza)
+			problems = append(problems, IndexProblem{Line: line, Version: version, Reason: "missing package name"})
+		default:
+			pkgs = append(pkgs, parsed[0])
+		}
+	})
+	return pkgs, problems
+}
+
+// checkIndexPackages leaves out the packages that are missing a version, and any but the first of
+// each name, version and architecture, as merged indexes have the builds of several architectures.
+func checkIndexPackages(pkgs []*repository.Package) ([]*repository.Package, []IndexProblem) {
+	var problems []IndexProblem
+	seen := make(map[string]bool, len(pkgs))
+	kept := pkgs[:0]
+	for _, pkg := range pkgs {
+		var reason string
+		if pkg.Version == "" {
+			reason = "missing version"
+		} else if id := pkg.Name + "=" + pkg.Version + " " + pkg.Arch; seen[id] {
+			reason = "duplicate entry"
+		} else {
+			seen[id] = true
+		}
+		if reason != "" {
+			problems = append(problems, IndexProblem{Package: pkg.Name, Version: pkg.Version, Reason: reason})
+			continue
+		}
+		kept = append(kept, pkg)
+	}
+	return kept, problems
+}
+
+// forEachStanza calls fn with each non-empty stanza of the chunk, and the line it starts on.
+func forEachStanza(chunk []byte, line int, fn func(stanza []byte, line int)) {
+	for off := 0; off < len(chunk); {
+		if chunk[off] == '\n' {
+			off++
+			line++
+			continue
+		}
+		next := len(chunk)
+		if end := bytes.Index(chunk[off:], []byte("\n\n")); end >= 0 {
+			next = off + end + 1
+		}
+		stanza := chunk[off:next]
+		fn(stanza, line)
+		line += bytes.Count(stanza, []byte("\n"))
+		off = next
+	}
+}
+
+func countStanzas(chunk []byte) int {
+	var n int
+	forEachStanza(chunk, 1, func([]byte, int) { n++ })
+	return n
+}
+
+// stanzaID returns what can be read of the name and version of a stanza that cannot be parsed.
+func stanzaID(stanza []byte) (name, version string) {
+	scanner := bufio.NewScanner(bytes.NewReader(stanza))
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "P:"); ok && name == "" {
+			name = v
+		}
+		if v, ok := strings.CutPrefix(scanner.Text(), "V:"); ok && version == "" {
+			version = v
+		}
+	}
+	return name, version
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// AddIndexPackages adds the packages to the index, each in place of the package of the index with the
+// same name and version, if any, or else after the packages of the index.
+func AddIndexPackages(index *repository.ApkIndex, pkgs ...*repository.Package) {
+	for _, pkg := range pkgs {
+		replaced := false
+		for i, existing := range index.Packages {
+			if existing.Name == pkg.Name && existing.Version == pkg.Version {
+				index.Packages[i] = pkg
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			index.Packages = append(index.Packages, pkg)
+		}
+	}
+}
+
+// RemoveIndexPackages removes the packages of the index that are named by the ids, either by name, for
+// every version, or by name and version, as foo-1.0-r0, and returns those it removed.
+func RemoveIndexPackages(index *repository.ApkIndex, ids ...string) []*repository.Package {
+	remove := map[string]bool{}
+	for _, id := range ids {
+		remove[id] = true
+	}
+	var kept, removed []*repository.Package
+	for _, pkg := range index.Packages {
+		if remove[pkg.Name] || remove[pkg.Name+"-"+pkg.Version] {
+			removed = append(removed, pkg)
+			continue
+		}
+		kept = append(kept, pkg)
+	}
+	index.Packages = kept
+	return removed
+}
+
+// UpdateIndexFile updates the APKINDEX.tar.gz file in place, adding the packages to it as
+// AddIndexPackages does, and removing those of the ids, as RemoveIndexPackages does, before adding
+// them. The packages already in the index are not read again, so publishing a package to a large
+// repository only costs parsing and writing its index. The description is kept unless another is
+// given, and the index is signed again with the signing key, if any; the signature it had is dropped
+// either way. An index with problems is not updated, as its entries with problems would be lost, and
+// a file that does not exist is created.
+func UpdateIndexFile(ctx context.Context, file, description, signingKey string, add []*repository.Package, remove ...string) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "UpdateIndexFile")
+	defer span.End()
+
+	index, err := readIndexFile(file)
+	if err != nil {
+		return err
+	}
+	RemoveIndexPackages(index, remove...)
+	AddIndexPackages(index, add...)
+	if description != "" {
+		index.Description = description
+	}
+	return writeSignedIndexFile(ctx, file, signingKey, index)
+}
+
+// readIndexFile parses the APKINDEX.tar.gz file to update, which is empty if it does not exist.
+func readIndexFile(file string) (*repository.ApkIndex, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &repository.ApkIndex{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	index, problems, err := parseIndexArchiveParallel(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("updating %s: %w", file, &IndexProblemsError{Problems: problems})
+	}
+	return index, nil
+}
+
+// writeSignedIndexFile replaces the file with the index, signed with the signing key if any, through a
+// temporary file so that the repository never serves a partial or unsigned index.
+func writeSignedIndexFile(ctx context.Context, file, signingKey string, index *repository.ApkIndex) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".APKINDEX-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err := WriteIndexArchive(tmp, index.Description, index.Packages); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", file, err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if signingKey != "" {
+		log := logrus.New()
+		log.SetOutput(io.Discard)
+		if err := sign.SignIndex(ctx, log, signingKey, tmp.Name()); err != nil {
+			return fmt.Errorf("signing %s: %w", file, err)
+		}
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestUpdateIndexFile(t *testing.T) {
+	ctx := context.Background()
+	keyFile, pub := testSigningKey(t, "update.rsa")
+	file := filepath.Join(t.TempDir(), indexFilename)
+	read := func() (*repository.ApkIndex, []string) {
+		b, err := os.ReadFile(file)
+		require.NoError(t, err)
+		_, err = verifyIndexSignature(b, file, map[string][]byte{"update.rsa.pub": pub})
+		require.NoError(t, err)
+		index, _, err := parseIndexArchive(b, "", "")
+		require.NoError(t, err)
+		var ids []string
+		for _, pkg := range index.Packages {
+			ids = append(ids, pkg.Name+"-"+pkg.Version)
+		}
+		return index, ids
+	}
+	pkg := func(name, version, description string) *repository.Package {
+		return &repository.Package{Name: name, Version: version, Arch: testArch, Description: description}
+	}
+
+	require.NoError(t, UpdateIndexFile(ctx, file, "v3.18/main", keyFile, []*repository.Package{pkg("foo", "1.0-r0", ""), pkg("bar", "1.0-r0", "")}))
+	index, ids := read()
+	require.Equal(t, "v3.18/main", index.Description)
+	require.Equal(t, []string{"foo-1.0-r0", "bar-1.0-r0"}, ids)
+
+	// the same version is replaced in place, the description is kept
+	require.NoError(t, UpdateIndexFile(ctx, file, "", keyFile, []*repository.Package{pkg("foo", "1.0-r0", "rebuilt"), pkg("foo", "1.1-r0", "")}))
+	index, ids = read()
+	require.Equal(t, "v3.18/main", index.Description)
+	require.Equal(t, []string{"foo-1.0-r0", "bar-1.0-r0", "foo-1.1-r0"}, ids)
+	require.Equal(t, "rebuilt", index.Packages[0].Description)
+
+	require.NoError(t, UpdateIndexFile(ctx, file, "", keyFile, nil, "foo-1.0-r0"))
+	_, ids = read()
+	require.Equal(t, []string{"bar-1.0-r0", "foo-1.1-r0"}, ids)
+	require.NoError(t, UpdateIndexFile(ctx, file, "", keyFile, []*repository.Package{pkg("baz", "1.0-r0", "")}, "foo"))
+	_, ids = read()
+	require.Equal(t, []string{"bar-1.0-r0", "baz-1.0-r0"}, ids)
+
+	// entries with problems would be lost
+	require.NoError(t, os.WriteFile(file, testIndexArchive(t, "P:foo\nV:1.0-r0\n\nP:foo\nV:1.0-r0\n\n"), 0o644))
+	var problems *IndexProblemsError
+	require.ErrorAs(t, UpdateIndexFile(ctx, file, "", "", nil), &problems)
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+)
+
+// PackageInfo is everything that is known about a package, the equivalent of "apk info -a".
+type PackageInfo struct {
+	repository.Package
+	// Repository is the repository the package comes from, if it was found in one.
+	Repository string
+	// Installed is set if the package is installed, in which case the other fields describe
+	// the installed version.
+	Installed bool
+	// Contents are the paths of the files in the package. They are known for installed packages,
+	// and for packages in the cache; otherwise they are empty.
+	Contents []string
+	// Triggers are the directories whose changes trigger the package's trigger script.
+	Triggers []string
+}
+
+// Info returns everything that is known about the named package. If it is installed, that is the
+// installed version, otherwise it is the version the name resolves to in the repositories, with
+// the index data completed from the control data of the package if the package is in the cache.
+func (a *APK) Info(ctx context.Context, name string) (*PackageInfo, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Info")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	for _, pkg := range installed {
+		if pkg.Name == name {
+			return a.installedInfo(pkg)
+		}
+	}
+
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	resolver, err := a.resolverOf(ctx, indexes, nil)
+	if err != nil {
+		return nil, err
+	}
+	pkgs, err := resolver.ResolvePackage(name)
+	if err != nil {
+		return nil, err
+	}
+	pkg := pkgs[0]
+	info := &PackageInfo{Package: *pkg.Package}
+	info.Repository = packageRepository(pkg)
+	if a.cache == nil {
+		return info, nil
+	}
+
+	cacheDir, err := cacheDirForPackage(a.cache.dir, pkg)
+	if err != nil {
+		return nil, err
+	}
+	exp, err := a.cachedPackage(ctx, pkg, cacheDir)
+	if err != nil {
+		// not in the cache, so all we have is the index
+		a.logger.Debugf("cache miss (%s): %v", pkg.Name, err)
+		return info, nil
+	}
+	if err := info.addControl(exp.ControlFile); err != nil {
+		return nil, fmt.Errorf("reading control data of %s: %w", pkg.Name, err)
+	}
+	var startedDataSection bool
+	for _, header := range exp.tarfs.Entries() {
+		// see lazilyInstallAPKFiles for why hidden files before the data section are skipped
+		if !startedDataSection && header.Name[0] == '.' && !strings.Contains(header.Name, "/") {
+			continue
+		}
+		startedDataSection = true
+		info.Contents = append(info.Contents, header.Name)
+	}
+	return info, nil
+}
+
+func (a *APK) installedInfo(pkg *InstalledPackage) (*PackageInfo, error) {
+	info := &PackageInfo{Package: pkg.Package, Installed: true}
+	for _, f := range pkg.Files {
+		info.Contents = append(info.Contents, f.Name)
+	}
+	if len(pkg.Checksum) == 0 {
+		return info, nil
+	}
+	b, err := a.fs.ReadFile(triggersFilePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return info, nil
+		}
+		return nil, fmt.Errorf("unable to read triggers file %s: %w", triggersFilePath, err)
+	}
+	// the checksum is written as is by updateTriggers, and in its Q1 form by apk-tools
+	sum := base64.StdEncoding.EncodeToString(pkg.Checksum)
+	for _, line := range strings.Split(string(b), "\n") {
+		checksum, triggers, _ := strings.Cut(line, " ")
+		if checksum == sum || checksum == FormatQ1Checksum(pkg.Checksum) {
+			info.Triggers = append(info.Triggers, strings.Fields(triggers)...)
+		}
+	}
+	return info, nil
+}
+
+// addControl completes the information from the index with the .PKGINFO in the control section,
+// which has fields, such as replaces and triggers, that the index does not.
+func (info *PackageInfo) addControl(controlFile string) error {
+	f, err := os.Open(controlFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	values, err := controlValues(f)
+	if err != nil {
+		return err
+	}
+	first := func(key string) string {
+		if v := values[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	for _, field := range []struct {
+		value *string
+		key   string
+	}{
+		{&info.Description, "pkgdesc"},
+		{&info.URL, "url"},
+		{&info.License, "license"},
+		{&info.Origin, "origin"},
+		{&info.Maintainer, "maintainer"},
+		{&info.RepoCommit, "commit"},
+		{&info.DataHash, "datahash"},
+	} {
+		if *field.value == "" {
+			*field.value = first(field.key)
+		}
+	}
+	if info.Replaces == "" {
+		info.Replaces = strings.Join(values["replaces"], " ")
+	}
+	for _, triggers := range values["triggers"] {
+		info.Triggers = append(info.Triggers, strings.Fields(triggers)...)
+	}
+	return nil
+}
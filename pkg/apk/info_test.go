@@ -0,0 +1,55 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestInfoInstalled(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+
+	info, err := a.Info(context.Background(), "busybox")
+	require.NoError(t, err)
+	require.True(t, info.Installed)
+	require.Equal(t, "1.35.0-r17", info.Version)
+	require.Equal(t, "https://busybox.net/", info.URL)
+	require.Contains(t, info.Contents, "bin/busybox")
+	require.Equal(t, []string{"/bin", "/usr/bin", "/sbin", "/usr/sbin", "/lib/modules/*"}, info.Triggers)
+}
+
+func TestInfoControl(t *testing.T) {
+	f, err := os.Open(filepath.Join(testPrimaryPkgDir, testPkgFilename))
+	require.NoError(t, err)
+	defer f.Close()
+	exp, err := ExpandApk(context.Background(), f, "")
+	require.NoError(t, err)
+	defer exp.Close()
+
+	// the index has no description, replaces or datahash, so they come from the control data
+	info := &PackageInfo{Package: repository.Package{Name: "alpine-baselayout", URL: "https://example.com"}}
+	require.NoError(t, info.addControl(exp.ControlFile))
+	require.Equal(t, "Alpine base dir structure and init scripts", info.Description)
+	require.Equal(t, "https://example.com", info.URL, "index data takes precedence")
+	require.Equal(t, "alpine-baselayout", info.Origin)
+	require.NotEmpty(t, info.DataHash)
+}
@@ -31,10 +31,11 @@ import (
 	"go.opentelemetry.io/otel"
 
 	"github.com/chainguard-dev/go-apk/internal/tarfs"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 )
 
 // writeOneFile writes one file from the APK given the tar header and tar reader.
-func (a *APK) writeOneFile(header *tar.Header, r io.Reader, allowOverwrite bool) error {
+func (a *APK) writeOneFile(header *tar.Header, r io.Reader, checksum []byte, allowOverwrite bool) error {
 	// check if the file exists; allow override if the origin i
 	if _, err := a.fs.Stat(header.Name); err == nil {
 		if !allowOverwrite {
@@ -54,16 +55,17 @@ func (a *APK) writeOneFile(header *tar.Header, r io.Reader, allowOverwrite bool)
 			return fmt.Errorf("unable to remove existing file %s: %w", header.Name, err)
 		}
 	}
-	f, err := a.fs.OpenFile(header.Name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, header.FileInfo().Mode())
-	if err != nil {
-		return fmt.Errorf("error creating file %s: %w", header.Name, err)
+	if linked, err := a.dedup.link(a.fs, header, checksum); linked || err != nil {
+		return err
 	}
-	defer f.Close()
-
-	if _, err := io.CopyN(f, r, header.Size); err != nil {
-		return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
+	if cloned, err := a.cloneFromCache(header, r, checksum); err != nil {
+		return err
+	} else if !cloned {
+		if err := apkfs.WriteHeader(a.fs, header, r); err != nil {
+			return err
+		}
 	}
-	// override one of the
+	a.dedup.record(a.fs, header, checksum)
 	return nil
 }
 
@@ -116,18 +118,8 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, origin, replace
 					}
 				}
 			}
-			if err := a.fs.MkdirAll(header.Name, header.FileInfo().Mode().Perm()); err != nil {
-				return nil, fmt.Errorf("error creating directory %s: %w", header.Name, err)
-			}
-			// xattrs
-			for k, v := range header.PAXRecords {
-				if !strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
-					continue
-				}
-				attrName := strings.TrimPrefix(k, xattrTarPAXRecordsPrefix)
-				if err := a.fs.SetXattr(header.Name, attrName, []byte(v)); err != nil {
-					return nil, fmt.Errorf("error setting xattr %s on %s: %w", attrName, header.Name, err)
-				}
+			if err := apkfs.WriteHeader(a.fs, header, nil); err != nil {
+				return nil, err
 			}
 
 		case tar.TypeReg:
@@ -167,10 +159,20 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, origin, replace
 				r = f
 			}
 
-			if err := a.writeOneFile(header, r, false); err != nil {
+			if a.inBase(header, checksum) {
+				// the base has it with the same content, so it stays out of the layer but is still recorded
+				if header.PAXRecords == nil {
+					header.PAXRecords = make(map[string]string)
+				}
+				header.PAXRecords[paxRecordsChecksumKey] = FormatQ1Checksum(checksum)
+				files = append(files, *header)
+				continue
+			}
+
+			if err := a.writeOneFile(header, r, checksum, false); err != nil {
 				// if the error is something other than the file exists, return the error
 				var fileExistsError FileExistsError
-				if !errors.As(err, &fileExistsError) || origin == "" {
+				if !errors.As(err, &fileExistsError) {
 					return nil, err
 				}
 				// if the two files are identical, no need to overwrite, but we will keep the first one
@@ -183,15 +185,18 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, origin, replace
 				// compare the origin of the package that we are installing now, to the origin of the package
 				// that provided the file. If the origins are the same, then we can allow the
 				// overwrite. Otherwise, we need to return an error.
-				installed, err := a.GetInstalled()
+				installed, err := a.installedPackages()
 				if err != nil {
 					return nil, fmt.Errorf("unable to get list of installed packages and files: %w", err)
 				}
 				// go through each installed, looking for those that match our origin
 				var found bool
 				for _, pkg := range installed {
-					// if it is not the same origin or isn't a replacement, we are not interested
-					if pkg.Origin != origin && pkg.Name != replaces {
+					// the old version of a package being upgraded, or a package being removed, gives way whatever
+					// its origin; otherwise, if it is not the same origin or isn't a replacement, we are not interested
+					givesWay := a.replacingPackage(pkg.Name) != nil || a.isRemovingPackage(pkg.Name)
+					sameOrigin := origin != "" && pkg.Origin == origin
+					if !givesWay && !sameOrigin && pkg.Name != replaces {
 						continue
 					}
 					// matched the origin (or is a replacement), so look for the file we are installing
@@ -211,7 +216,7 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, origin, replace
 				// it was found in a package with the same origin, so just overwrite
 
 				// if we get here, it had the same origin so even if different, we are allowed to overwrite the file
-				if err := a.writeOneFile(header, r, true); err != nil {
+				if err := a.writeOneFile(header, r, checksum, true); err != nil {
 					return nil, err
 				}
 			}
@@ -223,18 +228,7 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, origin, replace
 				header.PAXRecords = make(map[string]string)
 			}
 			// apk installed db uses this format
-			header.PAXRecords[paxRecordsChecksumKey] = fmt.Sprintf("Q1%s", base64.StdEncoding.EncodeToString(checksum))
-
-			// xattrs
-			for k, v := range header.PAXRecords {
-				if !strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
-					continue
-				}
-				attrName := strings.TrimPrefix(k, xattrTarPAXRecordsPrefix)
-				if err := a.fs.SetXattr(header.Name, attrName, []byte(v)); err != nil {
-					return nil, fmt.Errorf("error setting xattr %s on %s: %w", attrName, header.Name, err)
-				}
-			}
+			header.PAXRecords[paxRecordsChecksumKey] = FormatQ1Checksum(checksum)
 
 		case tar.TypeSymlink:
 			// some underlying filesystems and some memfs that we use in tests do not support symlinks.
@@ -243,11 +237,11 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, origin, replace
 			if target, err := a.fs.Readlink(header.Name); err == nil && target == header.Linkname {
 				continue
 			}
-			if err := a.fs.Symlink(header.Linkname, header.Name); err != nil {
-				return nil, fmt.Errorf("unable to install symlink from %s -> %s: %w", header.Name, header.Linkname, err)
+			if err := apkfs.WriteHeader(a.fs, header, nil); err != nil {
+				return nil, err
 			}
 		case tar.TypeLink:
-			if err := a.fs.Link(header.Linkname, header.Name); err != nil {
+			if err := apkfs.WriteHeader(a.fs, header, nil); err != nil {
 				return nil, err
 			}
 		default:
@@ -315,6 +309,12 @@ func (a *APK) lazilyInstallAPKFiles(ctx context.Context, wh writeHeaderer, tf *t
 		// whatever it is now, it is in the data section
 		startedDataSection = true
 
+		if checksum, err := checksumFromHeader(&header.Header); err == nil && a.inBase(&header.Header, checksum) {
+			// the base has it with the same content, so it stays out of the layer but is still recorded
+			files = append(files, header.Header)
+			continue
+		}
+
 		if err := wh.WriteHeader(header.Header, tf, pkg); err != nil {
 			return nil, err
 		}
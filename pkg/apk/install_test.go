@@ -18,6 +18,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
 	"fmt"
 	"io"
 	"io/fs"
@@ -101,6 +102,41 @@ func TestInstallAPKFiles(t *testing.T) {
 		}
 	})
 
+	t.Run("identical in base", func(t *testing.T) {
+		apk, src, err := testGetTestAPK()
+		require.NoErrorf(t, err, "failed to get test APK")
+		sum := sha1.Sum([]byte("same")) //nolint:gosec // this is what apk tools is using
+		apk.baseFiles = map[string]baseFile{
+			"etc/same":    {checksum: sum[:], mode: 0o644},
+			"etc/changed": {checksum: sum[:], mode: 0o644},
+			"etc/chmod":   {checksum: sum[:], mode: 0o644},
+			"etc/chown":   {checksum: sum[:], mode: 0o644, uid: 1000, gid: 1000},
+		}
+
+		entries := []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/same", 0o644, false, []byte("same"), nil},
+			{"etc/changed", 0o644, false, []byte("changed"), nil},
+			{"etc/chmod", 0o755, false, []byte("same"), nil},
+			{"etc/chown", 0o644, false, []byte("same"), nil},
+		}
+		headers, err := apk.installAPKFiles(context.Background(), testCreateTarForPackage(entries), "", "")
+		require.NoError(t, err)
+		require.Len(t, headers, len(entries), "files identical in the base are still recorded")
+
+		_, err = src.Stat("etc/same")
+		require.ErrorIs(t, err, fs.ErrNotExist, "files identical in the base are not written")
+		b, err := src.ReadFile("etc/changed")
+		require.NoError(t, err)
+		require.Equal(t, "changed", string(b))
+		// as are those of the same content with other permissions or ownership
+		for _, name := range []string{"etc/chmod", "etc/chown"} {
+			b, err = src.ReadFile(name)
+			require.NoError(t, err)
+			require.Equal(t, "same", string(b), name)
+		}
+	})
+
 	t.Run("xattrs", func(t *testing.T) {
 		apk, src, err := testGetTestAPK()
 		require.NoErrorf(t, err, "failed to get test APK")
@@ -17,11 +17,13 @@ package apk
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
@@ -29,8 +31,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/klauspost/compress/gzip"
-
 	"gitlab.alpinelinux.org/alpine/go/repository"
 )
 
@@ -49,8 +49,22 @@ func (a *APK) GetInstalled() ([]*InstalledPackage, error) {
 	return parseInstalled(installedFile)
 }
 
-// addInstalledPackage add a package to the list of installed packages
+// addInstalledPackage add a package to the list of installed packages. During FixateWorld the
+// entry is buffered in the installed database transaction instead of being written straight away.
 func (a *APK) addInstalledPackage(pkg *repository.Package, files []tar.Header) error {
+	entry, err := installedEntry(pkg, files)
+	if err != nil {
+		return err
+	}
+	if a.txn != nil {
+		a.txn.add(pkg, files, entry)
+		return nil
+	}
+	return a.appendInstalled(entry, false)
+}
+
+// appendInstalled appends the raw entries to the installed file, optionally syncing it to disk.
+func (a *APK) appendInstalled(b []byte, fsync bool) error {
 	// be sure to open the file in append mode so we add to the end
 	installedFile, err := a.fs.OpenFile(installedFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
@@ -58,6 +72,19 @@ func (a *APK) addInstalledPackage(pkg *repository.Package, files []tar.Header) e
 	}
 	defer installedFile.Close()
 
+	if _, err := installedFile.Write(b); err != nil {
+		return err
+	}
+	if syncer, ok := installedFile.(interface{ Sync() error }); ok && fsync {
+		if err := syncer.Sync(); err != nil {
+			return fmt.Errorf("could not sync installed file at %s: %w", installedFilePath, err)
+		}
+	}
+	return nil
+}
+
+// installedEntry returns the stanza for the package and its files, as it appears in the installed file.
+func installedEntry(pkg *repository.Package, files []tar.Header) ([]byte, error) {
 	// sort the files by directory
 	sortedFiles := sortTarHeaders(files)
 	// package lines
@@ -83,23 +110,93 @@ func (a *APK) addInstalledPackage(pkg *repository.Package, files []tar.Header) e
 					if !strings.HasPrefix(checksum, "Q1") {
 						hexsum, err := hex.DecodeString(checksum)
 						if err != nil {
-							return err
+							return nil, err
 						}
-						checksum = "Q1" + base64.StdEncoding.EncodeToString(hexsum)
+						checksum = FormatQ1Checksum(hexsum)
 					}
 					pkgLines = append(pkgLines, fmt.Sprintf("Z:%s", checksum))
 				}
 			}
 		}
 	}
-	// write to installed file
-	b := []byte(strings.Join(pkgLines, "\n") + "\n\n")
-	if _, err := installedFile.Write(b); err != nil {
-		return err
+	return []byte(strings.Join(pkgLines, "\n") + "\n\n"), nil
+}
+
+// installedTxn buffers the installed database while FixateWorld installs packages, so that the
+// installed file is read once at the start and written once at the end, rather than for every package.
+type installedTxn struct {
+	// installed holds the packages that were installed before the transaction, followed by those
+	// added during it, for the checks that need to know who owns a file.
+	installed []*InstalledPackage
+	pending   bytes.Buffer
+	// removing holds the names of the installed packages that are to be removed once the transaction
+	// is committed, whose files may be installed over until then.
+	removing map[string]bool
+	// replacing holds the installed packages that are replaced by another version, which are removed
+	// once the files of the new version are installed, over theirs.
+	replacing map[string]*InstalledPackage
+}
+
+func (t *installedTxn) add(pkg *repository.Package, files []tar.Header, entry []byte) {
+	installed := &InstalledPackage{Package: *pkg}
+	for i := range files {
+		installed.Files = append(installed.Files, &files[i])
+	}
+	t.installed = append(t.installed, installed)
+	t.pending.Write(entry)
+}
+
+// beginInstalledTxn starts buffering writes to the installed database.
+func (a *APK) beginInstalledTxn() error {
+	if a.txn != nil {
+		return fmt.Errorf("an installed database transaction is already in progress")
+	}
+	installed, err := a.GetInstalled()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	a.txn = &installedTxn{installed: installed, removing: map[string]bool{}, replacing: map[string]*InstalledPackage{}}
+	return nil
+}
+
+// commitInstalledTxn writes the buffered entries to the installed file in a single append and
+// ends the transaction.
+func (a *APK) commitInstalledTxn() error {
+	txn := a.txn
+	a.txn = nil
+	if txn == nil || txn.pending.Len() == 0 {
+		return nil
+	}
+	if err := a.appendInstalled(txn.pending.Bytes(), a.fsync); err != nil {
+		return fmt.Errorf("unable to update installed file: %w", err)
 	}
 	return nil
 }
 
+// installedPackages returns the installed packages, including those added by the transaction
+// in progress that are not yet in the installed file.
+func (a *APK) installedPackages() ([]*InstalledPackage, error) {
+	if a.txn != nil {
+		return a.txn.installed, nil
+	}
+	return a.GetInstalled()
+}
+
+// isRemovingPackage reports whether the named installed package is to be removed by the transaction in
+// progress, so that its files may be installed over whatever the origin of the package installing them.
+func (a *APK) isRemovingPackage(name string) bool {
+	return a.txn != nil && a.txn.removing[name]
+}
+
+// replacingPackage returns the installed package of the name that the transaction in progress replaces
+// with another version, if any.
+func (a *APK) replacingPackage(name string) *InstalledPackage {
+	if a.txn == nil {
+		return nil
+	}
+	return a.txn.replacing[name]
+}
+
 // isInstalledPackage check if a specific package is installed
 func (a *APK) isInstalledPackage(pkg string) (bool, error) {
 	installedPackages, err := a.GetInstalled()
@@ -116,12 +213,6 @@ func (a *APK) isInstalledPackage(pkg string) (bool, error) {
 
 // updateScriptsTar insert the scripts into the tarball
 func (a *APK) updateScriptsTar(pkg *repository.Package, controlTarGz io.Reader, sourceDateEpoch *time.Time) error {
-	gz, err := gzip.NewReader(controlTarGz)
-	if err != nil {
-		return fmt.Errorf("unable to gunzip control tar.gz file: %w", err)
-	}
-	defer gz.Close()
-	tr := tar.NewReader(gz)
 	fi, err := a.fs.Stat(scriptsFilePath)
 	if err != nil {
 		return fmt.Errorf("unable to stat scripts file: %w", err)
@@ -140,41 +231,7 @@ func (a *APK) updateScriptsTar(pkg *repository.Package, controlTarGz io.Reader,
 	defer scripts.Close()
 	tw := tar.NewWriter(scripts)
 	defer tw.Close()
-	for {
-		header, err := tr.Next()
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
-			return err
-		}
-
-		// ignore .PKGINFO as it is not a script
-		if header.Name == ".PKGINFO" { //nolint:goconst
-			continue
-		}
-
-		origName := header.Name
-		header.Name = fmt.Sprintf("%s-%s.Q1%s%s", pkg.Name, pkg.Version, base64.StdEncoding.EncodeToString(pkg.Checksum), origName)
-
-		// zero out timestamps for reproducibility
-		if sourceDateEpoch != nil {
-			header.ModTime = *sourceDateEpoch
-			// we do not use AccessTime or ChangeTime because these are incompatible with USTar, which is required for apk.
-			// See https://pkg.go.dev/archive/tar#Format for the capabilities of each format.
-			// Setting them to time.Time{} or the epoch will cause them to be ignored.
-			header.AccessTime = time.Time{}
-			header.ChangeTime = time.Time{}
-		}
-
-		if err := tw.WriteHeader(header); err != nil {
-			return fmt.Errorf("unable to write scripts header for %s: %w", header.Name, err)
-		}
-		if _, err := io.CopyN(tw, tr, header.Size); err != nil {
-			return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
-		}
-	}
-	return nil
+	return WriteScripts(tw, pkg, controlTarGz, sourceDateEpoch)
 }
 
 // readScriptsTar returns a reader for the current scripts.tar. It is up to the caller to close it.
@@ -184,14 +241,27 @@ func (a *APK) readScriptsTar() (io.ReadCloser, error) {
 
 // TODO: We should probably parse control section on the first pass and reuse it.
 func (a *APK) controlValue(controlTarGz io.Reader, want string) ([]string, error) {
-	gz, err := gzip.NewReader(controlTarGz)
+	values, err := controlValues(controlTarGz)
+	if err != nil {
+		return nil, err
+	}
+	if values[want] == nil {
+		return []string{}, nil
+	}
+	return values[want], nil
+}
+
+// controlValues returns the values of the .PKGINFO in the control section, by key. Keys such as
+// depend may have several values.
+func controlValues(controlTarGz io.Reader) (map[string][]string, error) {
+	gz, err := getGzipReader(controlTarGz)
 	if err != nil {
 		return nil, fmt.Errorf("unable to gunzip control tar file: %w", err)
 	}
-	defer gz.Close()
+	defer putGzipReader(gz)
 	tr := tar.NewReader(gz)
 
-	values := []string{}
+	values := map[string][]string{}
 	for {
 		header, err := tr.Next()
 		if errors.Is(err, io.EOF) {
@@ -206,23 +276,9 @@ func (a *APK) controlValue(controlTarGz io.Reader, want string) ([]string, error
 			continue
 		}
 
-		b, err := io.ReadAll(tr)
+		values, err = parsePackageInfoValues(tr)
 		if err != nil {
-			return nil, fmt.Errorf("unable to read .PKGINFO from control tar.gz file: %w", err)
-		}
-		lines := strings.Split(string(b), "\n")
-		for _, line := range lines {
-			parts := strings.Split(line, "=")
-			if len(parts) != 2 {
-				continue
-			}
-			key := strings.TrimSpace(parts[0])
-			if key != want {
-				continue
-			}
-
-			value := strings.TrimSpace(parts[1])
-			values = append(values, value)
+			return nil, err
 		}
 
 		break
@@ -244,12 +300,9 @@ func (a *APK) updateTriggers(pkg *repository.Package, controlTarGz io.Reader) er
 		return fmt.Errorf("updating triggers for %s: %w", pkg.Name, err)
 	}
 
-	for _, value := range values {
-		if _, err := triggers.Write([]byte(fmt.Sprintf("%s %s\n", base64.StdEncoding.EncodeToString(pkg.Checksum), value))); err != nil {
-			return fmt.Errorf("unable to write triggers file %s: %w", triggersFilePath, err)
-		}
+	if err := WriteTriggers(triggers, pkg, values...); err != nil {
+		return fmt.Errorf("unable to write triggers file %s: %w", triggersFilePath, err)
 	}
-
 	return nil
 }
 
@@ -309,9 +362,9 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 		case "U":
 			pkg.URL = val
 		case "D":
-			pkg.Dependencies = strings.Split(val, " ")
+			pkg.Dependencies = strings.Fields(val)
 		case "p":
-			pkg.Provides = strings.Split(val, " ")
+			pkg.Provides = strings.Fields(val)
 		case "c":
 			pkg.RepoCommit = val
 		case "t":
@@ -321,7 +374,7 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 			}
 			pkg.BuildTime = time.Unix(i, 0).UTC()
 		case "i":
-			pkg.InstallIf = strings.Split(val, " ")
+			pkg.InstallIf = strings.Fields(val)
 		case "S":
 			size, err := strconv.ParseUint(val, 10, 64)
 			if err != nil {
@@ -351,10 +404,11 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 			}
 		case "F":
 			lastDir = &tar.Header{
-				Name: val,
-				Mode: 0o755,
-				Uid:  0,
-				Gid:  0,
+				Name:     val,
+				Typeflag: tar.TypeDir,
+				Mode:     0o755,
+				Uid:      0,
+				Gid:      0,
 			}
 			pkg.Files = append(pkg.Files, lastDir)
 			lastFile = nil
@@ -376,10 +430,11 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 				fullpath, _ = sanitizeArchivePath(lastDir.Name, val)
 			}
 			lastFile = &tar.Header{
-				Name: fullpath,
-				Mode: 0o644,
-				Uid:  0,
-				Gid:  0,
+				Name:     fullpath,
+				Typeflag: tar.TypeReg,
+				Mode:     0o644,
+				Uid:      0,
+				Gid:      0,
 			}
 			pkg.Files = append(pkg.Files, lastFile)
 		case "a":
@@ -394,6 +449,12 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 			lastFile.Uid = uid
 			lastFile.Gid = gid
 			lastFile.Mode = perms
+		case "Z":
+			// file checksum, kept where installAPKFiles records it
+			if lastFile == nil {
+				return nil, fmt.Errorf("cannot parse line %d: no file specified when setting checksum", linenr)
+			}
+			lastFile.PAXRecords = map[string]string{paxRecordsChecksumKey: val}
 		}
 
 		linenr++
@@ -425,7 +486,7 @@ func parseInstalledPerms(permString string) (uid, gid int, perms int64, err erro
 // sortTarHeaders sorts tar headers by name. It ensures that all file children of a directory are listed
 // immediately after the directory itself. This is to support lib/apk/db/installed, which lists full paths
 // for directories, but only the basename for the files, so the last directory entry before a file must be the parent
-// in which it sits.
+// in which it sits. The names of directories lose the trailing slash that they have in packages.
 func sortTarHeaders(headers []tar.Header) []tar.Header {
 	// to hold our results
 	var (
@@ -436,6 +497,8 @@ func sortTarHeaders(headers []tar.Header) []tar.Header {
 	)
 
 	for _, header := range headers {
+		// directories are "usr/" in packages, but their children are looked up by filepath.Dir, which gives "usr"
+		header.Name = strings.TrimSuffix(header.Name, "/")
 		dir := filepath.Dir(header.Name)
 		listing[dir] = append(listing[dir], header.Name)
 		all[header.Name] = header
@@ -516,3 +579,219 @@ func sortTarHeaders(headers []tar.Header) []tar.Header {
 	*/
 	return sorted
 }
+
+// removeInstalledPackage removes a package from the system: its files, its entry in the installed
+// file, and its scripts, pending scripts and triggers. Files and directories that are also listed
+// by another installed package are left in place, as are directories that are not empty.
+func (a *APK) removeInstalledPackage(pkg *InstalledPackage) error {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	owned := map[string]bool{}
+	for _, other := range installed {
+		if other.Name == pkg.Name {
+			continue
+		}
+		for _, f := range other.Files {
+			owned[strings.TrimSuffix(f.Name, "/")] = true
+		}
+	}
+	if err := a.removePackageFiles(pkg, owned); err != nil {
+		return err
+	}
+	return a.removeInstalledEntry(pkg)
+}
+
+// replaceInstalledPackage removes the installed version of a package once the files of its new version
+// have been installed, over those of the old one: the files of the old version that are not among
+// the new ones, nor listed by another installed package, and its scripts, pending scripts, triggers
+// and entry in the installed file. The new version is recorded after, so that a failure to install
+// it leaves the old one in place.
+func (a *APK) replaceInstalledPackage(old *InstalledPackage, files []tar.Header) error {
+	installed, err := a.installedPackages()
+	if err != nil {
+		return fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	owned := map[string]bool{}
+	for i := range files {
+		owned[strings.TrimSuffix(files[i].Name, "/")] = true
+	}
+	for _, other := range installed {
+		if other.Name == old.Name {
+			continue
+		}
+		for _, f := range other.Files {
+			owned[strings.TrimSuffix(f.Name, "/")] = true
+		}
+	}
+	if err := a.removePackageFiles(old, owned); err != nil {
+		return err
+	}
+	if err := a.removeInstalledEntry(old); err != nil {
+		return err
+	}
+	if a.txn != nil {
+		kept := make([]*InstalledPackage, 0, len(a.txn.installed))
+		for _, pkg := range a.txn.installed {
+			if pkg.Name != old.Name {
+				kept = append(kept, pkg)
+			}
+		}
+		a.txn.installed = kept
+		delete(a.txn.replacing, old.Name)
+	}
+	return nil
+}
+
+// removePackageFiles removes the files and empty directories of the package that are not owned.
+func (a *APK) removePackageFiles(pkg *InstalledPackage, owned map[string]bool) error {
+	var dirs []string
+	for _, f := range pkg.Files {
+		if owned[strings.TrimSuffix(f.Name, "/")] {
+			continue
+		}
+		fi, err := a.fs.Lstat(f.Name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("unable to stat %s: %w", f.Name, err)
+		}
+		if fi.IsDir() {
+			dirs = append(dirs, f.Name)
+			continue
+		}
+		if err := a.fs.Remove(f.Name); err != nil {
+			return fmt.Errorf("unable to remove %s: %w", f.Name, err)
+		}
+	}
+	// remove the deepest directories first, so that parents can be emptied by their children
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], "/") > strings.Count(dirs[j], "/")
+	})
+	for _, dir := range dirs {
+		entries, err := a.fs.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("unable to read directory %s: %w", dir, err)
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		if err := a.fs.Remove(dir); err != nil {
+			return fmt.Errorf("unable to remove directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// removeInstalledEntry removes the scripts, pending scripts, triggers and installed entry of the package.
+func (a *APK) removeInstalledEntry(pkg *InstalledPackage) error {
+	if err := a.removeScripts(&pkg.Package); err != nil {
+		return fmt.Errorf("unable to update scripts.tar for pkg %s: %w", pkg.Name, err)
+	}
+	if err := a.removeTriggers(&pkg.Package); err != nil {
+		return fmt.Errorf("unable to update triggers for pkg %s: %w", pkg.Name, err)
+	}
+	if err := a.removePendingScripts(pkg.Name); err != nil {
+		return fmt.Errorf("unable to update pending scripts for pkg %s: %w", pkg.Name, err)
+	}
+	if err := a.removeFromInstalled(pkg.Name); err != nil {
+		return fmt.Errorf("unable to update installed file for pkg %s: %w", pkg.Name, err)
+	}
+	return nil
+}
+
+// removeFromInstalled removes the entry for the named package from the installed file.
+// The other entries are copied as is, so nothing that parseInstalled does not understand is lost.
+func (a *APK) removeFromInstalled(name string) error {
+	b, err := a.fs.ReadFile(installedFilePath)
+	if err != nil {
+		return fmt.Errorf("could not read installed file at %s: %w", installedFilePath, err)
+	}
+	var kept []string
+	for _, stanza := range strings.Split(string(b), "\n\n") {
+		stanza = strings.Trim(stanza, "\n")
+		if stanza == "" {
+			continue
+		}
+		isPkg := false
+		for _, line := range strings.Split(stanza, "\n") {
+			if line == "P:"+name {
+				isPkg = true
+				break
+			}
+		}
+		if !isPkg {
+			kept = append(kept, stanza+"\n\n")
+		}
+	}
+	// #nosec G306 -- apk installed file must be publicly readable
+	if err := a.fs.WriteFile(installedFilePath, []byte(strings.Join(kept, "")), 0o644); err != nil {
+		return fmt.Errorf("could not write installed file at %s: %w", installedFilePath, err)
+	}
+	return nil
+}
+
+// removeScripts removes the scripts for a package from the scripts tarball
+func (a *APK) removeScripts(pkg *repository.Package) error {
+	r, err := a.readScriptsTar()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("unable to open scripts file %s: %w", scriptsFilePath, err)
+	}
+	defer r.Close()
+
+	prefix := ScriptsTarName(pkg, "")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(header.Name, prefix) {
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("unable to write scripts header for %s: %w", header.Name, err)
+		}
+		if _, err := io.CopyN(tw, tr, header.Size); err != nil {
+			return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return a.fs.WriteFile(scriptsFilePath, buf.Bytes(), scriptsTarPerms)
+}
+
+// removeTriggers removes the triggers for a package from the triggers file
+func (a *APK) removeTriggers(pkg *repository.Package) error {
+	if len(pkg.Checksum) == 0 {
+		// triggers are keyed by checksum, so a package without one cannot have any
+		return nil
+	}
+	b, err := a.fs.ReadFile(triggersFilePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("unable to read triggers file %s: %w", triggersFilePath, err)
+	}
+	prefix := base64.StdEncoding.EncodeToString(pkg.Checksum) + " "
+	var kept []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" || strings.HasPrefix(line, prefix) {
+			continue
+		}
+		kept = append(kept, line+"\n")
+	}
+	return a.fs.WriteFile(triggersFilePath, []byte(strings.Join(kept, "")), 0o644)
+}
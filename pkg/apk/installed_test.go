@@ -105,6 +105,38 @@ func TestAddInstalledPackage(t *testing.T) {
 	require.Contains(t, str, want)
 }
 
+func TestInstalledTxn(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
+	before, err := a.fs.ReadFile(installedFilePath)
+	require.NoError(t, err)
+
+	require.NoError(t, a.beginInstalledTxn())
+	require.Error(t, a.beginInstalledTxn(), "transactions cannot be nested")
+	for _, name := range []string{"first", "second"} {
+		pkg := &repository.Package{Name: name, Version: "1.0.0", Arch: "x86_64"}
+		files := []tar.Header{{Name: "usr/share/" + name, Typeflag: tar.TypeReg, Mode: 0o644}}
+		require.NoError(t, a.addInstalledPackage(pkg, files))
+	}
+
+	// nothing is written until the transaction is committed, but the new packages are visible
+	during, err := a.fs.ReadFile(installedFilePath)
+	require.NoError(t, err)
+	require.Equal(t, before, during)
+	pkgs, err := a.installedPackages()
+	require.NoError(t, err)
+	require.Len(t, pkgs, len(testInstalledPackages)+2)
+	require.Equal(t, "usr/share/second", pkgs[len(pkgs)-1].Files[0].Name)
+
+	require.NoError(t, a.commitInstalledTxn())
+	require.Nil(t, a.txn)
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, len(testInstalledPackages)+2)
+	require.Equal(t, "first", installed[len(installed)-2].Name)
+	require.Equal(t, "second", installed[len(installed)-1].Name)
+}
+
 func TestIsInstalledPackage(t *testing.T) {
 	a, _, err := testGetTestAPK()
 	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
@@ -309,3 +341,19 @@ func TestSortTarHeaders(t *testing.T) {
 		assert.Equal(t, expected[i], header.Name, "position %d: expected %s, got %s", i, expected[i], header.Name)
 	}
 }
+
+func TestSortTarHeadersTrailingSlash(t *testing.T) {
+	// packages name their directories with a trailing slash
+	headers := []tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir},
+		{Name: "usr/bin/hello", Typeflag: tar.TypeReg},
+		{Name: "etc/", Typeflag: tar.TypeDir},
+		{Name: "etc/hello.conf", Typeflag: tar.TypeReg},
+	}
+	var names []string
+	for _, header := range sortTarHeaders(headers) {
+		names = append(names, header.Name)
+	}
+	require.Equal(t, []string{"etc", "etc/hello.conf", "usr", "usr/bin", "usr/bin/hello"}, names)
+}
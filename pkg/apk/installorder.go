@@ -0,0 +1,230 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+)
+
+// DependencyCycle is a set of packages that depend on each other, directly or not, so that they
+// cannot all be installed after their dependencies.
+type DependencyCycle struct {
+	// Packages are the names of the packages of the cycle, in the order they are installed in,
+	// which is the order the resolver found them in.
+	Packages []string `json:"packages"`
+	// Broken are the dependencies, as "package -> dependency", that are installed after the
+	// package that needs them because of that order.
+	Broken []string `json:"broken"`
+}
+
+func (c DependencyCycle) String() string {
+	return fmt.Sprintf("dependency cycle between %s, installed in that order, with the dependencies %s installed after what needs them", strings.Join(c.Packages, ", "), strings.Join(c.Broken, ", "))
+}
+
+// InstallOrder sorts resolved packages, such as those from GetPackagesWithDependencies, so that each
+// is after the packages it depends on, and returns the cycles that make that impossible for some. The
+// packages of a cycle are installed together once all they depend on outside of the cycle is, in the
+// order they are given in, and otherwise the order given is kept as much as possible. Dependencies on
+// packages that are not given are ignored.
+func (p *PkgResolver) InstallOrder(pkgs []*repository.RepositoryPackage) ([]*repository.RepositoryPackage, []DependencyCycle) {
+	deps := p.dependencyGraph(pkgs)
+
+	components := stronglyConnected(deps)
+	// the component of each package, and what each component depends on
+	componentOf := make([]int, len(pkgs))
+	for c, members := range components {
+		sort.Ints(members)
+		for _, i := range members {
+			componentOf[i] = c
+		}
+	}
+	waiting := make([]int, len(components))
+	dependents := make([][]int, len(components))
+	for i := range pkgs {
+		for _, j := range deps[i] {
+			if ci, cj := componentOf[i], componentOf[j]; ci != cj {
+				waiting[ci]++
+				dependents[cj] = append(dependents[cj], ci)
+			}
+		}
+	}
+
+	// of the components all of whose dependencies are installed, install the one with the first package
+	var (
+		ready   []int
+		ordered = make([]*repository.RepositoryPackage, 0, len(pkgs))
+		cycles  []DependencyCycle
+	)
+	for c := range components {
+		if waiting[c] == 0 {
+			ready = append(ready, c)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Slice(ready, func(a, b int) bool { return components[ready[a]][0] < components[ready[b]][0] })
+		c := ready[0]
+		ready = ready[1:]
+		members := components[c]
+		for _, i := range members {
+			ordered = append(ordered, pkgs[i])
+		}
+		if len(members) > 1 {
+			cycles = append(cycles, p.describeCycle(pkgs, members, deps))
+		}
+		for _, d := range dependents[c] {
+			waiting[d]--
+			if waiting[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	return ordered, cycles
+}
+
+// dependencyGraph returns the packages each of the packages depends on, by their index in pkgs. A
+// dependency is on the first of the packages that satisfy it, as the resolver would have it, and
+// dependencies on packages that are not given are ignored.
+func (p *PkgResolver) dependencyGraph(pkgs []*repository.RepositoryPackage) [][]int {
+	// the packages given that can satisfy each name
+	byName := map[string][]int{}
+	for i, pkg := range pkgs {
+		byName[pkg.Name] = append(byName[pkg.Name], i)
+		for name := range p.providedNames(pkg) {
+			byName[name] = append(byName[name], i)
+		}
+	}
+	deps := make([][]int, len(pkgs))
+	for i, pkg := range pkgs {
+		seen := map[int]bool{i: true}
+		for _, dep := range pkg.Dependencies {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+			name := p.resolvePackageNameVersionPin(dep).name
+			// a package is satisfied by itself, or, of several, by the first, as the resolver would have it
+			providers := byName[name]
+			if len(providers) == 0 || seen[providers[0]] {
+				continue
+			}
+			for _, j := range providers {
+				if j == i {
+					providers = nil
+					break
+				}
+			}
+			if len(providers) == 0 {
+				continue
+			}
+			seen[providers[0]] = true
+			deps[i] = append(deps[i], providers[0])
+		}
+	}
+	return deps
+}
+
+func (p *PkgResolver) describeCycle(pkgs []*repository.RepositoryPackage, members []int, deps [][]int) DependencyCycle {
+	var cycle DependencyCycle
+	position := map[int]int{}
+	for n, i := range members {
+		position[i] = n
+		cycle.Packages = append(cycle.Packages, pkgs[i].Name)
+	}
+	for _, i := range members {
+		for _, j := range deps[i] {
+			if n, ok := position[j]; ok && n > position[i] {
+				cycle.Broken = append(cycle.Broken, fmt.Sprintf("%s -> %s", pkgs[i].Name, pkgs[j].Name))
+			}
+		}
+	}
+	return cycle
+}
+
+// stronglyConnected returns the strongly connected components of the graph, with Tarjan's algorithm.
+func stronglyConnected(edges [][]int) [][]int {
+	var (
+		index      = 0
+		indexes    = make([]int, len(edges))
+		lowlinks   = make([]int, len(edges))
+		onStack    = make([]bool, len(edges))
+		stack      []int
+		components [][]int
+		visit      func(v int)
+	)
+	for i := range indexes {
+		indexes[i] = -1
+	}
+	visit = func(v int) {
+		indexes[v], lowlinks[v] = index, index
+		index++
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range edges[v] {
+			switch {
+			case indexes[w] < 0:
+				visit(w)
+				if lowlinks[w] < lowlinks[v] {
+					lowlinks[v] = lowlinks[w]
+				}
+			case onStack[w] && indexes[w] < lowlinks[v]:
+				lowlinks[v] = indexes[w]
+			}
+		}
+		if lowlinks[v] != indexes[v] {
+			return
+		}
+		var component []int
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			component = append(component, w)
+			if w == v {
+				break
+			}
+		}
+		components = append(components, component)
+	}
+	for v := range edges {
+		if indexes[v] < 0 {
+			visit(v)
+		}
+	}
+	return components
+}
+
+// InstallOrder returns the packages the world resolves to in the order they are installed in, and
+// the dependency cycles between them; see PkgResolver.InstallOrder.
+func (a *APK) InstallOrder(ctx context.Context) ([]*repository.RepositoryPackage, []DependencyCycle, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallOrder")
+	defer span.End()
+
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	pkgs, _, err := a.resolveWorld(ctx, indexes)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the packages are in order already; sorting them again finds the cycles
+	_, cycles := NewPkgResolver(ctx, indexes).InstallOrder(pkgs)
+	return pkgs, cycles, nil
+}
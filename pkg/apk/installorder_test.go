@@ -0,0 +1,69 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestInstallOrder(t *testing.T) {
+	pkg := func(name string, provides []string, deps ...string) *repository.RepositoryPackage {
+		return repository.NewRepositoryPackage(&repository.Package{Name: name, Version: "1.0-r0", Provides: provides, Dependencies: deps}, nil)
+	}
+	names := func(pkgs []*repository.RepositoryPackage) []string {
+		var out []string
+		for _, p := range pkgs {
+			out = append(out, p.Name)
+		}
+		return out
+	}
+	resolver := NewPkgResolver(context.Background(), nil)
+
+	t.Run("dependencies first", func(t *testing.T) {
+		pkgs := []*repository.RepositoryPackage{
+			pkg("app", nil, "lib>=1.0", "so:libc.so.1", "!oldapp"),
+			pkg("lib", nil, "so:libc.so.1"),
+			pkg("libc", []string{"so:libc.so.1=1"}),
+			pkg("unrelated", nil),
+		}
+		ordered, cycles := resolver.InstallOrder(pkgs)
+		require.Equal(t, []string{"libc", "lib", "app", "unrelated"}, names(ordered))
+		require.Empty(t, cycles)
+
+		// an order that already works is kept
+		again, _ := resolver.InstallOrder(ordered)
+		require.Equal(t, names(ordered), names(again))
+	})
+	t.Run("cycle", func(t *testing.T) {
+		pkgs := []*repository.RepositoryPackage{
+			pkg("app", nil, "a"),
+			pkg("a", nil, "b", "libc"),
+			pkg("b", nil, "c", "a"),
+			pkg("c", nil, "a"),
+			pkg("libc", nil, "libc"),
+		}
+		ordered, cycles := resolver.InstallOrder(pkgs)
+		require.Equal(t, []string{"libc", "a", "b", "c", "app"}, names(ordered))
+		require.Equal(t, []DependencyCycle{{
+			Packages: []string{"a", "b", "c"},
+			Broken:   []string{"a -> b", "b -> c"},
+		}}, cycles)
+		require.Equal(t, "dependency cycle between a, b, c, installed in that order, with the dependencies a -> b, b -> c installed after what needs them", cycles[0].String())
+	})
+}
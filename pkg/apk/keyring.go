@@ -0,0 +1,236 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// keyringStateFile is where, in the cache, the keys seen so far are recorded, to detect changes between runs.
+const keyringStateFile = "keyring-state.json"
+
+// KeyEventKind is the kind of change to the keys a repository is trusted with.
+type KeyEventKind int
+
+const (
+	// KeyAdded is a trusted key that was not there before.
+	KeyAdded KeyEventKind = iota
+	// KeyChanged is a trusted key whose contents changed under the same name.
+	KeyChanged
+	// KeyRotated is an index signed by another key than the last time it was read.
+	KeyRotated
+)
+
+func (k KeyEventKind) String() string {
+	switch k {
+	case KeyAdded:
+		return "key added"
+	case KeyChanged:
+		return "key changed"
+	case KeyRotated:
+		return "signing key rotated"
+	default:
+		return fmt.Sprintf("KeyEventKind(%d)", int(k))
+	}
+}
+
+// KeyEvent is a change to the keys that the repositories are trusted with, since they were last read.
+type KeyEvent struct {
+	Kind KeyEventKind `json:"kind"`
+	// Key is the name of the key.
+	Key string `json:"key"`
+	// Index is the URL of the index, for KeyRotated.
+	Index string `json:"index,omitempty"`
+	// Previous is the name of the key that signed the index before, for KeyRotated.
+	Previous string `json:"previous,omitempty"`
+}
+
+func (e KeyEvent) String() string {
+	if e.Kind == KeyRotated {
+		return fmt.Sprintf("%s: %s signed by %s, previously by %s", e.Kind, e.Index, e.Key, e.Previous)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Key)
+}
+
+// KeyChangeError is returned, with WithRejectKeyChanges, when the keys have changed since they were last seen.
+type KeyChangeError struct {
+	Events []KeyEvent
+}
+
+func (e *KeyChangeError) Error() string {
+	msgs := make([]string, len(e.Events))
+	for i, event := range e.Events {
+		msgs[i] = event.String()
+	}
+	return "keys have changed: " + strings.Join(msgs, "; ")
+}
+
+// UntrustedKeyError is returned for an index signed by a key, or with a signature, that none of the
+// trusted keys verify.
+type UntrustedKeyError struct {
+	Index string
+	Key   string
+}
+
+func (e *UntrustedKeyError) Error() string {
+	return fmt.Sprintf("no key found to verify signature of %s for keyfile %s; tried all other keys as well", e.Index, e.Key)
+}
+
+// keyringState is what was last seen of the keys.
+type keyringState struct {
+	// Keys are the sha256 checksums of the trusted keys, by name.
+	Keys map[string]string `json:"keys"`
+	// Signers are the names of the keys that last signed each index, by URL.
+	Signers map[string]string `json:"signers"`
+}
+
+// TrustedKeys returns the keys that the signatures of indexes are verified with, by name: those in
+// the keys directory of the root and the keyring directories, and those at the keyring URLs, which
+// are fetched through the cache if there is one.
+func (a *APK) TrustedKeys(ctx context.Context) (map[string][]byte, error) {
+	httpClient := a.getClient()
+	if a.cache != nil {
+		httpClient = a.cacheClient(httpClient, true)
+	}
+	return a.loadKeys(ctx, httpClient)
+}
+
+// checkKeyring compares the trusted keys, and the keys the indexes were signed with, to those seen the
+// last time, reporting any change. The first time, with nothing to compare to, they are only recorded.
+// What was seen is kept in the cache, if there is one, so that changes are noticed from one run to the next.
+func (a *APK) checkKeyring(indexes []NamedIndex, keys map[string][]byte) error {
+	a.keyringMu.Lock()
+	defer a.keyringMu.Unlock()
+
+	last := a.keyring
+	if last == nil {
+		last = a.readKeyringState()
+	}
+	next := &keyringState{Keys: map[string]string{}, Signers: map[string]string{}}
+	if last != nil {
+		for index, signer := range last.Signers {
+			next.Signers[index] = signer
+		}
+	}
+
+	var events []KeyEvent
+	for _, name := range sortedKeys(keys) {
+		sum := sha256.Sum256(keys[name])
+		next.Keys[name] = hex.EncodeToString(sum[:])
+		if last == nil {
+			continue
+		}
+		if prev, ok := last.Keys[name]; !ok {
+			events = append(events, KeyEvent{Kind: KeyAdded, Key: name})
+		} else if prev != next.Keys[name] {
+			events = append(events, KeyEvent{Kind: KeyChanged, Key: name})
+		}
+	}
+	for _, index := range indexes {
+		signer := indexSigner(index)
+		if signer == "" {
+			continue
+		}
+		if prev, ok := next.Signers[index.Source()]; ok && prev != signer {
+			events = append(events, KeyEvent{Kind: KeyRotated, Key: signer, Index: index.Source(), Previous: prev})
+		}
+		next.Signers[index.Source()] = signer
+	}
+
+	for _, event := range events {
+		a.logger.Warnf("%s", event)
+		if a.keyEventHandler != nil {
+			a.keyEventHandler(event)
+		}
+	}
+	if len(events) > 0 && a.rejectKeyChanges {
+		// nothing is recorded, so that the changes are rejected until they are accepted
+		return &KeyChangeError{Events: events}
+	}
+	a.keyring = next
+	a.writeKeyringState(next)
+	return nil
+}
+
+func indexSigner(index NamedIndex) string {
+	if s, ok := index.(interface{ Signer() string }); ok {
+		return s.Signer()
+	}
+	return ""
+}
+
+func (a *APK) readKeyringState() *keyringState {
+	if a.cache == nil {
+		return nil
+	}
+	b, err := os.ReadFile(filepath.Join(a.cache.dir, keyringStateFile))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			a.logger.Warnf("unable to read keyring state, key changes are not reported: %v", err)
+		}
+		return nil
+	}
+	var state keyringState
+	if err := json.Unmarshal(b, &state); err != nil {
+		a.logger.Warnf("unable to parse keyring state, key changes are not reported: %v", err)
+		return nil
+	}
+	if state.Keys == nil {
+		state.Keys = map[string]string{}
+	}
+	return &state
+}
+
+// writeKeyringState records what was seen in the cache. It is not fatal if it cannot, e.g. in a
+// read-only offline cache; changes are still reported for as long as the APK is used.
+func (a *APK) writeKeyringState(state *keyringState) {
+	if a.cache == nil {
+		return
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		a.logger.Debugf("unable to encode keyring state: %v", err)
+		return
+	}
+	if err := os.MkdirAll(a.cache.dir, 0o755); err != nil {
+		a.logger.Debugf("unable to write keyring state: %v", err)
+		return
+	}
+	tmp, err := os.CreateTemp(a.cache.dir, keyringStateFile+".*.tmp")
+	if err != nil {
+		a.logger.Debugf("unable to write keyring state: %v", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(a.cache.dir, keyringStateFile))
+	}
+	if err != nil {
+		a.logger.Debugf("unable to write keyring state: %v", err)
+	}
+}
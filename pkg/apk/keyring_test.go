@@ -0,0 +1,71 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestCheckKeyring(t *testing.T) {
+	cacheDir := t.TempDir()
+	index := func(signer string) []NamedIndex {
+		repo := repository.Repository{Uri: "https://example.com/main/aarch64"}
+		return []NamedIndex{&namedRepositoryWithIndex{repo: repo.WithIndex(&repository.ApkIndex{}), signer: signer}}
+	}
+	newAPK := func(options ...Option) (*APK, *[]KeyEvent) {
+		var events []KeyEvent
+		options = append(options,
+			WithFS(apkfs.NewMemFS()),
+			WithCache(cacheDir, false),
+			WithKeyEventHandler(func(e KeyEvent) { events = append(events, e) }))
+		a, err := New(options...)
+		require.NoError(t, err)
+		return a, &events
+	}
+
+	// the first time, everything is only recorded
+	a, events := newAPK()
+	require.NoError(t, a.checkKeyring(index("one.rsa.pub"), map[string][]byte{"one.rsa.pub": []byte("one")}))
+	require.Empty(t, *events)
+
+	// a later run notices what changed since, from the cache
+	keys := map[string][]byte{"one.rsa.pub": []byte("one, rotated"), "two.rsa.pub": []byte("two")}
+	a, events = newAPK()
+	require.NoError(t, a.checkKeyring(index("two.rsa.pub"), keys))
+	require.Equal(t, []KeyEvent{
+		{Kind: KeyChanged, Key: "one.rsa.pub"},
+		{Kind: KeyAdded, Key: "two.rsa.pub"},
+		{Kind: KeyRotated, Key: "two.rsa.pub", Index: "https://example.com/main/aarch64/APKINDEX.tar.gz", Previous: "one.rsa.pub"},
+	}, *events)
+
+	// having been accepted, the changes are not reported again
+	a, events = newAPK(WithRejectKeyChanges(true))
+	require.NoError(t, a.checkKeyring(index("two.rsa.pub"), keys))
+	require.Empty(t, *events)
+
+	// rejected changes are reported every time
+	for i := 0; i < 2; i++ {
+		err := a.checkKeyring(index("one.rsa.pub"), keys)
+		var changeErr *KeyChangeError
+		require.ErrorAs(t, err, &changeErr)
+		require.Len(t, changeErr.Events, 1)
+		require.Equal(t, KeyRotated, changeErr.Events[0].Kind)
+	}
+}
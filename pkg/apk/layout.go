@@ -0,0 +1,60 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RepositoryLayout describes where a repository host keeps the index and packages
+// for a given architecture, relative to the repository URL from /etc/apk/repositories.
+type RepositoryLayout interface {
+	// IndexURL returns the URL of the APKINDEX.tar.gz for the repository and architecture.
+	IndexURL(repo, arch string) string
+	// PackagesURL returns the URL of the directory holding the packages for the repository and
+	// architecture. The URL of each package is this followed by "/" and the package file name.
+	PackagesURL(repo, arch string) string
+}
+
+// AlpineLayout is the layout used by the official Alpine repositories, and is the default,
+// with a subdirectory per architecture holding both the index and the packages:
+//
+//	<repo>/<arch>/APKINDEX.tar.gz
+//	<repo>/<arch>/<name>-<version>.apk
+type AlpineLayout struct{}
+
+func (AlpineLayout) IndexURL(repo, arch string) string {
+	return fmt.Sprintf("%s/%s", AlpineLayout{}.PackagesURL(repo, arch), indexFilename)
+}
+
+func (AlpineLayout) PackagesURL(repo, arch string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(repo, "/"), arch)
+}
+
+// FlatLayout is for hosts that serve a single architecture with the index and the packages
+// directly under the repository URL:
+//
+//	<repo>/APKINDEX.tar.gz
+//	<repo>/<name>-<version>.apk
+type FlatLayout struct{}
+
+func (FlatLayout) IndexURL(repo, _ string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(repo, "/"), indexFilename)
+}
+
+func (FlatLayout) PackagesURL(repo, _ string) string {
+	return strings.TrimSuffix(repo, "/")
+}
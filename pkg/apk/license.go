@@ -0,0 +1,55 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// LicensePolicy is called for each package in the resolved set with the value of its license field.
+// Returning an error rejects the package, which causes resolution to fail before anything is downloaded.
+type LicensePolicy func(pkg *repository.RepositoryPackage, license string) error
+
+// AggregateLicenses returns a map of each license string found across the packages to the
+// sorted names of the packages that declare it.
+func AggregateLicenses(pkgs []*repository.RepositoryPackage) map[string][]string {
+	licenses := map[string][]string{}
+	for _, pkg := range pkgs {
+		licenses[pkg.License] = append(licenses[pkg.License], pkg.Name)
+	}
+	for _, names := range licenses {
+		sort.Strings(names)
+	}
+	return licenses
+}
+
+// checkLicenses runs the configured license policy, if any, against every package, returning
+// all of the rejections together.
+func (a *APK) checkLicenses(pkgs []*repository.RepositoryPackage) error {
+	if a.licensePolicy == nil {
+		return nil
+	}
+	var errs []error
+	for _, pkg := range pkgs {
+		if err := a.licensePolicy(pkg, pkg.License); err != nil {
+			errs = append(errs, fmt.Errorf("license %q of package %s rejected: %w", pkg.License, pkg.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
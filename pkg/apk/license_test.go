@@ -0,0 +1,62 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestLicenses(t *testing.T) {
+	pkgs := []*repository.RepositoryPackage{
+		{Package: &repository.Package{Name: "musl", License: "MIT"}},
+		{Package: &repository.Package{Name: "busybox", License: "GPL-2.0-only"}},
+		{Package: &repository.Package{Name: "ca-certificates", License: "MPL-2.0 AND MIT"}},
+		{Package: &repository.Package{Name: "libc-utils", License: "MIT"}},
+		{Package: &repository.Package{Name: "ghostscript", License: "AGPL-3.0-or-later"}},
+	}
+
+	t.Run("aggregate", func(t *testing.T) {
+		licenses := AggregateLicenses(pkgs)
+		require.Equal(t, map[string][]string{
+			"MIT":               {"libc-utils", "musl"},
+			"GPL-2.0-only":      {"busybox"},
+			"MPL-2.0 AND MIT":   {"ca-certificates"},
+			"AGPL-3.0-or-later": {"ghostscript"},
+		}, licenses)
+	})
+	t.Run("no policy", func(t *testing.T) {
+		a, err := New()
+		require.NoError(t, err)
+		require.NoError(t, a.checkLicenses(pkgs))
+	})
+	t.Run("policy rejects", func(t *testing.T) {
+		errForbidden := errors.New("forbidden")
+		a, err := New(WithLicensePolicy(func(pkg *repository.RepositoryPackage, license string) error {
+			if license == "AGPL-3.0-or-later" {
+				return errForbidden
+			}
+			return nil
+		}))
+		require.NoError(t, err)
+		err = a.checkLicenses(pkgs)
+		require.ErrorIs(t, err, errForbidden)
+		require.ErrorContains(t, err, "ghostscript")
+		require.NotContains(t, err.Error(), "busybox")
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// loadedFiles are the files that make up the state of an apk database, and whether they must exist.
+var loadedFiles = []struct {
+	path     string
+	required bool
+}{
+	{installedFilePath, true},
+	{worldFilePath, false},
+	{reposFilePath, false},
+	{archFilePath, false},
+	{scriptsFilePath, false},
+	{triggersFilePath, false},
+	{pendingScriptsFilePath, false},
+}
+
+// LoadInstalled takes over the apk database of an existing root filesystem, such as a prebuilt base
+// image: its installed packages, world, repositories, scripts, triggers and keys are copied into the
+// filesystem of the APK, replacing any that are there. A following FixateWorld or UpgradeWorld then only
+// installs what the base does not already have, so the filesystem of the APK can be used as a layer on
+// top of the base.
+//
+// The files of the installed packages are not copied. Newly installed files that the base already has
+// with the same content, permissions and ownership, according to its installed database, are recorded
+// but not written, so that the layer only holds what is new or changed. Conflicts between other files of the
+// base and newly installed files are not detected. It is an error if the base is for another architecture.
+func (a *APK) LoadInstalled(base fs.FS) error {
+	if b, err := fs.ReadFile(base, archFilePath); err == nil {
+		if arch := strings.TrimSpace(string(b)); arch != a.arch {
+			return fmt.Errorf("base is for architecture %s, not %s", arch, a.arch)
+		}
+	}
+	installed, err := fs.ReadFile(base, installedFilePath)
+	if err != nil {
+		return fmt.Errorf("reading installed database of base: %w", err)
+	}
+	pkgs, err := parseInstalled(bytes.NewReader(installed))
+	if err != nil {
+		return fmt.Errorf("parsing installed database of base: %w", err)
+	}
+
+	for _, f := range loadedFiles {
+		b, err := fs.ReadFile(base, f.path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && !f.required:
+			continue
+		case err != nil:
+			return fmt.Errorf("reading %s of base: %w", f.path, err)
+		}
+		if err := a.loadFile(f.path, b); err != nil {
+			return err
+		}
+	}
+
+	keys, err := fs.ReadDir(base, keysDirPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("reading keys of base: %w", err)
+	}
+	for _, key := range keys {
+		if key.IsDir() {
+			continue
+		}
+		p := path.Join(keysDirPath, key.Name())
+		b, err := fs.ReadFile(base, p)
+		if err != nil {
+			return fmt.Errorf("reading key %s of base: %w", key.Name(), err)
+		}
+		if err := a.loadFile(p, b); err != nil {
+			return err
+		}
+	}
+	a.baseFiles = map[string]baseFile{}
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			if checksum, err := checksumFromHeader(f); err == nil && checksum != nil {
+				a.baseFiles[f.Name] = baseFile{checksum: checksum, mode: f.Mode, uid: f.Uid, gid: f.Gid}
+			}
+		}
+	}
+	a.logger.Infof("loaded apk database of base with %d installed packages", len(pkgs))
+	return nil
+}
+
+// baseFile is what the installed database of the base records of one of its regular files.
+type baseFile struct {
+	checksum []byte
+	mode     int64
+	uid, gid int
+}
+
+// inBase reports whether the base loaded with LoadInstalled has a regular file at the path with the checksum,
+// and the same permissions and ownership as the header. The installed database does not record the times
+// of files, so those of the base are kept.
+func (a *APK) inBase(header *tar.Header, checksum []byte) bool {
+	if header.Typeflag != tar.TypeReg || checksum == nil {
+		return false
+	}
+	base, ok := a.baseFiles[header.Name]
+	return ok && bytes.Equal(base.checksum, checksum) &&
+		base.mode&0o7777 == header.Mode&0o7777 && base.uid == header.Uid && base.gid == header.Gid
+}
+
+func (a *APK) loadFile(p string, b []byte) error {
+	if err := a.fs.MkdirAll(path.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("creating directory for %s: %w", p, err)
+	}
+	// #nosec G306 -- the apk database must be publicly readable
+	if err := a.fs.WriteFile(p, b, 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", p, err)
+	}
+	return nil
+}
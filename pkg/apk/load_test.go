@@ -0,0 +1,71 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestLoadInstalled(t *testing.T) {
+	base, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	require.NoError(t, src.MkdirAll("etc/apk/keys", 0o755))
+	require.NoError(t, base.SetWorld(testBaseWorld))
+	require.NoError(t, base.SetRepositories([]string{testAlpineRepos}))
+	require.NoError(t, src.WriteFile(archFilePath, []byte(testArch+"\n"), 0o644))
+	require.NoError(t, src.WriteFile("etc/apk/keys/test.rsa.pub", []byte("key"), 0o644))
+
+	layer := apkfs.NewMemFS()
+	a, err := New(WithFS(layer), WithArch(testArch))
+	require.NoError(t, err)
+	require.NoError(t, a.LoadInstalled(src))
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, len(testInstalledPackages))
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, testBaseWorld, world)
+	repos, err := a.GetRepositories()
+	require.NoError(t, err)
+	require.Equal(t, []string{testAlpineRepos}, repos)
+	key, err := layer.ReadFile("etc/apk/keys/test.rsa.pub")
+	require.NoError(t, err)
+	require.Equal(t, "key", string(key))
+
+	// the checksums of the files of the base are known, so that identical files are not written again
+	require.Len(t, a.baseFiles["bin/busybox"].checksum, 20)
+
+	// what the base has installed is kept as it is
+	keep, replace, err := a.checkInstalledVersions([]*repository.RepositoryPackage{
+		{Package: &repository.Package{Name: "busybox", Version: "1.35.0-r17"}},
+	}, false)
+	require.NoError(t, err)
+	require.True(t, keep["busybox"])
+	require.Empty(t, replace)
+
+	other, err := New(WithFS(apkfs.NewMemFS()), WithArch("x86_64"))
+	require.NoError(t, err)
+	require.ErrorContains(t, other.LoadInstalled(src), "aarch64")
+
+	empty, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch))
+	require.NoError(t, err)
+	require.Error(t, empty.LoadInstalled(apkfs.NewMemFS()))
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+)
+
+// InstallLocalPackage installs the .apk file at the path, with its dependencies from the repositories,
+// the equivalent of "apk add ./foo.apk". The package is added to the world as name=version, and is
+// preferred to any package of the repositories that has the same name or provides it. It must be
+// signed with a trusted key, or it is an *UntrustedPackageError, unless WithAllowUntrusted is set.
+// Otherwise it is as FixateWorld, which on failure leaves the world as it was.
+func (a *APK) InstallLocalPackage(ctx context.Context, p string, sourceDateEpoch *time.Time) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallLocalPackage")
+	defer span.End()
+
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+	keys, err := a.loadKeys(ctx, a.getClient())
+	if err != nil {
+		return err
+	}
+	pkg, err := localPackage(ctx, p, keys, a.ignoreSignatures)
+	if err != nil {
+		return err
+	}
+	if pkg.Arch != a.arch && pkg.Arch != "noarch" {
+		return fmt.Errorf("%s is for architecture %s, not %s", p, pkg.Arch, a.arch)
+	}
+
+	// the package is fetched from the repository as <name>-<version>.apk
+	dir := filepath.Dir(p)
+	if filepath.Base(p) != pkg.Filename() {
+		if dir, err = os.MkdirTemp("", "go-apk-local-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if err := linkOrCopy(p, filepath.Join(dir, pkg.Filename())); err != nil {
+			return fmt.Errorf("staging %s: %w", p, err)
+		}
+	}
+	repo := repository.Repository{Uri: dir}
+	local := &namedRepositoryWithIndex{
+		repo:     repo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{pkg}}),
+		priority: math.MaxInt32,
+	}
+
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return err
+	}
+	added := make([]string, 0, len(world)+1)
+	for _, entry := range world {
+		if resolvePackageNameVersionPin(entry).name != pkg.Name {
+			added = append(added, entry)
+		}
+	}
+	if err := a.SetWorld(append(added, worldEntry(pkg.Name, "="+pkg.Version, ""))); err != nil {
+		return err
+	}
+	if err := a.fixateWorld(ctx, sourceDateEpoch, false, false, append([]NamedIndex{local}, indexes...)); err != nil {
+		if worldErr := a.SetWorld(world); worldErr != nil {
+			a.logger.Warnf("restoring world: %v", worldErr)
+		}
+		return fmt.Errorf("installing %s: %w", p, err)
+	}
+	return nil
+}
+
+// localPackage returns the package of the .apk file at the path, as an index would describe it,
+// verifying that it is signed with one of the keys unless untrusted packages are allowed.
+func localPackage(ctx context.Context, p string, keys map[string][]byte, allowUntrusted bool) (*repository.Package, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	exp, err := ExpandApk(ctx, f, "")
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", p, err)
+	}
+	defer exp.Close()
+	if _, err := VerifyPackageSignature(p, exp, keys); err != nil && !allowUntrusted {
+		return nil, err
+	}
+	pkg, err := exp.PackageInfo()
+	if err != nil {
+		return nil, fmt.Errorf("reading package info of %s: %w", p, err)
+	}
+	pkg.Checksum = exp.ControlHash
+	pkg.Size = uint64(fi.Size())
+	return pkg, nil
+}
+
+// linkOrCopy links the file at src to dst, or copies it if it cannot be linked.
+func linkOrCopy(src, dst string) error {
+	if err := os.Symlink(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// writeTestAPK writes an unsigned .apk of the package, with the files, to the path, and returns the
+// package with its checksum, as an index would list it.
+func writeTestAPK(t *testing.T, p string, pkg *repository.Package, files map[string]string) *repository.Package {
+	t.Helper()
+	targz := func(entries map[string]string, order []string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(zw)
+		dirs := map[string]bool{}
+		for _, name := range order {
+			// the directories of the files come first, named with a trailing slash as in real packages
+			for i := range name {
+				if name[i] == '/' && !dirs[name[:i]] {
+					dirs[name[:i]] = true
+					require.NoError(t, tw.WriteHeader(&tar.Header{Name: name[:i] + "/", Mode: 0o755, Typeflag: tar.TypeDir}))
+				}
+			}
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(entries[name])), Typeflag: tar.TypeReg}))
+			_, err := tw.Write([]byte(entries[name]))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	data := targz(files, names)
+	datahash := sha256.Sum256(data)
+
+	info := []string{
+		"pkgname = " + pkg.Name,
+		"pkgver = " + pkg.Version,
+		"arch = " + pkg.Arch,
+		"size = 1",
+		"datahash = " + hex.EncodeToString(datahash[:]),
+	}
+	for _, dep := range pkg.Dependencies {
+		info = append(info, "depend = "+dep)
+	}
+	for _, provided := range pkg.Provides {
+		info = append(info, "provides = "+provided)
+	}
+	control := targz(map[string]string{".PKGINFO": strings.Join(info, "\n") + "\n"}, []string{".PKGINFO"})
+	require.NoError(t, os.WriteFile(p, append(control, data...), 0o644))
+
+	exp, err := ExpandApk(context.Background(), bytes.NewReader(append(control, data...)), "")
+	require.NoError(t, err)
+	defer exp.Close()
+	indexed := *pkg
+	indexed.Checksum = exp.ControlHash
+	indexed.InstalledSize = 1
+	return &indexed
+}
+
+func TestInstallLocalPackage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// a repository with the dependency of the local package
+	repoDir := filepath.Join(dir, "repo")
+	require.NoError(t, os.MkdirAll(repoDir, 0o755))
+	writeTestRepository(t, repoDir,
+		testPackage{repository.Package{Name: "libhello", Version: "1.0-r0"}, map[string]string{"usr/lib/libhello.so": "lib"}},
+		// a package of the same name, that the local one is preferred to
+		testPackage{repository.Package{Name: "hello", Version: "2.0-r0"}, map[string]string{"usr/bin/hello": "repo"}},
+	)
+
+	local := filepath.Join(dir, "hello.apk")
+	writeTestAPK(t, local, &repository.Package{Name: "hello", Version: "1.0-r0", Arch: testArch, Dependencies: []string{"libhello"}},
+		map[string]string{"usr/bin/hello": "local"})
+
+	fs := apkfs.NewMemFS()
+	a := newTestAPK(t, fs, []string{repoDir}, nil)
+
+	require.NoError(t, a.InstallLocalPackage(ctx, local, nil))
+
+	b, err := fs.ReadFile("usr/bin/hello")
+	require.NoError(t, err)
+	require.Equal(t, "local", string(b))
+	_, err = fs.ReadFile("usr/lib/libhello.so")
+	require.NoError(t, err)
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"hello=1.0-r0"}, world)
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	var names []string
+	for _, pkg := range installed {
+		names = append(names, fmt.Sprintf("%s-%s", pkg.Name, pkg.Version))
+	}
+	require.ElementsMatch(t, []string{"hello-1.0-r0", "libhello-1.0-r0"}, names)
+	// the installed database records the directories without the slash, with the files after them
+	db, err := fs.ReadFile(installedFilePath)
+	require.NoError(t, err)
+	require.Contains(t, string(db), "P:hello\nV:1.0-r0\n")
+	require.Contains(t, string(db), "F:usr\nF:usr/bin\nR:hello\n")
+	require.Contains(t, string(db), "F:usr\nF:usr/lib\nR:libhello.so\n")
+	require.NotContains(t, string(db), "F:usr/\n")
+
+	t.Run("untrusted", func(t *testing.T) {
+		strict, err := New(WithFS(fs), WithArch(testArch), WithIgnoreMknodErrors(true), WithRepositoryLayout(FlatLayout{}))
+		require.NoError(t, err)
+		err = strict.InstallLocalPackage(ctx, local, nil)
+		var untrusted *UntrustedPackageError
+		require.ErrorAs(t, err, &untrusted)
+		require.Equal(t, local, untrusted.Package)
+		require.ErrorContains(t, err, "is not signed")
+	})
+	t.Run("other architecture", func(t *testing.T) {
+		p := filepath.Join(dir, "foreign.apk")
+		writeTestAPK(t, p, &repository.Package{Name: "foreign", Version: "1.0-r0", Arch: "s390x"}, map[string]string{"foreign": ""})
+		require.ErrorContains(t, a.InstallLocalPackage(ctx, p, nil), "is for architecture s390x")
+	})
+	t.Run("unresolvable dependency", func(t *testing.T) {
+		p := filepath.Join(dir, "broken.apk")
+		writeTestAPK(t, p, &repository.Package{Name: "broken", Version: "1.0-r0", Arch: testArch, Dependencies: []string{"no-such-package"}}, map[string]string{"broken": ""})
+		require.Error(t, a.InstallLocalPackage(ctx, p, nil))
+		// the world is left as it was
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"hello=1.0-r0"}, world)
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// PackageLookupFunc returns the .apk file of a package of a MemoryRepository.
+type PackageLookupFunc func(ctx context.Context, pkg *repository.RepositoryPackage) (io.ReadCloser, error)
+
+// MemoryRepository is a repository whose index is given rather than fetched, and whose packages are
+// looked up with a function rather than fetched from its URL, for tests and for systems that generate
+// indexes on the fly. Its packages are installed with WithMemoryRepositories.
+type MemoryRepository struct {
+	*namedRepositoryWithIndex
+	lookup PackageLookupFunc
+}
+
+// NewMemoryRepository reads the index of a repository from r, either an APKINDEX.tar.gz, whose
+// signature is not verified, or the APKINDEX text itself; for an index in memory, r is a
+// bytes.Reader. The packages of the repository have the URI, which must be unique among the
+// repositories of an APK, as their repository, and are pinned to name, if it is not empty, as with
+// NewNamedRepositoryWithIndex. They are looked up with lookup when they are installed. An index with
+// problems is an *IndexProblemsError.
+func NewMemoryRepository(name, uri string, r io.Reader, lookup PackageLookupFunc) (*MemoryRepository, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading index of %s: %w", uri, err)
+	}
+	var index *repository.ApkIndex
+	var problems []IndexProblem
+	if bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		if index, problems, err = parseIndexArchive(b, "", ""); err != nil {
+			return nil, fmt.Errorf("reading index of %s: %w", uri, err)
+		}
+	} else {
+		index = &repository.ApkIndex{}
+		index.Packages, problems = parsePackageIndexParallel(b, runtime.GOMAXPROCS(0))
+	}
+	if len(problems) > 0 {
+		for i := range problems {
+			problems[i].Index = uri
+		}
+		return nil, &IndexProblemsError{Problems: problems}
+	}
+	repo := repository.Repository{Uri: uri}
+	return &MemoryRepository{
+		namedRepositoryWithIndex: &namedRepositoryWithIndex{name: name, repo: repo.WithIndex(index)},
+		lookup:                   lookup,
+	}, nil
+}
+
+// URI returns the URI of the repository, that of its packages.
+func (m *MemoryRepository) URI() string {
+	return m.repo.Uri
+}
+
+// Source returns the URI of the repository, as it has no index URL.
+func (m *MemoryRepository) Source() string {
+	return m.repo.Uri
+}
+
+// memoryRepository returns the memory repository of the package, if it is from one given with
+// WithMemoryRepositories.
+func (a *APK) memoryRepository(pkg *repository.RepositoryPackage) (*MemoryRepository, bool) {
+	m, ok := a.memoryRepos[packageRepository(pkg)]
+	return m, ok
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	hello := writeTestAPK(t, filepath.Join(dir, "hello-1.0-r0.apk"),
+		&repository.Package{Name: "hello", Version: "1.0-r0", Arch: testArch, Dependencies: []string{"libhello"}}, map[string]string{"usr/bin/hello": "hello"})
+	lib := writeTestAPK(t, filepath.Join(dir, "libhello-1.0-r0.apk"),
+		&repository.Package{Name: "libhello", Version: "1.0-r0", Arch: testArch}, map[string]string{"usr/lib/libhello.so": "lib"})
+	var looked []string
+	lookup := func(_ context.Context, pkg *repository.RepositoryPackage) (io.ReadCloser, error) {
+		looked = append(looked, pkg.Name)
+		return os.Open(filepath.Join(dir, pkg.Filename()))
+	}
+
+	var archive bytes.Buffer
+	require.NoError(t, WriteIndexArchive(&archive, "memory", []*repository.Package{hello, lib}))
+	fromArchive, err := NewMemoryRepository("", "memory://archive", &archive, lookup)
+	require.NoError(t, err)
+	require.Equal(t, 2, fromArchive.Count())
+	require.Equal(t, "memory", IndexDescription(fromArchive))
+
+	// the APKINDEX text itself
+	text := strings.Join(PackageToIndex(hello), "\n") + "\n\n" + strings.Join(PackageToIndex(lib), "\n") + "\n"
+	fromText, err := NewMemoryRepository("", "memory://text", strings.NewReader(text), lookup)
+	require.NoError(t, err)
+	require.Equal(t, "memory://text", fromText.Source())
+	require.Equal(t, 2, fromText.Count())
+
+	_, err = NewMemoryRepository("", "memory://broken", strings.NewReader("P:\nV:1.0-r0\n"), lookup)
+	var problems *IndexProblemsError
+	require.ErrorAs(t, err, &problems)
+
+	fs := apkfs.NewMemFS()
+	a, err := New(WithFS(fs), WithArch(testArch), WithIgnoreMknodErrors(true), WithMemoryRepositories(fromText))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetWorld([]string{"hello"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	require.ElementsMatch(t, []string{"hello", "libhello"}, looked)
+	b, err := fs.ReadFile("usr/bin/hello")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+	_, err = fs.ReadFile("usr/lib/libhello.so")
+	require.NoError(t, err)
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/chainguard-dev/go-apk/pkg/tarball"
+)
+
+// minirootfsWorld is the world of the official alpine-minirootfs tarballs.
+// musl and the rest of the base system are pulled in as their dependencies.
+var minirootfsWorld = []string{
+	"alpine-baselayout",
+	"alpine-keys",
+	"apk-tools",
+	"busybox",
+	"libc-utils",
+}
+
+// BuildMinirootFS assembles the equivalent of the alpine-minirootfs tarball for the given alpine
+// release branch, e.g. "v3.18", "3.18" or "edge", and architecture, and writes it gzipped to dst.
+// The root is bootstrapped with the alpine keys for the release and an /etc/apk/repositories
+// pointing at the main and community repositories, and then has the base packages installed.
+//
+// Any additional options are applied after the filesystem and architecture are set,
+// so they can be used to set a cache, logger and the like.
+func BuildMinirootFS(ctx context.Context, version, arch string, dst io.Writer, options ...Option) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "BuildMinirootFS")
+	defer span.End()
+
+	if version != "edge" && !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+
+	cfg := BootstrapConfig{
+		AlpineVersions: []string{version},
+		Repositories: []string{
+			fmt.Sprintf("%s/%s/main", alpineRepositoriesURL, version),
+			fmt.Sprintf("%s/%s/community", alpineRepositoriesURL, version),
+		},
+		World: minirootfsWorld,
+	}
+	opts := append([]Option{WithArch(arch), WithVersion(version), WithIgnoreMknodErrors(true)}, options...)
+	return buildMinirootFS(ctx, cfg, dst, opts...)
+}
+
+// buildMinirootFS bootstraps a root in memory with the configuration, installs its world, and writes
+// it gzipped to dst.
+func buildMinirootFS(ctx context.Context, cfg BootstrapConfig, dst io.Writer, options ...Option) error {
+	fsys := apkfs.NewMemFS()
+	a, err := New(append([]Option{WithFS(fsys)}, options...)...)
+	if err != nil {
+		return err
+	}
+	if err := a.Bootstrap(ctx, cfg); err != nil {
+		return err
+	}
+	if err := a.FixateWorld(ctx, nil); err != nil {
+		return fmt.Errorf("failed to install base packages: %w", err)
+	}
+
+	tctx, err := tarball.NewContext()
+	if err != nil {
+		return fmt.Errorf("failed to create tarball context: %w", err)
+	}
+	if err := tctx.WriteTargz(ctx, dst, fsys); err != nil {
+		return fmt.Errorf("failed to write minirootfs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestBuildMinirootFS(t *testing.T) {
+	ctx := context.Background()
+	// a local repository with a package of each name of the world of the minirootfs
+	repoDir := t.TempDir()
+	var pkgs []testPackage
+	for _, name := range minirootfsWorld {
+		pkgs = append(pkgs, testPackage{repository.Package{Name: name, Version: "1.0-r0"}, map[string]string{"usr/share/" + name + "/README": name}})
+	}
+	writeTestRepository(t, repoDir, pkgs...)
+
+	var out bytes.Buffer
+	cfg := BootstrapConfig{Repositories: []string{repoDir}, World: minirootfsWorld}
+	require.NoError(t, buildMinirootFS(ctx, cfg, &out, WithArch(testArch), WithIgnoreMknodErrors(true), WithRepositoryLayout(FlatLayout{}), WithAllowUntrusted(true)))
+
+	zr, err := gzip.NewReader(&out)
+	require.NoError(t, err)
+	tr := tar.NewReader(zr)
+	contents := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		contents[strings.TrimPrefix(hdr.Name, "/")] = string(b)
+	}
+
+	// the files of every package, and the database that records them
+	for _, name := range minirootfsWorld {
+		require.Equal(t, name, contents["usr/share/"+name+"/README"], name)
+		require.Contains(t, contents[installedFilePath], "P:"+name+"\n")
+	}
+	require.Equal(t, strings.Join(minirootfsWorld, "\n")+"\n", contents[worldFilePath])
+	require.Equal(t, repoDir+"\n", contents[reposFilePath])
+	require.Equal(t, testArch+"\n", contents[archFilePath])
+}
@@ -0,0 +1,274 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/chainguard-dev/go-apk/pkg/logger"
+)
+
+const (
+	// DefaultMirrorTTL is how long the mirror picked for a MirrorSelection is kept on disk, when it
+	// has no TTL of its own.
+	DefaultMirrorTTL = 24 * time.Hour
+	// mirrorProbeTimeout is how long a mirror has to answer a probe.
+	mirrorProbeTimeout = 5 * time.Second
+	// mirrorsCacheDir is where the picked mirrors are kept in the cache.
+	mirrorsCacheDir = "mirrors"
+)
+
+// MirrorSelection is a set of mirrors of a repository base URL, such as the Alpine CDN at
+// https://dl-cdn.alpinelinux.org/alpine, to fetch from the fastest of instead of it.
+type MirrorSelection struct {
+	// Upstream is the base URL of the repositories that the mirrors mirror, as in
+	// /etc/apk/repositories, or the Alpine CDN if it is empty. Everything under it is fetched from
+	// the mirror picked, which is always one of Mirrors or Upstream itself.
+	Upstream string `json:"upstream,omitempty" yaml:"upstream,omitempty"`
+	// Mirrors are the base URLs of the mirrors, each with the same layout as Upstream.
+	Mirrors []string `json:"mirrors" yaml:"mirrors"`
+	// TTL is how long the mirror picked is kept in the cache, if there is one, for the next
+	// processes to use rather than probe again; DefaultMirrorTTL if it is zero.
+	TTL time.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+}
+
+// candidates returns the upstream and the mirrors, without trailing slashes, upstream first.
+func (s MirrorSelection) candidates() (string, []string) {
+	upstream := strings.TrimSuffix(s.Upstream, "/")
+	if upstream == "" {
+		upstream = alpineRepositoriesURL
+	}
+	candidates := []string{upstream}
+	for _, m := range s.Mirrors {
+		if m = strings.TrimSuffix(m, "/"); m != upstream {
+			candidates = append(candidates, m)
+		}
+	}
+	return upstream, candidates
+}
+
+// key identifies the selection, for its probe to be shared within the process and on disk.
+func (s MirrorSelection) key() string {
+	_, candidates := s.candidates()
+	sum := sha256.Sum256([]byte(strings.Join(candidates, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// mirrorProbes are the probes of the selections, by their key, so that each is only probed once
+// per process, however many APKs use it.
+var mirrorProbes sync.Map
+
+type mirrorProbe struct {
+	once   sync.Once
+	mirror string
+}
+
+// pickedMirror is what is written to the cache of the mirror picked for a selection.
+type pickedMirror struct {
+	Mirror string    `json:"mirror"`
+	Probed time.Time `json:"probed"`
+}
+
+// mirrorTransport fetches everything under the upstream of each selection from its fastest mirror,
+// probing them through the wrapped client the first time one is needed.
+type mirrorTransport struct {
+	wrapped    *http.Client
+	selections []MirrorSelection
+	cacheDir   string
+	logger     logger.Logger
+}
+
+// mirrorClient returns the client, fetching from the mirrors picked of WithMirrorSelection, if any.
+func (a *APK) mirrorClient(client *http.Client) *http.Client {
+	if len(a.mirrors) == 0 {
+		return client
+	}
+	t := &mirrorTransport{wrapped: client, selections: a.mirrors, logger: a.logger}
+	if a.cache != nil {
+		t.cacheDir = a.cache.dir
+	}
+	return &http.Client{Transport: t}
+}
+
+func (t *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for _, sel := range t.selections {
+		upstream, _ := sel.candidates()
+		rest, ok := underURL(req.URL.String(), upstream)
+		if !ok {
+			continue
+		}
+		mirror := t.mirror(req.Context(), sel)
+		if mirror == upstream {
+			break
+		}
+		u, err := url.Parse(mirror + rest)
+		if err != nil {
+			return nil, fmt.Errorf("mirror %s of %s: %w", mirror, req.URL, err)
+		}
+		req = req.Clone(req.Context())
+		req.URL = u
+		req.Host = ""
+		break
+	}
+	return t.wrapped.Do(req)
+}
+
+// underURL returns what is after base in the URL s, if s is base or under it.
+func underURL(s, base string) (string, bool) {
+	if !strings.HasPrefix(s, base) {
+		return "", false
+	}
+	rest := s[len(base):]
+	if rest != "" && !strings.HasPrefix(rest, "/") && !strings.HasPrefix(rest, "?") {
+		return "", false
+	}
+	return rest, true
+}
+
+// mirror returns the mirror of the selection to fetch from: that picked earlier in the process, or
+// in the cache within its TTL, or else the fastest to answer a probe now, or the upstream if none
+// does.
+func (t *mirrorTransport) mirror(ctx context.Context, sel MirrorSelection) string {
+	upstream, candidates := sel.candidates()
+	key := sel.key()
+	v, _ := mirrorProbes.LoadOrStore(key, &mirrorProbe{})
+	probe, _ := v.(*mirrorProbe)
+	probe.once.Do(func() {
+		ttl := sel.TTL
+		if ttl == 0 {
+			ttl = DefaultMirrorTTL
+		}
+		if picked, ok := t.readPicked(key, ttl, candidates); ok {
+			probe.mirror = picked
+			return
+		}
+		probe.mirror = t.probe(ctx, candidates)
+		if probe.mirror == "" {
+			t.logger.Warnf("no mirror of %s answered, fetching from it", upstream)
+			probe.mirror = upstream
+			return
+		}
+		t.logger.Debugf("fetching %s from %s", upstream, probe.mirror)
+		t.writePicked(key, probe.mirror)
+	})
+	return probe.mirror
+}
+
+// probe returns the candidate that sent the first byte of a response to a request for its base URL
+// first, or "" if none did in time.
+func (t *mirrorTransport) probe(ctx context.Context, candidates []string) string {
+	ctx, cancel := context.WithTimeout(ctx, mirrorProbeTimeout)
+	defer cancel()
+	fastest := make(chan string, len(candidates))
+	var wg sync.WaitGroup
+	for _, candidate := range candidates {
+		candidate := candidate
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			if err := t.probeOne(ctx, candidate); err != nil {
+				t.logger.Debugf("probing mirror %s: %v", candidate, err)
+				return
+			}
+			t.logger.Debugf("mirror %s answered in %s", candidate, time.Since(start).Round(time.Millisecond))
+			fastest <- candidate
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(fastest)
+	}()
+	// the first to answer is the fastest, the others are cancelled on return
+	return <-fastest
+}
+
+func (t *mirrorTransport) probeOne(ctx context.Context, candidate string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, candidate+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := t.wrapped.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	// the first byte, or the end of an empty body
+	if _, err := resp.Body.Read(make([]byte, 1)); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func (t *mirrorTransport) pickedPath(key string) string {
+	return filepath.Join(t.cacheDir, mirrorsCacheDir, key+".json")
+}
+
+// readPicked returns the mirror picked for the selection of the key in the cache, if there is one
+// and it is one of the candidates still, and was probed within the TTL.
+func (t *mirrorTransport) readPicked(key string, ttl time.Duration, candidates []string) (string, bool) {
+	if t.cacheDir == "" {
+		return "", false
+	}
+	b, err := os.ReadFile(t.pickedPath(key))
+	if err != nil {
+		return "", false
+	}
+	var picked pickedMirror
+	if err := json.Unmarshal(b, &picked); err != nil || time.Since(picked.Probed) > ttl {
+		return "", false
+	}
+	for _, c := range candidates {
+		if c == picked.Mirror {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// writePicked writes the mirror picked for the selection of the key to the cache, if there is one.
+// Failing to is only logged, as the mirror is kept for the process in any case.
+func (t *mirrorTransport) writePicked(key, mirror string) {
+	if t.cacheDir == "" {
+		return
+	}
+	b, err := json.Marshal(pickedMirror{Mirror: mirror, Probed: time.Now()})
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(t.cacheDir, mirrorsCacheDir), 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(t.pickedPath(key), b, 0o644) //nolint:gosec // the cache is readable, as the rest of it
+	}
+	if err != nil {
+		t.logger.Warnf("unable to cache the mirror picked %s: %v", mirror, err)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorSelection(t *testing.T) {
+	// the probes of the fastest, the only ones sure to arrive before the others are cancelled
+	var probes atomic.Int32
+	server := func(name string, delay time.Duration) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/alpine/" {
+				if delay == 0 {
+					probes.Add(1)
+				}
+				time.Sleep(delay)
+			}
+			_, _ = io.WriteString(w, name+" "+r.URL.Path)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	upstream := server("upstream", 200*time.Millisecond)
+	fast := server("fast", 0)
+	slow := server("slow", 400*time.Millisecond)
+	sel := MirrorSelection{Upstream: upstream.URL + "/alpine/", Mirrors: []string{slow.URL + "/alpine", fast.URL + "/alpine"}}
+	cacheDir := t.TempDir()
+
+	get := func(url string) string {
+		a, err := New(WithMirrorSelection(sel), WithCache(cacheDir, false))
+		require.NoError(t, err)
+		resp, err := a.getClient().Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	require.Equal(t, "fast /alpine/edge/main/x86_64/APKINDEX.tar.gz", get(upstream.URL+"/alpine/edge/main/x86_64/APKINDEX.tar.gz"))
+	require.Equal(t, int32(1), probes.Load())
+	// only what is under the upstream is fetched from the mirror
+	require.Equal(t, "upstream /other", get(upstream.URL+"/other"))
+	require.Equal(t, "upstream /alpinex", get(upstream.URL+"/alpinex"))
+	// probed once per process
+	require.Equal(t, "fast /alpine/edge/community/x86_64/APKINDEX.tar.gz", get(upstream.URL+"/alpine/edge/community/x86_64/APKINDEX.tar.gz"))
+	require.Equal(t, int32(1), probes.Load())
+	require.FileExists(t, filepath.Join(cacheDir, mirrorsCacheDir, sel.key()+".json"))
+
+	// another process reads the mirror picked from the cache, within the TTL
+	mirrorProbes.Delete(sel.key())
+	require.Equal(t, "fast /alpine/x", get(upstream.URL+"/alpine/x"))
+	require.Equal(t, int32(1), probes.Load())
+
+	// and probes again once it has expired
+	mirrorProbes.Delete(sel.key())
+	sel.TTL = time.Nanosecond
+	require.Equal(t, "fast /alpine/x", get(upstream.URL+"/alpine/x"))
+	require.Equal(t, int32(2), probes.Load())
+
+	_, err := New(WithMirrorSelection(MirrorSelection{Upstream: upstream.URL}))
+	require.Error(t, err)
+}
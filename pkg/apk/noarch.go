@@ -0,0 +1,134 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// noarch is the architecture of packages that are for every architecture.
+const noarch = "noarch"
+
+// MergeArchIndexes merges the packages of the indexes of the architectures of a repository, by
+// architecture, into those of a single index for all of them. The noarch packages, which are in the
+// index of every architecture, are kept once; it is an error if the same version of one has different
+// checksums in different indexes. Packages without an architecture are given that of their index.
+// The packages are in the order of the architectures, sorted, then of each index.
+func MergeArchIndexes(indexes map[string][]*repository.Package) ([]*repository.Package, error) {
+	arches := make([]string, 0, len(indexes))
+	for arch := range indexes {
+		arches = append(arches, arch)
+	}
+	sort.Strings(arches)
+
+	var merged []*repository.Package
+	seen := map[string]*repository.Package{}
+	for _, arch := range arches {
+		for _, pkg := range indexes[arch] {
+			if pkg.Arch == "" {
+				p := *pkg
+				p.Arch = arch
+				pkg = &p
+			}
+			if pkg.Arch == noarch {
+				id := pkg.Name + "=" + pkg.Version
+				if first, ok := seen[id]; ok {
+					if !bytes.Equal(first.Checksum, pkg.Checksum) {
+						return nil, fmt.Errorf("noarch package %s of %s has checksum %s, not %s as of another architecture", id, arch, FormatQ1Checksum(pkg.Checksum), FormatQ1Checksum(first.Checksum))
+					}
+					continue
+				}
+				seen[id] = pkg
+			}
+			merged = append(merged, pkg)
+		}
+	}
+	return merged, nil
+}
+
+// SplitArchIndexes splits the packages of a single index for several architectures into the
+// packages of the index of each of the architectures, each with every noarch package, as the
+// repositories of Alpine have them. Packages of other architectures are left out.
+func SplitArchIndexes(pkgs []*repository.Package, arches ...string) map[string][]*repository.Package {
+	split := make(map[string][]*repository.Package, len(arches))
+	for _, arch := range arches {
+		split[arch] = nil
+	}
+	for _, pkg := range pkgs {
+		if pkg.Arch == noarch {
+			for _, arch := range arches {
+				split[arch] = append(split[arch], pkg)
+			}
+			continue
+		}
+		if _, ok := split[pkg.Arch]; ok {
+			split[pkg.Arch] = append(split[pkg.Arch], pkg)
+		}
+	}
+	return split
+}
+
+// packagesForArch returns the packages of an index that are resolved from for arch. Where an index
+// has builds of the same version of a package for several architectures, as a merged index does,
+// only those for arch are kept, or else a single noarch one; a package with a single build is kept,
+// whatever its architecture, so that indexes of a single architecture are left as they are.
+func packagesForArch(pkgs []*repository.Package, arch string) []*repository.Package {
+	builds := make(map[string][]int, len(pkgs))
+	multiple := false
+	for i, pkg := range pkgs {
+		id := pkg.Name + "=" + pkg.Version
+		builds[id] = append(builds[id], i)
+		multiple = multiple || len(builds[id]) > 1
+	}
+	if !multiple {
+		return pkgs
+	}
+
+	keep := make([]bool, len(pkgs))
+	for _, idx := range builds {
+		if len(idx) == 1 {
+			keep[idx[0]] = true
+			continue
+		}
+		found := false
+		for _, i := range idx {
+			if pkgs[i].Arch == arch {
+				keep[i], found = true, true
+			}
+		}
+		for _, i := range idx {
+			if !found && pkgs[i].Arch == noarch {
+				keep[i], found = true, true
+			}
+		}
+		if !found {
+			// none is for arch, so it is for the resolver to fail or choose, as for other packages
+			for _, i := range idx {
+				keep[i] = true
+			}
+		}
+	}
+	kept := make([]*repository.Package, 0, len(pkgs))
+	for i, pkg := range pkgs {
+		if keep[i] {
+			kept = append(kept, pkg)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestMergeArchIndexes(t *testing.T) {
+	data := &repository.Package{Name: "hello-data", Version: "1.0-r0", Arch: "noarch", Checksum: []byte{1}}
+	x86 := &repository.Package{Name: "hello", Version: "1.0-r0", Arch: "x86_64", Checksum: []byte{2}}
+	arm := &repository.Package{Name: "hello", Version: "1.0-r0", Arch: "aarch64", Checksum: []byte{3}}
+	bare := &repository.Package{Name: "bare", Version: "1.0-r0", Checksum: []byte{4}}
+
+	split := SplitArchIndexes([]*repository.Package{data, x86, arm}, "x86_64", "aarch64")
+	require.Equal(t, map[string][]*repository.Package{
+		"x86_64":  {data, x86},
+		"aarch64": {data, arm},
+	}, split)
+
+	split["x86_64"] = append(split["x86_64"], bare)
+	merged, err := MergeArchIndexes(split)
+	require.NoError(t, err)
+	require.Equal(t, []*repository.Package{data, arm, x86, {Name: "bare", Version: "1.0-r0", Arch: "x86_64", Checksum: []byte{4}}}, merged)
+
+	// of the same version, the build for the architecture, or the noarch one, are resolved from
+	require.Equal(t, []*repository.Package{data, x86}, packagesForArch(merged[:3], "x86_64"))
+	require.Equal(t, []*repository.Package{data, arm}, packagesForArch(merged[:3], "aarch64"))
+	require.Equal(t, []*repository.Package{data, arm, x86}, packagesForArch(merged[:3], "riscv64"))
+	other := &repository.Package{Name: "hello-data", Version: "1.0-r0", Arch: "noarch", Checksum: []byte{1}}
+	require.Equal(t, []*repository.Package{data}, packagesForArch([]*repository.Package{data, other}, "x86_64"))
+	// indexes of a single architecture are left as they are, whatever it is
+	single := []*repository.Package{x86, bare}
+	require.Equal(t, single, packagesForArch(single, "aarch64"))
+
+	_, err = MergeArchIndexes(map[string][]*repository.Package{
+		"x86_64":  {data},
+		"aarch64": {{Name: "hello-data", Version: "1.0-r0", Arch: "noarch", Checksum: []byte{5}}},
+	})
+	require.ErrorContains(t, err, "noarch package hello-data=1.0-r0")
+}
+
+func TestResolveMergedIndex(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	var pkgs []*repository.Package
+	for _, arch := range []string{"x86_64", testArch} {
+		pkgs = append(pkgs, writeTestAPK(t, filepath.Join(dir, "hello-"+arch+".apk"),
+			&repository.Package{Name: "hello", Version: "1.0-r0", Arch: arch, Dependencies: []string{"hello-data"}}, map[string]string{"usr/bin/hello": arch}))
+	}
+	pkgs = append(pkgs, writeTestAPK(t, filepath.Join(dir, "hello-data.apk"),
+		&repository.Package{Name: "hello-data", Version: "1.0-r0", Arch: "noarch"}, map[string]string{"usr/share/hello": "data"}))
+	merged, err := MergeArchIndexes(SplitArchIndexes(pkgs, "x86_64", testArch))
+	require.NoError(t, err)
+	require.Len(t, merged, 3)
+	var index bytes.Buffer
+	require.NoError(t, WriteIndexArchive(&index, "test", merged))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, indexFilename), index.Bytes(), 0o644))
+
+	for _, arch := range []string{"x86_64", testArch} {
+		indexes, err := GetRepositoryIndexes(ctx, []string{dir}, nil, arch, WithIgnoreSignatures(true), WithLayout(FlatLayout{}))
+		require.NoError(t, err)
+		resolved, _, err := NewPkgResolver(ctx, indexes).GetPackagesWithDependencies(ctx, []string{"hello"})
+		require.NoError(t, err)
+		require.Len(t, resolved, 2)
+		for _, pkg := range resolved {
+			if pkg.Name == "hello" {
+				require.Equal(t, arch, pkg.Arch)
+			} else {
+				require.Equal(t, "noarch", pkg.Arch)
+			}
+		}
+	}
+}
@@ -15,24 +15,77 @@
 package apk
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 	logger "github.com/chainguard-dev/go-apk/pkg/logger"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 type opts struct {
 	logger            logger.Logger
 	executor          Executor
+	scriptLinter      ScriptLinter
+	packageVerifiers  map[string]PackageVerifier
 	arch              string
 	ignoreMknodErrors bool
 	fs                apkfs.FullFS
+	installRoot       string
 	version           string
 	cache             *cache
+	licensePolicy     LicensePolicy
+	maxInstalledSize  uint64
+	keyringDirs       []string
+	keyringURLs       []string
+	dialContext       DialContextFunc
+	allowDowngrade    bool
+	failOnDowngrade   bool
+	providerSelector  ProviderSelector
+	newResolver       NewResolverFunc
+	layout            RepositoryLayout
+	fsync             bool
+	subpackageRules   []SubpackageRule
+	strictIndexes     bool
+	keyEventHandler   func(KeyEvent)
+	rejectKeyChanges  bool
+	deltas            bool
+	cacheClone        apkfs.CloneMode
+	dedup             bool
+	repoPriorities    map[string]int
+	repoArches        map[string]string
+	shardedIndexes    bool
+	scriptPolicy      ScriptPolicy
+	firstBoot         bool
+	cleanupPolicies   []CleanupPolicy
+	allowUntrusted    bool
+	repoCommit        string
+	hosts             map[string]string
+	resolver          *net.Resolver
+	tls               *tls.Config
+	rootCAs           *x509.CertPool
+	pinnedCerts       []string
+	repoProxies       []repositoryProxy
+	traceFetches      bool
+	installReports    func(*InstallReport)
+	bestEffort        bool
+	timestampOverride time.Time
+	mirrors           []MirrorSelection
+	maxIndexAge       time.Duration
+	failStaleIndexes  bool
+	memoryRepos       map[string]*MemoryRepository
 }
 
 type Option func(*opts) error
@@ -45,7 +98,9 @@ func WithLogger(logger logger.Logger) Option {
 	}
 }
 
-// WithExecutor executor to use. Not currently used.
+// WithExecutor executor to run the scripts of packages with. The scripts are put in /lib/apk/exec of
+// the filesystem, and the executor is given their path there, so it must run them in the filesystem,
+// as NamespaceExecutor does. Without an executor, scripts are not run.
 func WithExecutor(executor Executor) Option {
 	return func(o *opts) error {
 		o.executor = executor
@@ -53,6 +108,85 @@ func WithExecutor(executor Executor) Option {
 	}
 }
 
+// WithScriptLinter sets a linter to look at the scripts of each package before it is installed, which
+// fails the install with the error it vetoes the package with, even with WithBestEffort. The scripts
+// are linted whether or not they are run, such as with DefaultScriptRules.
+func WithScriptLinter(linter ScriptLinter) Option {
+	return func(o *opts) error {
+		o.scriptLinter = linter
+		return nil
+	}
+}
+
+// WithPackageVerifier sets a verifier of the packages fetched from a repository, by its URL as in
+// /etc/apk/repositories, without any pin, or from every repository without one of its own for an
+// empty URL, such as a CosignVerifier for a repository that publishes cosign signatures. Packages are
+// verified when they are fetched, before they are cached; those already in the cache are not again.
+func WithPackageVerifier(repo string, verifier PackageVerifier) Option {
+	return func(o *opts) error {
+		// copied, as clones share it
+		verifiers := make(map[string]PackageVerifier, len(o.packageVerifiers)+1)
+		for r, v := range o.packageVerifiers {
+			verifiers[r] = v
+		}
+		verifiers[repo] = verifier
+		o.packageVerifiers = verifiers
+		return nil
+	}
+}
+
+// WithScriptPolicy sets the packages whose scripts are run by the executor, e.g. to only run the
+// post-install scripts that are needed for a working image. By default, the scripts of all packages
+// are run.
+func WithScriptPolicy(policy ScriptPolicy) Option {
+	return func(o *opts) error {
+		o.scriptPolicy = policy
+		return nil
+	}
+}
+
+// WithFirstBoot makes FixateWorld write a script to FirstBootPath that runs the scripts that were
+// not run, and the triggers of the installed packages, for an image to run at its first start; see
+// FirstBootScript. It is removed when there is nothing left to run.
+func WithFirstBoot(firstBoot bool) Option {
+	return func(o *opts) error {
+		o.firstBoot = firstBoot
+		return nil
+	}
+}
+
+// WithCleanup makes FixateWorld remove the paths of the policies once the packages are installed,
+// e.g. WithCleanup(CleanupCache, CleanupDocs). By default, everything is left, as with CleanupNone.
+func WithCleanup(policies ...CleanupPolicy) Option {
+	return func(o *opts) error {
+		o.cleanupPolicies = append(o.cleanupPolicies, policies...)
+		return nil
+	}
+}
+
+// WithAllowUntrusted allows indexes and local packages, as installed with InstallLocalPackage,
+// that are not signed with a trusted key, as "apk --allow-untrusted" does. It is off by default,
+// so that such packages fail with an *UntrustedPackageError.
+func WithAllowUntrusted(allow bool) Option {
+	return func(o *opts) error {
+		o.allowUntrusted = allow
+		return nil
+	}
+}
+
+// WithRepoCommit resolves the world only from the packages built from the commit, as in
+// IndexesFromCommit, for verifying that rebuilding from that commit reproduces the packages. By
+// default, packages from any commit are used.
+func WithRepoCommit(commit string) Option {
+	return func(o *opts) error {
+		if commit != "" && len(commit) < 7 {
+			return fmt.Errorf("commit %q is too short, it must be at least 7 characters", commit)
+		}
+		o.repoCommit = commit
+		return nil
+	}
+}
+
 // WithArch sets the architecture to use. If not provided, will use the default runtime.GOARCH.
 func WithArch(arch string) Option {
 	return func(o *opts) error {
@@ -86,6 +220,20 @@ func WithFS(fs apkfs.FullFS) Option {
 	}
 }
 
+// WithInstallRoot installs under the directory prefix of the filesystem, such as /sysroot or
+// /opt/toolchain, rather than at its root, for cross-compilation sysroots: everything, from the files of
+// packages to the installed database, the world and the keys, is under prefix as it would otherwise be
+// under /. The directory is created by InitDB, if it is not there.
+func WithInstallRoot(prefix string) Option {
+	return func(o *opts) error {
+		if clean := filepath.Clean(prefix); clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("install root %s is not within the filesystem", prefix)
+		}
+		o.installRoot = strings.TrimPrefix(filepath.Clean("/"+prefix), "/")
+		return nil
+	}
+}
+
 // WithCache sets to use a cache directory for downloaded apk files and APKINDEX files.
 // If not provided, will not cache.
 //
@@ -104,7 +252,282 @@ func WithCache(cacheDir string, offline bool) Option {
 		o.cache = &cache{
 			dir:     cacheDir,
 			offline: offline,
+			stats:   &cacheStats{},
+			fetches: &singleflight.Group{},
+		}
+		return nil
+	}
+}
+
+// WithLicensePolicy sets a policy that is consulted with the license of every package in the
+// resolved set. If it returns an error for any package, resolution fails before anything is installed.
+func WithLicensePolicy(policy LicensePolicy) Option {
+	return func(o *opts) error {
+		o.licensePolicy = policy
+		return nil
+	}
+}
+
+// WithMaxInstalledSize sets a budget, in bytes, for the total installed size of the resolved set.
+// Resolution fails before anything is downloaded if the sum of the packages' installed sizes exceeds it.
+// A value of 0, the default, means no limit.
+func WithMaxInstalledSize(size uint64) Option {
+	return func(o *opts) error {
+		o.maxInstalledSize = size
+		return nil
+	}
+}
+
+// WithKeyringDirs adds directories whose keys are trusted when verifying index signatures,
+// in addition to /etc/apk/keys. The directories are relative to the root filesystem, and must exist.
+func WithKeyringDirs(dirs ...string) Option {
+	return func(o *opts) error {
+		o.keyringDirs = append(o.keyringDirs, dirs...)
+		return nil
+	}
+}
+
+// WithKeyringURLs adds URLs of keys that are trusted when verifying index signatures, in addition
+// to those in /etc/apk/keys. The keys are fetched each time the indexes are loaded.
+func WithKeyringURLs(urls ...string) Option {
+	return func(o *opts) error {
+		o.keyringURLs = append(o.keyringURLs, urls...)
+		return nil
+	}
+}
+
+// DialContextFunc dials a network connection, with the same signature as net.Dialer.DialContext.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// WithDialContext sets the function used to open connections for all repository, package and key
+// traffic, e.g. to route it through a unix socket proxy:
+//
+//	apk.WithDialContext(func(ctx context.Context, _, _ string) (net.Conn, error) {
+//		var d net.Dialer
+//		return d.DialContext(ctx, "unix", "/run/proxy.sock")
+//	})
+//
+// It only applies to the default client; a client set with SetClient is used as is.
+func WithDialContext(dial DialContextFunc) Option {
+	return func(o *opts) error {
+		o.dialContext = dial
+		return nil
+	}
+}
+
+// WithHosts maps the names of hosts, such as those of the repositories, to the addresses to connect
+// to instead, as /etc/hosts would, e.g. to send the traffic for a CDN to a mirror on an internal
+// network as "dl-cdn.alpinelinux.org": "10.0.0.5". TLS is still verified against the name of the
+// host. Like WithDialContext, it only applies to the default client.
+func WithHosts(hosts map[string]string) Option {
+	return func(o *opts) error {
+		if o.hosts == nil {
+			o.hosts = map[string]string{}
+		}
+		for host, addr := range hosts {
+			o.hosts[strings.ToLower(host)] = addr
+		}
+		return nil
+	}
+}
+
+// WithResolver sets the resolver to look up the hosts that are not in WithHosts with, instead of the
+// system's. Like WithDialContext, it only applies to the default client.
+func WithResolver(resolver *net.Resolver) Option {
+	return func(o *opts) error {
+		o.resolver = resolver
+		return nil
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of the connections to repositories, and for keys, which
+// WithRootCAs and WithPinnedCerts add to. Like WithDialContext, it only applies to the default client.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(o *opts) error {
+		o.tls = cfg
+		return nil
+	}
+}
+
+// WithRootCAs sets the certificate authorities that the certificates of the servers are verified
+// against, for repositories whose certificates are issued by a private CA, instead of the system's.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(o *opts) error {
+		o.rootCAs = pool
+		return nil
+	}
+}
+
+// WithPinnedCerts only trusts servers that have one of the certificates, by their SHA-256
+// fingerprints as CertFingerprint returns them, in their verified chain, which can be the CA or the
+// certificate of the server itself. The fingerprints can also be in the colon separated form of
+// "openssl x509 -fingerprint -sha256".
+func WithPinnedCerts(fingerprints ...string) Option {
+	return func(o *opts) error {
+		for _, fingerprint := range fingerprints {
+			normalized, err := normalizeFingerprint(fingerprint)
+			if err != nil {
+				return err
+			}
+			o.pinnedCerts = append(o.pinnedCerts, normalized)
+		}
+		return nil
+	}
+}
+
+// WithRepositoryProxies sets the proxies of repositories, by their URL as in /etc/apk/repositories,
+// overriding the proxy of the environment, from HTTPS_PROXY, HTTP_PROXY and NO_PROXY, which is used
+// for everything else. The proxy of a repository also applies to the URLs under it, and ProxyDirect,
+// or an empty proxy, connects to the repository directly, e.g.
+//
+//	apk.WithRepositoryProxies(map[string]string{
+//		"https://dl-cdn.alpinelinux.org/alpine": "http://proxy.example.com:3128",
+//		"https://mirror.internal/alpine":        apk.ProxyDirect,
+//	})
+//
+// Like WithDialContext, it only applies to the default client.
+func WithRepositoryProxies(proxies map[string]string) Option {
+	return func(o *opts) error {
+		parsed, err := parseRepositoryProxies(proxies)
+		if err != nil {
+			return err
+		}
+		o.repoProxies = append(o.repoProxies, parsed...)
+		return nil
+	}
+}
+
+// WithFetchTracing logs every HTTP request at debug level, with its method, URL, the status and size
+// of the response, how long it took, and whether the cache served it, to find out why fetching is
+// slow or failing.
+func WithFetchTracing(trace bool) Option {
+	return func(o *opts) error {
+		o.traceFetches = trace
+		return nil
+	}
+}
+
+// WithBestEffort installs what it can of the world, instead of nothing, when some of it cannot be
+// resolved or fetched, such as for optional tooling. The world entries that cannot be resolved are
+// left out, as are the packages that cannot be fetched and those that depend on them, and the rest
+// is installed; the install then fails with a PartialInstallError listing what was left out. The
+// world file is kept as it is, so that the next install tries them again.
+func WithBestEffort(bestEffort bool) Option {
+	return func(o *opts) error {
+		o.bestEffort = bestEffort
+		return nil
+	}
+}
+
+// WithMirrorSelection fetches everything under the upstream of each selection from the fastest of
+// its mirrors, or the upstream itself, as probed by the time to the first byte of their responses.
+// The mirrors of a selection are probed once per process, when the first request under its upstream
+// is made, and the mirror picked is kept in the cache, if there is one, until its TTL expires. The
+// cache keeps the packages and indexes by the URLs of the upstream, whichever mirror they are from.
+func WithMirrorSelection(selections ...MirrorSelection) Option {
+	return func(o *opts) error {
+		for _, sel := range selections {
+			if len(sel.Mirrors) == 0 {
+				return fmt.Errorf("no mirrors to select from for %q", sel.Upstream)
+			}
+			_, candidates := sel.candidates()
+			for _, c := range candidates {
+				if u, err := url.Parse(c); err != nil || u.Host == "" {
+					return fmt.Errorf("invalid mirror %q", c)
+				}
+			}
 		}
+		o.mirrors = append(o.mirrors, selections...)
+		return nil
+	}
+}
+
+// WithTimestampOverride clamps the times of every file, directory and device written to the root to
+// t, typically SOURCE_DATE_EPOCH, for reproducible images: times later than t, such as those of the
+// files written during the install, become t, while the earlier times of packaged files are kept.
+// They are clamped as each file is written, so the root needs no pass over it afterwards, and the
+// directories that files are added to keep their times. The zero time does not clamp.
+func WithTimestampOverride(t time.Time) Option {
+	return func(o *opts) error {
+		o.timestampOverride = t
+		return nil
+	}
+}
+
+// WithInstallReportHandler calls handler at the end of every install of the world, such as with
+// FixateWorld or UpgradeWorld, with how long fetching, verifying and extracting each package took,
+// to find slow packages and mirrors. It is called whether the install succeeded or not, with the
+// packages that were installed.
+func WithInstallReportHandler(handler func(*InstallReport)) Option {
+	return func(o *opts) error {
+		o.installReports = handler
+		return nil
+	}
+}
+
+// WithAllowDowngrade allows FixateWorld to replace an installed package with an older version,
+// when that is what the world resolves to, e.g. because it asks for name=version explicitly.
+// Without it, the installed version is kept, as it always was, unless WithFailOnDowngrade is set.
+func WithAllowDowngrade(allow bool) Option {
+	return func(o *opts) error {
+		o.allowDowngrade = allow
+		return nil
+	}
+}
+
+// WithFailOnDowngrade makes FixateWorld fail when the world resolves to an older version of an
+// installed package, instead of keeping the installed version with a warning. It has no effect with
+// WithAllowDowngrade.
+func WithFailOnDowngrade(fail bool) Option {
+	return func(o *opts) error {
+		o.failOnDowngrade = fail
+		return nil
+	}
+}
+
+// WithProviderSelector sets a selector that chooses which package to use when several can satisfy
+// the same name, instead of relying only on provider_priority and versions.
+func WithProviderSelector(selector ProviderSelector) Option {
+	return func(o *opts) error {
+		o.providerSelector = selector
+		return nil
+	}
+}
+
+// WithResolverFunc sets how the world is resolved to the packages to install, for resolvers other than
+// PkgResolver, such as ones that solve with SAT or weigh packages by policy. The resolver is created
+// from the indexes each time the world is resolved.
+func WithResolverFunc(newResolver NewResolverFunc) Option {
+	return func(o *opts) error {
+		o.newResolver = newResolver
+		return nil
+	}
+}
+
+// WithRepositoryLayout sets the layout of the repositories in /etc/apk/repositories, for hosts that
+// do not lay out their index and packages the way the Alpine repositories do.
+// If not provided, AlpineLayout is used.
+func WithRepositoryLayout(layout RepositoryLayout) Option {
+	return func(o *opts) error {
+		o.layout = layout
+		return nil
+	}
+}
+
+// WithFsync makes FixateWorld flush the installed database to stable storage when it is written,
+// for roots that must survive a crash. It is off by default, as it slows down building images.
+func WithFsync(fsync bool) Option {
+	return func(o *opts) error {
+		o.fsync = fsync
+		return nil
+	}
+}
+
+// WithSubpackageRules sets rules that add companion subpackages, such as -doc or -dev, of the packages
+// in the world when resolving it, or leave them out. See SubpackageRule for how they are applied.
+func WithSubpackageRules(rules ...SubpackageRule) Option {
+	return func(o *opts) error {
+		o.subpackageRules = append(o.subpackageRules, rules...)
 		return nil
 	}
 }
@@ -121,3 +544,177 @@ func defaultOpts() *opts {
 		fs:                fs,
 	}
 }
+
+// validate returns an *InvalidOptionsError for the options that cannot be used, alone or together,
+// so that they fail when the APK is made, rather than partway through installing.
+func (o *opts) validate() error {
+	var problems []string
+	if o.fs == nil {
+		problems = append(problems, "no filesystem, WithFS must not be given nil")
+	}
+	if o.logger == nil {
+		problems = append(problems, "no logger, WithLogger must not be given nil")
+	}
+	if o.arch == "" {
+		problems = append(problems, "no architecture, WithArch must not be given an empty one")
+	}
+	if o.cache != nil && o.cache.offline {
+		if info, err := os.Stat(o.cache.dir); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("offline cache %s is not a directory, so has nothing to read", o.cache.dir))
+		}
+	}
+	if o.cache == nil {
+		if o.deltas {
+			problems = append(problems, "WithDeltas needs a cache, which holds the versions the deltas apply to")
+		}
+		if o.cacheClone != apkfs.NoClone {
+			problems = append(problems, "WithCacheClone needs a cache, which holds the files to clone")
+		}
+		if o.rejectKeyChanges {
+			problems = append(problems, "WithRejectKeyChanges needs a cache, where the keys seen are recorded")
+		}
+	}
+	for _, pattern := range append(append([]string(nil), o.scriptPolicy.Allow...), o.scriptPolicy.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid script policy pattern %q", pattern))
+		}
+	}
+	if o.tls != nil && o.tls.InsecureSkipVerify && (o.rootCAs != nil || len(o.pinnedCerts) > 0) {
+		problems = append(problems, "the TLS configuration skips verification, which WithRootCAs and WithPinnedCerts need")
+	}
+	if len(problems) > 0 {
+		return &InvalidOptionsError{Problems: problems}
+	}
+	return nil
+}
+
+// WithStrictIndexes fails to read repository indexes that have problems, such as malformed stanzas or
+// duplicate packages. Without it, the entries with problems are skipped, with a warning for each.
+func WithStrictIndexes(strict bool) Option {
+	return func(o *opts) error {
+		o.strictIndexes = strict
+		return nil
+	}
+}
+
+// WithMaxIndexAge warns about repository indexes built longer ago than age, as those of a mirror
+// that stopped syncing are, or, with fail, fails to read the indexes with a StaleIndexError. Indexes
+// that do not record when they were built are not checked. An age of 0 checks none.
+func WithMaxIndexAge(age time.Duration, fail bool) Option {
+	return func(o *opts) error {
+		if age < 0 {
+			return fmt.Errorf("maximum index age must not be negative: %s", age)
+		}
+		o.maxIndexAge = age
+		o.failStaleIndexes = fail
+		return nil
+	}
+}
+
+// WithKeyEventHandler calls handler with every change to the trusted keys, or to the keys that sign
+// the indexes, noticed when the indexes are read. Changes are logged as warnings either way. They are
+// noticed from one run to the next only with a cache, where the keys seen are recorded.
+func WithKeyEventHandler(handler func(KeyEvent)) Option {
+	return func(o *opts) error {
+		o.keyEventHandler = handler
+		return nil
+	}
+}
+
+// WithRejectKeyChanges fails to read the indexes, with a KeyChangeError, when the keys have changed
+// since they were last seen, instead of accepting the change. The changes go on being rejected until
+// the indexes are read once without this option.
+func WithRejectKeyChanges(reject bool) Option {
+	return func(o *opts) error {
+		o.rejectKeyChanges = reject
+		return nil
+	}
+}
+
+// WithDeltas rebuilds the packages that are upgraded or downgraded from the delta to them from the
+// cached older version, where the repository has one, at DeltaURL, rather than downloading them
+// whole. Packages that have no delta, or whose delta fails to apply, are downloaded whole. It needs
+// a cache, which holds the older versions.
+func WithDeltas(deltas bool) Option {
+	return func(o *opts) error {
+		o.deltas = deltas
+		return nil
+	}
+}
+
+// WithCacheClone installs the files of packages by cloning copies of them kept in the cache, rather
+// than copying them, when the root is a DirFS on the same filesystem as the cache, which makes
+// installing the same packages again, as repeated local builds do, much faster. Reflinks, on
+// filesystems that support them, such as btrfs and XFS, share the blocks of the files until either is
+// written to. Hardlinks make the installed files the copies in the cache themselves, so anything
+// that writes to an installed file in place, rather than replacing it, changes the cache too; the
+// files of etc/ are copied. Files that cannot be cloned, as where the root is not on the filesystem of
+// the cache, are copied from it. It needs a cache.
+func WithCacheClone(mode apkfs.CloneMode) Option {
+	return func(o *opts) error {
+		o.cacheClone = mode
+		return nil
+	}
+}
+
+// WithDedup installs the files of the same content as others installed before them, as licenses and
+// locale stubs shipped by many packages are, as hardlinks to the first of them, so that the content
+// is written once, making the root smaller and the install faster. Only files that also share their
+// mode, ownership and time are linked, as hardlinks share those too, and the files of etc/, which are
+// expected to be changed once installed, and those with extended attributes are always written. The
+// installed database lists each file as the package ships it either way.
+func WithDedup(dedup bool) Option {
+	return func(o *opts) error {
+		o.dedup = dedup
+		return nil
+	}
+}
+
+// WithRepositoryPriorities sets the priorities of repositories, by their URL as in
+// /etc/apk/repositories, without any pin. Packages are resolved from the repositories of the highest
+// priority that have them, even if others have newer versions; see WithRepositoryPriority.
+func WithRepositoryPriorities(priorities map[string]int) Option {
+	return func(o *opts) error {
+		o.repoPriorities = priorities
+		return nil
+	}
+}
+
+// WithRepositoryArches sets the architectures to fetch repositories for, by their URL as in
+// /etc/apk/repositories, without any pin, instead of that of the root, such as noarch for private
+// repositories that only publish noarch packages; see WithRepositoryArch.
+func WithRepositoryArches(arches map[string]string) Option {
+	return func(o *opts) error {
+		o.repoArches = arches
+		return nil
+	}
+}
+
+// WithShardedIndexes resolves the world from only the shards of the sharded indexes of the
+// repositories that it needs, fetching the full index only from repositories without a sharded
+// index; see GetShardedRepositoryIndexes. Subpackage rules only see the packages of the shards
+// that are fetched.
+func WithShardedIndexes(sharded bool) Option {
+	return func(o *opts) error {
+		o.shardedIndexes = sharded
+		return nil
+	}
+}
+
+// WithMemoryRepositories adds the memory repositories to those of /etc/apk/repositories, for
+// resolving and installing packages from; their packages are looked up with the function of the
+// repository rather than fetched. Repositories with the URI of one already added replace it.
+func WithMemoryRepositories(repos ...*MemoryRepository) Option {
+	return func(o *opts) error {
+		// copied, as clones share it
+		memoryRepos := make(map[string]*MemoryRepository, len(o.memoryRepos)+len(repos))
+		for uri, repo := range o.memoryRepos {
+			memoryRepos[uri] = repo
+		}
+		for _, repo := range repos {
+			memoryRepos[repo.URI()] = repo
+		}
+		o.memoryRepos = memoryRepos
+		return nil
+	}
+}
@@ -15,10 +15,12 @@
 package apk
 
 import (
-	"encoding/base64"
+	"archive/tar"
 	"fmt"
+	"io"
 	"strings"
 
+	"github.com/klauspost/compress/gzip"
 	"gitlab.alpinelinux.org/alpine/go/repository"
 )
 
@@ -35,14 +37,43 @@ func PackageToIndex(pkg *repository.Package) (out []string) {
 	out = append(out, fmt.Sprintf("D:%s", strings.Join(pkg.Dependencies, " ")))
 	out = append(out, fmt.Sprintf("p:%s", strings.Join(pkg.Provides, " ")))
 	out = append(out, fmt.Sprintf("c:%s", pkg.RepoCommit))
-	out = append(out, fmt.Sprintf("i:%s", pkg.InstallIf))
+	out = append(out, fmt.Sprintf("i:%s", strings.Join(pkg.InstallIf, " ")))
 	out = append(out, fmt.Sprintf("t:%d", pkg.BuildTime.Unix()))
 	out = append(out, fmt.Sprintf("S:%d", pkg.Size))
 	out = append(out, fmt.Sprintf("I:%d", pkg.InstalledSize))
 	out = append(out, fmt.Sprintf("k:%d", pkg.ProviderPriority))
 	if len(pkg.Checksum) > 0 {
-		out = append(out, fmt.Sprintf("C:Q1%s", base64.StdEncoding.EncodeToString(pkg.Checksum)))
+		out = append(out, fmt.Sprintf("C:%s", FormatQ1Checksum(pkg.Checksum)))
 	}
 
 	return
 }
+
+// WriteIndexArchive writes the packages as an unsigned APKINDEX.tar.gz, with the description.
+// It can be signed with signature.SignIndex once written to a file.
+func WriteIndexArchive(w io.Writer, description string, pkgs []*repository.Package) error {
+	var b strings.Builder
+	for _, pkg := range pkgs {
+		b.WriteString(strings.Join(PackageToIndex(pkg), "\n"))
+		b.WriteString("\n\n")
+	}
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	entries := []struct{ name, content string }{
+		{"DESCRIPTION", description},
+		{"APKINDEX", b.String()},
+	}
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, e.content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// ParsePackageInfo parses the .PKGINFO of a package, from its control section, into the fields of
+// an index entry. The fields that only the package file itself can provide, its size and checksum,
+// are left empty.
+func ParsePackageInfo(r io.Reader) (*repository.Package, error) {
+	values, err := parsePackageInfoValues(r)
+	if err != nil {
+		return nil, err
+	}
+	return packageFromInfo(values)
+}
+
+// PackageInfo returns the index entry of the expanded package, from the .PKGINFO in its control
+// section, along with its size and the checksum of its control section.
+func (a *APKExpanded) PackageInfo() (*repository.Package, error) {
+	f, err := os.Open(a.ControlFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values, err := controlValues(f)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := packageFromInfo(values)
+	if err != nil {
+		return nil, err
+	}
+	pkg.Size = uint64(a.Size)
+	pkg.Checksum = a.ControlHash
+	return pkg, nil
+}
+
+func packageFromInfo(values map[string][]string) (*repository.Package, error) {
+	first := func(key string) string {
+		if v := values[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	number := func(key string) (uint64, error) {
+		v := first(key)
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q in .PKGINFO: %w", key, v, err)
+		}
+		return n, nil
+	}
+
+	pkg := &repository.Package{
+		Name:         first("pkgname"),
+		Version:      first("pkgver"),
+		Arch:         first("arch"),
+		Description:  first("pkgdesc"),
+		License:      first("license"),
+		Origin:       first("origin"),
+		Maintainer:   first("maintainer"),
+		URL:          first("url"),
+		Dependencies: values["depend"],
+		Provides:     values["provides"],
+		InstallIf:    strings.Fields(strings.Join(values["install_if"], " ")),
+		RepoCommit:   first("commit"),
+		Replaces:     strings.Join(values["replaces"], " "),
+		DataHash:     first("datahash"),
+	}
+	if pkg.Name == "" || pkg.Version == "" {
+		return nil, errors.New("missing pkgname or pkgver in .PKGINFO")
+	}
+	var errs []error
+	var err error
+	pkg.InstalledSize, err = number("size")
+	errs = append(errs, err)
+	pkg.ProviderPriority, err = number("provider_priority")
+	errs = append(errs, err)
+	buildDate, err := number("builddate")
+	errs = append(errs, err)
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if buildDate > 1<<62 {
+		return nil, fmt.Errorf("invalid builddate %d in .PKGINFO", buildDate)
+	}
+	pkg.BuildDate = int64(buildDate)
+	pkg.BuildTime = time.Unix(pkg.BuildDate, 0).UTC()
+	return pkg, nil
+}
+
+// parsePackageInfoValues returns the values of a .PKGINFO by key. Keys such as depend may have several values.
+func parsePackageInfoValues(r io.Reader) (map[string][]string, error) {
+	values := map[string][]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		values[key] = append(values[key], strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read .PKGINFO: %w", err)
+	}
+	return values, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePackageInfo(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		pkg, err := ParsePackageInfo(strings.NewReader(`# Generated by abuild 3.10
+pkgname = foo
+pkgver = 1.2.3-r4
+arch = aarch64
+size = 4096
+builddate = 1690000000
+depend = so:libc.musl-aarch64.so.1
+depend = bar>=2
+provides = cmd:foo=1.2.3-r4
+replaces = old-foo
+replaces = older-foo
+datahash = abcdef
+`))
+		require.NoError(t, err)
+		require.Equal(t, "foo", pkg.Name)
+		require.Equal(t, "1.2.3-r4", pkg.Version)
+		require.Equal(t, uint64(4096), pkg.InstalledSize)
+		require.Equal(t, []string{"so:libc.musl-aarch64.so.1", "bar>=2"}, pkg.Dependencies)
+		require.Equal(t, []string{"cmd:foo=1.2.3-r4"}, pkg.Provides)
+		require.Equal(t, "old-foo older-foo", pkg.Replaces)
+		require.Equal(t, time.Unix(1690000000, 0).UTC(), pkg.BuildTime)
+		require.Equal(t, "abcdef", pkg.DataHash)
+	})
+	t.Run("missing name", func(t *testing.T) {
+		_, err := ParsePackageInfo(strings.NewReader("pkgver = 1.0-r0\n"))
+		require.Error(t, err)
+	})
+	t.Run("malformed number", func(t *testing.T) {
+		_, err := ParsePackageInfo(strings.NewReader("pkgname = foo\npkgver = 1.0-r0\nsize = big\n"))
+		require.ErrorContains(t, err, "invalid size")
+	})
+}
+
+func TestExpandedPackageInfo(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "alpine-316", "alpine-baselayout-3.2.0-r23.apk"))
+	require.NoError(t, err)
+	defer f.Close()
+	exp, err := ExpandApk(context.Background(), f, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+
+	pkg, err := exp.PackageInfo()
+	require.NoError(t, err)
+	require.Equal(t, "alpine-baselayout", pkg.Name)
+	require.Equal(t, "3.2.0-r23", pkg.Version)
+	require.Equal(t, uint64(11012), pkg.Size)
+	require.Equal(t, "Q1LLq2qDNrS/qRnhxQ3hsY/sHbQnc=", pkg.ChecksumString())
+}
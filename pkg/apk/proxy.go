@@ -0,0 +1,83 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyDirect is the proxy of WithRepositoryProxies for repositories to connect to directly, whatever
+// the environment says.
+const ProxyDirect = "direct"
+
+// repositoryProxy is the proxy of the repositories under a URL.
+type repositoryProxy struct {
+	host  string
+	path  string
+	proxy *url.URL
+}
+
+// parseRepositoryProxies parses the proxies of WithRepositoryProxies.
+func parseRepositoryProxies(proxies map[string]string) ([]repositoryProxy, error) {
+	parsed := make([]repositoryProxy, 0, len(proxies))
+	for repo, proxy := range proxies {
+		_, repoURL, err := parseRepositoryLine(repo)
+		if err != nil {
+			return nil, err
+		}
+		r, err := url.Parse(repoURL)
+		if err != nil || r.Host == "" {
+			return nil, fmt.Errorf("invalid repository %q for a proxy", repo)
+		}
+		rp := repositoryProxy{host: strings.ToLower(r.Host), path: strings.TrimSuffix(r.Path, "/")}
+		if proxy != "" && proxy != ProxyDirect {
+			if rp.proxy, err = url.Parse(proxy); err != nil || rp.proxy.Host == "" {
+				return nil, fmt.Errorf("invalid proxy %q for repository %s", proxy, repo)
+			}
+		}
+		parsed = append(parsed, rp)
+	}
+	return parsed, nil
+}
+
+// proxyFunc returns the proxy function of the default client, which uses the proxy of the repository
+// a request is for, of the longest URL that it is under, or else the proxy of fallback, which is that
+// of the environment, HTTPS_PROXY, HTTP_PROXY and NO_PROXY, for the default client.
+func proxyFunc(proxies []repositoryProxy, fallback func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		var match *repositoryProxy
+		for i, rp := range proxies {
+			if !strings.EqualFold(req.URL.Host, rp.host) {
+				continue
+			}
+			if req.URL.Path != rp.path && !strings.HasPrefix(req.URL.Path, rp.path+"/") {
+				continue
+			}
+			if match == nil || len(rp.path) > len(match.path) {
+				match = &proxies[i]
+			}
+		}
+		if match != nil {
+			return match.proxy, nil
+		}
+		if fallback == nil {
+			return nil, nil
+		}
+		return fallback(req)
+	}
+}
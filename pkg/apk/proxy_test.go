@@ -0,0 +1,68 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepositoryProxies(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "proxied "+r.URL.String())
+	}))
+	defer proxy.Close()
+
+	a, err := New(WithRepositoryProxies(map[string]string{
+		"@pinned http://repo.example/alpine": proxy.URL,
+		"http://repo.example/alpine/edge":    ProxyDirect,
+	}))
+	require.NoError(t, err)
+	res, err := a.getClient().Get("http://repo.example/alpine/v3.18/main/x86_64/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "proxied http://repo.example/alpine/v3.18/main/x86_64/APKINDEX.tar.gz", string(b))
+
+	fallback := &url.URL{Scheme: "http", Host: "env.example:3128"}
+	proxies, err := parseRepositoryProxies(map[string]string{
+		"https://repo.example/alpine":      "http://proxy.example:3128",
+		"https://repo.example/alpine/edge": "",
+	})
+	require.NoError(t, err)
+	proxyFor := proxyFunc(proxies, func(*http.Request) (*url.URL, error) { return fallback, nil })
+	for u, want := range map[string]*url.URL{
+		"https://repo.example/alpine/v3.18/main/x86_64/APKINDEX.tar.gz": {Scheme: "http", Host: "proxy.example:3128"},
+		"https://REPO.example/alpine":                                   {Scheme: "http", Host: "proxy.example:3128"},
+		"https://repo.example/alpine/edge/main/x86_64/APKINDEX.tar.gz":  nil,
+		"https://repo.example/alpine-other/APKINDEX.tar.gz":             fallback,
+		"https://keys.example/alpine/key.rsa.pub":                       fallback,
+	} {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		require.NoError(t, err)
+		got, err := proxyFor(req)
+		require.NoError(t, err)
+		require.Equal(t, want, got, u)
+	}
+
+	_, err = New(WithRepositoryProxies(map[string]string{"https://repo.example": "://"}))
+	require.Error(t, err)
+}
@@ -0,0 +1,389 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+)
+
+// ReleasesFilename is the name of the manifest of the branches of a repository tree that Publisher
+// writes at its top, as Alpine publishes releases.json.
+const ReleasesFilename = "releases.json"
+
+// Publisher publishes built packages into a tree of repositories in the layout of Alpine, as
+// <dir>/<branch>/<repo>/<arch>/, such as alpine/v3.18/main/x86_64/, each with its APKINDEX.tar.gz,
+// so that <dir>/<branch>/<repo> is a repository for /etc/apk/repositories, without abuild.
+type Publisher struct {
+	// Dir is the top of the tree, such as the directory served as https://example.com/alpine.
+	Dir string
+	// SigningKey is the RSA private key to sign the indexes with, as abuild-sign does, if any.
+	SigningKey string
+	// Description is that of the indexes, such as the version of the branch; the branch and repository
+	// if it is empty, as v3.18/main.
+	Description string
+	// Keys, if any, are the public keys by name, as with TrustedKeys, that the packages must be signed
+	// with to be published.
+	Keys map[string][]byte
+	// Logger logs what is published, which is nothing if it is nil.
+	Logger *logrus.Logger
+}
+
+// Publish copies the .apk files into the repository of the branch, into the directory of the
+// architecture of each, or of every architecture of the branch for noarch packages, replacing any
+// file of the same name. The packages are then added to the indexes of the architectures, with
+// UpdateIndexFile, without reading the packages already there again, or the indexes written from
+// every package in their directories where there are none yet, and the releases.json at the top of
+// the tree is written again with every branch. It returns the indexes that were written.
+func (p *Publisher) Publish(ctx context.Context, branch, repo string, files ...string) ([]string, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Publish")
+	defer span.End()
+
+	if err := checkPublishPath(branch, repo); err != nil {
+		return nil, err
+	}
+	log := p.Logger
+	if log == nil {
+		log = logrus.New()
+		log.SetOutput(io.Discard)
+	}
+	repoDir := filepath.Join(p.Dir, branch, repo)
+
+	type published struct {
+		file string
+		pkg  *repository.Package
+	}
+	var pkgs []published
+	arches := map[string]bool{}
+	for _, file := range files {
+		pkg, err := readPublishedPackage(ctx, file, p.Keys)
+		if err != nil {
+			return nil, err
+		}
+		pkgs = append(pkgs, published{file: file, pkg: pkg})
+		if pkg.Arch != noarch {
+			arches[pkg.Arch] = true
+		}
+	}
+	branchArches, err := p.branchArches(branch)
+	if err != nil {
+		return nil, err
+	}
+	for _, arch := range branchArches {
+		arches[arch] = true
+	}
+
+	touched := map[string][]*repository.Package{}
+	for _, pub := range pkgs {
+		targets := []string{pub.pkg.Arch}
+		if pub.pkg.Arch == noarch {
+			targets = sortedKeys(arches)
+			if len(targets) == 0 {
+				return nil, fmt.Errorf("no architectures in %s to publish noarch package %s to", branch, pub.file)
+			}
+		}
+		for _, arch := range targets {
+			dst := filepath.Join(repoDir, arch, pub.pkg.Filename())
+			if err := copyPublishedFile(pub.file, dst); err != nil {
+				return nil, err
+			}
+			log.Infof("published %s to %s", pub.pkg.Filename(), filepath.Join(branch, repo, arch))
+			touched[arch] = append(touched[arch], pub.pkg)
+		}
+	}
+
+	description := p.Description
+	if description == "" {
+		description = branch + "/" + repo
+	}
+	var indexes []string
+	for _, arch := range sortedKeys(touched) {
+		dir := filepath.Join(repoDir, arch)
+		index := filepath.Join(dir, indexFilename)
+		if _, err := os.Stat(index); err == nil {
+			err = UpdateIndexFile(ctx, index, description, p.SigningKey, touched[arch])
+			if err != nil {
+				return nil, err
+			}
+		} else if index, err = p.writeArchIndex(ctx, dir, description); err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+	if err := p.writeReleases(); err != nil {
+		return nil, err
+	}
+	return indexes, nil
+}
+
+// Remove removes the packages named by the ids, by name or by name and version, as foo-1.0-r0, from
+// every architecture of the repository of the branch, both their files and their entries in the
+// indexes, which are updated as by Publish. It returns the indexes that were written.
+func (p *Publisher) Remove(ctx context.Context, branch, repo string, ids ...string) ([]string, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Remove")
+	defer span.End()
+
+	if err := checkPublishPath(branch, repo); err != nil {
+		return nil, err
+	}
+	repoDir := filepath.Join(p.Dir, branch, repo)
+	arches, err := readDirNames(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []string
+	for _, arch := range arches {
+		index := filepath.Join(repoDir, arch, indexFilename)
+		if _, err := os.Stat(index); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		parsed, err := readIndexFile(index)
+		if err != nil {
+			return nil, err
+		}
+		removed := RemoveIndexPackages(parsed, ids...)
+		if len(removed) == 0 {
+			continue
+		}
+		if err := writeSignedIndexFile(ctx, index, p.SigningKey, parsed); err != nil {
+			return nil, err
+		}
+		for _, pkg := range removed {
+			if err := os.Remove(filepath.Join(repoDir, arch, pkg.Filename())); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// checkPublishPath checks that the branch and repository are single directories of the tree.
+func checkPublishPath(branch, repo string) error {
+	for _, name := range []string{branch, repo} {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("invalid branch %q or repository %q", branch, repo)
+		}
+	}
+	return nil
+}
+
+// readPublishedPackage returns the index entry of the .apk file, once it is verified to be signed with
+// one of the keys, if there are any.
+func readPublishedPackage(ctx context.Context, file string, keys map[string][]byte) (*repository.Package, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	exp, err := ExpandApk(ctx, f, "")
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", file, err)
+	}
+	defer exp.Close()
+	if keys != nil {
+		if _, err := VerifyPackageSignature(file, exp, keys); err != nil {
+			return nil, err
+		}
+	}
+	pkg, err := exp.PackageInfo()
+	if err != nil {
+		return nil, fmt.Errorf("reading .PKGINFO of %s: %w", file, err)
+	}
+	if pkg.Arch == "" {
+		return nil, fmt.Errorf("package %s has no architecture", file)
+	}
+	return pkg, nil
+}
+
+// branchArches returns the architectures of the repositories of the branch, from their directories.
+func (p *Publisher) branchArches(branch string) ([]string, error) {
+	repos, err := readDirNames(filepath.Join(p.Dir, branch))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, repo := range repos {
+		arches, err := readDirNames(filepath.Join(p.Dir, branch, repo))
+		if err != nil {
+			return nil, err
+		}
+		for _, arch := range arches {
+			seen[arch] = true
+		}
+	}
+	return sortedKeys(seen), nil
+}
+
+// writeArchIndex writes the index of every package in the directory of an architecture, signed with
+// the signing key, if any, and returns its path.
+func (p *Publisher) writeArchIndex(ctx context.Context, dir, description string) (string, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var pkgs []*repository.Package
+	for _, de := range des {
+		if de.IsDir() || filepath.Ext(de.Name()) != ".apk" {
+			continue
+		}
+		// already verified when they were published
+		pkg, err := readPublishedPackage(ctx, filepath.Join(dir, de.Name()), nil)
+		if err != nil {
+			return "", err
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+		c, err := CompareVersions(pkgs[i].Version, pkgs[j].Version)
+		return err == nil && c < 0
+	})
+
+	index := filepath.Join(dir, indexFilename)
+	if err := writeSignedIndexFile(ctx, index, p.SigningKey, &repository.ApkIndex{Description: description, Packages: pkgs}); err != nil {
+		return "", err
+	}
+	return index, nil
+}
+
+// writeReleases writes the manifest of the branches of the tree, their repositories and their
+// architectures, with the latest stable branch that of the highest version, as v3.18. The git
+// branches, keys and end of life dates of the manifest there was, which are not in the tree, are
+// kept.
+func (p *Publisher) writeReleases() error {
+	branches, err := readDirNames(p.Dir)
+	if err != nil {
+		return err
+	}
+	previous := map[string]ReleaseBranch{}
+	if b, err := os.ReadFile(filepath.Join(p.Dir, ReleasesFilename)); err == nil {
+		var old Releases
+		if err := json.Unmarshal(b, &old); err != nil {
+			return fmt.Errorf("parsing %s: %w", ReleasesFilename, err)
+		}
+		for _, rel := range old.ReleaseBranches {
+			previous[rel.ReleaseBranch] = rel
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	releases := Releases{ReleaseBranches: []ReleaseBranch{}}
+	all := map[string]bool{}
+	var latest string
+	for _, branch := range branches {
+		repos, err := readDirNames(filepath.Join(p.Dir, branch))
+		if err != nil {
+			return err
+		}
+		arches, err := p.branchArches(branch)
+		if err != nil {
+			return err
+		}
+		old := previous[branch]
+		rel := ReleaseBranch{Arches: arches, GitBranch: old.GitBranch, Keys: old.Keys, ReleaseBranch: branch}
+		for _, repo := range repos {
+			r := Repo{Name: repo}
+			for _, o := range old.Repos {
+				if o.Name == repo {
+					r.EOL = o.EOL
+				}
+			}
+			rel.Repos = append(rel.Repos, r)
+		}
+		for _, arch := range arches {
+			all[arch] = true
+		}
+		releases.ReleaseBranches = append(releases.ReleaseBranches, rel)
+		if version, ok := strings.CutPrefix(branch, "v"); ok {
+			if c, err := CompareVersions(version, strings.TrimPrefix(latest, "v")); latest == "" || (err == nil && c > 0) {
+				latest = branch
+			}
+		}
+	}
+	releases.Architectures = sortedKeys(all)
+	releases.LatestStable = latest
+
+	b, err := json.MarshalIndent(releases, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(p.Dir, ReleasesFilename), append(b, '\n'), 0o644)
+}
+
+// copyPublishedFile copies the file to dst, through a temporary file, so that the repository never
+// has a partial package.
+func copyPublishedFile(src, dst string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".publish-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return fmt.Errorf("copying %s: %w", src, err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// readDirNames returns the names of the directories in dir, sorted, or none if it does not exist.
+func readDirNames(dir string) ([]string, error) {
+	des, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, de := range des {
+		if de.IsDir() {
+			names = append(names, de.Name())
+		}
+	}
+	return names, nil
+}
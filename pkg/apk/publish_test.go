@@ -0,0 +1,122 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestPublisher(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	build := func(name, version, arch string) string {
+		file := filepath.Join(src, name+"-"+version+"."+arch+".apk")
+		writeTestAPK(t, file, &repository.Package{Name: name, Version: version, Arch: arch}, map[string]string{"usr/share/" + name: version})
+		return file
+	}
+	keyFile, pub := testSigningKey(t, "publish.rsa")
+	dir := t.TempDir()
+	p := &Publisher{Dir: dir, SigningKey: keyFile}
+
+	_, err := p.Publish(ctx, "v3.18", "main", build("data", "1.0-r0", noarch))
+	require.ErrorContains(t, err, "no architectures")
+
+	indexes, err := p.Publish(ctx, "v3.18", "main", build("foo", "1.0-r0", "x86_64"), build("foo", "1.0-r0", testArch))
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "v3.18", "main", testArch, indexFilename),
+		filepath.Join(dir, "v3.18", "main", "x86_64", indexFilename),
+	}, indexes)
+
+	// noarch packages go to every architecture of the branch, older packages stay indexed
+	indexes, err = p.Publish(ctx, "v3.18", "community", build("data", "1.0-r0", noarch), build("bar", "2.0-r0", "x86_64"))
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+	_, err = p.Publish(ctx, "v3.18", "main", build("foo", "1.1-r0", "x86_64"))
+	require.NoError(t, err)
+	_, err = p.Publish(ctx, "v3.9", "main", build("foo", "0.9-r0", "x86_64"))
+	require.NoError(t, err)
+
+	index := func(branch, repo, arch string) []string {
+		b, err := os.ReadFile(filepath.Join(dir, branch, repo, arch, indexFilename))
+		require.NoError(t, err)
+		_, err = verifyIndexSignature(b, branch+"/"+repo, map[string][]byte{"publish.rsa.pub": pub})
+		require.NoError(t, err)
+		parsed, _, err := parseIndexArchive(b, "", "")
+		require.NoError(t, err)
+		require.Equal(t, branch+"/"+repo, parsed.Description)
+		var ids []string
+		for _, pkg := range parsed.Packages {
+			ids = append(ids, pkg.Name+"-"+pkg.Version)
+		}
+		return ids
+	}
+	require.Equal(t, []string{"foo-1.0-r0", "foo-1.1-r0"}, index("v3.18", "main", "x86_64"))
+	require.Equal(t, []string{"foo-1.0-r0"}, index("v3.18", "main", testArch))
+	require.Equal(t, []string{"bar-2.0-r0", "data-1.0-r0"}, index("v3.18", "community", "x86_64"))
+	require.Equal(t, []string{"data-1.0-r0"}, index("v3.18", "community", testArch))
+
+	b, err := os.ReadFile(filepath.Join(dir, ReleasesFilename))
+	require.NoError(t, err)
+	var releases Releases
+	require.NoError(t, json.Unmarshal(b, &releases))
+	require.Equal(t, "v3.18", releases.LatestStable)
+	require.Equal(t, []string{testArch, "x86_64"}, releases.Architectures)
+	require.Len(t, releases.ReleaseBranches, 2)
+	rel := releases.GetReleaseBranch("v3.18")
+	require.NotNil(t, rel)
+	require.Equal(t, []string{testArch, "x86_64"}, rel.Arches)
+	require.Equal(t, []Repo{{Name: "community"}, {Name: "main"}}, rel.Repos)
+	require.Equal(t, []string{"x86_64"}, releases.GetReleaseBranch("v3.9").Arches)
+
+	// what the tree does not tell is kept
+	releases.ReleaseBranches[0].GitBranch = "3.18-stable"
+	b, err = json.Marshal(releases)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ReleasesFilename), b, 0o644))
+	_, err = p.Publish(ctx, "v3.18", "main", build("foo", "1.2-r0", testArch))
+	require.NoError(t, err)
+	b, err = os.ReadFile(filepath.Join(dir, ReleasesFilename))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &releases))
+	require.Equal(t, "3.18-stable", releases.GetReleaseBranch("v3.18").GitBranch)
+
+	indexes, err = p.Publish(ctx, "v3.18", "main")
+	require.NoError(t, err)
+	require.Empty(t, indexes)
+	indexes, err = p.Remove(ctx, "v3.18", "main", "foo-1.0-r0")
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+	require.Equal(t, []string{"foo-1.1-r0"}, index("v3.18", "main", "x86_64"))
+	require.Equal(t, []string{"foo-1.2-r0"}, index("v3.18", "main", testArch))
+	require.NoFileExists(t, filepath.Join(dir, "v3.18", "main", "x86_64", "foo-1.0-r0.apk"))
+	require.FileExists(t, filepath.Join(dir, "v3.18", "main", "x86_64", "foo-1.1-r0.apk"))
+	indexes, err = p.Remove(ctx, "v3.18", "community", "data")
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+	require.Equal(t, []string{"bar-2.0-r0"}, index("v3.18", "community", "x86_64"))
+
+	_, err = (&Publisher{Dir: dir, Keys: map[string][]byte{"publish.rsa.pub": pub}}).Publish(ctx, "v3.18", "main", build("baz", "1.0-r0", "x86_64"))
+	require.Error(t, err)
+	_, err = p.Publish(ctx, "..", "main")
+	require.Error(t, err)
+}
@@ -63,6 +63,9 @@ func (c *DateTime) UnmarshalJSON(b []byte) error {
 }
 
 func (c DateTime) MarshalJSON() ([]byte, error) {
+	if c.IsZero() {
+		return []byte("null"), nil
+	}
 	return []byte(`"` + c.Format("2006-01-02") + `"`), nil
 }
 
@@ -19,13 +19,18 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
-	"github.com/hashicorp/go-retryablehttp"
 	"gitlab.alpinelinux.org/alpine/go/repository"
 	"go.opentelemetry.io/otel"
+
+	"github.com/chainguard-dev/go-apk/pkg/version"
 )
 
 // NamedIndex an index that contains all of its packages,
@@ -47,8 +52,12 @@ func indexNames(indexes []NamedIndex) []string {
 }
 
 type namedRepositoryWithIndex struct {
-	name string
-	repo *repository.RepositoryWithIndex
+	name     string
+	repo     *repository.RepositoryWithIndex
+	problems []IndexProblem
+	signer   string
+	priority int
+	built    time.Time
 }
 
 func NewNamedRepositoryWithIndex(name string, repo *repository.RepositoryWithIndex) NamedIndex {
@@ -75,6 +84,64 @@ func (n *namedRepositoryWithIndex) Packages() []*repository.RepositoryPackage {
 	}
 	return n.repo.Packages()
 }
+
+// Problems returns the problems that were skipped when the index was parsed.
+func (n *namedRepositoryWithIndex) Problems() []IndexProblem {
+	return n.problems
+}
+
+// Signer returns the name of the key whose signature of the index was verified.
+func (n *namedRepositoryWithIndex) Signer() string {
+	return n.signer
+}
+
+// Priority returns the priority of the repository, set with WithRepositoryPriority.
+func (n *namedRepositoryWithIndex) Priority() int {
+	return n.priority
+}
+
+// IndexPriority returns the priority of the repository of the index, set with WithRepositoryPriority.
+// It is 0 for indexes from elsewhere.
+func IndexPriority(index NamedIndex) int {
+	if p, ok := index.(interface{ Priority() int }); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
+// Built returns the time the index was built, as recorded in its archive, or the zero time if it is
+// not known.
+func (n *namedRepositoryWithIndex) Built() time.Time {
+	return n.built
+}
+
+// IndexBuilt returns the time the index was built, from the header of the APKINDEX in its archive. It
+// is the zero time for indexes from elsewhere, or whose archive does not record it. For a sharded
+// index, it is the time of the oldest of the shards fetched.
+func IndexBuilt(index NamedIndex) time.Time {
+	if b, ok := index.(interface{ Built() time.Time }); ok {
+		return b.Built()
+	}
+	return time.Time{}
+}
+
+// Description returns the description of the repository, from the DESCRIPTION file of its index.
+func (n *namedRepositoryWithIndex) Description() string {
+	if n.repo == nil || n.repo.IndexObj == nil {
+		return ""
+	}
+	return n.repo.IndexObj.Description
+}
+
+// IndexDescription returns the description of the repository of the index, from the DESCRIPTION file
+// of its archive, such as "v3.18.4-123-gabcdef" for Alpine. It is empty for indexes from elsewhere.
+func IndexDescription(index NamedIndex) string {
+	if d, ok := index.(interface{ Description() string }); ok {
+		return d.Description()
+	}
+	return ""
+}
+
 func (n *namedRepositoryWithIndex) Source() string {
 	if n.repo == nil || n.repo.IndexUri() == "" {
 		return ""
@@ -88,6 +155,9 @@ func (n *namedRepositoryWithIndex) Source() string {
 type repositoryPackage struct {
 	*repository.RepositoryPackage
 	pinnedName string
+	// priority is that of the repository, and order its position in the list of indexes.
+	priority int
+	order    int
 }
 
 // SetRepositories sets the contents of /etc/apk/repositories file.
@@ -127,14 +197,27 @@ func (a *APK) GetRepositories() (repos []string, err error) {
 // GetRepositoryIndexes returns the indexes for the repositories in the specified root.
 // The signatures for each index are verified unless ignoreSignatures is set to true.
 func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) ([]NamedIndex, error) {
+	return a.getRepositoryIndexes(ctx, ignoreSignatures, nil)
+}
+
+// getRepositoryIndexes gets the indexes of the repositories or, with WithShardedIndexes and names to
+// resolve, only what is needed of them to resolve the names.
+func (a *APK) getRepositoryIndexes(ctx context.Context, ignoreSignatures bool, names []string) ([]NamedIndex, error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "getRepositoryIndexes")
 	defer span.End()
 
 	// get the repository URLs
-	repos, err := a.GetRepositories()
+	lines, err := a.GetRepositories()
 	if err != nil {
 		return nil, err
 	}
+	// a root with only memory repositories has an empty repositories file, as written by InitDB
+	repos := make([]string, 0, len(lines))
+	for _, repo := range lines {
+		if repo != "" {
+			repos = append(repos, repo)
+		}
+	}
 
 	archFile, err := a.fs.Open(archFilePath)
 	if err != nil {
@@ -147,31 +230,121 @@ func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) (
 	// trim the newline
 	arch := strings.TrimSuffix(string(archB), "\n")
 
-	// create the list of keys
-	keys := make(map[string][]byte)
-	dir, err := a.fs.ReadDir(keysDirPath)
+	httpClient := a.getClient()
+	if a.cache != nil {
+		httpClient = a.cacheClient(httpClient, true)
+	}
+	keys, err := a.loadKeys(ctx, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	options := []IndexOption{WithIgnoreSignatures(ignoreSignatures), WithHTTPClient(httpClient), WithLayout(a.layout), WithStrictIndex(a.strictIndexes)}
+	if a.cache != nil {
+		options = append(options, WithIndexCacheDir(a.cache.dir))
+	}
+	for repo, priority := range a.repoPriorities {
+		options = append(options, WithRepositoryPriority(repo, priority))
+	}
+	for repo, repoArch := range a.repoArches {
+		options = append(options, WithRepositoryArch(repo, repoArch))
+	}
+	var indexes []NamedIndex
+	if a.shardedIndexes && names != nil {
+		indexes, err = GetShardedRepositoryIndexes(ctx, repos, keys, arch, names, options...)
+	} else {
+		indexes, err = GetRepositoryIndexes(ctx, repos, keys, arch, options...)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("could not read keys directory in %s at %s: %w", a.fs, keysDirPath, err)
+		return nil, err
+	}
+	for _, uri := range sortedKeys(a.memoryRepos) {
+		indexes = append(indexes, a.memoryRepos[uri])
+	}
+	for _, index := range indexes {
+		for _, problem := range IndexProblems(index) {
+			a.logger.Warnf("skipping entry of repository index: %s", problem)
+		}
 	}
-	for _, d := range dir {
-		if d.IsDir() {
+	if err := a.checkIndexAges(indexes); err != nil {
+		return nil, err
+	}
+	if err := a.checkKeyring(indexes, keys); err != nil {
+		return nil, err
+	}
+	return indexes, nil
+}
+
+// checkIndexAges reports the indexes built longer ago than allowed by WithMaxIndexAge, warning about
+// each, or failing with a StaleIndexError for all of them.
+func (a *APK) checkIndexAges(indexes []NamedIndex) error {
+	if a.maxIndexAge == 0 {
+		return nil
+	}
+	var stale []StaleIndex
+	for _, index := range indexes {
+		built := IndexBuilt(index)
+		if built.IsZero() {
 			continue
 		}
-		fullPath := filepath.Join(keysDirPath, d.Name())
-		b, err := a.fs.ReadFile(fullPath)
-		if err != nil {
-			return nil, fmt.Errorf("could not read key file at %s: %w", fullPath, err)
+		if age := time.Since(built); age > a.maxIndexAge {
+			stale = append(stale, StaleIndex{Index: index.Source(), Built: built})
+			if !a.failStaleIndexes {
+				a.logger.Warnf("repository index %s was built %s ago, more than the maximum of %s", index.Source(), age.Round(time.Second), a.maxIndexAge)
+			}
 		}
-		keys[d.Name()] = b
 	}
-	httpClient := a.client
-	if httpClient == nil {
-		httpClient = retryablehttp.NewClient().StandardClient()
+	if len(stale) > 0 && a.failStaleIndexes {
+		return &StaleIndexError{MaxAge: a.maxIndexAge, Stale: stale}
 	}
-	if a.cache != nil {
-		httpClient = a.cache.client(httpClient, true)
+	return nil
+}
+
+// loadKeys returns the trusted keys, keyed by name, from the keys directory, any additional
+// keyring directories, and any keyring URLs.
+func (a *APK) loadKeys(ctx context.Context, httpClient *http.Client) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, keysDir := range append([]string{keysDirPath}, a.keyringDirs...) {
+		keysDir = strings.TrimPrefix(keysDir, "/")
+		dir, err := a.fs.ReadDir(keysDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not read keys directory in %s at %s: %w", a.fs, keysDir, err)
+		}
+		for _, d := range dir {
+			if d.IsDir() {
+				continue
+			}
+			fullPath := filepath.Join(keysDir, d.Name())
+			b, err := a.fs.ReadFile(fullPath)
+			if err != nil {
+				return nil, fmt.Errorf("could not read key file at %s: %w", fullPath, err)
+			}
+			keys[d.Name()] = b
+		}
 	}
-	return GetRepositoryIndexes(ctx, repos, keys, arch, WithIgnoreSignatures(ignoreSignatures), WithHTTPClient(httpClient))
+	for _, u := range a.keyringURLs {
+		asURL, err := url.Parse(u)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse keyring URL %s: %w", u, err)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, asURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch key %s: %w", u, err)
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unable to get key at %s: %v", u, res.Status)
+		}
+		b, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %w", u, err)
+		}
+		keys[path.Base(asURL.Path)] = b
+	}
+	return keys, nil
 }
 
 // PkgResolver resolves packages from a list of indexes.
@@ -191,8 +364,41 @@ type PkgResolver struct {
 
 	parsedVersions map[string]packageVersion
 	depForVersion  map[string]pinStuff
+	// providedVersions maps each package to the names it provides, e.g. so: and cmd: entries,
+	// and the version of each, so that matching a dependency does not scan the provides list.
+	providedVersions map[*repository.RepositoryPackage]map[string]string
+
+	providerSelector ProviderSelector
+}
+
+// ProviderSelector chooses between several packages that can satisfy the same name, e.g. cmd:awk.
+// The providers are sorted in the order of preference the resolver would otherwise use, with the
+// first being its choice. The selector must return one of them, or nil to keep the resolver's choice.
+type ProviderSelector func(name string, providers []*repository.RepositoryPackage) *repository.RepositoryPackage
+
+// SetProviderSelector sets the selector to consult when more than one package can satisfy a name.
+func (p *PkgResolver) SetProviderSelector(selector ProviderSelector) {
+	p.providerSelector = selector
+}
+
+// Resolver resolves packages, as they are written in the world such as foo, !foo or foo>=1.2.
+// PkgResolver is the Resolver unless another is set with WithResolverFunc.
+type Resolver interface {
+	// GetPackagesWithDependencies resolves the packages to those to install with all of their
+	// dependencies, and the conflicts of those: their dependencies without the leading !, which must
+	// not be installed. The packages need not be in the order they are to be installed in, which is
+	// worked out after.
+	GetPackagesWithDependencies(ctx context.Context, packages []string) (toInstall []*repository.RepositoryPackage, conflicts []string, err error)
+	// ResolvePackage resolves a single package, or name it provides, to the packages that can satisfy
+	// it, the one to use first.
+	ResolvePackage(pkgName string) ([]*repository.RepositoryPackage, error)
 }
 
+var _ Resolver = (*PkgResolver)(nil)
+
+// NewResolverFunc creates a Resolver of the packages of the indexes.
+type NewResolverFunc func(ctx context.Context, indexes []NamedIndex) (Resolver, error)
+
 // NewPkgResolver creates a new pkgResolver from a list of indexes.
 // The indexes are anything that implements NamedIndex.
 func NewPkgResolver(ctx context.Context, indexes []NamedIndex) *PkgResolver {
@@ -210,26 +416,25 @@ func NewPkgResolver(ctx context.Context, indexes []NamedIndex) *PkgResolver {
 		installIfMap   = map[string][]*repositoryPackage{}
 	)
 	p := &PkgResolver{
-		indexes:        indexes,
-		parsedVersions: map[string]packageVersion{},
-		depForVersion:  map[string]pinStuff{},
+		indexes:          indexes,
+		parsedVersions:   map[string]packageVersion{},
+		depForVersion:    map[string]pinStuff{},
+		providedVersions: make(map[*repository.RepositoryPackage]map[string]string, numPackages),
 	}
 
 	// create a map of every package by name and version to its RepositoryPackage
-	for _, index := range indexes {
+	for i, index := range indexes {
+		priority := IndexPriority(index)
 		for _, pkg := range index.Packages() {
-			pkgNameMap[pkg.Name] = append(pkgNameMap[pkg.Name], &repositoryPackage{
+			named := &repositoryPackage{
 				RepositoryPackage: pkg,
 				pinnedName:        index.Name(),
-			})
+				priority:          priority,
+				order:             i,
+			}
+			pkgNameMap[pkg.Name] = append(pkgNameMap[pkg.Name], named)
 			for _, dep := range pkg.InstallIf {
-				if _, ok := installIfMap[dep]; !ok {
-					installIfMap[dep] = []*repositoryPackage{}
-				}
-				installIfMap[dep] = append(installIfMap[dep], &repositoryPackage{
-					RepositoryPackage: pkg,
-					pinnedName:        index.Name(),
-				})
+				installIfMap[dep] = append(installIfMap[dep], named)
 			}
 		}
 	}
@@ -240,12 +445,8 @@ func NewPkgResolver(ctx context.Context, indexes []NamedIndex) *PkgResolver {
 	}
 	for _, pkgVersions := range allPkgs {
 		for _, pkg := range pkgVersions {
-			for _, provide := range pkg.Provides {
-				name := p.resolvePackageNameVersionPin(provide).name
+			for name := range p.providedNames(pkg.RepositoryPackage) {
 				pkgNameMap[name] = append(pkgNameMap[name], pkg)
-				if _, ok := pkgProvidesMap[name]; !ok {
-					pkgProvidesMap[name] = []*repositoryPackage{}
-				}
 				pkgProvidesMap[name] = append(pkgProvidesMap[name], pkg)
 			}
 		}
@@ -257,11 +458,24 @@ func NewPkgResolver(ctx context.Context, indexes []NamedIndex) *PkgResolver {
 }
 
 // GetPackagesWithDependencies get all of the dependencies for the given packages based on the
-// indexes. Does not filter for installed already or not.
+// indexes. Does not filter for installed already or not. Packages given as !name, as in the world
+// of apk-tools, are not to be installed: it is an error for any of the others to need them, and they
+// are returned among the conflicts.
 func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages []string) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
 	_, span := otel.Tracer("go-apk").Start(ctx, "GetPackageWithDependencies")
 	defer span.End()
 
+	var forbidden []string
+	wanted := make([]string, 0, len(packages))
+	for _, pkgName := range packages {
+		if strings.HasPrefix(pkgName, "!") {
+			forbidden = append(forbidden, pkgName[1:])
+			continue
+		}
+		wanted = append(wanted, pkgName)
+	}
+	packages = wanted
+
 	var (
 		dependenciesMap = make(map[string]*repository.RepositoryPackage, len(packages))
 		installTracked  = map[string]*repository.RepositoryPackage{}
@@ -303,11 +517,62 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 		conflicts = append(conflicts, confs...)
 	}
 
+	for _, conflict := range forbidden {
+		stuff := p.resolvePackageNameVersionPin(conflict)
+		conflict = stuff.name + stuff.constraint()
+		for _, pkg := range toInstall {
+			if conflictMatches(conflict, pkg.Package) {
+				return nil, nil, fmt.Errorf("cannot install %s, as !%s forbids it", pkg.Name, conflict)
+			}
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	// nor may any of them conflict with another
+	for _, pkg := range toInstall {
+		for _, dep := range pkg.Dependencies {
+			if !strings.HasPrefix(dep, "!") {
+				continue
+			}
+			for _, other := range toInstall {
+				if other != pkg && conflictMatches(dep[1:], other.Package) {
+					return nil, nil, fmt.Errorf("cannot install %s %s, as %s %s conflicts with it (%s)", other.Name, other.Version, pkg.Name, pkg.Version, dep)
+				}
+			}
+		}
+	}
 	conflicts = uniqify(conflicts)
 
 	return toInstall, conflicts, nil
 }
 
+// conflictMatches reports whether the package is what the conflict, a dependency without its leading
+// !, is with: the package of its name, or one that provides its name, at a version that satisfies its
+// version constraint, if any. Nothing matches a conflict that cannot be parsed.
+func conflictMatches(conflict string, pkg *repository.Package) bool {
+	dep, err := version.ParseDependency(conflict)
+	if err != nil {
+		return false
+	}
+	if pkg.Name == dep.Name {
+		ok, err := dep.Matches(pkg.Version)
+		return err == nil && ok
+	}
+	for _, prov := range pkg.Provides {
+		provided, err := version.ParseDependency(prov)
+		if err != nil || provided.Name != dep.Name {
+			continue
+		}
+		providedVersion := provided.Version
+		if providedVersion == "" {
+			providedVersion = pkg.Version
+		}
+		if ok, err := dep.Matches(providedVersion); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
 // GetPackageWithDependencies get all of the dependencies for a single package as well as looking
 // up the package itself and resolving its version, based on the indexes.
 // Requires the existing set because the logic for resolving dependencies between competing
@@ -399,6 +664,7 @@ func (p *PkgResolver) ResolvePackage(pkgName string) ([]*repository.RepositoryPa
 			return nil, fmt.Errorf("could not find package %s in indexes", pkgName)
 		}
 		p.sortPackages(packages, nil, name, nil, pin)
+		p.selectProvider(name, packages)
 	} else {
 		providers, ok := p.providesMap[name]
 		if !ok || len(providers) == 0 {
@@ -406,6 +672,7 @@ func (p *PkgResolver) ResolvePackage(pkgName string) ([]*repository.RepositoryPa
 		}
 		// we are going to do this in reverse order
 		p.sortPackages(providers, nil, name, nil, "")
+		p.selectProvider(name, providers)
 		packages = providers
 	}
 	pkgs := make([]*repository.RepositoryPackage, 0, len(packages))
@@ -415,6 +682,30 @@ func (p *PkgResolver) ResolvePackage(pkgName string) ([]*repository.RepositoryPa
 	return pkgs, nil
 }
 
+// Repositories returns the repositories that have a package of the name, in the order of the indexes.
+// When there are several, the package resolved is the one of the highest priority repository, then of
+// the highest version, then of the repository listed first, unless the name is pinned to a repository.
+func (p *PkgResolver) Repositories(name string) []string {
+	var repos []string
+	seen := map[int]bool{}
+	for _, pkg := range p.nameMap[name] {
+		if pkg.Name != name || seen[pkg.order] {
+			continue
+		}
+		seen[pkg.order] = true
+		repos = append(repos, packageRepository(pkg.RepositoryPackage))
+	}
+	return repos
+}
+
+// packageRepository returns the URL of the repository of the package, or "" if it has none.
+func packageRepository(pkg *repository.RepositoryPackage) string {
+	if repo := pkg.Repository(); repo != nil && repo.Repository != nil {
+		return repo.Uri
+	}
+	return ""
+}
+
 // getPackageDependencies get all of the dependencies for a single package based on the
 // indexes. Internal version includes passed arg for preventing infinite loops.
 // checked map is passed as an arg, rather than a member of the struct, because
@@ -448,13 +739,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *repository.RepositoryPackage,
 	if _, ok := parents[pkg.Name]; ok {
 		return nil, nil, nil
 	}
-	myProvides := make(map[string]bool, 2*len(pkg.Provides))
-	// see if we provide this
-	for _, provide := range pkg.Provides {
-		name := p.resolvePackageNameVersionPin(provide).name
-		myProvides[provide] = true
-		myProvides[name] = true
-	}
+	myProvides := p.providedNames(pkg)
 
 	// each dependency has only one of two possibilities:
 	// - !name     - "I cannot be installed along with the package <name>"
@@ -473,7 +758,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *repository.RepositoryPackage,
 		stuff := p.resolvePackageNameVersionPin(dep)
 		name, version, compare := stuff.name, stuff.version, stuff.dep
 		// see if we provide this
-		if myProvides[name] || myProvides[dep] {
+		if _, ok := myProvides[name]; ok {
 			// we provide this, so skip it
 			continue
 		}
@@ -510,6 +795,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *repository.RepositoryPackage,
 				return nil, nil, fmt.Errorf("could not find package %s in indexes", dep)
 			}
 			p.sortPackages(pkgs, nil, name, existing, "")
+			p.selectProvider(name, pkgs)
 			depPkg = pkgs[0].RepositoryPackage
 		} else {
 			// it was not the name of a package, see if some package provides this
@@ -541,6 +827,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *repository.RepositoryPackage,
 			}
 			// we are going to do this in reverse order
 			p.sortPackages(providers, pkg, name, existing, "")
+			p.selectProvider(name, providers)
 			depPkg = providers[0].RepositoryPackage
 		}
 		// and then recurse to its children
@@ -603,6 +890,10 @@ func (p *PkgResolver) resolvePackageNameVersionPin(pkgName string) pinStuff {
 // are named "a", but others that provided "a". In that case, we should look not at the
 // version of the package, but the version of "a" that the package provides.
 func (p *PkgResolver) sortPackages(pkgs []*repositoryPackage, compare *repository.RepositoryPackage, name string, existing map[string]*repository.RepositoryPackage, pin string) { //nolint:gocyclo
+	// most names have a single candidate, and there is nothing to sort
+	if len(pkgs) < 2 {
+		return
+	}
 	// get existing origins
 	existingOrigins := make(map[string]bool, len(existing))
 	for _, pkg := range existing {
@@ -610,7 +901,7 @@ func (p *PkgResolver) sortPackages(pkgs []*repositoryPackage, compare *repositor
 			existingOrigins[pkg.Origin] = true
 		}
 	}
-	sort.Slice(pkgs, func(i, j int) bool {
+	sort.SliceStable(pkgs, func(i, j int) bool {
 		// determine versions
 		iVersionStr := p.getDepVersionForName(pkgs[i], name)
 		jVersionStr := p.getDepVersionForName(pkgs[j], name)
@@ -666,6 +957,10 @@ func (p *PkgResolver) sortPackages(pkgs []*repositoryPackage, compare *repositor
 		if pkgs[i].pinnedName != pin && pkgs[j].pinnedName == pin {
 			return false
 		}
+		// check repository priority
+		if pkgs[i].priority != pkgs[j].priority {
+			return pkgs[i].priority > pkgs[j].priority
+		}
 		// check provider priority
 		if pkgs[i].ProviderPriority != pkgs[j].ProviderPriority {
 			return pkgs[i].ProviderPriority > pkgs[j].ProviderPriority
@@ -700,10 +995,42 @@ func (p *PkgResolver) sortPackages(pkgs []*repositoryPackage, compare *repositor
 			}
 		}
 		// if versions are equal, compare names
-		return pkgs[i].Name < pkgs[j].Name
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+		// the same package in several repositories: the first listed wins
+		return pkgs[i].order < pkgs[j].order
 	})
 }
 
+// selectProvider consults the provider selector, if any, when the sorted pkgs come from more than one
+// package, and moves its choice to the front.
+func (p *PkgResolver) selectProvider(name string, pkgs []*repositoryPackage) {
+	if p.providerSelector == nil || len(pkgs) < 2 {
+		return
+	}
+	names := map[string]bool{}
+	providers := make([]*repository.RepositoryPackage, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		names[pkg.Name] = true
+		providers = append(providers, pkg.RepositoryPackage)
+	}
+	if len(names) < 2 {
+		return
+	}
+	selected := p.providerSelector(name, providers)
+	if selected == nil {
+		return
+	}
+	for i, pkg := range pkgs {
+		if pkg.RepositoryPackage == selected {
+			copy(pkgs[1:i+1], pkgs[:i])
+			pkgs[0] = pkg
+			return
+		}
+	}
+}
+
 // getDepVersionForName get the version of the package that provides the given name.
 // If the name matches the package name, then the version of the package is used;
 // if it does not, then the version of the provides is used.
@@ -717,15 +1044,31 @@ func (p *PkgResolver) getDepVersionForName(pkg *repositoryPackage, name string)
 	if name == "" || name == pkg.Name {
 		return pkg.Version
 	}
+	return p.providedNames(pkg.RepositoryPackage)[name]
+}
+
+// providedNames returns the names the package provides, each mapped to the version it is
+// provided at, which is the version of the package itself unless the provides entry sets one.
+// The result is computed once per package and must not be modified.
+func (p *PkgResolver) providedNames(pkg *repository.RepositoryPackage) map[string]string {
+	if provided, ok := p.providedVersions[pkg]; ok {
+		return provided
+	}
+	provided := make(map[string]string, len(pkg.Provides))
 	for _, prov := range pkg.Provides {
 		stuff := p.resolvePackageNameVersionPin(prov)
-		pName, pVersion := stuff.name, stuff.version
-		if pVersion == "" {
-			pVersion = pkg.Version
+		if _, ok := provided[stuff.name]; ok {
+			continue
 		}
-		if pName == name {
-			return pVersion
+		version := stuff.version
+		if version == "" {
+			version = pkg.Version
 		}
+		provided[stuff.name] = version
 	}
-	return ""
+	if p.providedVersions == nil {
+		p.providedVersions = map[*repository.RepositoryPackage]map[string]string{}
+	}
+	p.providedVersions[pkg] = provided
+	return provided
 }
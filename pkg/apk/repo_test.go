@@ -15,6 +15,9 @@
 package apk
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io/fs"
@@ -26,6 +29,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"gitlab.alpinelinux.org/alpine/go/repository"
@@ -714,3 +718,275 @@ func testNamedPackageFromVersionAndPin(version, pin string) *repositoryPackage {
 		pinnedName:        pin,
 	}
 }
+
+func TestAdditionalKeyrings(t *testing.T) {
+	prepLayout := func(t *testing.T, keysDir string, options ...Option) *APK {
+		src := apkfs.NewMemFS()
+		require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+		require.NoError(t, src.MkdirAll(keysDir, 0o755))
+		require.NoError(t, src.WriteFile(archFilePath, []byte(testArch+"\n"), 0o644))
+		require.NoError(t, src.WriteFile(reposFilePath, []byte(testAlpineRepos), 0o644))
+		for k, v := range testKeys {
+			require.NoError(t, src.WriteFile(filepath.Join(keysDir, k), []byte(v), 0o644))
+		}
+		a, err := New(append([]Option{WithFS(src)}, options...)...)
+		require.NoError(t, err, "unable to create APK")
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		})
+		return a
+	}
+	t.Run("keys outside the default keyring are not trusted", func(t *testing.T) {
+		a := prepLayout(t, "usr/share/apk/keys")
+		_, err := a.GetRepositoryIndexes(context.TODO(), false)
+		require.Error(t, err)
+	})
+	t.Run("additional keyring dir", func(t *testing.T) {
+		a := prepLayout(t, "usr/share/apk/keys", WithKeyringDirs("/usr/share/apk/keys"))
+		indexes, err := a.GetRepositoryIndexes(context.TODO(), false)
+		require.NoError(t, err)
+		require.Greater(t, len(indexes), 0, "no indexes found")
+	})
+	t.Run("missing keyring dir", func(t *testing.T) {
+		a := prepLayout(t, keysDirPath, WithKeyringDirs("does/not/exist"))
+		_, err := a.GetRepositoryIndexes(context.TODO(), false)
+		require.Error(t, err)
+	})
+	t.Run("keyring url", func(t *testing.T) {
+		a := prepLayout(t, "unused", WithKeyringURLs("https://example.com/alpine-devel@lists.alpinelinux.org-4a6a0840.rsa.pub"))
+		keys, err := a.loadKeys(context.TODO(), a.client)
+		require.NoError(t, err)
+		require.Contains(t, keys, "alpine-devel@lists.alpinelinux.org-4a6a0840.rsa.pub")
+	})
+}
+
+func TestProviderSelector(t *testing.T) {
+	ctx := context.Background()
+	repo := repository.Repository{}
+	index := repo.WithIndex(&repository.ApkIndex{
+		Packages: []*repository.Package{
+			{Name: "busybox", Version: "1.36.0-r0", Provides: []string{"cmd:awk"}, ProviderPriority: 100},
+			{Name: "gawk", Version: "5.2.0-r0", Provides: []string{"cmd:awk"}, ProviderPriority: 10},
+			{Name: "my-awk", Version: "1.0.0-r0", Origin: "myorg", Provides: []string{"cmd:awk"}},
+			{Name: "app", Version: "1.0.0-r0", Dependencies: []string{"cmd:awk"}},
+		},
+	})
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{index})
+
+	resolver := NewPkgResolver(ctx, indexes)
+	pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, "busybox", pkgs[0].Name)
+
+	var offered []string
+	resolver = NewPkgResolver(ctx, indexes)
+	resolver.SetProviderSelector(func(name string, providers []*repository.RepositoryPackage) *repository.RepositoryPackage {
+		offered = offered[:0]
+		for _, p := range providers {
+			offered = append(offered, p.Name)
+		}
+		for _, p := range providers {
+			if p.Origin == "myorg" {
+				return p
+			}
+		}
+		return nil
+	})
+	pkgs, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, "my-awk", pkgs[0].Name)
+	require.Equal(t, []string{"busybox", "gawk", "my-awk"}, offered)
+
+	resolved, err := resolver.ResolvePackage("cmd:awk")
+	require.NoError(t, err)
+	require.Equal(t, "my-awk", resolved[0].Name)
+	require.Len(t, resolved, 3)
+}
+
+func TestRepositoryPriority(t *testing.T) {
+	ctx := context.Background()
+	newIndex := func(uri string, priority int, pkgs ...*repository.Package) NamedIndex {
+		repo := repository.Repository{Uri: uri}
+		return &namedRepositoryWithIndex{repo: repo.WithIndex(&repository.ApkIndex{Packages: pkgs}), priority: priority}
+	}
+	resolve := func(indexes []NamedIndex, name string) string {
+		pkgs, err := NewPkgResolver(ctx, indexes).ResolvePackage(name)
+		require.NoError(t, err)
+		return packageRepository(pkgs[0]) + " " + pkgs[0].Version
+	}
+	indexes := func(priority int) []NamedIndex {
+		return []NamedIndex{
+			newIndex("first", priority,
+				&repository.Package{Name: "foo", Version: "1.0.0-r0"},
+				&repository.Package{Name: "bar", Version: "1.0.0-r0"}),
+			newIndex("second", 0,
+				&repository.Package{Name: "foo", Version: "2.0.0-r0"},
+				&repository.Package{Name: "bar", Version: "1.0.0-r0"}),
+		}
+	}
+
+	// without priorities, the highest version wins, and of equal ones, the first repository
+	for i := 0; i < 10; i++ {
+		require.Equal(t, "second 2.0.0-r0", resolve(indexes(0), "foo"))
+		require.Equal(t, "first 1.0.0-r0", resolve(indexes(0), "bar"))
+	}
+	require.Equal(t, []string{"first", "second"}, NewPkgResolver(ctx, indexes(0)).Repositories("bar"))
+	require.Empty(t, NewPkgResolver(ctx, indexes(0)).Repositories("baz"))
+
+	// a higher priority repository wins, whatever its version
+	require.Equal(t, "first 1.0.0-r0", resolve(indexes(10), "foo"))
+	// and a lower one loses, even where it is listed first
+	require.Equal(t, "second 1.0.0-r0", resolve(indexes(-1), "bar"))
+
+	named, err := GetRepositoryIndexes(ctx, []string{testPrimaryPkgDir}, nil, testArch, WithIgnoreSignatures(true), WithLayout(FlatLayout{}), WithRepositoryPriority(testPrimaryPkgDir, 5))
+	require.NoError(t, err)
+	require.Len(t, named, 1)
+	require.Equal(t, 5, IndexPriority(named[0]))
+}
+
+func TestRepositoryArch(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeRepo := func(repo, arch string, pkg *repository.Package, files map[string]string) {
+		archDir := filepath.Join(dir, repo, arch)
+		require.NoError(t, os.MkdirAll(archDir, 0o755))
+		indexed := writeTestAPK(t, filepath.Join(archDir, pkg.Filename()), pkg, files)
+		var index bytes.Buffer
+		require.NoError(t, WriteIndexArchive(&index, repo, []*repository.Package{indexed}))
+		require.NoError(t, os.WriteFile(filepath.Join(archDir, indexFilename), index.Bytes(), 0o644))
+	}
+	writeRepo("main", testArch, &repository.Package{Name: "hello", Version: "1.0-r0", Arch: testArch, Dependencies: []string{"hello-data"}},
+		map[string]string{"usr/bin/hello": "hello"})
+	// a repository of noarch packages only
+	writeRepo("data", "noarch", &repository.Package{Name: "hello-data", Version: "1.0-r0", Arch: "noarch"},
+		map[string]string{"usr/share/hello/data": "data"})
+	main, data := filepath.Join(dir, "main"), filepath.Join(dir, "data")
+
+	named, err := GetRepositoryIndexes(ctx, []string{main, data}, nil, testArch, WithIgnoreSignatures(true), WithRepositoryArch(data, "noarch"))
+	require.NoError(t, err)
+	require.Len(t, named, 2)
+	require.Equal(t, filepath.Join(data, "noarch", indexFilename), named[1].Source())
+
+	fsys := apkfs.NewMemFS()
+	a, err := New(WithFS(fsys), WithArch(testArch), WithIgnoreMknodErrors(true), WithAllowUntrusted(true),
+		WithRepositoryArches(map[string]string{data: "noarch"}))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetRepositories([]string{main, data}))
+	require.NoError(t, a.SetWorld([]string{"hello"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+	b, err := fsys.ReadFile("usr/share/hello/data")
+	require.NoError(t, err)
+	require.Equal(t, "data", string(b))
+
+	// without the override, the repository has no index for the architecture
+	a, err = New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithIgnoreMknodErrors(true), WithAllowUntrusted(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetRepositories([]string{main, data}))
+	require.NoError(t, a.SetWorld([]string{"hello"}))
+	require.ErrorContains(t, a.FixateWorld(ctx, nil), "hello-data")
+}
+
+func TestRepositoryLayout(t *testing.T) {
+	require.Equal(t, "https://example.com/repo/x86_64/APKINDEX.tar.gz", AlpineLayout{}.IndexURL("https://example.com/repo/", "x86_64"))
+	require.Equal(t, "https://example.com/repo/x86_64", AlpineLayout{}.PackagesURL("https://example.com/repo", "x86_64"))
+	require.Equal(t, "https://example.com/repo/APKINDEX.tar.gz", FlatLayout{}.IndexURL("https://example.com/repo", "x86_64"))
+	require.Equal(t, "https://example.com/repo", FlatLayout{}.PackagesURL("https://example.com/repo/", "x86_64"))
+
+	// the testdata repositories keep the index at the top level
+	indexes, err := GetRepositoryIndexes(context.Background(), []string{testPrimaryPkgDir}, nil, testArch, WithIgnoreSignatures(true))
+	require.NoError(t, err)
+	require.Empty(t, indexes)
+
+	indexes, err = GetRepositoryIndexes(context.Background(), []string{testPrimaryPkgDir}, nil, testArch, WithIgnoreSignatures(true), WithLayout(FlatLayout{}))
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.Equal(t, filepath.Join(testPrimaryPkgDir, indexFilename), indexes[0].Source())
+	pkg := indexes[0].Packages()[0]
+	require.Equal(t, testPrimaryPkgDir+"/"+pkg.Filename(), pkg.Url())
+}
+
+func BenchmarkGetPackagesWithDependencies(b *testing.B) {
+	// an index the size of community, where each package needs a library and a command
+	// provided by a smaller set of base packages
+	const (
+		count = 20000
+		base  = 200
+	)
+	index := &repository.ApkIndex{}
+	for i := 0; i < count; i++ {
+		pkg := &repository.Package{
+			Name:     fmt.Sprintf("pkg-%d", i),
+			Version:  "1.0.0-r0",
+			Provides: []string{fmt.Sprintf("so:libpkg-%d.so.1=1", i), fmt.Sprintf("cmd:pkg-%d=1.0.0-r0", i)},
+		}
+		if i >= base {
+			pkg.Dependencies = []string{fmt.Sprintf("so:libpkg-%d.so.1", i%base), fmt.Sprintf("cmd:pkg-%d", (i/base)%base)}
+		}
+		index.Packages = append(index.Packages, pkg)
+	}
+	repo := &repository.Repository{Uri: "local"}
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(index)})
+	var world []string
+	for i := count - 500; i < count; i++ {
+		world = append(world, fmt.Sprintf("pkg-%d", i))
+	}
+
+	ctx := context.Background()
+	resolver := NewPkgResolver(ctx, indexes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := resolver.GetPackagesWithDependencies(ctx, world); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMaxIndexAge(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	built := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	var index bytes.Buffer
+	zw := gzip.NewWriter(&index)
+	tw := tar.NewWriter(zw)
+	for _, e := range []struct{ name, content string }{
+		{"DESCRIPTION", "v3.18.4-1-gabcdef"},
+		{"APKINDEX", strings.Join(PackageToIndex(&repository.Package{Name: "hello", Version: "1.0-r0", Arch: testArch}), "\n") + "\n\n"},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content)), ModTime: built, Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, indexFilename), index.Bytes(), 0o644))
+
+	named, err := GetRepositoryIndexes(ctx, []string{repoDir}, nil, testArch, WithIgnoreSignatures(true), WithLayout(FlatLayout{}))
+	require.NoError(t, err)
+	require.Len(t, named, 1)
+	require.True(t, built.Equal(IndexBuilt(named[0])), "built %s, want %s", IndexBuilt(named[0]), built)
+	require.Equal(t, "v3.18.4-1-gabcdef", IndexDescription(named[0]))
+	require.True(t, IndexBuilt(NewNamedRepositoryWithIndex("", nil)).IsZero())
+
+	newAPK := func(options ...Option) *APK {
+		return newTestAPK(t, apkfs.NewMemFS(), []string{repoDir}, nil, options...)
+	}
+
+	// fresh enough, or stale with only a warning
+	for _, options := range [][]Option{nil, {WithMaxIndexAge(72*time.Hour, true)}, {WithMaxIndexAge(time.Hour, false)}} {
+		indexes, err := newAPK(options...).GetRepositoryIndexes(ctx, true)
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+	}
+
+	_, err = newAPK(WithMaxIndexAge(time.Hour, true)).GetRepositoryIndexes(ctx, true)
+	var stale *StaleIndexError
+	require.ErrorAs(t, err, &stale)
+	require.Equal(t, time.Hour, stale.MaxAge)
+	require.Len(t, stale.Stale, 1)
+	require.True(t, built.Equal(stale.Stale[0].Built))
+
+	_, err = New(WithMaxIndexAge(-time.Hour, false))
+	require.Error(t, err)
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ReportVersion is the version of the JSON form of the reports. Within a version, fields are only
+// ever added, so that consumers of the reports are not broken by newer releases.
+const ReportVersion = 1
+
+// The kinds of reports.
+const (
+	ReportRepositoryChecks = "repository-checks"
+	ReportDependencyCycles = "dependency-cycles"
+	ReportIndexProblems    = "index-problems"
+	ReportKeyEvents        = "key-events"
+	ReportPendingScripts   = "pending-scripts"
+	ReportPackages         = "packages"
+	ReportVersions         = "versions"
+	ReportDifferences      = "differences"
+	ReportConfig           = "config"
+	ReportVulnerabilities  = "vulnerabilities"
+	ReportValidation       = "validation-problems"
+	ReportSonameProviders  = "soname-providers"
+	ReportVerifications    = "package-verifications"
+)
+
+// Report is the versioned envelope of what go-apk reports, such as []RepositoryCheck or
+// []*PackageInfo, for CI pipelines and other tools to consume as JSON.
+type Report struct {
+	Version int    `json:"version"`
+	Kind    string `json:"kind"`
+	// Items are the reported values, which are of a type with a stable JSON form.
+	Items interface{} `json:"items"`
+}
+
+// NewReport returns a report of the kind, of the current ReportVersion.
+func NewReport(kind string, items interface{}) *Report {
+	return &Report{Version: ReportVersion, Kind: kind, Items: items}
+}
+
+// WriteReport writes the report of the kind, as indented JSON, to w.
+func WriteReport(w io.Writer, kind string, items interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(NewReport(kind, items))
+}
+
+// packageInfoJSON is the JSON form of a PackageInfo, which does not depend on that of repository.Package.
+type packageInfoJSON struct {
+	Name          string   `json:"name"`
+	Version       string   `json:"version"`
+	Arch          string   `json:"arch,omitempty"`
+	Description   string   `json:"description,omitempty"`
+	URL           string   `json:"url,omitempty"`
+	License       string   `json:"license,omitempty"`
+	Origin        string   `json:"origin,omitempty"`
+	Maintainer    string   `json:"maintainer,omitempty"`
+	Commit        string   `json:"commit,omitempty"`
+	Checksum      string   `json:"checksum,omitempty"`
+	Size          uint64   `json:"size,omitempty"`
+	InstalledSize uint64   `json:"installed_size,omitempty"`
+	Depends       []string `json:"depends,omitempty"`
+	Provides      []string `json:"provides,omitempty"`
+	InstallIf     []string `json:"install_if,omitempty"`
+	Replaces      string   `json:"replaces,omitempty"`
+	Repository    string   `json:"repository,omitempty"`
+	Installed     bool     `json:"installed"`
+	Contents      []string `json:"contents,omitempty"`
+	Triggers      []string `json:"triggers,omitempty"`
+}
+
+// MarshalJSON encodes the package information with lower case field names, as in apk-tools.
+func (info PackageInfo) MarshalJSON() ([]byte, error) {
+	v := packageInfoJSON{
+		Name:          info.Name,
+		Version:       info.Version,
+		Arch:          info.Arch,
+		Description:   info.Description,
+		URL:           info.URL,
+		License:       info.License,
+		Origin:        info.Origin,
+		Maintainer:    info.Maintainer,
+		Commit:        info.RepoCommit,
+		Size:          info.Size,
+		InstalledSize: info.InstalledSize,
+		Depends:       info.Dependencies,
+		Provides:      info.Provides,
+		InstallIf:     info.InstallIf,
+		Replaces:      info.Replaces,
+		Repository:    info.Repository,
+		Installed:     info.Installed,
+		Contents:      info.Contents,
+		Triggers:      info.Triggers,
+	}
+	if len(info.Checksum) > 0 {
+		v.Checksum = FormatQ1Checksum(info.Checksum)
+	}
+	return json.Marshal(v)
+}
+
+// MarshalJSON encodes the check with its error as a string.
+func (c RepositoryCheck) MarshalJSON() ([]byte, error) {
+	type check RepositoryCheck
+	v := struct {
+		check
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	}{check: check(c), OK: c.OK()}
+	if c.Err != nil {
+		v.Error = c.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+// MarshalJSON encodes the verification with its errors as strings.
+func (v PackageVerification) MarshalJSON() ([]byte, error) {
+	type verification PackageVerification
+	out := struct {
+		verification
+		OK             bool   `json:"ok"`
+		Error          string `json:"error,omitempty"`
+		SignatureError string `json:"signature_error,omitempty"`
+		DataHashError  string `json:"datahash_error,omitempty"`
+	}{verification: verification(v), OK: v.OK()}
+	if v.Err != nil {
+		out.Error = v.Err.Error()
+	}
+	if v.SignatureErr != nil {
+		out.SignatureError = v.SignatureErr.Error()
+	}
+	if v.DataHashErr != nil {
+		out.DataHashError = v.DataHashErr.Error()
+	}
+	return json.Marshal(out)
+}
+
+// MarshalText encodes the kind by name, such as "key-added".
+func (k KeyEventKind) MarshalText() ([]byte, error) {
+	switch k {
+	case KeyAdded:
+		return []byte("key-added"), nil
+	case KeyChanged:
+		return []byte("key-changed"), nil
+	case KeyRotated:
+		return []byte("key-rotated"), nil
+	default:
+		return []byte(k.String()), nil
+	}
+}
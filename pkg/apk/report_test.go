@@ -0,0 +1,79 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/fsdiff"
+)
+
+func TestReportJSON(t *testing.T) {
+	for _, tt := range []struct {
+		kind  string
+		items interface{}
+		want  string
+	}{
+		{
+			ReportRepositoryChecks,
+			[]RepositoryCheck{
+				{Repository: "https://example.com/main", IndexURL: "https://example.com/main/x86_64/APKINDEX.tar.gz", Signer: "key.rsa.pub", Packages: 3},
+				{Repository: "https://example.com/other", Failed: CheckSignature, Err: errors.New("untrusted")},
+			},
+			`[{"repository":"https://example.com/main","index_url":"https://example.com/main/x86_64/APKINDEX.tar.gz","signer":"key.rsa.pub","packages":3,"ok":true},` +
+				`{"repository":"https://example.com/other","packages":0,"failed":"signature","ok":false,"error":"untrusted"}]`,
+		},
+		{
+			ReportPackages,
+			[]*PackageInfo{{Package: repository.Package{Name: "busybox", Version: "1.36.1-r0", Checksum: []byte{1, 2, 3}, Dependencies: []string{"so:libc.musl-x86_64.so.1"}}, Installed: true}},
+			`[{"name":"busybox","version":"1.36.1-r0","checksum":"Q1AQID","depends":["so:libc.musl-x86_64.so.1"],"installed":true}]`,
+		},
+		{
+			ReportKeyEvents,
+			[]KeyEvent{{Kind: KeyRotated, Key: "new.rsa.pub", Index: "i", Previous: "old.rsa.pub"}},
+			`[{"kind":"key-rotated","key":"new.rsa.pub","index":"i","previous":"old.rsa.pub"}]`,
+		},
+		{
+			ReportDependencyCycles,
+			[]DependencyCycle{{Packages: []string{"a", "b"}, Broken: []string{"a -> b"}}},
+			`[{"packages":["a","b"],"broken":["a -> b"]}]`,
+		},
+		{
+			ReportDifferences,
+			[]fsdiff.Difference{{Path: "etc/passwd", Kind: fsdiff.Changed, Detail: "mode 0644 != 0600"}, {Path: "bin/sh", Kind: fsdiff.Added}},
+			`[{"path":"etc/passwd","kind":"changed","detail":"mode 0644 != 0600"},{"path":"bin/sh","kind":"added"}]`,
+		},
+	} {
+		t.Run(tt.kind, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, WriteReport(&buf, tt.kind, tt.items))
+			var report struct {
+				Version int             `json:"version"`
+				Kind    string          `json:"kind"`
+				Items   json.RawMessage `json:"items"`
+			}
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &report))
+			require.Equal(t, ReportVersion, report.Version)
+			require.Equal(t, tt.kind, report.Kind)
+			require.JSONEq(t, tt.want, string(report.Items))
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// ScriptLinter looks at the scripts of each package before it is installed, with WithScriptLinter,
+// and vetoes the package by returning an error. ScriptRules is one, with rules of its own, and
+// DefaultScriptRules those for what is most often risky.
+type ScriptLinter interface {
+	LintScripts(pkg *repository.Package, scripts *PackageScripts) error
+}
+
+// ScriptLinterFunc is a function that is a ScriptLinter.
+type ScriptLinterFunc func(pkg *repository.Package, scripts *PackageScripts) error
+
+func (f ScriptLinterFunc) LintScripts(pkg *repository.Package, scripts *PackageScripts) error {
+	return f(pkg, scripts)
+}
+
+// ScriptRule is something scripts are not to do, found in them line by line.
+type ScriptRule struct {
+	// Name identifies the rule in findings, such as network.
+	Name string
+	// Pattern matches the lines of the scripts that break the rule.
+	Pattern *regexp.Regexp
+}
+
+// DefaultScriptRules are rules for what the scripts of packages most often should not do: fetch
+// from the network, pipe what they fetch to a shell, or make files writable by everyone.
+var DefaultScriptRules = ScriptRules{
+	{Name: "pipe-to-shell", Pattern: regexp.MustCompile(`\b(curl|wget)\b[^|]*\|\s*(sudo\s+)?(ba|da|k|z)?sh\b`)},
+	{Name: "network", Pattern: regexp.MustCompile(`\b(curl|wget|nc|ncat|socat|ftp|tftp)\s`)},
+	{Name: "world-writable", Pattern: regexp.MustCompile(`\bchmod\s+(-\w+\s+)*([0-7]{0,2}[0-7]{2}[2367]|[ug]*[ao][ug]*\+[rxX]*w)\b`)},
+}
+
+// ScriptRules is a ScriptLinter vetoing the packages whose scripts have lines matching any of its
+// rules, with a *ScriptLintError of every finding.
+type ScriptRules []ScriptRule
+
+func (rules ScriptRules) LintScripts(pkg *repository.Package, scripts *PackageScripts) error {
+	names := make([]string, 0, len(scripts.Scripts))
+	for name := range scripts.Scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var findings []ScriptFinding
+	for _, name := range names {
+		for i, line := range strings.Split(string(scripts.Scripts[name]), "\n") {
+			if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			for _, rule := range rules {
+				if rule.Pattern.MatchString(line) {
+					findings = append(findings, ScriptFinding{Script: name, Line: i + 1, Rule: rule.Name, Text: strings.TrimSpace(line)})
+				}
+			}
+		}
+	}
+	if len(findings) > 0 {
+		return &ScriptLintError{Package: pkg.Name, Findings: findings}
+	}
+	return nil
+}
+
+// ScriptFinding is a line of a script that breaks a rule.
+type ScriptFinding struct {
+	// Script is the name of the script, such as post-install.
+	Script string `json:"script"`
+	// Line is the number of the line in the script, from 1.
+	Line int    `json:"line"`
+	Rule string `json:"rule"`
+	Text string `json:"text"`
+}
+
+// ScriptLintError is the error of ScriptRules for a package whose scripts break its rules.
+type ScriptLintError struct {
+	Package  string
+	Findings []ScriptFinding
+}
+
+func (e *ScriptLintError) Error() string {
+	found := make([]string, len(e.Findings))
+	for i, f := range e.Findings {
+		found[i] = fmt.Sprintf("%s:%d: %s: %s", f.Script, f.Line, f.Rule, f.Text)
+	}
+	return fmt.Sprintf("scripts of %s break the script rules:\n%s", e.Package, strings.Join(found, "\n"))
+}
+
+// lintScripts vetoes the package if the linter of WithScriptLinter, if any, finds fault with its
+// scripts, read from the control section.
+func (a *APK) lintScripts(pkg *repository.Package, scripts map[string][]byte, controlFile string) error {
+	if a.scriptLinter == nil {
+		return nil
+	}
+	f, err := os.Open(controlFile)
+	if err != nil {
+		return fmt.Errorf("opening control file %q: %w", controlFile, err)
+	}
+	defer f.Close()
+	values, err := controlValues(f)
+	if err != nil {
+		return fmt.Errorf("reading triggers of pkg %s: %w", pkg.Name, err)
+	}
+	linted := &PackageScripts{Scripts: scripts}
+	for _, triggers := range values["triggers"] {
+		linted.Triggers = append(linted.Triggers, strings.Fields(triggers)...)
+	}
+	if err := a.scriptLinter.LintScripts(pkg, linted); err != nil {
+		return fmt.Errorf("the script linter vetoed %s: %w", pkg.Name, err)
+	}
+	return nil
+}
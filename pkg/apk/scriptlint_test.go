@@ -0,0 +1,107 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestDefaultScriptRules(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want []string
+	}{
+		{"curl -fsSL https://example.com/install.sh | sh", []string{"pipe-to-shell", "network"}},
+		{"wget -qO- https://example.com/x | sudo bash", []string{"pipe-to-shell", "network"}},
+		{"wget https://example.com/data -O /tmp/data", []string{"network"}},
+		{"chmod 777 /var/lib/foo", []string{"world-writable"}},
+		{"chmod -R 0666 /srv", []string{"world-writable"}},
+		{"chmod 1777 /tmp", []string{"world-writable"}},
+		{"chmod a+w /etc/foo", []string{"world-writable"}},
+		{"chmod 640 /etc/shadow", nil},
+		{"chmod +x /etc/init.d/rcL", nil},
+		{"# curl https://example.com | sh", nil},
+		{"addgroup -S -g 42 shadow", nil},
+	} {
+		t.Run(tt.line, func(t *testing.T) {
+			err := DefaultScriptRules.LintScripts(&repository.Package{Name: "foo"}, &PackageScripts{Scripts: map[string][]byte{"post-install": []byte("#!/bin/sh\n" + tt.line + "\n")}})
+			if tt.want == nil {
+				require.NoError(t, err)
+				return
+			}
+			var lintErr *ScriptLintError
+			require.ErrorAs(t, err, &lintErr)
+			var rules []string
+			for _, f := range lintErr.Findings {
+				require.Equal(t, "post-install", f.Script)
+				require.Equal(t, 2, f.Line)
+				rules = append(rules, f.Rule)
+			}
+			require.Equal(t, tt.want, rules)
+		})
+	}
+}
+
+func TestInstallLintsScripts(t *testing.T) {
+	ctx := context.Background()
+	install := func(t *testing.T, linter ScriptLinter) (*APK, error) {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithIgnoreMknodErrors(true), WithScriptLinter(linter))
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(ctx))
+
+		f, err := os.Open(filepath.Join("testdata", "alpine-316", "alpine-baselayout-3.2.0-r23.apk"))
+		require.NoError(t, err)
+		defer f.Close()
+		exp, err := ExpandApk(ctx, f, "")
+		require.NoError(t, err)
+		pkg := repository.NewRepositoryPackage(&repository.Package{Name: "alpine-baselayout", Version: "3.2.0-r23", Arch: testArch, Checksum: exp.ControlHash}, nil)
+		return a, a.installPackage(ctx, pkg, exp, nil, nil)
+	}
+
+	t.Run("default rules", func(t *testing.T) {
+		_, err := install(t, DefaultScriptRules)
+		require.NoError(t, err)
+	})
+	t.Run("vetoed", func(t *testing.T) {
+		a, err := install(t, ScriptRules{{Name: "shadow", Pattern: regexp.MustCompile(`chown root:shadow`)}})
+		var lintErr *ScriptLintError
+		require.ErrorAs(t, err, &lintErr)
+		require.Equal(t, "alpine-baselayout", lintErr.Package)
+		require.Len(t, lintErr.Findings, 2)
+		require.Equal(t, "post-install", lintErr.Findings[0].Script)
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		require.Empty(t, installed)
+	})
+	t.Run("linter func", func(t *testing.T) {
+		var linted *PackageScripts
+		_, err := install(t, ScriptLinterFunc(func(pkg *repository.Package, scripts *PackageScripts) error {
+			linted = scripts
+			return errors.New("not today")
+		}))
+		require.ErrorContains(t, err, "the script linter vetoed alpine-baselayout: not today")
+		require.Contains(t, linted.Scripts, "pre-install")
+	})
+}
@@ -0,0 +1,268 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PackageScripts is what a package would run as it is installed, upgraded or removed.
+type PackageScripts struct {
+	// Scripts are the scripts of the package, by name without the leading dot, such as pre-install,
+	// post-upgrade, pre-deinstall or trigger.
+	Scripts map[string][]byte `json:"scripts,omitempty"`
+	// Triggers are the directories, or globs of them, that the trigger script is run for.
+	Triggers []string `json:"triggers,omitempty"`
+}
+
+// Scripts returns the scripts of the package and what its trigger is run for, as in its control
+// section, without running any of them, for policy tools to look at what would run before the
+// package is installed. Only the signature and control sections are fetched, as with FetchControl.
+func (a *APK) Scripts(ctx context.Context, pkg *repository.RepositoryPackage) (*PackageScripts, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Scripts", trace.WithAttributes(attribute.String("package", pkg.Name)))
+	defer span.End()
+
+	control, err := a.FetchControl(ctx, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("getting scripts of %s: %w", pkg.Name, err)
+	}
+	return &PackageScripts{Scripts: control.Scripts, Triggers: control.Triggers}, nil
+}
+
+// packageScripts returns the scripts of the control section, by name without the leading dot.
+func packageScripts(controlFile string) (map[string][]byte, error) {
+	f, err := os.Open(controlFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readPackageScripts(f)
+}
+
+// readPackageScripts returns the scripts of the gzipped control section, by name without the leading dot.
+func readPackageScripts(r io.Reader) (map[string][]byte, error) {
+	gz, err := getGzipReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to gunzip control tar.gz file: %w", err)
+	}
+	defer putGzipReader(gz)
+	tr := tar.NewReader(gz)
+	scripts := map[string][]byte{}
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return scripts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == ".PKGINFO" || header.Typeflag != tar.TypeReg || len(header.Name) < 2 || header.Name[0] != '.' {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		scripts[header.Name[1:]] = b
+	}
+}
+
+// runScript runs the script of the package, such as post-install, if it has one, with the executor.
+// As with apk-tools, the script is put in /lib/apk/exec for the executor to run in the root, with
+// the arguments, and removed afterwards.
+func (a *APK) runScript(pkg *repository.Package, scripts map[string][]byte, script string, args ...string) error {
+	b, ok := scripts[script]
+	if !ok || a.executor == nil {
+		return nil
+	}
+	if err := a.fs.MkdirAll(scriptsExecDir, 0o755); err != nil {
+		return fmt.Errorf("creating %s: %w", scriptsExecDir, err)
+	}
+	p := path.Join(scriptsExecDir, fmt.Sprintf("%s-%s.%s", pkg.Name, pkg.Version, script))
+	if err := a.fs.WriteFile(p, b, 0o755); err != nil { //nolint:gosec // scripts are executable
+		return fmt.Errorf("writing %s: %w", p, err)
+	}
+	defer a.fs.Remove(p) //nolint:errcheck // the directory is only for running scripts
+
+	a.logger.Debugf("running %s of %s (%s)", script, pkg.Name, pkg.Version)
+	if err := a.executor.Execute("/"+p, args...); err != nil {
+		return fmt.Errorf("%s script of %s: %w", script, pkg.Name, err)
+	}
+	return nil
+}
+
+// ScriptPolicy decides the packages whose scripts are run, when there is an executor to run them
+// with. Packages are matched by name against the patterns of Allow and Deny, as in path.Match.
+type ScriptPolicy struct {
+	// Skip skips the scripts of all packages but those matching Allow. Without it, the scripts of all
+	// packages but those matching Deny are run.
+	Skip bool `json:"skip,omitempty"`
+	// Allow are the packages whose scripts are run even with Skip.
+	Allow []string `json:"allow,omitempty"`
+	// Deny are the packages whose scripts are never run, even if they match Allow.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// Runs reports whether the scripts of the package are run.
+func (p ScriptPolicy) Runs(name string) bool {
+	if matchesAny(name, p.Deny) {
+		return false
+	}
+	return !p.Skip || matchesAny(name, p.Allow)
+}
+
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingScript is a script of an installed package that was not run when the package was
+// installed, because there was no executor or the script policy skipped it.
+type PendingScript struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	// Script is the name of the script, such as post-install.
+	Script string `json:"script"`
+	// Args are the arguments the script is to be run with, as by apk-tools.
+	Args []string `json:"args"`
+	// Contents is the script, from the scripts database.
+	Contents []byte `json:"contents,omitempty"`
+}
+
+// PendingScripts returns the scripts of the installed packages that have not been run, in the order
+// they are to be run, e.g. by a runner at the first boot of the image. They stay pending until the
+// packages are removed.
+func (a *APK) PendingScripts() ([]PendingScript, error) {
+	b, err := a.fs.ReadFile(pendingScriptsFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pending scripts file %s: %w", pendingScriptsFilePath, err)
+	}
+	var pending []PendingScript
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		pending = append(pending, PendingScript{Package: fields[0], Version: fields[1], Script: fields[2], Args: fields[3:]})
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	contents, err := a.installedScripts()
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range pending {
+		b, ok := contents[fmt.Sprintf("%s-%s.%s", p.Package, p.Version, p.Script)]
+		if !ok {
+			return nil, fmt.Errorf("pending %s script of %s is not in %s", p.Script, p.Package, scriptsFilePath)
+		}
+		pending[i].Contents = b
+	}
+	return pending, nil
+}
+
+// installedScripts returns the scripts of the scripts database by <name>-<version>.<script>.
+func (a *APK) installedScripts() (map[string][]byte, error) {
+	r, err := a.readScriptsTar()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open scripts file %s: %w", scriptsFilePath, err)
+	}
+	defer r.Close()
+	contents := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return contents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		// the scripts are named <name>-<version>.Q1<checksum>.<script>
+		if i := strings.LastIndex(header.Name, ".Q1"); i >= 0 {
+			if _, script, ok := strings.Cut(header.Name[i+3:], "."); ok {
+				contents[header.Name[:i]+"."+script] = b
+			}
+		}
+	}
+}
+
+// addPendingScripts records those of the scripts, in order, that the package has as pending, with
+// the arguments.
+func (a *APK) addPendingScripts(pkg *repository.Package, scripts map[string][]byte, names []string, args []string) error {
+	var lines []string
+	for _, name := range names {
+		if _, ok := scripts[name]; ok {
+			lines = append(lines, strings.Join(append([]string{pkg.Name, pkg.Version, name}, args...), " ")+"\n")
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	f, err := a.fs.OpenFile(pendingScriptsFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open pending scripts file %s: %w", pendingScriptsFilePath, err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(strings.Join(lines, ""))); err != nil {
+		return fmt.Errorf("unable to write pending scripts file %s: %w", pendingScriptsFilePath, err)
+	}
+	return nil
+}
+
+// removePendingScripts removes the pending scripts of the named package.
+func (a *APK) removePendingScripts(name string) error {
+	b, err := a.fs.ReadFile(pendingScriptsFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read pending scripts file %s: %w", pendingScriptsFilePath, err)
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] != name {
+			kept = append(kept, line)
+		}
+	}
+	// #nosec G306 -- the apk database must be publicly readable
+	return a.fs.WriteFile(pendingScriptsFilePath, []byte(strings.Join(kept, "")), 0o644)
+}
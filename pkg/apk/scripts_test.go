@@ -0,0 +1,218 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// testExecutor records the commands it is given, and the scripts they are, from the filesystem.
+type testExecutor struct {
+	fs   apkfs.FullFS
+	runs []string
+	fail string
+}
+
+func (e *testExecutor) Execute(name string, arg ...string) error {
+	b, err := e.fs.ReadFile(strings.TrimPrefix(name, "/"))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(b), "#!") {
+		return errors.New("not a script")
+	}
+	e.runs = append(e.runs, strings.Join(append([]string{name}, arg...), " "))
+	if e.fail != "" && strings.HasSuffix(name, e.fail) {
+		return errors.New("exit status 1")
+	}
+	return nil
+}
+
+func TestInstallRunsScripts(t *testing.T) {
+	ctx := context.Background()
+	install := func(t *testing.T, fail string, from *repository.Package) (*testExecutor, error) {
+		fs := apkfs.NewMemFS()
+		e := &testExecutor{fs: fs, fail: fail}
+		a, err := New(WithFS(fs), WithArch(testArch), WithIgnoreMknodErrors(true), WithExecutor(e))
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(ctx))
+
+		f, err := os.Open(filepath.Join("testdata", "alpine-316", "alpine-baselayout-3.2.0-r23.apk"))
+		require.NoError(t, err)
+		defer f.Close()
+		exp, err := ExpandApk(ctx, f, "")
+		require.NoError(t, err)
+		pkg := repository.NewRepositoryPackage(&repository.Package{Name: "alpine-baselayout", Version: "3.2.0-r23", Arch: testArch, Checksum: exp.ControlHash}, nil)
+		err = a.installPackage(ctx, pkg, exp, nil, from)
+
+		// the scripts are cleaned up
+		entries, readErr := fs.ReadDir(scriptsExecDir)
+		require.NoError(t, readErr)
+		require.Empty(t, entries)
+		return e, err
+	}
+
+	t.Run("install", func(t *testing.T) {
+		e, err := install(t, "", nil)
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			"/lib/apk/exec/alpine-baselayout-3.2.0-r23.pre-install 3.2.0-r23",
+			"/lib/apk/exec/alpine-baselayout-3.2.0-r23.post-install 3.2.0-r23",
+		}, e.runs)
+	})
+	t.Run("upgrade", func(t *testing.T) {
+		e, err := install(t, "", &repository.Package{Name: "alpine-baselayout", Version: "3.1.0-r0"})
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			"/lib/apk/exec/alpine-baselayout-3.2.0-r23.pre-upgrade 3.2.0-r23 3.1.0-r0",
+			"/lib/apk/exec/alpine-baselayout-3.2.0-r23.post-upgrade 3.2.0-r23 3.1.0-r0",
+		}, e.runs)
+	})
+	t.Run("failing pre-install", func(t *testing.T) {
+		e, err := install(t, "pre-install", nil)
+		require.ErrorContains(t, err, "pre-install script of alpine-baselayout")
+		require.Len(t, e.runs, 1)
+	})
+	t.Run("failing post-install", func(t *testing.T) {
+		_, err := install(t, "post-install", nil)
+		require.NoError(t, err)
+	})
+}
+
+func TestScriptPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		policy ScriptPolicy
+		runs   map[string]bool
+	}{
+		{"default", ScriptPolicy{}, map[string]bool{"busybox": true, "openrc": true}},
+		{"deny", ScriptPolicy{Deny: []string{"*-openrc"}}, map[string]bool{"busybox": true, "busybox-openrc": false}},
+		{"skip", ScriptPolicy{Skip: true}, map[string]bool{"busybox": false}},
+		{"skip but allow", ScriptPolicy{Skip: true, Allow: []string{"busybox", "ca-*"}}, map[string]bool{"busybox": true, "ca-certificates": true, "openrc": false}},
+		{"deny wins", ScriptPolicy{Skip: true, Allow: []string{"*"}, Deny: []string{"openrc"}}, map[string]bool{"busybox": true, "openrc": false}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, runs := range tt.runs {
+				require.Equal(t, runs, tt.policy.Runs(name), name)
+			}
+		})
+	}
+}
+
+func TestPendingScripts(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name    string
+		options []Option
+	}{
+		{"no executor", nil},
+		{"skipped by policy", []Option{WithExecutor(&testExecutor{}), WithScriptPolicy(ScriptPolicy{Deny: []string{"alpine-*"}})}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := apkfs.NewMemFS()
+			a, err := New(append([]Option{WithFS(fs), WithArch(testArch), WithIgnoreMknodErrors(true)}, tt.options...)...)
+			require.NoError(t, err)
+			require.NoError(t, a.InitDB(ctx))
+
+			f, err := os.Open(filepath.Join("testdata", "alpine-316", "alpine-baselayout-3.2.0-r23.apk"))
+			require.NoError(t, err)
+			defer f.Close()
+			exp, err := ExpandApk(ctx, f, "")
+			require.NoError(t, err)
+			pkg := repository.NewRepositoryPackage(&repository.Package{Name: "alpine-baselayout", Version: "3.2.0-r23", Arch: testArch, Checksum: exp.ControlHash}, nil)
+			require.NoError(t, a.installPackage(ctx, pkg, exp, nil, nil))
+
+			pending, err := a.PendingScripts()
+			require.NoError(t, err)
+			require.Len(t, pending, 2)
+			for i, script := range []string{"pre-install", "post-install"} {
+				require.Equal(t, "alpine-baselayout", pending[i].Package)
+				require.Equal(t, script, pending[i].Script)
+				require.Equal(t, []string{"3.2.0-r23"}, pending[i].Args)
+				require.True(t, strings.HasPrefix(string(pending[i].Contents), "#!"))
+			}
+
+			installed, err := a.GetInstalled()
+			require.NoError(t, err)
+			require.Len(t, installed, 1)
+			require.NoError(t, a.removeInstalledPackage(installed[0]))
+			pending, err = a.PendingScripts()
+			require.NoError(t, err)
+			require.Empty(t, pending)
+		})
+	}
+}
+
+func TestScripts(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(WithArch(testArch))
+	require.NoError(t, err)
+
+	t.Run("scripts", func(t *testing.T) {
+		repo := repository.Repository{Uri: filepath.Join("testdata", "alpine-316")}
+		baselayout := &repository.Package{Name: "alpine-baselayout", Version: "3.2.0-r23", Arch: testArch}
+		scripts, err := a.Scripts(ctx, repository.NewRepositoryPackage(baselayout, repo.WithIndex(nil)))
+		require.NoError(t, err)
+		names := make([]string, 0, len(scripts.Scripts))
+		for name := range scripts.Scripts {
+			names = append(names, name)
+		}
+		require.ElementsMatch(t, []string{"pre-install", "pre-upgrade", "post-install", "post-upgrade"}, names)
+		require.True(t, strings.HasPrefix(string(scripts.Scripts["post-install"]), "#!"))
+		require.Empty(t, scripts.Triggers)
+	})
+
+	t.Run("triggers", func(t *testing.T) {
+		targz := func(entries ...[2]string) []byte {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(zw)
+			for _, e := range entries {
+				require.NoError(t, tw.WriteHeader(&tar.Header{Name: e[0], Mode: 0o755, Size: int64(len(e[1])), Typeflag: tar.TypeReg}))
+				_, err := tw.Write([]byte(e[1]))
+				require.NoError(t, err)
+			}
+			require.NoError(t, tw.Close())
+			require.NoError(t, zw.Close())
+			return buf.Bytes()
+		}
+		control := targz(
+			[2]string{".PKGINFO", "pkgname = fonts\npkgver = 1.0-r0\narch = " + testArch + "\ntriggers = /usr/share/fonts/* /etc/fonts\n"},
+			[2]string{".trigger", "#!/bin/sh\nfc-cache\n"},
+		)
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "fonts-1.0-r0.apk"), append(control, targz()...), 0o644))
+
+		repo := repository.Repository{Uri: dir}
+		pkg := &repository.Package{Name: "fonts", Version: "1.0-r0", Arch: testArch}
+		scripts, err := a.Scripts(ctx, repository.NewRepositoryPackage(pkg, repo.WithIndex(nil)))
+		require.NoError(t, err)
+		require.Equal(t, map[string][]byte{"trigger": []byte("#!/bin/sh\nfc-cache\n")}, scripts.Scripts)
+		require.Equal(t, []string{"/usr/share/fonts/*", "/etc/fonts"}, scripts.Triggers)
+	})
+}
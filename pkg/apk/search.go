@@ -0,0 +1,223 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+)
+
+// SearchMatch is how a search pattern is matched against the fields of a package.
+type SearchMatch int
+
+const (
+	// SearchGlob matches the whole field against a shell pattern, as in path.Match.
+	SearchGlob SearchMatch = iota
+	// SearchExact matches fields equal to the pattern.
+	SearchExact
+	// SearchRegex matches fields containing a match of the regular expression; use ^ and $ to anchor it.
+	SearchRegex
+)
+
+// SearchField selects the fields of a package that a search matches against. Fields can be combined.
+type SearchField int
+
+const (
+	// SearchName matches the name of the package.
+	SearchName SearchField = 1 << iota
+	// SearchProvides matches the names the package provides, without their versions.
+	SearchProvides
+	// SearchDescription matches the description of the package.
+	SearchDescription
+	// SearchCommit matches the commit the package was built from, e.g. "abc1234*" with SearchGlob
+	// for an abbreviated one.
+	SearchCommit
+)
+
+type searchOpts struct {
+	match       SearchMatch
+	fields      SearchField
+	allVersions bool
+	byOrigin    bool
+}
+
+type SearchOption func(*searchOpts)
+
+// WithSearchMatch sets how the pattern is matched. If not provided, SearchGlob is used.
+func WithSearchMatch(match SearchMatch) SearchOption {
+	return func(o *searchOpts) {
+		o.match = match
+	}
+}
+
+// WithSearchFields sets the fields the pattern is matched against. If not provided, or 0,
+// SearchName|SearchProvides is used.
+func WithSearchFields(fields SearchField) SearchOption {
+	return func(o *searchOpts) {
+		if fields != 0 {
+			o.fields = fields
+		}
+	}
+}
+
+// WithSearchAllVersions returns every matching version of each package, instead of only the latest.
+func WithSearchAllVersions(all bool) SearchOption {
+	return func(o *searchOpts) {
+		o.allVersions = all
+	}
+}
+
+// WithSearchOrigin groups the matches by origin, returning one package per origin, the equivalent
+// of "apk search -o". Without WithSearchAllVersions, that is the latest version of the origin package
+// itself if it is in the indexes, or else of its first matching subpackage by name.
+func WithSearchOrigin(byOrigin bool) SearchOption {
+	return func(o *searchOpts) {
+		o.byOrigin = byOrigin
+	}
+}
+
+// Search returns the packages in the repositories of the world that match the pattern.
+// See SearchIndexes for how they are matched and ordered.
+func (a *APK) Search(ctx context.Context, pattern string, options ...SearchOption) ([]*repository.RepositoryPackage, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Search")
+	defer span.End()
+
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	return SearchIndexes(indexes, pattern, options...)
+}
+
+// SearchIndexes returns the packages in the indexes that match the pattern, in order of name,
+// and newest version first within a name. By default the pattern is a glob matched against the
+// names and provides of the packages, and only the latest version of each package is returned.
+func SearchIndexes(indexes []NamedIndex, pattern string, options ...SearchOption) ([]*repository.RepositoryPackage, error) {
+	opts := &searchOpts{match: SearchGlob, fields: SearchName | SearchProvides}
+	for _, opt := range options {
+		opt(opts)
+	}
+	match, err := searchMatcher(opts.match, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string][]*repository.RepositoryPackage{}
+	for _, index := range indexes {
+		for _, pkg := range index.Packages() {
+			if searchMatches(opts.fields, match, pkg.Package) {
+				byName[pkg.Name] = append(byName[pkg.Name], pkg)
+			}
+		}
+	}
+
+	var results []*repository.RepositoryPackage
+	for _, name := range sortedKeys(byName) {
+		pkgs := byName[name]
+		sortNewestFirst(pkgs)
+		if !opts.allVersions {
+			pkgs = pkgs[:1]
+		}
+		results = append(results, pkgs...)
+	}
+	if opts.byOrigin {
+		results = groupByOrigin(results, opts.allVersions)
+	}
+	return results, nil
+}
+
+func searchMatcher(match SearchMatch, pattern string) (func(string) bool, error) {
+	switch match {
+	case SearchExact:
+		return func(s string) bool { return s == pattern }, nil
+	case SearchGlob:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid search pattern %q: %w", pattern, err)
+		}
+		return func(s string) bool {
+			ok, _ := path.Match(pattern, s)
+			return ok
+		}, nil
+	case SearchRegex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid search pattern %q: %w", pattern, err)
+		}
+		return re.MatchString, nil
+	default:
+		return nil, fmt.Errorf("unknown search match %d", match)
+	}
+}
+
+func searchMatches(fields SearchField, match func(string) bool, pkg *repository.Package) bool {
+	if fields&SearchName != 0 && match(pkg.Name) {
+		return true
+	}
+	if fields&SearchProvides != 0 {
+		for _, provide := range pkg.Provides {
+			if match(resolvePackageNameVersionPin(provide).name) {
+				return true
+			}
+		}
+	}
+	if fields&SearchCommit != 0 && pkg.RepoCommit != "" && match(pkg.RepoCommit) {
+		return true
+	}
+	return fields&SearchDescription != 0 && match(pkg.Description)
+}
+
+// sortNewestFirst sorts packages of the same name by descending version. Versions that cannot be
+// parsed are kept in their index order, after those that can.
+func sortNewestFirst(pkgs []*repository.RepositoryPackage) {
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		vi, erri := parseVersion(pkgs[i].Version)
+		vj, errj := parseVersion(pkgs[j].Version)
+		if erri != nil || errj != nil {
+			return erri == nil && errj != nil
+		}
+		return compareVersions(vi, vj) == greater
+	})
+}
+
+// groupByOrigin keeps the packages of each origin together, ordered by origin, preferring the origin
+// package itself over its subpackages. Unless all is set, only the first package of each origin is kept.
+func groupByOrigin(pkgs []*repository.RepositoryPackage, all bool) []*repository.RepositoryPackage {
+	byOrigin := map[string][]*repository.RepositoryPackage{}
+	for _, pkg := range pkgs {
+		origin := pkg.Origin
+		if origin == "" {
+			origin = pkg.Name
+		}
+		byOrigin[origin] = append(byOrigin[origin], pkg)
+	}
+	var results []*repository.RepositoryPackage
+	for _, origin := range sortedKeys(byOrigin) {
+		group := byOrigin[origin]
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Name == origin && group[j].Name != origin
+		})
+		if !all {
+			group = group[:1]
+		}
+		results = append(results, group...)
+	}
+	return results
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestSearchIndexes(t *testing.T) {
+	index := &repository.ApkIndex{Packages: []*repository.Package{
+		{Name: "python3", Version: "3.11.4-r0", Origin: "python3", Description: "The Python programming language"},
+		{Name: "python3", Version: "3.11.10-r0", Origin: "python3", Description: "The Python programming language"},
+		{Name: "python3-dev", Version: "3.11.10-r0", Origin: "python3", Description: "The Python programming language (development files)"},
+		{Name: "py3-pip", Version: "23.1-r0", Origin: "py3-pip", Provides: []string{"cmd:pip=23.1-r0"}, Description: "Tool for installing Python packages"},
+		{Name: "busybox", Version: "1.36.1-r0", Origin: "busybox", Provides: []string{"/bin/sh"}, RepoCommit: "0123456789abcdef0123456789abcdef01234567"},
+	}}
+	repo := &repository.Repository{Uri: "local"}
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(index)})
+
+	search := func(pattern string, options ...SearchOption) []string {
+		t.Helper()
+		pkgs, err := SearchIndexes(indexes, pattern, options...)
+		require.NoError(t, err)
+		var found []string
+		for _, pkg := range pkgs {
+			found = append(found, pkg.Name+"-"+pkg.Version)
+		}
+		return found
+	}
+
+	require.Equal(t, []string{"python3-3.11.10-r0", "python3-dev-3.11.10-r0"}, search("python3*"))
+	require.Equal(t, []string{"python3-3.11.10-r0", "python3-3.11.4-r0", "python3-dev-3.11.10-r0"}, search("python3*", WithSearchAllVersions(true)))
+	require.Equal(t, []string{"python3-3.11.10-r0"}, search("python3", WithSearchMatch(SearchExact)))
+	require.Equal(t, []string{"py3-pip-23.1-r0"}, search("cmd:pip"))
+	require.Empty(t, search("cmd:pip", WithSearchFields(SearchName)))
+	require.Equal(t, []string{"busybox-1.36.1-r0"}, search("/bin/sh"))
+	require.Equal(t, []string{"py3-pip-23.1-r0", "python3-3.11.10-r0", "python3-dev-3.11.10-r0"},
+		search("(?i)python", WithSearchMatch(SearchRegex), WithSearchFields(SearchDescription)))
+	require.Equal(t, []string{"py3-pip-23.1-r0", "python3-3.11.10-r0"},
+		search("^py", WithSearchMatch(SearchRegex), WithSearchOrigin(true)))
+	require.Equal(t, []string{"busybox-1.36.1-r0"}, search("0123456*", WithSearchFields(SearchCommit)))
+
+	_, err := SearchIndexes(indexes, "[", WithSearchMatch(SearchRegex))
+	require.Error(t, err)
+	_, err = SearchIndexes(indexes, "[")
+	require.Error(t, err)
+}
@@ -0,0 +1,283 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+)
+
+// A repository may publish, next to its APKINDEX.tar.gz, a sharded index: the same packages split
+// into shards, each an APKINDEX.tar.gz of its own, signed like the full index. A package is in the
+// shard of its name, of each name it provides, and of each name of its install_if, so that the
+// packages that can satisfy a name are all in the shard of the name, ShardOf. The number of shards
+// is in a manifest, which is not signed: the shards are, and tampering with the number can only make
+// packages go missing. A client resolving a few packages then fetches a few shards rather than the
+// whole index.
+const (
+	shardManifestFilename = "APKINDEX.shards.json"
+	shardsDirname         = "APKINDEX.shards"
+)
+
+type shardManifest struct {
+	Shards int `json:"shards"`
+}
+
+// ShardOf returns the shard of a sharded index of the given number of shards that has the packages
+// that can satisfy the name.
+func ShardOf(name string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// ShardIndex splits the packages into the given number of shards; see ShardOf.
+func ShardIndex(pkgs []*repository.Package, shards int) [][]*repository.Package {
+	out := make([][]*repository.Package, shards)
+	for _, pkg := range pkgs {
+		in := map[int]bool{}
+		for _, name := range shardNames(pkg) {
+			shard := ShardOf(name, shards)
+			if !in[shard] {
+				in[shard] = true
+				out[shard] = append(out[shard], pkg)
+			}
+		}
+	}
+	return out
+}
+
+// WriteShardedIndex writes the sharded index of the packages into dir, which is the one with the
+// APKINDEX.tar.gz of the repository. It returns the paths of the shards it wrote, which are unsigned;
+// they must be signed, with signature.SignIndex, before they are published.
+func WriteShardedIndex(dir, description string, pkgs []*repository.Package, shards int) ([]string, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("invalid number of shards %d", shards)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, shardsDirname), 0o755); err != nil {
+		return nil, err
+	}
+	var files []string
+	for i, shard := range ShardIndex(pkgs, shards) {
+		file := filepath.Join(dir, shardsDirname, fmt.Sprintf("%d.tar.gz", i))
+		if err := writeIndexFile(file, description, shard); err != nil {
+			return nil, fmt.Errorf("writing shard %d: %w", i, err)
+		}
+		files = append(files, file)
+	}
+	b, err := json.Marshal(shardManifest{Shards: shards})
+	if err != nil {
+		return nil, err
+	}
+	// #nosec G306 -- the index is to be published
+	if err := os.WriteFile(filepath.Join(dir, shardManifestFilename), b, 0o644); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func writeIndexFile(file, description string, pkgs []*repository.Package) (err error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+	return WriteIndexArchive(f, description, pkgs)
+}
+
+// GetShardedRepositoryIndexes is GetRepositoryIndexes for resolving only the named packages: of the
+// repositories with a sharded index, only the shards needed to resolve the packages and their
+// dependencies are fetched, and the indexes returned only have the packages of those shards. The
+// full index is fetched for repositories without a sharded index. The names are as in the world.
+func GetShardedRepositoryIndexes(ctx context.Context, repos []string, keys map[string][]byte, arch string, names []string, options ...IndexOption) ([]NamedIndex, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetShardedRepositoryIndexes")
+	defer span.End()
+
+	opts := &indexOpts{layout: AlpineLayout{}}
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	type shardedRepo struct {
+		index    *namedRepositoryWithIndex
+		arch     string
+		shards   int
+		loaded   map[int]bool
+		packages map[string]bool
+	}
+	var (
+		indexes []NamedIndex
+		sharded []*shardedRepo
+		// the packages of the full indexes, by the names they can satisfy
+		full = map[string][]*repository.Package{}
+	)
+	for _, repo := range repos {
+		repoName, repoURL, err := parseRepositoryLine(repo)
+		if err != nil {
+			return nil, err
+		}
+		repoArch := opts.repositoryArch(repoURL, arch)
+		base := opts.layout.PackagesURL(repoURL, repoArch)
+		var manifest shardManifest
+		b, err := fetchIndex(ctx, base+"/"+shardManifestFilename, repoArch, opts)
+		if err != nil || b == nil || json.Unmarshal(b, &manifest) != nil || manifest.Shards < 1 {
+			whole, err := GetRepositoryIndexes(ctx, []string{repo}, keys, arch, options...)
+			if err != nil {
+				return nil, err
+			}
+			for _, index := range whole {
+				for _, pkg := range index.Packages() {
+					for _, name := range shardNames(pkg.Package) {
+						full[name] = append(full[name], pkg.Package)
+					}
+				}
+			}
+			indexes = append(indexes, whole...)
+			continue
+		}
+		repoRef := repository.Repository{Uri: base}
+		r := &shardedRepo{
+			index:    &namedRepositoryWithIndex{name: repoName, repo: repoRef.WithIndex(&repository.ApkIndex{}), priority: opts.priorities[repoURL]},
+			arch:     repoArch,
+			shards:   manifest.Shards,
+			loaded:   map[int]bool{},
+			packages: map[string]bool{},
+		}
+		sharded = append(sharded, r)
+		indexes = append(indexes, r.index)
+	}
+
+	// fetch the shards of the names, then of the dependencies of the packages found, until there are
+	// no more names
+	seen := map[string]bool{}
+	var pending []string
+	want := func(deps []string) {
+		for _, dep := range deps {
+			if name, ok := dependencyName(dep); ok && !seen[name] {
+				seen[name] = true
+				pending = append(pending, name)
+			}
+		}
+	}
+	want(names)
+	for len(pending) > 0 {
+		current := pending
+		pending = nil
+		for _, name := range current {
+			for _, pkg := range full[name] {
+				want(pkg.Dependencies)
+			}
+		}
+		for _, r := range sharded {
+			var needed []int
+			for _, name := range current {
+				if shard := ShardOf(name, r.shards); !r.loaded[shard] {
+					r.loaded[shard] = true
+					needed = append(needed, shard)
+				}
+			}
+			sort.Ints(needed)
+			for _, shard := range needed {
+				pkgs, err := fetchShard(ctx, r.index, shard, keys, r.arch, opts)
+				if err != nil {
+					return nil, err
+				}
+				for _, pkg := range packagesForArch(pkgs, arch) {
+					id := pkg.Name + "=" + pkg.Version
+					if r.packages[id] {
+						continue
+					}
+					r.packages[id] = true
+					r.index.repo.IndexObj.Packages = append(r.index.repo.IndexObj.Packages, pkg)
+					want(pkg.Dependencies)
+				}
+			}
+		}
+	}
+	return indexes, nil
+}
+
+// fetchShard fetches, verifies and parses a shard of the sharded index of the repository.
+func fetchShard(ctx context.Context, index *namedRepositoryWithIndex, shard int, keys map[string][]byte, arch string, opts *indexOpts) ([]*repository.Package, error) {
+	u := fmt.Sprintf("%s/%s/%d.tar.gz", index.repo.Uri, shardsDirname, shard)
+	b, err := fetchIndex(ctx, u, arch, opts)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("shard %s not found", u)
+	}
+	if !opts.ignoreSignatures {
+		if index.signer, err = verifyIndexSignature(b, u, keys); err != nil {
+			return nil, err
+		}
+	}
+	parsed, problems, err := parseIndexArchive(b, opts.cacheDir, u)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read convert repository index bytes to index struct at %s: %w", u, err)
+	}
+	for i := range problems {
+		problems[i].Index = u
+	}
+	if len(problems) > 0 && opts.strict {
+		return nil, &IndexProblemsError{Problems: problems}
+	}
+	index.problems = append(index.problems, problems...)
+	// the sharded index is as old as its oldest shard
+	if built := readIndexBuilt(b); !built.IsZero() && (index.built.IsZero() || built.Before(index.built)) {
+		index.built = built
+	}
+	return parsed.Packages, nil
+}
+
+// shardNames returns the names the package can satisfy, or is installed along with: its own, those
+// it provides, and those of its install_if.
+func shardNames(pkg *repository.Package) []string {
+	names := []string{pkg.Name}
+	for _, deps := range [][]string{pkg.Provides, pkg.InstallIf} {
+		for _, dep := range deps {
+			if name, ok := dependencyName(dep); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// dependencyName returns the name of a dependency, provided name or world entry, without its version
+// constraint or pin. It returns false for conflicts, which need not be resolved.
+func dependencyName(dep string) (string, bool) {
+	if strings.HasPrefix(dep, "!") {
+		return "", false
+	}
+	if i := strings.IndexAny(dep, "<>=~@"); i >= 0 {
+		dep = dep[:i]
+	}
+	return dep, dep != ""
+}
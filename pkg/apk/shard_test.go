@@ -0,0 +1,89 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestShardIndex(t *testing.T) {
+	pkgs := []*repository.Package{
+		{Name: "libfoo", Version: "1.0-r0", Provides: []string{"so:libfoo.so.1=1"}},
+		{Name: "foo-doc", Version: "1.0-r0", InstallIf: []string{"foo=1.0-r0", "docs"}},
+	}
+	shards := ShardIndex(pkgs, 16)
+	for _, name := range []string{"libfoo", "so:libfoo.so.1"} {
+		require.Contains(t, shards[ShardOf(name, 16)], pkgs[0], name)
+	}
+	for _, name := range []string{"foo-doc", "foo", "docs"} {
+		require.Contains(t, shards[ShardOf(name, 16)], pkgs[1], name)
+	}
+}
+
+func TestGetShardedRepositoryIndexes(t *testing.T) {
+	ctx := context.Background()
+	pkgs := []*repository.Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"libfoo>=1.0", "so:libc.so.1", "!oldapp"}},
+		{Name: "libfoo", Version: "1.0-r0", Dependencies: []string{"so:libc.so.1"}},
+		{Name: "libc", Version: "1.0-r0", Provides: []string{"so:libc.so.1=1"}},
+	}
+	for i := 0; i < 100; i++ {
+		pkgs = append(pkgs, &repository.Package{Name: fmt.Sprintf("other-%d", i), Version: "1.0-r0"})
+	}
+	sharded := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(sharded, testArch), 0o755))
+	_, err := WriteShardedIndex(filepath.Join(sharded, testArch), "", pkgs, 32)
+	require.NoError(t, err)
+
+	// the full index of another repository, without shards
+	whole := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(whole, testArch), 0o755))
+	f, err := os.Create(filepath.Join(whole, testArch, indexFilename))
+	require.NoError(t, err)
+	require.NoError(t, WriteIndexArchive(f, "", []*repository.Package{{Name: "tool", Version: "1.0-r0", Dependencies: []string{"libc"}}}))
+	require.NoError(t, f.Close())
+
+	indexes, err := GetShardedRepositoryIndexes(ctx, []string{sharded, whole}, nil, testArch, []string{"app", "tool"}, WithIgnoreSignatures(true))
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+	require.Less(t, indexes[0].Count(), 30)
+	require.Equal(t, 1, indexes[1].Count())
+
+	resolved, _, err := NewPkgResolver(ctx, indexes).GetPackagesWithDependencies(ctx, []string{"app", "tool"})
+	require.NoError(t, err)
+	var names []string
+	for _, pkg := range resolved {
+		names = append(names, pkg.Name)
+		if pkg.Name == "app" {
+			require.Equal(t, filepath.Join(sharded, testArch)+"/app-1.0-r0.apk", pkg.Url())
+		}
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{"app", "libc", "libfoo", "tool"}, names)
+
+	t.Run("missing shard", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(sharded, testArch, shardsDirname, fmt.Sprintf("%d.tar.gz", ShardOf("app", 32)))))
+		_, err := GetShardedRepositoryIndexes(ctx, []string{sharded}, nil, testArch, []string{"app"}, WithIgnoreSignatures(true))
+		require.ErrorContains(t, err, "not found")
+	})
+}
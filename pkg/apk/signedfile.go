@@ -0,0 +1,149 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // the digest apk signs with
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// FileVerifier verifies the detached signature of a file given to the library from a less trusted
+// source, such as a configuration read with LoadSignedConfig, returning who signed it.
+// RSAFileVerifier verifies those written by SignFile; other backends, such as one for sigstore, can
+// be used by implementing it.
+type FileVerifier interface {
+	VerifyFile(data, signature []byte) (string, error)
+}
+
+// FileVerifierFunc is a function that is a FileVerifier.
+type FileVerifierFunc func(data, signature []byte) (string, error)
+
+func (f FileVerifierFunc) VerifyFile(data, signature []byte) (string, error) {
+	return f(data, signature)
+}
+
+// FileSignature is the detached signature of a file, as SignFile writes it, in JSON.
+type FileSignature struct {
+	// Key is the name of the key the file is signed with, as in /etc/apk/keys.
+	Key string `json:"key"`
+	// Signature is the RSA signature of the SHA-1 digest of the file, as apk signs indexes.
+	Signature []byte `json:"signature"`
+}
+
+// UntrustedFileError is returned by RSAFileVerifier for a file that is not signed, or not signed
+// with any of its keys.
+type UntrustedFileError struct {
+	// Key is the name of the key the file claims to be signed with, or empty if it is not signed.
+	Key     string
+	wrapped error
+}
+
+func (e *UntrustedFileError) Error() string {
+	if e.Key == "" {
+		return "file is not signed"
+	}
+	msg := fmt.Sprintf("file is signed with untrusted key %s", e.Key)
+	if e.wrapped != nil {
+		msg += ": " + e.wrapped.Error()
+	}
+	return msg
+}
+
+func (e *UntrustedFileError) Unwrap() error {
+	return e.wrapped
+}
+
+// SignFile returns the detached signature of the file, signed with the RSA private key in keyFile,
+// which is decrypted with the passphrase if it is encrypted. The key is named in the signature as
+// that of the public key, keyFile.pub, as for indexes.
+func SignFile(data []byte, keyFile, passphrase string) ([]byte, error) {
+	digest := sha1.Sum(data) //nolint:gosec
+	sig, err := sign.RSASignSHA1Digest(digest[:], keyFile, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("signing file: %w", err)
+	}
+	return json.Marshal(FileSignature{Key: filepath.Base(keyFile) + ".pub", Signature: sig})
+}
+
+// RSAFileVerifier is a FileVerifier of the signatures of SignFile, with public keys by name, as with
+// TrustedKeys. A signature with a key of another name is verified against every key, as signatures
+// of packages are, so that the keys can be renamed.
+type RSAFileVerifier map[string][]byte
+
+func (keys RSAFileVerifier) VerifyFile(data, signature []byte) (string, error) {
+	if len(bytes.TrimSpace(signature)) == 0 {
+		return "", &UntrustedFileError{}
+	}
+	var sig FileSignature
+	if err := json.Unmarshal(signature, &sig); err != nil {
+		return "", fmt.Errorf("parsing signature: %w", err)
+	}
+	if len(sig.Signature) == 0 {
+		return "", &UntrustedFileError{}
+	}
+	digest := sha1.Sum(data) //nolint:gosec
+	if key, ok := keys[sig.Key]; ok {
+		if err := sign.RSAVerifySHA1Digest(digest[:], sig.Signature, key); err != nil {
+			return "", &UntrustedFileError{Key: sig.Key, wrapped: err}
+		}
+		return sig.Key, nil
+	}
+	for _, key := range keys {
+		if err := sign.RSAVerifySHA1Digest(digest[:], sig.Signature, key); err == nil {
+			return sig.Key, nil
+		}
+	}
+	return "", &UntrustedFileError{Key: sig.Key}
+}
+
+// LoadSignedConfig reads a Config, for NewFromConfig, from JSON or YAML once the verifier has
+// verified its signature, returning it with who signed it. Nothing of the file is parsed before then.
+func LoadSignedConfig(data, signature []byte, verifier FileVerifier) (Config, string, error) {
+	signer, err := verifier.VerifyFile(data, signature)
+	if err != nil {
+		return Config{}, "", fmt.Errorf("verifying configuration: %w", err)
+	}
+	var cfg Config
+	if json.Valid(data) {
+		err = json.Unmarshal(data, &cfg)
+	} else {
+		err = yaml.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return Config{}, "", fmt.Errorf("parsing configuration: %w", err)
+	}
+	return cfg, signer, nil
+}
+
+// LoadSignedImageContents is LoadImageContents for an image configuration whose signature the
+// verifier has verified, returning its contents with who signed it.
+func LoadSignedImageContents(data, signature []byte, verifier FileVerifier) (*ImageContents, string, error) {
+	signer, err := verifier.VerifyFile(data, signature)
+	if err != nil {
+		return nil, "", fmt.Errorf("verifying image configuration: %w", err)
+	}
+	contents, err := LoadImageContents(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	return contents, signer, nil
+}
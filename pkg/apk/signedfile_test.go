@@ -0,0 +1,94 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testSigningKey writes an RSA private key to a file named name, returning the file and the PEM of
+// its public key.
+func testSigningKey(t *testing.T, name string) (string, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+	return keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+}
+
+func TestSignedFiles(t *testing.T) {
+	keyFile, pub := testSigningKey(t, "ci.rsa")
+	_, otherPub := testSigningKey(t, "other.rsa")
+
+	cfg := []byte("arch: aarch64\nrepositories:\n  - https://example.com/main\nmaxIndexAge: 24h\n")
+	sig, err := SignFile(cfg, keyFile, "")
+	require.NoError(t, err)
+
+	got, signer, err := LoadSignedConfig(cfg, sig, RSAFileVerifier{"ci.rsa.pub": pub})
+	require.NoError(t, err)
+	require.Equal(t, "ci.rsa.pub", signer)
+	require.Equal(t, "aarch64", got.Arch)
+	require.Equal(t, []string{"https://example.com/main"}, got.Repositories)
+
+	// a renamed key still verifies it
+	_, _, err = LoadSignedConfig(cfg, sig, RSAFileVerifier{"renamed.rsa.pub": pub})
+	require.NoError(t, err)
+
+	// JSON too
+	jsonCfg := []byte(`{"arch":"x86_64","maxIndexAge":60000000000}`)
+	jsonSig, err := SignFile(jsonCfg, keyFile, "")
+	require.NoError(t, err)
+	got, _, err = LoadSignedConfig(jsonCfg, jsonSig, RSAFileVerifier{"ci.rsa.pub": pub})
+	require.NoError(t, err)
+	require.Equal(t, "x86_64", got.Arch)
+
+	var untrusted *UntrustedFileError
+	for name, tc := range map[string]struct {
+		data, sig []byte
+		keys      RSAFileVerifier
+		key       string
+	}{
+		"tampered":      {data: append(cfg, "allowUntrusted: true\n"...), sig: sig, keys: RSAFileVerifier{"ci.rsa.pub": pub}, key: "ci.rsa.pub"},
+		"untrusted key": {data: cfg, sig: sig, keys: RSAFileVerifier{"other.rsa.pub": otherPub}, key: "ci.rsa.pub"},
+		"not signed":    {data: cfg, keys: RSAFileVerifier{"ci.rsa.pub": pub}},
+	} {
+		_, _, err := LoadSignedConfig(tc.data, tc.sig, tc.keys)
+		require.ErrorAs(t, err, &untrusted, name)
+		require.Equal(t, tc.key, untrusted.Key, name)
+	}
+
+	image := []byte("contents:\n  packages:\n    - busybox\n")
+	imageSig, err := SignFile(image, keyFile, "")
+	require.NoError(t, err)
+	contents, _, err := LoadSignedImageContents(image, imageSig, RSAFileVerifier{"ci.rsa.pub": pub})
+	require.NoError(t, err)
+	require.Equal(t, []string{"busybox"}, contents.Packages)
+
+	// other backends plug in
+	refuse := FileVerifierFunc(func(data, signature []byte) (string, error) { return "", errors.New("no") })
+	_, _, err = LoadSignedImageContents(image, imageSig, refuse)
+	require.ErrorContains(t, err, "verifying image configuration: no")
+}
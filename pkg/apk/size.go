@@ -0,0 +1,77 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"sort"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// maxSizeContributors is how many of the largest packages are reported when the
+// installed size budget is exceeded.
+const maxSizeContributors = 10
+
+// checkInstalledSize sums the installed size of the packages and returns an
+// *InstalledSizeExceededError if it is over the configured budget.
+func (a *APK) checkInstalledSize(pkgs []*repository.RepositoryPackage) error {
+	if a.maxInstalledSize == 0 {
+		return nil
+	}
+	var total uint64
+	sizes := make([]PackageSize, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		total += pkg.InstalledSize
+		sizes = append(sizes, PackageSize{Name: pkg.Name, Size: pkg.InstalledSize})
+	}
+	if total <= a.maxInstalledSize {
+		return nil
+	}
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].Size > sizes[j].Size
+	})
+	if len(sizes) > maxSizeContributors {
+		sizes = sizes[:maxSizeContributors]
+	}
+	return &InstalledSizeExceededError{Max: a.maxInstalledSize, Total: total, Largest: sizes}
+}
+
+// checkDiskSpace compares the installed size of the packages to install, less that of the installed
+// versions they replace, with the space available on the filesystem of the root, returning an *InsufficientSpaceError if they do not fit, before anything is written.
+func (a *APK) checkDiskSpace(pkgs []*repository.RepositoryPackage, isInstalled map[string]bool, replace map[string]*InstalledPackage) error {
+	var needed, freed uint64
+	for _, pkg := range pkgs {
+		if isInstalled[pkg.Name] {
+			continue
+		}
+		needed += pkg.InstalledSize
+		if old, ok := replace[pkg.Name]; ok {
+			freed += old.InstalledSize
+		}
+	}
+	if needed <= freed {
+		return nil
+	}
+	needed -= freed
+	capacity, err := a.fs.StatFS()
+	if err != nil {
+		a.logger.Warnf("not checking for disk space: %v", err)
+		return nil
+	}
+	if needed > capacity.Available {
+		return &InsufficientSpaceError{Needed: needed, Available: capacity.Available}
+	}
+	return nil
+}
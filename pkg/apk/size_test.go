@@ -0,0 +1,93 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// capacityFS is a filesystem in memory with the capacity given.
+type capacityFS struct {
+	apkfs.FullFS
+	capacity apkfs.Capacity
+}
+
+func (f capacityFS) StatFS() (apkfs.Capacity, error) {
+	return f.capacity, nil
+}
+
+func TestCheckInstalledSize(t *testing.T) {
+	pkgs := []*repository.RepositoryPackage{
+		{Package: &repository.Package{Name: "small", InstalledSize: 100}},
+		{Package: &repository.Package{Name: "big", InstalledSize: 5000}},
+		{Package: &repository.Package{Name: "medium", InstalledSize: 1000}},
+	}
+
+	t.Run("no limit", func(t *testing.T) {
+		a, err := New()
+		require.NoError(t, err)
+		require.NoError(t, a.checkInstalledSize(pkgs))
+	})
+	t.Run("within limit", func(t *testing.T) {
+		a, err := New(WithMaxInstalledSize(6100))
+		require.NoError(t, err)
+		require.NoError(t, a.checkInstalledSize(pkgs))
+	})
+	t.Run("over limit", func(t *testing.T) {
+		a, err := New(WithMaxInstalledSize(6000))
+		require.NoError(t, err)
+		err = a.checkInstalledSize(pkgs)
+		var sizeErr *InstalledSizeExceededError
+		require.True(t, errors.As(err, &sizeErr))
+		require.Equal(t, uint64(6100), sizeErr.Total)
+		require.Equal(t, []PackageSize{{"big", 5000}, {"medium", 1000}, {"small", 100}}, sizeErr.Largest)
+		require.ErrorContains(t, err, "big (5000)")
+	})
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	pkgs := []*repository.RepositoryPackage{
+		{Package: &repository.Package{Name: "installed", InstalledSize: 9000}},
+		{Package: &repository.Package{Name: "new", InstalledSize: 1000}},
+		{Package: &repository.Package{Name: "upgraded", InstalledSize: 600}},
+	}
+	isInstalled := map[string]bool{"installed": true}
+	replace := map[string]*InstalledPackage{"upgraded": {Package: repository.Package{Name: "upgraded", InstalledSize: 500}}}
+
+	check := func(available uint64) error {
+		a, err := New(WithFS(capacityFS{FullFS: apkfs.NewMemFS(), capacity: apkfs.Capacity{Total: 1 << 20, Free: available, Available: available}}))
+		require.NoError(t, err)
+		return a.checkDiskSpace(pkgs, isInstalled, replace)
+	}
+
+	// the new package, and the growth of the upgraded one
+	require.NoError(t, check(1100))
+	err := check(1099)
+	var spaceErr *InsufficientSpaceError
+	require.ErrorAs(t, err, &spaceErr)
+	require.Equal(t, uint64(1100), spaceErr.Needed)
+	require.Equal(t, uint64(1099), spaceErr.Available)
+
+	// filesystems in memory have no limit
+	a, err := New(WithFS(apkfs.NewMemFS()))
+	require.NoError(t, err)
+	require.NoError(t, a.checkDiskSpace(pkgs, isInstalled, replace))
+}
@@ -0,0 +1,227 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// SubpackageRule adds or leaves out a companion subpackage, such as foo-doc or foo-dev, for the packages
+// in the world that it matches, so that they do not need to be listed one by one. The rules are applied in
+// order, and the last one that matches a package and suffix decides whether the subpackage is installed.
+type SubpackageRule struct {
+	// Suffix is appended to the name of a package in the world to get that of the subpackage, e.g. "-doc".
+	Suffix string
+	// Packages are path.Match patterns for the names of the packages in the world the rule applies to.
+	// If empty, it applies to all of them.
+	Packages []string
+	// Exclude leaves the subpackage out rather than adding it, including when it would otherwise be
+	// pulled in by its install_if. It is still installed if listed in the world or required by another package.
+	Exclude bool
+}
+
+func (r SubpackageRule) matches(name string) bool {
+	if len(r.Packages) == 0 {
+		return true
+	}
+	for _, pattern := range r.Packages {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// subpackageSuffixes returns, for the named package, each suffix covered by the rules and whether the
+// last rule matching it includes the subpackage.
+func (a *APK) subpackageSuffixes(name string) map[string]bool {
+	suffixes := map[string]bool{}
+	for _, rule := range a.subpackageRules {
+		if rule.matches(name) {
+			suffixes[rule.Suffix] = !rule.Exclude
+		}
+	}
+	return suffixes
+}
+
+// addSubpackages returns the world with the subpackages included by the rules added after it. Each one
+// keeps the version constraint and pin of the package it belongs to, and is only added if the indexes
+// have it, as not every package has every subpackage.
+func (a *APK) addSubpackages(resolver *PkgResolver, world []string) []string {
+	if len(a.subpackageRules) == 0 {
+		return world
+	}
+	listed := make(map[string]bool, len(world))
+	for _, entry := range world {
+		listed[resolver.resolvePackageNameVersionPin(entry).name] = true
+	}
+	extended := world
+	for _, entry := range world {
+		stuff := resolver.resolvePackageNameVersionPin(entry)
+		constraint := stuff.constraint()
+		suffixes := a.subpackageSuffixes(stuff.name)
+		for _, suffix := range sortedKeys(suffixes) {
+			name := stuff.name + suffix
+			if !suffixes[suffix] || listed[name] {
+				continue
+			}
+			sub := worldEntry(name, constraint, stuff.pin)
+			if _, err := resolver.ResolvePackage(sub); err != nil {
+				continue
+			}
+			a.logger.Debugf("adding subpackage %s of %s", name, stuff.name)
+			extended = append(extended, sub)
+			listed[name] = true
+		}
+	}
+	return extended
+}
+
+// checkSubpackageVersions reports the subpackages added by addSubpackages that were resolved at a version
+// the constraint of their package does not allow. The resolver settles on the first version of a name that
+// it reaches, so a package depending on another version of the subpackage can win over the constraint.
+func (a *APK) checkSubpackageVersions(world, extended []string, pkgs []*repository.RepositoryPackage) error {
+	if len(extended) <= len(world) {
+		return nil
+	}
+	added := map[string]bool{}
+	for _, entry := range extended[len(world):] {
+		added[resolvePackageNameVersionPin(entry).name] = true
+	}
+	resolved := make(map[string]*repository.RepositoryPackage, len(pkgs))
+	for _, pkg := range pkgs {
+		resolved[pkg.Name] = pkg
+	}
+	var errs []error
+	for _, entry := range world {
+		stuff := resolvePackageNameVersionPin(entry)
+		if stuff.dep == versionNone {
+			continue
+		}
+		required, err := parseVersion(stuff.version)
+		if err != nil {
+			continue
+		}
+		for suffix, include := range a.subpackageSuffixes(stuff.name) {
+			sub, ok := resolved[stuff.name+suffix]
+			if !include || !ok || !added[sub.Name] {
+				continue
+			}
+			actual, err := parseVersion(sub.Version)
+			if err == nil && stuff.dep.satisfies(actual, required) {
+				continue
+			}
+			wanted, requiredBy := requiringPackage(sub.Name, pkgs)
+			if wanted == "" {
+				wanted = sub.Name + " version " + sub.Version
+			}
+			if stuff.dep == versionEqual {
+				errs = append(errs, &HeldPackageError{Name: stuff.name, Held: stuff.version, Wanted: wanted, RequiredBy: requiredBy})
+				continue
+			}
+			errs = append(errs, fmt.Errorf("subpackage %s of %s%s resolved to version %s", sub.Name, stuff.name, stuff.constraint(), sub.Version))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// requiringPackage returns the first dependency on the named package with a version constraint, and the
+// package that has it, or empty strings if none of the packages has one.
+func requiringPackage(name string, pkgs []*repository.RepositoryPackage) (dep, requiredBy string) {
+	for _, pkg := range pkgs {
+		for _, d := range pkg.Dependencies {
+			stuff := resolvePackageNameVersionPin(d)
+			if stuff.name == name && stuff.dep != versionNone {
+				return d, pkg.Name
+			}
+		}
+	}
+	return "", ""
+}
+
+// excludeSubpackages removes the subpackages excluded by the rules from the resolved packages, unless
+// they are listed in the world or another of the packages depends on them.
+func (a *APK) excludeSubpackages(world []string, pkgs []*repository.RepositoryPackage) []*repository.RepositoryPackage {
+	if len(a.subpackageRules) == 0 {
+		return pkgs
+	}
+	listed := make(map[string]bool, len(world))
+	excluded := map[string]bool{}
+	for _, entry := range world {
+		name := resolvePackageNameVersionPin(entry).name
+		listed[name] = true
+		for suffix, include := range a.subpackageSuffixes(name) {
+			if !include {
+				excluded[name+suffix] = true
+			}
+		}
+	}
+	for name := range listed {
+		delete(excluded, name)
+	}
+	if len(excluded) == 0 {
+		return pkgs
+	}
+
+	// anything the remaining packages depend on must stay
+	required := map[string]bool{}
+	for _, pkg := range pkgs {
+		if excluded[pkg.Name] {
+			continue
+		}
+		for _, dep := range pkg.Dependencies {
+			if !strings.HasPrefix(dep, "!") {
+				required[resolvePackageNameVersionPin(dep).name] = true
+			}
+		}
+	}
+	kept := make([]*repository.RepositoryPackage, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		if excluded[pkg.Name] && !isRequired(pkg, required) {
+			a.logger.Debugf("excluding subpackage %s", pkg.Name)
+			continue
+		}
+		kept = append(kept, pkg)
+	}
+	return kept
+}
+
+// isRequired reports whether the package satisfies any of the required names, by its name or what it provides.
+func isRequired(pkg *repository.RepositoryPackage, required map[string]bool) bool {
+	if required[pkg.Name] {
+		return true
+	}
+	for _, provide := range pkg.Provides {
+		if required[resolvePackageNameVersionPin(provide).name] {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestSubpackageRules(t *testing.T) {
+	index := &repository.ApkIndex{Packages: []*repository.Package{
+		{Name: "foo", Version: "1.0.0-r0"},
+		{Name: "foo", Version: "2.0.0-r0"},
+		{Name: "foo-doc", Version: "1.0.0-r0", InstallIf: []string{"docs", "foo=1.0.0-r0"}},
+		{Name: "foo-doc", Version: "2.0.0-r0", InstallIf: []string{"docs", "foo=2.0.0-r0"}},
+		{Name: "foo-dev", Version: "2.0.0-r0", Dependencies: []string{"foo"}},
+		{Name: "bar", Version: "1.0.0-r0", Dependencies: []string{"busybox-doc"}},
+		{Name: "bar-doc", Version: "1.0.0-r0", InstallIf: []string{"docs", "bar=1.0.0-r0"}},
+		{Name: "busybox", Version: "1.0.0-r0"},
+		{Name: "busybox-doc", Version: "1.0.0-r0", InstallIf: []string{"docs", "busybox=1.0.0-r0"}},
+		{Name: "docs", Version: "1.0.0-r0"},
+		{Name: "app", Version: "1.0.0-r0", Dependencies: []string{"docs", "foo"}},
+		{Name: "reader", Version: "1.0.0-r0", Dependencies: []string{"foo-doc>=2.0.0-r0"}},
+	}}
+	repo := &repository.Repository{Uri: "local"}
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(index)})
+	ctx := context.Background()
+
+	resolve := func(t *testing.T, a *APK, world []string) []string {
+		resolver := NewPkgResolver(ctx, indexes)
+		world = a.addSubpackages(resolver, world)
+		pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, world)
+		require.NoError(t, err)
+		var names []string
+		for _, pkg := range a.excludeSubpackages(world, pkgs) {
+			names = append(names, pkg.Name+"-"+pkg.Version)
+		}
+		return names
+	}
+
+	t.Run("include", func(t *testing.T) {
+		a, err := New(WithSubpackageRules(
+			SubpackageRule{Suffix: "-dev"},
+			SubpackageRule{Suffix: "-doc", Packages: []string{"f*"}},
+		))
+		require.NoError(t, err)
+		// the subpackages follow the version of the package; busybox has no -dev, so it is skipped
+		require.ElementsMatch(t, []string{"foo-1.0.0-r0", "foo-doc-1.0.0-r0", "busybox-1.0.0-r0"}, resolve(t, a, []string{"foo=1.0.0-r0", "busybox"}))
+		require.ElementsMatch(t, []string{"foo-2.0.0-r0", "foo-doc-2.0.0-r0", "foo-dev-2.0.0-r0"}, resolve(t, a, []string{"foo"}))
+	})
+	t.Run("exclude", func(t *testing.T) {
+		a, err := New(WithSubpackageRules(
+			SubpackageRule{Suffix: "-doc"},
+			SubpackageRule{Suffix: "-doc", Packages: []string{"foo", "busybox"}, Exclude: true},
+		))
+		require.NoError(t, err)
+		// foo-doc would come in by install_if through app, busybox-doc stays as bar depends on it
+		got := resolve(t, a, []string{"app", "foo", "bar", "busybox"})
+		require.ElementsMatch(t, []string{"app-1.0.0-r0", "docs-1.0.0-r0", "foo-2.0.0-r0", "bar-1.0.0-r0", "bar-doc-1.0.0-r0", "busybox-1.0.0-r0", "busybox-doc-1.0.0-r0"}, got)
+		// listing it in the world wins over the rules
+		require.Contains(t, resolve(t, a, []string{"docs", "foo", "foo-doc"}), "foo-doc-2.0.0-r0")
+	})
+	t.Run("held", func(t *testing.T) {
+		a, err := New(WithSubpackageRules(SubpackageRule{Suffix: "-doc"}))
+		require.NoError(t, err)
+		// foo-doc follows the version foo is held at, but only foo is held
+		world := []string{"foo=1.0.0-r0", "reader"}
+		resolver := NewPkgResolver(ctx, indexes)
+		expand := func(world []string) []string { return a.addSubpackages(resolver, world) }
+		pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, expand(world))
+		require.NoError(t, err)
+		require.NoError(t, checkHeldPackages(world, pkgs))
+		// reader wants a newer foo-doc than the version of foo that it follows
+		err = a.checkSubpackageVersions(world, expand(world), pkgs)
+		var heldErr *HeldPackageError
+		require.ErrorAs(t, err, &heldErr)
+		require.Equal(t, "foo", heldErr.Name)
+		require.Equal(t, "1.0.0-r0", heldErr.Held)
+		require.Equal(t, "foo-doc>=2.0.0-r0", heldErr.Wanted)
+		require.Equal(t, "reader", heldErr.RequiredBy)
+
+		// nor is foo-doc reported when what was resolved needs another version of it
+		pkgs, _, err = resolver.GetPackagesWithDependencies(ctx, expand([]string{"foo=1.0.0-r0"}))
+		require.NoError(t, err)
+		require.NoError(t, checkHeldPackages(world, append(pkgs, &repository.RepositoryPackage{
+			Package: &repository.Package{Name: "reader", Version: "1.0.0-r0", Dependencies: []string{"foo-doc>=2.0.0-r0"}},
+		})))
+	})
+}
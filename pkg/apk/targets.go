@@ -0,0 +1,111 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// FixateWorldTargets is FixateWorld for the root and each of the targets together, such as a root
+// filesystem and the sysroot of an SDK. The indexes of the repositories of the root are fetched once,
+// the world of the root is resolved against them for each target as for the root, with the world of
+// each target set to it, and each package is fetched once for all of them, through the cache, or a
+// temporary one without WithCache.
+//
+// Either everything is installed, or, if installing into any of the roots fails, every one of them is
+// put back as it was and the error returned. With WithBestEffort, a PartialInstallError is returned
+// once every root is installed. The targets must already be initialized, as with InitDB. With
+// WithInstallRoot, everything is installed under the install root of each of them.
+func (a *APK) FixateWorldTargets(ctx context.Context, sourceDateEpoch *time.Time, targets ...apkfs.FullFS) (err error) {
+	a.logger.Infof("synchronizing %d roots with desired apk world", len(targets)+1)
+
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "FixateWorldTargets")
+	defer span.End()
+
+	world, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	var names []string
+	if a.shardedIndexes {
+		names = world
+	}
+	indexes, err := a.getRepositoryIndexes(ctx, a.ignoreSignatures, names)
+	if err != nil {
+		return fmt.Errorf("error getting repository indexes: %w", err)
+	}
+
+	var options []Option
+	if a.cache == nil {
+		dir, err := os.MkdirTemp("", "go-apk-cache")
+		if err != nil {
+			return fmt.Errorf("unable to create temporary cache: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		options = append(options, WithCache(dir, false))
+	}
+
+	// the root is journaled as given, without the install root or clamping its times, which its
+	// clone does again, as for the targets
+	roots := append([]apkfs.FullFS{a.baseFS}, targets...)
+	journals := make([]*apkfs.JournalFS, 0, len(roots))
+	defer func() {
+		if err == nil {
+			return
+		}
+		var partial *PartialInstallError
+		if errors.As(err, &partial) {
+			return
+		}
+		for i, j := range journals {
+			if rollbackErr := j.Rollback(); rollbackErr != nil {
+				err = errors.Join(err, fmt.Errorf("rolling back root %d: %w", i, rollbackErr))
+			}
+		}
+	}()
+
+	var partial *PartialInstallError
+	for i, root := range roots {
+		j := apkfs.NewJournalFS(root)
+		journals = append(journals, j)
+		clone, err := a.Clone(append(options, WithFS(j))...)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if err := clone.SetWorld(world); err != nil {
+				return fmt.Errorf("setting world of root %d: %w", i, err)
+			}
+		}
+		if err := clone.fixateWorld(ctx, sourceDateEpoch, false, false, indexes); err != nil {
+			if errors.As(err, &partial) {
+				continue
+			}
+			return fmt.Errorf("installing into root %d: %w", i, err)
+		}
+	}
+	if partial != nil {
+		return partial
+	}
+	return nil
+}
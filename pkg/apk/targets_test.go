@@ -0,0 +1,90 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestFixateWorldTargets(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	writeTestRepository(t, repoDir,
+		testPackage{repository.Package{Name: "libhello", Version: "1.0-r0"}, map[string]string{"usr/lib/libhello.so": "lib"}},
+		testPackage{repository.Package{Name: "hello", Version: "1.0-r0", Dependencies: []string{"libhello"}}, map[string]string{"usr/bin/hello": "hello"}},
+	)
+	var fetches atomic.Int32
+	files := http.FileServer(http.Dir(repoDir))
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".apk") {
+			fetches.Add(1)
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	newRoot := func(t *testing.T) (*APK, apkfs.FullFS) {
+		fs := apkfs.NewMemFS()
+		a := newTestAPK(t, fs, []string{srv.URL}, []string{"hello"})
+		a.SetClient(srv.Client())
+		return a, fs
+	}
+
+	t.Run("all", func(t *testing.T) {
+		fetches.Store(0)
+		a, root := newRoot(t)
+		_, sysroot := newRoot(t)
+		require.NoError(t, sysroot.WriteFile(worldFilePath, []byte("other\n"), 0o644))
+		require.NoError(t, a.FixateWorldTargets(ctx, nil, sysroot))
+		for _, fs := range []apkfs.FullFS{root, sysroot} {
+			b, err := fs.ReadFile("usr/bin/hello")
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(b))
+			world, err := fs.ReadFile(worldFilePath)
+			require.NoError(t, err)
+			require.Equal(t, "hello\n", string(world))
+		}
+		// each package is fetched once, for both roots
+		require.Equal(t, int32(2), fetches.Load())
+	})
+
+	t.Run("none", func(t *testing.T) {
+		a, root := newRoot(t)
+		before, err := root.ReadFile(installedFilePath)
+		require.NoError(t, err)
+		// not initialized, so nothing can be installed into it
+		broken := apkfs.NewMemFS()
+		require.Error(t, a.FixateWorldTargets(ctx, nil, broken))
+
+		after, err := root.ReadFile(installedFilePath)
+		require.NoError(t, err)
+		require.Equal(t, before, after)
+		_, err = root.Stat("usr/bin/hello")
+		require.ErrorIs(t, err, os.ErrNotExist)
+		_, err = root.Stat("usr")
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
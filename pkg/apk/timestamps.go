@@ -0,0 +1,214 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// timestampFS is a FullFS that clamps the times of everything written to it to a limit, as it is
+// written, for WithTimestampOverride. Entries that are created or written get the time they would
+// have had, now, clamped; the times of packaged files are those of their headers, clamped; and
+// the directories that entries are created or removed in keep the time they had, so the times of
+// a root do not depend on the order or the time it was made in.
+type timestampFS struct {
+	apkfs.FullFS
+	limit time.Time
+}
+
+// clampTimes returns fsys clamping the times written to it to limit, or just fsys if limit is zero.
+// A fsys that clamps already is unwrapped first, so that clones do not clamp twice.
+func clampTimes(fsys apkfs.FullFS, limit time.Time) apkfs.FullFS {
+	if t, ok := fsys.(*timestampFS); ok {
+		fsys = t.FullFS
+	}
+	if limit.IsZero() {
+		return fsys
+	}
+	return &timestampFS{FullFS: fsys, limit: limit}
+}
+
+func (f *timestampFS) clamp(t time.Time) time.Time {
+	if t.After(f.limit) {
+		return f.limit
+	}
+	return t
+}
+
+// touch sets the times of the entry at path to now, clamped, unless it is a symlink, whose own
+// times cannot be changed.
+func (f *timestampFS) touch(path string) error {
+	fi, err := f.FullFS.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	t := f.clamp(time.Now())
+	return f.FullFS.Chtimes(path, t, t)
+}
+
+// inDir runs change, which adds or removes entries in the directory dir, then sets the time of
+// dir back to what it was, clamped.
+func (f *timestampFS) inDir(dir string, change func() error) error {
+	fi, statErr := f.FullFS.Stat(dir)
+	if err := change(); err != nil {
+		return err
+	}
+	if statErr != nil {
+		return nil
+	}
+	t := f.clamp(fi.ModTime())
+	return f.FullFS.Chtimes(dir, t, t)
+}
+
+// create runs create, which makes the entry at path, then touches it.
+func (f *timestampFS) create(path string, create func() error) error {
+	if err := f.inDir(filepath.Dir(path), create); err != nil {
+		return err
+	}
+	return f.touch(path)
+}
+
+func (f *timestampFS) Chtimes(path string, atime, mtime time.Time) error {
+	return f.FullFS.Chtimes(path, f.clamp(atime), f.clamp(mtime))
+}
+
+func (f *timestampFS) Mkdir(path string, perm fs.FileMode) error {
+	return f.create(path, func() error { return f.FullFS.Mkdir(path, perm) })
+}
+
+func (f *timestampFS) MkdirAll(path string, perm fs.FileMode) error {
+	// the directories that are missing, from the deepest
+	var missing []string
+	for dir := filepath.Clean(path); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if _, err := f.FullFS.Stat(dir); err == nil {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	if len(missing) == 0 {
+		return f.FullFS.MkdirAll(path, perm)
+	}
+	top := missing[len(missing)-1]
+	if err := f.inDir(filepath.Dir(top), func() error { return f.FullFS.MkdirAll(path, perm) }); err != nil {
+		return err
+	}
+	for _, dir := range missing {
+		if err := f.touch(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *timestampFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
+	return f.create(name, func() error { return f.FullFS.WriteFile(name, b, mode) })
+}
+
+func (f *timestampFS) Create(name string) (apkfs.File, error) {
+	return f.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
+}
+
+func (f *timestampFS) OpenFile(name string, flag int, perm fs.FileMode) (apkfs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f.FullFS.OpenFile(name, flag, perm)
+	}
+	var file apkfs.File
+	if err := f.inDir(filepath.Dir(name), func() (err error) {
+		file, err = f.FullFS.OpenFile(name, flag, perm)
+		return err
+	}); err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+	return &timestampFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *timestampFS) Mknod(path string, mode uint32, dev int) error {
+	return f.create(path, func() error { return f.FullFS.Mknod(path, mode, dev) })
+}
+
+func (f *timestampFS) Symlink(oldname, newname string) error {
+	return f.inDir(filepath.Dir(newname), func() error { return f.FullFS.Symlink(oldname, newname) })
+}
+
+func (f *timestampFS) Link(oldname, newname string) error {
+	// the file linked to keeps its times
+	return f.inDir(filepath.Dir(newname), func() error { return f.FullFS.Link(oldname, newname) })
+}
+
+func (f *timestampFS) CloneFile(src, name string, mode apkfs.CloneMode) error {
+	cfs, ok := f.FullFS.(apkfs.CloneFS)
+	if !ok {
+		return apkfs.ErrCloneUnsupported
+	}
+	// the times are set from the header once it is cloned, and hardlinks share them with src
+	return f.inDir(filepath.Dir(name), func() error { return cfs.CloneFile(src, name, mode) })
+}
+
+func (f *timestampFS) Remove(name string) error {
+	return f.inDir(filepath.Dir(name), func() error { return f.FullFS.Remove(name) })
+}
+
+// timestampFile is a file opened for writing in a timestampFS, which is touched when it is closed,
+// after the last write.
+type timestampFile struct {
+	apkfs.File
+	fs   *timestampFS
+	name string
+}
+
+func (f *timestampFile) Close() error {
+	return errors.Join(f.File.Close(), f.fs.touch(f.name))
+}
+
+// headerWriter returns the writeHeaderer of fsys, if it has one, for the packages to be installed
+// lazily. For a timestampFS, that is the one of the wrapped filesystem, given clamped headers.
+func headerWriter(fsys apkfs.FullFS) (writeHeaderer, bool) {
+	if t, ok := fsys.(*timestampFS); ok {
+		wh, ok := t.FullFS.(writeHeaderer)
+		if !ok {
+			return nil, false
+		}
+		return &timestampHeaderWriter{wh: wh, fs: t}, true
+	}
+	wh, ok := fsys.(writeHeaderer)
+	return wh, ok
+}
+
+type timestampHeaderWriter struct {
+	wh writeHeaderer
+	fs *timestampFS
+}
+
+func (w *timestampHeaderWriter) WriteHeader(hdr tar.Header, tfs fs.FS, pkg *repository.Package) error {
+	hdr.ModTime = w.fs.clamp(hdr.ModTime)
+	hdr.AccessTime = w.fs.clamp(hdr.AccessTime)
+	hdr.ChangeTime = w.fs.clamp(hdr.ChangeTime)
+	return w.wh.WriteHeader(hdr, tfs, pkg)
+}
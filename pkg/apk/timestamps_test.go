@@ -0,0 +1,71 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestTimestampOverride(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	writeTestRepository(t, repoDir,
+		testPackage{repository.Package{Name: "hello", Version: "1.0-r0"}, map[string]string{"usr/bin/hello": "hello", "usr/share/hello/greeting": "hi"}})
+
+	epoch := time.Unix(1690000000, 123456789)
+	install := func() map[string]time.Time {
+		root := t.TempDir()
+		a := newTestAPK(t, apkfs.DirFS(root), []string{repoDir}, []string{"hello"}, WithTimestampOverride(epoch))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+
+		times := map[string]time.Time{}
+		require.NoError(t, filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			require.NoError(t, err)
+			if path == root || d.Type()&fs.ModeSymlink != 0 {
+				return nil
+			}
+			fi, err := os.Lstat(path)
+			require.NoError(t, err)
+			rel, err := filepath.Rel(root, path)
+			require.NoError(t, err)
+			require.False(t, fi.ModTime().After(epoch), "%s is from %s, after the epoch", rel, fi.ModTime())
+			times[rel] = fi.ModTime()
+			return nil
+		}))
+		return times
+	}
+
+	times := install()
+	require.Contains(t, times, "usr/bin/hello")
+	require.Contains(t, times, "lib/apk/db/installed")
+	// written by the install, and clamped to the nanosecond
+	require.True(t, epoch.Equal(times["lib/apk/db/installed"]), "installed database is from %s", times["lib/apk/db/installed"])
+	require.True(t, epoch.Equal(times["lib/apk/db"]), "created directory is from %s", times["lib/apk/db"])
+	// packaged, with the times of the package, which are earlier
+	require.True(t, time.Unix(0, 0).Equal(times["usr/bin/hello"]), "packaged file is from %s", times["usr/bin/hello"])
+	require.True(t, time.Unix(0, 0).Equal(times["usr/share/hello"]), "packaged directory is from %s", times["usr/share/hello"])
+	// the same install gives the same times, however long it takes
+	require.Equal(t, times, install())
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"time"
+)
+
+// PackageTiming is how long each phase of installing a package took.
+type PackageTiming struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Repository is the URI of the repository the package was fetched from.
+	Repository string `json:"repository,omitempty"`
+	// Cached is whether the package was read from the cache, rather than fetched.
+	Cached bool `json:"cached,omitempty"`
+	// Fetch is the time taken to download and expand the package, or to find it in the cache.
+	Fetch time.Duration `json:"fetch"`
+	// Verify is the time taken to check the package against the checksums of its index entry,
+	// which is only done for packages that are verified, such as those of a bundle.
+	Verify time.Duration `json:"verify"`
+	// Extract is the time taken to install the files of the package, and run its scripts.
+	Extract time.Duration `json:"extract"`
+}
+
+// InstallReport is how long installing the world took, for each package and in total for each
+// phase. Packages are fetched concurrently, so the totals of the phases add up to more than the
+// time the install took.
+type InstallReport struct {
+	// Packages are the packages installed, in the order they were installed.
+	Packages []PackageTiming `json:"packages"`
+	Fetch    time.Duration   `json:"fetch"`
+	Verify   time.Duration   `json:"verify"`
+	Extract  time.Duration   `json:"extract"`
+	// Total is the time the install took, from resolving the world to the end.
+	Total time.Duration `json:"total"`
+}
+
+// newInstallReport returns the report of an install that started at start, of the packages as
+// they were timed, skipping those that were not installed.
+func newInstallReport(timings []PackageTiming, start time.Time) *InstallReport {
+	report := &InstallReport{Packages: []PackageTiming{}}
+	for _, t := range timings {
+		if t.Name == "" {
+			continue
+		}
+		report.Packages = append(report.Packages, t)
+		report.Fetch += t.Fetch
+		report.Verify += t.Verify
+		report.Extract += t.Extract
+	}
+	report.Total = time.Since(start)
+	return report
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestInstallReport(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	repoDir := filepath.Join(dir, "repo")
+	require.NoError(t, os.MkdirAll(repoDir, 0o755))
+	writeTestRepository(t, repoDir,
+		testPackage{repository.Package{Name: "libhello", Version: "1.0-r0"}, map[string]string{"usr/lib/libhello.so": "lib"}},
+		testPackage{repository.Package{Name: "hello", Version: "1.0-r0", Dependencies: []string{"libhello"}}, map[string]string{"usr/bin/hello": "hello"}},
+	)
+
+	cacheDir := filepath.Join(dir, "cache")
+	install := func() *InstallReport {
+		var report *InstallReport
+		a := newTestAPK(t, apkfs.NewMemFS(), []string{repoDir}, []string{"hello"},
+			WithCache(cacheDir, false), WithInstallReportHandler(func(r *InstallReport) { report = r }))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+		require.NotNil(t, report)
+		return report
+	}
+
+	report := install()
+	require.Len(t, report.Packages, 2)
+	require.Equal(t, "libhello", report.Packages[0].Name)
+	require.Equal(t, "hello", report.Packages[1].Name)
+	var fetch, extract int64
+	for _, p := range report.Packages {
+		require.Equal(t, "1.0-r0", p.Version)
+		require.Equal(t, repoDir, p.Repository)
+		require.False(t, p.Cached)
+		require.Positive(t, p.Fetch)
+		require.Positive(t, p.Extract)
+		fetch += int64(p.Fetch)
+		extract += int64(p.Extract)
+	}
+	require.Equal(t, fetch, int64(report.Fetch))
+	require.Equal(t, extract, int64(report.Extract))
+	require.GreaterOrEqual(t, report.Total, report.Extract)
+
+	// the second install reads the packages from the cache
+	report = install()
+	require.Len(t, report.Packages, 2)
+	for _, p := range report.Packages {
+		require.True(t, p.Cached)
+	}
+}
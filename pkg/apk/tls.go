@@ -0,0 +1,78 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CertFingerprint returns the SHA-256 fingerprint of the certificate, in hex, as WithPinnedCerts
+// takes it.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint returns the fingerprint in lowercase hex without separators, accepting the
+// colon separated uppercase form of "openssl x509 -fingerprint -sha256".
+func normalizeFingerprint(fingerprint string) (string, error) {
+	fingerprint = strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	if b, err := hex.DecodeString(fingerprint); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid certificate fingerprint %q, expected the hex of a SHA-256", fingerprint)
+	}
+	return fingerprint, nil
+}
+
+// tlsConfig returns the TLS configuration of the default client, or nil if none was set.
+func (a *APK) tlsConfig() *tls.Config {
+	if a.tls == nil && a.rootCAs == nil && len(a.pinnedCerts) == 0 {
+		return nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if a.tls != nil {
+		cfg = a.tls.Clone()
+	}
+	if a.rootCAs != nil {
+		cfg.RootCAs = a.rootCAs
+	}
+	if len(a.pinnedCerts) > 0 {
+		pinned := map[string]bool{}
+		for _, fingerprint := range a.pinnedCerts {
+			pinned[fingerprint] = true
+		}
+		verify := cfg.VerifyConnection
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			for _, cert := range cs.PeerCertificates {
+				if pinned[CertFingerprint(cert)] {
+					return nil
+				}
+			}
+			// worded as the errors that the retrying client knows not to retry
+			return errors.New("certificate is not trusted: none of the certificates of the server is pinned")
+		}
+	}
+	return cfg
+}
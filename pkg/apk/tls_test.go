@@ -0,0 +1,57 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSOptions(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	fingerprint := CertFingerprint(server.Certificate())
+
+	get := func(options ...Option) error {
+		t.Helper()
+		a, err := New(options...)
+		require.NoError(t, err)
+		res, err := a.getClient().Get(server.URL)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+
+	require.NoError(t, get(WithRootCAs(pool)))
+	require.NoError(t, get(WithRootCAs(pool), WithPinnedCerts(fingerprint)))
+	// the openssl form of the fingerprint
+	var colons []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		colons = append(colons, strings.ToUpper(fingerprint[i:i+2]))
+	}
+	require.NoError(t, get(WithRootCAs(pool), WithPinnedCerts(strings.Join(colons, ":"))))
+	require.ErrorContains(t, get(WithRootCAs(pool), WithPinnedCerts(strings.Repeat("0", 64))), "is pinned")
+
+	_, err := New(WithPinnedCerts("not-a-fingerprint"))
+	require.Error(t, err)
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// ValidationKind is what is wrong with the root in a ValidationProblem.
+type ValidationKind string
+
+const (
+	// ValidationBrokenSymlink is a symlink whose target does not exist in the root.
+	ValidationBrokenSymlink ValidationKind = "broken-symlink"
+	// ValidationMissingSoname is a shared library that an installed package depends on, as so:, that no
+	// installed package provides, so that its binaries do not run.
+	ValidationMissingSoname ValidationKind = "missing-soname"
+	// ValidationDanglingAlternative is a broken symlink of, or through, etc/alternatives, whose
+	// alternative selects a target that is not installed.
+	ValidationDanglingAlternative ValidationKind = "dangling-alternative"
+)
+
+// alternativesDir is where the symlinks of alternatives, as update-alternatives manages them, are.
+const alternativesDir = "etc/alternatives"
+
+// maxSymlinkHops is how many symlinks resolving a path follows before giving up, as Linux does.
+const maxSymlinkHops = 40
+
+// ValidationProblem is a problem found with the root by Validate.
+type ValidationProblem struct {
+	Kind ValidationKind `json:"kind"`
+	// Path is the file with the problem, if any, such as the broken symlink.
+	Path string `json:"path,omitempty"`
+	// Package is the installed package with the problem, or that owns its file, if any.
+	Package string `json:"package,omitempty"`
+	// Detail is what is missing: the target of the symlink, or the so: dependency.
+	Detail string `json:"detail"`
+}
+
+func (p ValidationProblem) String() string {
+	switch p.Kind {
+	case ValidationMissingSoname:
+		return fmt.Sprintf("%s: %s depends on %s, which no installed package provides", p.Kind, p.Package, p.Detail)
+	default:
+		owner := ""
+		if p.Package != "" {
+			owner = " of " + p.Package
+		}
+		return fmt.Sprintf("%s: %s%s points to %s, which does not exist", p.Kind, p.Path, owner, p.Detail)
+	}
+}
+
+// Validate checks the root once packages are installed for what makes an image that boots but whose
+// binaries do not run: symlinks whose targets do not exist, resolved within the root as they would be
+// in it; so: dependencies of installed packages that no installed package provides; and symlinks of
+// alternatives, under etc/alternatives, that are broken or are the targets of broken symlinks. It
+// returns the problems found, sorted by kind and path, so that a build can fail with all of them; the
+// error is only for what keeps the root from being checked at all.
+func (a *APK) Validate(ctx context.Context) ([]ValidationProblem, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "Validate")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	owners := map[string]string{}
+	for _, pkg := range installed {
+		for _, f := range pkg.Files {
+			owners[f.Name] = pkg.Name
+		}
+	}
+
+	problems := missingSonames(installed)
+	if err := fs.WalkDir(a.fs, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := a.fs.Readlink(p)
+		if err != nil {
+			return fmt.Errorf("unable to read symlink %s: %w", p, err)
+		}
+		// whatever keeps it from resolving, such as a file where its target has a directory, breaks it
+		missing, links, err := resolveInRoot(a.fs, p)
+		if err == nil {
+			return nil
+		}
+		kind := ValidationBrokenSymlink
+		for _, l := range append(links, missing) {
+			if strings.HasPrefix(l, alternativesDir+"/") {
+				kind = ValidationDanglingAlternative
+			}
+		}
+		problems = append(problems, ValidationProblem{Kind: kind, Path: p, Package: owners[p], Detail: target})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Kind != problems[j].Kind {
+			return problems[i].Kind < problems[j].Kind
+		}
+		return problems[i].Path < problems[j].Path
+	})
+	return problems, nil
+}
+
+// missingSonames returns the so: dependencies of the installed packages that none of them provides.
+func missingSonames(installed []*InstalledPackage) []ValidationProblem {
+	provided := map[string]bool{}
+	for _, pkg := range installed {
+		for _, p := range pkg.Provides {
+			provided[resolvePackageNameVersionPin(p).name] = true
+		}
+	}
+	problems := []ValidationProblem{}
+	for _, pkg := range installed {
+		for _, dep := range pkg.Dependencies {
+			name := resolvePackageNameVersionPin(dep).name
+			if strings.HasPrefix(name, "so:") && !provided[name] {
+				problems = append(problems, ValidationProblem{Kind: ValidationMissingSoname, Package: pkg.Name, Detail: name})
+			}
+		}
+	}
+	return problems
+}
+
+var errTooManySymlinks = errors.New("too many levels of symbolic links")
+
+// resolveInRoot resolves the symlinks of the path within the root, both of its last element and of its
+// parents, with absolute targets relative to the root, returning the path it resolves to or, if it
+// does not resolve, the path that does not exist, and the symlinks it followed.
+func resolveInRoot(fsys apkfs.FullFS, name string) (string, []string, error) {
+	var resolved, links []string
+	pending := strings.Split(name, "/")
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		p := path.Join(append(resolved, part)...)
+		fi, err := fsys.Lstat(p)
+		if err != nil {
+			return p, links, err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = append(resolved, part)
+			continue
+		}
+		if len(links) == maxSymlinkHops {
+			return p, links, errTooManySymlinks
+		}
+		links = append(links, p)
+		target, err := fsys.Readlink(p)
+		if err != nil {
+			return p, links, err
+		}
+		if path.IsAbs(target) {
+			resolved = nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return path.Join(resolved...), links, nil
+}
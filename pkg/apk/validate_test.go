@@ -0,0 +1,84 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithIgnoreMknodErrors(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+
+	problems, err := a.Validate(ctx)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	for _, dir := range []string{"usr/lib", "usr/bin", "etc/alternatives", "usr/lib/jvm/java-17/bin"} {
+		require.NoError(t, a.fs.MkdirAll(dir, 0o755))
+	}
+	require.NoError(t, a.fs.WriteFile("usr/lib/libfoo.so.1", []byte("lib"), 0o755))
+	require.NoError(t, a.fs.WriteFile("usr/lib/jvm/java-17/bin/java", []byte("java"), 0o755))
+	links := map[string]string{
+		// merged /usr, resolved through the link of the parent
+		"lib64":                   "usr/lib",
+		"usr/lib/libfoo.so":       "/lib64/libfoo.so.1",
+		"usr/bin/foo-ok":          "../lib/libfoo.so",
+		"usr/bin/gone":            "/usr/lib/libgone.so.1",
+		"usr/bin/loop":            "loop",
+		"etc/alternatives/java":   "/usr/lib/jvm/java-17/bin/java",
+		"etc/alternatives/javac":  "/usr/lib/jvm/java-17/bin/javac",
+		"usr/bin/javac":           "/etc/alternatives/javac",
+		"usr/bin/java":            "../../etc/alternatives/java",
+		"usr/bin/not-a-directory": "/usr/lib/libfoo.so.1/x",
+	}
+	for link, target := range links {
+		require.NoError(t, a.fs.Symlink(target, link))
+	}
+	require.NoError(t, a.addInstalledPackage(&repository.Package{
+		Name:         "foo",
+		Version:      "1.0-r0",
+		Provides:     []string{"so:libfoo.so.1=1"},
+		Dependencies: []string{"so:libc.musl-aarch64.so.1", "so:libfoo.so.1", "busybox"},
+	}, []tar.Header{{Name: "usr/bin", Typeflag: tar.TypeDir}, {Name: "usr/bin/gone", Typeflag: tar.TypeSymlink}}))
+	require.NoError(t, a.addInstalledPackage(&repository.Package{
+		Name:         "bar",
+		Version:      "1.0-r0",
+		Dependencies: []string{"so:libfoo.so.1>=1", "so:libbar.so.2", "!so:libold.so.1"},
+	}, nil))
+
+	problems, err = a.Validate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []ValidationProblem{
+		{Kind: ValidationBrokenSymlink, Path: "usr/bin/gone", Package: "foo", Detail: "/usr/lib/libgone.so.1"},
+		{Kind: ValidationBrokenSymlink, Path: "usr/bin/loop", Detail: "loop"},
+		{Kind: ValidationBrokenSymlink, Path: "usr/bin/not-a-directory", Detail: "/usr/lib/libfoo.so.1/x"},
+		{Kind: ValidationDanglingAlternative, Path: "etc/alternatives/javac", Detail: "/usr/lib/jvm/java-17/bin/javac"},
+		{Kind: ValidationDanglingAlternative, Path: "usr/bin/javac", Detail: "/etc/alternatives/javac"},
+		{Kind: ValidationMissingSoname, Package: "foo", Detail: "so:libc.musl-aarch64.so.1"},
+		{Kind: ValidationMissingSoname, Package: "bar", Detail: "so:libbar.so.2"},
+	}, problems)
+	require.Equal(t, "dangling-alternative: usr/bin/javac points to /etc/alternatives/javac, which does not exist", problems[4].String())
+	require.Equal(t, "missing-soname: bar depends on so:libbar.so.2, which no installed package provides", problems[6].String())
+}
@@ -0,0 +1,213 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// UntrustedPackageError is returned for a package that is not signed, or not signed with any of
+// the trusted keys, unless untrusted packages are allowed with WithAllowUntrusted.
+type UntrustedPackageError struct {
+	// Package is the name of the package, or the path of its file.
+	Package string
+	// Key is the name of the key the package claims to be signed with, or empty if it is not signed.
+	Key     string
+	wrapped error
+}
+
+func (e *UntrustedPackageError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("package %s is not signed", e.Package)
+	}
+	msg := fmt.Sprintf("package %s is signed with untrusted key %s", e.Package, e.Key)
+	if e.wrapped != nil {
+		msg += ": " + e.wrapped.Error()
+	}
+	return msg
+}
+
+func (e *UntrustedPackageError) Unwrap() error {
+	return e.wrapped
+}
+
+// VerifyPackageSignature verifies the signature of the control section of the expanded package,
+// named name in errors, against the keys, by name as with GetRepositoryIndexes, returning the name
+// of the key it is signed with. It returns an *UntrustedPackageError if the package is not signed,
+// or not with any of the keys.
+func VerifyPackageSignature(name string, exp *APKExpanded, keys map[string][]byte) (string, error) {
+	if exp.SignatureFile == "" {
+		return "", &UntrustedPackageError{Package: name}
+	}
+	keyName, sig, err := readPackageSignature(exp.SignatureFile)
+	if err != nil {
+		return "", fmt.Errorf("reading signature of %s: %w", name, err)
+	}
+	if key, ok := keys[keyName]; ok {
+		if err := sign.RSAVerifySHA1Digest(exp.ControlHash, sig, key); err != nil {
+			return "", &UntrustedPackageError{Package: name, Key: keyName, wrapped: err}
+		}
+		return keyName, nil
+	}
+	for _, key := range keys {
+		if err := sign.RSAVerifySHA1Digest(exp.ControlHash, sig, key); err == nil {
+			return keyName, nil
+		}
+	}
+	return "", &UntrustedPackageError{Package: name, Key: keyName}
+}
+
+// readPackageSignature returns the name of the key and the signature from the signature section.
+func readPackageSignature(file string) (string, []byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", nil, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return "", nil, errors.New("no signature in signature section")
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if keyName, ok := strings.CutPrefix(hdr.Name, ".SIGN.RSA."); ok {
+			sig, err := io.ReadAll(tr)
+			return keyName, sig, err
+		}
+	}
+}
+
+// PackageVerification is the result of verifying an .apk file with VerifyPackage.
+type PackageVerification struct {
+	// Source is the path or URL of the file.
+	Source string `json:"source"`
+	// Package is the control metadata of the package, from its .PKGINFO, if it could be read.
+	Package *PackageInfo `json:"package,omitempty"`
+	// Signer is the key the package is signed with, if the signature verified.
+	Signer string `json:"signer,omitempty"`
+	// DataHash is the sha256 of the data section of the package, as read.
+	DataHash string `json:"datahash,omitempty"`
+	// Err is why the package could not be read at all, such as a file whose checksum does not match
+	// that of its header; the other checks are not made.
+	Err error `json:"-"`
+	// SignatureErr is why the signature did not verify, an *UntrustedPackageError if the package is
+	// not signed, or not with any of the keys.
+	SignatureErr error `json:"-"`
+	// DataHashErr is set if the data section does not match the datahash of the .PKGINFO.
+	DataHashErr error `json:"-"`
+}
+
+// OK reports whether the package passed every check.
+func (v PackageVerification) OK() bool {
+	return v.Err == nil && v.SignatureErr == nil && v.DataHashErr == nil
+}
+
+func (v PackageVerification) String() string {
+	switch {
+	case v.Err != nil:
+		return fmt.Sprintf("%s: FAILED: %v", v.Source, v.Err)
+	case v.SignatureErr != nil && v.DataHashErr != nil:
+		return fmt.Sprintf("%s: FAILED: %v; %v", v.Source, v.SignatureErr, v.DataHashErr)
+	case v.SignatureErr != nil:
+		return fmt.Sprintf("%s: FAILED: %v", v.Source, v.SignatureErr)
+	case v.DataHashErr != nil:
+		return fmt.Sprintf("%s: FAILED: %v", v.Source, v.DataHashErr)
+	}
+	return fmt.Sprintf("%s: OK, %s-%s signed with %s", v.Source, v.Package.Name, v.Package.Version, v.Signer)
+}
+
+// VerifyPackage verifies the .apk file at the path or http(s) URL, fetched with the client, or
+// http.DefaultClient if nil, without installing it: that the checksum of each of its files matches
+// its header, that its control section is signed with one of the keys, by name as with
+// GetRepositoryIndexes, and that its data section matches the datahash of its .PKGINFO, whose
+// metadata it reports. Every check is made, and reported, even if another fails, so that a CI gate can
+// tell what is wrong with a package.
+func VerifyPackage(ctx context.Context, source string, keys map[string][]byte, client *http.Client) PackageVerification {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "VerifyPackage")
+	defer span.End()
+
+	v := PackageVerification{Source: source}
+	r, err := openPackageSource(ctx, source, client)
+	if err != nil {
+		v.Err = err
+		return v
+	}
+	defer r.Close()
+	exp, err := ExpandApk(ctx, r, "")
+	if err != nil {
+		v.Err = err
+		return v
+	}
+	defer exp.Close()
+
+	pkg, err := exp.PackageInfo()
+	if err != nil {
+		v.Err = fmt.Errorf("reading .PKGINFO: %w", err)
+		return v
+	}
+	v.Package = &PackageInfo{Package: *pkg}
+	v.DataHash = hex.EncodeToString(exp.PackageHash)
+	if want := pkg.DataHash; want != "" && want != v.DataHash {
+		v.DataHashErr = fmt.Errorf("data section does not match datahash %s", want)
+	}
+	v.Signer, v.SignatureErr = VerifyPackageSignature(source, exp, keys)
+	return v
+}
+
+// openPackageSource opens the .apk file at the path or http(s) URL.
+func openPackageSource(ctx context.Context, source string, client *http.Client) (io.ReadCloser, error) {
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return os.Open(source)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: %s", source, resp.Status)
+	}
+	return resp.Body, nil
+}
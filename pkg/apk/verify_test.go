@@ -0,0 +1,56 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestVerifyPackage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "foo-1.0-r0.apk")
+	writeTestAPK(t, file, &repository.Package{Name: "foo", Version: "1.0-r0", Arch: testArch}, map[string]string{"usr/bin/foo": "foo"})
+	_, pub := testSigningKey(t, "ci.rsa")
+	keys := map[string][]byte{"ci.rsa.pub": pub}
+
+	// the package is read, and its datahash checked, even though it is not signed
+	v := VerifyPackage(ctx, file, keys, nil)
+	require.NoError(t, v.Err)
+	require.NoError(t, v.DataHashErr)
+	var untrusted *UntrustedPackageError
+	require.ErrorAs(t, v.SignatureErr, &untrusted)
+	require.False(t, v.OK())
+	require.Equal(t, "foo", v.Package.Name)
+	require.Equal(t, "1.0-r0", v.Package.Version)
+	require.NotEmpty(t, v.DataHash)
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+	fetched := VerifyPackage(ctx, srv.URL+"/foo-1.0-r0.apk", keys, srv.Client())
+	require.NoError(t, fetched.Err)
+	require.Equal(t, v.DataHash, fetched.DataHash)
+
+	missing := VerifyPackage(ctx, srv.URL+"/bar-1.0-r0.apk", keys, srv.Client())
+	require.ErrorContains(t, missing.Err, "404")
+	require.Nil(t, missing.Package)
+}
@@ -15,16 +15,15 @@
 package apk
 
 import (
-	"fmt"
 	"regexp"
-	"strconv"
-	"strings"
 
 	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/version"
 )
 
-// versionRegex how to parse versions.
-// see https://github.com/alpinelinux/apk-tools/blob/50ab589e9a5a84592ee4c0ac5a49506bb6c552fc/src/version.c#
+// packageNameRegex how to parse package names, with their versions and pins; for the versions
+// themselves, see the version package.
 // for information on pinning, see https://wiki.alpinelinux.org/wiki/Alpine_Package_Keeper#Repository_pinning
 // To quote:
 //
@@ -37,151 +36,17 @@ import (
 //
 //   2. allows pulling in dependencies for the tagged package from the tagged repository (though it prefers to use untagged repositories to satisfy dependencies if possible)
 
-var (
-	versionRegex     = regexp.MustCompile(`^([0-9]+)((\.[0-9]+)*)([a-z]?)((_alpha|_beta|_pre|_rc)([0-9]*))?((_cvs|_svn|_git|_hg|_p)([0-9]*))?((-r)([0-9]+))?$`)
-	packageNameRegex = regexp.MustCompile(`^([^@=><~]+)(([=><~]+)([^@]+))?(@([a-zA-Z0-9]+))?$`)
-)
+var packageNameRegex = regexp.MustCompile(`^([^@=><~]+)(@([a-zA-Z0-9]+))?(([=><~]+)([^@]+))?(@([a-zA-Z0-9]+))?$`)
 
 func init() {
-	versionRegex.Longest()
 	packageNameRegex.Longest()
 }
 
-type packageVersionPreModifier int
-type packageVersionPostModifier int
-
-// the order of these matters!
-const (
-	packageVersionPreModifierNone  packageVersionPreModifier = 0
-	packageVersionPreModifierAlpha packageVersionPreModifier = 1
-	packageVersionPreModifierBeta  packageVersionPreModifier = 2
-	packageVersionPreModifierPre   packageVersionPreModifier = 3
-	packageVersionPreModifierRC    packageVersionPreModifier = 4
-	packageVersionPreModifierMax   packageVersionPreModifier = 1000
-)
-const (
-	packageVersionPostModifierNone packageVersionPostModifier = 0
-	packageVersionPostModifierCVS  packageVersionPostModifier = 1
-	packageVersionPostModifierSVN  packageVersionPostModifier = 2
-	packageVersionPostModifierGit  packageVersionPostModifier = 3
-	packageVersionPostModifierHG   packageVersionPostModifier = 4
-	packageVersionPostModifierP    packageVersionPostModifier = 5
-	packageVersionPostModifierMax  packageVersionPostModifier = 1000
-)
+// packageVersion is a parsed version of a package.
+type packageVersion = version.Version
 
-type packageVersion struct {
-	numbers          []int
-	letter           rune
-	preSuffix        packageVersionPreModifier
-	preSuffixNumber  int
-	postSuffix       packageVersionPostModifier
-	postSuffixNumber int
-	revision         int
-}
-
-func parseVersion(version string) (packageVersion, error) {
-	parts := versionRegex.FindAllStringSubmatch(version, -1)
-	if len(parts) == 0 {
-		return packageVersion{}, fmt.Errorf("invalid version %s, could not parse", version)
-	}
-	actuals := parts[0]
-	numbers := make([]int, 0, 10)
-	if len(actuals) != 14 {
-		return packageVersion{}, fmt.Errorf("invalid version %s, could not find enough components", version)
-	}
-
-	// get the first version number
-	num, err := strconv.Atoi(actuals[1])
-	if err != nil {
-		return packageVersion{}, fmt.Errorf("invalid version %s, first part is not number: %w", version, err)
-	}
-	numbers = append(numbers, num)
-
-	// get any other version numbers
-	if actuals[2] != "" {
-		subparts := strings.Split(actuals[2], ".")
-		for i, s := range subparts {
-			if s == "" {
-				continue
-			}
-			num, err := strconv.Atoi(s)
-			if err != nil {
-				return packageVersion{}, fmt.Errorf("invalid version %s, part %d is not number: %w", version, i, err)
-			}
-			numbers = append(numbers, num)
-		}
-	}
-	var letter rune
-	if len(actuals[4]) > 0 {
-		letter = rune(actuals[4][0])
-	}
-	var preSuffix packageVersionPreModifier
-	switch actuals[6] {
-	case "_alpha":
-		preSuffix = packageVersionPreModifierAlpha
-	case "_beta":
-		preSuffix = packageVersionPreModifierBeta
-	case "_pre":
-		preSuffix = packageVersionPreModifierPre
-	case "_rc":
-		preSuffix = packageVersionPreModifierRC
-	case "":
-		preSuffix = packageVersionPreModifierNone
-	default:
-		return packageVersion{}, fmt.Errorf("invalid version %s, pre-suffix %s is not valid", version, actuals[6])
-	}
-	var preSuffixNumber int
-	if actuals[7] != "" {
-		num, err := strconv.Atoi(actuals[7])
-		if err != nil {
-			return packageVersion{}, fmt.Errorf("invalid version %s, suffix %s number %s is not number: %w", version, actuals[6], actuals[7], err)
-		}
-		preSuffixNumber = num
-	}
-
-	var postSuffix packageVersionPostModifier
-	switch actuals[9] {
-	case "_cvs":
-		postSuffix = packageVersionPostModifierCVS
-	case "_svn":
-		postSuffix = packageVersionPostModifierSVN
-	case "_git":
-		postSuffix = packageVersionPostModifierGit
-	case "_hg":
-		postSuffix = packageVersionPostModifierHG
-	case "_p":
-		postSuffix = packageVersionPostModifierP
-	case "":
-		postSuffix = packageVersionPostModifierNone
-	default:
-		return packageVersion{}, fmt.Errorf("invalid version %s, suffix %s is not valid", version, actuals[9])
-	}
-	var postSuffixNumber int
-	if actuals[10] != "" {
-		num, err := strconv.Atoi(actuals[10])
-		if err != nil {
-			return packageVersion{}, fmt.Errorf("invalid version %s, post-suffix %s number %s is not number: %w", version, actuals[9], actuals[10], err)
-		}
-		postSuffixNumber = num
-	}
-
-	var revision int
-	if actuals[13] != "" {
-		num, err := strconv.Atoi(actuals[13])
-		if err != nil {
-			return packageVersion{}, fmt.Errorf("invalid version %s, revision %s is not number: %w", version, actuals[13], err)
-		}
-		revision = num
-	}
-	return packageVersion{
-		numbers:          numbers,
-		letter:           letter,
-		preSuffix:        preSuffix,
-		preSuffixNumber:  preSuffixNumber,
-		postSuffix:       postSuffix,
-		postSuffixNumber: postSuffixNumber,
-		revision:         revision,
-	}, nil
+func parseVersion(v string) (packageVersion, error) {
+	return version.Parse(v)
 }
 
 type versionCompare int
@@ -205,134 +70,26 @@ func (vc versionCompare) String() string {
 	}
 }
 
-// compare versions based on https://dev.gentoo.org/~ulm/pms/head/pms.html#x1-250003.2
 func compareVersions(actual, required packageVersion) versionCompare {
-	for i := 0; i < len(actual.numbers) && i < len(required.numbers); i++ {
-		if actual.numbers[i] > required.numbers[i] {
-			return greater
-		}
-		if actual.numbers[i] < required.numbers[i] {
-			return less
-		}
-	}
-	// if we made it here, the parts that were the same size are equal
-	if len(actual.numbers) > len(required.numbers) {
+	switch actual.Compare(required) {
+	case 1:
 		return greater
-	}
-	if len(actual.numbers) < len(required.numbers) {
-		return less
-	}
-	// same length of numbers, same numbers
-	// compare letters
-	if actual.letter > required.letter {
-		return greater
-	}
-	if actual.letter < required.letter {
-		return less
-	}
-	// same letters
-	// compare pre-suffixes
-	// because None is 0 but the lowest priority to make it easy to have a sane default,
-	// but lowest priority, we need some extra logic to handle
-	actualPreSuffix, requiredPreSuffix := actual.preSuffix, required.preSuffix
-	if actualPreSuffix == packageVersionPreModifierNone {
-		actualPreSuffix = packageVersionPreModifierMax
-	}
-	if requiredPreSuffix == packageVersionPreModifierNone {
-		requiredPreSuffix = packageVersionPreModifierMax
-	}
-	if actualPreSuffix > requiredPreSuffix {
-		return greater
-	}
-	if actualPreSuffix < requiredPreSuffix {
-		return less
-	}
-	// same pre-suffixes, compare pre-suffix numbers
-	if actual.preSuffixNumber > required.preSuffixNumber {
-		return greater
-	}
-	if actual.preSuffixNumber < required.preSuffixNumber {
-		return less
-	}
-	// same pre-suffix numbers
-	// compare post-suffixes
-	// because None is 0 but the lowest priority to make it easy to have a sane default,
-	// but lowest priority, we need some extra logic to handle
-	actualPostSuffix, requiredPostSuffix := actual.postSuffix, required.postSuffix
-	if actualPostSuffix == packageVersionPostModifierNone {
-		actualPostSuffix = packageVersionPostModifierMax
-	}
-	if requiredPostSuffix == packageVersionPostModifierNone {
-		requiredPostSuffix = packageVersionPostModifierMax
-	}
-	if actualPostSuffix > requiredPostSuffix {
-		return greater
-	}
-	if actualPostSuffix < requiredPostSuffix {
-		return less
-	}
-	// same post-suffixes, compare post-suffix numbers
-	if actual.postSuffixNumber > required.postSuffixNumber {
-		return greater
-	}
-	if actual.postSuffixNumber < required.postSuffixNumber {
-		return less
-	}
-	// same post-suffix numbers
-	// compare revisions
-	if actual.revision > required.revision {
-		return greater
-	}
-	if actual.revision < required.revision {
+	case -1:
 		return less
+	default:
+		return equal
 	}
-	return equal
+}
+
+// CompareVersions compares two versions of packages as apk does, returning -1, 0 or +1 if a is older
+// than, the same as, or newer than b. It is version.Compare.
+func CompareVersions(a, b string) (int, error) {
+	return version.Compare(a, b)
 }
 
 // includesVersion returns true if the actual version is a strict subset of the required version
 func includesVersion(actual, required packageVersion) bool {
-	// if more required numbers than actual numbers, than require is more specific,
-	// so no match
-	if len(actual.numbers) < len(required.numbers) {
-		return false
-	}
-	for i := 0; i < len(required.numbers); i++ {
-		if actual.numbers[i] != required.numbers[i] {
-			return false
-		}
-	}
-	// if length is the same, check the rest of it; if actual is longer, it's ok
-	if len(actual.numbers) > len(required.numbers) {
-		return true
-	}
-	// was there a required letter?
-	if required.letter != 0 && actual.letter != required.letter {
-		return false
-	}
-
-	// was there pre-suffix
-	if required.preSuffix != packageVersionPreModifierNone && actual.preSuffix != required.preSuffix {
-		return false
-	}
-
-	// was there pre-suffix number
-	if required.preSuffixNumber != 0 && actual.preSuffixNumber != required.preSuffixNumber {
-		return false
-	}
-
-	// was there post-suffix
-	if required.postSuffix != packageVersionPostModifierNone && actual.postSuffix != required.postSuffix {
-		return false
-	}
-	if required.postSuffixNumber != 0 && actual.postSuffixNumber != required.postSuffixNumber {
-		return false
-	}
-
-	// compare revisions
-	if required.revision != 0 && actual.revision != required.revision {
-		return false
-	}
-	return true
+	return actual.HasPrefix(required)
 }
 
 type versionDependency int
@@ -375,6 +132,16 @@ type pinStuff struct {
 	version string
 	dep     versionDependency
 	pin     string
+	// op is the operator of the version constraint as it was written, e.g. >= or =~
+	op string
+}
+
+// constraint returns the version constraint as it was written, e.g. >=1.2, or "" if there is none.
+func (p pinStuff) constraint() string {
+	if p.op == "" {
+		return ""
+	}
+	return p.op + p.version
 }
 
 func resolvePackageNameVersionPin(pkgName string) pinStuff {
@@ -385,15 +152,27 @@ func resolvePackageNameVersionPin(pkgName string) pinStuff {
 			dep:  versionNone,
 		}
 	}
-	// layout: [full match, name, =version, =|>|<, version, @pin, pin]
+	// layout: [full match, name, @pin, pin, =version, =|>|<, version, @pin, pin]
+	// the pin is before the version constraint as apk-tools writes it, e.g. name@edge>=1.2, or after
+	// it, as go-apk used to write it, e.g. name>=1.2@edge
 	p := pinStuff{
 		name:    parts[0][1],
-		version: parts[0][4],
-		pin:     parts[0][6],
+		version: parts[0][6],
+		pin:     parts[0][3],
 		dep:     versionNone,
+		op:      parts[0][5],
+	}
+	if p.pin == "" {
+		p.pin = parts[0][8]
+	} else if parts[0][8] != "" {
+		// tagged twice, so not a valid name
+		return pinStuff{
+			name: pkgName,
+			dep:  versionNone,
+		}
 	}
 
-	matcher := parts[0][3]
+	matcher := parts[0][5]
 	if matcher != "" {
 		// we have an equal
 		switch matcher {
@@ -407,7 +186,8 @@ func resolvePackageNameVersionPin(pkgName string) pinStuff {
 			p.dep = versionGreaterEqual
 		case "<=":
 			p.dep = versionLessEqual
-		case "~":
+		case "~", "=~", "~=":
+			// apk-tools reads ~ as =~, and writes both as ~
 			p.dep = versionTilde
 		default:
 			p.dep = versionNone
@@ -0,0 +1,163 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+)
+
+// Versions returns the versions of the named package in the repositories, latest first, without
+// duplicates, or none if no repository has it. The indexes are verified as by GetRepositoryIndexes,
+// and read through the cache, if any, but only scanned for the package rather than parsed in full,
+// for tooling that only needs to know whether, and at what versions, the package is available.
+func (a *APK) Versions(ctx context.Context, name string) ([]string, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Versions")
+	defer span.End()
+
+	repos, err := a.GetRepositories()
+	if err != nil {
+		return nil, err
+	}
+	b, err := a.fs.ReadFile(archFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read arch file: %w", err)
+	}
+	arch := strings.TrimSpace(string(b))
+	httpClient := a.getClient()
+	if a.cache != nil {
+		httpClient = a.cacheClient(httpClient, true)
+	}
+	keys, err := a.loadKeys(ctx, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	opts := &indexOpts{layout: a.layout, httpClient: httpClient, arches: a.repoArches}
+	if opts.layout == nil {
+		opts.layout = AlpineLayout{}
+	}
+
+	seen := map[string]bool{}
+	var versions []string
+	for _, repo := range repos {
+		_, repoURL, err := parseRepositoryLine(repo)
+		if err != nil {
+			return nil, err
+		}
+		repoArch := opts.repositoryArch(repoURL, arch)
+		u := opts.layout.IndexURL(repoURL, repoArch)
+		b, err := fetchIndex(ctx, u, repoArch, opts)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			continue
+		}
+		if _, err := verifyIndexSignature(b, u, keys); err != nil {
+			return nil, err
+		}
+		found, err := indexVersions(b, name)
+		if err != nil {
+			return nil, fmt.Errorf("reading repository index at %s: %w", u, err)
+		}
+		for _, v := range found {
+			if !seen[v] {
+				seen[v] = true
+				versions = append(versions, v)
+			}
+		}
+	}
+	sortVersions(versions)
+	return versions, nil
+}
+
+// indexVersions returns the versions of the named package in the index archive, scanning the
+// APKINDEX for its stanzas.
+func indexVersions(b []byte, name string) ([]string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != "APKINDEX" {
+			continue
+		}
+		var (
+			versions []string
+			pkg, ver string
+		)
+		scanner := bufio.NewScanner(tr)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if pkg == name && ver != "" {
+					versions = append(versions, ver)
+				}
+				pkg, ver = "", ""
+			case strings.HasPrefix(line, "P:"):
+				pkg = line[2:]
+			case strings.HasPrefix(line, "V:"):
+				ver = line[2:]
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		if pkg == name && ver != "" {
+			versions = append(versions, ver)
+		}
+		return versions, nil
+	}
+}
+
+// sortVersions sorts the versions latest first; those that do not parse go last, as they are.
+func sortVersions(versions []string) {
+	parsed := make(map[string]*packageVersion, len(versions))
+	for _, v := range versions {
+		if pv, err := parseVersion(v); err == nil {
+			parsed[v] = &pv
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		vi, vj := parsed[versions[i]], parsed[versions[j]]
+		switch {
+		case vi == nil || vj == nil:
+			return vi != nil
+		default:
+			return compareVersions(*vi, *vj) == greater
+		}
+	})
+}
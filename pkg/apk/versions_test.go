@@ -0,0 +1,53 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestVersions(t *testing.T) {
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+	require.NoError(t, src.WriteFile(archFilePath, []byte("x86_64\n"), 0o644))
+	for k, v := range testKeys {
+		require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, k), []byte(v), 0o644))
+	}
+	repos := []string{"testdata/alpine-316", "testdata/alpine-317"}
+	require.NoError(t, src.WriteFile(reposFilePath, []byte(strings.Join(repos, "\n")), 0o644))
+	a, err := New(WithFS(src), WithRepositoryLayout(FlatLayout{}))
+	require.NoError(t, err)
+
+	versions, err := a.Versions(context.Background(), "alpine-baselayout")
+	require.NoError(t, err)
+	require.Equal(t, []string{"3.4.0-r0", "3.2.0-r23"}, versions)
+
+	versions, err = a.Versions(context.Background(), "no-such-package")
+	require.NoError(t, err)
+	require.Empty(t, versions)
+}
+
+func TestSortVersions(t *testing.T) {
+	versions := []string{"1.2.0-r0", "not a version", "1.10.0-r0", "1.2.0-r1", "1.2_rc1-r0"}
+	sortVersions(versions)
+	require.Equal(t, []string{"1.10.0-r0", "1.2.0-r1", "1.2.0-r0", "1.2_rc1-r0", "not a version"}, versions)
+}
@@ -0,0 +1,328 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	// virtualPackageDescription is the description apk gives to packages created with --virtual,
+	// and is how we tell them apart from real packages in the installed file.
+	virtualPackageDescription = "virtual meta package"
+	virtualPackageArch        = "noarch"
+	// virtualPackageVersionFormat is the timestamp layout apk uses for the version of a virtual package.
+	virtualPackageVersionFormat = "20060102.150405"
+	// ephemeralPackageName is the name of the virtual package used by WithEphemeralPackages.
+	ephemeralPackageName = ".ephemeral-deps"
+)
+
+// AddVirtualPackage creates a virtual package with the given name whose dependencies are deps,
+// records it in the installed file and adds it to the world. The dependencies are not installed
+// until the next FixateWorld, after which the whole group can be removed with DeleteVirtualPackage.
+// If a virtual package with the same name already exists, it is replaced.
+//
+// This is the equivalent of "apk add --virtual name deps...".
+// The version of the package is derived from sourceDateEpoch, if provided, otherwise the current time.
+func (a *APK) AddVirtualPackage(ctx context.Context, name string, deps []string, sourceDateEpoch *time.Time) error {
+	_, span := otel.Tracer("go-apk").Start(ctx, "AddVirtualPackage")
+	defer span.End()
+
+	a.logger.Infof("adding virtual package %s", name)
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	for _, pkg := range installed {
+		if pkg.Name != name {
+			continue
+		}
+		if !isVirtualPackage(&pkg.Package) {
+			return fmt.Errorf("package %s is already installed and is not a virtual package", name)
+		}
+		if err := a.removeFromInstalled(name); err != nil {
+			return fmt.Errorf("unable to remove previous virtual package %s: %w", name, err)
+		}
+	}
+
+	buildTime := time.Now().UTC()
+	if sourceDateEpoch != nil {
+		buildTime = sourceDateEpoch.UTC()
+	}
+	pkg := &repository.Package{
+		Name:         name,
+		Version:      buildTime.Format(virtualPackageVersionFormat),
+		Arch:         virtualPackageArch,
+		Description:  virtualPackageDescription,
+		Dependencies: deps,
+		BuildTime:    buildTime,
+	}
+	if err := a.addInstalledPackage(pkg, nil); err != nil {
+		return fmt.Errorf("unable to add virtual package %s: %w", name, err)
+	}
+
+	world, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	for _, w := range world {
+		if w == name {
+			return nil
+		}
+	}
+	return a.SetWorld(append(world, name))
+}
+
+// DeleteVirtualPackage removes the named virtual package from the world and the installed file,
+// along with every installed package that is no longer required by anything left in the world.
+//
+// This is the equivalent of "apk del name" for a package created with AddVirtualPackage.
+func (a *APK) DeleteVirtualPackage(ctx context.Context, name string) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "DeleteVirtualPackage")
+	defer span.End()
+
+	return a.deleteVirtualPackage(ctx, name, nil)
+}
+
+// deleteVirtualPackage is DeleteVirtualPackage, but leaves the packages named in keep installed,
+// even if nothing requires them any more.
+func (a *APK) deleteVirtualPackage(ctx context.Context, name string, keep map[string]bool) error {
+	a.logger.Infof("deleting virtual package %s", name)
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	var virtual *InstalledPackage
+	for _, pkg := range installed {
+		if pkg.Name == name && isVirtualPackage(&pkg.Package) {
+			virtual = pkg
+			break
+		}
+	}
+	if virtual == nil {
+		return fmt.Errorf("virtual package %s is not installed", name)
+	}
+
+	world, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	newWorld := make([]string, 0, len(world))
+	for _, w := range world {
+		if w != name {
+			newWorld = append(newWorld, w)
+		}
+	}
+	if err := a.SetWorld(newWorld); err != nil {
+		return err
+	}
+	if err := a.removeInstalledPackage(virtual); err != nil {
+		return fmt.Errorf("unable to remove virtual package %s: %w", name, err)
+	}
+	_, err = a.autoremove(ctx, keep)
+	return err
+}
+
+// WithEphemeralPackages installs the named packages, runs fn, and then removes them again along
+// with any of their dependencies that nothing else in the world needs, leaving the world and the
+// installed file as they were. The packages are grouped under a virtual package while fn runs,
+// which is the equivalent of the Dockerfile pattern:
+//
+//	apk add --virtual .build-deps names... && fn && apk del .build-deps
+//
+// Only what was installed for fn is removed: packages that were installed before, even if nothing
+// requires them, are left as they are. The packages are removed even if fn returns an error; all
+// errors are returned together.
+func (a *APK) WithEphemeralPackages(ctx context.Context, names []string, sourceDateEpoch *time.Time, fn func() error) (err error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "WithEphemeralPackages")
+	defer span.End()
+
+	installed, err := a.isInstalledPackage(ephemeralPackageName)
+	if err != nil {
+		return fmt.Errorf("error checking if package %s is installed: %w", ephemeralPackageName, err)
+	}
+	if installed {
+		return fmt.Errorf("ephemeral packages are already installed, WithEphemeralPackages cannot be nested")
+	}
+
+	before, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	preexisting := make(map[string]bool, len(before))
+	for _, pkg := range before {
+		preexisting[pkg.Name] = true
+	}
+
+	if err := a.AddVirtualPackage(ctx, ephemeralPackageName, names, sourceDateEpoch); err != nil {
+		return err
+	}
+	defer func() {
+		if delErr := a.deleteVirtualPackage(ctx, ephemeralPackageName, preexisting); delErr != nil {
+			err = errors.Join(err, fmt.Errorf("unable to remove ephemeral packages: %w", delErr))
+		}
+	}()
+
+	if err := a.FixateWorld(ctx, sourceDateEpoch); err != nil {
+		return fmt.Errorf("unable to install ephemeral packages: %w", err)
+	}
+	return fn()
+}
+
+// Autoremove removes every installed package that is not required, directly or indirectly, by the
+// world, as "apk del" does after removing from the world, and returns those it removed, in the order
+// of installation. The dependencies are resolved against the installed packages only, so this does
+// not need access to any repository.
+func (a *APK) Autoremove(ctx context.Context) ([]*InstalledPackage, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Autoremove")
+	defer span.End()
+
+	return a.autoremove(ctx, nil)
+}
+
+// autoremove is Autoremove, but leaves the orphans named in keep installed.
+func (a *APK) autoremove(ctx context.Context, keep map[string]bool) ([]*InstalledPackage, error) {
+	orphans, err := a.Orphans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]*InstalledPackage, 0, len(orphans))
+	for _, pkg := range orphans {
+		if !keep[pkg.Name] {
+			removed = append(removed, pkg)
+		}
+	}
+	// remove in reverse order of installation, so dependents go before their dependencies
+	for i := len(removed) - 1; i >= 0; i-- {
+		a.logger.Debugf("removing %s (%s)", removed[i].Name, removed[i].Version)
+		if err := a.removeInstalledPackage(removed[i]); err != nil {
+			return nil, fmt.Errorf("removing %s: %w", removed[i].Name, err)
+		}
+	}
+	return removed, nil
+}
+
+// removeOrphans is Autoremove, for those that only need to know whether it failed.
+func (a *APK) removeOrphans(ctx context.Context) error {
+	_, err := a.Autoremove(ctx)
+	return err
+}
+
+// Orphans returns the installed packages, in order of installation, that are not required by the
+// world, directly or indirectly, nor installed along with those that are through their install_if.
+// It does not need access to any repository.
+func (a *APK) Orphans(ctx context.Context) ([]*InstalledPackage, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+	resolver, err := a.resolverOf(ctx, []NamedIndex{installedIndex(installed)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	required, _, err := resolver.GetPackagesWithDependencies(ctx, world)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve world against installed packages: %w", err)
+	}
+	keep := make(map[string]string, len(required))
+	for _, pkg := range required {
+		keep[pkg.Name] = pkg.Version
+	}
+	// the resolver only considers install_if within the dependencies of a single world entry,
+	// so also keep anything whose install_if is satisfied by the packages we are keeping
+	for changed := true; changed; {
+		changed = false
+		for _, pkg := range installed {
+			if _, ok := keep[pkg.Name]; ok || len(pkg.InstallIf) == 0 {
+				continue
+			}
+			if installIfSatisfied(pkg.InstallIf, keep) {
+				keep[pkg.Name] = pkg.Version
+				changed = true
+			}
+		}
+	}
+	var orphans []*InstalledPackage
+	for _, pkg := range installed {
+		if _, ok := keep[pkg.Name]; !ok {
+			orphans = append(orphans, pkg)
+		}
+	}
+	return orphans, nil
+}
+
+// installIfSatisfied reports whether every entry of installIf, each either a name or name=version,
+// matches one of the packages, which are given as a map of name to version.
+func installIfSatisfied(installIf []string, pkgs map[string]string) bool {
+	for _, cond := range installIf {
+		stuff := resolvePackageNameVersionPin(cond)
+		version, ok := pkgs[stuff.name]
+		if !ok || (stuff.version != "" && stuff.version != version) {
+			return false
+		}
+	}
+	return true
+}
+
+// virtualPackagesIndex returns an index of the virtual packages in the installed file, so that
+// the resolver can find them when they are listed in the world.
+func (a *APK) virtualPackagesIndex() (NamedIndex, error) {
+	installed, err := a.GetInstalled()
+	if errors.Is(err, fs.ErrNotExist) {
+		// nothing has been installed yet, so there cannot be any virtual packages
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	var virtual []*InstalledPackage
+	for _, pkg := range installed {
+		if isVirtualPackage(&pkg.Package) {
+			virtual = append(virtual, pkg)
+		}
+	}
+	if len(virtual) == 0 {
+		return nil, nil
+	}
+	return installedIndex(virtual), nil
+}
+
+// installedIndex returns an unpinned index holding the given installed packages.
+func installedIndex(pkgs []*InstalledPackage) NamedIndex {
+	index := &repository.ApkIndex{}
+	for _, installed := range pkgs {
+		pkg := installed.Package
+		index.Packages = append(index.Packages, &pkg)
+	}
+	repo := &repository.Repository{Uri: installedFilePath}
+	return NewNamedRepositoryWithIndex("", repo.WithIndex(index))
+}
+
+func isVirtualPackage(pkg *repository.Package) bool {
+	return pkg.Description == virtualPackageDescription && len(pkg.Checksum) == 0
+}
@@ -0,0 +1,262 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+var testBaseWorld = []string{"alpine-baselayout", "alpine-keys", "apk-tools", "busybox", "libc-utils"}
+
+func TestVirtualPackage(t *testing.T) {
+	ctx := context.Background()
+	a, src, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+	require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, a.SetWorld(testBaseWorld))
+
+	// everything in the test database is required by the base world
+	orphans, err := a.Orphans(ctx)
+	require.NoError(t, err)
+	require.Empty(t, orphans)
+
+	epoch := time.Date(2023, 6, 1, 12, 30, 0, 0, time.UTC)
+	require.NoError(t, a.AddVirtualPackage(ctx, ".build-deps", []string{"dep-a"}, &epoch))
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Contains(t, world, ".build-deps")
+
+	index, err := a.virtualPackagesIndex()
+	require.NoError(t, err)
+	require.Equal(t, 1, index.Count())
+	virtual := index.Packages()[0]
+	require.Equal(t, ".build-deps", virtual.Name)
+	require.Equal(t, "20230601.123000", virtual.Version)
+	require.Equal(t, []string{"dep-a"}, virtual.Dependencies)
+
+	// simulate FixateWorld having installed the dependencies of the virtual package
+	require.NoError(t, src.MkdirAll("usr/share/dep", 0o755))
+	require.NoError(t, src.WriteFile("usr/share/dep/a", []byte("a"), 0o644))
+	require.NoError(t, src.WriteFile("usr/share/dep/b", []byte("b"), 0o644))
+	require.NoError(t, a.addInstalledPackage(&repository.Package{Name: "dep-a", Version: "1.0-r0", Dependencies: []string{"dep-b"}, Checksum: []byte("dep-a")}, []tar.Header{
+		{Name: "usr", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/share", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/share/dep", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/share/dep/a", Typeflag: tar.TypeReg, Mode: 0o644},
+	}))
+	require.NoError(t, a.addInstalledPackage(&repository.Package{Name: "dep-b", Version: "1.0-r0", Checksum: []byte("dep-b")}, []tar.Header{
+		{Name: "usr/share/dep", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/share/dep/b", Typeflag: tar.TypeReg, Mode: 0o644},
+	}))
+	triggers, err := src.OpenFile(triggersFilePath, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = triggers.Write([]byte("ZGVwLWI= /usr/share/dep\n"))
+	require.NoError(t, err)
+	require.NoError(t, triggers.Close())
+
+	orphans, err = a.Orphans(ctx)
+	require.NoError(t, err)
+	require.Empty(t, orphans)
+
+	require.NoError(t, a.DeleteVirtualPackage(ctx, ".build-deps"))
+
+	world, err = a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, testBaseWorld, world)
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, len(testInstalledPackages))
+	for i, pkg := range installed {
+		require.Equal(t, testInstalledPackages[i].Name, pkg.Name)
+	}
+
+	for _, name := range []string{"usr/share/dep/a", "usr/share/dep/b", "usr/share/dep"} {
+		_, err := src.Stat(name)
+		require.ErrorIs(t, err, os.ErrNotExist, "expected %s to be removed", name)
+	}
+	// usr/share is still used by the base packages
+	_, err = src.Stat("usr/share")
+	require.NoError(t, err)
+
+	b, err := src.ReadFile(triggersFilePath)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "ZGVwLWI=")
+
+	require.Error(t, a.DeleteVirtualPackage(ctx, ".build-deps"))
+	require.Error(t, a.AddVirtualPackage(ctx, "busybox", nil, nil))
+}
+
+func TestDeleteVirtualPackageFiles(t *testing.T) {
+	ctx := context.Background()
+	fs := apkfs.NewMemFS()
+	a, err := New(WithFS(fs), WithArch(testArch), WithIgnoreMknodErrors(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.AddVirtualPackage(ctx, ".build-deps", []string{testPkg.Name}, nil))
+	files := installTestBaselayout(t, a)
+	for _, name := range files {
+		_, err := fs.Stat(name)
+		require.NoError(t, err, name)
+	}
+
+	// the dependencies of the virtual package go, along with their files
+	require.NoError(t, a.DeleteVirtualPackage(ctx, ".build-deps"))
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Empty(t, installed)
+	for _, name := range files {
+		_, err := fs.Stat(name)
+		require.ErrorIs(t, err, os.ErrNotExist, name)
+	}
+}
+
+func TestWithEphemeralPackagesNested(t *testing.T) {
+	ctx := context.Background()
+	a, src, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+	require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, a.SetWorld(testBaseWorld))
+	require.NoError(t, a.AddVirtualPackage(ctx, ephemeralPackageName, nil, nil))
+
+	called := false
+	err = a.WithEphemeralPackages(ctx, []string{"dep-a"}, nil, func() error {
+		called = true
+		return nil
+	})
+	require.Error(t, err)
+	require.False(t, called, "callback should not run when nested")
+}
+
+func TestWithEphemeralPackages(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	writeTestRepository(t, repoDir,
+		testPackage{repository.Package{Name: "libtool", Version: "1.0-r0"}, map[string]string{"usr/lib/libtool.so": "lib"}},
+		testPackage{repository.Package{Name: "tool", Version: "1.0-r0", Dependencies: []string{"libtool"}}, map[string]string{"usr/bin/tool": "tool"}},
+	)
+
+	fs := apkfs.NewMemFS()
+	a := newTestAPK(t, fs, []string{repoDir}, nil)
+	// installed by hand, and needed by nothing in the world
+	require.NoError(t, a.addInstalledPackage(&repository.Package{Name: "stray", Version: "1.0-r0", Checksum: []byte("stray")}, nil))
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+
+	err = a.WithEphemeralPackages(ctx, []string{"tool"}, nil, func() error {
+		_, err := fs.Stat("usr/bin/tool")
+		return err
+	})
+	require.NoError(t, err)
+
+	// what was installed for the callback is gone, and what was there before is not
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	var names []string
+	for _, pkg := range installed {
+		names = append(names, pkg.Name)
+	}
+	require.Equal(t, []string{"stray"}, names)
+	for _, name := range []string{"usr/bin/tool", "usr/lib/libtool.so"} {
+		_, err := fs.Stat(name)
+		require.ErrorIs(t, err, os.ErrNotExist, name)
+	}
+	after, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, world, after)
+}
+
+func TestWithEphemeralPackagesFiles(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	writeTestIndex(t, repoDir, []*repository.Package{copyTestBaselayout(t, repoDir)})
+
+	fs := apkfs.NewMemFS()
+	a := newTestAPK(t, fs, []string{repoDir}, nil)
+	var files []string
+	require.NoError(t, a.WithEphemeralPackages(ctx, []string{testPkg.Name}, nil, func() error {
+		installed, err := a.GetInstalled()
+		if err != nil {
+			return err
+		}
+		for _, pkg := range installed {
+			for _, f := range pkg.Files {
+				if f.Typeflag == tar.TypeReg {
+					files = append(files, f.Name)
+				}
+			}
+		}
+		return nil
+	}))
+
+	// the files of a real package are recorded, and removed along with it
+	require.Contains(t, files, "etc/modprobe.d/aliases.conf")
+	for _, name := range files {
+		_, err := fs.Stat(name)
+		require.ErrorIs(t, err, os.ErrNotExist, name)
+	}
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Empty(t, installed)
+}
+
+func TestAutoremove(t *testing.T) {
+	ctx := context.Background()
+	a, src, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+	require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, a.SetWorld(testBaseWorld))
+
+	// installed by hand, and needed by nothing in the world
+	dir := t.TempDir()
+	for _, stray := range []testPackage{
+		{repository.Package{Name: "stray", Version: "1.0-r0", Arch: testArch, Dependencies: []string{"stray-lib"}}, map[string]string{"usr/share/stray/file": "stray"}},
+		{repository.Package{Name: "stray-lib", Version: "1.0-r0", Arch: testArch}, nil},
+	} {
+		p := filepath.Join(dir, stray.pkg.Filename())
+		installTestAPK(t, a, p, writeTestAPK(t, p, &stray.pkg, stray.files))
+	}
+	_, err = src.Stat("usr/share/stray/file")
+	require.NoError(t, err)
+
+	orphans, err := a.Orphans(ctx)
+	require.NoError(t, err)
+	require.Len(t, orphans, 2)
+	require.Equal(t, "stray", orphans[0].Name)
+	require.Equal(t, "stray-lib", orphans[1].Name)
+
+	removed, err := a.Autoremove(ctx)
+	require.NoError(t, err)
+	require.Equal(t, orphans, removed)
+	_, err = src.Stat("usr/share/stray/file")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, len(testInstalledPackages))
+
+	removed, err = a.Autoremove(ctx)
+	require.NoError(t, err)
+	require.Empty(t, removed)
+}
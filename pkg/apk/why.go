@@ -0,0 +1,133 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// Why explains why the installed package name is installed, with the chains of packages from the world
+// to it: each starts with the package of a world entry, ends with name, and has each package depend on
+// the next, or the next be installed along with it through its install_if. There is a chain, the
+// shortest, for each world entry that requires the package, in the order of the world, and none if
+// nothing does, for an orphan. It is an error if the package is not installed.
+//
+// The dependencies are resolved against the installed packages only, so this does not need access to
+// any repository.
+func (a *APK) Why(ctx context.Context, name string) ([][]string, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Why")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+	pkgs := installedIndex(installed).Packages()
+	target := -1
+	for i, pkg := range pkgs {
+		if pkg.Name == name {
+			target = i
+			break
+		}
+	}
+	if target < 0 {
+		return nil, fmt.Errorf("package %s is not installed", name)
+	}
+
+	// this only walks the dependencies between the installed packages, as they were resolved, so the
+	// PkgResolver is used for its graph whatever Resolver is set
+	resolver := NewPkgResolver(ctx, nil)
+	edges := resolver.dependencyGraph(pkgs)
+	// the packages given that can satisfy each name, as for the dependencies
+	byName := map[string][]int{}
+	for i, pkg := range pkgs {
+		byName[pkg.Name] = append(byName[pkg.Name], i)
+		for provided := range resolver.providedNames(pkg) {
+			byName[provided] = append(byName[provided], i)
+		}
+	}
+	// a package installed for its install_if is there because of the packages it names
+	for i, pkg := range pkgs {
+		for _, cond := range pkg.InstallIf {
+			if providers := byName[resolvePackageNameVersionPin(cond).name]; len(providers) > 0 && providers[0] != i {
+				edges[providers[0]] = append(edges[providers[0]], i)
+			}
+		}
+	}
+
+	var chains [][]string
+	seen := map[string]bool{}
+	for _, entry := range world {
+		roots := byName[resolvePackageNameVersionPin(entry).name]
+		if len(roots) == 0 {
+			continue
+		}
+		chain := shortestChain(edges, roots[0], target)
+		if chain == nil {
+			continue
+		}
+		names := make([]string, len(chain))
+		for i, p := range chain {
+			names[i] = pkgs[p].Name
+		}
+		// world entries for the same package, or for providers of the same, have the same chain
+		if key := strings.Join(names, " "); !seen[key] {
+			seen[key] = true
+			chains = append(chains, names)
+		}
+	}
+	return chains, nil
+}
+
+// shortestChain returns the shortest path in the graph from one vertex to another, both included, or nil
+// if there is none.
+func shortestChain(edges [][]int, from, to int) []int {
+	parent := make([]int, len(edges))
+	for i := range parent {
+		parent[i] = -1
+	}
+	parent[from] = from
+	queue := []int{from}
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		if v == to {
+			var chain []int
+			for ; v != from; v = parent[v] {
+				chain = append(chain, v)
+			}
+			chain = append(chain, from)
+			for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+				chain[i], chain[j] = chain[j], chain[i]
+			}
+			return chain
+		}
+		for _, w := range edges[v] {
+			if parent[w] < 0 {
+				parent[w] = v
+				queue = append(queue, w)
+			}
+		}
+	}
+	return nil
+}
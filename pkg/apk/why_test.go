@@ -0,0 +1,60 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestWhy(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithIgnoreMknodErrors(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	for _, pkg := range []*repository.Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"so:libfoo.so.1", "cmd:sh"}},
+		{Name: "libfoo", Version: "1.0-r0", Provides: []string{"so:libfoo.so.1=1"}, Dependencies: []string{"libbar>=1"}},
+		{Name: "libbar", Version: "1.0-r0"},
+		{Name: "busybox", Version: "1.0-r0", Provides: []string{"cmd:sh=1.0"}},
+		{Name: "docs", Version: "1.0-r0"},
+		{Name: "app-doc", Version: "1.0-r0", InstallIf: []string{"app=1.0-r0", "docs"}},
+		{Name: "stray", Version: "1.0-r0"},
+	} {
+		pkg.Checksum = []byte(pkg.Name)
+		require.NoError(t, a.addInstalledPackage(pkg, nil))
+	}
+	require.NoError(t, a.SetWorld([]string{"app", "docs", "busybox"}))
+
+	for name, want := range map[string][][]string{
+		"libbar":  {{"app", "libfoo", "libbar"}},
+		"busybox": {{"app", "busybox"}, {"busybox"}},
+		"app-doc": {{"app", "app-doc"}, {"docs", "app-doc"}},
+		"app":     {{"app"}},
+		"stray":   nil,
+	} {
+		chains, err := a.Why(ctx, name)
+		require.NoError(t, err)
+		require.Equal(t, want, chains, name)
+	}
+
+	_, err = a.Why(ctx, "missing")
+	require.ErrorContains(t, err, "not installed")
+}
@@ -15,11 +15,17 @@
 package apk
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
 )
 
 // getWorldPackages get list of packages that should be installed, according to /etc/apk/world
@@ -56,3 +62,272 @@ func (a *APK) SetWorld(packages []string) error {
 
 	return nil
 }
+
+// DeletePackages removes the named packages from the world, then removes every installed package
+// that the world no longer requires, the equivalent of "apk del names...". It is an error to delete
+// a package that is not in the world.
+func (a *APK) DeletePackages(ctx context.Context, names ...string) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "DeletePackages")
+	defer span.End()
+
+	world, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	remove := make(map[string]bool, len(names))
+	for _, name := range names {
+		remove[name] = true
+	}
+	newWorld := make([]string, 0, len(world))
+	for _, entry := range world {
+		stuff := resolvePackageNameVersionPin(entry)
+		if remove[stuff.name] {
+			delete(remove, stuff.name)
+			continue
+		}
+		newWorld = append(newWorld, entry)
+	}
+	if len(remove) > 0 {
+		missing := make([]string, 0, len(remove))
+		for name := range remove {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("not in world: %s", strings.Join(missing, ", "))
+	}
+	if err := a.SetWorld(newWorld); err != nil {
+		return err
+	}
+	return a.removeOrphans(ctx)
+}
+
+// UpdateWorld adds the entries of add to the world, and removes those of the packages named in remove,
+// then installs what the world now requires and removes every installed package that it no longer does,
+// the equivalent of "apk add add..." and "apk del remove..." at once. An entry of add replaces the entry
+// of the same package already in the world, such as "foo=1.2-r0" replacing "foo". It is an error to remove
+// a package that is not in the world, or to both add and remove one.
+//
+// If the new world cannot be installed, the world is set back to what it was, except with WithBestEffort,
+// where it is kept for the next install to try the rest again.
+func (a *APK) UpdateWorld(ctx context.Context, add, remove []string, sourceDateEpoch *time.Time) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "UpdateWorld")
+	defer span.End()
+
+	world, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	newWorld, err := editWorld(world, add, remove)
+	if err != nil {
+		return err
+	}
+	if err := a.SetWorld(newWorld); err != nil {
+		return err
+	}
+	if err := a.fixateWorld(ctx, sourceDateEpoch, false, false, nil); err != nil {
+		var partial *PartialInstallError
+		if errors.As(err, &partial) {
+			return errors.Join(err, a.removeOrphans(ctx))
+		}
+		if restoreErr := a.SetWorld(world); restoreErr != nil {
+			return errors.Join(err, fmt.Errorf("restoring world: %w", restoreErr))
+		}
+		return err
+	}
+	return a.removeOrphans(ctx)
+}
+
+// editWorld returns the world with the entries of add, replacing those of the same packages, and
+// without the entries of the packages named in remove.
+func editWorld(world, add, remove []string) ([]string, error) {
+	drop := make(map[string]bool, len(remove)+len(add))
+	for _, name := range remove {
+		drop[name] = true
+	}
+	for _, entry := range add {
+		name := resolvePackageNameVersionPin(entry).name
+		if drop[name] {
+			return nil, fmt.Errorf("cannot both add and remove %s", name)
+		}
+	}
+	missing := make(map[string]bool, len(remove))
+	for name := range drop {
+		missing[name] = true
+	}
+	for _, entry := range add {
+		drop[resolvePackageNameVersionPin(entry).name] = true
+	}
+
+	newWorld := make([]string, 0, len(world)+len(add))
+	for _, entry := range world {
+		name := resolvePackageNameVersionPin(entry).name
+		delete(missing, name)
+		if !drop[name] {
+			newWorld = append(newWorld, entry)
+		}
+	}
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("not in world: %s", strings.Join(names, ", "))
+	}
+	return append(newWorld, add...), nil
+}
+
+// HoldPackages holds each of the named packages at its installed version, so that resolution
+// will not move it, by pinning its entry in the world to that exact version, the equivalent of
+// "apk add name=version". Packages that are not in the world yet are added to it.
+func (a *APK) HoldPackages(names ...string) error {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	versions := make(map[string]string, len(installed))
+	for _, pkg := range installed {
+		versions[pkg.Name] = pkg.Version
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	for _, name := range names {
+		version, ok := versions[name]
+		if !ok {
+			return fmt.Errorf("cannot hold package %s: not installed", name)
+		}
+		found := false
+		for i, entry := range world {
+			stuff := resolvePackageNameVersionPin(entry)
+			if stuff.name != name {
+				continue
+			}
+			world[i] = worldEntry(name, "="+version, stuff.pin)
+			found = true
+		}
+		if !found {
+			world = append(world, worldEntry(name, "="+version, ""))
+		}
+	}
+	return a.SetWorld(world)
+}
+
+// UnholdPackages removes the version pin from the world entries of the named packages,
+// so they are free to move again.
+func (a *APK) UnholdPackages(names ...string) error {
+	world, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	unhold := make(map[string]bool, len(names))
+	for _, name := range names {
+		unhold[name] = true
+	}
+	for i, entry := range world {
+		stuff := resolvePackageNameVersionPin(entry)
+		if unhold[stuff.name] && stuff.dep == versionEqual {
+			world[i] = worldEntry(stuff.name, "", stuff.pin)
+		}
+	}
+	return a.SetWorld(world)
+}
+
+// HeldPackages returns the packages that are held, i.e. pinned to an exact version in the world,
+// as a map of name to version.
+func (a *APK) HeldPackages() (map[string]string, error) {
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+	return heldPackages(world), nil
+}
+
+func heldPackages(world []string) map[string]string {
+	held := map[string]string{}
+	for _, entry := range world {
+		stuff := resolvePackageNameVersionPin(entry)
+		if stuff.dep == versionEqual {
+			held[stuff.name] = stuff.version
+		}
+	}
+	return held
+}
+
+// worldEntry builds an entry for the world file from a name, an optional constraint such as "=1.2-r0",
+// and an optional repository pin.
+func worldEntry(name, constraint, pin string) string {
+	// the tag goes before the constraint, as apk-tools writes and reads it
+	entry := name
+	if pin != "" {
+		entry += "@" + pin
+	}
+	return entry + constraint
+}
+
+// explainHeldPackages looks for held packages behind a failure to resolve the world, by resolving
+// it again with each one released in turn. Each held package whose release lets resolution succeed
+// is reported as a *HeldPackageError wrapping the original error; if there are none, the original
+// error is returned as is. Only the entries of world count as held; expand, if not nil, adds what
+// is resolved along with them, such as their subpackages, after each release.
+func explainHeldPackages(ctx context.Context, resolver Resolver, world []string, expand func([]string) []string, resolveErr error) error {
+	var errs []error
+	for name, version := range heldPackages(world) {
+		released := make([]string, 0, len(world))
+		for _, entry := range world {
+			stuff := resolvePackageNameVersionPin(entry)
+			if stuff.name == name && stuff.dep == versionEqual {
+				entry = worldEntry(name, "", stuff.pin)
+			}
+			released = append(released, entry)
+		}
+		if expand != nil {
+			released = expand(released)
+		}
+		pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, released)
+		if err != nil {
+			continue
+		}
+		for _, pkg := range pkgs {
+			if pkg.Name == name {
+				errs = append(errs, &HeldPackageError{Name: name, Held: version, Wanted: "version " + pkg.Version, wrapped: resolveErr})
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return resolveErr
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].(*HeldPackageError).Name < errs[j].(*HeldPackageError).Name
+	})
+	return errors.Join(errs...)
+}
+
+// checkHeldPackages verifies that resolution kept every held package at its held version, and that
+// nothing that was resolved needs a version of a held package other than the held one.
+func checkHeldPackages(world []string, pkgs []*repository.RepositoryPackage) error {
+	held := heldPackages(world)
+	if len(held) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, pkg := range pkgs {
+		if version, ok := held[pkg.Name]; ok && version != pkg.Version {
+			errs = append(errs, &HeldPackageError{Name: pkg.Name, Held: version, Wanted: "version " + pkg.Version})
+		}
+		for _, dep := range pkg.Dependencies {
+			stuff := resolvePackageNameVersionPin(dep)
+			version, ok := held[stuff.name]
+			if !ok || stuff.dep == versionNone {
+				continue
+			}
+			actual, err1 := parseVersion(version)
+			required, err2 := parseVersion(stuff.version)
+			if err1 != nil || err2 != nil || !stuff.dep.satisfies(actual, required) {
+				errs = append(errs, &HeldPackageError{Name: stuff.name, Held: version, Wanted: dep, RequiredBy: pkg.Name})
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -15,12 +15,19 @@
 package apk
 
 import (
+	"archive/tar"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/chainguard-dev/go-apk/pkg/version"
 )
 
 func TestGetWorld(t *testing.T) {
@@ -36,3 +43,462 @@ func TestGetWorld(t *testing.T) {
 	require.NoError(t, err, "unable to get world packages")
 	require.Equal(t, strings.Join(packages, " "), strings.Join(pkgs, " "), "expected packages %v, got %v", packages, pkgs)
 }
+
+func TestDeletePackages(t *testing.T) {
+	ctx := context.Background()
+	a, src, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+	require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, a.SetWorld(testBaseWorld))
+
+	require.ErrorContains(t, a.DeletePackages(ctx, "libc-utils", "notinworld"), "notinworld")
+
+	require.NoError(t, a.DeletePackages(ctx, "libc-utils"))
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"alpine-baselayout", "alpine-keys", "apk-tools", "busybox"}, world)
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	names := make([]string, 0, len(installed))
+	for _, pkg := range installed {
+		names = append(names, pkg.Name)
+	}
+	// libc-utils took musl-utils and scanelf with it
+	require.Len(t, names, len(testInstalledPackages)-3)
+	require.NotContains(t, names, "libc-utils")
+	require.NotContains(t, names, "musl-utils")
+	require.NotContains(t, names, "scanelf")
+}
+
+func TestHoldPackages(t *testing.T) {
+	a, src, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+	require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, a.SetWorld([]string{"busybox", "apk-tools@edge"}))
+
+	require.NoError(t, a.HoldPackages("apk-tools", "busybox", "musl"))
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"apk-tools@edge=2.12.9-r3", "busybox=1.35.0-r17", "musl=1.2.3-r0"}, world)
+
+	held, err := a.HeldPackages()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"apk-tools": "2.12.9-r3", "busybox": "1.35.0-r17", "musl": "1.2.3-r0"}, held)
+
+	require.NoError(t, a.UnholdPackages("apk-tools", "musl"))
+	world, err = a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"apk-tools@edge", "busybox=1.35.0-r17", "musl"}, world)
+
+	require.Error(t, a.HoldPackages("notinstalled"))
+}
+
+func TestHeldPackagesBlocking(t *testing.T) {
+	ctx := context.Background()
+	repo := repository.Repository{}
+	index := repo.WithIndex(&repository.ApkIndex{
+		Packages: []*repository.Package{
+			{Name: "lib", Version: "1.0.0"},
+			{Name: "lib", Version: "2.0.0"},
+			{Name: "app", Version: "1.0.0", Dependencies: []string{"lib>=2.0.0"}},
+		},
+	})
+	resolver := NewPkgResolver(ctx, testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{index}))
+
+	t.Run("held package moved", func(t *testing.T) {
+		world := []string{"app", "lib=1.0.0"}
+		pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, world)
+		require.NoError(t, err)
+		err = checkHeldPackages(world, pkgs)
+		var heldErr *HeldPackageError
+		require.ErrorAs(t, err, &heldErr)
+		require.Equal(t, "lib", heldErr.Name)
+		require.Equal(t, "1.0.0", heldErr.Held)
+	})
+	t.Run("held package does not satisfy a dependency", func(t *testing.T) {
+		world := []string{"lib=1.0.0", "app"}
+		pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, world)
+		require.NoError(t, err)
+		err = checkHeldPackages(world, pkgs)
+		var heldErr *HeldPackageError
+		require.ErrorAs(t, err, &heldErr)
+		require.Equal(t, "app", heldErr.RequiredBy)
+		require.Equal(t, "lib>=2.0.0", heldErr.Wanted)
+	})
+	t.Run("held version no longer available", func(t *testing.T) {
+		world := []string{"app", "lib=0.5.0"}
+		_, _, resolveErr := resolver.GetPackagesWithDependencies(ctx, world)
+		require.Error(t, resolveErr)
+		err := explainHeldPackages(ctx, resolver, world, nil, resolveErr)
+		var heldErr *HeldPackageError
+		require.ErrorAs(t, err, &heldErr)
+		require.Equal(t, "lib", heldErr.Name)
+		require.Equal(t, "version 2.0.0", heldErr.Wanted)
+		require.ErrorIs(t, err, resolveErr)
+	})
+	t.Run("unrelated errors are passed through", func(t *testing.T) {
+		other := errors.New("other")
+		require.Equal(t, other, explainHeldPackages(ctx, resolver, []string{"app", "missing"}, nil, other))
+	})
+	t.Run("held packages that do not move", func(t *testing.T) {
+		world := []string{"app", "lib=2.0.0"}
+		pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, world)
+		require.NoError(t, err)
+		require.NoError(t, checkHeldPackages(world, pkgs))
+	})
+}
+
+func TestWorldOperators(t *testing.T) {
+	ctx := context.Background()
+	b, err := os.ReadFile(filepath.Join("testdata", "world", "world"))
+	require.NoError(t, err)
+
+	fs := apkfs.NewMemFS()
+	require.NoError(t, fs.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, fs.WriteFile(worldFilePath, b, 0o644))
+	a, err := New(WithFS(fs), WithIgnoreMknodErrors(ignoreMknodErrors))
+	require.NoError(t, err)
+
+	// the entries are read as apk-tools wrote them, and written back the same
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"!doas", "alpine-base", "apk-tools@edge>=2.12", "busybox<1.37", "curl~8.5", "musl=1.2.4-r2", "openssl>3.1", "zlib<=1.3.1"}, world)
+	require.NoError(t, a.SetWorld(world))
+	rewritten, err := fs.ReadFile(worldFilePath)
+	require.NoError(t, err)
+	require.Equal(t, string(b), string(rewritten))
+
+	for _, tt := range []struct {
+		entry, name, version, pin string
+		dep                       versionDependency
+	}{
+		{entry: "apk-tools@edge>=2.12", name: "apk-tools", version: "2.12", pin: "edge", dep: versionGreaterEqual},
+		{entry: "busybox<1.37", name: "busybox", version: "1.37", dep: versionLess},
+		{entry: "curl~8.5", name: "curl", version: "8.5", dep: versionTilde},
+		{entry: "musl=1.2.4-r2", name: "musl", version: "1.2.4-r2", dep: versionEqual},
+		{entry: "openssl>3.1", name: "openssl", version: "3.1", dep: versionGreater},
+		{entry: "zlib<=1.3.1", name: "zlib", version: "1.3.1", dep: versionLessEqual},
+	} {
+		stuff := resolvePackageNameVersionPin(tt.entry)
+		require.Equal(t, tt.name, stuff.name, tt.entry)
+		require.Equal(t, tt.version, stuff.version, tt.entry)
+		require.Equal(t, tt.pin, stuff.pin, tt.entry)
+		require.Equal(t, tt.dep, stuff.dep, tt.entry)
+		require.Equal(t, tt.entry, worldEntry(stuff.name, stuff.constraint(), stuff.pin), tt.entry)
+	}
+
+	// and honored when resolving
+	repo := repository.Repository{}
+	index := repo.WithIndex(&repository.ApkIndex{
+		Packages: []*repository.Package{
+			{Name: "curl", Version: "8.4.0-r0"},
+			{Name: "curl", Version: "8.5.0-r0"},
+			{Name: "curl", Version: "8.6.0-r0", Dependencies: []string{"doas"}},
+			{Name: "busybox", Version: "1.36.1-r0"},
+			{Name: "busybox", Version: "1.37.0-r0"},
+			{Name: "openssl", Version: "3.1.0-r0"},
+			{Name: "openssl", Version: "3.1.4-r0"},
+			{Name: "doas", Version: "6.8.2-r0"},
+		},
+	})
+	edge := repository.Repository{Uri: "edge"}
+	edgeIndex := edge.WithIndex(&repository.ApkIndex{
+		Packages: []*repository.Package{
+			{Name: "apk-tools", Version: "2.14.0-r0"},
+		},
+	})
+	resolver := NewPkgResolver(ctx, []NamedIndex{
+		NewNamedRepositoryWithIndex("", index),
+		NewNamedRepositoryWithIndex("edge", edgeIndex),
+	})
+	pkgs, conflicts, err := resolver.GetPackagesWithDependencies(ctx, []string{"!doas", "apk-tools@edge>=2.12", "busybox<1.37", "curl~8.5", "openssl>3.1"})
+	require.NoError(t, err)
+	versions := map[string]string{}
+	for _, pkg := range pkgs {
+		versions[pkg.Name] = pkg.Version
+	}
+	require.Equal(t, map[string]string{"apk-tools": "2.14.0-r0", "busybox": "1.36.1-r0", "curl": "8.5.0-r0", "openssl": "3.1.4-r0"}, versions)
+	require.Contains(t, conflicts, "doas")
+
+	// a conflict in the world forbids what would need it
+	_, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"!doas", "curl>8.5"})
+	require.ErrorContains(t, err, "!doas")
+	_, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"!doas<6", "curl>8.5"})
+	require.NoError(t, err)
+}
+
+func TestResolveConflicts(t *testing.T) {
+	ctx := context.Background()
+	repo := repository.Repository{}
+	index := repo.WithIndex(&repository.ApkIndex{
+		Packages: []*repository.Package{
+			{Name: "sudo", Version: "1.9.15-r0", Provides: []string{"cmd:sudo=1.9.15-r0"}},
+			{Name: "doas", Version: "6.8.2-r0"},
+			{Name: "doas-only", Version: "1.0-r0", Dependencies: []string{"doas", "!cmd:sudo"}},
+			{Name: "doas-sudo-shim", Version: "0.1.1-r0", Provides: []string{"cmd:sudo"}, Dependencies: []string{"doas", "!sudo", "!cmd:sudo"}},
+			{Name: "oldlib", Version: "1.0-r0"},
+			{Name: "app", Version: "1.0-r0", Dependencies: []string{"!oldlib>=2"}},
+		},
+	})
+	resolver := NewPkgResolver(ctx, []NamedIndex{NewNamedRepositoryWithIndex("", index)})
+
+	// a package may not be installed with one that it conflicts with, by name or by what it provides
+	_, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"doas-only", "sudo"})
+	require.ErrorContains(t, err, "cannot install sudo 1.9.15-r0, as doas-only 1.0-r0 conflicts with it (!cmd:sudo)")
+	_, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"doas-sudo-shim", "sudo"})
+	require.ErrorContains(t, err, "(!sudo)")
+
+	// but it may with one it conflicts with that it provides itself, or at a version outside the conflict
+	pkgs, conflicts, err := resolver.GetPackagesWithDependencies(ctx, []string{"doas-sudo-shim"})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 2)
+	require.ElementsMatch(t, []string{"cmd:sudo", "sudo"}, conflicts)
+	_, conflicts, err = resolver.GetPackagesWithDependencies(ctx, []string{"app", "oldlib"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"oldlib>=2"}, conflicts)
+}
+
+func TestInstalledConflicts(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	writeTestRepository(t, repoDir,
+		testPackage{repository.Package{Name: "sudo", Version: "1.9.15-r0"}, map[string]string{"usr/bin/sudo": "sudo"}},
+		testPackage{repository.Package{Name: "doas", Version: "6.8.2-r0", Dependencies: []string{"!sudo"}}, map[string]string{"usr/bin/doas": "doas", "usr/bin/sudo": "doas"}},
+		testPackage{repository.Package{Name: "missing", Version: "1.0-r0"}, nil},
+	)
+	require.NoError(t, os.Remove(filepath.Join(repoDir, "missing-1.0-r0.apk")))
+
+	fs := apkfs.NewMemFS()
+	a := newTestAPK(t, fs, []string{repoDir}, []string{"sudo"})
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	// installing what conflicts with an installed package is an error
+	require.NoError(t, a.SetWorld([]string{"doas"}))
+	require.ErrorContains(t, a.FixateWorld(ctx, nil), "cannot install due to conflict with sudo")
+
+	installedNames := func() []string {
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		var names []string
+		for _, pkg := range installed {
+			names = append(names, pkg.Name)
+		}
+		return names
+	}
+
+	// unless upgrading, which removes it once everything else is installed, and not if that fails
+	require.NoError(t, a.SetWorld([]string{"doas", "missing"}))
+	require.Error(t, a.UpgradeWorld(ctx, nil))
+	require.Contains(t, installedNames(), "sudo")
+
+	require.NoError(t, a.SetWorld([]string{"doas"}))
+	require.NoError(t, a.UpgradeWorld(ctx, nil))
+	require.Equal(t, []string{"doas"}, installedNames())
+	// what it installed over the removed package's files is kept
+	b, err := fs.ReadFile("usr/bin/sudo")
+	require.NoError(t, err)
+	require.Equal(t, "doas", string(b))
+}
+
+func TestUpgradeReplacesOnlyOnceInstalled(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	writeTestRepository(t, repoDir,
+		testPackage{repository.Package{Name: "hello", Version: "1.0-r0"}, map[string]string{"usr/bin/hello": "1.0", "usr/share/hello/old": "old"}})
+
+	fs := apkfs.NewMemFS()
+	a := newTestAPK(t, fs, []string{repoDir}, []string{"hello"})
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	// the new version needs a package that cannot be fetched, and is installed after it
+	writeTestRepository(t, repoDir,
+		testPackage{repository.Package{Name: "hello", Version: "2.0-r0", Dependencies: []string{"missing"}}, map[string]string{"usr/bin/hello": "2.0"}},
+		testPackage{repository.Package{Name: "missing", Version: "1.0-r0"}, nil},
+	)
+	missing := filepath.Join(repoDir, "missing-1.0-r0.apk")
+	require.NoError(t, os.Rename(missing, missing+".bak"))
+
+	readFile := func(name string) string {
+		b, err := fs.ReadFile(name)
+		require.NoError(t, err)
+		return string(b)
+	}
+	installedVersion := func() string {
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		for _, pkg := range installed {
+			if pkg.Name == "hello" {
+				return pkg.Version
+			}
+		}
+		return ""
+	}
+
+	// a failed upgrade leaves the old version installed, with its files
+	require.Error(t, a.UpgradeWorld(ctx, nil))
+	require.Equal(t, "1.0-r0", installedVersion())
+	require.Equal(t, "1.0", readFile("usr/bin/hello"))
+	require.Equal(t, "old", readFile("usr/share/hello/old"))
+
+	// and a successful one removes the files that only the old version had
+	require.NoError(t, os.Rename(missing+".bak", missing))
+	require.NoError(t, a.UpgradeWorld(ctx, nil))
+	require.Equal(t, "2.0-r0", installedVersion())
+	require.Equal(t, "2.0", readFile("usr/bin/hello"))
+	_, err := fs.Stat("usr/share/hello/old")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestUpdateWorld(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	writeTestRepository(t, repoDir,
+		testPackage{repository.Package{Name: "libhello", Version: "1.0-r0"}, map[string]string{"usr/lib/libhello.so": "lib"}},
+		testPackage{repository.Package{Name: "hello", Version: "1.0-r0", Dependencies: []string{"libhello"}}, map[string]string{"usr/bin/hello": "hello"}},
+		testPackage{repository.Package{Name: "goodbye", Version: "1.0-r0"}, map[string]string{"usr/bin/goodbye": "goodbye"}},
+	)
+
+	a := newTestAPK(t, apkfs.NewMemFS(), []string{repoDir}, nil)
+	installedNames := func() []string {
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		var names []string
+		for _, pkg := range installed {
+			names = append(names, pkg.Name)
+		}
+		return names
+	}
+
+	require.NoError(t, a.UpdateWorld(ctx, []string{"hello"}, nil, nil))
+	require.ElementsMatch(t, []string{"hello", "libhello"}, installedNames())
+
+	// adding replaces the entry of the same package, and removing takes the dependencies along
+	require.NoError(t, a.UpdateWorld(ctx, []string{"goodbye", "hello=1.0-r0"}, nil, nil))
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"goodbye", "hello=1.0-r0"}, world)
+	require.NoError(t, a.UpdateWorld(ctx, nil, []string{"hello"}, nil))
+	require.ElementsMatch(t, []string{"goodbye"}, installedNames())
+
+	require.ErrorContains(t, a.UpdateWorld(ctx, nil, []string{"hello"}, nil), "not in world: hello")
+	require.ErrorContains(t, a.UpdateWorld(ctx, []string{"hello"}, []string{"hello"}, nil), "both add and remove")
+
+	// a world that cannot be installed is set back
+	require.Error(t, a.UpdateWorld(ctx, []string{"missing"}, []string{"goodbye"}, nil))
+	world, err = a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"goodbye"}, world)
+	require.ElementsMatch(t, []string{"goodbye"}, installedNames())
+}
+
+func TestUpdateWorldFiles(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	writeTestIndex(t, repoDir, []*repository.Package{copyTestBaselayout(t, repoDir)})
+
+	fs := apkfs.NewMemFS()
+	a := newTestAPK(t, fs, []string{repoDir}, nil)
+	require.NoError(t, a.UpdateWorld(ctx, []string{testPkg.Name}, nil, nil))
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	var files []string
+	for _, pkg := range installed {
+		for _, f := range pkg.Files {
+			if f.Typeflag == tar.TypeReg {
+				files = append(files, f.Name)
+			}
+		}
+	}
+	require.Contains(t, files, "etc/modprobe.d/aliases.conf")
+	for _, name := range files {
+		_, err := fs.Stat(name)
+		require.NoError(t, err, name)
+	}
+
+	// the files of a real package are removed along with it when it leaves the world
+	require.NoError(t, a.UpdateWorld(ctx, nil, []string{testPkg.Name}, nil))
+	for _, name := range files {
+		_, err := fs.Stat(name)
+		require.ErrorIs(t, err, os.ErrNotExist, name)
+	}
+	installed, err = a.GetInstalled()
+	require.NoError(t, err)
+	require.Empty(t, installed)
+}
+
+// oldestResolver resolves each package to its oldest version, ignoring dependencies.
+type oldestResolver struct {
+	indexes []NamedIndex
+}
+
+func (r *oldestResolver) GetPackagesWithDependencies(_ context.Context, packages []string) ([]*repository.RepositoryPackage, []string, error) {
+	var toInstall []*repository.RepositoryPackage
+	for _, name := range packages {
+		var oldest *repository.RepositoryPackage
+		for _, index := range r.indexes {
+			for _, pkg := range index.Packages() {
+				if pkg.Name != name {
+					continue
+				}
+				if oldest == nil {
+					oldest = pkg
+					continue
+				}
+				if c, err := version.Compare(pkg.Version, oldest.Version); err == nil && c < 0 {
+					oldest = pkg
+				}
+			}
+		}
+		if oldest == nil {
+			return nil, nil, errors.New("no package " + name)
+		}
+		toInstall = append(toInstall, oldest)
+	}
+	return toInstall, nil, nil
+}
+
+func (r *oldestResolver) ResolvePackage(name string) ([]*repository.RepositoryPackage, error) {
+	pkgs, _, err := r.GetPackagesWithDependencies(context.Background(), []string{name})
+	return pkgs, err
+}
+
+func TestWithResolverFunc(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	writeTestRepository(t, repoDir,
+		testPackage{repository.Package{Name: "hello", Version: "1.0-r0"}, map[string]string{"usr/bin/hello": "hello 1"}},
+		testPackage{repository.Package{Name: "hello", Version: "2.0-r0"}, map[string]string{"usr/bin/hello": "hello 2"}},
+	)
+
+	resolved := func(opts ...Option) (string, error) {
+		a := newTestAPK(t, apkfs.NewMemFS(), []string{repoDir}, []string{"hello"}, opts...)
+		toInstall, _, err := a.ResolveWorld(ctx)
+		if err != nil {
+			return "", err
+		}
+		require.Len(t, toInstall, 1)
+		// and info looks up packages with the same resolver
+		info, err := a.Info(ctx, "hello")
+		require.NoError(t, err)
+		require.Equal(t, toInstall[0].Version, info.Version)
+		return toInstall[0].Version, nil
+	}
+
+	// the newest, by default
+	v, err := resolved()
+	require.NoError(t, err)
+	require.Equal(t, "2.0-r0", v)
+
+	// or as the resolver set chooses
+	v, err = resolved(WithResolverFunc(func(_ context.Context, indexes []NamedIndex) (Resolver, error) {
+		return &oldestResolver{indexes: indexes}, nil
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "1.0-r0", v)
+
+	_, err = resolved(WithResolverFunc(func(context.Context, []NamedIndex) (Resolver, error) {
+		return nil, errors.New("no solver")
+	}))
+	require.ErrorContains(t, err, "no solver")
+}
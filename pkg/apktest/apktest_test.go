@@ -0,0 +1,90 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apktest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestRepository(t *testing.T) {
+	ctx := context.Background()
+	key, err := NewKey("test.rsa")
+	require.NoError(t, err)
+	repo := NewRepository("test", key)
+	added, err := repo.Add(
+		&Package{
+			Package: repository.Package{Name: "hello", Version: "1.0-r0", Arch: "x86_64", Dependencies: []string{"libhello"}},
+			Files:   map[string]string{"usr/bin/hello": "hello"},
+		},
+		&Package{
+			Package:  repository.Package{Name: "libhello", Version: "1.0-r0", Arch: "x86_64"},
+			Files:    map[string]string{"usr/lib/libhello.so.1": "lib"},
+			Symlinks: map[string]string{"usr/lib/libhello.so": "libhello.so.1"},
+		},
+	)
+	require.NoError(t, err)
+	require.Len(t, added, 2)
+	require.Equal(t, uint64(5), added[0].InstalledSize)
+
+	// the packages are signed, and their datahash matches
+	dir := t.TempDir()
+	require.NoError(t, repo.WriteDir(dir, "x86_64"))
+	v := apk.VerifyPackage(ctx, filepath.Join(dir, "x86_64", "hello-1.0-r0.apk"), key.Keys(), nil)
+	require.True(t, v.OK(), v.String())
+	require.Equal(t, key.PublicName(), v.Signer)
+	require.Equal(t, added[0].DataHash, v.DataHash)
+
+	// as is the index
+	indexes, err := apk.GetRepositoryIndexes(ctx, []string{dir}, key.Keys(), "x86_64")
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.Equal(t, 2, indexes[0].Count())
+	_, err = apk.GetRepositoryIndexes(ctx, []string{dir}, map[string][]byte{}, "x86_64")
+	require.Error(t, err)
+
+	// and the packages install from memory
+	mem, err := repo.MemoryRepository("", "memory://test")
+	require.NoError(t, err)
+	fs := apkfs.NewMemFS()
+	a, err := apk.New(apk.WithFS(fs), apk.WithArch("x86_64"), apk.WithIgnoreMknodErrors(true), apk.WithMemoryRepositories(mem))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetWorld([]string{"hello"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+	b, err := fs.ReadFile("usr/bin/hello")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+}
+
+func TestKeyWriteFiles(t *testing.T) {
+	key, err := NewKey("test.rsa")
+	require.NoError(t, err)
+	dir := t.TempDir()
+	private, err := key.WriteFiles(dir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "test.rsa"), private)
+	pub, err := os.ReadFile(filepath.Join(dir, "test.rsa.pub"))
+	require.NoError(t, err)
+	require.Equal(t, key.PublicKeyPEM(), pub)
+}
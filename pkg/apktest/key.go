@@ -0,0 +1,105 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apktest synthesizes minimal valid .apk files, signed repository indexes and the key pairs to
+// sign them with, in memory, for hermetic tests of code that uses go-apk without real Alpine artifacts.
+package apktest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec // apk signatures are over sha1 digests
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Key is an RSA key pair to sign packages and indexes with, as by abuild-sign.
+type Key struct {
+	// Name is the name of the key, such as "test.rsa". Signatures name the public key, Name + ".pub",
+	// that they are verified with.
+	Name       string
+	PrivateKey *rsa.PrivateKey
+}
+
+// NewKey generates a key pair of the name, such as "test.rsa". Its keys are 2048 bits, the smallest
+// that apk-tools accepts.
+func NewKey(name string) (*Key, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generating key %s: %w", name, err)
+	}
+	return &Key{Name: name, PrivateKey: key}, nil
+}
+
+// PublicName returns the name of the public key, the file name it is trusted as in /etc/apk/keys.
+func (k *Key) PublicName() string {
+	return k.Name + ".pub"
+}
+
+// PublicKeyPEM returns the public key, PEM encoded as in /etc/apk/keys.
+func (k *Key) PublicKeyPEM() []byte {
+	der, err := x509.MarshalPKIXPublicKey(&k.PrivateKey.PublicKey)
+	if err != nil {
+		// an RSA public key always marshals
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// PrivateKeyPEM returns the private key, PEM encoded as the signing keys given to go-apk, such as
+// to UpdateIndexFile.
+func (k *Key) PrivateKeyPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k.PrivateKey)})
+}
+
+// Keys returns the public key by name, as the trusted keys given to GetRepositoryIndexes and
+// VerifyPackage.
+func (k *Key) Keys() map[string][]byte {
+	return map[string][]byte{k.PublicName(): k.PublicKeyPEM()}
+}
+
+// WriteFiles writes the private key to <dir>/<name> and the public key to <dir>/<name>.pub,
+// returning the path of the private key, for what takes keys by path.
+func (k *Key) WriteFiles(dir string) (string, error) {
+	private := filepath.Join(dir, k.Name)
+	if err := os.WriteFile(private, k.PrivateKeyPEM(), 0o600); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, k.PublicName()), k.PublicKeyPEM(), 0o644); err != nil {
+		return "", err
+	}
+	return private, nil
+}
+
+// signatureSection returns the signature section of a package or index whose signed section is
+// data, a gzipped tar of the signature of its sha1 digest. Like the control section of a package,
+// it has no end of archive, as the sections are read as one tar stream.
+func (k *Key) signatureSection(data []byte) ([]byte, error) {
+	digest := sha1.Sum(data) //nolint:gosec
+	sig, err := k.PrivateKey.Sign(rand.Reader, digest[:], crypto.SHA1)
+	if err != nil {
+		return nil, fmt.Errorf("signing with %s: %w", k.Name, err)
+	}
+	var buf bytes.Buffer
+	if err := writeTarGz(&buf, []entry{{name: ".SIGN.RSA." + k.PublicName(), content: sig}}, time.Unix(0, 0), false); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apktest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1" //nolint:gosec // apk checksums are sha1
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// Package is a package to build: its metadata, as in its .PKGINFO, and its contents.
+type Package struct {
+	repository.Package
+	// Files are the contents of the regular files of the package, by path, such as "usr/bin/foo".
+	// Their directories are added.
+	Files map[string]string
+	// Symlinks are the targets of the symlinks of the package, by path.
+	Symlinks map[string]string
+	// Scripts are the contents of the scripts of the package, by name, such as ".post-install".
+	Scripts map[string]string
+}
+
+// entry is a file of a tar.
+type entry struct {
+	name     string
+	content  []byte
+	typeflag byte
+	linkname string
+	mode     int64
+	pax      map[string]string
+}
+
+// Build builds the .apk file of the package, signed with the key, if it is not nil. It returns the
+// file, and the package as an index lists it, with its size, checksum and datahash. The package has
+// no build date unless its BuildTime is set, and the files and directories of the package have that
+// time, so that packages of the same contents are built the same.
+func (p *Package) Build(key *Key) ([]byte, *repository.Package, error) {
+	if p.Name == "" || p.Version == "" {
+		return nil, nil, errors.New("a package needs a name and a version")
+	}
+	modTime := time.Unix(0, 0)
+	if !p.BuildTime.IsZero() {
+		modTime = p.BuildTime
+	}
+
+	var data bytes.Buffer
+	entries, installedSize := p.dataEntries()
+	if err := writeTarGz(&data, entries, modTime, true); err != nil {
+		return nil, nil, err
+	}
+	datahash := sha256.Sum256(data.Bytes())
+
+	indexed := p.Package
+	indexed.InstalledSize = installedSize
+	indexed.DataHash = hex.EncodeToString(datahash[:])
+	control := []entry{{name: ".PKGINFO", content: []byte(packageInfo(&indexed))}}
+	for _, name := range sortedKeys(p.Scripts) {
+		control = append(control, entry{name: name, content: []byte(p.Scripts[name]), mode: 0o755})
+	}
+	var controlSection bytes.Buffer
+	if err := writeTarGz(&controlSection, control, modTime, false); err != nil {
+		return nil, nil, err
+	}
+
+	var apk []byte
+	if key != nil {
+		sig, err := key.signatureSection(controlSection.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+		apk = append(apk, sig...)
+	}
+	apk = append(apk, controlSection.Bytes()...)
+	apk = append(apk, data.Bytes()...)
+
+	controlHash := sha1.Sum(controlSection.Bytes()) //nolint:gosec
+	indexed.Checksum = controlHash[:]
+	indexed.Size = uint64(len(apk))
+	return apk, &indexed, nil
+}
+
+// dataEntries returns the entries of the data section, directories first, and the installed size of
+// the files.
+func (p *Package) dataEntries() ([]entry, uint64) {
+	dirs := map[string]bool{}
+	var entries []entry
+	var size uint64
+	addDirs := func(name string) {
+		for i := range name {
+			if name[i] == '/' && !dirs[name[:i]] {
+				dirs[name[:i]] = true
+				entries = append(entries, entry{name: name[:i] + "/", typeflag: tar.TypeDir, mode: 0o755})
+			}
+		}
+	}
+	names := append(sortedKeys(p.Files), sortedKeys(p.Symlinks)...)
+	sort.Strings(names)
+	for _, name := range names {
+		addDirs(name)
+		if target, ok := p.Symlinks[name]; ok {
+			sum := sha1.Sum([]byte(target)) //nolint:gosec
+			entries = append(entries, entry{name: name, typeflag: tar.TypeSymlink, linkname: target, mode: 0o777, pax: checksumRecords(sum[:])})
+			continue
+		}
+		sum := sha1.Sum([]byte(p.Files[name])) //nolint:gosec
+		entries = append(entries, entry{name: name, content: []byte(p.Files[name]), mode: 0o644, pax: checksumRecords(sum[:])})
+		size += uint64(len(p.Files[name]))
+	}
+	return entries, size
+}
+
+// checksumRecords returns the PAX records of the sha1 of the contents of a file, or of the target of
+// a symlink, as apk-tools records it in the headers of the data section.
+func checksumRecords(sum []byte) map[string]string {
+	return map[string]string{"APK-TOOLS.checksum.SHA1": hex.EncodeToString(sum)}
+}
+
+// packageInfo returns the .PKGINFO of the package.
+func packageInfo(pkg *repository.Package) string {
+	lines := []string{
+		"pkgname = " + pkg.Name,
+		"pkgver = " + pkg.Version,
+	}
+	add := func(key, value string) {
+		if value != "" {
+			lines = append(lines, key+" = "+value)
+		}
+	}
+	add("pkgdesc", pkg.Description)
+	add("url", pkg.URL)
+	if !pkg.BuildTime.IsZero() {
+		add("builddate", strconv.FormatInt(pkg.BuildTime.Unix(), 10))
+	}
+	add("maintainer", pkg.Maintainer)
+	add("size", strconv.FormatUint(pkg.InstalledSize, 10))
+	add("arch", pkg.Arch)
+	add("origin", pkg.Origin)
+	add("commit", pkg.RepoCommit)
+	add("license", pkg.License)
+	add("replaces", pkg.Replaces)
+	if pkg.ProviderPriority != 0 {
+		add("provider_priority", strconv.FormatUint(pkg.ProviderPriority, 10))
+	}
+	for _, dep := range pkg.Dependencies {
+		add("depend", dep)
+	}
+	for _, provided := range pkg.Provides {
+		add("provides", provided)
+	}
+	add("install_if", strings.Join(pkg.InstallIf, " "))
+	add("datahash", pkg.DataHash)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// writeTarGz writes the entries as a gzipped tar of the time, with an end of archive if closeTar is
+// set.
+func writeTarGz(w io.Writer, entries []entry, modTime time.Time, closeTar bool) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     e.mode,
+			Size:     int64(len(e.content)),
+			ModTime:  modTime,
+			Uname:    "root",
+			Gname:    "root",
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		hdr.PAXRecords = e.pax
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing %s: %w", e.name, err)
+		}
+		if _, err := tw.Write(e.content); err != nil {
+			return fmt.Errorf("writing %s: %w", e.name, err)
+		}
+	}
+	if closeTar {
+		if err := tw.Close(); err != nil {
+			return err
+		}
+	} else if err := tw.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
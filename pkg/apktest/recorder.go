@@ -0,0 +1,214 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apktest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Mode is whether a Recorder records or replays.
+type Mode int
+
+const (
+	// Replay serves the recorded responses, failing requests that were not recorded.
+	Replay Mode = iota
+	// Record makes the requests and records their responses, replacing any recorded before.
+	Record
+	// ReplayOrRecord serves the recorded responses, and makes and records the requests that were not
+	// recorded.
+	ReplayOrRecord
+)
+
+// RecordEnv is the environment variable that ModeFromEnv reads: "record" to record, "missing" to
+// record what was not, and anything else to replay.
+const RecordEnv = "GOAPK_RECORD"
+
+// ModeFromEnv returns the mode set by RecordEnv, so that tests replay unless they are run with
+// GOAPK_RECORD=record, to record them against the real mirrors once.
+func ModeFromEnv() Mode {
+	switch os.Getenv(RecordEnv) {
+	case "record":
+		return Record
+	case "missing":
+		return ReplayOrRecord
+	}
+	return Replay
+}
+
+// recording is a recorded response, as kept in the cassette directory.
+type recording struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// Recorder is an http.RoundTripper that records the responses to the requests made through it in a
+// directory, the cassette, as one file per method and URL, or replays them from it, so that tests of
+// repositories are hermetic and fast. Requests are told apart by their method and URL only.
+type Recorder struct {
+	dir       string
+	mode      Mode
+	transport http.RoundTripper
+	mu        sync.Mutex
+}
+
+// NewRecorder returns a Recorder of the cassette dir, which when recording makes the requests with
+// the transport, or http.DefaultTransport if it is nil.
+func NewRecorder(dir string, mode Mode, transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{dir: dir, mode: mode, transport: transport}
+}
+
+// Client returns a client that makes its requests through the recorder, such as to set with
+// APK.SetClient or WithHTTPClient.
+func (r *Recorder) Client() *http.Client {
+	return &http.Client{Transport: r}
+}
+
+// RoundTrip replays or records the response to the request, as the mode of the recorder.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	file := filepath.Join(r.dir, recordingName(req.Method, req.URL.String()))
+	if r.mode != Record {
+		rec, err := readRecording(file)
+		if err == nil {
+			return rec.response(req), nil
+		}
+		if r.mode == Replay || !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("replaying %s %s: %w", req.Method, req.URL, err)
+		}
+	}
+
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("recording %s %s: %w", req.Method, req.URL, err)
+	}
+	rec := &recording{Method: req.Method, URL: req.URL.String(), StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := writeRecording(file, rec); err != nil {
+		return nil, fmt.Errorf("recording %s %s: %w", req.Method, req.URL, err)
+	}
+	return rec.response(req), nil
+}
+
+// NewReplayServer starts an https server of the responses recorded in the cassette dir, by the method,
+// path and query of their URL, whatever its host, so that repositories recorded from real mirrors
+// are served from the server's URL instead, to its Client. Requests that were not recorded are 404.
+// The caller closes the server.
+func NewReplayServer(dir string) (*httptest.Server, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	recordings := map[string]*recording{}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		rec, err := readRecording(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		u, err := url.Parse(rec.URL)
+		if err != nil {
+			return nil, fmt.Errorf("recording %s: %w", e.Name(), err)
+		}
+		recordings[rec.Method+" "+u.RequestURI()] = rec
+	}
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec, ok := recordings[req.Method+" "+req.URL.RequestURI()]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		for k, v := range rec.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.StatusCode)
+		_, _ = w.Write(rec.Body)
+	})), nil
+}
+
+func (rec *recording) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.StatusCode, http.StatusText(rec.StatusCode)),
+		StatusCode:    rec.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(rec.Body)),
+		ContentLength: int64(len(rec.Body)),
+		Request:       req,
+	}
+}
+
+// recordingName returns the file name of the recording of the method and URL, its digest, ending
+// with the last element of the URL path so that the cassette can be told apart by eye.
+func recordingName(method, u string) string {
+	sum := sha256.Sum256([]byte(method + " " + u))
+	base := u
+	if parsed, err := url.Parse(u); err == nil {
+		base = parsed.Path
+	}
+	base = base[strings.LastIndex(base, "/")+1:]
+	return hex.EncodeToString(sum[:8]) + "-" + base + ".json"
+}
+
+func readRecording(file string) (*recording, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rec recording
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	return &rec, nil
+}
+
+func writeRecording(file string, rec *recording) error {
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, b, 0o644)
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apktest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+// mirrorTransport serves an index as a mirror would, counting the requests.
+type mirrorTransport struct {
+	index    []byte
+	requests int
+}
+
+func (m *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.requests++
+	if req.URL.Path != "/alpine/main/x86_64/APKINDEX.tar.gz" {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody, Request: req}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(m.index)), Request: req}, nil
+}
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	key, err := NewKey("test.rsa")
+	require.NoError(t, err)
+	repo := NewRepository("main", key)
+	_, err = repo.Add(&Package{Package: repository.Package{Name: "hello", Version: "1.0-r0", Arch: "x86_64"}})
+	require.NoError(t, err)
+	index, err := repo.Index()
+	require.NoError(t, err)
+
+	const mirror = "https://mirror.example.com/alpine/main"
+	cassette := t.TempDir()
+	upstream := &mirrorTransport{index: index}
+	fetch := func(rec *Recorder) error {
+		_, err := apk.GetRepositoryIndexes(ctx, []string{mirror}, key.Keys(), "x86_64", apk.WithHTTPClient(rec.Client()))
+		return err
+	}
+
+	require.NoError(t, fetch(NewRecorder(cassette, Record, upstream)))
+	require.Equal(t, 1, upstream.requests)
+
+	// replayed without the mirror
+	require.NoError(t, fetch(NewRecorder(cassette, Replay, upstream)))
+	require.Equal(t, 1, upstream.requests)
+
+	// what was not recorded fails, or is recorded
+	_, err = NewRecorder(cassette, Replay, upstream).Client().Get(mirror + "/aarch64/APKINDEX.tar.gz")
+	require.ErrorContains(t, err, "replaying GET")
+	resp, err := NewRecorder(cassette, ReplayOrRecord, upstream).Client().Get(mirror + "/aarch64/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, 2, upstream.requests)
+
+	// and served from elsewhere
+	srv, err := NewReplayServer(cassette)
+	require.NoError(t, err)
+	defer srv.Close()
+	indexes, err := apk.GetRepositoryIndexes(ctx, []string{srv.URL + "/alpine/main"}, key.Keys(), "x86_64", apk.WithHTTPClient(srv.Client()))
+	require.NoError(t, err)
+	require.Equal(t, 1, indexes[0].Count())
+}
@@ -0,0 +1,143 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apktest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+// Repository is a repository of packages built in memory, whose index and packages are signed with
+// its key, if it has one.
+type Repository struct {
+	// Description is the DESCRIPTION of its index.
+	Description string
+	// Key signs the index and the packages, if it is not nil.
+	Key *Key
+
+	// files are the .apk files of the packages, by file name
+	files   map[string][]byte
+	indexed []*repository.Package
+}
+
+// NewRepository returns an empty repository signed with the key, which may be nil.
+func NewRepository(description string, key *Key) *Repository {
+	return &Repository{Description: description, Key: key, files: map[string][]byte{}}
+}
+
+// Add builds the packages and adds them to the repository, replacing any of the same name and
+// version. It returns them as the index lists them.
+func (r *Repository) Add(pkgs ...*Package) ([]*repository.Package, error) {
+	added := make([]*repository.Package, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		file, indexed, err := pkg.Build(r.Key)
+		if err != nil {
+			return nil, fmt.Errorf("building %s-%s: %w", pkg.Name, pkg.Version, err)
+		}
+		if _, ok := r.files[indexed.Filename()]; ok {
+			for i, p := range r.indexed {
+				if p.Filename() == indexed.Filename() {
+					r.indexed = append(r.indexed[:i], r.indexed[i+1:]...)
+					break
+				}
+			}
+		}
+		r.files[indexed.Filename()] = file
+		r.indexed = append(r.indexed, indexed)
+		added = append(added, indexed)
+	}
+	return added, nil
+}
+
+// Packages returns the packages of the repository as its index lists them, sorted by name.
+func (r *Repository) Packages() []*repository.Package {
+	pkgs := append([]*repository.Package(nil), r.indexed...)
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return pkgs[i].Name < pkgs[j].Name
+	})
+	return pkgs
+}
+
+// Package returns the .apk file of the package, by its file name, such as "foo-1.0-r0.apk".
+func (r *Repository) Package(filename string) ([]byte, bool) {
+	b, ok := r.files[filename]
+	return b, ok
+}
+
+// Index returns the APKINDEX.tar.gz of the repository, signed with its key, if it has one.
+func (r *Repository) Index() ([]byte, error) {
+	var index bytes.Buffer
+	if err := apk.WriteIndexArchive(&index, r.Description, r.Packages()); err != nil {
+		return nil, err
+	}
+	if r.Key == nil {
+		return index.Bytes(), nil
+	}
+	sig, err := r.Key.signatureSection(index.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return append(sig, index.Bytes()...), nil
+}
+
+// WriteDir writes the repository to <dir>/<arch>, as an Alpine repository is laid out: its index and
+// the .apk files of its packages. It is there for the repository <dir>, with the architecture of the
+// root, or at <dir> with FlatLayout for arch "".
+func (r *Repository) WriteDir(dir, arch string) error {
+	dir = filepath.Join(dir, arch)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	index, err := r.Index()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "APKINDEX.tar.gz"), index, 0o644); err != nil {
+		return err
+	}
+	for name, b := range r.files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MemoryRepository returns the repository as an apk.MemoryRepository of the URI, pinned to name if
+// it is not empty, for WithMemoryRepositories, with no files written.
+func (r *Repository) MemoryRepository(name, uri string) (*apk.MemoryRepository, error) {
+	index, err := r.Index()
+	if err != nil {
+		return nil, err
+	}
+	return apk.NewMemoryRepository(name, uri, bytes.NewReader(index), r.lookup)
+}
+
+func (r *Repository) lookup(_ context.Context, pkg *repository.RepositoryPackage) (io.ReadCloser, error) {
+	b, ok := r.files[pkg.Filename()]
+	if !ok {
+		return nil, fmt.Errorf("no package %s in the repository", pkg.Filename())
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
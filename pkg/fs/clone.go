@@ -0,0 +1,130 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CloneMode is how CloneFS gives one of its files the content of a file on disk without copying it.
+type CloneMode int
+
+const (
+	// NoClone copies the content, as WriteHeader does.
+	NoClone CloneMode = iota
+	// Reflink shares the blocks of the file on disk, copy on write, so that the two files are
+	// separate but only take space once, on filesystems that support it, such as btrfs and XFS.
+	Reflink
+	// Hardlink makes the two the same file, so that writing to either changes both, as does
+	// setting their mode, ownership or times.
+	Hardlink
+)
+
+// ErrCloneUnsupported is returned by CloneFS for clones that the platform or the filesystem wrapped
+// does not support.
+var ErrCloneUnsupported = errors.New("cloning files is not supported")
+
+func (m CloneMode) String() string {
+	switch m {
+	case NoClone:
+		return ""
+	case Reflink:
+		return "reflink"
+	case Hardlink:
+		return "hardlink"
+	}
+	return fmt.Sprintf("CloneMode(%d)", int(m))
+}
+
+// MarshalText is for configurations, where the mode is reflink, hardlink or empty.
+func (m CloneMode) MarshalText() ([]byte, error) {
+	if m < NoClone || m > Hardlink {
+		return nil, fmt.Errorf("unknown clone mode %d", int(m))
+	}
+	return []byte(m.String()), nil
+}
+
+func (m *CloneMode) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "", "copy":
+		*m = NoClone
+	case "reflink":
+		*m = Reflink
+	case "hardlink":
+		*m = Hardlink
+	default:
+		return fmt.Errorf("unknown clone mode %q, not reflink or hardlink", b)
+	}
+	return nil
+}
+
+// CloneFS is a FullFS on disk that can create its files from files on disk, as DirFS can.
+type CloneFS interface {
+	FullFS
+	// CloneFile creates the regular file name, which must not exist, with the content of the file
+	// src, a path on disk, by mode. It fails, with nothing created, where the mode is not supported,
+	// as across filesystems, or for names that are not on disk.
+	CloneFile(src, name string, mode CloneMode) error
+}
+
+// CloneHeader is WriteHeader for a regular file whose content is that of the file src on disk,
+// which fsys clones by mode, if it is a CloneFS that can, or else copies. The mode, ownership,
+// xattrs and times are then set as WriteHeader sets them, which for hardlinks sets them on src too.
+// It returns whether the file was cloned.
+func CloneHeader(fsys FullFS, header *tar.Header, src string, mode CloneMode) (bool, error) {
+	if header.Typeflag != tar.TypeReg {
+		return false, fmt.Errorf("cannot clone %s, which is not a regular file", header.Name)
+	}
+	if cfs, ok := fsys.(CloneFS); ok && mode != NoClone {
+		if err := cfs.CloneFile(src, header.Name, mode); err == nil {
+			return true, setHeaderMetadata(fsys, header)
+		}
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return false, WriteHeader(fsys, header, f)
+}
+
+func (f *dirFS) CloneFile(src, name string, mode CloneMode) error {
+	if !f.createOnDisk(name) {
+		return fmt.Errorf("cannot clone %s, which is not on disk", name)
+	}
+	dst := filepath.Join(f.base, name)
+	switch mode {
+	case Reflink:
+		if err := reflink(src, dst); err != nil {
+			return err
+		}
+	case Hardlink:
+		if err := os.Link(src, dst); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown clone mode %d", int(mode))
+	}
+	file, err := f.overrides.Create(name)
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return file.Close()
+}
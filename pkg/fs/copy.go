@@ -0,0 +1,210 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// permBits are the bits of a mode that Chmod sets.
+const permBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// CopyFS copies the whole tree of src into dst, keeping the modes, ownership, xattrs and times
+// of every entry, the targets of symlinks, and the device numbers of devices; fifos are made anew.
+// Files that are hardlinked in src are hardlinked in dst as well. This is how to write an install
+// done in memory out to disk, or to read one from disk into memory.
+//
+// The root of dst is left as it is. Directories that already exist in dst are reused, and files
+// overwritten, but dst should not already have any other entries of src. Only the targets of
+// symlinks are kept, not their ownership or times.
+func CopyFS(dst, src FullFS) error {
+	c := &copier{dst: dst, src: src, links: map[any]string{}, buf: make([]byte, 1<<20)}
+	return c.copyDir(".")
+}
+
+type copier struct {
+	dst, src FullFS
+	// links are the first path copied of each file in src with hardlinks, by HardlinkID.
+	links map[any]string
+	buf   []byte
+	// shallow copies directories without their children.
+	shallow bool
+}
+
+// copyEntry copies the single entry at path of src into dst, with its metadata, but not the children
+// of a directory. The parent of path must already exist in dst.
+func copyEntry(dst, src FullFS, path string) error {
+	fi, err := src.Lstat(path)
+	if err != nil {
+		return err
+	}
+	c := &copier{dst: dst, src: src, links: map[any]string{}, buf: make([]byte, 32<<10), shallow: true}
+	return c.copyEntry(path, fi)
+}
+
+func (c *copier) copyDir(dir string) error {
+	entries, err := c.src.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("reading directory %s: %w", dir, err)
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		fi, err := c.src.Lstat(path)
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", path, err)
+		}
+		if err := c.copyEntry(path, fi); err != nil {
+			return fmt.Errorf("copying %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (c *copier) copyEntry(path string, fi fs.FileInfo) error {
+	mode := fi.Mode()
+	switch {
+	case mode.IsDir():
+		if err := c.dst.MkdirAll(path, mode.Perm()); err != nil {
+			return err
+		}
+		if !c.shallow {
+			if err := c.copyDir(path); err != nil {
+				return err
+			}
+		}
+	case mode&fs.ModeSymlink != 0:
+		target, err := c.src.Readlink(path)
+		if err != nil {
+			return err
+		}
+		// nothing else is kept for symlinks, as changing it would follow the link on disk
+		return c.dst.Symlink(target, path)
+	default:
+		id, hardlinked := HardlinkID(fi)
+		if hardlinked {
+			if first, ok := c.links[id]; ok {
+				// the metadata is shared with the first link, which already has it
+				return c.dst.Link(first, path)
+			}
+			c.links[id] = path
+		}
+		switch {
+		case mode&fs.ModeNamedPipe != 0:
+			if err := c.dst.Mknod(path, unix.S_IFIFO|uint32(mode.Perm()), 0); err != nil {
+				return err
+			}
+		case mode&fs.ModeDevice != 0:
+			dev, err := c.src.Readnod(path)
+			if err != nil {
+				return err
+			}
+			typ := uint32(unix.S_IFCHR)
+			if mode&fs.ModeCharDevice == 0 {
+				typ = unix.S_IFBLK
+			}
+			if err := c.dst.Mknod(path, typ|uint32(mode.Perm()), dev); err != nil {
+				return err
+			}
+		default:
+			if err := c.copyFile(path, mode); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := c.dst.Chmod(path, mode&permBits); err != nil {
+		return err
+	}
+	if uid, gid, ok := owner(fi); ok {
+		if err := c.dst.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if err := c.copyXattrs(path); err != nil {
+		return err
+	}
+	// last, as writing the children of a directory changes its time
+	atime := fi.ModTime()
+	if h, ok := fi.Sys().(*tar.Header); ok && !h.AccessTime.IsZero() {
+		atime = h.AccessTime
+	}
+	return c.dst.Chtimes(path, atime, fi.ModTime())
+}
+
+func (c *copier) copyFile(path string, mode fs.FileMode) error {
+	in, err := c.src.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := c.dst.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyBuffer(out, in, c.buf); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (c *copier) copyXattrs(path string) error {
+	xattrs, err := c.src.ListXattrs(path)
+	if err != nil {
+		return err
+	}
+	for name, value := range xattrs {
+		if err := c.dst.SetXattr(path, name, value); err != nil {
+			return fmt.Errorf("setting xattr %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// owner returns the uid and gid of the file, if its FileInfo has them.
+func owner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	switch sys := fi.Sys().(type) {
+	case *tar.Header:
+		return sys.Uid, sys.Gid, true
+	case *syscall.Stat_t:
+		return int(sys.Uid), int(sys.Gid), true
+	}
+	return 0, 0, false
+}
+
+// HardlinkID returns what identifies the file of fi, the same whichever of its paths fi is for,
+// and whether it has more than one path at all, so that hardlinks to it can be told apart from
+// copies. It is comparable, for use as a map key, and knows the files of memfs and DirFS, as well
+// as those whose Sys is a *syscall.Stat_t.
+func HardlinkID(fi fs.FileInfo) (any, bool) {
+	switch fi := fi.(type) {
+	case *memFileInfo:
+		return fi.node, fi.linkCount > 0
+	case *fileInfo:
+		return HardlinkID(fi.mem)
+	}
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return [2]uint64{uint64(sys.Dev), sys.Ino}, sys.Nlink > 1 //nolint:unconvert
+	}
+	return nil, false
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyFS(t *testing.T) {
+	mtime := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+	src := NewMemFS()
+	require.NoError(t, src.MkdirAll("etc/conf.d", 0o755))
+	require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, src.Mkdir("dev", 0o755))
+	require.NoError(t, src.WriteFile("etc/conf.d/hello", []byte("greeting=hi"), 0o640))
+	require.NoError(t, src.Chown("etc/conf.d/hello", 1000, 1001))
+	require.NoError(t, src.SetXattr("etc/conf.d/hello", "user.note", []byte("hi")))
+	require.NoError(t, src.WriteFile("usr/bin/hello", []byte("#!/bin/sh\necho hi"), 0o755))
+	require.NoError(t, src.Chmod("usr/bin/hello", 0o755|fs.ModeSetuid))
+	require.NoError(t, src.Link("usr/bin/hello", "usr/bin/hi"))
+	require.NoError(t, src.Symlink("hello", "usr/bin/greet"))
+	require.NoError(t, src.Mknod("dev/null", unix.S_IFCHR|0o666, int(unix.Mkdev(1, 3))))
+	require.NoError(t, src.Chtimes("etc/conf.d/hello", mtime, mtime))
+	require.NoError(t, src.Chtimes("etc/conf.d", mtime, mtime))
+
+	check := func(t *testing.T, fsys FullFS) {
+		b, err := fsys.ReadFile("etc/conf.d/hello")
+		require.NoError(t, err)
+		require.Equal(t, "greeting=hi", string(b))
+		fi, err := fsys.Lstat("etc/conf.d/hello")
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o640), fi.Mode().Perm())
+		require.Equal(t, 1000, fi.Sys().(*tar.Header).Uid)
+		require.Equal(t, 1001, fi.Sys().(*tar.Header).Gid)
+		require.True(t, mtime.Equal(fi.ModTime()), "mtime of %s", fi.ModTime())
+		xattrs, err := fsys.ListXattrs("etc/conf.d/hello")
+		require.NoError(t, err)
+		require.Equal(t, map[string][]byte{"user.note": []byte("hi")}, xattrs)
+
+		fi, err = fsys.Lstat("etc/conf.d")
+		require.NoError(t, err)
+		require.True(t, fi.IsDir())
+		require.True(t, mtime.Equal(fi.ModTime()), "mtime of %s", fi.ModTime())
+
+		fi, err = fsys.Lstat("usr/bin/hello")
+		require.NoError(t, err)
+		require.NotZero(t, fi.Mode()&fs.ModeSetuid)
+		hello, hardlinked := HardlinkID(fi)
+		require.True(t, hardlinked)
+		fi, err = fsys.Lstat("usr/bin/hi")
+		require.NoError(t, err)
+		hi, _ := HardlinkID(fi)
+		require.Equal(t, hello, hi)
+
+		target, err := fsys.Readlink("usr/bin/greet")
+		require.NoError(t, err)
+		require.Equal(t, "hello", target)
+
+		dev, err := fsys.Readnod("dev/null")
+		require.NoError(t, err)
+		require.Equal(t, int(unix.Mkdev(1, 3)), dev)
+	}
+
+	disk := DirFS(t.TempDir())
+	require.NoError(t, CopyFS(disk, src))
+	check(t, disk)
+
+	back := NewMemFS()
+	require.NoError(t, CopyFS(back, disk))
+	check(t, back)
+}
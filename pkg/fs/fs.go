@@ -16,6 +16,7 @@ package fs
 import (
 	"io"
 	"io/fs"
+	"time"
 )
 
 // FullFS is a filesystem that supports all filesystem operations.
@@ -39,10 +40,12 @@ type FullFS interface {
 	Remove(name string) error
 	Chmod(path string, perm fs.FileMode) error
 	Chown(path string, uid int, gid int) error
+	Chtimes(path string, atime time.Time, mtime time.Time) error
 	SetXattr(path string, attr string, data []byte) error
 	GetXattr(path string, attr string) ([]byte, error)
 	RemoveXattr(path string, attr string) error
 	ListXattrs(path string) (map[string][]byte, error)
+	StatFS() (Capacity, error)
 }
 
 // File is an interface for a file. It includes Read, Write, Close.
@@ -54,6 +57,18 @@ type File interface {
 	io.ReaderAt
 }
 
+// Capacity is the space of the filesystem that a FullFS is on, in bytes, as statfs(2) reports it.
+type Capacity struct {
+	// Total is the size of the filesystem.
+	Total uint64
+	// Used is the space that is used, by everything on the filesystem, not only the FullFS.
+	Used uint64
+	// Free is the space that is not used, including any reserved for the superuser.
+	Free uint64
+	// Available is the space that unprivileged users can write to.
+	Available uint64
+}
+
 type ReadLinkFS interface {
 	fs.FS
 	Readlink(name string) (string, error)
@@ -0,0 +1,283 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JournalFS is a FullFS that keeps what each entry of the filesystem it wraps was like before it is
+// first changed through it, or that it did not exist, so that all the changes made through it can be
+// undone with Rollback. This is how go-apk installs into several roots at once, all or nothing.
+//
+// The entries are kept in memory, with the whole content of the regular files among them, so that
+// replacing large files costs as much memory. Files that were hardlinked are put back as copies, and
+// the root itself is left as it is.
+type JournalFS struct {
+	FullFS
+
+	mu sync.Mutex
+	// saved holds the entries as they were before they were changed, and touched has every entry
+	// changed, with whether it existed.
+	saved   FullFS
+	touched map[string]bool
+}
+
+// NewJournalFS returns fsys, keeping what is changed through it to be undone with Rollback.
+func NewJournalFS(fsys FullFS) *JournalFS {
+	return &JournalFS{FullFS: fsys, saved: NewMemFS(), touched: map[string]bool{}}
+}
+
+// journalPath returns the path as the journal keeps it, relative to the root, or "" for the root.
+func journalPath(path string) string {
+	path = strings.TrimPrefix(filepath.Clean(path), "/")
+	if path == "." {
+		return ""
+	}
+	return path
+}
+
+// save records the entry at path as it is, if it is the first time it is changed.
+func (j *JournalFS) save(path string) error {
+	path = journalPath(path)
+	if path == "" {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.touched[path]; ok {
+		return nil
+	}
+	if _, err := j.FullFS.Lstat(path); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		j.touched[path] = false
+		return nil
+	}
+	if err := j.saved.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := copyEntry(j.saved, j.FullFS, path); err != nil {
+		return fmt.Errorf("saving %s to the journal: %w", path, err)
+	}
+	j.touched[path] = true
+	return nil
+}
+
+// saveEntry records the entry at path and the directory it is in, for those that add or remove it.
+func (j *JournalFS) saveEntry(path string) error {
+	if err := j.save(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return j.save(path)
+}
+
+func (j *JournalFS) Mkdir(path string, perm fs.FileMode) error {
+	if err := j.saveEntry(path); err != nil {
+		return err
+	}
+	return j.FullFS.Mkdir(path, perm)
+}
+
+func (j *JournalFS) MkdirAll(path string, perm fs.FileMode) error {
+	// the parent of each directory is saved before it
+	parts := strings.Split(journalPath(path), "/")
+	for i := range parts {
+		if err := j.save(strings.Join(parts[:i+1], "/")); err != nil {
+			return err
+		}
+	}
+	return j.FullFS.MkdirAll(path, perm)
+}
+
+func (j *JournalFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if err := j.saveEntry(name); err != nil {
+			return nil, err
+		}
+	}
+	return j.FullFS.OpenFile(name, flag, perm)
+}
+
+func (j *JournalFS) Create(name string) (File, error) {
+	return j.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
+}
+
+func (j *JournalFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
+	if err := j.saveEntry(name); err != nil {
+		return err
+	}
+	return j.FullFS.WriteFile(name, b, mode)
+}
+
+func (j *JournalFS) Mknod(path string, mode uint32, dev int) error {
+	if err := j.saveEntry(path); err != nil {
+		return err
+	}
+	return j.FullFS.Mknod(path, mode, dev)
+}
+
+func (j *JournalFS) Symlink(oldname, newname string) error {
+	if err := j.saveEntry(newname); err != nil {
+		return err
+	}
+	return j.FullFS.Symlink(oldname, newname)
+}
+
+func (j *JournalFS) Link(oldname, newname string) error {
+	if err := j.saveEntry(newname); err != nil {
+		return err
+	}
+	return j.FullFS.Link(oldname, newname)
+}
+
+func (j *JournalFS) Remove(name string) error {
+	if err := j.saveEntry(name); err != nil {
+		return err
+	}
+	return j.FullFS.Remove(name)
+}
+
+func (j *JournalFS) Chmod(path string, perm fs.FileMode) error {
+	if err := j.save(path); err != nil {
+		return err
+	}
+	return j.FullFS.Chmod(path, perm)
+}
+
+func (j *JournalFS) Chown(path string, uid, gid int) error {
+	if err := j.save(path); err != nil {
+		return err
+	}
+	return j.FullFS.Chown(path, uid, gid)
+}
+
+func (j *JournalFS) Chtimes(path string, atime, mtime time.Time) error {
+	if err := j.save(path); err != nil {
+		return err
+	}
+	return j.FullFS.Chtimes(path, atime, mtime)
+}
+
+func (j *JournalFS) SetXattr(path, attr string, data []byte) error {
+	if err := j.save(path); err != nil {
+		return err
+	}
+	return j.FullFS.SetXattr(path, attr, data)
+}
+
+func (j *JournalFS) RemoveXattr(path, attr string) error {
+	if err := j.save(path); err != nil {
+		return err
+	}
+	return j.FullFS.RemoveXattr(path, attr)
+}
+
+// Rollback undoes every change made through the JournalFS, removing the entries that were created and
+// putting back those that were changed or removed as they were, then forgets them, for the JournalFS
+// to be used again. It goes on through errors, which are all returned.
+func (j *JournalFS) Rollback() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	paths := make([]string, 0, len(j.touched))
+	for path := range j.touched {
+		paths = append(paths, path)
+	}
+	depth := func(path string) int { return strings.Count(path, "/") }
+	// the deepest first, so that directories are empty by the time they are removed
+	sort.Slice(paths, func(a, b int) bool {
+		if da, db := depth(paths[a]), depth(paths[b]); da != db {
+			return da > db
+		}
+		return paths[a] < paths[b]
+	})
+
+	var errs []error
+	isDir := func(fsys FullFS, path string) (exists, dir bool) {
+		fi, err := fsys.Lstat(path)
+		if err != nil {
+			return false, false
+		}
+		return true, fi.IsDir()
+	}
+	// first remove what was created, and what is not the directory it was
+	for _, path := range paths {
+		exists, dir := isDir(j.FullFS, path)
+		if !exists {
+			continue
+		}
+		_, wasDir := isDir(j.saved, path)
+		if !j.touched[path] || !dir || !wasDir {
+			if err := j.FullFS.Remove(path); err != nil {
+				errs = append(errs, fmt.Errorf("removing %s: %w", path, err))
+			}
+		}
+	}
+	// then put back what there was, the shallowest first, so that parents are there for their children
+	for i := len(paths) - 1; i >= 0; i-- {
+		path := paths[i]
+		if !j.touched[path] {
+			continue
+		}
+		if err := j.restore(path); err != nil {
+			errs = append(errs, fmt.Errorf("restoring %s: %w", path, err))
+		}
+	}
+	// and last the directories again, whose times changed as their children were put back
+	for _, path := range paths {
+		if _, wasDir := isDir(j.saved, path); wasDir && j.touched[path] {
+			if err := copyEntry(j.FullFS, j.saved, path); err != nil {
+				errs = append(errs, fmt.Errorf("restoring %s: %w", path, err))
+			}
+		}
+	}
+
+	j.saved = NewMemFS()
+	j.touched = map[string]bool{}
+	return errors.Join(errs...)
+}
+
+// restore puts back the entry at path as it was saved, removing the xattrs it did not have.
+func (j *JournalFS) restore(path string) error {
+	if _, err := j.FullFS.Lstat(path); err == nil {
+		xattrs, err := j.FullFS.ListXattrs(path)
+		if err != nil {
+			return err
+		}
+		saved, err := j.saved.ListXattrs(path)
+		if err != nil {
+			return err
+		}
+		for attr := range xattrs {
+			if _, ok := saved[attr]; ok {
+				continue
+			}
+			if err := j.FullFS.RemoveXattr(path, attr); err != nil {
+				return err
+			}
+		}
+	}
+	return copyEntry(j.FullFS, j.saved, path)
+}
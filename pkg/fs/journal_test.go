@@ -0,0 +1,102 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalFS(t *testing.T) {
+	mtime := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+	// describe returns every entry of the tree, with what rolling back must put back
+	describe := func(t *testing.T, fsys FullFS) map[string]string {
+		entries := map[string]string{}
+		var walk func(dir string)
+		walk = func(dir string) {
+			des, err := fsys.ReadDir(dir)
+			require.NoError(t, err)
+			for _, de := range des {
+				path := filepath.Join(dir, de.Name())
+				fi, err := fsys.Lstat(path)
+				require.NoError(t, err)
+				xattrs, err := fsys.ListXattrs(path)
+				require.NoError(t, err)
+				desc := fmt.Sprintf("%s %s %v", fi.Mode(), fi.ModTime().UTC(), xattrs)
+				switch {
+				case fi.IsDir():
+					walk(path)
+				case fi.Mode()&fs.ModeSymlink != 0:
+					target, err := fsys.Readlink(path)
+					require.NoError(t, err)
+					desc = "-> " + target
+				default:
+					b, err := fsys.ReadFile(path)
+					require.NoError(t, err)
+					desc += " " + string(b)
+				}
+				entries[path] = desc
+			}
+		}
+		walk(".")
+		return entries
+	}
+
+	for name, newFS := range map[string]func(t *testing.T) FullFS{
+		"memfs": func(*testing.T) FullFS { return NewMemFS() },
+		"dirfs": func(t *testing.T) FullFS { return DirFS(t.TempDir()) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			fsys := newFS(t)
+			require.NoError(t, fsys.MkdirAll("etc/conf.d", 0o755))
+			require.NoError(t, fsys.WriteFile("etc/conf.d/hello", []byte("old"), 0o644))
+			require.NoError(t, fsys.WriteFile("etc/keep", []byte("keep"), 0o600))
+			require.NoError(t, fsys.Symlink("conf.d/hello", "etc/hello"))
+			for _, path := range []string{"etc/conf.d/hello", "etc/keep", "etc/conf.d", "etc"} {
+				require.NoError(t, fsys.Chtimes(path, mtime, mtime))
+			}
+			before := describe(t, fsys)
+
+			j := NewJournalFS(fsys)
+			require.NoError(t, j.WriteFile("etc/conf.d/hello", []byte("new"), 0o644))
+			require.NoError(t, j.Chmod("etc/conf.d/hello", 0o600))
+			require.NoError(t, j.SetXattr("etc/conf.d", "user.note", []byte("hi")))
+			require.NoError(t, j.Remove("etc/hello"))
+			require.NoError(t, j.Mkdir("etc/hello", 0o700))
+			require.NoError(t, j.MkdirAll("usr/share/hello", 0o755))
+			f, err := j.Create("usr/share/hello/file")
+			require.NoError(t, err)
+			_, err = f.Write([]byte("file"))
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+			require.NoError(t, j.Link("usr/share/hello/file", "etc/link"))
+			require.NoError(t, j.Remove("etc/keep"))
+			require.NotEqual(t, before, describe(t, fsys))
+
+			require.NoError(t, j.Rollback())
+			require.Equal(t, before, describe(t, fsys))
+
+			// the journal starts again after rolling back
+			require.NoError(t, j.WriteFile("etc/new", []byte("new"), 0o644))
+			require.NoError(t, j.Rollback())
+			require.Equal(t, before, describe(t, fsys))
+		})
+	}
+}
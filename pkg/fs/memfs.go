@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -54,6 +55,38 @@ func NewMemFS() FullFS {
 	}
 }
 
+// StatFS returns the capacity of the filesystem in memory, which is unlimited, with the size of the
+// contents of its files used.
+func (m *memFS) StatFS() (Capacity, error) {
+	used := m.tree.dataSize(map[*node]bool{})
+	return Capacity{
+		Total:     math.MaxUint64,
+		Used:      used,
+		Free:      math.MaxUint64 - used,
+		Available: math.MaxUint64 - used,
+	}, nil
+}
+
+// dataSize returns the size of the contents of the node and everything under it, counting each
+// node once however many links there are to it.
+func (n *node) dataSize(seen map[*node]bool) uint64 {
+	if seen[n] {
+		return 0
+	}
+	seen[n] = true
+	n.mu.Lock()
+	size := uint64(len(n.data))
+	children := make([]*node, 0, len(n.children))
+	for _, child := range n.children {
+		children = append(children, child)
+	}
+	n.mu.Unlock()
+	for _, child := range children {
+		size += child.dataSize(seen)
+	}
+	return size
+}
+
 // getNode returns the node for the given path. If the path is not found, it
 // returns an error.
 func (m *memFS) getNode(path string) (*node, error) {
@@ -156,10 +189,21 @@ func (m *memFS) Stat(path string) (fs.FileInfo, error) {
 }
 
 func (m *memFS) Lstat(path string) (fs.FileInfo, error) {
-	node, err := m.getNode(path)
+	// resolve links in the parents, but not in the last element
+	base := filepath.Base(path)
+	if path == "/" || path == "." || base == "/" {
+		return m.tree.fileInfo(path), nil
+	}
+	parentNode, err := m.getNode(filepath.Dir(path))
 	if err != nil {
 		return nil, err
 	}
+	parentNode.mu.Lock()
+	defer parentNode.mu.Unlock()
+	node, ok := parentNode.children[base]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
 	return node.fileInfo(path), nil
 }
 
@@ -333,7 +377,7 @@ func (m *memFS) Mknod(path string, mode uint32, dev int) error {
 	}
 	anode.children[base] = &node{
 		name:       base,
-		mode:       fs.FileMode(mode) | os.ModeCharDevice | os.ModeDevice,
+		mode:       nodMode(mode),
 		modTime:    time.Now(),
 		createTime: time.Now(),
 		major:      unix.Major(uint64(dev)),
@@ -344,6 +388,29 @@ func (m *memFS) Mknod(path string, mode uint32, dev int) error {
 	return nil
 }
 
+// nodMode returns the mode of a node made by Mknod with mode, whose type is one of the S_IF* of
+// mknod(2): a block device, a fifo, or else a character device, as all nodes were before.
+func nodMode(mode uint32) fs.FileMode {
+	perm := fs.FileMode(mode).Perm()
+	if mode&unix.S_ISUID != 0 {
+		perm |= fs.ModeSetuid
+	}
+	if mode&unix.S_ISGID != 0 {
+		perm |= fs.ModeSetgid
+	}
+	if mode&unix.S_ISVTX != 0 {
+		perm |= fs.ModeSticky
+	}
+	switch mode & unix.S_IFMT {
+	case unix.S_IFBLK:
+		return perm | fs.ModeDevice
+	case unix.S_IFIFO:
+		return perm | fs.ModeNamedPipe
+	default:
+		return perm | fs.ModeDevice | fs.ModeCharDevice
+	}
+}
+
 func (m *memFS) Readnod(path string) (dev int, err error) {
 	parent := filepath.Dir(path)
 	base := filepath.Base(path)
@@ -357,7 +424,7 @@ func (m *memFS) Readnod(path string) (dev int, err error) {
 	if !ok {
 		return 0, os.ErrNotExist
 	}
-	if anode.mode&os.ModeDevice != os.ModeDevice || anode.mode&os.ModeCharDevice != os.ModeCharDevice {
+	if anode.mode&os.ModeDevice != os.ModeDevice {
 		return 0, fmt.Errorf("not a device")
 	}
 	return int(unix.Mkdev(anode.major, anode.minor)), nil
@@ -382,6 +449,17 @@ func (m *memFS) Chown(path string, uid, gid int) error {
 	return nil
 }
 
+// Chtimes changes the access and modification times of the file at path, to the nanosecond.
+func (m *memFS) Chtimes(path string, atime, mtime time.Time) error {
+	anode, err := m.getNode(path)
+	if err != nil {
+		return err
+	}
+	anode.accessTime = atime
+	anode.modTime = mtime
+	return nil
+}
+
 func (m *memFS) Create(name string) (File, error) {
 	return m.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
 }
@@ -625,6 +703,7 @@ type node struct {
 	name         string
 	data         []byte
 	modTime      time.Time
+	accessTime   time.Time // only set by Chtimes, it is the modTime until then
 	createTime   time.Time
 	linkTarget   string
 	linkCount    int // extra links, so 0 means a single pointer. O-based, like most compuuter counting systems.
@@ -662,9 +741,15 @@ func (m *memFileInfo) IsDir() bool {
 	return m.dir
 }
 func (m *memFileInfo) Sys() any {
+	atime := m.accessTime
+	if atime.IsZero() {
+		atime = m.modTime
+	}
 	return &tar.Header{
-		Mode: int64(m.mode),
-		Uid:  m.uid,
-		Gid:  m.gid,
+		Mode:       int64(m.mode),
+		Uid:        m.uid,
+		Gid:        m.gid,
+		ModTime:    m.modTime,
+		AccessTime: atime,
 	}
 }
@@ -1,12 +1,15 @@
 package fs
 
 import (
+	"archive/tar"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 type testDirEntry struct {
@@ -206,6 +209,13 @@ func TestMemFSSymlink(t *testing.T) {
 	actualTarget, err := m.Readlink(link)
 	require.NoError(t, err, "error reading target of link file %s", link)
 	require.Equal(t, target, actualTarget, "target of %s should be %s", link, target)
+	// Lstat describes the link itself, Stat its target
+	fi, err := m.Lstat(link)
+	require.NoError(t, err, "error lstat %s", link)
+	require.Equal(t, os.ModeSymlink, fi.Mode()&os.ModeType, "%s should be a symlink", link)
+	fi, err = m.Stat(link)
+	require.NoError(t, err, "error stat %s", link)
+	require.True(t, fi.Mode().IsRegular(), "%s should resolve to a regular file", link)
 }
 func TestMemFSHardlink(t *testing.T) {
 	var (
@@ -450,3 +460,77 @@ func TestMemFSConsistentOrdering(t *testing.T) {
 	}
 	// all results should be the same
 }
+
+func TestMemFSStatFS(t *testing.T) {
+	m := NewMemFS()
+	capacity, err := m.StatFS()
+	require.NoError(t, err)
+	require.Zero(t, capacity.Used)
+
+	require.NoError(t, m.MkdirAll("a/b", 0o755))
+	require.NoError(t, m.WriteFile("a/one", []byte("12345"), 0o644))
+	require.NoError(t, m.WriteFile("a/b/two", []byte("123"), 0o644))
+	// links are counted once
+	require.NoError(t, m.Link("a/one", "a/b/link"))
+	require.NoError(t, m.Symlink("one", "a/symlink"))
+
+	capacity, err = m.StatFS()
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), capacity.Used)
+	require.Equal(t, capacity.Total, capacity.Used+capacity.Free)
+	require.Equal(t, capacity.Free, capacity.Available)
+}
+
+func TestMemFSMknod(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.Mkdir("dev", 0o755))
+	tests := []struct {
+		path    string
+		mode    uint32
+		dev     int
+		typ     fs.FileMode
+		typflag byte
+	}{
+		{"dev/null", unix.S_IFCHR | 0o666, int(unix.Mkdev(1, 3)), fs.ModeDevice | fs.ModeCharDevice, tar.TypeChar},
+		{"dev/loop0", unix.S_IFBLK | 0o660, int(unix.Mkdev(7, 0)), fs.ModeDevice, tar.TypeBlock},
+		{"dev/initctl", unix.S_IFIFO | 0o600, 0, fs.ModeNamedPipe, tar.TypeFifo},
+		// no type is a character device, as it always was
+		{"dev/zero", 0o666, int(unix.Mkdev(1, 5)), fs.ModeDevice | fs.ModeCharDevice, tar.TypeChar},
+	}
+	for _, tt := range tests {
+		require.NoError(t, m.Mknod(tt.path, tt.mode, tt.dev), tt.path)
+		fi, err := m.Lstat(tt.path)
+		require.NoError(t, err)
+		require.Equal(t, tt.typ, fi.Mode().Type(), tt.path)
+		require.Equal(t, fs.FileMode(tt.mode&0o777), fi.Mode().Perm(), tt.path)
+
+		dev, err := m.Readnod(tt.path)
+		if tt.typ&fs.ModeDevice == 0 {
+			require.Error(t, err, tt.path)
+		} else {
+			require.NoError(t, err, tt.path)
+			require.Equal(t, tt.dev, dev, tt.path)
+		}
+
+		header, err := ReadHeader(m, tt.path, fi)
+		require.NoError(t, err)
+		require.Equal(t, tt.typflag, header.Typeflag, tt.path)
+		require.Equal(t, int64(unix.Major(uint64(tt.dev))), header.Devmajor, tt.path)
+		require.Equal(t, int64(unix.Minor(uint64(tt.dev))), header.Devminor, tt.path)
+	}
+}
+
+func TestMemFSChtimes(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.WriteFile("a", []byte("hello"), 0o644))
+	atime := time.Unix(1690000000, 1)
+	mtime := time.Unix(1690000001, 999999999)
+	require.NoError(t, m.Chtimes("a", atime, mtime))
+	fi, err := m.Lstat("a")
+	require.NoError(t, err)
+	require.True(t, mtime.Equal(fi.ModTime()), "mtime is %s", fi.ModTime())
+	h := fi.Sys().(*tar.Header)
+	require.True(t, mtime.Equal(h.ModTime), "header mtime is %s", h.ModTime)
+	require.True(t, atime.Equal(h.AccessTime), "header atime is %s", h.AccessTime)
+	require.Error(t, m.Chtimes("b", atime, mtime))
+}
@@ -144,7 +144,7 @@ func DirFS(dir string, opts ...DirFSOption) FullFS {
 			if err != nil {
 				err = f.overrides.Symlink(target, path)
 			}
-		case fs.ModeCharDevice:
+		case fs.ModeDevice | fs.ModeCharDevice, fs.ModeDevice:
 			var dev int
 			sys := fi.Sys()
 			st1, ok1 := sys.(*syscall.Stat_t)
@@ -157,7 +157,13 @@ func DirFS(dir string, opts ...DirFSOption) FullFS {
 			default:
 				return fmt.Errorf("unsupported type %T", sys)
 			}
-			err = f.overrides.Mknod(path, uint32(unix.S_IFCHR|mode), dev)
+			typ := uint32(unix.S_IFBLK)
+			if mode&fs.ModeCharDevice != 0 {
+				typ = unix.S_IFCHR
+			}
+			err = f.overrides.Mknod(path, typ|uint32(perm), dev)
+		case fs.ModeNamedPipe:
+			err = f.overrides.Mknod(path, unix.S_IFIFO|uint32(perm), 0)
 		default:
 			var memFile File
 			memFile, err = f.overrides.OpenFile(path, os.O_CREATE, perm)
@@ -503,6 +509,15 @@ func (f *dirFS) Chown(path string, uid, gid int) error {
 	return f.overrides.Chown(path, uid, gid)
 }
 
+func (f *dirFS) Chtimes(path string, atime, mtime time.Time) error {
+	if f.caseSensitiveOnDisk(path) {
+		if err := os.Chtimes(filepath.Join(f.base, path), atime, mtime); err != nil {
+			return err
+		}
+	}
+	return f.overrides.Chtimes(path, atime, mtime)
+}
+
 func (f *dirFS) Mknod(name string, mode uint32, dev int) error {
 	if f.caseSensitiveOnDisk(name) {
 		err := unix.Mknod(filepath.Join(f.base, name), mode, dev)
@@ -516,6 +531,23 @@ func (f *dirFS) Mknod(name string, mode uint32, dev int) error {
 	return f.overrides.Mknod(name, mode, dev)
 }
 
+// StatFS returns the capacity of the filesystem that the directory is on.
+func (f *dirFS) StatFS() (Capacity, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(f.base, &st); err != nil {
+		return Capacity{}, fmt.Errorf("statfs %s: %w", f.base, err)
+	}
+	bsize := uint64(st.Bsize)          //nolint:unconvert // the type of the block size differs by platform
+	total := uint64(st.Blocks) * bsize //nolint:unconvert // as does that of the counts of blocks
+	free := uint64(st.Bfree) * bsize   //nolint:unconvert
+	return Capacity{
+		Total:     total,
+		Used:      total - free,
+		Free:      free,
+		Available: uint64(st.Bavail) * bsize, //nolint:unconvert
+	}, nil
+}
+
 func (f *dirFS) SetXattr(path string, attr string, data []byte) error {
 	// the underlying filesystem might or might not support xattrs
 	// but we have info on every file in memory, so might as well store it there.
@@ -195,3 +195,11 @@ func TestDirFSConsistentOrdering(t *testing.T) {
 	}
 	// all results should be the same
 }
+
+func TestDirFSStatFS(t *testing.T) {
+	capacity, err := DirFS(t.TempDir()).StatFS()
+	require.NoError(t, err)
+	require.NotZero(t, capacity.Total)
+	require.LessOrEqual(t, capacity.Available, capacity.Free)
+	require.Equal(t, capacity.Total, capacity.Used+capacity.Free)
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sub returns the FullFS of the directory dir of fsys, whose paths are those under dir, as with
+// fs.Sub, such as for a sysroot within a root. The targets of symlinks are kept as they are given, so
+// absolute ones are absolute in fsys, as they would be once dir is the root. Errors are about the
+// paths of fsys.
+func Sub(fsys FullFS, dir string) FullFS {
+	dir = strings.TrimPrefix(filepath.Clean(dir), "/")
+	if dir == "." || dir == "" {
+		return fsys
+	}
+	return &subFS{fsys: fsys, dir: dir}
+}
+
+type subFS struct {
+	fsys FullFS
+	dir  string
+}
+
+// full returns the path in the wrapped filesystem, which never escapes dir.
+func (s *subFS) full(path string) string {
+	// cleaned as if absolute, so that .. stops at dir
+	return filepath.Join(s.dir, filepath.Clean("/"+path))
+}
+
+func (s *subFS) Mkdir(path string, perm fs.FileMode) error {
+	return s.fsys.Mkdir(s.full(path), perm)
+}
+
+func (s *subFS) MkdirAll(path string, perm fs.FileMode) error {
+	return s.fsys.MkdirAll(s.full(path), perm)
+}
+
+func (s *subFS) Open(name string) (fs.File, error) {
+	return s.fsys.Open(s.full(name))
+}
+
+func (s *subFS) OpenReaderAt(name string) (File, error) {
+	return s.fsys.OpenReaderAt(s.full(name))
+}
+
+func (s *subFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return s.fsys.OpenFile(s.full(name), flag, perm)
+}
+
+func (s *subFS) ReadFile(name string) ([]byte, error) {
+	return s.fsys.ReadFile(s.full(name))
+}
+
+func (s *subFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
+	return s.fsys.WriteFile(s.full(name), b, mode)
+}
+
+func (s *subFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return s.fsys.ReadDir(s.full(name))
+}
+
+func (s *subFS) Mknod(path string, mode uint32, dev int) error {
+	return s.fsys.Mknod(s.full(path), mode, dev)
+}
+
+func (s *subFS) Readnod(name string) (int, error) {
+	return s.fsys.Readnod(s.full(name))
+}
+
+func (s *subFS) Symlink(oldname, newname string) error {
+	return s.fsys.Symlink(oldname, s.full(newname))
+}
+
+func (s *subFS) Link(oldname, newname string) error {
+	return s.fsys.Link(s.full(oldname), s.full(newname))
+}
+
+func (s *subFS) Readlink(name string) (string, error) {
+	return s.fsys.Readlink(s.full(name))
+}
+
+func (s *subFS) Stat(path string) (fs.FileInfo, error) {
+	return s.fsys.Stat(s.full(path))
+}
+
+func (s *subFS) Lstat(path string) (fs.FileInfo, error) {
+	return s.fsys.Lstat(s.full(path))
+}
+
+func (s *subFS) Create(name string) (File, error) {
+	return s.fsys.Create(s.full(name))
+}
+
+func (s *subFS) Remove(name string) error {
+	if s.full(name) == s.dir {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("cannot remove the root of a sub filesystem")}
+	}
+	return s.fsys.Remove(s.full(name))
+}
+
+func (s *subFS) Chmod(path string, perm fs.FileMode) error {
+	return s.fsys.Chmod(s.full(path), perm)
+}
+
+func (s *subFS) Chown(path string, uid, gid int) error {
+	return s.fsys.Chown(s.full(path), uid, gid)
+}
+
+func (s *subFS) Chtimes(path string, atime, mtime time.Time) error {
+	return s.fsys.Chtimes(s.full(path), atime, mtime)
+}
+
+func (s *subFS) SetXattr(path, attr string, data []byte) error {
+	return s.fsys.SetXattr(s.full(path), attr, data)
+}
+
+func (s *subFS) GetXattr(path, attr string) ([]byte, error) {
+	return s.fsys.GetXattr(s.full(path), attr)
+}
+
+func (s *subFS) RemoveXattr(path, attr string) error {
+	return s.fsys.RemoveXattr(s.full(path), attr)
+}
+
+func (s *subFS) ListXattrs(path string) (map[string][]byte, error) {
+	return s.fsys.ListXattrs(s.full(path))
+}
+
+func (s *subFS) StatFS() (Capacity, error) {
+	return s.fsys.StatFS()
+}
+
+func (s *subFS) CloneFile(src, name string, mode CloneMode) error {
+	cfs, ok := s.fsys.(CloneFS)
+	if !ok {
+		return ErrCloneUnsupported
+	}
+	return cfs.CloneFile(src, s.full(name), mode)
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSub(t *testing.T) {
+	fsys := NewMemFS()
+	require.NoError(t, fsys.MkdirAll("sysroot", 0o755))
+	sub := Sub(fsys, "/sysroot/")
+
+	require.NoError(t, sub.MkdirAll("/etc/apk", 0o755))
+	require.NoError(t, sub.WriteFile("etc/apk/world", []byte("busybox\n"), 0o644))
+	require.NoError(t, sub.Symlink("/etc/apk/world", "etc/world"))
+	require.NoError(t, sub.Link("etc/apk/world", "etc/world.bak"))
+	require.NoError(t, sub.SetXattr("etc/apk/world", "user.note", []byte("hi")))
+
+	b, err := fsys.ReadFile("sysroot/etc/apk/world")
+	require.NoError(t, err)
+	require.Equal(t, "busybox\n", string(b))
+	b, err = fsys.ReadFile("sysroot/etc/world.bak")
+	require.NoError(t, err)
+	require.Equal(t, "busybox\n", string(b))
+	target, err := sub.Readlink("etc/world")
+	require.NoError(t, err)
+	require.Equal(t, "/etc/apk/world", target)
+	xattr, err := fsys.GetXattr("sysroot/etc/apk/world", "user.note")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hi"), xattr)
+
+	entries, err := sub.ReadDir(".")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "etc", entries[0].Name())
+
+	// paths do not escape the directory
+	_, err = sub.Stat("../sysroot/etc/apk/world")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.NoError(t, sub.WriteFile("../escaped", nil, 0o644))
+	_, err = fsys.Stat("sysroot/escaped")
+	require.NoError(t, err)
+	_, err = fsys.Stat("escaped")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.Error(t, sub.Remove("/"))
+	require.Same(t, fsys, Sub(fsys, "/"))
+}
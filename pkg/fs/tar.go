@@ -0,0 +1,172 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// XattrPAXRecordsPrefix is the prefix of the PAX records of a tar header that hold the xattrs
+// of the entry, as GNU tar and apk write them.
+const XattrPAXRecordsPrefix = "SCHILY.xattr."
+
+// ReadHeader returns the tar header describing the entry at name in fsys, whose FileInfo, as
+// from Lstat or the DirEntry of ReadDir, is info. The header has the mode and ownership of the
+// entry, the target of symlinks, the device numbers of devices, and the xattrs of directories
+// and regular files, for those that fsys can report. The content of regular files is not read.
+//
+// It is the reverse of WriteHeader, and what go-apk uses to write filesystems out as tar.
+func ReadHeader(fsys fs.FS, name string, info fs.FileInfo) (*tar.Header, error) {
+	var link string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		rlfs, ok := fsys.(ReadLinkFS)
+		if !ok {
+			return nil, fmt.Errorf("readlink not supported by this fs: path (%s)", name)
+		}
+		var err error
+		if link, err = rlfs.Readlink(name); err != nil {
+			return nil, err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	// FileInfoHeader sets just the basename
+	header.Name = name
+
+	if info.Mode()&fs.ModeDevice != 0 {
+		rnfs, ok := fsys.(ReadnodFS)
+		if !ok {
+			return nil, fmt.Errorf("read device not supported by this fs: path (%s)", name)
+		}
+		dev, err := rnfs.Readnod(name)
+		if err != nil {
+			return nil, err
+		}
+		header.Devmajor = int64(unix.Major(uint64(dev)))
+		header.Devminor = int64(unix.Minor(uint64(dev)))
+	}
+
+	// only capture xattrs for real objects in the FS
+	if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeDir {
+		if xfs, ok := fsys.(XattrFS); ok {
+			// we can ignore errors
+			if xattrs, err := xfs.ListXattrs(name); err == nil && len(xattrs) > 0 {
+				if header.PAXRecords == nil {
+					header.PAXRecords = map[string]string{}
+				}
+				for attr, value := range xattrs {
+					header.PAXRecords[XattrPAXRecordsPrefix+attr] = string(value)
+				}
+			}
+		}
+	}
+
+	return header, nil
+}
+
+// WriteHeader creates the entry described by the tar header in fsys, reading the content of
+// regular files from r, and sets its mode, ownership, xattrs and times from the header. Symlinks
+// and hardlinks get none of those, as their own metadata is not kept, or is that of their target.
+// Parent directories must already exist, and an existing regular file is overwritten, but any
+// other existing entry is an error.
+//
+// It is the reverse of ReadHeader, and what go-apk uses to install the files of packages.
+func WriteHeader(fsys FullFS, header *tar.Header, r io.Reader) error {
+	mode := header.FileInfo().Mode()
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := fsys.MkdirAll(header.Name, mode.Perm()); err != nil {
+			return fmt.Errorf("error creating directory %s: %w", header.Name, err)
+		}
+	case tar.TypeReg:
+		f, err := fsys.OpenFile(header.Name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return fmt.Errorf("error creating file %s: %w", header.Name, err)
+		}
+		if _, err := io.CopyN(f, r, header.Size); err != nil {
+			f.Close()
+			return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
+		}
+	case tar.TypeSymlink:
+		if err := fsys.Symlink(header.Linkname, header.Name); err != nil {
+			return fmt.Errorf("unable to install symlink from %s -> %s: %w", header.Name, header.Linkname, err)
+		}
+		return nil
+	case tar.TypeLink:
+		if err := fsys.Link(header.Linkname, header.Name); err != nil {
+			return fmt.Errorf("unable to install hardlink from %s -> %s: %w", header.Name, header.Linkname, err)
+		}
+		return nil
+	case tar.TypeChar, tar.TypeBlock:
+		typ := uint32(unix.S_IFCHR)
+		if header.Typeflag == tar.TypeBlock {
+			typ = unix.S_IFBLK
+		}
+		dev := int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
+		if err := fsys.Mknod(header.Name, typ|uint32(mode.Perm()), dev); err != nil {
+			return fmt.Errorf("error creating device %s: %w", header.Name, err)
+		}
+	case tar.TypeFifo:
+		if err := fsys.Mknod(header.Name, unix.S_IFIFO|uint32(mode.Perm()), 0); err != nil {
+			return fmt.Errorf("error creating fifo %s: %w", header.Name, err)
+		}
+	default:
+		return fmt.Errorf("unsupported file type %s %v", header.Name, header.Typeflag)
+	}
+	return setHeaderMetadata(fsys, header)
+}
+
+// setHeaderMetadata sets the mode, ownership, xattrs and times of the entry from the header.
+func setHeaderMetadata(fsys FullFS, header *tar.Header) error {
+	mode := header.FileInfo().Mode()
+	if err := fsys.Chmod(header.Name, mode&permBits); err != nil {
+		return fmt.Errorf("error setting mode of %s: %w", header.Name, err)
+	}
+	if err := fsys.Chown(header.Name, header.Uid, header.Gid); err != nil {
+		return fmt.Errorf("error setting ownership of %s: %w", header.Name, err)
+	}
+	for k, v := range header.PAXRecords {
+		if !strings.HasPrefix(k, XattrPAXRecordsPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(k, XattrPAXRecordsPrefix)
+		if err := fsys.SetXattr(header.Name, attr, []byte(v)); err != nil {
+			return fmt.Errorf("error setting xattr %s on %s: %w", attr, header.Name, err)
+		}
+	}
+	if !header.ModTime.IsZero() {
+		atime := header.AccessTime
+		if atime.IsZero() {
+			atime = header.ModTime
+		}
+		if err := fsys.Chtimes(header.Name, atime, header.ModTime); err != nil {
+			return fmt.Errorf("error setting times of %s: %w", header.Name, err)
+		}
+	}
+	return nil
+}
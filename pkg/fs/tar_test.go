@@ -0,0 +1,76 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	mtime := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "usr", Mode: 0o755, ModTime: mtime},
+		{Typeflag: tar.TypeDir, Name: "usr/bin", Mode: 0o750, Uid: 0, Gid: 10, ModTime: mtime,
+			PAXRecords: map[string]string{XattrPAXRecordsPrefix + "user.dir": "foo"}},
+		{Typeflag: tar.TypeReg, Name: "usr/bin/hello", Mode: 0o4755, Uid: 1000, Gid: 1000, Size: 5, ModTime: mtime,
+			PAXRecords: map[string]string{XattrPAXRecordsPrefix + "security.capability": "cap", "APK-TOOLS.checksum.SHA1": "ignored"}},
+		{Typeflag: tar.TypeSymlink, Name: "usr/bin/greet", Linkname: "hello", Mode: 0o777},
+		{Typeflag: tar.TypeChar, Name: "usr/null", Mode: 0o666, Devmajor: 1, Devminor: 3, ModTime: mtime},
+		{Typeflag: tar.TypeBlock, Name: "usr/loop0", Mode: 0o660, Gid: 6, Devmajor: 7, ModTime: mtime},
+		{Typeflag: tar.TypeFifo, Name: "usr/initctl", Mode: 0o600, ModTime: mtime},
+	}
+
+	m := NewMemFS()
+	for _, h := range headers {
+		require.NoError(t, WriteHeader(m, h, strings.NewReader("hello")), "writing %s", h.Name)
+	}
+	require.NoError(t, WriteHeader(m, &tar.Header{Typeflag: tar.TypeLink, Name: "usr/bin/hi", Linkname: "usr/bin/hello"}, nil))
+	require.Error(t, WriteHeader(m, &tar.Header{Typeflag: tar.TypeSymlink, Name: "usr/bin/greet", Linkname: "hi"}, nil))
+
+	b, err := m.ReadFile("usr/bin/hi")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+
+	for _, want := range headers {
+		fi, err := m.Lstat(want.Name)
+		require.NoError(t, err)
+		got, err := ReadHeader(m, want.Name, fi)
+		require.NoError(t, err)
+		require.Equal(t, want.Typeflag, got.Typeflag, want.Name)
+		require.Equal(t, want.Name, got.Name)
+		require.Equal(t, want.Mode, got.Mode, want.Name)
+		require.Equal(t, want.Linkname, got.Linkname, want.Name)
+		require.Equal(t, want.Devmajor, got.Devmajor, want.Name)
+		require.Equal(t, want.Devminor, got.Devminor, want.Name)
+		if want.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		require.Equal(t, want.Uid, got.Uid, want.Name)
+		require.Equal(t, want.Gid, got.Gid, want.Name)
+		require.True(t, mtime.Equal(got.ModTime), want.Name)
+		for k, v := range want.PAXRecords {
+			if strings.HasPrefix(k, XattrPAXRecordsPrefix) {
+				require.Equal(t, v, got.PAXRecords[k], "%s of %s", k, want.Name)
+			} else {
+				require.NotContains(t, got.PAXRecords, k)
+			}
+		}
+	}
+}
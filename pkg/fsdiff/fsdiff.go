@@ -0,0 +1,362 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fsdiff compares two filesystem trees, such as the roots built by apk-tools and by
+// go-apk from the same packages. The apk database files are compared by meaning rather than
+// byte for byte, so that, e.g., the order in which packages were installed does not matter.
+package fsdiff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Kind is the kind of a difference.
+type Kind int
+
+const (
+	// Removed is a path that is only in the first tree.
+	Removed Kind = iota
+	// Added is a path that is only in the second tree.
+	Added
+	// Changed is a path that is in both trees, but differs.
+	Changed
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Removed:
+		return "-"
+	case Added:
+		return "+"
+	default:
+		return "~"
+	}
+}
+
+// Difference is a path that differs between two trees.
+type Difference struct {
+	Path string `json:"path"`
+	Kind Kind   `json:"kind"`
+	// Detail describes a change; it is empty for added and removed paths.
+	Detail string `json:"detail,omitempty"`
+}
+
+// MarshalText encodes the kind by name: "removed", "added" or "changed".
+func (k Kind) MarshalText() ([]byte, error) {
+	switch k {
+	case Removed:
+		return []byte("removed"), nil
+	case Added:
+		return []byte("added"), nil
+	default:
+		return []byte("changed"), nil
+	}
+}
+
+func (d Difference) String() string {
+	if d.Detail == "" {
+		return fmt.Sprintf("%s %s", d.Kind, d.Path)
+	}
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Path, d.Detail)
+}
+
+// A Comparer compares the contents of a file in the two trees, returning a description of how
+// they differ, or "" if they are equivalent.
+type Comparer func(a, b []byte) string
+
+type options struct {
+	ignore    []string
+	comparers map[string]Comparer
+}
+
+type Option func(*options)
+
+// WithIgnore leaves out paths matching any of the patterns, as in path.Match, along with everything
+// below them.
+func WithIgnore(patterns ...string) Option {
+	return func(o *options) {
+		o.ignore = append(o.ignore, patterns...)
+	}
+}
+
+// WithComparer sets how the contents of the file at the path are compared, replacing the default.
+// A nil comparer compares the file byte for byte.
+func WithComparer(p string, c Comparer) Option {
+	return func(o *options) {
+		o.comparers[p] = c
+	}
+}
+
+// errNoReadlink is returned by readlink for filesystems that cannot read symlinks, whose targets
+// are then not compared.
+var errNoReadlink = errors.New("filesystem cannot read symlinks")
+
+// readlinkFS is implemented by filesystems that can read symlinks, such as those of
+// github.com/chainguard-dev/go-apk/pkg/fs.
+type readlinkFS interface {
+	Readlink(name string) (string, error)
+}
+
+// Diff returns the differences between the trees, ordered by path. Paths are compared by type,
+// permissions, and by content for regular files, or target for symlinks; modification times and
+// ownership are not compared. By default, the installed database and the world of apk are compared
+// with InstalledComparer and LinesComparer.
+func Diff(a, b fs.FS, opts ...Option) ([]Difference, error) {
+	o := &options{comparers: map[string]Comparer{
+		"lib/apk/db/installed": InstalledComparer,
+		"etc/apk/world":        LinesComparer,
+	}}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	aEntries, err := walk(a, o.ignore)
+	if err != nil {
+		return nil, fmt.Errorf("walking first tree: %w", err)
+	}
+	bEntries, err := walk(b, o.ignore)
+	if err != nil {
+		return nil, fmt.Errorf("walking second tree: %w", err)
+	}
+
+	var diffs []Difference
+	for p, ai := range aEntries {
+		bi, ok := bEntries[p]
+		if !ok {
+			diffs = append(diffs, Difference{Path: p, Kind: Removed})
+			continue
+		}
+		detail, err := compare(a, b, p, ai, bi, o.comparers[p])
+		if err != nil {
+			return nil, err
+		}
+		if detail != "" {
+			diffs = append(diffs, Difference{Path: p, Kind: Changed, Detail: detail})
+		}
+	}
+	for p := range bEntries {
+		if _, ok := aEntries[p]; !ok {
+			diffs = append(diffs, Difference{Path: p, Kind: Added})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs, nil
+}
+
+func walk(fsys fs.FS, ignore []string) (map[string]fs.FileInfo, error) {
+	entries := map[string]fs.FileInfo{}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "." {
+			return nil
+		}
+		if ignored(p, ignore) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries[p] = fi
+		return nil
+	})
+	return entries, err
+}
+
+func ignored(p string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func compare(a, b fs.FS, p string, ai, bi fs.FileInfo, comparer Comparer) (string, error) {
+	if at, bt := ai.Mode().Type(), bi.Mode().Type(); at != bt {
+		return fmt.Sprintf("type %s != %s", typeName(at), typeName(bt)), nil
+	}
+	if ap, bp := ai.Mode().Perm(), bi.Mode().Perm(); ap != bp {
+		return fmt.Sprintf("mode %04o != %04o", ap, bp), nil
+	}
+
+	switch {
+	case ai.Mode().Type() == fs.ModeSymlink:
+		at, aErr := readlink(a, p)
+		bt, bErr := readlink(b, p)
+		if errors.Is(aErr, errNoReadlink) || errors.Is(bErr, errNoReadlink) {
+			return "", nil
+		}
+		if err := errors.Join(aErr, bErr); err != nil {
+			return "", err
+		}
+		if at != bt {
+			return fmt.Sprintf("target %s != %s", at, bt), nil
+		}
+	case ai.Mode().IsRegular():
+		ab, err := fs.ReadFile(a, p)
+		if err != nil {
+			return "", err
+		}
+		bb, err := fs.ReadFile(b, p)
+		if err != nil {
+			return "", err
+		}
+		if comparer != nil {
+			return comparer(ab, bb), nil
+		}
+		if !bytes.Equal(ab, bb) {
+			return fmt.Sprintf("content differs (%d and %d bytes)", len(ab), len(bb)), nil
+		}
+	}
+	return "", nil
+}
+
+func readlink(fsys fs.FS, p string) (string, error) {
+	rl, ok := fsys.(readlinkFS)
+	if !ok {
+		return "", errNoReadlink
+	}
+	return rl.Readlink(p)
+}
+
+func typeName(m fs.FileMode) string {
+	switch {
+	case m == 0:
+		return "file"
+	case m&fs.ModeDir != 0:
+		return "directory"
+	case m&fs.ModeSymlink != 0:
+		return "symlink"
+	case m&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case m&fs.ModeCharDevice != 0:
+		return "char device"
+	case m&fs.ModeDevice != 0:
+		return "device"
+	default:
+		return m.String()
+	}
+}
+
+// LinesComparer compares files as sets of lines, ignoring their order and empty lines.
+func LinesComparer(a, b []byte) string {
+	al, bl := lineSet(a), lineSet(b)
+	var removed, added []string
+	for l := range al {
+		if !bl[l] {
+			removed = append(removed, l)
+		}
+	}
+	for l := range bl {
+		if !al[l] {
+			added = append(added, l)
+		}
+	}
+	return describe(removed, added)
+}
+
+func lineSet(b []byte) map[string]bool {
+	set := map[string]bool{}
+	for _, l := range strings.Split(string(b), "\n") {
+		if l != "" {
+			set[l] = true
+		}
+	}
+	return set
+}
+
+// InstalledComparer compares apk installed databases package by package, ignoring the order in
+// which the packages are listed. The entry of each package must be the same line for line.
+func InstalledComparer(a, b []byte) string {
+	ap, bp := installedEntries(a), installedEntries(b)
+	var removed, added, changed []string
+	for name, entry := range ap {
+		other, ok := bp[name]
+		switch {
+		case !ok:
+			removed = append(removed, name)
+		case entry != other:
+			changed = append(changed, fmt.Sprintf("%s (%s)", name, firstDifference(entry, other)))
+		}
+	}
+	for name := range bp {
+		if _, ok := ap[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	detail := describe(removed, added)
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		if detail != "" {
+			detail += "; "
+		}
+		detail += "changed " + strings.Join(changed, ", ")
+	}
+	return detail
+}
+
+// installedEntries returns the entries of an installed database by package name.
+func installedEntries(b []byte) map[string]string {
+	entries := map[string]string{}
+	for _, entry := range strings.Split(string(b), "\n\n") {
+		entry = strings.Trim(entry, "\n")
+		if entry == "" {
+			continue
+		}
+		name := entry
+		for _, l := range strings.Split(entry, "\n") {
+			if n, ok := strings.CutPrefix(l, "P:"); ok {
+				name = n
+				break
+			}
+		}
+		entries[name] = entry
+	}
+	return entries
+}
+
+func firstDifference(a, b string) string {
+	al, bl := strings.Split(a, "\n"), strings.Split(b, "\n")
+	for i := 0; i < len(al) && i < len(bl); i++ {
+		if al[i] != bl[i] {
+			return fmt.Sprintf("%q != %q", al[i], bl[i])
+		}
+	}
+	return fmt.Sprintf("%d != %d lines", len(al), len(bl))
+}
+
+func describe(removed, added []string) string {
+	sort.Strings(removed)
+	sort.Strings(added)
+	var parts []string
+	if len(removed) > 0 {
+		parts = append(parts, "only in first: "+strings.Join(removed, ", "))
+	}
+	if len(added) > 0 {
+		parts = append(parts, "only in second: "+strings.Join(added, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsdiff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestDiff(t *testing.T) {
+	newTree := func(files map[string]string) apkfs.FullFS {
+		fsys := apkfs.NewMemFS()
+		require.NoError(t, fsys.MkdirAll("lib/apk/db", 0o755))
+		require.NoError(t, fsys.MkdirAll("etc/apk", 0o755))
+		require.NoError(t, fsys.MkdirAll("tmp", 0o755))
+		for name, content := range files {
+			require.NoError(t, fsys.WriteFile(name, []byte(content), 0o644))
+		}
+		return fsys
+	}
+	a := newTree(map[string]string{
+		"lib/apk/db/installed": "P:foo\nV:1.0-r0\n\nP:bar\nV:2.0-r0\n\n",
+		"etc/apk/world":        "bar\nfoo\n",
+		"etc/same":             "same",
+		"etc/content":          "one",
+		"etc/removed":          "gone",
+		"tmp/noise":            "a",
+	})
+	b := newTree(map[string]string{
+		"lib/apk/db/installed": "P:bar\nV:2.0-r0\n\nP:foo\nV:1.0-r0\n\n",
+		"etc/apk/world":        "foo\nbar\n",
+		"etc/same":             "same",
+		"etc/content":          "two",
+		"etc/added":            "new",
+		"tmp/noise":            "b",
+	})
+	require.NoError(t, a.Symlink("same", "etc/link"))
+	require.NoError(t, b.Symlink("content", "etc/link"))
+	require.NoError(t, b.Chmod("etc/same", 0o600))
+
+	diffs, err := Diff(a, b, WithIgnore("tmp"))
+	require.NoError(t, err)
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.String())
+	}
+	require.Equal(t, []string{
+		"+ etc/added",
+		"~ etc/content: content differs (3 and 3 bytes)",
+		"~ etc/link: target same != content",
+		"- etc/removed",
+		"~ etc/same: mode 0644 != 0600",
+	}, got, "the database files only differ in order")
+
+	// against itself, there are no differences
+	diffs, err = Diff(a, a)
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+}
+
+func TestInstalledComparer(t *testing.T) {
+	a := []byte("P:foo\nV:1.0-r0\n\nP:bar\nV:2.0-r0\n\nP:baz\nV:1\n")
+	b := []byte("P:foo\nV:1.1-r0\n\nP:bar\nV:2.0-r0\n\nP:qux\nV:1\n")
+	require.Equal(t, `only in first: baz; only in second: qux; changed foo ("V:1.0-r0" != "V:1.1-r0")`, InstalledComparer(a, b))
+	require.Empty(t, InstalledComparer(a, a))
+}
@@ -0,0 +1,210 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package secdb reads the security databases of Alpine, at secdb.alpinelinux.org, and of Wolfi, which
+// list the vulnerabilities fixed in each version of the packages of a repository, and matches them
+// against a set of packages, such as those installed or resolved, to find the packages that have
+// vulnerabilities that newer versions fix.
+package secdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+// AlpineURL is where the security databases of Alpine are, one for each repository of each release,
+// as https://secdb.alpinelinux.org/v3.18/main.json.
+const AlpineURL = "https://secdb.alpinelinux.org"
+
+// notAffected is the version the vulnerabilities that never affected a package are listed for.
+const notAffected = "0"
+
+// Database is a security database, for the packages of a repository.
+type Database struct {
+	APKURL        string   `json:"apkurl,omitempty"`
+	Archs         []string `json:"archs,omitempty"`
+	RepoName      string   `json:"reponame,omitempty"`
+	URLPrefix     string   `json:"urlprefix,omitempty"`
+	DistroVersion string   `json:"distroversion,omitempty"`
+	Packages      []Entry  `json:"packages"`
+}
+
+// Entry is the entry of a package in a Database.
+type Entry struct {
+	Pkg Package `json:"pkg"`
+}
+
+// Package is what a Database has for a package, by the name of the origin of the packages built
+// from it.
+type Package struct {
+	Name string `json:"name"`
+	// SecFixes are the identifiers of the vulnerabilities, such as CVE-2023-0464, by the version
+	// that fixed them, or by 0 for those that never affected the package.
+	SecFixes map[string][]string `json:"secfixes"`
+}
+
+// Vulnerability is a vulnerability of a package that a newer version of it fixes.
+type Vulnerability struct {
+	// Package and Version are those of the vulnerable package.
+	Package string `json:"package"`
+	Version string `json:"version"`
+	// Origin is the name the package is listed by in the database, if it is not that of the package.
+	Origin string `json:"origin,omitempty"`
+	// ID identifies the vulnerability, such as CVE-2023-0464.
+	ID string `json:"id"`
+	// FixedVersion is the earliest version of the package that fixes it.
+	FixedVersion string `json:"fixedVersion"`
+}
+
+func (v Vulnerability) String() string {
+	return fmt.Sprintf("%s-%s: %s, fixed in %s", v.Package, v.Version, v.ID, v.FixedVersion)
+}
+
+// Parse reads a Database from its JSON.
+func Parse(r io.Reader) (*Database, error) {
+	var db Database
+	if err := json.NewDecoder(r).Decode(&db); err != nil {
+		return nil, fmt.Errorf("parsing security database: %w", err)
+	}
+	return &db, nil
+}
+
+// Fetch fetches the Database at the URL, or the path of a local file, with the client, or
+// http.DefaultClient if it is nil.
+func Fetch(ctx context.Context, client *http.Client, u string) (*Database, error) {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+		f, err := os.Open(strings.TrimPrefix(u, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return Parse(f)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching security database: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching security database %s: %s", u, res.Status)
+	}
+	db, err := Parse(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	return db, nil
+}
+
+// URLForRepository returns the URL of the security database of the repository, a line of
+// /etc/apk/repositories, for the repositories of Alpine and of its mirrors, such as
+// https://dl-cdn.alpinelinux.org/alpine/v3.18/main, and for Wolfi, or false for other repositories.
+func URLForRepository(repo string) (string, bool) {
+	// without any pin
+	fields := strings.Fields(repo)
+	if len(fields) == 0 {
+		return "", false
+	}
+	repoURL := strings.TrimSuffix(fields[len(fields)-1], "/")
+	if repoURL == "https://packages.wolfi.dev/os" {
+		return repoURL + "/security.json", true
+	}
+	parts := strings.Split(repoURL, "/")
+	if len(parts) < 3 || parts[len(parts)-3] != "alpine" {
+		return "", false
+	}
+	release, name := parts[len(parts)-2], parts[len(parts)-1]
+	if release != "edge" && !strings.HasPrefix(release, "v") {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%s/%s.json", AlpineURL, release, name), true
+}
+
+// Match returns the vulnerabilities of the packages that the databases list as fixed in newer
+// versions of them, sorted by package and identifier. Packages are looked up by their origin, as the
+// databases list them, or their name if they have none. A vulnerability listed as fixed in
+// several versions is reported with the earliest of them that is newer than the package.
+func Match(pkgs []*repository.Package, dbs ...*Database) ([]Vulnerability, error) {
+	fixes := map[string][]map[string][]string{}
+	for _, db := range dbs {
+		for _, entry := range db.Packages {
+			fixes[entry.Pkg.Name] = append(fixes[entry.Pkg.Name], entry.Pkg.SecFixes)
+		}
+	}
+
+	var vulns []Vulnerability
+	for _, pkg := range pkgs {
+		origin := pkg.Origin
+		if origin == "" {
+			origin = pkg.Name
+		}
+		fixed := map[string]string{}
+		for _, secfixes := range fixes[origin] {
+			for version, ids := range secfixes {
+				if version == notAffected {
+					continue
+				}
+				newer, err := apk.CompareVersions(version, pkg.Version)
+				if err != nil {
+					return nil, fmt.Errorf("comparing %s-%s to fixed version %s of %s: %w", pkg.Name, pkg.Version, version, origin, err)
+				}
+				if newer <= 0 {
+					continue
+				}
+				for _, id := range ids {
+					for _, id := range strings.Fields(id) {
+						if earliest, ok := fixed[id]; ok {
+							if c, err := apk.CompareVersions(version, earliest); err != nil || c >= 0 {
+								continue
+							}
+						}
+						fixed[id] = version
+					}
+				}
+			}
+		}
+		for id, version := range fixed {
+			v := Vulnerability{Package: pkg.Name, Version: pkg.Version, ID: id, FixedVersion: version}
+			if origin != pkg.Name {
+				v.Origin = origin
+			}
+			vulns = append(vulns, v)
+		}
+	}
+	sort.Slice(vulns, func(i, j int) bool {
+		if vulns[i].Package != vulns[j].Package {
+			return vulns[i].Package < vulns[j].Package
+		}
+		return vulns[i].ID < vulns[j].ID
+	})
+	return vulns, nil
+}
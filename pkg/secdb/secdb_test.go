@@ -0,0 +1,95 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secdb
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+const testDB = `{
+  "apkurl": "{{urlprefix}}/{{distroversion}}/{{reponame}}/{{arch}}/{{pkg.name}}-{{pkg.ver}}.apk",
+  "archs": ["aarch64", "x86_64"],
+  "reponame": "main",
+  "urlprefix": "https://dl-cdn.alpinelinux.org/alpine",
+  "distroversion": "v3.18",
+  "packages": [
+    {"pkg": {"name": "openssl", "secfixes": {
+      "3.1.0-r1": ["CVE-2023-0464"],
+      "3.1.0-r4": ["CVE-2023-1255", "CVE-2023-2650"],
+      "3.1.1-r0": ["CVE-2023-2650"],
+      "0": ["CVE-2022-3358"]
+    }}},
+    {"pkg": {"name": "busybox", "secfixes": {"1.36.1-r1": ["CVE-2022-48174"]}}}
+  ]
+}`
+
+func TestMatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v3.18/main.json", r.URL.Path)
+		_, _ = io.WriteString(w, testDB)
+	}))
+	defer server.Close()
+
+	db, err := Fetch(context.Background(), server.Client(), server.URL+"/v3.18/main.json")
+	require.NoError(t, err)
+	require.Equal(t, "v3.18", db.DistroVersion)
+	require.Len(t, db.Packages, 2)
+
+	vulns, err := Match([]*repository.Package{
+		{Name: "libcrypto3", Version: "3.1.0-r2", Origin: "openssl"},
+		{Name: "busybox", Version: "1.36.1-r1", Origin: "busybox"},
+		{Name: "zlib", Version: "1.2.13-r1"},
+	}, db)
+	require.NoError(t, err)
+	require.Equal(t, []Vulnerability{
+		{Package: "libcrypto3", Version: "3.1.0-r2", Origin: "openssl", ID: "CVE-2023-1255", FixedVersion: "3.1.0-r4"},
+		// the earliest fix of those newer than the package
+		{Package: "libcrypto3", Version: "3.1.0-r2", Origin: "openssl", ID: "CVE-2023-2650", FixedVersion: "3.1.0-r4"},
+	}, vulns)
+	require.Equal(t, "libcrypto3-3.1.0-r2: CVE-2023-1255, fixed in 3.1.0-r4", vulns[0].String())
+
+	// a local file
+	file := filepath.Join(t.TempDir(), "main.json")
+	require.NoError(t, os.WriteFile(file, []byte(testDB), 0o644))
+	local, err := Fetch(context.Background(), nil, file)
+	require.NoError(t, err)
+	require.Equal(t, db, local)
+
+	_, err = Match([]*repository.Package{{Name: "busybox", Version: "not-a-version"}}, db)
+	require.ErrorContains(t, err, "busybox-not-a-version")
+}
+
+func TestURLForRepository(t *testing.T) {
+	for repo, want := range map[string]string{
+		"https://dl-cdn.alpinelinux.org/alpine/v3.18/main":        "https://secdb.alpinelinux.org/v3.18/main.json",
+		"@edge https://mirror.example.com/alpine/edge/community/": "https://secdb.alpinelinux.org/edge/community.json",
+		"https://packages.wolfi.dev/os":                           "https://packages.wolfi.dev/os/security.json",
+		"https://example.com/packages":                            "",
+		"./packages":                                              "",
+	} {
+		got, ok := URLForRepository(repo)
+		require.Equal(t, want, got, repo)
+		require.Equal(t, want != "", ok, repo)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+// Upgrade is the version bump of an installed package that fixes its vulnerabilities.
+type Upgrade struct {
+	Package string `json:"package"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	// Fixes are the identifiers of the vulnerabilities the upgrade fixes.
+	Fixes []string `json:"fixes"`
+	// Unfixed are those of the vulnerabilities of the package that no version in the repositories
+	// fixes yet.
+	Unfixed []string `json:"unfixed,omitempty"`
+}
+
+func (u Upgrade) String() string {
+	s := fmt.Sprintf("%s %s -> %s: fixes %s", u.Package, u.From, u.To, strings.Join(u.Fixes, ", "))
+	if len(u.Unfixed) > 0 {
+		s += fmt.Sprintf(", not %s", strings.Join(u.Unfixed, ", "))
+	}
+	return s
+}
+
+// SuggestSecurityUpgrades returns the upgrades of the installed packages of the APK that fix their
+// vulnerabilities that the databases list as fixed, each to the earliest version in the repositories
+// that fixes all of them, or else to the latest, which fixes those it can. Packages are not upgraded
+// any further than that, so that the upgrades are as small as they can be. Packages whose
+// vulnerabilities no version in the repositories fixes are left out.
+func SuggestSecurityUpgrades(ctx context.Context, a *apk.APK, dbs ...*Database) ([]Upgrade, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, err
+	}
+	pkgs := make([]*repository.Package, len(installed))
+	for i, pkg := range installed {
+		pkgs[i] = &pkg.Package
+	}
+	vulns, err := Match(pkgs, dbs...)
+	if err != nil {
+		return nil, err
+	}
+	return suggestUpgrades(vulns, func(name string) ([]string, error) {
+		return a.Versions(ctx, name)
+	})
+}
+
+// suggestUpgrades returns the upgrades of the packages of the vulnerabilities, sorted by package as
+// they are, given the versions of each package available, latest first.
+func suggestUpgrades(vulns []Vulnerability, versions func(name string) ([]string, error)) ([]Upgrade, error) {
+	var upgrades []Upgrade
+	for i := 0; i < len(vulns); {
+		j := i
+		for j < len(vulns) && vulns[j].Package == vulns[i].Package {
+			j++
+		}
+		pkg := vulns[i:j]
+		i = j
+
+		available, err := versions(pkg[0].Package)
+		if err != nil {
+			return nil, fmt.Errorf("versions of %s: %w", pkg[0].Package, err)
+		}
+		// the earliest version that fixes the most, from the latest down
+		var to string
+		var fixes []string
+		for _, v := range available {
+			newer, err := apk.CompareVersions(v, pkg[0].Version)
+			if err != nil {
+				return nil, err
+			}
+			if newer <= 0 {
+				break
+			}
+			var fixed []string
+			for _, vuln := range pkg {
+				if c, err := apk.CompareVersions(v, vuln.FixedVersion); err == nil && c >= 0 {
+					fixed = append(fixed, vuln.ID)
+				}
+			}
+			if len(fixed) == 0 || len(fixed) < len(fixes) {
+				break
+			}
+			to, fixes = v, fixed
+		}
+		if to == "" {
+			continue
+		}
+		upgrade := Upgrade{Package: pkg[0].Package, From: pkg[0].Version, To: to, Fixes: fixes}
+		for _, vuln := range pkg {
+			if c, err := apk.CompareVersions(to, vuln.FixedVersion); err != nil || c < 0 {
+				upgrade.Unfixed = append(upgrade.Unfixed, vuln.ID)
+			}
+		}
+		upgrades = append(upgrades, upgrade)
+	}
+	return upgrades, nil
+}
+
+// ApplySecurityUpgrades installs the upgrades, as suggested by SuggestSecurityUpgrades, with
+// UpgradeWorld, as if the world pinned each package to the version it is upgraded to, and every other
+// installed package to its version, so that nothing else is upgraded. The world is left as it was,
+// without the pins; as FixateWorld keeps installed packages at their version, the upgrades stay
+// installed.
+func ApplySecurityUpgrades(ctx context.Context, a *apk.APK, upgrades []Upgrade, sourceDateEpoch *time.Time) (err error) {
+	if len(upgrades) == 0 {
+		return nil
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return err
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if restoreErr := a.SetWorld(world); restoreErr != nil {
+			err = errors.Join(err, fmt.Errorf("restoring world: %w", restoreErr))
+		}
+	}()
+
+	versions := make(map[string]string, len(installed))
+	names := make([]string, 0, len(installed))
+	for _, pkg := range installed {
+		versions[pkg.Name] = pkg.Version
+		names = append(names, pkg.Name)
+	}
+	for _, u := range upgrades {
+		if _, ok := versions[u.Package]; !ok {
+			return fmt.Errorf("%s is not installed", u.Package)
+		}
+		versions[u.Package] = u.To
+	}
+	pinned := make([]string, 0, len(world)+len(installed))
+	for _, entry := range world {
+		if version, ok := versions[entry]; ok {
+			// the unconstrained entry is replaced by its pin
+			pinned = append(pinned, entry+"="+version)
+			delete(versions, entry)
+			continue
+		}
+		pinned = append(pinned, entry)
+	}
+	for _, name := range names {
+		if version, ok := versions[name]; ok {
+			pinned = append(pinned, name+"="+version)
+		}
+	}
+	if err := a.SetWorld(pinned); err != nil {
+		return err
+	}
+	if err := a.UpgradeWorld(ctx, sourceDateEpoch); err != nil {
+		return fmt.Errorf("applying security upgrades: %w", err)
+	}
+	return nil
+}
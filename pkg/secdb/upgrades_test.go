@@ -0,0 +1,47 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuggestUpgrades(t *testing.T) {
+	vulns := []Vulnerability{
+		{Package: "busybox", Version: "1.36.0-r0", ID: "CVE-2022-48174", FixedVersion: "1.36.1-r1"},
+		{Package: "curl", Version: "8.0.0-r0", ID: "CVE-2023-27533", FixedVersion: "8.0.1-r0"},
+		{Package: "curl", Version: "8.0.0-r0", ID: "CVE-2023-28319", FixedVersion: "8.1.0-r0"},
+		{Package: "libcrypto3", Version: "3.1.0-r2", ID: "CVE-2023-1255", FixedVersion: "3.1.0-r4"},
+		{Package: "zlib", Version: "1.2.13-r0", ID: "CVE-2023-45853", FixedVersion: "1.3-r0"},
+	}
+	available := map[string][]string{
+		// the earliest that fixes it, not the latest
+		"busybox": {"1.36.1-r3", "1.36.1-r2", "1.36.1-r1", "1.36.0-r0"},
+		// the latest only fixes one
+		"curl": {"8.0.2-r0", "8.0.1-r0", "8.0.0-r0"},
+		// nothing newer
+		"libcrypto3": {"3.1.0-r2"},
+		"zlib":       {"1.2.13-r1", "1.2.13-r0"},
+	}
+	upgrades, err := suggestUpgrades(vulns, func(name string) ([]string, error) { return available[name], nil })
+	require.NoError(t, err)
+	require.Equal(t, []Upgrade{
+		{Package: "busybox", From: "1.36.0-r0", To: "1.36.1-r1", Fixes: []string{"CVE-2022-48174"}},
+		{Package: "curl", From: "8.0.0-r0", To: "8.0.1-r0", Fixes: []string{"CVE-2023-27533"}, Unfixed: []string{"CVE-2023-28319"}},
+	}, upgrades)
+	require.Equal(t, "curl 8.0.0-r0 -> 8.0.1-r0: fixes CVE-2023-27533, not CVE-2023-28319", upgrades[1].String())
+}
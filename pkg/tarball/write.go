@@ -22,57 +22,15 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
-	"os"
-	"syscall"
+	"strings"
 
 	"go.opentelemetry.io/otel"
 	gzip "golang.org/x/build/pargzip"
-	"golang.org/x/sys/unix"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 	"github.com/chainguard-dev/go-apk/pkg/passwd"
 )
 
-const xattrTarPAXRecordsPrefix = "SCHILY.xattr."
-
-func hasHardlinks(fi fs.FileInfo) bool {
-	if stat := fi.Sys(); stat != nil {
-		si, ok := stat.(*syscall.Stat_t)
-		if !ok {
-			return false
-		}
-
-		// if we don't have inodes, we just assume the filesystem
-		// does not support hardlinks
-		if si == nil {
-			return false
-		}
-
-		return si.Nlink > 1
-	}
-
-	return false
-}
-
-func getInodeFromFileInfo(fi fs.FileInfo) (uint64, error) {
-	if stat := fi.Sys(); stat != nil {
-		si, ok := stat.(*syscall.Stat_t)
-		if !ok {
-			return 0, fmt.Errorf("unable to stat underlying file")
-		}
-
-		// if we don't have inodes, we just assume the filesystem
-		// does not support hardlinks
-		if si == nil {
-			return 0, fmt.Errorf("unable to stat underlying file")
-		}
-
-		return si.Ino, nil
-	}
-
-	return 0, fmt.Errorf("unable to stat underlying file")
-}
-
 func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, users, groups map[int]string) error { //nolint:gocyclo
 	if users == nil {
 		users = map[int]string{}
@@ -80,7 +38,9 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 	if groups == nil {
 		groups = map[int]string{}
 	}
-	seenFiles := map[uint64]string{}
+	// the first path of each file with hardlinks, by apkfs.HardlinkID, for the others to link to.
+	// The walk is in lexical order, so the same tree always links to the same paths.
+	seenFiles := map[any]string{}
 	// set this once, to make it easy to look up later
 	if c.overridePerms == nil {
 		c.overridePerms = map[string]tar.Header{}
@@ -106,47 +66,11 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 			return err
 		}
 
-		var (
-			link         string
-			major, minor uint32
-			isCharDevice bool
-		)
-		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
-			rlfs, ok := fsys.(apkfs.ReadLinkFS)
-			if !ok {
-				return fmt.Errorf("readlink not supported by this fs: path (%s)", path)
-			}
-
-			if link, err = rlfs.Readlink(path); err != nil {
-				return err
-			}
-		}
-
-		if info.Mode()&os.ModeCharDevice == os.ModeCharDevice {
-			rlfs, ok := fsys.(apkfs.ReadnodFS)
-			if !ok {
-				return fmt.Errorf("read character device not supported by this fs: path (%s) %#v %#v", path, info, fsys)
-			}
-			isCharDevice = true
-			dev, err := rlfs.Readnod(path)
-			if err != nil {
-				return err
-			}
-			major = unix.Major(uint64(dev))
-			minor = unix.Minor(uint64(dev))
-		}
-
-		header, err := tar.FileInfoHeader(info, link)
+		header, err := apkfs.ReadHeader(fsys, path, info)
 		if err != nil {
 			return err
 		}
-		// devices
-		if isCharDevice {
-			header.Devmajor = int64(major)
-			header.Devminor = int64(minor)
-		}
-		// work around some weirdness, without this we wind up with just the basename
-		header.Name = path
+		link := header.Linkname
 
 		// zero out timestamps for reproducibility
 		header.AccessTime = c.SourceDateEpoch
@@ -189,21 +113,19 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 			header.Gname = h.Gname
 		}
 
-		if link != "" {
-			header.Typeflag = tar.TypeSymlink
-		}
-		if !info.IsDir() && hasHardlinks(info) {
-			inode, err := getInodeFromFileInfo(info)
-			if err != nil {
-				return err
-			}
-
-			if oldpath, ok := seenFiles[inode]; ok {
+		if id, ok := apkfs.HardlinkID(info); ok && !info.IsDir() {
+			if oldpath, ok := seenFiles[id]; ok {
 				header.Typeflag = tar.TypeLink
 				header.Linkname = oldpath
 				header.Size = 0
+				// the xattrs are those of the file linked to
+				for k := range header.PAXRecords {
+					if strings.HasPrefix(k, apkfs.XattrPAXRecordsPrefix) {
+						delete(header.PAXRecords, k)
+					}
+				}
 			} else {
-				seenFiles[inode] = header.Name
+				seenFiles[id] = header.Name
 			}
 		}
 
@@ -232,20 +154,6 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 			}
 		}
 
-		// only capture xattrs for real objects in the FS
-		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeDir {
-			xfs, ok := fsys.(apkfs.XattrFS)
-			if ok {
-				xattrs, err := xfs.ListXattrs(path)
-				// we can ignore errors
-				if err == nil && xattrs != nil {
-					for name, value := range xattrs {
-						header.PAXRecords[xattrTarPAXRecordsPrefix+name] = string(value)
-					}
-				}
-			}
-		}
-
 		if err := tw.WriteHeader(header); err != nil {
 			return err
 		}
@@ -4,6 +4,8 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"errors"
+	"io"
 	"testing"
 
 	"github.com/chainguard-dev/go-apk/pkg/fs"
@@ -39,10 +41,55 @@ func TestWriteTar(t *testing.T) {
 	hdr, err := tr.Next()
 	require.NoError(t, err, "error reading dir tar header")
 	require.Equal(t, dir, hdr.Name, "tar dir header name mismatch")
-	require.Equal(t, "foo", hdr.PAXRecords[xattrTarPAXRecordsPrefix+"user.dir"], "tar header for dir xattr mismatch")
+	require.Equal(t, "foo", hdr.PAXRecords[fs.XattrPAXRecordsPrefix+"user.dir"], "tar header for dir xattr mismatch")
 
 	hdr, err = tr.Next()
 	require.NoError(t, err, "error reading file tar header")
 	require.Equal(t, file, hdr.Name, "tar file header name mismatch")
-	require.Equal(t, "bar", hdr.PAXRecords[xattrTarPAXRecordsPrefix+"user.file"], "tar header for file xattr mismatch")
+	require.Equal(t, "bar", hdr.PAXRecords[fs.XattrPAXRecordsPrefix+"user.file"], "tar header for file xattr mismatch")
+}
+
+func TestWriteTarHardlinks(t *testing.T) {
+	m := fs.NewMemFS()
+	for _, dir := range []string{"a", "b", "c"} {
+		require.NoError(t, m.MkdirAll(dir, 0o755))
+	}
+	require.NoError(t, m.WriteFile("b/file", []byte("hello world"), 0o644))
+	require.NoError(t, m.Link("b/file", "c/link"))
+	require.NoError(t, m.Link("b/file", "a/link"))
+	require.NoError(t, m.WriteFile("c/copy", []byte("hello world"), 0o644))
+
+	write := func() []byte {
+		var buf bytes.Buffer
+		ctx := Context{}
+		require.NoError(t, ctx.WriteTar(context.TODO(), &buf, m))
+		return buf.Bytes()
+	}
+	archive := write()
+	for i := 0; i < 5; i++ {
+		require.Equal(t, archive, write(), "archives should be identical")
+	}
+
+	// the first path of the group in the walk holds the content, and the others link to it
+	type entry struct {
+		typeflag byte
+		linkname string
+		content  string
+	}
+	entries := map[string]entry{}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		entries[hdr.Name] = entry{hdr.Typeflag, hdr.Linkname, string(b)}
+	}
+	require.Equal(t, entry{tar.TypeReg, "", "hello world"}, entries["a/link"])
+	require.Equal(t, entry{tar.TypeLink, "a/link", ""}, entries["b/file"])
+	require.Equal(t, entry{tar.TypeLink, "a/link", ""}, entries["c/link"])
+	require.Equal(t, entry{tar.TypeReg, "", "hello world"}, entries["c/copy"])
 }
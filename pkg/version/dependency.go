@@ -0,0 +1,124 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// pinRegex is what a repository pin may be, as in /etc/apk/repositories.
+var pinRegex = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// Dependency is a parsed dependency, provided name or world entry, such as foo, !foo, foo@edge>=1.2,
+// so:libssl.so.3=3 or cmd:sh.
+type Dependency struct {
+	// Conflict is set for a dependency written with a leading !, on the name not being installed, or
+	// not in a version that satisfies the constraint.
+	Conflict bool
+	// Name is the name depended on, with any prefix such as so: or cmd:.
+	Name string
+	// Pin is the tag of the repositories the name is allowed from, such as edge for foo@edge.
+	Pin string
+	// Op and Version are the version constraint, if any; Op is Any for none.
+	Op      Operator
+	Version string
+}
+
+// ParseDependency parses a dependency, provided name or world entry. The pin may be written before
+// the version constraint, as apk-tools writes it, such as foo@edge>=1.2, or after it, as in
+// foo>=1.2@edge; it is formatted before.
+func ParseDependency(s string) (Dependency, error) {
+	var d Dependency
+	rest := s
+	if strings.HasPrefix(rest, "!") {
+		d.Conflict = true
+		rest = rest[1:]
+	}
+	end := strings.IndexAny(rest, "<>=~@")
+	if end < 0 {
+		end = len(rest)
+	}
+	d.Name, rest = rest[:end], rest[end:]
+	if d.Name == "" {
+		return Dependency{}, fmt.Errorf("invalid dependency %s, no name", s)
+	}
+
+	// the pin, before or after the constraint
+	pinned := false
+	if strings.HasPrefix(rest, "@") {
+		end := strings.IndexAny(rest, "<>=~")
+		if end < 0 {
+			end = len(rest)
+		}
+		pinned, d.Pin, rest = true, rest[1:end], rest[end:]
+	}
+	if at := strings.Index(rest, "@"); at >= 0 {
+		if pinned {
+			return Dependency{}, fmt.Errorf("invalid dependency %s, pinned twice", s)
+		}
+		pinned, d.Pin, rest = true, rest[at+1:], rest[:at]
+	}
+	if pinned && !pinRegex.MatchString(d.Pin) {
+		return Dependency{}, fmt.Errorf("invalid dependency %s, invalid pin %q", s, d.Pin)
+	}
+
+	if rest != "" {
+		op, version, err := splitConstraint(rest)
+		if err != nil {
+			return Dependency{}, fmt.Errorf("invalid dependency %s: %w", s, err)
+		}
+		d.Op, d.Version = op, version
+	}
+	return d, nil
+}
+
+// Kind returns the kind of name depended on, by the prefix of the name, such as so for so:libc.so.6
+// or cmd for cmd:sh, or "" for the name of a package.
+func (d Dependency) Kind() string {
+	if kind, _, ok := strings.Cut(d.Name, ":"); ok {
+		return kind
+	}
+	return ""
+}
+
+// Constraint returns the version constraint, such as >=1.2, or "" if there is none.
+func (d Dependency) Constraint() string {
+	if d.Op == Any {
+		return ""
+	}
+	return string(d.Op) + d.Version
+}
+
+// Matches reports whether the version satisfies the version constraint of the dependency, whether or
+// not it is a conflict. Every version satisfies a dependency without a constraint.
+func (d Dependency) Matches(version string) (bool, error) {
+	return d.Op.Matches(version, d.Version)
+}
+
+// String formats the dependency as apk-tools writes it, such as !foo@edge>=1.2.
+func (d Dependency) String() string {
+	var b strings.Builder
+	if d.Conflict {
+		b.WriteString("!")
+	}
+	b.WriteString(d.Name)
+	if d.Pin != "" {
+		b.WriteString("@" + d.Pin)
+	}
+	b.WriteString(d.Constraint())
+	return b.String()
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDependency(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Dependency
+		// formatted is how it is formatted, if not as it was written
+		formatted string
+	}{
+		{input: "busybox", want: Dependency{Name: "busybox"}},
+		{input: "!busybox", want: Dependency{Conflict: true, Name: "busybox"}},
+		{input: "foo<2", want: Dependency{Name: "foo", Op: Less, Version: "2"}},
+		{input: "!foo>=1.2.3-r4", want: Dependency{Conflict: true, Name: "foo", Op: GreaterEqual, Version: "1.2.3-r4"}},
+		{input: "so:libssl.so.3=3", want: Dependency{Name: "so:libssl.so.3", Op: Equal, Version: "3"}},
+		{input: "cmd:sh", want: Dependency{Name: "cmd:sh"}},
+		{input: "pc:zlib>1.2", want: Dependency{Name: "pc:zlib", Op: Greater, Version: "1.2"}},
+		{input: "foo@edge", want: Dependency{Name: "foo", Pin: "edge"}},
+		{input: "foo@edge<=1.2", want: Dependency{Name: "foo", Pin: "edge", Op: LessEqual, Version: "1.2"}},
+		{input: "foo<=1.2@edge", want: Dependency{Name: "foo", Pin: "edge", Op: LessEqual, Version: "1.2"}, formatted: "foo@edge<=1.2"},
+		{input: "foo~1.2", want: Dependency{Name: "foo", Op: Fuzzy, Version: "1.2"}},
+		{input: "foo=~1.2", want: Dependency{Name: "foo", Op: Fuzzy, Version: "1.2"}, formatted: "foo~1.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			d, err := ParseDependency(tt.input)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, d)
+			formatted := tt.formatted
+			if formatted == "" {
+				formatted = tt.input
+			}
+			require.Equal(t, formatted, d.String())
+			// and it parses back the same
+			again, err := ParseDependency(d.String())
+			require.NoError(t, err)
+			require.Equal(t, d, again)
+		})
+	}
+
+	for _, input := range []string{"", "!", ">=1.2", "foo>=", "foo=>1.2", "foo=a.b", "foo@", "foo@edge=1.2@main", "foo@ed-ge"} {
+		_, err := ParseDependency(input)
+		require.Error(t, err, input)
+	}
+}
+
+func TestDependency(t *testing.T) {
+	d, err := ParseDependency("so:libssl.so.3>=3")
+	require.NoError(t, err)
+	require.Equal(t, "so", d.Kind())
+	require.Equal(t, ">=3", d.Constraint())
+	ok, err := d.Matches("3.1.2-r0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = d.Matches("1.1")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	d, err = ParseDependency("!busybox")
+	require.NoError(t, err)
+	require.Equal(t, "", d.Kind())
+	require.Equal(t, "", d.Constraint())
+	ok, err = d.Matches("anything")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
@@ -0,0 +1,409 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package version parses and compares the versions of Alpine packages as apk-tools does, such as
+// 1.2.3a_rc1_p2-r4: dotted numbers, an optional letter, an optional pre-release suffix (_alpha, _beta,
+// _pre or _rc) and post-release suffix (_cvs, _svn, _git, _hg or _p), each with an optional number,
+// and an optional revision.
+// See https://github.com/alpinelinux/apk-tools/blob/50ab589e9a5a84592ee4c0ac5a49506bb6c552fc/src/version.c
+package version
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var versionRegex = regexp.MustCompile(`^([0-9]+)((\.[0-9]+)*)([a-z]?)((_alpha|_beta|_pre|_rc)([0-9]*))?((_cvs|_svn|_git|_hg|_p)([0-9]*))?((-r)([0-9]+))?$`)
+
+func init() {
+	versionRegex.Longest()
+}
+
+type preModifier int
+type postModifier int
+
+// the order of these matters!
+const (
+	preModifierNone  preModifier = 0
+	preModifierAlpha preModifier = 1
+	preModifierBeta  preModifier = 2
+	preModifierPre   preModifier = 3
+	preModifierRC    preModifier = 4
+	preModifierMax   preModifier = 1000
+)
+const (
+	postModifierNone postModifier = 0
+	postModifierCVS  postModifier = 1
+	postModifierSVN  postModifier = 2
+	postModifierGit  postModifier = 3
+	postModifierHG   postModifier = 4
+	postModifierP    postModifier = 5
+)
+
+// Version is a parsed version of a package.
+type Version struct {
+	numbers          []int
+	letter           rune
+	preSuffix        preModifier
+	preSuffixNumber  int
+	postSuffix       postModifier
+	postSuffixNumber int
+	revision         int
+}
+
+// Parse parses the version of a package.
+func Parse(version string) (Version, error) {
+	parts := versionRegex.FindAllStringSubmatch(version, -1)
+	if len(parts) == 0 {
+		return Version{}, fmt.Errorf("invalid version %s, could not parse", version)
+	}
+	actuals := parts[0]
+	numbers := make([]int, 0, 10)
+	if len(actuals) != 14 {
+		return Version{}, fmt.Errorf("invalid version %s, could not find enough components", version)
+	}
+
+	// get the first version number
+	num, err := strconv.Atoi(actuals[1])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid version %s, first part is not number: %w", version, err)
+	}
+	numbers = append(numbers, num)
+
+	// get any other version numbers
+	if actuals[2] != "" {
+		subparts := strings.Split(actuals[2], ".")
+		for i, s := range subparts {
+			if s == "" {
+				continue
+			}
+			num, err := strconv.Atoi(s)
+			if err != nil {
+				return Version{}, fmt.Errorf("invalid version %s, part %d is not number: %w", version, i, err)
+			}
+			numbers = append(numbers, num)
+		}
+	}
+	var letter rune
+	if len(actuals[4]) > 0 {
+		letter = rune(actuals[4][0])
+	}
+	var preSuffix preModifier
+	switch actuals[6] {
+	case "_alpha":
+		preSuffix = preModifierAlpha
+	case "_beta":
+		preSuffix = preModifierBeta
+	case "_pre":
+		preSuffix = preModifierPre
+	case "_rc":
+		preSuffix = preModifierRC
+	case "":
+		preSuffix = preModifierNone
+	default:
+		return Version{}, fmt.Errorf("invalid version %s, pre-suffix %s is not valid", version, actuals[6])
+	}
+	var preSuffixNumber int
+	if actuals[7] != "" {
+		num, err := strconv.Atoi(actuals[7])
+		if err != nil {
+			return Version{}, fmt.Errorf("invalid version %s, suffix %s number %s is not number: %w", version, actuals[6], actuals[7], err)
+		}
+		preSuffixNumber = num
+	}
+
+	var postSuffix postModifier
+	switch actuals[9] {
+	case "_cvs":
+		postSuffix = postModifierCVS
+	case "_svn":
+		postSuffix = postModifierSVN
+	case "_git":
+		postSuffix = postModifierGit
+	case "_hg":
+		postSuffix = postModifierHG
+	case "_p":
+		postSuffix = postModifierP
+	case "":
+		postSuffix = postModifierNone
+	default:
+		return Version{}, fmt.Errorf("invalid version %s, suffix %s is not valid", version, actuals[9])
+	}
+	var postSuffixNumber int
+	if actuals[10] != "" {
+		num, err := strconv.Atoi(actuals[10])
+		if err != nil {
+			return Version{}, fmt.Errorf("invalid version %s, post-suffix %s number %s is not number: %w", version, actuals[9], actuals[10], err)
+		}
+		postSuffixNumber = num
+	}
+
+	var revision int
+	if actuals[13] != "" {
+		num, err := strconv.Atoi(actuals[13])
+		if err != nil {
+			return Version{}, fmt.Errorf("invalid version %s, revision %s is not number: %w", version, actuals[13], err)
+		}
+		revision = num
+	}
+	return Version{
+		numbers:          numbers,
+		letter:           letter,
+		preSuffix:        preSuffix,
+		preSuffixNumber:  preSuffixNumber,
+		postSuffix:       postSuffix,
+		postSuffixNumber: postSuffixNumber,
+		revision:         revision,
+	}, nil
+}
+
+// Valid reports whether the version parses.
+func Valid(version string) bool {
+	_, err := Parse(version)
+	return err == nil
+}
+
+// Compare returns -1, 0 or +1 if v is older than, the same as, or newer than other, based on
+// https://dev.gentoo.org/~ulm/pms/head/pms.html#x1-250003.2
+func (v Version) Compare(other Version) int {
+	for i := 0; i < len(v.numbers) && i < len(other.numbers); i++ {
+		if c := compareInts(v.numbers[i], other.numbers[i]); c != 0 {
+			return c
+		}
+	}
+	// if we made it here, the parts that were the same size are equal
+	if c := compareInts(len(v.numbers), len(other.numbers)); c != 0 {
+		return c
+	}
+	// same length of numbers, same numbers
+	// compare letters
+	if c := compareInts(int(v.letter), int(other.letter)); c != 0 {
+		return c
+	}
+	// same letters
+	// compare pre-suffixes
+	// because None is 0 but the lowest priority to make it easy to have a sane default,
+	// but lowest priority, we need some extra logic to handle
+	vPreSuffix, otherPreSuffix := v.preSuffix, other.preSuffix
+	if vPreSuffix == preModifierNone {
+		vPreSuffix = preModifierMax
+	}
+	if otherPreSuffix == preModifierNone {
+		otherPreSuffix = preModifierMax
+	}
+	if c := compareInts(int(vPreSuffix), int(otherPreSuffix)); c != 0 {
+		return c
+	}
+	// same pre-suffixes, compare pre-suffix numbers
+	if c := compareInts(v.preSuffixNumber, other.preSuffixNumber); c != 0 {
+		return c
+	}
+	// same pre-suffix numbers
+	// compare post-suffixes; unlike the pre-suffixes, any of them is newer than none, as with
+	// 1.2_p1 after 1.2
+	if c := compareInts(int(v.postSuffix), int(other.postSuffix)); c != 0 {
+		return c
+	}
+	// same post-suffixes, compare post-suffix numbers
+	if c := compareInts(v.postSuffixNumber, other.postSuffixNumber); c != 0 {
+		return c
+	}
+	// same post-suffix numbers
+	// compare revisions
+	return compareInts(v.revision, other.revision)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a > b:
+		return 1
+	case a < b:
+		return -1
+	}
+	return 0
+}
+
+// HasPrefix reports whether v is within the prefix, as the fuzzy constraint ~ matches: 1.2.3-r1 is
+// within 1.2 and 1.2.3, but not 1.2.3-r2 or 1.3.
+func (v Version) HasPrefix(prefix Version) bool {
+	// if more required numbers than actual numbers, than require is more specific,
+	// so no match
+	if len(v.numbers) < len(prefix.numbers) {
+		return false
+	}
+	for i := 0; i < len(prefix.numbers); i++ {
+		if v.numbers[i] != prefix.numbers[i] {
+			return false
+		}
+	}
+	// if length is the same, check the rest of it; if actual is longer, it's ok
+	if len(v.numbers) > len(prefix.numbers) {
+		return true
+	}
+	// was there a required letter?
+	if prefix.letter != 0 && v.letter != prefix.letter {
+		return false
+	}
+
+	// was there pre-suffix
+	if prefix.preSuffix != preModifierNone && v.preSuffix != prefix.preSuffix {
+		return false
+	}
+
+	// was there pre-suffix number
+	if prefix.preSuffixNumber != 0 && v.preSuffixNumber != prefix.preSuffixNumber {
+		return false
+	}
+
+	// was there post-suffix
+	if prefix.postSuffix != postModifierNone && v.postSuffix != prefix.postSuffix {
+		return false
+	}
+	if prefix.postSuffixNumber != 0 && v.postSuffixNumber != prefix.postSuffixNumber {
+		return false
+	}
+
+	// compare revisions
+	if prefix.revision != 0 && v.revision != prefix.revision {
+		return false
+	}
+	return true
+}
+
+// Compare compares two versions of packages as apk does, returning -1, 0 or +1 if a is older
+// than, the same as, or newer than b.
+func Compare(a, b string) (int, error) {
+	va, err := Parse(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := Parse(b)
+	if err != nil {
+		return 0, err
+	}
+	return va.Compare(vb), nil
+}
+
+// Satisfies reports whether the version satisfies the constraint, as of a dependency such as
+// foo>=1.2: an operator, one of =, <, >, <=, >=, or ~ (also written =~ or ~=) for the versions within
+// a prefix, followed by a version. Every version satisfies the empty constraint.
+func Satisfies(version, constraint string) (bool, error) {
+	if constraint == "" {
+		return true, nil
+	}
+	op, required, err := splitConstraint(constraint)
+	if err != nil {
+		return false, err
+	}
+	return op.Matches(version, required)
+}
+
+// Operator is the operator of a version constraint.
+type Operator string
+
+const (
+	// Any is no constraint, that every version satisfies.
+	Any          Operator = ""
+	Equal        Operator = "="
+	Less         Operator = "<"
+	Greater      Operator = ">"
+	LessEqual    Operator = "<="
+	GreaterEqual Operator = ">="
+	// Fuzzy is ~, for the versions within a prefix, as HasPrefix.
+	Fuzzy Operator = "~"
+)
+
+// parseOperator returns the operator as written, with =~ and ~= read as ~, as apk-tools does.
+func parseOperator(op string) (Operator, error) {
+	switch Operator(op) {
+	case Equal, Less, Greater, LessEqual, GreaterEqual, Fuzzy:
+		return Operator(op), nil
+	case "=~", "~=":
+		return Fuzzy, nil
+	}
+	return "", fmt.Errorf("unknown operator %s", op)
+}
+
+// splitConstraint returns the operator and the version of a constraint such as >=1.2, checking that
+// the version parses.
+func splitConstraint(constraint string) (Operator, string, error) {
+	rest := strings.TrimLeft(constraint, "=<>~")
+	if len(rest) == len(constraint) {
+		return "", "", fmt.Errorf("invalid constraint %s, no operator", constraint)
+	}
+	op, err := parseOperator(constraint[:len(constraint)-len(rest)])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid constraint %s: %w", constraint, err)
+	}
+	if _, err := Parse(rest); err != nil {
+		return "", "", fmt.Errorf("invalid constraint %s: %w", constraint, err)
+	}
+	return op, rest, nil
+}
+
+// Matches reports whether the version is in the relation of the operator to the required version,
+// such as 1.3 to 1.2 for >=. Any version matches Any.
+func (op Operator) Matches(version, required string) (bool, error) {
+	if op == Any {
+		return true, nil
+	}
+	actual, err := Parse(version)
+	if err != nil {
+		return false, err
+	}
+	req, err := Parse(required)
+	if err != nil {
+		return false, err
+	}
+	c := actual.Compare(req)
+	switch op {
+	case Equal:
+		return c == 0, nil
+	case Less:
+		return c < 0, nil
+	case Greater:
+		return c > 0, nil
+	case LessEqual:
+		return c <= 0, nil
+	case GreaterEqual:
+		return c >= 0, nil
+	case Fuzzy:
+		return actual.HasPrefix(req), nil
+	}
+	return false, fmt.Errorf("unknown operator %s", op)
+}
+
+// Sort sorts the versions from oldest to newest. Versions that do not parse sort before all others,
+// by their text.
+func Sort(versions []string) {
+	parsed := make(map[string]*Version, len(versions))
+	for _, v := range versions {
+		if pv, err := Parse(v); err == nil {
+			parsed[v] = &pv
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		vi, vj := parsed[versions[i]], parsed[versions[j]]
+		switch {
+		case vi == nil && vj == nil:
+			return versions[i] < versions[j]
+		case vi == nil || vj == nil:
+			return vi == nil
+		}
+		return vi.Compare(*vj) < 0
+	})
+}
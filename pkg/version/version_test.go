@@ -0,0 +1,179 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVersion(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		tests := []struct {
+			version  string
+			expected Version
+		}{
+			// various legitimate ones
+			{"1", Version{numbers: []int{1}, preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 0}},
+			{"1.1", Version{numbers: []int{1, 1}, preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 0}},
+			{"1.1.1", Version{numbers: []int{1, 1, 1}, preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 0}},
+			{"1a", Version{numbers: []int{1}, letter: 'a', preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 0}},
+			{"1.1a", Version{numbers: []int{1, 1}, letter: 'a', preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 0}},
+			{"1.1.1a", Version{numbers: []int{1, 1, 1}, letter: 'a', preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 0}},
+			{"1_alpha", Version{numbers: []int{1}, preSuffix: preModifierAlpha, postSuffix: postModifierNone, revision: 0}},
+			{"1_beta", Version{numbers: []int{1}, preSuffix: preModifierBeta, postSuffix: postModifierNone, revision: 0}},
+			{"1_alpha1", Version{numbers: []int{1}, preSuffix: preModifierAlpha, preSuffixNumber: 1, postSuffix: postModifierNone, revision: 0}},
+			{"1_alpha2", Version{numbers: []int{1}, preSuffix: preModifierAlpha, preSuffixNumber: 2, postSuffix: postModifierNone, revision: 0}},
+			{"1.1_alpha", Version{numbers: []int{1, 1}, preSuffix: preModifierAlpha, postSuffix: postModifierNone, revision: 0}},
+			{"1.1.1_alpha", Version{numbers: []int{1, 1, 1}, preSuffix: preModifierAlpha, postSuffix: postModifierNone, revision: 0}},
+			{"1.1_alpha1", Version{numbers: []int{1, 1}, preSuffix: preModifierAlpha, preSuffixNumber: 1, postSuffix: postModifierNone, revision: 0}},
+			{"1a_alpha1", Version{numbers: []int{1}, letter: 'a', preSuffix: preModifierAlpha, preSuffixNumber: 1, postSuffix: postModifierNone, revision: 0}},
+			{"1a_alpha2", Version{numbers: []int{1}, letter: 'a', preSuffix: preModifierAlpha, preSuffixNumber: 2, postSuffix: postModifierNone, revision: 0}},
+			{"1.1b_alpha", Version{numbers: []int{1, 1}, letter: 'b', preSuffix: preModifierAlpha, postSuffix: postModifierNone, revision: 0}},
+			{"1.1.1c_alpha", Version{numbers: []int{1, 1, 1}, letter: 'c', preSuffix: preModifierAlpha, postSuffix: postModifierNone, revision: 0}},
+			{"1.1r_alpha1", Version{numbers: []int{1, 1}, preSuffix: preModifierAlpha, preSuffixNumber: 1, letter: 'r', postSuffix: postModifierNone, revision: 0}},
+			{"1.1.1s_alpha2", Version{numbers: []int{1, 1, 1}, preSuffix: preModifierAlpha, preSuffixNumber: 2, letter: 's', postSuffix: postModifierNone, revision: 0}},
+			{"1-r2", Version{numbers: []int{1}, preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 2}},
+			{"1.1-r2", Version{numbers: []int{1, 1}, preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 2}},
+			{"1.1.1-r2", Version{numbers: []int{1, 1, 1}, preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 2}},
+			{"1a-r2", Version{numbers: []int{1}, letter: 'a', preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 2}},
+			{"1.1a-r2", Version{numbers: []int{1, 1}, letter: 'a', preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 2}},
+			{"1.1.1a-r2", Version{numbers: []int{1, 1, 1}, letter: 'a', preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 2}},
+			{"1_alpha-r2", Version{numbers: []int{1}, preSuffix: preModifierAlpha, postSuffix: postModifierNone, revision: 2}},
+			{"1_beta-r2", Version{numbers: []int{1}, preSuffix: preModifierBeta, postSuffix: postModifierNone, revision: 2}},
+			{"1_alpha1-r2", Version{numbers: []int{1}, preSuffix: preModifierAlpha, preSuffixNumber: 1, postSuffix: postModifierNone, revision: 2}},
+			{"1_alpha2-r2", Version{numbers: []int{1}, preSuffix: preModifierAlpha, preSuffixNumber: 2, postSuffix: postModifierNone, revision: 2}},
+			{"1.1_alpha-r2", Version{numbers: []int{1, 1}, preSuffix: preModifierAlpha, postSuffix: postModifierNone, revision: 2}},
+			{"1.1.1_alpha-r2", Version{numbers: []int{1, 1, 1}, preSuffix: preModifierAlpha, postSuffix: postModifierNone, revision: 2}},
+			{"1.1_alpha1-r2", Version{numbers: []int{1, 1}, preSuffix: preModifierAlpha, preSuffixNumber: 1, postSuffix: postModifierNone, revision: 2}},
+			{"1.1.1_alpha2-r2", Version{numbers: []int{1, 1, 1}, preSuffix: preModifierAlpha, preSuffixNumber: 2, postSuffix: postModifierNone, revision: 2}},
+			{"1a_alpha1-r2", Version{numbers: []int{1}, letter: 'a', preSuffix: preModifierAlpha, preSuffixNumber: 1, postSuffix: postModifierNone, revision: 2}},
+			{"1a_alpha2-r2", Version{numbers: []int{1}, letter: 'a', preSuffix: preModifierAlpha, preSuffixNumber: 2, postSuffix: postModifierNone, revision: 2}},
+			{"1.1b_alpha-r2", Version{numbers: []int{1, 1}, letter: 'b', preSuffix: preModifierAlpha, postSuffix: postModifierNone, revision: 2}},
+			{"1.1.1c_alpha-r2", Version{numbers: []int{1, 1, 1}, letter: 'c', preSuffix: preModifierAlpha, postSuffix: postModifierNone, revision: 2}},
+			{"1.1r_alpha1-r2", Version{numbers: []int{1, 1}, preSuffix: preModifierAlpha, preSuffixNumber: 1, letter: 'r', postSuffix: postModifierNone, revision: 2}},
+			{"1.1.1s_alpha2-r2", Version{numbers: []int{1, 1, 1}, preSuffix: preModifierAlpha, preSuffixNumber: 2, letter: 's', postSuffix: postModifierNone, revision: 2}},
+			{"1.1.1-r2", Version{numbers: []int{1, 1, 1}, preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 2}},
+			{"1.1.1-r29", Version{numbers: []int{1, 1, 1}, preSuffix: preModifierNone, postSuffix: postModifierNone, revision: 29}},
+			// the other pre-release suffixes, and those after a release
+			{"1_pre", Version{numbers: []int{1}, preSuffix: preModifierPre, postSuffix: postModifierNone, revision: 0}},
+			{"1_rc3", Version{numbers: []int{1}, preSuffix: preModifierRC, preSuffixNumber: 3, postSuffix: postModifierNone, revision: 0}},
+			{"1_p", Version{numbers: []int{1}, preSuffix: preModifierNone, postSuffix: postModifierP, revision: 0}},
+			{"1.1_p2-r1", Version{numbers: []int{1, 1}, preSuffix: preModifierNone, postSuffix: postModifierP, postSuffixNumber: 2, revision: 1}},
+			{"1_cvs", Version{numbers: []int{1}, preSuffix: preModifierNone, postSuffix: postModifierCVS, revision: 0}},
+			{"1_svn3", Version{numbers: []int{1}, preSuffix: preModifierNone, postSuffix: postModifierSVN, postSuffixNumber: 3, revision: 0}},
+			{"1_git20231001", Version{numbers: []int{1}, preSuffix: preModifierNone, postSuffix: postModifierGit, postSuffixNumber: 20231001, revision: 0}},
+			{"1_hg-r2", Version{numbers: []int{1}, preSuffix: preModifierNone, postSuffix: postModifierHG, revision: 2}},
+			{"1.2a_rc1_p2-r3", Version{numbers: []int{1, 2}, letter: 'a', preSuffix: preModifierRC, preSuffixNumber: 1, postSuffix: postModifierP, postSuffixNumber: 2, revision: 3}},
+		}
+		for _, tt := range tests {
+			actual, err := Parse(tt.version)
+			require.NoError(t, err, "%q unexpected error", tt.version)
+			require.Equal(t, tt.expected, actual, "%q expected %v, got %v", tt.version, tt.expected, actual)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		tests := []string{
+			// various illegitimate ones
+			"a.1.2",
+			"1.a.2",
+			"1_illegal",
+			"1.1.1-rQ",
+			"",
+			"1..2",
+			"1-r",
+			"1-r2-r3",
+			"1_p_rc1",
+		}
+		for _, version := range tests {
+			_, err := Parse(version)
+			require.Error(t, err, "%q mismatched error", version)
+		}
+	})
+}
+
+// TestCompareCorpus compares the versions of testdata/version.data, in the format of the test data of
+// apk-tools: lines of two versions with the operator between them that is true of their comparison.
+func TestCompareCorpus(t *testing.T) {
+	f, err := os.Open("testdata/version.data")
+	require.NoError(t, err)
+	defer f.Close()
+	want := map[string]int{"<": -1, "=": 0, ">": 1}
+	scanner := bufio.NewScanner(f)
+	var n int
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		require.Len(t, fields, 3, line)
+		c, err := Compare(fields[0], fields[2])
+		require.NoError(t, err, line)
+		require.Equal(t, want[fields[1]], c, line)
+		// and the other way around
+		c, err = Compare(fields[2], fields[0])
+		require.NoError(t, err, line)
+		require.Equal(t, -want[fields[1]], c, line)
+		n++
+	}
+	require.NoError(t, scanner.Err())
+	require.NotZero(t, n)
+}
+
+func TestSatisfies(t *testing.T) {
+	tests := []struct {
+		version    string
+		constraint string
+		want       bool
+	}{
+		{"1.2.3-r0", "", true},
+		{"1.2.3-r0", "=1.2.3-r0", true},
+		{"1.2.3-r0", "=1.2.3", true},
+		{"1.2.3-r1", "=1.2.3", false},
+		{"1.2.3-r1", ">1.2.3", true},
+		{"1.2.3", ">1.2.3", false},
+		{"1.2.3", ">=1.2.3", true},
+		{"1.2.3_rc1", "<1.2.3", true},
+		{"1.2.3_p1", "<=1.2.3", false},
+		{"1.2.3-r1", "~1.2", true},
+		{"1.2.3-r1", "=~1.2.3", true},
+		{"1.2.3-r1", "~=1.2.3-r1", true},
+		{"1.2.3-r1", "~1.2.3-r2", false},
+		{"1.3", "~1.2", false},
+	}
+	for _, tt := range tests {
+		got, err := Satisfies(tt.version, tt.constraint)
+		require.NoError(t, err, "%s %s", tt.version, tt.constraint)
+		require.Equal(t, tt.want, got, "%s %s", tt.version, tt.constraint)
+	}
+
+	for _, constraint := range []string{"1.2.3", "=>1.2", "<>1.2", ">=a.b"} {
+		_, err := Satisfies("1.2.3", constraint)
+		require.Error(t, err, constraint)
+	}
+	_, err := Satisfies("a.b", ">=1.2")
+	require.Error(t, err)
+}
+
+func TestSort(t *testing.T) {
+	versions := []string{"1.10", "1.2_rc1", "not-a-version", "1.2", "1.2-r1", "1.2_p1", "1.2a", "1.2_alpha", "0.9"}
+	Sort(versions)
+	require.Equal(t, []string{"not-a-version", "0.9", "1.2_alpha", "1.2_rc1", "1.2", "1.2-r1", "1.2_p1", "1.2a", "1.10"}, versions)
+}